@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/compression"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/layercache"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// cacheStats describes the contents of the layer cache, for the cache stats command.
+type cacheStats struct {
+	Directory string            `json:"directory"`
+	Blobs     int               `json:"blobs"`
+	Size      int64             `json:"size"`
+	Entries   []layercache.Blob `json:"entries"`
+}
+
+// cacheDir returns the absolute path of the layer cache directory.
+func cacheDir(clx *cli.Context) (string, error) {
+	return filepath.Abs(os.ExpandEnv(clx.GlobalString("cache-dir")))
+}
+
+// cacheOptions returns the options for the layer cache, which set the compression of the layers stored in it.
+func cacheOptions(clx *cli.Context) ([]layercache.Option, error) {
+	switch c := compression.Compression(clx.GlobalString("cache-compression")); c {
+	case "":
+		return nil, nil
+	case compression.None, compression.ZStd:
+		return []layercache.Option{layercache.WithCompression(c)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported cache compression %q; supported values: none, zstd", c)
+	}
+}
+
+// showCacheStats prints the number and total size of the blobs in the layer cache, and when each was last used.
+func showCacheStats(ctx context.Context, clx *cli.Context) error {
+	output := clx.String("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unsupported output format %q; supported formats: text, json", output)
+	}
+
+	dir, err := cacheDir(clx)
+	if err != nil {
+		return err
+	}
+	blobs, err := layercache.List(dir)
+	if err != nil {
+		return err
+	}
+	stats := cacheStats{Directory: dir, Blobs: len(blobs), Entries: blobs}
+	for _, blob := range blobs {
+		stats.Size += blob.Size
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(clx.App.Writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+	fmt.Fprintf(clx.App.Writer, "Directory: %s\nBlobs:     %d\nSize:      %s\n", stats.Directory, stats.Blobs, formatSize(stats.Size))
+	for _, blob := range blobs {
+		if _, err := fmt.Fprintf(clx.App.Writer, "%s %10d %s\n", blob.LastUsed.UTC().Format(time.RFC3339), blob.Size, blob.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneCache removes blobs that have not been used within the --older-than duration, or all blobs, from the layer
+// cache. The cache is not pruned while another wharfie process is using it.
+func pruneCache(ctx context.Context, clx *cli.Context) error {
+	var cutoff time.Time
+	if !clx.Bool("all") {
+		olderThan := clx.Duration("older-than")
+		if olderThan < 0 {
+			return fmt.Errorf("invalid duration %s: must not be negative", olderThan)
+		}
+		cutoff = time.Now().Add(-olderThan)
+	}
+
+	dir, err := cacheDir(clx)
+	if err != nil {
+		return err
+	}
+	lock, err := layercache.TryLockExclusive(dir)
+	if err != nil {
+		if errors.Is(err, layercache.ErrLocked) {
+			return fmt.Errorf("layer cache %s is in use by another wharfie process", dir)
+		}
+		return err
+	}
+	defer lock.Unlock()
+
+	setPhase(ctx, "pruning layer cache %s", dir)
+	removed, err := layercache.Prune(dir, cutoff)
+	var size int64
+	for _, blob := range removed {
+		logrus.WithField("blob", blob.Digest).Debugf("Removed blob last used %s", blob.LastUsed.UTC().Format(time.RFC3339))
+		size += blob.Size
+	}
+	fmt.Fprintf(clx.App.Writer, "Removed %d blobs, freeing %s\n", len(removed), formatSize(size))
+	return err
+}
+
+// verifyCache removes the blobs whose content does not match their digest from the layer cache.
+func verifyCache(ctx context.Context, clx *cli.Context) error {
+	dir, err := cacheDir(clx)
+	if err != nil {
+		return err
+	}
+	lock, err := layercache.TryLockExclusive(dir)
+	if err != nil {
+		if errors.Is(err, layercache.ErrLocked) {
+			return fmt.Errorf("layer cache %s is in use by another wharfie process", dir)
+		}
+		return err
+	}
+	defer lock.Unlock()
+
+	setPhase(ctx, "verifying layer cache %s", dir)
+	checked, removed, err := layercache.Verify(dir)
+	var size int64
+	for _, blob := range removed {
+		logrus.WithField("blob", blob.Digest).Warn("Removed corrupt blob")
+		size += blob.Size
+	}
+	fmt.Fprintf(clx.App.Writer, "Verified %d blobs, removed %d corrupt blobs, freeing %s\n", len(checked), len(removed), formatSize(size))
+	return err
+}
+
+// exportCache writes an image from the layer cache to a tarball, if the output ends with .tar, or else to an OCI
+// image layout directory. With --include-referrers, the referrers of the image are read from the registry, and added
+// to the image layout; those found under a cosign tag are named by that tag.
+func exportCache(ctx context.Context, clx *cli.Context) error {
+	if len(clx.Args()) < 2 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <image> and <output> are required arguments.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "export", 1)
+	}
+
+	options, err := referenceOptions(clx)
+	if err != nil {
+		return err
+	}
+	ref, err := name.ParseReference(clx.Args().Get(0), options...)
+	if err != nil {
+		return err
+	}
+	output := clx.Args().Get(1)
+	includeReferrers := clx.Bool("include-referrers")
+	if includeReferrers && strings.HasSuffix(output, ".tar") {
+		return errors.New("referrers can only be exported to an OCI image layout, not a tarball")
+	}
+	dir, err := cacheDir(clx)
+	if err != nil {
+		return err
+	}
+	// hold a shared lock while the cache is in use, so that it is not pruned by another process
+	lock, err := layercache.LockShared(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	setPhase(ctx, "exporting image %s from layer cache %s", ref.Name(), dir)
+	if err := layercache.Export(dir, ref, output); err != nil {
+		return errors.Wrapf(err, "failed to export image %s", ref.Name())
+	}
+	if includeReferrers {
+		if err := exportReferrers(ctx, clx, dir, ref, output); err != nil {
+			return errors.Wrapf(err, "failed to export referrers of image %s", ref.Name())
+		}
+	}
+	fmt.Fprintf(clx.App.Writer, "Exported %s to %s\n", ref.Name(), output)
+	return nil
+}
+
+// exportReferrers adds the referrers of the image in the layer cache, as read from the registry, to the OCI image
+// layout.
+func exportReferrers(ctx context.Context, clx *cli.Context, dir string, ref name.Reference, output string) error {
+	// the exported image is compressed again, so referrers are listed for the digest that it was pulled with
+	digest, err := layercache.Digest(dir, ref)
+	if err != nil {
+		return err
+	}
+	p, err := layout.FromPath(output)
+	if err != nil {
+		return err
+	}
+
+	source, err := newImageSource(clx, ref)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	referrers, err := getReferrers(ctx, source, ref.Context().Digest(digest.String()))
+	if err != nil {
+		return err
+	}
+	for _, r := range referrers {
+		options := []layout.Option{}
+		if tag, ok := r.reference(ref.Context()).(name.Tag); ok {
+			options = append(options, layout.WithAnnotations(map[string]string{registries.ReferrerTagAnnotation: tag.Name()}))
+		}
+		if r.index != nil {
+			err = p.AppendIndex(r.index, options...)
+		} else {
+			err = p.AppendImage(r.image, options...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Exported %d referrers of %s", len(referrers), ref.Name())
+	return nil
+}
+
+// importCache stores the layers of the images in each local image archive, or directory of archives, in the layer
+// cache.
+func importCache(ctx context.Context, clx *cli.Context) error {
+	if len(clx.Args()) < 1 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <tarball-or-dir> is a required argument.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "import", 1)
+	}
+
+	dir, err := cacheDir(clx)
+	if err != nil {
+		return err
+	}
+	opts, err := cacheOptions(clx)
+	if err != nil {
+		return err
+	}
+	// hold a shared lock while the cache is in use, so that it is not pruned by another process
+	lock, err := layercache.LockShared(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	for _, path := range clx.Args() {
+		setPhase(ctx, "importing layers from %s into layer cache %s", path, dir)
+		result, err := layercache.Import(dir, path, opts...)
+		if result != nil {
+			var size int64
+			for _, blob := range result.Imported {
+				size += blob.Size
+			}
+			fmt.Fprintf(clx.App.Writer, "Imported %d layers (%s) from %d archives in %s; %d layers were already cached\n",
+				len(result.Imported), formatSize(size), result.Archives, path, result.Cached)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
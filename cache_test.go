@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/rancher/wharfie/pkg/layercache"
+	"github.com/rancher/wharfie/pkg/tarfile"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// cachedFile returns the path that the filesystem cache stores content with the given hash at.
+func cachedFile(dir string, h v1.Hash) string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(dir, fmt.Sprintf("%s-%s", h.Algorithm, h.Hex))
+	}
+	return filepath.Join(dir, h.String())
+}
+
+func assertCached(t *testing.T, dir string, img v1.Image) {
+	t.Helper()
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Failed to get layers: %v", err)
+	}
+	for _, layer := range layers {
+		diffID, _ := layer.DiffID()
+		size, _ := layer.Size()
+		fi, err := os.Stat(cachedFile(dir, diffID))
+		if err != nil {
+			t.Errorf("Expected layer %s to be cached: %v", diffID, err)
+		} else if fi.Size() < size {
+			t.Errorf("Expected cached layer %s to be complete, got %d bytes", diffID, fi.Size())
+		}
+	}
+}
+
+func TestCacheCommands(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, err := name.ParseReference(u.Host + "/test/cache:latest")
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	layers, _ := img.Layers()
+	diffIDs := []v1.Hash{}
+	var size int64
+	for _, layer := range layers {
+		diffID, _ := layer.DiffID()
+		diffIDs = append(diffIDs, diffID)
+	}
+
+	dir := t.TempDir()
+	run := func(command func(context.Context, *cli.Context) error, args ...string) (string, error) {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("private-registry", filepath.Join(dir, "registries.yaml"), "")
+		set.String("cache-dir", dir, "")
+		set.String("output", "text", "")
+		set.Duration("older-than", 720*time.Hour, "")
+		set.Bool("all", false, "")
+		if err := set.Parse(args); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		app := cli.NewApp()
+		output := &bytes.Buffer{}
+		app.Writer = output
+		err := command(context.Background(), cli.NewContext(app, set, nil))
+		return output.String(), err
+	}
+	stats := func() cacheStats {
+		output, err := run(showCacheStats, "--output", "json")
+		if err != nil {
+			t.Fatalf("Failed to show cache stats: %v", err)
+		}
+		var stats cacheStats
+		if err := json.Unmarshal([]byte(output), &stats); err != nil {
+			t.Fatalf("Failed to parse cache stats: %v\n%s", err, output)
+		}
+		return stats
+	}
+	setLastUsed := func(diffID v1.Hash, lastUsed time.Time) {
+		if err := os.Chtimes(cachedFile(dir, diffID), lastUsed, lastUsed); err != nil {
+			t.Fatalf("Failed to set last used time: %v", err)
+		}
+	}
+
+	// the cache is populated by pulling the image
+	if _, err := run(pull, ref.Name()); err != nil {
+		t.Fatalf("Failed to pull image: %v", err)
+	}
+	for _, diffID := range diffIDs {
+		info, err := os.Stat(cachedFile(dir, diffID))
+		if err != nil {
+			t.Fatalf("Expected layer %s to be cached: %v", diffID, err)
+		}
+		size += info.Size()
+	}
+	if s := stats(); s.Blobs != len(diffIDs) || s.Size != size || len(s.Entries) != len(diffIDs) {
+		t.Errorf("Expected %d blobs totalling %d bytes but got %d blobs totalling %d bytes", len(diffIDs), size, s.Blobs, s.Size)
+	}
+	output, err := run(showCacheStats)
+	if err != nil {
+		t.Fatalf("Failed to show cache stats: %v", err)
+	}
+	if !strings.Contains(output, fmt.Sprintf("Blobs:     %d\n", len(diffIDs))) {
+		t.Errorf("Expected blob count in output:\n%s", output)
+	}
+
+	// pulling the image again marks the cached layers as used
+	old := time.Now().Add(-48 * time.Hour)
+	for _, diffID := range diffIDs {
+		setLastUsed(diffID, old)
+	}
+	if _, err := run(pull, ref.Name()); err != nil {
+		t.Fatalf("Failed to pull image: %v", err)
+	}
+	for _, entry := range stats().Entries {
+		if !entry.LastUsed.After(old) {
+			t.Errorf("Expected blob %s to be marked as used, but it was last used %s", entry.Digest, entry.LastUsed)
+		}
+	}
+
+	// a corrupt blob is read from the registry again, and cached again
+	if err := os.Truncate(cachedFile(dir, diffIDs[0]), 100); err != nil {
+		t.Fatalf("Failed to truncate cached layer: %v", err)
+	}
+	if _, err := run(pull, ref.Name()); err != nil {
+		t.Fatalf("Failed to pull image with a corrupt cached layer: %v", err)
+	}
+	assertCached(t, dir, img)
+
+	// cache verify removes corrupt blobs
+	if err := os.Truncate(cachedFile(dir, diffIDs[1]), 100); err != nil {
+		t.Fatalf("Failed to truncate cached layer: %v", err)
+	}
+	output, err = run(verifyCache)
+	if err != nil {
+		t.Fatalf("Failed to verify cache: %v", err)
+	}
+	if expected := fmt.Sprintf("Verified %d blobs, removed 1 corrupt blobs", len(diffIDs)); !strings.HasPrefix(output, expected) {
+		t.Errorf("Expected output %q but got %q", expected, output)
+	}
+	if _, err := os.Stat(cachedFile(dir, diffIDs[1])); !os.IsNotExist(err) {
+		t.Errorf("Expected corrupt layer %s to be removed: %v", diffIDs[1], err)
+	}
+	if _, err := os.Stat(cachedFile(dir, diffIDs[0])); err != nil {
+		t.Errorf("Expected layer %s to be kept: %v", diffIDs[0], err)
+	}
+	if _, err := run(pull, ref.Name()); err != nil {
+		t.Fatalf("Failed to pull image: %v", err)
+	}
+	assertCached(t, dir, img)
+
+	// blobs that have not been used recently are pruned
+	setLastUsed(diffIDs[0], old)
+	if _, err := run(pruneCache, "--older-than", "24h"); err != nil {
+		t.Fatalf("Failed to prune cache: %v", err)
+	}
+	if _, err := os.Stat(cachedFile(dir, diffIDs[0])); !os.IsNotExist(err) {
+		t.Errorf("Expected layer %s to be pruned: %v", diffIDs[0], err)
+	}
+	if _, err := os.Stat(cachedFile(dir, diffIDs[1])); err != nil {
+		t.Errorf("Expected recently used layer %s to be kept: %v", diffIDs[1], err)
+	}
+
+	// the cache is not pruned while another process is using it
+	lock, err := layercache.LockShared(dir)
+	if err != nil {
+		t.Fatalf("Failed to lock cache: %v", err)
+	}
+	if _, err := run(pruneCache, "--all"); err == nil || !strings.Contains(err.Error(), "in use by another wharfie process") {
+		t.Errorf("Expected prune to fail while the cache is in use, but got %v", err)
+	}
+	if _, err := os.Stat(cachedFile(dir, diffIDs[1])); err != nil {
+		t.Errorf("Expected layer %s to be kept while the cache is in use: %v", diffIDs[1], err)
+	}
+	lock.Unlock()
+
+	output, err = run(pruneCache, "--all")
+	if err != nil {
+		t.Fatalf("Failed to prune cache: %v", err)
+	}
+	if !strings.HasPrefix(output, "Removed 1 blobs") {
+		t.Errorf("Expected one blob to be removed, but got %q", output)
+	}
+	if s := stats(); s.Blobs != 0 || s.Size != 0 {
+		t.Errorf("Expected empty cache but got %d blobs totalling %d bytes", s.Blobs, s.Size)
+	}
+}
+
+func TestCacheExport(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, err := name.ParseReference(u.Host + "/test/export:v1")
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+
+	dir := t.TempDir()
+	run := func(command func(context.Context, *cli.Context) error, args ...string) (string, error) {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("private-registry", filepath.Join(dir, "registries.yaml"), "")
+		set.String("cache-dir", filepath.Join(dir, "cache"), "")
+		if err := set.Parse(args); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		app := cli.NewApp()
+		output := &bytes.Buffer{}
+		app.Writer = output
+		err := command(context.Background(), cli.NewContext(app, set, nil))
+		return output.String(), err
+	}
+
+	// images that have not been pulled cannot be exported
+	if _, err := run(exportCache, ref.Name(), filepath.Join(dir, "images", "export.tar")); err == nil || !strings.Contains(err.Error(), "has not been pulled") {
+		t.Errorf("Expected export of an image that has not been pulled to fail, but got %v", err)
+	}
+
+	if _, err := run(pull, ref.Name()); err != nil {
+		t.Fatalf("Failed to pull image: %v", err)
+	}
+	// the registry is not used to export the image
+	server.Close()
+	output, err := run(exportCache, ref.Name(), filepath.Join(dir, "images", "export.tar"))
+	if err != nil {
+		t.Fatalf("Failed to export image: %v", err)
+	}
+	if expected := fmt.Sprintf("Exported %s to %s\n", ref.Name(), filepath.Join(dir, "images", "export.tar")); output != expected {
+		t.Errorf("Expected output %q but got %q", expected, output)
+	}
+	exported, err := tarfile.FindImage(filepath.Join(dir, "images"), ref)
+	if err != nil {
+		t.Fatalf("Failed to find exported image: %v", err)
+	}
+	configName, _ := img.ConfigName()
+	if exportedName, _ := exported.ConfigName(); exportedName != configName {
+		t.Errorf("Expected exported image to have config %s but got %s", configName, exportedName)
+	}
+	layers, _ := img.Layers()
+	exportedLayers, err := exported.Layers()
+	if err != nil || len(exportedLayers) != len(layers) {
+		t.Fatalf("Expected exported image to have %d layers but got %d: %v", len(layers), len(exportedLayers), err)
+	}
+	for i, layer := range exportedLayers {
+		expected, _ := layers[i].DiffID()
+		if diffID, _ := layer.DiffID(); diffID != expected {
+			t.Errorf("Expected exported layer %d to have diff ID %s but got %s", i, expected, diffID)
+		}
+	}
+
+	// an incomplete cache is not exported, and the missing blobs are listed
+	diffID, _ := layers[1].DiffID()
+	if err := os.Remove(cachedFile(filepath.Join(dir, "cache"), diffID)); err != nil {
+		t.Fatalf("Failed to remove cached layer: %v", err)
+	}
+	_, err = run(exportCache, ref.Name(), filepath.Join(dir, "layout"))
+	if err == nil || !strings.Contains(err.Error(), "missing 1 blobs") || !strings.Contains(err.Error(), diffID.String()) {
+		t.Errorf("Expected export to fail listing missing layer %s, but got %v", diffID, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "layout")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written for an incomplete image: %v", err)
+	}
+}
+
+func TestCacheSummary(t *testing.T) {
+	defer func(output io.Writer) { logrus.SetOutput(output) }(logrus.StandardLogger().Out)
+
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(4096, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, _ := name.ParseReference(u.Host + "/test/summary:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+
+	dir := t.TempDir()
+	pullImage := func() string {
+		t.Helper()
+		logs := &bytes.Buffer{}
+		logrus.SetOutput(logs)
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("private-registry", filepath.Join(dir, "registries.yaml"), "")
+		set.String("cache-dir", filepath.Join(dir, "cache"), "")
+		if err := set.Parse([]string{ref.Name()}); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		app := cli.NewApp()
+		app.Writer = io.Discard
+		if err := pull(context.Background(), cli.NewContext(app, set, nil)); err != nil {
+			t.Fatalf("Failed to pull image: %v", err)
+		}
+		return logs.String()
+	}
+
+	if logs := pullImage(); !strings.Contains(logs, "Layer cache served 0% of layer content") || !strings.Contains(logs, "misses=2") {
+		t.Errorf("Expected first pull to be summarized with 2 misses, but got:\n%s", logs)
+	}
+	if logs := pullImage(); !strings.Contains(logs, "Layer cache served 100% of layer content") || !strings.Contains(logs, "hits=2") || !strings.Contains(logs, "remote=\"0 B\"") {
+		t.Errorf("Expected second pull to be summarized with 2 hits, but got:\n%s", logs)
+	}
+}
+
+func TestCacheCompression(t *testing.T) {
+	recorder := &blobRecorder{Handler: registry.New(registry.Logger(log.New(io.Discard, "", 0)))}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(4096, 3)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, _ := name.ParseReference(u.Host + "/test/compression:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+
+	dir := t.TempDir()
+	extractImage := func(destination string) {
+		t.Helper()
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("private-registry", filepath.Join(dir, "registries.yaml"), "")
+		set.String("cache-dir", filepath.Join(dir, "cache"), "")
+		set.Bool("cache", true, "")
+		set.String("cache-compression", "zstd", "")
+		set.String("output", "text", "")
+		set.String("overwrite-policy", "overwrite", "")
+		set.String("case-collision-policy", "warn", "")
+		set.String("compress", "none", "")
+		set.Int("parallel", 1, "")
+		set.String("platform", "linux/amd64", "")
+		if err := set.Parse([]string{ref.Name(), destination}); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		app := cli.NewApp()
+		app.Writer = io.Discard
+		if err := run(context.Background(), cli.NewContext(app, set, nil)); err != nil {
+			t.Fatalf("Failed to extract image: %v", err)
+		}
+	}
+
+	extractImage(filepath.Join(dir, "first"))
+	layers, _ := img.Layers()
+	for _, layer := range layers {
+		diffID, _ := layer.DiffID()
+		if _, err := os.Stat(cachedFile(filepath.Join(dir, "cache"), diffID) + ".zst"); err != nil {
+			t.Errorf("Expected layer %s to be cached compressed: %v", diffID, err)
+		}
+	}
+
+	// the second extraction is served from the compressed cache, and extracts the same files
+	fetched := len(recorder.blobs)
+	extractImage(filepath.Join(dir, "second"))
+	configName, _ := img.ConfigName()
+	for _, blob := range recorder.blobs[fetched:] {
+		if blob != configName.String() {
+			t.Errorf("Expected no layers to be fetched from the registry but got %s", blob)
+		}
+	}
+	first, second := readTree(t, filepath.Join(dir, "first")), readTree(t, filepath.Join(dir, "second"))
+	if len(first) == 0 || !reflect.DeepEqual(first, second) {
+		t.Errorf("Expected extraction from the compressed cache to match the first extraction of %d files but got %d", len(first), len(second))
+	}
+}
+
+// readTree returns the content of the regular files in the directory, by their path relative to it.
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[rel] = string(b)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", dir, err)
+	}
+	return files
+}
+
+func TestCacheImport(t *testing.T) {
+	recorder := &blobRecorder{Handler: registry.New(registry.Logger(log.New(io.Discard, "", 0)))}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	// the image in the archive shares its base layers with the image in the registry
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	extra, err := random.Layer(1024, "")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	img, err := mutate.AppendLayers(base, extra)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, _ := name.ParseReference(u.Host + "/test/import:v2")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "images"), 0755); err != nil {
+		t.Fatalf("Failed to create images directory: %v", err)
+	}
+	baseRef, _ := name.ParseReference(u.Host + "/test/import:v1")
+	if err := tarball.WriteToFile(filepath.Join(dir, "images", "base.tar"), baseRef, base); err != nil {
+		t.Fatalf("Failed to write image archive: %v", err)
+	}
+
+	run := func(command func(context.Context, *cli.Context) error, args ...string) (string, error) {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("private-registry", filepath.Join(dir, "registries.yaml"), "")
+		set.String("cache-dir", filepath.Join(dir, "cache"), "")
+		if err := set.Parse(args); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		app := cli.NewApp()
+		output := &bytes.Buffer{}
+		app.Writer = output
+		err := command(context.Background(), cli.NewContext(app, set, nil))
+		return output.String(), err
+	}
+
+	output, err := run(importCache, filepath.Join(dir, "images"))
+	if err != nil {
+		t.Fatalf("Failed to import image archives: %v", err)
+	}
+	if !strings.HasPrefix(output, "Imported 2 layers") {
+		t.Errorf("Expected 2 layers to be imported, but got %q", output)
+	}
+	baseLayers, _ := base.Layers()
+	for _, layer := range baseLayers {
+		diffID, _ := layer.DiffID()
+		if _, err := os.Stat(cachedFile(filepath.Join(dir, "cache"), diffID)); err != nil {
+			t.Errorf("Expected layer %s to be cached: %v", diffID, err)
+		}
+	}
+
+	// only the layer that is not in the archive, and the config, are downloaded
+	if _, err := run(pull, ref.Name()); err != nil {
+		t.Fatalf("Failed to pull image: %v", err)
+	}
+	configName, _ := img.ConfigName()
+	extraDigest, _ := extra.Digest()
+	expected := []string{configName.String(), extraDigest.String()}
+	sort.Strings(expected)
+	sort.Strings(recorder.blobs)
+	if !reflect.DeepEqual(recorder.blobs, expected) {
+		t.Errorf("Expected only blobs %v to be downloaded, but got %v", expected, recorder.blobs)
+	}
+	assertCached(t, filepath.Join(dir, "cache"), img)
+
+	if output, err = run(importCache, filepath.Join(dir, "images", "base.tar")); err != nil {
+		t.Fatalf("Failed to import image archive: %v", err)
+	}
+	if !strings.HasPrefix(output, "Imported 0 layers") || !strings.Contains(output, "2 layers were already cached") {
+		t.Errorf("Expected layers to be already cached, but got %q", output)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/urfave/cli"
+)
+
+// checkAuth reports which of the credential sources have credentials for the image, and requests the manifest of the
+// image from each of the endpoints that it is pulled from, with the credentials that a pull would use, reporting the
+// HTTP status of each. Credentials are described by their username or type; secrets are never printed.
+func checkAuth(ctx context.Context, clx *cli.Context) error {
+	if len(clx.Args()) != 1 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <image> is a required argument.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "check-auth", 1)
+	}
+
+	ref, err := parseReference(clx, clx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	source, err := newImageSource(clx, ref)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	sources, statuses, err := source.CheckEndpoints(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(clx.App.Writer, "%s\n\ncredential sources:\n", ref.Name())
+	if len(sources) == 0 {
+		fmt.Fprintf(clx.App.Writer, "  none\n")
+	}
+	for _, source := range sources {
+		auth, err := source.keychain.Resolve(ref.Context())
+		fmt.Fprintf(clx.App.Writer, "  %s: %s\n", source.name, describeCredentials(auth, err))
+	}
+
+	fmt.Fprintf(clx.App.Writer, "\nendpoints:\n")
+	accepted := false
+	for _, status := range statuses {
+		from := "default endpoint"
+		if status.Mirror != "" {
+			from = fmt.Sprintf("mirrors[%q]", status.Mirror)
+		}
+		fmt.Fprintf(clx.App.Writer, "  %s (%s)\n", status.URL, from)
+		fmt.Fprintf(clx.App.Writer, "    repository: %s\n", status.Reference.Context().RepositoryStr())
+		credentials := describeCredentials(status.Authenticator, nil)
+		if status.Auth != "" {
+			credentials += " from " + configEntry(status.Auth)
+		} else if name := credentialSourceName(sources, status); name != "" {
+			credentials += " from " + name
+		}
+		fmt.Fprintf(clx.App.Writer, "    credentials: %s\n", credentials)
+		switch {
+		case status.StatusCode != 0:
+			fmt.Fprintf(clx.App.Writer, "    status: %d %s\n", status.StatusCode, http.StatusText(status.StatusCode))
+		case status.Err != nil:
+			fmt.Fprintf(clx.App.Writer, "    error: %v\n", status.Err)
+		}
+		if status.StatusCode == http.StatusOK {
+			accepted = true
+		}
+	}
+	if !accepted {
+		return errors.Errorf("failed to get the manifest of %s from any endpoint", ref.Name())
+	}
+	return nil
+}
+
+// credentialSourceName returns the name of the credential source that supplied the credentials used for the
+// endpoint: the first that has any for its repository. It is empty if none of them do.
+func credentialSourceName(sources []credentialSource, status registries.EndpointStatus) string {
+	for _, source := range sources {
+		if auth, err := source.keychain.Resolve(status.Reference.Context()); err == nil && auth != authn.Anonymous {
+			return source.name
+		}
+	}
+	return ""
+}
+
+// describeCredentials describes the credentials returned by a keychain without revealing any secrets: the username,
+// or the type of token.
+func describeCredentials(auth authn.Authenticator, err error) string {
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	if auth == nil || auth == authn.Anonymous {
+		return "none"
+	}
+	config, err := auth.Authorization()
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	username := config.Username
+	if username == "" && config.Auth != "" {
+		if b, err := base64.StdEncoding.DecodeString(config.Auth); err == nil {
+			username, _, _ = strings.Cut(string(b), ":")
+		}
+	}
+	switch {
+	case username != "":
+		return fmt.Sprintf("username %q", username)
+	case config.IdentityToken != "":
+		return "identity token"
+	case config.RegistryToken != "":
+		return "registry token"
+	}
+	return "none"
+}
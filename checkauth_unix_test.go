@@ -0,0 +1,131 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCheckAuth(t *testing.T) {
+	defer func(output io.Writer) { logrus.SetOutput(output) }(logrus.StandardLogger().Out)
+	logrus.SetOutput(io.Discard)
+
+	server := httptest.NewServer(basicAuth(registry.New(registry.Logger(log.New(io.Discard, "", 0))), "user", "pass"))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	host := u.Host
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, _ := name.ParseReference(host + "/test/check-auth:v1")
+	if err := remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"})); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+
+	testCases := map[string]struct {
+		auth        string
+		credentials string
+		status      string
+		expectErr   bool
+	}{
+		"success": {
+			auth:        `{"username": "user", "password": "pass"}`,
+			credentials: `username "user"`,
+			status:      "200 OK",
+		},
+		"unauthorized": {
+			auth:        `{"username": "user", "password": "wrong"}`,
+			credentials: `username "user"`,
+			status:      "401 Unauthorized",
+			expectErr:   true,
+		},
+		"no credentials": {
+			credentials: "none",
+			status:      "401 Unauthorized",
+			expectErr:   true,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			t.Setenv("DOCKER_CONFIG", filepath.Join(home, "docker"))
+			t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+
+			binDir := t.TempDir()
+			auth := "{}"
+			if tc.auth != "" {
+				auth = fmt.Sprintf("{%q: %s}", host, tc.auth)
+			}
+			script := fmt.Sprintf("#!/bin/sh\ncat > /dev/null\ncat <<'EOF'\n"+`{"apiVersion": "credentialprovider.kubelet.k8s.io/v1", "kind": "CredentialProviderResponse", "cacheKeyType": "Registry", "auth": %s}`+"\nEOF\n", auth)
+			if err := os.WriteFile(filepath.Join(binDir, "test-provider"), []byte(script), 0755); err != nil {
+				t.Fatalf("Failed to write plugin: %v", err)
+			}
+			pluginConfig := filepath.Join(binDir, "config.yaml")
+			if err := os.WriteFile(pluginConfig, []byte(fmt.Sprintf(`apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: test-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: [%q]
+  defaultCacheDuration: 1h
+`, host)), 0644); err != nil {
+				t.Fatalf("Failed to write plugin config: %v", err)
+			}
+
+			app := newApp(context.Background())
+			output := &bytes.Buffer{}
+			app.Writer = output
+			err := app.Run([]string{"wharfie", "--private-registry", filepath.Join(home, "registries.yaml"),
+				"--image-credential-provider-config", pluginConfig, "--image-credential-provider-bin-dir", binDir,
+				"check-auth", ref.Name()})
+			if tc.expectErr && err == nil {
+				t.Errorf("Expected check-auth to fail")
+			} else if !tc.expectErr && err != nil {
+				t.Errorf("Expected check-auth to succeed, but got %v", err)
+			}
+
+			from := ""
+			if tc.credentials != "none" {
+				from = " from image credential provider plugins"
+			}
+			expected := strings.Join([]string{
+				ref.Name(),
+				"",
+				"credential sources:",
+				"  image credential provider plugins: " + tc.credentials,
+				"  docker config: none",
+				"",
+				"endpoints:",
+				"  http://" + host + "/v2 (default endpoint)",
+				"    repository: test/check-auth",
+				"    credentials: " + tc.credentials + from,
+				"    status: " + tc.status,
+				"",
+			}, "\n")
+			if output.String() != expected {
+				t.Errorf("Expected output:\n%s\nbut got:\n%s", expected, output.String())
+			}
+		})
+	}
+}
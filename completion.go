@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// completionShells are the shells that completion scripts can be generated for.
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completion prints a completion script for the shell. The script is generated from the flags and commands of the
+// application, so that it does not need to be updated when they change. Arguments that are not flags are completed
+// by running wharfie with --generate-bash-completion, so that commands can complete their own arguments.
+func completion(clx *cli.Context) error {
+	if len(clx.Args()) != 1 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <shell> is a required argument.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "completion", 1)
+	}
+
+	var script string
+	var err error
+	switch shell := clx.Args().Get(0); shell {
+	case "bash":
+		script = bashCompletion(clx.App)
+	case "zsh":
+		script = zshCompletion(clx.App)
+	case "fish":
+		script, err = clx.App.ToFishCompletion()
+	default:
+		return fmt.Errorf("unsupported shell %q; supported shells: %s", shell, strings.Join(completionShells, ", "))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(clx.App.Writer, script)
+	return err
+}
+
+// completeShells prints the shells that completion scripts can be generated for, to complete the argument of the
+// completion command.
+func completeShells(clx *cli.Context) {
+	if clx.NArg() > 0 {
+		return
+	}
+	for _, shell := range completionShells {
+		fmt.Fprintln(clx.App.Writer, shell)
+	}
+}
+
+// completionFlag describes a flag for a completion script.
+type completionFlag struct {
+	names    []string
+	usage    string
+	value    bool
+	file     bool
+	multiple bool
+}
+
+// completionFlags returns the flags that can be completed, with their names as they are given on the command line.
+func completionFlags(flags []cli.Flag) []completionFlag {
+	completions := []completionFlag{}
+	for _, f := range flags {
+		doc, ok := f.(cli.DocGenerationFlag)
+		if !ok {
+			continue
+		}
+		flag := completionFlag{usage: doc.GetUsage(), value: doc.TakesValue()}
+		switch f := f.(type) {
+		case cli.StringFlag:
+			flag.file = f.TakesFile
+		case cli.StringSliceFlag:
+			flag.file, flag.multiple = f.TakesFile, true
+		case cli.IntSliceFlag, cli.Int64SliceFlag:
+			flag.multiple = true
+		case cli.GenericFlag:
+			flag.file = f.TakesFile
+		}
+		for _, name := range strings.Split(doc.GetName(), ",") {
+			if name = strings.TrimSpace(name); len(name) == 1 {
+				flag.names = append(flag.names, "-"+name)
+			} else {
+				flag.names = append(flag.names, "--"+name)
+			}
+		}
+		completions = append(completions, flag)
+	}
+	return completions
+}
+
+// commandFlags returns the flags of the command, including the help flag that is added when the command is run.
+func commandFlags(command cli.Command) []completionFlag {
+	flags := command.VisibleFlags()
+	if !command.HideHelp {
+		flags = append(flags, cli.HelpFlag)
+	}
+	return completionFlags(flags)
+}
+
+// bashCompletion returns a bash completion script for the application. Flags are completed for the application or
+// the command being run, and the values of flags that take a file are completed as paths.
+func bashCompletion(app *cli.App) string {
+	app.Setup()
+	commands := app.VisibleCommands()
+	globalFlags := completionFlags(app.VisibleFlags())
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# bash completion for %s, generated by %s completion bash\n\n", app.Name, app.Name)
+	fmt.Fprintf(b, "_%s() {\n", app.Name)
+	b.WriteString("\tlocal cur prev word command i\n")
+	b.WriteString("\tCOMPREPLY=()\n")
+	b.WriteString("\tcur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	b.WriteString("\tprev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n\n")
+
+	// global flags must be given before the command, so the first argument that is not a flag or the value of a
+	// flag is either the command, or an image for the default action
+	b.WriteString("\tcommand=\"\"\n")
+	b.WriteString("\tfor ((i = 1; i < COMP_CWORD; i++)); do\n")
+	b.WriteString("\t\tword=\"${COMP_WORDS[i]}\"\n")
+	b.WriteString("\t\tcase \"$word\" in\n")
+	if names := bashValueFlags(globalFlags, func(completionFlag) bool { return true }); names != "" {
+		fmt.Fprintf(b, "\t\t%s)\n\t\t\t((i++))\n\t\t\t;;\n", names)
+	}
+	b.WriteString("\t\t-*) ;;\n")
+	b.WriteString("\t\t*)\n\t\t\tcommand=\"$word\"\n\t\t\tbreak\n\t\t\t;;\n")
+	b.WriteString("\t\tesac\n")
+	b.WriteString("\tdone\n\n")
+
+	b.WriteString("\tcase \"$command\" in\n")
+	names := []string{}
+	for _, command := range commands {
+		names = append(names, command.Names()...)
+	}
+	b.WriteString("\t\"\")\n")
+	writeBashFlagCompletion(b, globalFlags, fmt.Sprintf("compgen -W %q -- \"$cur\"", strings.Join(names, " ")))
+	for _, command := range commands {
+		fmt.Fprintf(b, "\t%s)\n", strings.Join(command.Names(), "|"))
+		writeBashFlagCompletion(b, commandFlags(command), "compgen -W \"$(\"${COMP_WORDS[@]:0:COMP_CWORD}\" --generate-bash-completion 2>/dev/null)\" -- \"$cur\"")
+	}
+	b.WriteString("\t*)\n")
+	b.WriteString("\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n")
+	b.WriteString("\t\t;;\n")
+	b.WriteString("\tesac\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(b, "complete -o filenames -F _%s %s\n", app.Name, app.Name)
+	return b.String()
+}
+
+// writeBashFlagCompletion writes the completion of the flags, or of their values, for a case of a bash completion
+// script. Arguments that are not flags are completed with the output of the command.
+func writeBashFlagCompletion(b *strings.Builder, flags []completionFlag, command string) {
+	files := bashValueFlags(flags, func(flag completionFlag) bool { return flag.file })
+	values := bashValueFlags(flags, func(flag completionFlag) bool { return !flag.file })
+	if files != "" || values != "" {
+		b.WriteString("\t\tcase \"$prev\" in\n")
+		if files != "" {
+			fmt.Fprintf(b, "\t\t%s)\n\t\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\t\t\treturn 0\n\t\t\t;;\n", files)
+		}
+		if values != "" {
+			fmt.Fprintf(b, "\t\t%s)\n\t\t\treturn 0\n\t\t\t;;\n", values)
+		}
+		b.WriteString("\t\tesac\n")
+	}
+	names := []string{}
+	for _, flag := range flags {
+		names = append(names, flag.names...)
+	}
+	b.WriteString("\t\tif [[ \"$cur\" == -* ]]; then\n")
+	fmt.Fprintf(b, "\t\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	b.WriteString("\t\telse\n")
+	fmt.Fprintf(b, "\t\t\tCOMPREPLY=($(%s))\n", command)
+	b.WriteString("\t\tfi\n")
+	b.WriteString("\t\t;;\n")
+}
+
+// bashValueFlags returns a bash case pattern matching the names of the flags that take a value and are included,
+// or an empty string if there are none.
+func bashValueFlags(flags []completionFlag, include func(completionFlag) bool) string {
+	names := []string{}
+	for _, flag := range flags {
+		if flag.value && include(flag) {
+			names = append(names, flag.names...)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// zshCompletion returns a zsh completion script for the application. Flags are completed with their usage for the
+// application or the command being run, and the values of flags that take a file are completed as paths.
+func zshCompletion(app *cli.App) string {
+	app.Setup()
+	commands := app.VisibleCommands()
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "#compdef %s\n# zsh completion for %s, generated by %s completion zsh\n\n", app.Name, app.Name, app.Name)
+
+	// arguments that are not flags are completed by the command itself
+	fmt.Fprintf(b, "_%s_arguments() {\n", app.Name)
+	b.WriteString("\tlocal -a values\n")
+	fmt.Fprintf(b, "\tvalues=(${(f)\"$(${_%s_words[@]} --generate-bash-completion 2>/dev/null)\"})\n", app.Name)
+	b.WriteString("\tcompadd -a values\n")
+	b.WriteString("}\n\n")
+
+	fmt.Fprintf(b, "_%s() {\n", app.Name)
+	b.WriteString("\tlocal curcontext=\"$curcontext\" state line\n")
+	fmt.Fprintf(b, "\tlocal -a _%s_words commands\n", app.Name)
+	fmt.Fprintf(b, "\t_%s_words=(${words[1,CURRENT-1]})\n", app.Name)
+	b.WriteString("\tcommands=(\n")
+	for _, command := range commands {
+		for _, name := range command.Names() {
+			fmt.Fprintf(b, "\t\t%s\n", zshQuote(name+":"+command.Usage))
+		}
+	}
+	b.WriteString("\t)\n\n")
+
+	b.WriteString("\t_arguments -C \\\n")
+	for _, flag := range completionFlags(app.VisibleFlags()) {
+		writeZshFlags(b, "\t\t", flag)
+	}
+	b.WriteString("\t\t'1: :->command' \\\n")
+	b.WriteString("\t\t'*:: :->arguments'\n\n")
+
+	b.WriteString("\tcase $state in\n")
+	b.WriteString("\tcommand)\n")
+	b.WriteString("\t\t_describe -t commands command commands\n")
+	b.WriteString("\t\t_files\n")
+	b.WriteString("\t\t;;\n")
+	b.WriteString("\targuments)\n")
+	b.WriteString("\t\tcase $line[1] in\n")
+	for _, command := range commands {
+		fmt.Fprintf(b, "\t\t%s)\n", strings.Join(command.Names(), "|"))
+		b.WriteString("\t\t\t_arguments \\\n")
+		for _, flag := range commandFlags(command) {
+			writeZshFlags(b, "\t\t\t\t", flag)
+		}
+		fmt.Fprintf(b, "\t\t\t\t'*: :_%s_arguments'\n", app.Name)
+		b.WriteString("\t\t\t;;\n")
+	}
+	b.WriteString("\t\t*)\n")
+	b.WriteString("\t\t\t_files\n")
+	b.WriteString("\t\t\t;;\n")
+	b.WriteString("\t\tesac\n")
+	b.WriteString("\t\t;;\n")
+	b.WriteString("\tesac\n")
+	b.WriteString("}\n\n")
+	fmt.Fprintf(b, "compdef _%s %s\n", app.Name, app.Name)
+	return b.String()
+}
+
+// writeZshFlags writes an _arguments specification for each name of the flag. Names of the same flag exclude each
+// other, unless the flag may be given more than once.
+func writeZshFlags(b *strings.Builder, indent string, flag completionFlag) {
+	usage := strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`).Replace(flag.usage)
+	for _, name := range flag.names {
+		spec := name
+		switch {
+		case flag.multiple:
+			spec = "*" + spec
+		case len(flag.names) > 1:
+			spec = "(" + strings.Join(flag.names, " ") + ")" + spec
+		}
+		if flag.value && strings.HasPrefix(name, "--") {
+			spec += "="
+		}
+		spec += "[" + usage + "]"
+		if flag.value {
+			spec += ":value:"
+			if flag.file {
+				spec += "_files"
+			}
+		}
+		fmt.Fprintf(b, "%s%s \\\n", indent, zshQuote(spec))
+	}
+}
+
+// zshQuote returns the string quoted for zsh.
+func zshQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
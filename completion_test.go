@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestCompletion(t *testing.T) {
+	// mentioned returns true if the script for each shell completes a flag name
+	mentioned := map[string]func(script, name string) bool{
+		"bash": func(script, name string) bool {
+			return regexp.MustCompile(`[\s"|]` + regexp.QuoteMeta(name) + `[\s"|)]`).MatchString(script)
+		},
+		"zsh": func(script, name string) bool {
+			return strings.Contains(script, name+"[") || strings.Contains(script, name+"=[")
+		},
+		"fish": func(script, name string) bool {
+			if strings.HasPrefix(name, "--") {
+				return strings.Contains(script, " -l "+strings.TrimPrefix(name, "--"))
+			}
+			return strings.Contains(script, " -s "+strings.TrimPrefix(name, "-"))
+		},
+	}
+
+	for shell, mentions := range mentioned {
+		t.Run(shell, func(t *testing.T) {
+			app := newApp(context.Background())
+			output := &bytes.Buffer{}
+			app.Writer = output
+			if err := app.Run([]string{"wharfie", "completion", shell}); err != nil {
+				t.Fatalf("Failed to generate completion script: %v", err)
+			}
+			script := output.String()
+
+			flags := completionFlags(app.VisibleFlags())
+			for _, command := range app.VisibleCommands() {
+				if !strings.Contains(script, command.Name) {
+					t.Errorf("Expected %s completion script to mention command %s", shell, command.Name)
+				}
+				flags = append(flags, commandFlags(command)...)
+			}
+			for _, flag := range flags {
+				for _, name := range flag.names {
+					if !mentions(script, name) {
+						t.Errorf("Expected %s completion script to mention flag %s", shell, name)
+					}
+				}
+			}
+
+			// check the syntax of the script, if the shell is installed
+			path, err := exec.LookPath(shell)
+			if err != nil {
+				return
+			}
+			file := filepath.Join(t.TempDir(), "completion")
+			if err := os.WriteFile(file, []byte(script), 0644); err != nil {
+				t.Fatalf("Failed to write completion script: %v", err)
+			}
+			if out, err := exec.Command(path, "-n", file).CombinedOutput(); err != nil {
+				t.Errorf("Invalid %s completion script: %v\n%s", shell, err, out)
+			}
+		})
+	}
+}
+
+func TestCompletionFileFlags(t *testing.T) {
+	app := newApp(context.Background())
+	output := &bytes.Buffer{}
+	app.Writer = output
+	if err := app.Run([]string{"wharfie", "completion", "zsh"}); err != nil {
+		t.Fatalf("Failed to generate completion script: %v", err)
+	}
+	for _, expected := range []string{
+		"'--private-registry=[Private registry configuration file, as YAML or JSON, or - to read it from stdin]:value:_files'",
+		"'--timeout=[Abort the operation if it does not complete within the given duration, such as 5m; 0 for no limit]:value:'",
+		"'(--quiet -q)-q[Print only the digest, and suppress logging other than errors]'",
+		"'*--exclude=[",
+		`'--platform=[Select images for the given platform, as <os>/<arch>\[/<variant>\]\[:<os-version>\], instead of the machine platform]:value:'`,
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Expected zsh completion script to contain %s", expected)
+		}
+	}
+}
+
+func TestCompletionArguments(t *testing.T) {
+	testCases := map[string]struct {
+		args     []string
+		expected string
+		err      string
+	}{
+		"shells": {
+			args:     []string{"wharfie", "completion", "--generate-bash-completion"},
+			expected: "bash\nzsh\nfish\n",
+		},
+		"unsupported shell": {
+			args: []string{"wharfie", "completion", "powershell"},
+			err:  `unsupported shell "powershell"; supported shells: bash, zsh, fish`,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			app := newApp(context.Background())
+			output := &bytes.Buffer{}
+			app.Writer = output
+			app.ExitErrHandler = func(*cli.Context, error) {}
+			err := app.Run(tc.args)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("Expected error %q but got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if output.String() != tc.expected {
+				t.Errorf("Expected output %q but got %q", tc.expected, output)
+			}
+		})
+	}
+}
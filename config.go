@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultConfigFile is the configuration file that global flags are read from, unless --config is given.
+const defaultConfigFile = "/etc/rancher/wharfie/config.yaml"
+
+// envExcluded are the flags that are not read from WHARFIE_<FLAG> environment variables, as the variables of the same
+// name give credentials for the registries of the images, which are applied with their own precedence.
+var envExcluded = map[string]bool{
+	"username": true,
+	"password": true,
+}
+
+// configExcluded are the global flags that cannot be given defaults, as they select the configuration file or are added
+// by urfave/cli.
+var configExcluded = map[string]bool{
+	"config":                   true,
+	"help":                     true,
+	"version":                  true,
+	"generate-bash-completion": true,
+}
+
+// supersededBy are the flags whose defaults are not applied when the flag that replaces them is given on the command
+// line, as the two cannot be combined.
+var supersededBy = map[string]string{
+	"private-registry": "registry-config-json",
+}
+
+// flagName returns the name of the flag, without its aliases.
+func flagName(f cli.Flag) string {
+	return strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+}
+
+// flagEnvVar returns the environment variable that the flag is read from: the flag name uppercased, with dashes
+// replaced by underscores, so that --cache-dir is WHARFIE_CACHE_DIR.
+func flagEnvVar(name string) string {
+	return "WHARFIE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// isSliceFlag returns true if the flag may be specified multiple times.
+func isSliceFlag(f cli.Flag) bool {
+	_, ok := f.(cli.StringSliceFlag)
+	return ok
+}
+
+// applyDefaults sets the global flags that were not given on the command line from their WHARFIE_<FLAG> environment
+// variables, or else from the configuration file, so that the command line takes precedence over the environment,
+// which takes precedence over the configuration file, which takes precedence over the built-in defaults. The
+// configuration file is --config, or defaultConfigFile if it exists. Warnings for keys in the configuration file that
+// are not global flags are returned, to be logged once logging has been set up.
+func applyDefaults(clx *cli.Context) ([]string, error) {
+	if !clx.IsSet("config") {
+		if value, ok := os.LookupEnv(flagEnvVar("config")); ok {
+			if err := clx.Set("config", value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	config, err := readConfigFile(clx.String("config"), clx.IsSet("config"))
+	if err != nil {
+		return nil, err
+	}
+
+	flags := map[string]bool{}
+	for _, f := range clx.App.Flags {
+		name := flagName(f)
+		if configExcluded[name] {
+			continue
+		}
+		flags[name] = true
+		if clx.IsSet(name) || clx.IsSet(supersededBy[name]) {
+			continue
+		}
+
+		envVar := flagEnvVar(name)
+		if value, ok := os.LookupEnv(envVar); ok && !envExcluded[name] {
+			values := []string{value}
+			if isSliceFlag(f) {
+				values = strings.Split(value, ",")
+			}
+			if err := setFlag(clx, name, values); err != nil {
+				return nil, errors.Wrapf(err, "invalid value for %s", envVar)
+			}
+			continue
+		}
+
+		if value, ok := config[name]; ok {
+			values, err := configValues(f, value)
+			if err == nil {
+				err = setFlag(clx, name, values)
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value for %s in configuration file %s", name, clx.String("config"))
+			}
+		}
+	}
+
+	warnings := []string{}
+	for key := range config {
+		if !flags[key] {
+			warnings = append(warnings, fmt.Sprintf("Ignoring unknown key %q in configuration file %s", key, clx.String("config")))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings, nil
+}
+
+// readConfigFile reads the configuration file, as a map of global flag names to values. A missing file is ignored,
+// unless it was given explicitly.
+func readConfigFile(path string, explicit bool) (map[string]interface{}, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "failed to read configuration file")
+	}
+	config := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse configuration file %s", path)
+	}
+	return config, nil
+}
+
+// configValues returns the values to set the flag to from its value in the configuration file. A list is only
+// accepted for flags that may be specified multiple times.
+func configValues(f cli.Flag, value interface{}) ([]string, error) {
+	switch value := value.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		if !isSliceFlag(f) {
+			return nil, errors.New("expected a single value, not a list")
+		}
+		values := []string{}
+		for _, v := range value {
+			if _, ok := v.(map[interface{}]interface{}); ok {
+				return nil, errors.New("expected a list of values, not a list of mappings")
+			}
+			values = append(values, fmt.Sprint(v))
+		}
+		return values, nil
+	case map[interface{}]interface{}:
+		return nil, errors.New("expected a value, not a mapping")
+	default:
+		return []string{fmt.Sprint(value)}, nil
+	}
+}
+
+// setFlag sets the flag to each of the values in turn, which appends them to flags that may be specified multiple
+// times.
+func setFlag(clx *cli.Context, name string, values []string) error {
+	for _, value := range values {
+		if err := clx.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// viewConfig prints the effective value of each global flag, after the command line, environment variables, and
+// configuration file have been applied, as a configuration file. The password is redacted.
+func viewConfig(clx *cli.Context) error {
+	// subcommands are run by an app of their own, so the global flags are those of the root context
+	root := clx
+	for root.Parent() != nil {
+		root = root.Parent()
+	}
+
+	config := yaml.MapSlice{}
+	for _, f := range root.App.Flags {
+		name := flagName(f)
+		if configExcluded[name] {
+			continue
+		}
+		var value interface{}
+		switch f.(type) {
+		case cli.BoolFlag:
+			value = root.Bool(name)
+		case cli.BoolTFlag:
+			value = root.BoolT(name)
+		case cli.StringSliceFlag:
+			value = root.StringSlice(name)
+		case cli.IntFlag:
+			value = root.Int(name)
+		case cli.Int64Flag:
+			value = root.Int64(name)
+		case cli.DurationFlag:
+			value = root.Duration(name).String()
+		default:
+			value = root.String(name)
+		}
+		if name == "password" && value != "" {
+			value = "REDACTED"
+		}
+		config = append(config, yaml.MapItem{Key: name, Value: value})
+	}
+
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	_, err = clx.App.Writer.Write(b)
+	return err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	config := `images-dir:
+  - /config/images
+  - /config/more-images
+cache: true
+cache-dir: /config/cache
+private-registry: /config/registries.yaml
+retries: 3
+`
+	if err := os.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	type effective struct {
+		ImagesDir       []string `yaml:"images-dir"`
+		Cache           bool     `yaml:"cache"`
+		CacheDir        string   `yaml:"cache-dir"`
+		PrivateRegistry string   `yaml:"private-registry"`
+		Retries         int      `yaml:"retries"`
+		Password        string   `yaml:"password"`
+	}
+
+	testCases := map[string]struct {
+		flags    []string
+		env      map[string]string
+		expected effective
+	}{
+		"built-in defaults": {
+			expected: effective{
+				CacheDir:        "$XDG_CACHE_HOME/rancher/wharfie",
+				PrivateRegistry: "/etc/rancher/common/registries.yaml",
+			},
+		},
+		"config file": {
+			flags: []string{"--config", configFile},
+			expected: effective{
+				ImagesDir:       []string{"/config/images", "/config/more-images"},
+				Cache:           true,
+				CacheDir:        "/config/cache",
+				PrivateRegistry: "/config/registries.yaml",
+				Retries:         3,
+			},
+		},
+		"config file from environment": {
+			env: map[string]string{"WHARFIE_CONFIG": configFile},
+			expected: effective{
+				ImagesDir:       []string{"/config/images", "/config/more-images"},
+				Cache:           true,
+				CacheDir:        "/config/cache",
+				PrivateRegistry: "/config/registries.yaml",
+				Retries:         3,
+			},
+		},
+		"environment over config file": {
+			flags: []string{"--config", configFile},
+			env: map[string]string{
+				"WHARFIE_IMAGES_DIR":       "/env/images,/env/more-images",
+				"WHARFIE_CACHE":            "false",
+				"WHARFIE_CACHE_DIR":        "/env/cache",
+				"WHARFIE_PRIVATE_REGISTRY": "/env/registries.yaml",
+			},
+			expected: effective{
+				ImagesDir:       []string{"/env/images", "/env/more-images"},
+				CacheDir:        "/env/cache",
+				PrivateRegistry: "/env/registries.yaml",
+				Retries:         3,
+			},
+		},
+		"command line over environment": {
+			flags: []string{"--config", configFile, "--images-dir", "/cli/images", "--cache=false", "--cache-dir", "/cli/cache", "--private-registry", "/cli/registries.yaml"},
+			env: map[string]string{
+				"WHARFIE_IMAGES_DIR":       "/env/images",
+				"WHARFIE_CACHE_DIR":        "/env/cache",
+				"WHARFIE_PRIVATE_REGISTRY": "/env/registries.yaml",
+				"WHARFIE_RETRIES":          "5",
+			},
+			expected: effective{
+				ImagesDir:       []string{"/cli/images"},
+				CacheDir:        "/cli/cache",
+				PrivateRegistry: "/cli/registries.yaml",
+				Retries:         5,
+			},
+		},
+		"inline registry configuration over config file": {
+			flags: []string{"--config", configFile, "--registry-config-json", "{}"},
+			expected: effective{
+				ImagesDir:       []string{"/config/images", "/config/more-images"},
+				Cache:           true,
+				CacheDir:        "/config/cache",
+				PrivateRegistry: "/etc/rancher/common/registries.yaml",
+				Retries:         3,
+			},
+		},
+		"credentials are not read from the environment": {
+			flags: []string{"--config", configFile, "--password", "secret"},
+			env:   map[string]string{"WHARFIE_USERNAME": "user", "WHARFIE_PASSWORD": "other"},
+			expected: effective{
+				ImagesDir:       []string{"/config/images", "/config/more-images"},
+				Cache:           true,
+				CacheDir:        "/config/cache",
+				PrivateRegistry: "/config/registries.yaml",
+				Retries:         3,
+				Password:        "REDACTED",
+			},
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+			app := newApp(context.Background())
+			output := &bytes.Buffer{}
+			app.Writer = output
+			args := append(append([]string{"wharfie"}, tc.flags...), "config", "view")
+			if err := app.Run(args); err != nil {
+				t.Fatalf("Failed to view config: %v", err)
+			}
+
+			var actual effective
+			if err := yaml.Unmarshal(output.Bytes(), &actual); err != nil {
+				t.Fatalf("Failed to parse config view output: %v\n%s", err, output)
+			}
+			if strings.Join(actual.ImagesDir, ",") != strings.Join(tc.expected.ImagesDir, ",") {
+				t.Errorf("Expected images-dir %v but got %v", tc.expected.ImagesDir, actual.ImagesDir)
+			}
+			actual.ImagesDir, tc.expected.ImagesDir = nil, nil
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("Expected effective config %+v but got %+v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestConfigFileErrors(t *testing.T) {
+	defer func(output io.Writer) { logrus.SetOutput(output) }(logrus.StandardLogger().Out)
+
+	dir := t.TempDir()
+	testCases := map[string]struct {
+		config   string
+		missing  bool
+		expected string
+		warning  string
+	}{
+		"unknown key": {
+			config:  "cache: true\nregistry: docker.io\n",
+			warning: `Ignoring unknown key \"registry\" in configuration file`,
+		},
+		"missing file": {
+			missing:  true,
+			expected: "failed to read configuration file",
+		},
+		"invalid YAML": {
+			config:   "cache: [true\n",
+			expected: "failed to parse configuration file",
+		},
+		"list for single value": {
+			config:   "cache-dir:\n  - /a\n  - /b\n",
+			expected: "invalid value for cache-dir in configuration file",
+		},
+		"invalid value": {
+			config:   "retries: many\n",
+			expected: "invalid value for retries in configuration file",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			configFile := filepath.Join(dir, strings.ReplaceAll(testName, " ", "-")+".yaml")
+			if !tc.missing {
+				if err := os.WriteFile(configFile, []byte(tc.config), 0600); err != nil {
+					t.Fatalf("Failed to write config file: %v", err)
+				}
+			}
+			logs := &bytes.Buffer{}
+			logrus.SetOutput(logs)
+
+			app := newApp(context.Background())
+			app.Writer = &bytes.Buffer{}
+			err := app.Run([]string{"wharfie", "--config", configFile, "config", "view"})
+			if tc.expected == "" {
+				if err != nil {
+					t.Fatalf("Failed to view config: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected error containing %q but got %v", tc.expected, err)
+			}
+			if !strings.Contains(logs.String(), tc.warning) {
+				t.Errorf("Expected warning %q but got:\n%s", tc.warning, logs)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// copyImage copies the source image, as resolved by the configured registry endpoints or found in a local image
+// tarball, to the default endpoint of the destination registry, and prints the destination reference pinned to the
+// digest, which is the same as the source digest. Blobs that already exist at the destination are not transferred.
+// With --include-referrers, the referrers of the copied image or image index are copied to the destination repository
+// too, under the same cosign tag or by digest.
+func copyImage(ctx context.Context, clx *cli.Context) error {
+	if len(clx.Args()) < 2 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <src-image> and <dst-image> are required arguments.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "copy", 1)
+	}
+
+	src, err := parseReference(clx, clx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	dst, err := parseReference(clx, clx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	source, err := newImageSource(clx, src, dst)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	index, img, err := source.Resolve(ctx, src)
+	if err != nil {
+		return err
+	}
+	if !allPlatforms(clx) {
+		index = nil
+	}
+	var digest v1.Hash
+	if index != nil {
+		digest, err = index.Digest()
+	} else {
+		digest, err = img.Digest()
+	}
+	if err != nil {
+		return err
+	}
+	var referrers []referrer
+	if clx.Bool("include-referrers") {
+		if referrers, err = getReferrers(ctx, source, src.Context().Digest(digest.String())); err != nil {
+			return err
+		}
+	}
+
+	if clx.Bool("dry-run") {
+		images := []v1.Image{img}
+		if index != nil {
+			if images, err = indexImages(index); err != nil {
+				return err
+			}
+		}
+		for _, r := range referrers {
+			if r.image != nil {
+				images = append(images, r.image)
+			} else if indexed, err := indexImages(r.index); err != nil {
+				return err
+			} else {
+				images = append(images, indexed...)
+			}
+		}
+		return listBlobs(ctx, clx.App.Writer, source, dst.Context(), images)
+	}
+
+	if index != nil {
+		logrus.Infof("Copying image index %s to %s", src.Name(), dst.Name())
+		err = source.WriteIndex(ctx, dst, index)
+	} else {
+		logrus.Infof("Copying image %s to %s", src.Name(), dst.Name())
+		err = source.Write(ctx, dst, img)
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range referrers {
+		ref := r.reference(dst.Context())
+		logrus.Infof("Copying referrer %s of %s to %s", r.desc.Digest, src.Name(), ref.Name())
+		if r.index != nil {
+			err = source.WriteIndex(ctx, ref, r.index)
+		} else {
+			err = source.Write(ctx, ref, r.image)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(clx.App.Writer, dst.Context().Digest(digest.String()).Name())
+	return nil
+}
+
+// indexImages returns the images in the image index, skipping manifests that are not images.
+func indexImages(index v1.ImageIndex) ([]v1.Image, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	images := []v1.Image{}
+	for _, m := range manifest.Manifests {
+		if !m.MediaType.IsImage() {
+			logrus.Debugf("Skipping manifest %s with media type %s", m.Digest, m.MediaType)
+			continue
+		}
+		img, err := index.Image(m.Digest)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// listBlobs prints the config and layer blobs of each image, and whether each would be transferred to the
+// repository or already exists there. Blobs shared by several images are only listed once.
+func listBlobs(ctx context.Context, w io.Writer, source *imageSource, repo name.Repository, images []v1.Image) error {
+	seen := map[v1.Hash]bool{}
+	for _, img := range images {
+		manifest, err := img.Manifest()
+		if err != nil {
+			return err
+		}
+		for _, desc := range append([]v1.Descriptor{manifest.Config}, manifest.Layers...) {
+			if seen[desc.Digest] {
+				continue
+			}
+			seen[desc.Digest] = true
+
+			exists, err := source.BlobExists(ctx, repo, desc.Digest)
+			if err != nil {
+				return errors.Wrapf(err, "failed to check for blob %s in %s", desc.Digest, repo.Name())
+			}
+			action := "transfer"
+			if exists {
+				action = "exists"
+			}
+			if _, err := fmt.Fprintf(w, "%s %s %d\n", action, desc.Digest, desc.Size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/urfave/cli"
+)
+
+func TestCopy(t *testing.T) {
+	srcServer := httptest.NewServer(registry.New())
+	defer srcServer.Close()
+	platforms := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}
+	index := v1.ImageIndex(empty.Index)
+	images := map[string]v1.Image{}
+	for _, platform := range platforms {
+		img, err := random.Image(1024, 2)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		images[platform.Architecture] = img
+		p := platform
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &p}})
+	}
+	srcURL, _ := url.Parse(srcServer.URL)
+	srcRef, _ := name.ParseReference(srcURL.Host + "/test/copy:v1")
+	if err := remote.WriteIndex(srcRef, index); err != nil {
+		t.Fatalf("Failed to push index: %v", err)
+	}
+
+	// registry.example.com is not resolvable, so the source can only be found through the mirror
+	config := filepath.Join(t.TempDir(), "registries.yaml")
+	mirror := fmt.Sprintf("mirrors:\n  registry.example.com:\n    endpoint:\n      - %s\n", srcServer.URL)
+	if err := os.WriteFile(config, []byte(mirror), 0644); err != nil {
+		t.Fatalf("Failed to write registry config: %v", err)
+	}
+
+	runCopy := func(t *testing.T, dst string, allPlatforms, dryRun bool) string {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("private-registry", config, "")
+		set.String("platform", "linux/arm64", "")
+		set.Bool("all-platforms", allPlatforms, "")
+		set.Bool("dry-run", dryRun, "")
+		if err := set.Parse([]string{"registry.example.com/test/copy:v1", dst}); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		output := &bytes.Buffer{}
+		app := cli.NewApp()
+		app.Writer = output
+
+		if err := copyImage(context.Background(), cli.NewContext(app, set, nil)); err != nil {
+			t.Fatalf("Failed to copy image: %v", err)
+		}
+		return output.String()
+	}
+
+	indexDigest, _ := index.Digest()
+	imageDigest, _ := images["arm64"].Digest()
+	testCases := map[string]struct {
+		allPlatforms bool
+		digest       v1.Hash
+		copied       []string
+	}{
+		"platform image": {
+			digest: imageDigest,
+			copied: []string{"arm64"},
+		},
+		"all platforms": {
+			allPlatforms: true,
+			digest:       indexDigest,
+			copied:       []string{"amd64", "arm64"},
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			// the in-memory registry shares blobs across repositories, so each case gets its own destination
+			dstServer := httptest.NewServer(registry.New())
+			defer dstServer.Close()
+			dstURL, _ := url.Parse(dstServer.URL)
+			dst := dstURL.Host + "/test/copy:v1"
+			dstRef, _ := name.ParseReference(dst)
+
+			expected := ""
+			for _, arch := range tc.copied {
+				for _, digest := range blobDigests(t, images[arch]) {
+					expected += "transfer " + digest + "\n"
+				}
+			}
+			if output := runCopy(t, dst, tc.allPlatforms, true); output != expected {
+				t.Errorf("Expected dry run output %q but got %q", expected, output)
+			}
+			if _, err := remote.Head(dstRef); err == nil {
+				t.Fatalf("Expected dry run not to copy image")
+			}
+
+			expected = dstRef.Context().Digest(tc.digest.String()).Name() + "\n"
+			if output := runCopy(t, dst, tc.allPlatforms, false); output != expected {
+				t.Errorf("Expected output %q but got %q", expected, output)
+			}
+
+			desc, err := remote.Head(dstRef)
+			if err != nil {
+				t.Fatalf("Failed to get copied image: %v", err)
+			}
+			if desc.Digest != tc.digest {
+				t.Errorf("Expected digest %s but got %s", tc.digest, desc.Digest)
+			}
+			for _, arch := range tc.copied {
+				digest, _ := images[arch].Digest()
+				img, err := remote.Image(dstRef.Context().Digest(digest.String()))
+				if err != nil {
+					t.Fatalf("Failed to get copied image for %s: %v", arch, err)
+				}
+				layers, _ := img.Layers()
+				for _, layer := range layers {
+					if err := readLayer(layer); err != nil {
+						t.Errorf("Failed to read copied layer for %s: %v", arch, err)
+					}
+				}
+			}
+
+			output := runCopy(t, dst, tc.allPlatforms, true)
+			if strings.Contains(output, "transfer") || !strings.Contains(output, "exists") {
+				t.Errorf("Expected all blobs to exist after copy, but got %q", output)
+			}
+		})
+	}
+}
+
+// blobDigests returns the digest and size of the config and layer blobs of the image, as listed by a dry run.
+func blobDigests(t *testing.T, img v1.Image) []string {
+	manifest, err := img.Manifest()
+	if err != nil {
+		t.Fatalf("Failed to get manifest: %v", err)
+	}
+	blobs := []string{}
+	for _, desc := range append([]v1.Descriptor{manifest.Config}, manifest.Layers...) {
+		blobs = append(blobs, fmt.Sprintf("%s %d", desc.Digest, desc.Size))
+	}
+	return blobs
+}
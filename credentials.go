@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// tlsFiles returns the TLS configuration given by the --ca-file, --cert-file, and --key-file flags, or nil if none
+// were given. The files are loaded, so that they are known to be usable before any images are pulled.
+func tlsFiles(clx *cli.Context) (*registries.TLSConfig, error) {
+	config := &registries.TLSConfig{
+		CAFile:   clx.GlobalString("ca-file"),
+		CertFile: clx.GlobalString("cert-file"),
+		KeyFile:  clx.GlobalString("key-file"),
+	}
+	switch {
+	case config.CAFile == "" && config.CertFile == "" && config.KeyFile == "":
+		if clx.GlobalString("tls-registry") != "" {
+			return nil, errors.New("--tls-registry requires --ca-file, or --cert-file and --key-file")
+		}
+		return nil, nil
+	case config.CertFile != "" && config.KeyFile == "":
+		return nil, errors.New("--cert-file requires --key-file")
+	case config.CertFile == "" && config.KeyFile != "":
+		return nil, errors.New("--key-file requires --cert-file")
+	}
+
+	if config.CAFile != "" {
+		b, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read CA file")
+		}
+		if !x509.NewCertPool().AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", config.CAFile)
+		}
+	}
+	if config.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+			return nil, errors.Wrap(err, "failed to load cert file")
+		}
+	}
+	return config, nil
+}
+
+// credentials returns the credentials given by the --username flag, with the password from the --password flag or
+// read from stdin, or nil if no username was given.
+func credentials(clx *cli.Context) (*registries.AuthConfig, error) {
+	username := clx.GlobalString("username")
+	password := clx.GlobalString("password")
+	passwordStdin := clx.GlobalBool("password-stdin")
+	switch {
+	case password != "" && passwordStdin:
+		return nil, errors.New("--password cannot be combined with --password-stdin")
+	case username == "" && (password != "" || passwordStdin):
+		return nil, errors.New("--password and --password-stdin require --username")
+	case username == "":
+		return nil, nil
+	case clx.GlobalIsSet("auth-file"):
+		return nil, errors.New("--username cannot be combined with --auth-file")
+	case password == "" && !passwordStdin:
+		return nil, errors.New("--username requires --password or --password-stdin")
+	}
+
+	if passwordStdin {
+		for _, arg := range clx.Args() {
+			if arg == "-" {
+				return nil, errors.New("--password-stdin cannot be combined with reading image references from stdin")
+			}
+		}
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read password from stdin")
+		}
+		if password = strings.TrimRight(string(b), "\r\n"); password == "" {
+			return nil, errors.New("no password was read from stdin")
+		}
+	} else {
+		logrus.Warn("Passing a password with --password may expose it to other users in the process list; use --password-stdin instead")
+	}
+	return &registries.AuthConfig{Username: username, Password: password}, nil
+}
+
+// loadAuthFile loads the Docker config.json file given by the --auth-file flag, or returns nil if it was not given.
+func loadAuthFile(clx *cli.Context) (*configfile.ConfigFile, error) {
+	if !clx.GlobalIsSet("auth-file") {
+		return nil, nil
+	}
+	authFile := clx.GlobalString("auth-file")
+	f, err := os.Open(authFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open auth file")
+	}
+	defer f.Close()
+	configFile, err := config.LoadFromReader(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load auth file %s", authFile)
+	}
+	return configFile, nil
+}
+
+// envCredentials returns the credentials given by the WHARFIE_USERNAME and WHARFIE_PASSWORD, or
+// WHARFIE_REGISTRY_TOKEN, environment variables, or nil if none were given.
+func envCredentials() (*registries.AuthConfig, error) {
+	username := os.Getenv("WHARFIE_USERNAME")
+	password := os.Getenv("WHARFIE_PASSWORD")
+	token := os.Getenv("WHARFIE_REGISTRY_TOKEN")
+	switch {
+	case token != "" && (username != "" || password != ""):
+		return nil, errors.New("WHARFIE_REGISTRY_TOKEN cannot be combined with WHARFIE_USERNAME and WHARFIE_PASSWORD")
+	case token != "":
+		return &registries.AuthConfig{RegistryToken: token}, nil
+	case username == "" && password == "":
+		return nil, nil
+	case username == "" || password == "":
+		return nil, errors.New("WHARFIE_USERNAME and WHARFIE_PASSWORD must be set together")
+	}
+	return &registries.AuthConfig{Username: username, Password: password}, nil
+}
+
+// envAuthName returns the name of the environment variable that gives credentials for the registry, as
+// WHARFIE_AUTH_<HOST>. The host is uppercased, and each character that is not a letter or digit, such as a dot or
+// colon, is replaced by an underscore, so that registry.example.com:5000 is WHARFIE_AUTH_REGISTRY_EXAMPLE_COM_5000.
+func envAuthName(registry string) string {
+	return "WHARFIE_AUTH_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, registry)
+}
+
+// registryEnvCredentials returns the credentials given for the registry by its WHARFIE_AUTH_<HOST> environment
+// variable, as <username>:<password>, and the name of the variable, or nil if it is not set. Docker Hub credentials
+// may also be given as WHARFIE_AUTH_DOCKER_IO.
+func registryEnvCredentials(registry string) (*registries.AuthConfig, string, error) {
+	keys := []string{envAuthName(registry)}
+	if registry == name.DefaultRegistry {
+		keys = append(keys, envAuthName("docker.io"))
+	}
+	for _, key := range keys {
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		username, password, ok := strings.Cut(value, ":")
+		if !ok || username == "" || password == "" {
+			return nil, "", fmt.Errorf("invalid %s: must be <username>:<password>", key)
+		}
+		return &registries.AuthConfig{Username: username, Password: password}, key, nil
+	}
+	return nil, "", nil
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/rancher/dynamiclistener/factory"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+func TestTLSFlags(t *testing.T) {
+	defer func(output io.Writer) { logrus.SetOutput(output) }(logrus.StandardLogger().Out)
+
+	dir := t.TempDir()
+	caCert, caKey, err := factory.GenCA()
+	if err != nil {
+		t.Fatalf("Failed to generate CA: %v", err)
+	}
+	certPEM, keyPEM, err := factory.Marshal(caCert, caKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal CA: %v", err)
+	}
+	files := map[string][]byte{
+		"ca.crt":      certPEM,
+		"client.key":  keyPEM,
+		"invalid.crt": []byte("not a certificate\n"),
+	}
+	for file, b := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), b, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", file, err)
+		}
+	}
+	caFile := filepath.Join(dir, "ca.crt")
+	keyFile := filepath.Join(dir, "client.key")
+
+	config := "configs:\n  other.example.com:\n    tls:\n      ca_file: /etc/ssl/other.crt\n"
+	targets := []string{"registry.example.com/app:v1", "other.example.com/app:v1"}
+
+	testCases := map[string]struct {
+		flags    []string
+		expected []string
+		err      string
+	}{
+		"ca file": {
+			flags:    []string{"--ca-file", caFile},
+			expected: []string{"Ignoring TLS files given on the command line for registry other.example.com: TLS is configured for other.example.com in "},
+		},
+		"cert and key files": {
+			flags:    []string{"--cert-file", caFile, "--key-file", keyFile},
+			expected: []string{"Ignoring TLS files given on the command line for registry other.example.com: TLS is configured for other.example.com in "},
+		},
+		"tls registry": {
+			flags: []string{"--ca-file", caFile, "--tls-registry", "auth.example.com"},
+		},
+		"tls registry with TLS configured": {
+			flags:    []string{"--ca-file", caFile, "--tls-registry", "other.example.com"},
+			expected: []string{"Ignoring TLS files given on the command line for registry other.example.com: TLS is configured for other.example.com in "},
+		},
+		"missing ca file": {
+			flags: []string{"--ca-file", filepath.Join(dir, "missing.crt")},
+			err:   "failed to read CA file",
+		},
+		"invalid ca file": {
+			flags: []string{"--ca-file", filepath.Join(dir, "invalid.crt")},
+			err:   "no certificates found in CA file " + filepath.Join(dir, "invalid.crt"),
+		},
+		"cert file without key file": {
+			flags: []string{"--cert-file", caFile},
+			err:   "--cert-file requires --key-file",
+		},
+		"key file without cert file": {
+			flags: []string{"--key-file", keyFile},
+			err:   "--key-file requires --cert-file",
+		},
+		"mismatched cert and key files": {
+			flags: []string{"--cert-file", filepath.Join(dir, "invalid.crt"), "--key-file", keyFile},
+			err:   "failed to load cert file",
+		},
+		"tls registry without files": {
+			flags: []string{"--tls-registry", "auth.example.com"},
+			err:   "--tls-registry requires --ca-file, or --cert-file and --key-file",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			privateRegistry := filepath.Join(t.TempDir(), "registries.yaml")
+			if err := os.WriteFile(privateRegistry, []byte(config), 0644); err != nil {
+				t.Fatalf("Failed to write registries.yaml: %v", err)
+			}
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("private-registry", privateRegistry, "")
+			set.String("ca-file", "", "")
+			set.String("cert-file", "", "")
+			set.String("key-file", "", "")
+			set.String("tls-registry", "", "")
+			if err := set.Parse(tc.flags); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			refs := []name.Reference{}
+			for _, target := range targets {
+				ref, err := name.ParseReference(target)
+				if err != nil {
+					t.Fatalf("Failed to parse reference: %v", err)
+				}
+				refs = append(refs, ref)
+			}
+			source, err := newImageSource(cli.NewContext(cli.NewApp(), set, nil), refs...)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error containing %q but got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to create image source: %v", err)
+			}
+
+			output := &bytes.Buffer{}
+			logrus.SetOutput(output)
+			source.once.Do(source.init)
+			if source.err != nil {
+				t.Fatalf("Failed to initialize image source: %v", source.err)
+			}
+
+			warnings := strings.Count(output.String(), "level=warning")
+			if warnings != len(tc.expected) {
+				t.Errorf("Expected %d warnings but got %d:\n%s", len(tc.expected), warnings, output)
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(output.String(), expected) {
+					t.Errorf("Expected warning %q in output:\n%s", expected, output)
+				}
+			}
+		})
+	}
+}
+
+// basicAuthHandler requires requests to authenticate with the username and password.
+type basicAuthHandler struct {
+	http.Handler
+	username string
+	password string
+}
+
+func (h basicAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if username, password, ok := r.BasicAuth(); !ok || username != h.username || password != h.password {
+		w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestCredentials(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+	defer func(output io.Writer) { logrus.SetOutput(output) }(logrus.StandardLogger().Out)
+
+	server := httptest.NewServer(basicAuthHandler{Handler: registry.New(), username: "user", password: "pass"})
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	ref, err := name.ParseReference(u.Host + "/test/credentials:v1")
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	if err := remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"})); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	testCases := map[string]struct {
+		flags    []string
+		env      map[string]string
+		stdin    string
+		config   string
+		authFile string
+		expected string
+		logged   string
+	}{
+		"no credentials": {
+			expected: "401 Unauthorized",
+		},
+		"username and password": {
+			flags:  []string{"--username", "user", "--password", "pass"},
+			logged: "Passing a password with --password may expose it to other users in the process list",
+		},
+		"password from stdin": {
+			flags: []string{"--username", "user", "--password-stdin"},
+			stdin: "pass\n",
+		},
+		"wrong password": {
+			flags:    []string{"--username", "user", "--password-stdin"},
+			stdin:    "wrong\n",
+			expected: "401 Unauthorized",
+		},
+		"auth file": {
+			flags:    []string{"--auth-file"},
+			authFile: fmt.Sprintf(`{"auths": {%q: {"auth": %q}}}`, u.Host, auth),
+		},
+		"auth file for another registry": {
+			flags:    []string{"--auth-file"},
+			authFile: fmt.Sprintf(`{"auths": {"other.example.com": {"auth": %q}}}`, auth),
+			expected: "401 Unauthorized",
+		},
+		"flags take precedence over registries.yaml": {
+			flags:  []string{"--username", "user", "--password-stdin"},
+			stdin:  "pass\n",
+			config: fmt.Sprintf("configs:\n  %q:\n    auth:\n      username: user\n      password: wrong\n", u.Host),
+			logged: "Using credentials from --username for registry " + u.Host + " instead of those configured for " + u.Host,
+		},
+		"flags take precedence over environment variables": {
+			flags: []string{"--username", "user", "--password-stdin"},
+			stdin: "pass\n",
+			env:   map[string]string{"WHARFIE_USERNAME": "user", "WHARFIE_PASSWORD": "wrong", envAuthName(u.Host): "user:wrong"},
+		},
+		"environment variables": {
+			env: map[string]string{"WHARFIE_USERNAME": "user", "WHARFIE_PASSWORD": "pass"},
+		},
+		"environment variable for the registry": {
+			env: map[string]string{envAuthName(u.Host): "user:pass"},
+		},
+		"environment variable for another registry": {
+			env:      map[string]string{envAuthName("other.example.com"): "user:pass"},
+			expected: "401 Unauthorized",
+		},
+		"environment variable for the registry takes precedence": {
+			env: map[string]string{"WHARFIE_USERNAME": "user", "WHARFIE_PASSWORD": "wrong", envAuthName(u.Host): "user:pass"},
+		},
+		"environment variables take precedence over registries.yaml": {
+			env:    map[string]string{"WHARFIE_USERNAME": "user", "WHARFIE_PASSWORD": "pass"},
+			config: "configs:\n  \"*\":\n    auth:\n      username: user\n      password: wrong\n",
+			logged: "Using credentials from WHARFIE_USERNAME for registry " + u.Host + " instead of those configured for *",
+		},
+		"auth file without credentials for the registry falls back to environment variables": {
+			flags:    []string{"--auth-file"},
+			authFile: fmt.Sprintf(`{"auths": {"other.example.com": {"auth": %q}}}`, auth),
+			env:      map[string]string{envAuthName(u.Host): "user:pass"},
+		},
+		"credentials in registries.yaml for another registry": {
+			flags:  []string{"--username", "user", "--password-stdin"},
+			stdin:  "pass\n",
+			config: "configs:\n  other.example.com:\n    auth:\n      username: user\n      password: wrong\n",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			dir := t.TempDir()
+			privateRegistry := filepath.Join(dir, "registries.yaml")
+			if err := os.WriteFile(privateRegistry, []byte(tc.config), 0644); err != nil {
+				t.Fatalf("Failed to write registries.yaml: %v", err)
+			}
+			flags := tc.flags
+			if tc.authFile != "" {
+				authFile := filepath.Join(dir, "config.json")
+				if err := os.WriteFile(authFile, []byte(tc.authFile), 0600); err != nil {
+					t.Fatalf("Failed to write auth file: %v", err)
+				}
+				flags = append(flags, authFile)
+			}
+			stdin = strings.NewReader(tc.stdin)
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("private-registry", privateRegistry, "")
+			set.String("cache-dir", filepath.Join(dir, "cache"), "")
+			set.String("username", "", "")
+			set.String("password", "", "")
+			set.Bool("password-stdin", false, "")
+			set.String("auth-file", "", "")
+			if err := set.Parse(append(flags, ref.Name())); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			app := cli.NewApp()
+			app.Writer = &bytes.Buffer{}
+			output := &bytes.Buffer{}
+			logrus.SetOutput(output)
+
+			err := pull(context.Background(), cli.NewContext(app, set, nil))
+			if tc.expected == "" && err != nil {
+				t.Fatalf("Expected pull to succeed: %v", err)
+			}
+			if tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)) {
+				t.Fatalf("Expected error containing %q but got %v", tc.expected, err)
+			}
+			if tc.logged != "" && !strings.Contains(output.String(), tc.logged) {
+				t.Errorf("Expected %q in output:\n%s", tc.logged, output)
+			}
+		})
+	}
+}
+
+func TestCredentialFlags(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+
+	testCases := map[string]struct {
+		flags    []string
+		args     []string
+		env      map[string]string
+		stdin    string
+		expected string
+	}{
+		"username without password": {
+			flags:    []string{"--username", "user"},
+			expected: "--username requires --password or --password-stdin",
+		},
+		"password without username": {
+			flags:    []string{"--password", "pass"},
+			expected: "--password and --password-stdin require --username",
+		},
+		"password and password stdin": {
+			flags:    []string{"--username", "user", "--password", "pass", "--password-stdin"},
+			expected: "--password cannot be combined with --password-stdin",
+		},
+		"username and auth file": {
+			flags:    []string{"--username", "user", "--password", "pass", "--auth-file", "config.json"},
+			expected: "--username cannot be combined with --auth-file",
+		},
+		"empty password from stdin": {
+			flags:    []string{"--username", "user", "--password-stdin"},
+			stdin:    "\n",
+			expected: "no password was read from stdin",
+		},
+		"password and images from stdin": {
+			flags:    []string{"--username", "user", "--password-stdin"},
+			args:     []string{"-"},
+			expected: "--password-stdin cannot be combined with reading image references from stdin",
+		},
+		"username without password in environment": {
+			env:      map[string]string{"WHARFIE_USERNAME": "user"},
+			expected: "WHARFIE_USERNAME and WHARFIE_PASSWORD must be set together",
+		},
+		"password without username in environment": {
+			env:      map[string]string{"WHARFIE_PASSWORD": "pass"},
+			expected: "WHARFIE_USERNAME and WHARFIE_PASSWORD must be set together",
+		},
+		"registry token and username in environment": {
+			env:      map[string]string{"WHARFIE_REGISTRY_TOKEN": "token", "WHARFIE_USERNAME": "user", "WHARFIE_PASSWORD": "pass"},
+			expected: "WHARFIE_REGISTRY_TOKEN cannot be combined with WHARFIE_USERNAME and WHARFIE_PASSWORD",
+		},
+		"missing auth file": {
+			flags:    []string{"--auth-file", filepath.Join(t.TempDir(), "config.json")},
+			expected: "failed to open auth file",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			stdin = strings.NewReader(tc.stdin)
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("username", "", "")
+			set.String("password", "", "")
+			set.Bool("password-stdin", false, "")
+			set.String("auth-file", "", "")
+			if err := set.Parse(append(tc.flags, tc.args...)); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			_, err := newImageSource(cli.NewContext(cli.NewApp(), set, nil))
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected error containing %q but got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestEnvAuthName(t *testing.T) {
+	testCases := map[string]string{
+		"registry.example.com":      "WHARFIE_AUTH_REGISTRY_EXAMPLE_COM",
+		"registry.example.com:5000": "WHARFIE_AUTH_REGISTRY_EXAMPLE_COM_5000",
+		"my-registry.example.com":   "WHARFIE_AUTH_MY_REGISTRY_EXAMPLE_COM",
+		"127.0.0.1:5000":            "WHARFIE_AUTH_127_0_0_1_5000",
+		"[::1]:5000":                "WHARFIE_AUTH____1__5000",
+		"index.docker.io":           "WHARFIE_AUTH_INDEX_DOCKER_IO",
+	}
+	for registry, expected := range testCases {
+		if name := envAuthName(registry); name != expected {
+			t.Errorf("Expected %s for registry %s but got %s", expected, registry, name)
+		}
+	}
+}
+
+func TestRegistryEnvCredentials(t *testing.T) {
+	testCases := map[string]struct {
+		registry string
+		env      map[string]string
+		auth     *registries.AuthConfig
+		key      string
+		expected string
+	}{
+		"not set": {
+			registry: "registry.example.com",
+		},
+		"registry": {
+			registry: "registry.example.com:5000",
+			env:      map[string]string{"WHARFIE_AUTH_REGISTRY_EXAMPLE_COM_5000": "user:pa:ss"},
+			auth:     &registries.AuthConfig{Username: "user", Password: "pa:ss"},
+			key:      "WHARFIE_AUTH_REGISTRY_EXAMPLE_COM_5000",
+		},
+		"docker hub": {
+			registry: name.DefaultRegistry,
+			env:      map[string]string{"WHARFIE_AUTH_DOCKER_IO": "user:pass"},
+			auth:     &registries.AuthConfig{Username: "user", Password: "pass"},
+			key:      "WHARFIE_AUTH_DOCKER_IO",
+		},
+		"docker hub prefers its registry": {
+			registry: name.DefaultRegistry,
+			env:      map[string]string{"WHARFIE_AUTH_DOCKER_IO": "user:wrong", "WHARFIE_AUTH_INDEX_DOCKER_IO": "user:pass"},
+			auth:     &registries.AuthConfig{Username: "user", Password: "pass"},
+			key:      "WHARFIE_AUTH_INDEX_DOCKER_IO",
+		},
+		"invalid": {
+			registry: "registry.example.com",
+			env:      map[string]string{"WHARFIE_AUTH_REGISTRY_EXAMPLE_COM": "token"},
+			expected: "invalid WHARFIE_AUTH_REGISTRY_EXAMPLE_COM: must be <username>:<password>",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+			auth, key, err := registryEnvCredentials(tc.registry)
+			if tc.expected != "" {
+				if err == nil || err.Error() != tc.expected {
+					t.Fatalf("Expected error %q but got %v", tc.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if !reflect.DeepEqual(auth, tc.auth) || key != tc.key {
+				t.Errorf("Expected %+v from %q but got %+v from %q", tc.auth, tc.key, auth, key)
+			}
+		})
+	}
+}
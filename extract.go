@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/extract"
+	"github.com/rancher/wharfie/pkg/layercache"
+	"github.com/rancher/wharfie/pkg/logging"
+	"github.com/rancher/wharfie/pkg/puller"
+	"github.com/rancher/wharfie/pkg/tarfile"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// dryRunMode determines how much of an extraction is planned by --dry-run.
+type dryRunMode string
+
+const (
+	// dryRunResolve resolves the image, and the endpoint it is pulled from, without downloading any layers.
+	dryRunResolve dryRunMode = "resolve"
+	// dryRunFull also lists the files that would be extracted, which requires downloading the layers.
+	dryRunFull dryRunMode = "full"
+)
+
+// Set sets the mode from the value of the --dry-run flag. The flag may be given without a value for a full dry run.
+func (m *dryRunMode) Set(value string) error {
+	switch value {
+	case "true", string(dryRunFull):
+		*m = dryRunFull
+	case string(dryRunResolve):
+		*m = dryRunResolve
+	case "false":
+		*m = ""
+	default:
+		return fmt.Errorf("unsupported dry run mode %q; supported modes: resolve, full", value)
+	}
+	return nil
+}
+
+func (m *dryRunMode) String() string {
+	return string(*m)
+}
+
+// IsBoolFlag allows --dry-run to be given without a value.
+func (m *dryRunMode) IsBoolFlag() bool {
+	return true
+}
+
+// dryRun returns the mode of the --dry-run flag, or an empty mode if it is not set.
+func dryRun(clx *cli.Context) dryRunMode {
+	if mode, ok := clx.Generic("dry-run").(*dryRunMode); ok {
+		return *mode
+	}
+	return ""
+}
+
+func run(ctx context.Context, clx *cli.Context) error {
+	// images for different platforms would overwrite each other at the same destination
+	if clx.Bool("all-platforms") {
+		return errors.New("--all-platforms cannot be used when extracting; select a single platform with --platform, or use the pull or copy commands")
+	}
+
+	refs, destinations, err := imageArgs(clx)
+	if err != nil {
+		return err
+	}
+
+	overwritePolicy, err := extract.ParseOverwritePolicy(clx.String("overwrite-policy"))
+	if err != nil {
+		return err
+	}
+
+	caseCollisionPolicy, err := extract.ParseCaseCollisionPolicy(clx.String("case-collision-policy"))
+	if err != nil {
+		return err
+	}
+
+	output := clx.String("output")
+	if output != "text" && output != "json" && output != "-" {
+		return fmt.Errorf("unsupported output format %q; supported formats: text, json, -", output)
+	}
+	tarOutput, tarFlag := outputTar(clx), "--output-tar"
+	if output == "-" {
+		if clx.String("output-tar") != "" {
+			return errors.New("--output - cannot be combined with --output-tar")
+		}
+		tarFlag = "--output -"
+	}
+	if tarOutput != "" && dryRun(clx) != "" {
+		return fmt.Errorf("%s cannot be used with --dry-run", tarFlag)
+	}
+	compression, err := tarfile.ParseCompression(clx.String("compress"))
+	if err != nil {
+		return err
+	}
+	if compression != tarfile.CompressionNone && tarOutput == "" {
+		return errors.New("--compress requires --output-tar")
+	}
+
+	if parallel := clx.Int("parallel"); parallel < 1 {
+		return fmt.Errorf("invalid parallel value %d: must be at least 1", parallel)
+	}
+
+	// options that write a single output cannot be shared by multiple images
+	if len(refs) > 1 {
+		for _, flag := range []string{"write-manifest", "write-image-metadata"} {
+			if clx.String(flag) != "" {
+				return fmt.Errorf("--%s cannot be used with more than one image", flag)
+			}
+		}
+		if tarOutput != "" {
+			return fmt.Errorf("%s cannot be used with more than one image", tarFlag)
+		}
+	}
+
+	// destination is one or more bare local paths to extract to on the host, or
+	// image-path:local-path pairs if the content should be extracted to specific
+	// locations. If the image-path is a file, the local-path is the name of the
+	// extracted file, unless it is an existing directory.
+	dirs := map[string]string{}
+	for _, destination := range destinations {
+		var source string
+		parts := strings.SplitN(destination, ":", 2)
+		if len(parts) == 2 {
+			source, destination = parts[0], parts[1]
+		} else {
+			source, destination = "/", parts[0]
+		}
+		destination, err := filepath.Abs(os.ExpandEnv(destination))
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Extract mapping %s => %s", source, destination)
+		dirs[source] = destination
+	}
+
+	extractOptions := []extract.Option{
+		extract.WithPreserveOwnership(clx.Bool("preserve-owner")),
+		extract.WithPreserveSpecialBits(clx.Bool("preserve-special-bits")),
+		extract.WithPreserveXattrs(clx.Bool("preserve-xattrs")),
+		extract.WithDevices(clx.Bool("devices")),
+		extract.WithOverwritePolicy(overwritePolicy),
+		extract.WithCaseCollisionPolicy(caseCollisionPolicy),
+		extract.WithAtomic(clx.BoolT("atomic")),
+		extract.WithVerify(clx.Bool("verify")),
+		extract.WithMaxSize(clx.Int64("max-extract-size")),
+		extract.WithMaxFiles(clx.Int("max-extract-files")),
+		extract.WithExclude(clx.StringSlice("exclude")...),
+		extract.WithStripComponents(clx.Int("strip-components")),
+	}
+	if owner := clx.String("chown"); owner != "" {
+		uid, gid, err := extract.ParseOwner(owner)
+		if err != nil {
+			return err
+		}
+		extractOptions = append(extractOptions, extract.WithChown(uid, gid))
+	}
+	if clx.Bool("preserve-permissions") {
+		extractOptions = append(extractOptions, extract.WithPreservePermissions())
+	}
+	// options such as exclude patterns are checked before any image is pulled, so that a typo fails fast
+	if err := extract.ValidateOptions(extractOptions...); err != nil {
+		return err
+	}
+
+	source, err := newImageSource(clx, refs...)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if len(refs) == 1 {
+		err = extractImage(ctx, clx, clx.App.Writer, source, refs[0], dirs, extractOptions)
+	} else {
+		err = eachImage(ctx, clx, refs, "extract", "Extracted", func(ctx context.Context, ref name.Reference, w io.Writer) error {
+			return extractImage(ctx, clx, w, source, ref, dirs, extractOptions)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	// the destinations are the result of extraction, unless the file list or archive was written instead
+	if quiet(clx) && dryRun(clx) == "" && tarOutput == "" {
+		return writeDestinations(clx.App.Writer, dirs)
+	}
+	return nil
+}
+
+// outputTar returns the file that --output-tar writes the archive of the extracted content to, - for stdout, or an
+// empty string if the content is extracted to the destination. --output - is kept as shorthand for --output-tar -.
+func outputTar(clx *cli.Context) string {
+	if clx.String("output") == "-" {
+		return "-"
+	}
+	return clx.String("output-tar")
+}
+
+// writeTar writes a tar archive of the extracted content to stdout, or to the file, compressed as selected by
+// --compress. The file is removed if the archive cannot be written in full.
+func writeTar(ctx context.Context, clx *cli.Context, stdout io.Writer, path string, img v1.Image, dirs map[string]string, extractOptions []extract.Option) (err error) {
+	compression, err := tarfile.ParseCompression(clx.String("compress"))
+	if err != nil {
+		return err
+	}
+
+	w := stdout
+	if path != "-" {
+		if path, err = filepath.Abs(os.ExpandEnv(path)); err != nil {
+			return err
+		}
+		var f *os.File
+		if f, err = os.Create(path); err != nil {
+			return errors.Wrap(err, "failed to create tar archive")
+		}
+		defer func() {
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(path)
+			}
+		}()
+		logrus.Infof("Writing tar archive to %s", path)
+		w = f
+	}
+
+	cw, err := tarfile.NewCompressor(w, compression)
+	if err != nil {
+		return err
+	}
+	if err := extract.ExtractToWriterContext(ctx, img, dirs, cw, extractOptions...); err != nil {
+		cw.Close()
+		return err
+	}
+	return cw.Close()
+}
+
+// writeDestinations writes each destination directory to the writer once, in sorted order.
+func writeDestinations(w io.Writer, dirs map[string]string) error {
+	destinations := []string{}
+	seen := map[string]bool{}
+	for _, destination := range dirs {
+		if !seen[destination] {
+			seen[destination] = true
+			destinations = append(destinations, destination)
+		}
+	}
+	sort.Strings(destinations)
+	for _, destination := range destinations {
+		if _, err := fmt.Fprintln(w, destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractImage extracts a single image to the destination mappings. The plan of a dry run, or the tar archive for
+// --output -, is written to w.
+func extractImage(ctx context.Context, clx *cli.Context, w io.Writer, source *imageSource, ref name.Reference, dirs map[string]string, extractOptions []extract.Option) error {
+	// copy the shared options, so that images extracted in parallel do not append to the same slice
+	extractOptions = append([]extract.Option{}, extractOptions...)
+	extractOptions = append(extractOptions, extract.WithLogger(logging.Logrus(logrus.WithField("image", ref.Name()))))
+	if metadata := clx.String("write-image-metadata"); metadata != "" {
+		metadata, err := filepath.Abs(os.ExpandEnv(metadata))
+		if err != nil {
+			return err
+		}
+		extractOptions = append(extractOptions, extract.WithImageMetadata(metadata, ref))
+	}
+
+	output := clx.String("output")
+	if mode := dryRun(clx); mode != "" {
+		plan, img, err := source.Plan(ctx, ref)
+		if err != nil {
+			return err
+		}
+		plan.Mappings = dirs
+		plan.Exclude = clx.StringSlice("exclude")
+		if mode == dryRunFull {
+			setPhase(ctx, "extracting image %s", ref.Name())
+			plan.Files = []extract.Entry{}
+			extractOptions = append(extractOptions, extract.WithDryRun(func(entry extract.Entry) {
+				plan.Files = append(plan.Files, entry)
+			}))
+			if err := extract.ExtractDirsContext(ctx, img, dirs, extractOptions...); err != nil {
+				return err
+			}
+		}
+		return writePlan(w, output, plan)
+	}
+
+	img, info, err := source.ImageInfo(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	setPhase(ctx, "extracting image %s", ref.Name())
+	if tarOutput := outputTar(clx); tarOutput != "" {
+		return writeTar(ctx, clx, w, tarOutput, img, dirs, extractOptions)
+	}
+
+	entries, err := extract.ExtractDirsWithResult(ctx, img, dirs, extractOptions...)
+	if err != nil {
+		return err
+	}
+
+	if manifest := clx.String("write-manifest"); manifest != "" {
+		manifest, err := filepath.Abs(os.ExpandEnv(manifest))
+		if err != nil {
+			return err
+		}
+		data, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Writing manifest to %s", manifest)
+		if err := os.WriteFile(manifest, data, 0644); err != nil {
+			return err
+		}
+	}
+	return writeSummary(w, output, ref, info, source.cacheStats())
+}
+
+// extractSummary describes an extracted image, as written by writeSummary.
+type extractSummary struct {
+	Image string `json:"image"`
+	puller.PullInfo
+	// Cache counts the layer cache hits and misses of all images extracted so far, if the layer cache is in use.
+	Cache *layercache.Stats `json:"cache,omitempty"`
+}
+
+// writeSummary logs what was extracted for the image, and where it was pulled from, so that what was deployed can be
+// recorded. With --output json, the summary is also written to the writer, along with the layer cache stats if the
+// cache is in use.
+func writeSummary(w io.Writer, format string, ref name.Reference, info puller.PullInfo, cache *layercache.Stats) error {
+	fields := logrus.Fields{"image": ref.Name(), "source": info.Source, "digest": info.Digest, "layers": info.Layers, "size": info.Size}
+	if info.Path != "" {
+		fields["path"] = info.Path
+	}
+	if info.Endpoint != "" {
+		fields["endpoint"] = info.Endpoint
+	}
+	logrus.WithFields(fields).Infof("Extracted %d layers (%s)", info.Layers, formatSize(info.Size))
+	if format != "json" {
+		return nil
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(extractSummary{Image: ref.Name(), PullInfo: info, Cache: cache})
+}
+
+// dryRunPlan describes what would be extracted from an image, for --dry-run.
+type dryRunPlan struct {
+	Image string `json:"image"`
+	// Local is set if the image is found in a local image tarball, and Endpoint is the URL of the registry endpoint
+	// that has it otherwise, with the key of the mirror that configures the endpoint, and the reference requested
+	// from it if that is rewritten.
+	Local     bool              `json:"local,omitempty"`
+	Endpoint  string            `json:"endpoint,omitempty"`
+	Mirror    string            `json:"mirror,omitempty"`
+	Reference string            `json:"reference,omitempty"`
+	Digest    string            `json:"digest"`
+	Layers    int               `json:"layers"`
+	Size      int64             `json:"size"`
+	Mappings  map[string]string `json:"mappings"`
+	Exclude   []string          `json:"exclude,omitempty"`
+	Files     []extract.Entry   `json:"files,omitempty"`
+}
+
+// writePlan writes the plan of a dry run to the writer, in the requested format.
+func writePlan(w io.Writer, format string, plan *dryRunPlan) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	lines := []string{plan.Image}
+	switch {
+	case plan.Local:
+		lines = append(lines, "  source: local image tarball")
+	case plan.Mirror != "":
+		lines = append(lines, fmt.Sprintf("  endpoint: %s (mirrors[%q])", plan.Endpoint, plan.Mirror))
+	case plan.Endpoint != "":
+		lines = append(lines, fmt.Sprintf("  endpoint: %s (default endpoint)", plan.Endpoint))
+	}
+	if plan.Reference != "" {
+		lines = append(lines, "  reference: "+plan.Reference)
+	}
+	lines = append(lines, "  digest: "+plan.Digest, fmt.Sprintf("  layers: %d (%s)", plan.Layers, formatSize(plan.Size)))
+	sources := []string{}
+	for source := range plan.Mappings {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		lines = append(lines, fmt.Sprintf("  extract: %s => %s", source, plan.Mappings[source]))
+	}
+	for _, pattern := range plan.Exclude {
+		lines = append(lines, "  exclude: "+pattern)
+	}
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return writeEntries(w, format, plan.Files)
+}
+
+// writeEntries writes a list of extracted or listed entries to the writer, in the requested format.
+func writeEntries(w io.Writer, format string, entries []extract.Entry) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	for _, entry := range entries {
+		line := fmt.Sprintf("%-8s %v %10d %s", entry.Type, entry.Mode, entry.Size, entry.Source)
+		if entry.Destination != "" {
+			line += " => " + entry.Destination
+		}
+		if entry.Linkname != "" {
+			line += " -> " + entry.Linkname
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
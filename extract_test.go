@@ -0,0 +1,589 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/rancher/wharfie/pkg/layercache"
+	"github.com/rancher/wharfie/pkg/puller"
+	"github.com/rancher/wharfie/pkg/tarfile"
+	"github.com/sirupsen/logrus"
+)
+
+// fileImage returns an image with a single layer containing regular files at the given paths, each with its own
+// path as content.
+func fileImage(t *testing.T, paths ...string) v1.Image {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, path := range paths {
+		tw.WriteHeader(&tar.Header{Name: path, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(path))})
+		tw.Write([]byte(path))
+	}
+	tw.Close()
+	layer, err := tarball.LayerFromReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	return img
+}
+
+func TestDryRun(t *testing.T) {
+	defer func(output io.Writer) { logrus.SetOutput(output) }(logrus.StandardLogger().Out)
+	logrus.SetOutput(io.Discard)
+
+	recorder := &blobRecorder{Handler: registry.New(registry.Logger(log.New(io.Discard, "", 0)))}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img := fileImage(t, "bin/app", "etc/app.conf")
+	ref, _ := name.ParseReference(u.Host + "/test/dryrun:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	digest, _ := img.Digest()
+	layers, _ := img.Layers()
+	layerDigest, _ := layers[0].Digest()
+	layerSize, _ := layers[0].Size()
+
+	// registry.example.com is not resolvable, so images can only be found through the mirror
+	dir := t.TempDir()
+	config := filepath.Join(dir, "registries.yaml")
+	mirror := fmt.Sprintf("mirrors:\n  registry.example.com:\n    endpoint:\n      - %s\n", server.URL)
+	if err := os.WriteFile(config, []byte(mirror), 0644); err != nil {
+		t.Fatalf("Failed to write registry config: %v", err)
+	}
+	image := "registry.example.com/test/dryrun:v1"
+	destination := filepath.Join(dir, "destination")
+	imagesDir := filepath.Join(dir, "images")
+	if err := os.Mkdir(imagesDir, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	tag, _ := name.NewTag(image)
+	if err := tarball.WriteToFile(filepath.Join(imagesDir, "dryrun.tar"), tag, img); err != nil {
+		t.Fatalf("Failed to write image tarball: %v", err)
+	}
+
+	testCases := map[string]struct {
+		flags         []string
+		expected      string
+		layersFetched bool
+		err           string
+	}{
+		"resolve": {
+			flags: []string{"--dry-run=resolve"},
+			expected: image + "\n" +
+				"  endpoint: " + server.URL + "/v2 (mirrors[\"registry.example.com\"])\n" +
+				"  digest: " + digest.String() + "\n" +
+				fmt.Sprintf("  layers: 1 (%s)\n", formatSize(layerSize)) +
+				"  extract: / => " + destination + "\n",
+		},
+		"full": {
+			flags: []string{"--dry-run"},
+			expected: image + "\n" +
+				"  endpoint: " + server.URL + "/v2 (mirrors[\"registry.example.com\"])\n" +
+				"  digest: " + digest.String() + "\n" +
+				fmt.Sprintf("  layers: 1 (%s)\n", formatSize(layerSize)) +
+				"  extract: / => " + destination + "\n" +
+				"dir      -rwxr-xr-x          0 . => " + destination + "\n" +
+				"dir      -rwxr-xr-x          0 bin => " + filepath.Join(destination, "bin") + "\n" +
+				"file     -rw-r--r--          7 bin/app => " + filepath.Join(destination, "bin", "app") + "\n" +
+				"dir      -rwxr-xr-x          0 etc => " + filepath.Join(destination, "etc") + "\n" +
+				"file     -rw-r--r--         12 etc/app.conf => " + filepath.Join(destination, "etc", "app.conf") + "\n",
+			layersFetched: true,
+		},
+		"resolve from local image tarball": {
+			flags: []string{"--dry-run=resolve", "--images-dir", imagesDir},
+			expected: image + "\n" +
+				"  source: local image tarball\n" +
+				"  digest: " + digest.String() + "\n" +
+				fmt.Sprintf("  layers: 1 (%s)\n", formatSize(layerSize)) +
+				"  extract: / => " + destination + "\n",
+		},
+		"full by name": {
+			flags:         []string{"--dry-run=full"},
+			layersFetched: true,
+		},
+		"unsupported mode": {
+			flags: []string{"--dry-run=partial"},
+			err:   `unsupported dry run mode "partial"`,
+		},
+		"tar archive": {
+			flags: []string{"--dry-run=resolve", "--output", "-"},
+			err:   "--output - cannot be used with --dry-run",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			recorder.lock.Lock()
+			recorder.blobs = nil
+			recorder.lock.Unlock()
+			output := &bytes.Buffer{}
+			app := newApp(context.Background())
+			app.Writer = output
+			app.ErrWriter = io.Discard
+
+			args := append([]string{"wharfie", "--private-registry", config}, tc.flags...)
+			err := app.Run(append(args, image, destination))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error containing %q but got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to run dry run: %v", err)
+			}
+			if tc.expected != "" && output.String() != tc.expected {
+				t.Errorf("Expected output:\n%s\nbut got:\n%s", tc.expected, output)
+			}
+			if _, err := os.Stat(destination); !os.IsNotExist(err) {
+				t.Errorf("Expected destination not to be created, but got %v", err)
+			}
+			fetched := false
+			for _, blob := range recorder.blobs {
+				if blob == layerDigest.String() {
+					fetched = true
+				}
+			}
+			if fetched != tc.layersFetched {
+				t.Errorf("Expected layer fetched to be %t, but got %t", tc.layersFetched, fetched)
+			}
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		for _, mode := range []string{"resolve", "full"} {
+			output := &bytes.Buffer{}
+			app := newApp(context.Background())
+			app.Writer = output
+			if err := app.Run([]string{"wharfie", "--private-registry", config, "--dry-run=" + mode, "--output", "json", "--exclude", "etc/**", image, destination}); err != nil {
+				t.Fatalf("Failed to run dry run: %v", err)
+			}
+			plan := &dryRunPlan{}
+			if err := json.Unmarshal(output.Bytes(), plan); err != nil {
+				t.Fatalf("Failed to parse dry run output: %v\n%s", err, output)
+			}
+			files := []string{}
+			for _, entry := range plan.Files {
+				files = append(files, entry.Source)
+			}
+			expected := &dryRunPlan{
+				Image:    image,
+				Endpoint: server.URL + "/v2",
+				Mirror:   "registry.example.com",
+				Digest:   digest.String(),
+				Layers:   1,
+				Size:     layerSize,
+				Mappings: map[string]string{"/": destination},
+				Exclude:  []string{"etc/**"},
+			}
+			plan.Files = nil
+			if !reflect.DeepEqual(plan, expected) {
+				t.Errorf("Expected %s plan %+v but got %+v", mode, expected, plan)
+			}
+			if expected := map[string]string{"resolve": "", "full": ".,bin,bin/app"}[mode]; strings.Join(files, ",") != expected {
+				t.Errorf("Expected %s plan to list files %q but got %q", mode, expected, files)
+			}
+		}
+		if _, err := os.Stat(destination); !os.IsNotExist(err) {
+			t.Errorf("Expected destination not to be created, but got %v", err)
+		}
+	})
+}
+
+func TestExcludeFlag(t *testing.T) {
+	defer func(output io.Writer) { logrus.SetOutput(output) }(logrus.StandardLogger().Out)
+	logrus.SetOutput(io.Discard)
+
+	requests := atomic.Int32{}
+	handler := registry.New(registry.Logger(log.New(io.Discard, "", 0)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img := fileImage(t, "usr/bin/app", "usr/share/doc/app/README.md", "usr/share/doc/app/copyright", "etc/app/README.md", "etc/app/app.conf")
+	ref, _ := name.ParseReference(u.Host + "/test/exclude:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "registries.yaml")
+
+	testCases := map[string]struct {
+		exclude  []string
+		mapping  string
+		expected []string
+		err      string
+	}{
+		"root mapping": {
+			exclude:  []string{"/usr/share/doc/**", "**/*.md"},
+			expected: []string{"etc/app/app.conf", "usr/bin/app"},
+		},
+		"directory mapping": {
+			exclude:  []string{"/usr/share/doc/**", "**/*.md"},
+			mapping:  "/usr",
+			expected: []string{"bin/app"},
+		},
+		"mapping within excluded directory": {
+			exclude:  []string{"/usr/share/doc/**", "**/*.md"},
+			mapping:  "/usr/share/doc/app",
+			expected: []string{},
+		},
+		"single pattern": {
+			exclude:  []string{"**/*.md"},
+			mapping:  "/etc/app",
+			expected: []string{"app.conf"},
+		},
+		"without exclusions": {
+			mapping:  "/etc/app",
+			expected: []string{"README.md", "app.conf"},
+		},
+		"invalid pattern": {
+			exclude: []string{"**/*.md", "/usr/["},
+			err:     "invalid exclude pattern /usr/[",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			destination := filepath.Join(t.TempDir(), "destination")
+			args := []string{"wharfie", "--private-registry", config}
+			for _, pattern := range tc.exclude {
+				args = append(args, "--exclude", pattern)
+			}
+			target := destination
+			if tc.mapping != "" {
+				target = tc.mapping + ":" + destination
+			}
+			app := newApp(context.Background())
+			app.Writer = &bytes.Buffer{}
+
+			before := requests.Load()
+			err := app.Run(append(args, ref.Name(), target))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error containing %q but got %v", tc.err, err)
+				}
+				if n := requests.Load() - before; n != 0 {
+					t.Errorf("Expected no registry requests before the pattern is rejected, but got %d", n)
+				}
+				if _, err := os.Stat(destination); !os.IsNotExist(err) {
+					t.Errorf("Expected destination not to be created, but got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to extract image: %v", err)
+			}
+
+			files := []string{}
+			filepath.Walk(destination, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					rel, _ := filepath.Rel(destination, path)
+					files = append(files, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			if !reflect.DeepEqual(files, tc.expected) {
+				t.Errorf("Expected extracted files %v but got %v", tc.expected, files)
+			}
+		})
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		destination := filepath.Join(t.TempDir(), "destination")
+		output := &bytes.Buffer{}
+		app := newApp(context.Background())
+		app.Writer = output
+		if err := app.Run([]string{"wharfie", "--private-registry", config, "--exclude", "/usr/share/doc/**", "--exclude", "**/*.md", "--dry-run", ref.Name(), destination}); err != nil {
+			t.Fatalf("Failed to run dry run: %v", err)
+		}
+		for _, expected := range []string{"  exclude: /usr/share/doc/**\n", "  exclude: **/*.md\n", " usr/bin/app => ", " etc/app/app.conf => "} {
+			if !strings.Contains(output.String(), expected) {
+				t.Errorf("Expected dry run output to contain %q:\n%s", expected, output)
+			}
+		}
+		for _, excluded := range []string{"README.md", "copyright", " usr/share"} {
+			if strings.Contains(output.String(), excluded) {
+				t.Errorf("Expected dry run output not to list %q:\n%s", excluded, output)
+			}
+		}
+	})
+}
+
+// tarFiles returns the names of the files in the tar archive, relative to the prefix that all entries must be under.
+func tarFiles(t *testing.T, r io.Reader, prefix string) []string {
+	t.Helper()
+	names := []string{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		if !strings.HasPrefix(h.Name, prefix+"/") {
+			t.Fatalf("Expected tar entry %s to be under %s", h.Name, prefix)
+		}
+		if h.Typeflag != tar.TypeDir {
+			names = append(names, strings.TrimPrefix(h.Name, prefix+"/"))
+		}
+	}
+	return names
+}
+
+func TestOutputTar(t *testing.T) {
+	defer func(output io.Writer) { logrus.SetOutput(output) }(logrus.StandardLogger().Out)
+	logs := &bytes.Buffer{}
+	logrus.SetOutput(logs)
+
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img := fileImage(t, "usr/bin/app", "etc/app/README.md", "etc/app/app.conf", "etc/app/conf.d/default.conf")
+	ref, _ := name.ParseReference(u.Host + "/test/tar:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	config := filepath.Join(t.TempDir(), "registries.yaml")
+	args := []string{"wharfie", "--private-registry", config, "--exclude", "**/*.md"}
+
+	// the archive should contain the same entries as a direct extraction with the same mapping and exclusions
+	direct := filepath.Join(t.TempDir(), "direct")
+	app := newApp(context.Background())
+	app.Writer = &bytes.Buffer{}
+	if err := app.Run(append(args, ref.Name(), "/etc:"+direct)); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+	expected := []string{}
+	if err := filepath.Walk(direct, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(direct, path)
+		expected = append(expected, filepath.ToSlash(rel))
+		return err
+	}); err != nil {
+		t.Fatalf("Failed to walk destination: %v", err)
+	}
+	if len(expected) == 0 {
+		t.Fatalf("Expected files to be extracted to %s", direct)
+	}
+
+	testCases := map[string]struct {
+		flags []string
+		// file is the name of the archive written by --output-tar, or empty if it is written to stdout
+		file string
+		// extension selects the decompressor that the archive written to stdout is read with
+		extension string
+		err       string
+	}{
+		"stdout": {
+			flags:     []string{"--output-tar", "-"},
+			extension: ".tar",
+		},
+		"stdout shorthand": {
+			flags:     []string{"--output", "-"},
+			extension: ".tar",
+		},
+		"stdout with gzip": {
+			flags:     []string{"--output-tar", "-", "--compress", "gzip"},
+			extension: ".tar.gz",
+		},
+		"file with zstd": {
+			flags: []string{"--output-tar", "app.tar.zst", "--compress", "zstd"},
+			file:  "app.tar.zst",
+		},
+		"file with lz4": {
+			flags: []string{"--output-tar", "app.tar.lz4", "--compress", "lz4"},
+			file:  "app.tar.lz4",
+		},
+		"unsupported compression": {
+			flags: []string{"--output-tar", "-", "--compress", "bzip2"},
+			err:   `invalid compression "bzip2"`,
+		},
+		"compression without archive": {
+			flags: []string{"--compress", "gzip"},
+			err:   "--compress requires --output-tar",
+		},
+		"archive and shorthand": {
+			flags: []string{"--output", "-", "--output-tar", "app.tar"},
+			err:   "--output - cannot be combined with --output-tar",
+		},
+		"dry run": {
+			flags: []string{"--output-tar", "-", "--dry-run"},
+			err:   "--output-tar cannot be used with --dry-run",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			dir := t.TempDir()
+			flags := []string{}
+			for _, flag := range tc.flags {
+				if tc.file != "" && flag == tc.file {
+					flag = filepath.Join(dir, flag)
+				}
+				flags = append(flags, flag)
+			}
+			destination := filepath.Join(dir, "destination")
+			output := &bytes.Buffer{}
+			logs.Reset()
+			app := newApp(context.Background())
+			app.Writer = output
+			app.ErrWriter = io.Discard
+
+			err := app.Run(append(append(append([]string{}, args...), flags...), ref.Name(), "/etc:"+destination))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error containing %q but got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to write tar archive: %v", err)
+			}
+			if _, err := os.Stat(destination); !os.IsNotExist(err) {
+				t.Errorf("Expected destination not to be created, but got %v", err)
+			}
+			if !strings.Contains(logs.String(), "Extract mapping") {
+				t.Errorf("Expected logs to be written to the log output rather than stdout, got %q", logs)
+			}
+
+			archive := filepath.Join(dir, tc.file)
+			if tc.file == "" {
+				archive = filepath.Join(dir, "stdout"+tc.extension)
+				if err := os.WriteFile(archive, output.Bytes(), 0644); err != nil {
+					t.Fatalf("Failed to write archive: %v", err)
+				}
+			} else if output.Len() != 0 {
+				t.Errorf("Expected nothing to be written to stdout, got %q", output)
+			}
+			opener, err := tarfile.GetOpener(archive)
+			if err != nil {
+				t.Fatalf("Failed to get opener: %v", err)
+			}
+			rc, err := opener()
+			if err != nil {
+				t.Fatalf("Failed to open archive: %v", err)
+			}
+			defer rc.Close()
+
+			prefix := filepath.ToSlash(strings.TrimPrefix(destination, filepath.VolumeName(destination)))
+			if files := tarFiles(t, rc, strings.TrimPrefix(prefix, "/")); !reflect.DeepEqual(files, expected) {
+				t.Errorf("Expected tar files %v but got %v", expected, files)
+			}
+		})
+	}
+}
+
+func TestExtractSummary(t *testing.T) {
+	defer func(output io.Writer) { logrus.SetOutput(output) }(logrus.StandardLogger().Out)
+	logs := &bytes.Buffer{}
+	logrus.SetOutput(logs)
+
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img := fileImage(t, "usr/bin/app", "etc/app/app.conf")
+	ref, _ := name.ParseReference(u.Host + "/test/summary:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	digest, _ := img.Digest()
+	manifest, _ := img.Manifest()
+	size := int64(0)
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	config := filepath.Join(t.TempDir(), "registries.yaml")
+
+	for _, format := range []string{"text", "json"} {
+		t.Run(format, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			logs.Reset()
+			app := newApp(context.Background())
+			app.Writer = output
+			app.ErrWriter = io.Discard
+			if err := app.Run([]string{"wharfie", "--private-registry", config, "--output", format, ref.Name(), t.TempDir()}); err != nil {
+				t.Fatalf("Failed to extract image: %v", err)
+			}
+			if !strings.Contains(logs.String(), fmt.Sprintf("Extracted %d layers", len(manifest.Layers))) || !strings.Contains(logs.String(), digest.String()) {
+				t.Errorf("Expected the extracted image %s to be logged, got %q", digest, logs)
+			}
+			if format == "text" {
+				if output.Len() != 0 {
+					t.Errorf("Expected nothing to be written to stdout, got %q", output)
+				}
+				return
+			}
+
+			summary := extractSummary{}
+			if err := json.NewDecoder(output).Decode(&summary); err != nil {
+				t.Fatalf("Failed to decode summary %q: %v", output, err)
+			}
+			if summary.Image != ref.Name() || summary.Source != puller.SourceRegistry || !strings.Contains(summary.Endpoint, u.Host) {
+				t.Errorf("Expected %s to be pulled from the registry at %s, got %+v", ref.Name(), u.Host, summary)
+			}
+			if summary.Digest != digest || summary.Layers != len(manifest.Layers) || summary.Size != size {
+				t.Errorf("Expected image %s with %d layers of %d bytes, got %+v", digest, len(manifest.Layers), size, summary)
+			}
+			if summary.Cache != nil {
+				t.Errorf("Expected no cache stats without the layer cache, got %+v", summary.Cache)
+			}
+		})
+	}
+
+	// with the layer cache, the summary counts its hits and misses
+	cache := filepath.Join(t.TempDir(), "cache")
+	for _, expected := range []layercache.Stats{{Misses: len(manifest.Layers)}, {Hits: len(manifest.Layers)}} {
+		output := &bytes.Buffer{}
+		app := newApp(context.Background())
+		app.Writer = output
+		app.ErrWriter = io.Discard
+		if err := app.Run([]string{"wharfie", "--private-registry", config, "--cache", "--cache-dir", cache, "--output", "json", ref.Name(), t.TempDir()}); err != nil {
+			t.Fatalf("Failed to extract image: %v", err)
+		}
+		summary := extractSummary{}
+		if err := json.NewDecoder(output).Decode(&summary); err != nil {
+			t.Fatalf("Failed to decode summary %q: %v", output, err)
+		}
+		if summary.Cache == nil || summary.Cache.Hits != expected.Hits || summary.Cache.Misses != expected.Misses {
+			t.Errorf("Expected cache stats with %d hits and %d misses, got %+v", expected.Hits, expected.Misses, summary.Cache)
+		}
+	}
+}
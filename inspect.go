@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/urfave/cli"
+)
+
+// imageInfo describes an image as resolved by wharfie, for the inspect command. If the reference is an image index,
+// the digest and media type are those of the index, and the layers and config are those of the image for the
+// requested platform.
+type imageInfo struct {
+	Reference   string          `json:"reference"`
+	Digest      string          `json:"digest"`
+	MediaType   types.MediaType `json:"mediaType"`
+	Platforms   []v1.Platform   `json:"platforms,omitempty"`
+	ImageDigest string          `json:"imageDigest,omitempty"`
+	Layers      []layerInfo     `json:"layers"`
+	Config      *v1.ConfigFile  `json:"config"`
+}
+
+// layerInfo describes a layer of an image, for the inspect command.
+type layerInfo struct {
+	Digest    string          `json:"digest"`
+	DiffID    string          `json:"diffID"`
+	MediaType types.MediaType `json:"mediaType"`
+	Size      int64           `json:"size"`
+}
+
+// inspect prints a description of the image as JSON, or the raw manifest or image index.
+func inspect(ctx context.Context, clx *cli.Context) error {
+	if len(clx.Args()) < 1 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <image> is a required argument.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "inspect", 1)
+	}
+
+	options, err := referenceOptions(clx)
+	if err != nil {
+		return err
+	}
+	refs, err := parseImages(clx.Args(), options)
+	if err != nil {
+		return err
+	}
+
+	source, err := newImageSource(clx, refs...)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if len(refs) == 1 {
+		return inspectImage(ctx, clx, clx.App.Writer, source, refs[0])
+	}
+	return eachImage(ctx, clx, refs, "inspect", "Inspected", func(ctx context.Context, ref name.Reference, w io.Writer) error {
+		return inspectImage(ctx, clx, w, source, ref)
+	})
+}
+
+// inspectImage writes a description of a single image to w.
+func inspectImage(ctx context.Context, clx *cli.Context, w io.Writer, source *imageSource, ref name.Reference) error {
+	index, img, err := source.Resolve(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	if clx.Bool("raw") {
+		var raw []byte
+		if index != nil {
+			raw, err = index.RawManifest()
+		} else {
+			raw, err = img.RawManifest()
+		}
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(raw)
+		return err
+	}
+
+	info, err := describeImage(ref, index, img)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(info)
+}
+
+// describeImage returns a description of the image, and of the index it was resolved from, if any.
+func describeImage(ref name.Reference, index v1.ImageIndex, img v1.Image) (*imageInfo, error) {
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	mediaType, err := img.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	info := &imageInfo{
+		Reference: ref.Name(),
+		Digest:    digest.String(),
+		MediaType: mediaType,
+		Layers:    []layerInfo{},
+		Config:    config,
+	}
+
+	if index != nil {
+		manifest, err := index.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		indexDigest, err := index.Digest()
+		if err != nil {
+			return nil, err
+		}
+		info.ImageDigest = info.Digest
+		info.Digest = indexDigest.String()
+		info.MediaType = manifest.MediaType
+		for _, m := range manifest.Manifests {
+			if m.Platform != nil {
+				info.Platforms = append(info.Platforms, *m.Platform)
+			}
+		}
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range layers {
+		digest, err := layer.Digest()
+		if err != nil {
+			return nil, err
+		}
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return nil, err
+		}
+		mediaType, err := layer.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		size, err := layer.Size()
+		if err != nil {
+			return nil, err
+		}
+		info.Layers = append(info.Layers, layerInfo{Digest: digest.String(), DiffID: diffID.String(), MediaType: mediaType, Size: size})
+	}
+	return info, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/urfave/cli"
+)
+
+func TestInspect(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	img, err = mutate.Config(img, v1.Config{Labels: map[string]string{"org.opencontainers.image.source": "https://github.com/rancher/wharfie"}})
+	if err != nil {
+		t.Fatalf("Failed to set image config: %v", err)
+	}
+	platform := v1.Platform{OS: "linux", Architecture: "amd64"}
+	index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &platform}})
+
+	imageRef, _ := name.ParseReference(u.Host + "/test/inspect:image")
+	indexRef, _ := name.ParseReference(u.Host + "/test/inspect:index")
+	if err := remote.Write(imageRef, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	if err := remote.WriteIndex(indexRef, index); err != nil {
+		t.Fatalf("Failed to push index: %v", err)
+	}
+
+	imageDigest, _ := img.Digest()
+	indexDigest, _ := index.Digest()
+	testCases := map[string]struct {
+		ref         name.Reference
+		digest      v1.Hash
+		mediaType   types.MediaType
+		imageDigest string
+		platforms   []v1.Platform
+	}{
+		"image": {
+			ref:       imageRef,
+			digest:    imageDigest,
+			mediaType: types.DockerManifestSchema2,
+		},
+		"index": {
+			ref:         indexRef,
+			digest:      indexDigest,
+			mediaType:   types.OCIImageIndex,
+			imageDigest: imageDigest.String(),
+			platforms:   []v1.Platform{platform},
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			source := &imageSource{
+				clx:      cli.NewContext(cli.NewApp(), flag.NewFlagSet("test", flag.ContinueOnError), nil),
+				platform: platform,
+				registry: testRegistry(t),
+			}
+			source.once.Do(func() {})
+
+			resolvedIndex, resolvedImage, err := source.Resolve(context.Background(), tc.ref)
+			if err != nil {
+				t.Fatalf("Failed to resolve image: %v", err)
+			}
+			if (resolvedIndex != nil) != (tc.platforms != nil) {
+				t.Errorf("Expected index to be resolved: %t", tc.platforms != nil)
+			}
+			info, err := describeImage(tc.ref, resolvedIndex, resolvedImage)
+			if err != nil {
+				t.Fatalf("Failed to describe image: %v", err)
+			}
+
+			data, err := json.Marshal(info)
+			if err != nil {
+				t.Fatalf("Failed to marshal image info: %v", err)
+			}
+			output := map[string]interface{}{}
+			if err := json.Unmarshal(data, &output); err != nil {
+				t.Fatalf("Failed to unmarshal image info: %v", err)
+			}
+			for _, key := range []string{"reference", "digest", "mediaType", "layers", "config"} {
+				if _, ok := output[key]; !ok {
+					t.Errorf("Expected %q in output %s", key, data)
+				}
+			}
+
+			if info.Reference != tc.ref.Name() {
+				t.Errorf("Expected reference %s but got %s", tc.ref.Name(), info.Reference)
+			}
+			if info.Digest != tc.digest.String() {
+				t.Errorf("Expected digest %s but got %s", tc.digest, info.Digest)
+			}
+			if info.MediaType != tc.mediaType {
+				t.Errorf("Expected media type %s but got %s", tc.mediaType, info.MediaType)
+			}
+			if info.ImageDigest != tc.imageDigest {
+				t.Errorf("Expected image digest %q but got %q", tc.imageDigest, info.ImageDigest)
+			}
+			if !reflect.DeepEqual(info.Platforms, tc.platforms) {
+				t.Errorf("Expected platforms %v but got %v", tc.platforms, info.Platforms)
+			}
+
+			layers, _ := img.Layers()
+			if len(info.Layers) != len(layers) {
+				t.Fatalf("Expected %d layers but got %d", len(layers), len(info.Layers))
+			}
+			for i, layer := range layers {
+				digest, _ := layer.Digest()
+				size, _ := layer.Size()
+				if info.Layers[i].Digest != digest.String() || info.Layers[i].Size != size {
+					t.Errorf("Expected layer %s with size %d but got %+v", digest, size, info.Layers[i])
+				}
+			}
+			if label := info.Config.Config.Labels["org.opencontainers.image.source"]; label != "https://github.com/rancher/wharfie" {
+				t.Errorf("Expected image label in config, got %q", label)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/rancher/wharfie/pkg/extract"
+	"github.com/urfave/cli"
+)
+
+func list(ctx context.Context, clx *cli.Context) error {
+	if len(clx.Args()) < 1 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <image> is a required argument.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "ls", 1)
+	}
+
+	output := clx.String("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unsupported output format %q; supported formats: text, json", output)
+	}
+
+	ref, err := parseReference(clx, clx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+
+	source, err := newImageSource(clx, ref)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	img, err := source.Image(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	setPhase(ctx, "listing image %s", ref.Name())
+	entries, err := extract.List(img)
+	if err != nil {
+		return err
+	}
+
+	// filter by path prefix, matching whole path components
+	if prefix := clx.Args().Get(1); prefix != "" {
+		prefix = path.Clean("/" + prefix)
+		filtered := []extract.Entry{}
+		for _, entry := range entries {
+			if prefix == "/" || entry.Source == prefix || strings.HasPrefix(entry.Source, prefix+"/") {
+				filtered = append(filtered, entry)
+			}
+		}
+		entries = filtered
+	}
+
+	return writeEntries(clx.App.Writer, output, entries)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/types"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	// storeDocker stores credentials in the Docker config.json file, which is read by default.
+	storeDocker = "docker"
+	// storeWharfie stores credentials in wharfie's own credentials file, which only wharfie reads.
+	storeWharfie = "wharfie"
+)
+
+// login verifies the credentials for the registry, through the endpoints and TLS configuration that images are
+// pulled from it with, and stores them for subsequent commands.
+func login(ctx context.Context, clx *cli.Context) error {
+	if len(clx.Args()) != 1 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <registry> is a required argument.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "login", 1)
+	}
+
+	reg, err := name.NewRegistry(clx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	configFile, err := loadCredentialStore(clx.String("store"))
+	if err != nil {
+		return err
+	}
+	auth, err := loginCredentials(clx)
+	if err != nil {
+		return err
+	}
+
+	source, err := newImageSource(clx, reg.Repo("library").Tag(name.DefaultTag))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	endpoint, err := source.Ping(ctx, reg, authn.FromConfig(authn.AuthConfig{Username: auth.Username, Password: auth.Password}))
+	if err != nil {
+		return errors.Wrapf(err, "failed to log in to %s", reg.RegistryStr())
+	}
+	logrus.WithField("endpoint", endpoint).Debugf("Credentials accepted by registry %s", reg.RegistryStr())
+
+	key := authKey(reg.RegistryStr())
+	auth.ServerAddress = key
+	if err := configFile.GetCredentialsStore(key).Store(auth); err != nil {
+		return errors.Wrapf(err, "failed to store credentials for %s", reg.RegistryStr())
+	}
+	fmt.Fprintf(clx.App.Writer, "Login succeeded for %s\n", reg.RegistryStr())
+	return nil
+}
+
+// logout removes the stored credentials for the registry.
+func logout(clx *cli.Context) error {
+	if len(clx.Args()) != 1 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <registry> is a required argument.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "logout", 1)
+	}
+
+	reg, err := name.NewRegistry(clx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	configFile, err := loadCredentialStore(clx.String("store"))
+	if err != nil {
+		return err
+	}
+
+	key := authKey(reg.RegistryStr())
+	store := configFile.GetCredentialsStore(key)
+	auth, err := store.Get(key)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get credentials for %s", reg.RegistryStr())
+	}
+	if auth.Username == "" && auth.Password == "" && auth.Auth == "" && auth.IdentityToken == "" && auth.RegistryToken == "" {
+		fmt.Fprintf(clx.App.Writer, "Not logged in to %s\n", reg.RegistryStr())
+		return nil
+	}
+	if err := store.Erase(key); err != nil {
+		return errors.Wrapf(err, "failed to remove credentials for %s", reg.RegistryStr())
+	}
+	fmt.Fprintf(clx.App.Writer, "Removed credentials for %s\n", reg.RegistryStr())
+	return nil
+}
+
+// loginCredentials returns the credentials given by the login command's --username flag, with the password from its
+// --password flag or read from stdin.
+func loginCredentials(clx *cli.Context) (types.AuthConfig, error) {
+	username := clx.String("username")
+	password := clx.String("password")
+	passwordStdin := clx.Bool("password-stdin")
+	switch {
+	case username == "":
+		return types.AuthConfig{}, errors.New("--username is required")
+	case password != "" && passwordStdin:
+		return types.AuthConfig{}, errors.New("--password cannot be combined with --password-stdin")
+	case password == "" && !passwordStdin:
+		return types.AuthConfig{}, errors.New("--username requires --password or --password-stdin")
+	}
+
+	if passwordStdin {
+		if clx.GlobalString("private-registry") == "-" {
+			return types.AuthConfig{}, errors.New("--private-registry - cannot be combined with --password-stdin")
+		}
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return types.AuthConfig{}, errors.Wrap(err, "failed to read password from stdin")
+		}
+		if password = strings.TrimRight(string(b), "\r\n"); password == "" {
+			return types.AuthConfig{}, errors.New("no password was read from stdin")
+		}
+	} else {
+		logrus.Warn("Passing a password with --password may expose it to other users in the process list; use --password-stdin instead")
+	}
+	return types.AuthConfig{Username: username, Password: password}, nil
+}
+
+// loadCredentialStore loads the file that login and logout store credentials in: the Docker config.json file in
+// $DOCKER_CONFIG or ~/.docker, as read by default, or wharfie's own credentials file. Credential helpers configured in
+// the Docker config.json file are used to store credentials, as they are by docker login.
+func loadCredentialStore(store string) (*configfile.ConfigFile, error) {
+	switch store {
+	case storeDocker:
+		dir := os.Getenv(config.EnvOverrideConfigDir)
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to find Docker config.json file")
+			}
+			dir = filepath.Join(home, ".docker")
+		}
+		configFile, err := config.Load(dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load Docker config.json file")
+		}
+		return configFile, nil
+	case storeWharfie:
+		path, err := credentialsFile()
+		if err != nil {
+			return nil, err
+		}
+		return loadCredentialsFile(path)
+	}
+	return nil, fmt.Errorf("unsupported credential store %q; supported stores: %s, %s", store, storeDocker, storeWharfie)
+}
+
+// credentialsFile returns the path of wharfie's own credentials file, in the user's configuration directory.
+func credentialsFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to find credentials file")
+	}
+	return filepath.Join(dir, "rancher", "wharfie", "auth.json"), nil
+}
+
+// loadCredentialsFile loads wharfie's own credentials file, which has the same format as the Docker config.json file.
+// A missing file is loaded as empty, so that it is created when credentials are stored.
+func loadCredentialsFile(path string) (*configfile.ConfigFile, error) {
+	configFile := configfile.New(path)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return configFile, nil
+		}
+		return nil, errors.Wrap(err, "failed to open credentials file")
+	}
+	defer f.Close()
+	if err := configFile.LoadFromReader(f); err != nil {
+		return nil, errors.Wrapf(err, "failed to load credentials file %s", path)
+	}
+	return configFile, nil
+}
+
+// loadCredentialsKeychain returns a keychain for the credentials stored in wharfie's own credentials file, or nil if
+// there are none.
+func loadCredentialsKeychain() (authn.Keychain, error) {
+	path, err := credentialsFile()
+	if err != nil {
+		// without a configuration directory, there is nowhere that credentials could have been stored
+		return nil, nil
+	}
+	configFile, err := loadCredentialsFile(path)
+	if err != nil || len(configFile.AuthConfigs) == 0 {
+		return nil, err
+	}
+	return &credentialsKeychain{configFile: configFile}, nil
+}
+
+// credentialsKeychain is a keychain for the credentials in wharfie's own credentials file.
+type credentialsKeychain struct {
+	configFile *configfile.ConfigFile
+}
+
+// Resolve returns the credentials stored for the registry of the resource, or anonymous access if there are none.
+func (k *credentialsKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	auth, ok := k.configFile.AuthConfigs[authKey(target.RegistryStr())]
+	if !ok {
+		return authn.Anonymous, nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		Auth:          auth.Auth,
+		IdentityToken: auth.IdentityToken,
+		RegistryToken: auth.RegistryToken,
+	}), nil
+}
+
+// authKey returns the key that credentials for the registry are stored under. Docker stores the credentials for
+// Docker Hub under its legacy address.
+func authKey(registry string) string {
+	if registry == name.DefaultRegistry {
+		return authn.DefaultAuthKey
+	}
+	return registry
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/sirupsen/logrus"
+)
+
+// basicAuth wraps the handler, so that requests must carry the username and password as Basic credentials.
+func basicAuth(handler http.Handler, username, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != username || p != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="wharfie"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func TestLogin(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+	defer func(output io.Writer) { logrus.SetOutput(output) }(logrus.StandardLogger().Out)
+	logrus.SetOutput(io.Discard)
+
+	server := httptest.NewServer(basicAuth(registry.New(), "user", "pass"))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	host := u.Host
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, _ := name.ParseReference(host + "/test/login:v1")
+	if err := remote.Write(ref, img, remote.WithAuth(&authn.Basic{Username: "user", Password: "pass"})); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+
+	run := func(stdinContent string, args ...string) (string, error) {
+		stdin = strings.NewReader(stdinContent)
+		app := newApp(context.Background())
+		output := &bytes.Buffer{}
+		app.Writer = output
+		err := app.Run(append([]string{"wharfie", "--private-registry", filepath.Join(t.TempDir(), "registries.yaml")}, args...))
+		return output.String(), err
+	}
+
+	testCases := map[string]struct {
+		store string
+		file  func(home string) string
+	}{
+		"docker": {
+			store: storeDocker,
+			file:  func(home string) string { return filepath.Join(home, "docker", "config.json") },
+		},
+		"wharfie": {
+			store: storeWharfie,
+			file:  func(home string) string { return filepath.Join(home, "config", "rancher", "wharfie", "auth.json") },
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			t.Setenv("DOCKER_CONFIG", filepath.Join(home, "docker"))
+			t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "config"))
+			file := tc.file(home)
+
+			if _, err := run("", "resolve", ref.Name()); err == nil {
+				t.Fatalf("Expected resolve to fail before login")
+			}
+
+			if _, err := run("", "login", "--store", tc.store, "-u", "user", "-p", "wrong", host); err == nil || !strings.Contains(err.Error(), "failed to log in to "+host) {
+				t.Fatalf("Expected login with the wrong password to fail, but got %v", err)
+			}
+			if _, err := os.Stat(file); !os.IsNotExist(err) {
+				t.Fatalf("Expected credentials not to be stored after failed login, but got %v", err)
+			}
+
+			output, err := run("pass\n", "login", "--store", tc.store, "-u", "user", "--password-stdin", host)
+			if err != nil {
+				t.Fatalf("Failed to log in: %v", err)
+			}
+			if expected := "Login succeeded for " + host + "\n"; output != expected {
+				t.Errorf("Expected output %q but got %q", expected, output)
+			}
+
+			// the stored credentials round-trip through the file
+			f, err := os.Open(file)
+			if err != nil {
+				t.Fatalf("Failed to open credentials file: %v", err)
+			}
+			configFile := configfile.New(file)
+			err = configFile.LoadFromReader(f)
+			f.Close()
+			if err != nil {
+				t.Fatalf("Failed to load credentials file: %v", err)
+			}
+			if auth := configFile.AuthConfigs[host]; auth.Username != "user" || auth.Password != "pass" {
+				t.Errorf("Expected stored credentials user:pass for %s but got %+v", host, auth)
+			}
+
+			if _, err := run("", "resolve", ref.Name()); err != nil {
+				t.Errorf("Expected resolve to use the stored credentials, but got %v", err)
+			}
+
+			if output, err := run("", "logout", "--store", tc.store, host); err != nil || output != "Removed credentials for "+host+"\n" {
+				t.Fatalf("Expected logout to remove credentials, but got %q, %v", output, err)
+			}
+			if output, err := run("", "logout", "--store", tc.store, host); err != nil || output != "Not logged in to "+host+"\n" {
+				t.Fatalf("Expected second logout to report no credentials, but got %q, %v", output, err)
+			}
+			if _, err := run("", "resolve", ref.Name()); err == nil {
+				t.Errorf("Expected resolve to fail after logout")
+			}
+		})
+	}
+}
+
+func TestLoginFlags(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+
+	testCases := map[string]struct {
+		args     []string
+		stdin    string
+		expected string
+	}{
+		"no username": {
+			args:     []string{"login", "-p", "pass", "registry.example.com"},
+			expected: "--username is required",
+		},
+		"no password": {
+			args:     []string{"login", "-u", "user", "registry.example.com"},
+			expected: "--username requires --password or --password-stdin",
+		},
+		"password and password from stdin": {
+			args:     []string{"login", "-u", "user", "-p", "pass", "--password-stdin", "registry.example.com"},
+			expected: "--password cannot be combined with --password-stdin",
+		},
+		"empty password from stdin": {
+			args:     []string{"login", "-u", "user", "--password-stdin", "registry.example.com"},
+			stdin:    "\n",
+			expected: "no password was read from stdin",
+		},
+		"registry configuration and password from stdin": {
+			args:     []string{"--private-registry", "-", "login", "-u", "user", "--password-stdin", "registry.example.com"},
+			expected: "--private-registry - cannot be combined with --password-stdin",
+		},
+		"unsupported store": {
+			args:     []string{"login", "--store", "keyring", "-u", "user", "-p", "pass", "registry.example.com"},
+			expected: `unsupported credential store "keyring"`,
+		},
+		"invalid registry": {
+			args:     []string{"logout", "registry.example.com/repository"},
+			expected: "registries must be valid RFC 3986 URI authorities",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			t.Setenv("DOCKER_CONFIG", t.TempDir())
+			stdin = strings.NewReader(tc.stdin)
+			app := newApp(context.Background())
+			app.Writer = &bytes.Buffer{}
+			err := app.Run(append([]string{"wharfie"}, tc.args...))
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Fatalf("Expected error containing %q but got %v", tc.expected, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "github.com/urfave/cli"
+
+// logTargetFlags are the platform-specific flags selecting where logs are written; logs are always written to stderr
+// on this platform.
+var logTargetFlags []cli.Flag
+
+// setupLogTarget does nothing, as logs are always written to stderr on this platform.
+func setupLogTarget(clx *cli.Context) error {
+	return nil
+}
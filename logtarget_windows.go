@@ -0,0 +1,120 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+const (
+	logTargetStderr   = "stderr"
+	logTargetEventLog = "eventlog"
+
+	// eventLogSource is the source that events are logged under, in the Application event log.
+	eventLogSource = "wharfie"
+	// eventLogKey is the registry key that event log sources are registered under.
+	eventLogKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+	// eventLogID is the ID of all events; the EventCreate message file formats the message as is.
+	eventLogID = 1
+)
+
+// logTargetFlags are the platform-specific flags selecting where logs are written.
+var logTargetFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "log-target",
+		Usage: "Write logs to the given target (stderr, eventlog); eventlog writes them to the Windows Application event log under the wharfie source, which is created if missing",
+		Value: logTargetStderr,
+	},
+}
+
+// eventLogWriter writes messages to the event log, as events of each type.
+type eventLogWriter interface {
+	Info(eid uint32, msg string) error
+	Warning(eid uint32, msg string) error
+	Error(eid uint32, msg string) error
+}
+
+// openEventLog opens the event log for the source. It is a variable so that tests can record events without
+// registering a source.
+var openEventLog = func(source string) (eventLogWriter, error) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, eventLogKey+source, registry.QUERY_VALUE)
+	switch {
+	case err == nil:
+		key.Close()
+	case errors.Is(err, registry.ErrNotExist):
+		if err := eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			return nil, errors.Wrapf(err, "failed to create event log source %s", source)
+		}
+	default:
+		return nil, errors.Wrapf(err, "failed to find event log source %s", source)
+	}
+
+	elog, err := eventlog.Open(source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open event log source %s", source)
+	}
+	return elog, nil
+}
+
+// setupLogTarget routes logs to the target selected by --log-target. Logs written to the event log are not written
+// to stderr.
+func setupLogTarget(clx *cli.Context) error {
+	switch target := clx.String("log-target"); target {
+	case "", logTargetStderr:
+		return nil
+	case logTargetEventLog:
+		elog, err := openEventLog(eventLogSource)
+		if err != nil {
+			return err
+		}
+		logrus.AddHook(&eventLogHook{log: elog, formatter: eventLogFormatter(clx.String("log-format"))})
+		logrus.SetOutput(io.Discard)
+		return nil
+	default:
+		return fmt.Errorf("unsupported log target %q; supported targets: %s, %s", target, logTargetStderr, logTargetEventLog)
+	}
+}
+
+// eventLogFormatter returns the formatter for events in the given log format. Events are never colored, and carry
+// their own timestamp.
+func eventLogFormatter(format string) logrus.Formatter {
+	if format == "json" {
+		return &logrus.JSONFormatter{DisableTimestamp: true}
+	}
+	return &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}
+}
+
+// eventLogHook writes log entries to the event log, with their fields. Errors, including the fatal error that wharfie
+// exits with, are logged as error events, and warnings as warning events.
+type eventLogHook struct {
+	log       eventLogWriter
+	formatter logrus.Formatter
+}
+
+func (h *eventLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *eventLogHook) Fire(entry *logrus.Entry) error {
+	b, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(string(b), "\n")
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return h.log.Error(eventLogID, msg)
+	case logrus.WarnLevel:
+		return h.log.Warning(eventLogID, msg)
+	default:
+		return h.log.Info(eventLogID, msg)
+	}
+}
@@ -0,0 +1,145 @@
+//go:build windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// eventRecorder records the events written to it, prefixed with their type.
+type eventRecorder struct {
+	events []string
+}
+
+func (r *eventRecorder) Info(eid uint32, msg string) error {
+	r.events = append(r.events, "info: "+msg)
+	return nil
+}
+
+func (r *eventRecorder) Warning(eid uint32, msg string) error {
+	r.events = append(r.events, "warning: "+msg)
+	return nil
+}
+
+func (r *eventRecorder) Error(eid uint32, msg string) error {
+	r.events = append(r.events, "error: "+msg)
+	return nil
+}
+
+func TestSetupLogTarget(t *testing.T) {
+	defer func(formatter logrus.Formatter, level logrus.Level, output io.Writer, hooks logrus.LevelHooks) {
+		logrus.SetFormatter(formatter)
+		logrus.SetLevel(level)
+		logrus.SetOutput(output)
+		logrus.StandardLogger().ReplaceHooks(hooks)
+	}(logrus.StandardLogger().Formatter, logrus.GetLevel(), logrus.StandardLogger().Out, logrus.StandardLogger().Hooks)
+	defer func(open func(string) (eventLogWriter, error)) { openEventLog = open }(openEventLog)
+
+	var recorder *eventRecorder
+	openEventLog = func(source string) (eventLogWriter, error) {
+		if source != eventLogSource {
+			return nil, fmt.Errorf("unexpected event log source %q", source)
+		}
+		recorder = &eventRecorder{}
+		return recorder, nil
+	}
+
+	newContext := func(args ...string) *cli.Context {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("log-format", "text", "")
+		set.String("log-level", "info", "")
+		set.String("log-target", logTargetStderr, "")
+		if err := set.Parse(args); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		return cli.NewContext(cli.NewApp(), set, nil)
+	}
+
+	if err := setupLogging(newContext("--log-target", "syslog")); err == nil || !strings.Contains(err.Error(), `unsupported log target "syslog"`) {
+		t.Errorf("Expected unsupported log target error but got %v", err)
+	}
+
+	t.Run("stderr", func(t *testing.T) {
+		logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+		output := &bytes.Buffer{}
+		logrus.SetOutput(output)
+		if err := setupLogging(newContext()); err != nil {
+			t.Fatalf("Failed to set up logging: %v", err)
+		}
+		formatter, ok := logrus.StandardLogger().Formatter.(*logrus.TextFormatter)
+		if !ok || !formatter.DisableColors {
+			t.Errorf("Expected text formatter without colors for output that is not a terminal, got %#v", logrus.StandardLogger().Formatter)
+		}
+		logrus.WithField("image", "busybox").Error("Failed")
+		if !strings.Contains(output.String(), "msg=Failed image=busybox") {
+			t.Errorf("Expected error to be logged to stderr, got %q", output.String())
+		}
+		if recorder != nil {
+			t.Errorf("Expected event log not to be opened, got events %v", recorder.events)
+		}
+	})
+
+	testCases := map[string]struct {
+		format   string
+		expected func(t *testing.T, event string)
+	}{
+		"text": {
+			format: "text",
+			expected: func(t *testing.T, event string) {
+				if expected := "error: level=error msg=Failed image=busybox"; event != expected {
+					t.Errorf("Expected event %q but got %q", expected, event)
+				}
+			},
+		},
+		"json": {
+			format: "json",
+			expected: func(t *testing.T, event string) {
+				fields := map[string]interface{}{}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(event, "error: ")), &fields); err != nil {
+					t.Fatalf("Failed to decode event %q: %v", event, err)
+				}
+				if _, ok := fields["time"]; ok || fields["level"] != "error" || fields["msg"] != "Failed" || fields["image"] != "busybox" {
+					t.Errorf("Expected error event with fields and no timestamp, got %q", event)
+				}
+			},
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+			output := &bytes.Buffer{}
+			logrus.SetOutput(output)
+			recorder = nil
+			if err := setupLogging(newContext("--log-format", tc.format, "--log-target", logTargetEventLog)); err != nil {
+				t.Fatalf("Failed to set up logging: %v", err)
+			}
+
+			logrus.Debug("Not logged")
+			logrus.Warn("Falling back")
+			logrus.WithField("image", "busybox").Error("Failed")
+			if output.Len() != 0 {
+				t.Errorf("Expected nothing to be logged to stderr, got %q", output.String())
+			}
+			if recorder == nil || len(recorder.events) != 2 {
+				t.Fatalf("Expected a warning and an error event, got %v", recorder)
+			}
+			if !strings.HasPrefix(recorder.events[0], "warning: ") || !strings.Contains(recorder.events[0], "Falling back") {
+				t.Errorf("Expected warning event, got %q", recorder.events[0])
+			}
+			if strings.Contains(recorder.events[1], "\x1b[") {
+				t.Errorf("Expected event without color codes, got %q", recorder.events[1])
+			}
+			tc.expected(t, recorder.events[1])
+		})
+	}
+}
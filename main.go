@@ -1,22 +1,27 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 
-	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/google/go-containerregistry/pkg/name"
-	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/cache"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/rancher/wharfie/pkg/credentialprovider/plugin"
 	"github.com/rancher/wharfie/pkg/extract"
+	"github.com/rancher/wharfie/pkg/policy"
 	"github.com/rancher/wharfie/pkg/registries"
 	"github.com/rancher/wharfie/pkg/tarfile"
 	"github.com/sirupsen/logrus"
@@ -24,160 +29,975 @@ import (
 )
 
 var (
-	version = "v0.0.0"
+	// stdin is read for image references when an image argument is -.
+	stdin io.Reader = os.Stdin
 )
 
+const (
+	// exitFailed is the exit code used for errors that do not have a more specific exit code.
+	exitFailed = 1
+	// exitNotFound is the exit code used when an image reference is not found at any registry endpoint.
+	exitNotFound = 2
+	// exitNotPresent is the exit code used when an image is not found locally, and the pull policy is never.
+	exitNotPresent = 3
+	// exitUnauthorized is the exit code used when a registry rejects the credentials.
+	exitUnauthorized = 4
+	// exitUnreachable is the exit code used when every registry endpoint failed for another reason.
+	exitUnreachable = 5
+	// exitIllegalPath is the exit code used when the image has a file that would be extracted outside of the
+	// destination.
+	exitIllegalPath = 6
+	// exitUnsupportedFormat is the exit code used when an image archive or compression is not supported.
+	exitUnsupportedFormat = 7
+	// exitPolicyViolation is the exit code used when the image policy does not allow an image.
+	exitPolicyViolation = 8
+	// exitInterrupted is the exit code used when the operation is stopped by SIGINT or SIGTERM.
+	exitInterrupted = 130
+)
+
+// shutdownTimeout is how long in-flight work is given to stop and clean up after SIGINT or SIGTERM.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
+	// cancel extraction if interrupted, so that partially written files are cleaned up
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := handleSignals(cancel)
+	defer stop()
+
+	if os.Getenv("XDG_CACHE_HOME") == "" && os.Getenv("HOME") != "" {
+		os.Setenv("XDG_CACHE_HOME", os.ExpandEnv("$HOME/.cache"))
+	}
+
+	if err := newApp(ctx).Run(os.Args); err != nil {
+		if ctx.Err() != nil {
+			logrus.Warnf("Stopped after interrupt: %v", err)
+			stop()
+			os.Exit(exitInterrupted)
+		}
+		if code := exitCode(err); code != exitFailed {
+			logrus.Errorf("Error: %v", err)
+			os.Exit(code)
+		}
+		logrus.Fatalf("Error: %v", err)
+	}
+}
+
+// exitCauses are the errors that have their own exit code, so that scripts can tell the cause of a failure apart.
+// Errors are matched in order, so that an image that was not found at any endpoint is reported as such, rather than
+// as every endpoint having failed.
+var exitCauses = []struct {
+	err  error
+	code int
+}{
+	{policy.ErrViolation, exitPolicyViolation},
+	{errNotPresent, exitNotPresent},
+	{registries.ErrNotFound, exitNotFound},
+	{registries.ErrUnauthorized, exitUnauthorized},
+	{registries.ErrAllEndpointsFailed, exitUnreachable},
+	{extract.ErrIllegalPath, exitIllegalPath},
+	{tarfile.ErrUnsupportedFormat, exitUnsupportedFormat},
+}
+
+// exitCause returns the first of the exitCauses that the error matches, and its exit code, or nil and exitFailed if
+// it matches none of them.
+func exitCause(err error) (error, int) {
+	for _, cause := range exitCauses {
+		if errors.Is(err, cause.err) {
+			return cause.err, cause.code
+		}
+	}
+	return nil, exitFailed
+}
+
+// exitCode returns the exit code for the error.
+func exitCode(err error) int {
+	_, code := exitCause(err)
+	return code
+}
+
+// newApp returns the wharfie command line application. Commands are run with the context, so that they are
+// stopped when it is cancelled.
+func newApp(ctx context.Context) *cli.App {
 	app := cli.NewApp()
 	app.Name = "wharfie"
 	app.Usage = "pulls and unpacks a container image to the local filesystem"
 	app.Description = "Supports K3s/RKE2 style repository rewrites, endpoint overrides, and auth configuration. Supports optional loading from local image tarballs or layer cache. Supports Kubelet credential provider plugins."
-	app.ArgsUsage = "<image> [<destination>|<source:destination>] [<source:destination>]"
-	app.Version = version
-	app.Action = run
+	app.ArgsUsage = "<image> [<destination>|<source:destination>] [<source:destination>]\n   wharfie [global options] --destination <destination>|<source:destination> <image> [<image>]"
+	app.Version = getBuildInfo().Version
+	cli.VersionPrinter = printVersion
+	app.EnableBashCompletion = true
+	app.Before = func(clx *cli.Context) error {
+		warnings, err := applyDefaults(clx)
+		if err != nil {
+			return err
+		}
+		if err := setupLogging(clx); err != nil {
+			return err
+		}
+		for _, warning := range warnings {
+			logrus.Warn(warning)
+		}
+		return nil
+	}
+	app.Action = timed(ctx, run)
+	app.Commands = []cli.Command{
+		{
+			Name:      "ls",
+			Usage:     "lists the contents of a container image, without extracting it",
+			ArgsUsage: "<image> [<path-prefix>]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "Output format (text, json)",
+					Value: "text",
+				},
+			},
+			Action: timed(ctx, list),
+		},
+		{
+			Name:      "pull",
+			Usage:     "pulls container images into the layer cache, without extracting them",
+			ArgsUsage: "<image>|- [<image>]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "platform",
+					Usage: "Pull the image for the given platform, as <os>/<arch>[/<variant>][:<os-version>], instead of the global --platform option",
+				},
+				cli.BoolFlag{
+					Name:  "all-platforms",
+					Usage: "Pull the images for all platforms in the image index",
+				},
+			},
+			Action: timed(ctx, pull),
+		},
+		{
+			Name:      "inspect",
+			Usage:     "prints the manifest, platforms, layers, and config of a container image, as resolved by wharfie",
+			ArgsUsage: "<image>|- [<image>]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "raw",
+					Usage: "Print the unmodified manifest or image index",
+				},
+			},
+			Action: timed(ctx, inspect),
+		},
+		{
+			Name:      "resolve",
+			Usage:     "prints the image reference pinned to the digest that the registry configuration resolves it to",
+			ArgsUsage: "<image>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "quiet, q",
+					Usage: "Print only the digest, and suppress logging other than errors",
+				},
+			},
+			Action: timed(ctx, resolve),
+		},
+		{
+			Name:      "tags",
+			Usage:     "lists the tags in a repository, as listed by the configured registry endpoints",
+			ArgsUsage: "<repository>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "Output format (text, json)",
+					Value: "text",
+				},
+				cli.BoolFlag{
+					Name:  "digests",
+					Usage: "Include the digest of each tag; requires a request per tag",
+				},
+				cli.IntFlag{
+					Name:  "digest-rate",
+					Usage: "Maximum number of digest requests per second",
+					Value: 10,
+				},
+			},
+			Action: timed(ctx, listTags),
+		},
+		{
+			Name:      "referrers",
+			Usage:     "lists the signatures, SBOMs, and other artifacts that refer to a container image, as listed by the configured registry endpoints",
+			ArgsUsage: "<image>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "artifact-type",
+					Usage: "List only referrers of the artifact type",
+				},
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "Output format (text, json)",
+					Value: "text",
+				},
+			},
+			Action: timed(ctx, listReferrers),
+		},
+		{
+			Name:      "copy",
+			Usage:     "copies a container image to another registry, preserving its digest",
+			ArgsUsage: "<src-image> <dst-image>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "all-platforms",
+					Usage: "Copy the image index and the images for all platforms, instead of only the image for the --platform option",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "List the blobs that would be transferred, and those that already exist at the destination, without copying",
+				},
+				cli.BoolFlag{
+					Name:  "include-referrers",
+					Usage: "Also copy the signatures, SBOMs, and other artifacts that refer to the image",
+				},
+			},
+			Action: timed(ctx, copyImage),
+		},
+		{
+			Name:      "validate-config",
+			Usage:     "validates the private registry configuration, and any image credential provider configuration and image policy, and prints the endpoints and configuration that apply to each image, without making any requests",
+			ArgsUsage: "[<image>...]",
+			Action:    validateConfig,
+		},
+		{
+			Name:      "login",
+			Usage:     "verifies credentials for a registry, and stores them for subsequent commands",
+			ArgsUsage: "<registry>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "username, u",
+					Usage: "Username for the registry",
+				},
+				cli.StringFlag{
+					Name:  "password, p",
+					Usage: "Password for the registry; visible to other users in the process list, so prefer --password-stdin",
+				},
+				cli.BoolFlag{
+					Name:  "password-stdin",
+					Usage: "Read the password from stdin",
+				},
+				cli.StringFlag{
+					Name:  "store",
+					Usage: "Where to store the credentials: the Docker config.json file (docker), or wharfie's own credentials file (wharfie)",
+					Value: storeDocker,
+				},
+			},
+			Action: timed(ctx, login),
+		},
+		{
+			Name:      "logout",
+			Usage:     "removes the stored credentials for a registry",
+			ArgsUsage: "<registry>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "store",
+					Usage: "Where to remove the credentials from: the Docker config.json file (docker), or wharfie's own credentials file (wharfie)",
+					Value: storeDocker,
+				},
+			},
+			Action: logout,
+		},
+		{
+			Name:      "check-auth",
+			Usage:     "reports the credentials that each credential source has for an image, and whether each endpoint accepts them",
+			ArgsUsage: "<image>",
+			Action:    timed(ctx, checkAuth),
+		},
+		{
+			Name:  "cache",
+			Usage: "manages the layer cache",
+			Subcommands: []cli.Command{
+				{
+					Name:  "stats",
+					Usage: "prints the number and size of the blobs in the layer cache, and when each was last used",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "output",
+							Usage: "Output format (text, json)",
+							Value: "text",
+						},
+					},
+					Action: timed(ctx, showCacheStats),
+				},
+				{
+					Name:  "prune",
+					Usage: "removes blobs that have not been used recently from the layer cache",
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "older-than",
+							Usage: "Remove blobs that have not been used for this long",
+							Value: 720 * time.Hour,
+						},
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "Remove all blobs",
+						},
+					},
+					Action: timed(ctx, pruneCache),
+				},
+				{
+					Name:   "verify",
+					Usage:  "hashes the blobs in the layer cache, and removes those that do not match their digest",
+					Action: timed(ctx, verifyCache),
+				},
+				{
+					Name:      "export",
+					Usage:     "writes an image pulled into the layer cache to a tarball or an OCI image layout, without downloading it again",
+					ArgsUsage: "<image> <output>",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "include-referrers",
+							Usage: "Also export the signatures, SBOMs, and other artifacts that refer to the image, from the registry; OCI image layouts only",
+						},
+					},
+					Action: timed(ctx, exportCache),
+				},
+				{
+					Name:      "import",
+					Usage:     "stores the layers of the images in local image archives in the layer cache",
+					ArgsUsage: "<tarball-or-dir>...",
+					Action:    timed(ctx, importCache),
+				},
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "manages the wharfie configuration file",
+			Subcommands: []cli.Command{
+				{
+					Name:   "view",
+					Usage:  "prints the effective value of each global option, from the command line, environment variables, configuration file, and built-in defaults",
+					Action: viewConfig,
+				},
+			},
+		},
+		{
+			Name:  "version",
+			Usage: "prints the version of wharfie, and of the libraries it was built with",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output",
+					Usage: "Output format (text, json)",
+					Value: "text",
+				},
+			},
+			Action: showVersion,
+		},
+		{
+			Name:         "completion",
+			Usage:        "prints a shell completion script for wharfie",
+			ArgsUsage:    "bash|zsh|fish",
+			Action:       completion,
+			BashComplete: completeShells,
+		},
+	}
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "private-registry",
-			Usage: "Private registry configuration file",
-			Value: "/etc/rancher/common/registries.yaml",
+			Name:      "config",
+			Usage:     "Configuration file providing defaults for global options, which are overridden by WHARFIE_<OPTION> environment variables and the command line",
+			Value:     defaultConfigFile,
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:      "private-registry",
+			Usage:     "Private registry configuration file, as YAML or JSON, or - to read it from stdin",
+			Value:     "/etc/rancher/common/registries.yaml",
+			TakesFile: true,
 		},
 		cli.StringFlag{
-			Name:  "images-dir",
-			Usage: "Images tarball directory",
+			Name:  "registry-config-json",
+			Usage: "Private registry configuration as inline JSON or YAML, instead of --private-registry",
+		},
+		cli.StringFlag{
+			Name:  "default-registry",
+			Usage: "Registry that unqualified image names refer to, instead of Docker Hub; overrides defaultRegistry in the private registry configuration",
+		},
+		cli.StringSliceFlag{
+			Name:      "images-dir",
+			Usage:     "Images tarball directory; may be specified multiple times, to search each directory in order",
+			TakesFile: true,
 		},
 		cli.BoolFlag{
 			Name:  "cache",
 			Usage: "Enable layer cache when image is not available locally",
 		},
 		cli.StringFlag{
-			Name:  "cache-dir",
-			Usage: "Layer cache directory",
-			Value: "$XDG_CACHE_HOME/rancher/wharfie",
+			Name:      "cache-dir",
+			Usage:     "Layer cache directory",
+			Value:     "$XDG_CACHE_HOME/rancher/wharfie",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:  "cache-compression",
+			Usage: "Compression of layers stored in the layer cache (none, zstd); layers already in the cache are read whatever their compression",
+			Value: "none",
+		},
+		cli.StringFlag{
+			Name:      "image-credential-provider-config",
+			Usage:     "Image credential provider configuration file",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:      "image-credential-provider-bin-dir",
+			Usage:     "Image credential provider binary directory",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:      "image-credential-provider-env",
+			Usage:     "File setting environment variables for image credential provider plugins, in addition to the env of each provider in the configuration file",
+			TakesFile: true,
+		},
+		cli.DurationFlag{
+			Name:  "image-credential-provider-timeout",
+			Usage: "Kill image credential provider plugins that do not complete within the given duration; 0 for no limit",
+			Value: plugin.DefaultTimeout,
+		},
+		cli.StringFlag{
+			Name:  "credential-order",
+			Usage: "Comma-separated order in which to try the sources of credentials for registries without credentials in the private registry configuration: plugins, docker-config",
+			Value: "plugins,docker-config",
+		},
+		cli.BoolFlag{
+			Name:  "insecure-skip-verify",
+			Usage: "Skip verification of TLS certificates for the registries of the images, unless TLS is configured for them in the private registry configuration",
+		},
+		cli.BoolFlag{
+			Name:  "insecure-all",
+			Usage: "Skip verification of TLS certificates for all registries, unless TLS is configured for them in the private registry configuration",
+		},
+		cli.BoolFlag{
+			Name:  "plain-http",
+			Usage: "Use plain HTTP for the registries of the images, unless TLS is configured for them in the private registry configuration",
+		},
+		cli.StringFlag{
+			Name:      "ca-file",
+			Usage:     "CA certificate file to verify the registries of the images with, unless TLS is configured for them in the private registry configuration",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:      "cert-file",
+			Usage:     "Client certificate file to authenticate to the registries of the images with; requires --key-file",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:      "key-file",
+			Usage:     "Client key file for --cert-file",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:  "tls-registry",
+			Usage: "Registry host to apply --ca-file, --cert-file, and --key-file to, instead of the registries of the images",
+		},
+		cli.StringFlag{
+			Name:  "username",
+			Usage: "Username for the registries of the images, instead of credentials from environment variables or the private registry configuration",
+		},
+		cli.StringFlag{
+			Name:  "password",
+			Usage: "Password for --username; visible to other users in the process list, so prefer --password-stdin",
+		},
+		cli.BoolFlag{
+			Name:  "password-stdin",
+			Usage: "Read the password for --username from stdin",
+		},
+		cli.StringFlag{
+			Name:      "auth-file",
+			Usage:     "Docker config.json file to read credentials for the registries of the images from, instead of credentials from environment variables or the private registry configuration",
+			TakesFile: true,
+		},
+		cli.StringSliceFlag{
+			Name:      "destination",
+			Usage:     "Destination to extract to, as <destination> or <source:destination>; may be specified multiple times. When set, all arguments are images",
+			TakesFile: true,
+		},
+		cli.StringFlag{
+			Name:      "image-list",
+			Usage:     "File listing images to extract, one per line; blank lines and # comments are ignored. Requires --destination",
+			TakesFile: true,
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Abort the operation if it does not complete within the given duration, such as 5m; 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "Number of times to retry resolving and pulling an image from the registry endpoints after a retryable failure",
+		},
+		cli.DurationFlag{
+			Name:  "retry-delay",
+			Usage: "Delay between retries",
+			Value: 5 * time.Second,
+		},
+		cli.IntFlag{
+			Name:  "concurrency",
+			Usage: "Number of layers to upload at once when pushing images to a registry (default 4)",
+		},
+		cli.StringFlag{
+			Name:  "pull-policy",
+			Usage: "When to pull images from the registry instead of reading them from --images-dir (ifnotpresent, always, never)",
+			Value: string(pullIfNotPresent),
+		},
+		cli.StringFlag{
+			Name:      "image-policy",
+			Usage:     "Image policy file, listing the registries and repositories that images may be pulled from, and the cosign keys that they must be signed with",
+			TakesFile: true,
+		},
+		cli.IntFlag{
+			Name:  "parallel",
+			Usage: "Number of images to extract at once",
+			Value: 1,
+		},
+		cli.BoolFlag{
+			Name:  "continue-on-error",
+			Usage: "Continue extracting the remaining images if one fails, and exit successfully",
+		},
+		cli.StringSliceFlag{
+			Name:  "layers",
+			Usage: "Extract only the selected layers: last:<count> or a layer digest; may be specified multiple times",
+		},
+		cli.StringSliceFlag{
+			Name:  "exclude",
+			Usage: "Exclude paths matching a glob pattern from extraction; may be specified multiple times",
+		},
+		cli.IntFlag{
+			Name:  "strip-components",
+			Usage: "Remove the given number of leading components from image paths before applying mappings and exclusions",
+		},
+		cli.BoolFlag{
+			Name:  "preserve-owner",
+			Usage: "Preserve file ownership from the image when extracting; requires running as root",
+		},
+		cli.StringFlag{
+			Name:  "chown",
+			Usage: "Set ownership of all extracted content to user:group, as names or numeric ids; requires running as root",
+		},
+		cli.BoolFlag{
+			Name:  "preserve-permissions",
+			Usage: "Preserve file permissions from the image, excluding setuid, setgid, and sticky bits",
+		},
+		cli.BoolFlag{
+			Name:  "preserve-special-bits",
+			Usage: "Preserve setuid, setgid, and sticky bits from the image",
+		},
+		cli.BoolFlag{
+			Name:  "devices",
+			Usage: "Create fifos and device nodes from the image; device nodes require running as root (Linux only)",
+		},
+		cli.BoolFlag{
+			Name:  "preserve-xattrs",
+			Usage: "Preserve extended attributes and file capabilities from the image (Linux only)",
+		},
+		cli.StringFlag{
+			Name:  "overwrite-policy",
+			Usage: "Handling of files that already exist at the destination (overwrite, skip, error, if-changed)",
+			Value: "overwrite",
 		},
 		cli.StringFlag{
-			Name:  "image-credential-provider-config",
-			Usage: "Image credential provider configuration file",
+			Name:  "case-collision-policy",
+			Usage: "Handling of extracted paths that differ only by case, on case-insensitive filesystems (warn, error, ignore)",
+			Value: "warn",
+		},
+		cli.BoolTFlag{
+			Name:  "atomic",
+			Usage: "Write extracted files to a temporary file and rename them into place once complete",
+		},
+		cli.StringFlag{
+			Name:      "write-manifest",
+			Usage:     "Write a JSON manifest of extracted files to the given path",
+			TakesFile: true,
 		},
 		cli.StringFlag{
-			Name:  "image-credential-provider-bin-dir",
-			Usage: "Image credential provider binary directory",
+			Name:      "write-image-metadata",
+			Usage:     "Write the image manifest, config file, and resolved digest reference as JSON files to the given directory",
+			TakesFile: true,
+		},
+		cli.Int64Flag{
+			Name:  "max-extract-size",
+			Usage: "Maximum total bytes to extract from the image; 0 is unlimited",
+		},
+		cli.IntFlag{
+			Name:  "max-extract-files",
+			Usage: "Maximum number of files to extract from the image; 0 is unlimited",
+		},
+		cli.BoolFlag{
+			Name:  "verify",
+			Usage: "Verify the content of extracted files against the image once extraction is complete",
+		},
+		cli.GenericFlag{
+			Name:  "dry-run",
+			Usage: "Show the image and the endpoint it would be pulled from, without writing anything to the destination; --dry-run=resolve stops there, while --dry-run or --dry-run=full also lists the files that would be extracted, which requires downloading the layers",
+			Value: new(dryRunMode),
+		},
+		cli.StringFlag{
+			Name:  "output",
+			Usage: "Output format for the dry run, or for the summary of each extracted image (text, json), or - as shorthand for --output-tar -",
+			Value: "text",
+		},
+		cli.StringFlag{
+			Name:  "output-tar",
+			Usage: "Write a tar archive of the extracted content to the given file, or to stdout if -, instead of the destination; entries are named for their destination",
+		},
+		cli.StringFlag{
+			Name:  "compress",
+			Usage: "Compress the --output-tar archive (none, gzip, zstd, lz4)",
+			Value: "none",
 		},
 		cli.BoolFlag{
 			Name:  "debug",
-			Usage: "Enable debug logging",
+			Usage: "Enable debug logging; equivalent to --log-level trace",
+		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Usage: "Log level (panic, fatal, error, warn, info, debug, trace)",
+			Value: "info",
+		},
+		cli.StringFlag{
+			Name:  "log-format",
+			Usage: "Log format (text, json)",
+			Value: "text",
+		},
+		cli.BoolFlag{
+			Name:  "trace-requests",
+			Usage: "Log each registry request and response, with credentials redacted, and its DNS, connect, TLS handshake, and time to first byte, regardless of the log level; the timings for each endpoint are summarized at exit",
+		},
+		cli.BoolFlag{
+			Name:  "quiet",
+			Usage: "Suppress logging other than errors, and layer download progress, so that only the result of the command is printed to stdout",
+		},
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Select images for the given platform, as <os>/<arch>[/<variant>][:<os-version>], instead of the machine platform",
+		},
+		cli.StringFlag{
+			Name:  "os-version",
+			Usage: "Select images for the given operating system version, such as a Windows build; overrides the <os-version> of --platform",
+		},
+		cli.BoolFlag{
+			Name:  "all-platforms",
+			Usage: "Pull or copy the images for all platforms in the image index; not supported when extracting",
 		},
 		cli.StringFlag{
 			Name:  "arch",
-			Usage: "Override the machine architecture",
+			Usage: "Override the machine architecture (deprecated: use --platform)",
 			Value: runtime.GOARCH,
 		},
 		cli.StringFlag{
 			Name:  "os",
-			Usage: "Override the machine operating system",
+			Usage: "Override the machine operating system (deprecated: use --platform)",
 			Value: runtime.GOOS,
 		},
 	}
+	app.Flags = append(app.Flags, logTargetFlags...)
+	return app
+}
 
-	if os.Getenv("XDG_CACHE_HOME") == "" && os.Getenv("HOME") != "" {
-		os.Setenv("XDG_CACHE_HOME", os.ExpandEnv("$HOME/.cache"))
-	}
+// handleSignals cancels the operation when SIGINT or SIGTERM is received, so that in-flight extraction can stop and
+// clean up after itself. If the operation has not stopped within shutdownTimeout, or a second signal is received,
+// the process exits immediately. The returned function stops handling signals.
+func handleSignals(cancel context.CancelFunc) func() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	var once sync.Once
 
-	if err := app.Run(os.Args); err != nil {
-		if !errors.Is(err, context.Canceled) {
-			logrus.Fatalf("Error: %v", err)
+	go func() {
+		select {
+		case sig := <-signals:
+			logrus.Warnf("Received %s, stopping; signal again to exit immediately", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-signals:
+			logrus.Warnf("Received %s, exiting immediately", sig)
+		case <-time.After(shutdownTimeout):
+			logrus.Warnf("Timed out after %s waiting for cleanup, exiting", shutdownTimeout)
+		case <-done:
+			return
 		}
+		os.Exit(exitInterrupted)
+	}()
+
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+		})
 	}
 }
 
-func run(clx *cli.Context) error {
-	var img v1.Image
+// phaseKey is the context key for the phase of the operation that is in progress.
+type phaseKey struct{}
 
-	if len(clx.Args()) < 2 {
-		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <image> and <destination> are required arguments.\n\n")
-		cli.ShowAppHelpAndExit(clx, 1)
+// timed returns an action that runs the command with a deadline, if a timeout is set. If the deadline is exceeded,
+// the error identifies the phase of the operation that was in progress, as last recorded with setPhase.
+func timed(ctx context.Context, command func(context.Context, *cli.Context) error) func(*cli.Context) error {
+	return func(clx *cli.Context) error {
+		timeout := clx.GlobalDuration("timeout")
+		if timeout < 0 {
+			return fmt.Errorf("invalid timeout %s: must not be negative", timeout)
+		}
+		if timeout == 0 {
+			return command(ctx, clx)
+		}
+
+		phase := &atomic.Value{}
+		phase.Store("starting")
+		ctx, cancel := context.WithTimeout(context.WithValue(ctx, phaseKey{}, phase), timeout)
+		defer cancel()
+
+		err := command(ctx, clx)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return errors.Wrapf(err, "operation timed out after %s while %s", timeout, phase.Load())
+		}
+		return err
+	}
+}
+
+// setPhase records the phase of the operation that is in progress, for timeout errors. When images are processed
+// in parallel, the most recently started phase is recorded.
+func setPhase(ctx context.Context, format string, args ...interface{}) {
+	if phase, ok := ctx.Value(phaseKey{}).(*atomic.Value); ok {
+		phase.Store(fmt.Sprintf(format, args...))
 	}
+}
 
-	if clx.Bool("debug") {
-		logrus.SetLevel(logrus.TraceLevel)
+// setupLogging configures the log level and format. JSON logs carry the image, endpoint, and path of each
+// message as separate fields, so that they can be queried by log aggregators.
+func setupLogging(clx *cli.Context) error {
+	switch format := clx.String("log-format"); format {
+	case "text":
+		// color codes are only written to terminals, so that they do not end up in log files or service logs
+		logrus.SetFormatter(&logrus.TextFormatter{DisableColors: !isTerminal(logrus.StandardLogger().Out)})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unsupported log format %q; supported formats: text, json", format)
+	}
+	if err := setupLogTarget(clx); err != nil {
+		return err
 	}
 
-	ref, err := name.ParseReference(clx.Args().Get(0))
+	level, err := logrus.ParseLevel(clx.String("log-level"))
 	if err != nil {
 		return err
 	}
+	if clx.Bool("debug") {
+		level = logrus.TraceLevel
+	}
+	if clx.Bool("quiet") {
+		level = logrus.ErrorLevel
+	}
+	logrus.SetLevel(level)
 
-	// destination is one or more bare local paths to extract to on the host, or
-	// image-path:local-path pairs if the content should be extracted to specific
-	// locations.
-	dirs := map[string]string{}
-	for i := 1; i < clx.NArg(); i++ {
-		var source, destination string
-		destination = clx.Args().Get(i)
-		parts := strings.SplitN(destination, ":", 2)
-		if len(parts) == 2 {
-			source, destination = parts[0], parts[1]
-		} else {
-			source, destination = "/", parts[0]
-		}
-		destination, err := filepath.Abs(os.ExpandEnv(destination))
-		if err != nil {
-			return err
-		}
-		logrus.Infof("Extract mapping %s => %s", source, destination)
-		dirs[source] = destination
+	// registry requests are logged by go-containerregistry, which redacts credentials and blob content
+	if clx.Bool("trace-requests") {
+		logs.Debug.SetOutput(os.Stderr)
 	}
+	return nil
+}
 
-	if clx.IsSet("images-dir") {
-		imagesDir, err := filepath.Abs(os.ExpandEnv(clx.String("images-dir")))
-		if err != nil {
-			return err
-		}
+// quiet returns true if --quiet is set, either globally or for the command. Only errors are logged, and only the
+// result of the command is printed to stdout.
+func quiet(clx *cli.Context) bool {
+	return clx.Bool("quiet") || clx.GlobalBool("quiet")
+}
 
-		i, err := tarfile.FindImage(imagesDir, ref)
-		if err != nil && !errors.Is(err, tarfile.ErrNotFound) {
-			return err
-		}
-		img = i
+// imageArgs returns the image references and destinations to extract them to. If destinations are passed with
+// --destination, or images are read from --image-list, all arguments are image references. Otherwise, the first
+// argument is the image reference, and the remaining arguments are destinations.
+func imageArgs(clx *cli.Context) ([]name.Reference, []string, error) {
+	args := []string(clx.Args())
+	images := []string{}
+	destinations := clx.StringSlice("destination")
+	if len(destinations) > 0 || clx.IsSet("image-list") {
+		images = args
+	} else if len(args) > 0 {
+		images, destinations = args[:1], args[1:]
 	}
 
-	if img == nil {
-		registry, err := registries.GetPrivateRegistries(clx.String("private-registry"))
+	if imageList := clx.String("image-list"); imageList != "" {
+		listed, err := readImageList(os.ExpandEnv(imageList))
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
+		images = append(images, listed...)
+	}
 
-		// Next check Kubelet image credential provider plugins, if configured
-		if clx.IsSet("image-credential-provider-config") && clx.IsSet("image-credential-provider-bin-dir") {
-			plugins, err := plugin.RegisterCredentialProviderPlugins(clx.String("image-credential-provider-config"), clx.String("image-credential-provider-bin-dir"))
+	if len(images) == 0 || len(destinations) == 0 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <image> and <destination> are required arguments.\n\n")
+		cli.ShowAppHelpAndExit(clx, 1)
+	}
+
+	options, err := referenceOptions(clx)
+	if err != nil {
+		return nil, nil, err
+	}
+	refs, err := parseImages(images, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	return refs, destinations, nil
+}
+
+// parseImages parses the image arguments with the options. An argument of - is replaced by the image references read
+// from stdin, one per line.
+func parseImages(images []string, options []name.Option) ([]name.Reference, error) {
+	refs := make([]name.Reference, 0, len(images))
+	read := false
+	for _, image := range images {
+		if image != "-" {
+			ref, err := name.ParseReference(image, options...)
 			if err != nil {
-				return err
-			}
-			registry.DefaultKeychain = plugins
-		} else {
-			// The kubelet image credential provider plugin also falls back to checking legacy Docker credentials, so only
-			// explicitly set up the go-containerregistry DefaultKeychain if plugins are not configured.
-			// DefaultKeychain tries to read config from the home dir, and will error if HOME isn't set, so also gate on that.
-			if os.Getenv("HOME") != "" {
-				registry.DefaultKeychain = authn.DefaultKeychain
+				return nil, err
 			}
+			refs = append(refs, ref)
+			continue
 		}
 
-		logrus.Infof("Pulling image reference %s", ref.Name())
-		img, err = registry.Image(ref, remote.WithPlatform(v1.Platform{Architecture: clx.String("arch"), OS: clx.String("os")}))
+		// stdin can only be read once
+		if read {
+			return nil, errors.New("- cannot be given more than once")
+		}
+		read = true
+		listed, err := readImages(stdin)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read image references from stdin")
+		}
+		if len(listed) == 0 {
+			return nil, errors.New("no image references were read from stdin")
+		}
+		stdinRefs, err := parseImages(listed, options)
 		if err != nil {
-			return errors.Wrapf(err, "failed to get image reference %s", ref.Name())
+			return nil, err
 		}
+		refs = append(refs, stdinRefs...)
+	}
+	return refs, nil
+}
 
-		if clx.Bool("cache") {
-			cacheDir, err := filepath.Abs(os.ExpandEnv(clx.String("cache-dir")))
-			if err != nil {
-				return err
+// readImageList returns the image references listed in a file, one per line. Blank lines and comments
+// starting with # are ignored.
+func readImageList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open image list")
+	}
+	defer f.Close()
+
+	images, err := readImages(f)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read image list")
+	}
+	return images, nil
+}
+
+// readImages returns the image references read from r, one per line. Blank lines and comments starting with #
+// are ignored.
+func readImages(r io.Reader) ([]string, error) {
+	images := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			images = append(images, line)
+		}
+	}
+	return images, scanner.Err()
+}
+
+// eachImage calls f for each of the images in turn, or for up to --parallel images at once. The output of each
+// image is buffered, and written in the order that the images were given once all have finished, so that it does
+// not depend on which images finish first. Failures are logged and reported once all images have finished. Unless
+// --continue-on-error is set, no further images are started once one has failed, and an error is returned if any
+// image failed. The verb and its past tense describe what is done to each image, for log messages and errors.
+func eachImage(ctx context.Context, clx *cli.Context, refs []name.Reference, verb, past string, f func(context.Context, name.Reference, io.Writer) error) error {
+	parallel := clx.GlobalInt("parallel")
+	if parallel < 1 {
+		return fmt.Errorf("invalid parallel value %d: must be at least 1", parallel)
+	}
+	continueOnError := clx.GlobalBool("continue-on-error")
+	errs := make([]error, len(refs))
+	outputs := make([]bytes.Buffer, len(refs))
+	sem := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	failed := atomic.Bool{}
+	started := 0
+
+	for i, ref := range refs {
+		sem <- struct{}{}
+		if ctx.Err() != nil || (failed.Load() && !continueOnError) {
+			break
+		}
+		started++
+		wg.Add(1)
+		go func(i int, ref name.Reference) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := f(ctx, ref, &outputs[i]); err != nil {
+				logrus.WithField("image", ref.Name()).WithError(err).Errorf("Failed to %s image", verb)
+				errs[i] = err
+				failed.Store(true)
 			}
-			logrus.Infof("Using layer cache %s", cacheDir)
-			imageCache := cache.NewFilesystemCache(cacheDir)
-			img = cache.Image(img, imageCache)
+		}(i, ref)
+	}
+	wg.Wait()
+
+	for i := range outputs {
+		if _, err := outputs[i].WriteTo(clx.App.Writer); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	failures := []string{}
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, refs[i].Name())
+		}
+	}
+	if len(failures) == 0 {
+		logrus.Infof("%s %d images", past, len(refs))
+		return nil
+	}
+	if skipped := len(refs) - started; skipped > 0 {
+		logrus.Warnf("Skipped %d images after failing to %s an image", skipped, verb)
+	}
+	if continueOnError {
+		logrus.Warnf("Failed to %s %d of %d images: %s", verb, len(failures), len(refs), strings.Join(failures, ", "))
+		return nil
+	}
+	// the cause of the failures is only reported if it is why all of them failed, so that the exit code reflects it
+	var cause error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		c, _ := exitCause(err)
+		if c == nil || (cause != nil && c != cause) {
+			return fmt.Errorf("failed to %s %d of %d images: %s", verb, len(failures), len(refs), strings.Join(failures, ", "))
 		}
+		cause = c
 	}
+	return fmt.Errorf("failed to %s %d of %d images: %s: %w", verb, len(failures), len(refs), strings.Join(failures, ", "), cause)
+}
 
-	return extract.ExtractDirs(img, dirs)
+// formatSize formats a size in bytes using binary units.
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
 }
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/extract"
+	"github.com/rancher/wharfie/pkg/policy"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/rancher/wharfie/pkg/tarfile"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// TestMain runs wharfie itself instead of the tests when WHARFIE_TEST_MAIN is set, so that tests can run it
+// as a child process and send it signals.
+func TestMain(m *testing.M) {
+	if os.Getenv("WHARFIE_TEST_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testRegistry returns a registry without configuration, which uses the default endpoint for each registry.
+func testRegistry(t *testing.T) imageRegistry {
+	registry, err := registries.GetPrivateRegistries("")
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	return registry
+}
+
+func TestStdinImages(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	digests := []string{}
+	for _, tag := range []string{"v1", "v2", "v3"} {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		ref, _ := name.ParseReference(u.Host + "/test/stdin:" + tag)
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatalf("Failed to push image: %v", err)
+		}
+		digest, _ := img.Digest()
+		digests = append(digests, ref.Context().Digest(digest.String()).Name())
+	}
+	images := strings.Join([]string{
+		"# images to pre-pull",
+		u.Host + "/test/stdin:v1",
+		"",
+		u.Host + "/test/bogus:v1",
+		u.Host + "/test/stdin:v2 # trailing comment",
+		u.Host + "/test/stdin:v3",
+	}, "\n")
+
+	testCases := map[string]struct {
+		command         func(context.Context, *cli.Context) error
+		args            []string
+		stdin           string
+		parallel        int
+		continueOnError bool
+		expected        string
+		output          []string
+		exact           bool
+	}{
+		"pull with failure": {
+			command:  pull,
+			exact:    true,
+			args:     []string{"-"},
+			stdin:    images,
+			parallel: 1,
+			expected: "failed to pull 1 of 4 images: " + u.Host + "/test/bogus:v1: " + registries.ErrNotFound.Error(),
+			output:   digests[:1],
+		},
+		"pull with failure and continue on error": {
+			command:         pull,
+			exact:           true,
+			args:            []string{"-"},
+			stdin:           images,
+			parallel:        1,
+			continueOnError: true,
+			output:          digests,
+		},
+		"pull in parallel": {
+			command:         pull,
+			exact:           true,
+			args:            []string{"-"},
+			stdin:           images,
+			parallel:        4,
+			continueOnError: true,
+			output:          digests,
+		},
+		"pull with arguments": {
+			command:  pull,
+			exact:    true,
+			args:     []string{u.Host + "/test/stdin:v1", "-"},
+			stdin:    u.Host + "/test/stdin:v3",
+			parallel: 1,
+			output:   []string{digests[0], digests[2]},
+		},
+		"inspect with failure": {
+			command:         inspect,
+			args:            []string{"-"},
+			stdin:           images,
+			parallel:        4,
+			continueOnError: true,
+			output:          []string{`"reference": "` + u.Host + `/test/stdin:v1"`, `"reference": "` + u.Host + `/test/stdin:v2"`, `"reference": "` + u.Host + `/test/stdin:v3"`},
+		},
+		"empty stdin": {
+			command:  pull,
+			args:     []string{"-"},
+			stdin:    "# nothing to pull\n",
+			parallel: 1,
+			expected: "no image references were read from stdin",
+		},
+		"stdin twice": {
+			command:  pull,
+			args:     []string{"-", "-"},
+			stdin:    images,
+			parallel: 1,
+			expected: "- cannot be given more than once",
+		},
+	}
+
+	defer func(r io.Reader) { stdin = r }(stdin)
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			stdin = strings.NewReader(tc.stdin)
+			dir := t.TempDir()
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("private-registry", filepath.Join(dir, "registries.yaml"), "")
+			set.String("cache-dir", filepath.Join(dir, "cache"), "")
+			set.String("platform", "linux/amd64", "")
+			set.Int("parallel", tc.parallel, "")
+			set.Bool("continue-on-error", tc.continueOnError, "")
+			if err := set.Parse(tc.args); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			app := cli.NewApp()
+			output := &bytes.Buffer{}
+			app.Writer = output
+
+			err := tc.command(context.Background(), cli.NewContext(app, set, nil))
+			if tc.expected == "" && err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if tc.expected != "" && (err == nil || err.Error() != tc.expected) {
+				t.Fatalf("Expected error %q but got %v", tc.expected, err)
+			}
+
+			// output is in the order that the images were listed, whichever finished first
+			last := -1
+			for _, line := range tc.output {
+				i := strings.Index(output.String(), line)
+				if i <= last {
+					t.Fatalf("Expected %q in order in output:\n%s", line, output)
+				}
+				last = i
+			}
+			if tc.exact && strings.Count(output.String(), "\n") != len(tc.output) {
+				t.Errorf("Expected %d lines of output but got:\n%s", len(tc.output), output)
+			}
+		})
+	}
+}
+
+// blobRecorder records the digests of the blobs that are fetched from the registry.
+type blobRecorder struct {
+	http.Handler
+	lock  sync.Mutex
+	blobs []string
+}
+
+func (h *blobRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if i := strings.Index(r.URL.Path, "/blobs/"); i >= 0 && r.Method == http.MethodGet {
+		h.lock.Lock()
+		h.blobs = append(h.blobs, r.URL.Path[i+len("/blobs/"):])
+		h.lock.Unlock()
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestExitCode(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		code int
+	}{
+		"other":              {err: errors.New("failed"), code: exitFailed},
+		"not present":        {err: errors.Wrap(errNotPresent, "registry.example.com/test/app:v1"), code: exitNotPresent},
+		"not found":          {err: errors.Wrap(&registries.EndpointsError{Errs: []error{&transport.Error{StatusCode: http.StatusNotFound}}}, "failed to get image"), code: exitNotFound},
+		"unreachable":        {err: errors.Wrap(&registries.EndpointsError{Errs: []error{errors.New("connection refused")}}, "failed to get image"), code: exitUnreachable},
+		"illegal path":       {err: fmt.Errorf("failed to extract image: %w", errors.Wrap(extract.ErrIllegalPath, "../etc/passwd")), code: exitIllegalPath},
+		"unsupported format": {err: errors.Wrap(tarfile.ErrUnsupportedFormat, "failed to read image archive"), code: exitUnsupportedFormat},
+		"multiple images":    {err: fmt.Errorf("failed to pull 2 of 2 images: %w", registries.ErrUnauthorized), code: exitUnauthorized},
+		"policy violation":   {err: errors.Wrap(&policy.Violation{Image: "registry.example.com/test/app:v1", Rule: "default", Reason: "not allowed by any rule"}, "failed to pull image"), code: exitPolicyViolation},
+	}
+	for testName, tc := range tests {
+		t.Run(testName, func(t *testing.T) {
+			if code := exitCode(tc.err); code != tc.code {
+				t.Errorf("Expected exit code %d for %v but got %d", tc.code, tc.err, code)
+			}
+		})
+	}
+
+	// wharfie exits with the code for the cause of failures pulling from registries
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	registryTests := map[string]struct {
+		server string
+		code   int
+	}{
+		"unauthorized": {server: unauthorized.URL, code: exitUnauthorized},
+		"unreachable":  {server: unreachable.URL, code: exitUnreachable},
+	}
+	for testName, tc := range registryTests {
+		t.Run(testName, func(t *testing.T) {
+			dir := t.TempDir()
+			u, _ := url.Parse(tc.server)
+			stderr := &bytes.Buffer{}
+			cmd := exec.Command(os.Args[0], "--private-registry", filepath.Join(dir, "registries.yaml"), "pull", u.Host+"/test/app:v1", u.Host+"/test/app:v2")
+			cmd.Env = append(os.Environ(), "WHARFIE_TEST_MAIN=1", "DOCKER_CONFIG="+dir)
+			cmd.Stderr = stderr
+			err := cmd.Run()
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != tc.code {
+				t.Errorf("Expected exit code %d but got %v: %s", tc.code, err, stderr)
+			}
+		})
+	}
+}
+
+func TestQuietOutput(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, err := name.ParseReference(u.Host + "/test/quiet:latest")
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	digest, _ := img.Digest()
+	dir := t.TempDir()
+
+	testCases := map[string]struct {
+		args   []string
+		stdout string
+		logged bool
+	}{
+		"resolve with command flag": {
+			args:   []string{"resolve", ref.Name(), "--quiet"},
+			stdout: digest.String() + "\n",
+		},
+		"resolve with global flag": {
+			args:   []string{"--quiet", "resolve", ref.Name()},
+			stdout: digest.String() + "\n",
+		},
+		"resolve without quiet": {
+			args:   []string{"resolve", ref.Name()},
+			stdout: ref.Name() + "@" + digest.String() + "\n",
+			logged: true,
+		},
+		"pull": {
+			args:   []string{"--quiet", "--cache-dir", filepath.Join(dir, "cache"), "pull", ref.Name()},
+			stdout: digest.String() + "\n",
+		},
+		"pull without quiet": {
+			args:   []string{"--cache-dir", filepath.Join(dir, "cache"), "pull", ref.Name()},
+			stdout: ref.Context().Digest(digest.String()).Name() + "\n",
+			logged: true,
+		},
+		"extract": {
+			args:   []string{"--quiet", ref.Name(), filepath.Join(dir, "quiet")},
+			stdout: filepath.Join(dir, "quiet") + "\n",
+		},
+		"extract without quiet": {
+			args:   []string{ref.Name(), filepath.Join(dir, "extract")},
+			logged: true,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+			cmd := exec.Command(os.Args[0], append([]string{"--private-registry", filepath.Join(dir, "registries.yaml")}, tc.args...)...)
+			cmd.Env = append(os.Environ(), "WHARFIE_TEST_MAIN=1")
+			cmd.Stdout = stdout
+			cmd.Stderr = stderr
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("Failed to run wharfie: %v\n%s", err, stderr)
+			}
+			if stdout.String() != tc.stdout {
+				t.Errorf("Expected stdout %q but got %q", tc.stdout, stdout)
+			}
+			if tc.logged && !strings.Contains(stderr.String(), "level=info") {
+				t.Errorf("Expected info logs on stderr but got %q", stderr)
+			}
+			if !tc.logged && stderr.Len() != 0 {
+				t.Errorf("Expected nothing on stderr but got %q", stderr)
+			}
+		})
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer func(formatter logrus.Formatter, level logrus.Level, output io.Writer) {
+		logrus.SetFormatter(formatter)
+		logrus.SetLevel(level)
+		logrus.SetOutput(output)
+	}(logrus.StandardLogger().Formatter, logrus.GetLevel(), logrus.StandardLogger().Out)
+
+	newContext := func(args ...string) *cli.Context {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("log-format", "text", "")
+		set.String("log-level", "info", "")
+		set.Bool("debug", false, "")
+		if err := set.Parse(args); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		return cli.NewContext(cli.NewApp(), set, nil)
+	}
+
+	for _, args := range [][]string{{"--log-format", "logfmt"}, {"--log-level", "verbose"}} {
+		if err := setupLogging(newContext(args...)); err == nil {
+			t.Errorf("Expected error setting up logging with %v", args)
+		}
+	}
+
+	logrus.SetOutput(&bytes.Buffer{})
+	if err := setupLogging(newContext("--log-level", "warn", "--debug")); err != nil {
+		t.Fatalf("Failed to set up logging: %v", err)
+	}
+	if level := logrus.GetLevel(); level != logrus.TraceLevel {
+		t.Errorf("Expected --debug to set level trace but got %s", level)
+	}
+	if formatter, ok := logrus.StandardLogger().Formatter.(*logrus.TextFormatter); !ok || !formatter.DisableColors {
+		t.Errorf("Expected text formatter without colors for output that is not a terminal, got %#v", logrus.StandardLogger().Formatter)
+	}
+
+	if err := setupLogging(newContext("--log-format", "json", "--log-level", "debug")); err != nil {
+		t.Fatalf("Failed to set up logging: %v", err)
+	}
+	if level := logrus.GetLevel(); level != logrus.DebugLevel {
+		t.Errorf("Expected level debug but got %s", level)
+	}
+	output := &bytes.Buffer{}
+	logrus.SetOutput(output)
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, _ := name.ParseReference(u.Host + "/test/logging:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+
+	source := &imageSource{
+		clx:      newContext(),
+		platform: v1.Platform{OS: "linux", Architecture: "amd64"},
+		registry: testRegistry(t),
+	}
+	source.once.Do(func() {})
+	if _, err := source.Image(context.Background(), ref); err != nil {
+		t.Fatalf("Failed to get image: %v", err)
+	}
+
+	events := map[string]map[string]interface{}{}
+	decoder := json.NewDecoder(output)
+	for decoder.More() {
+		event := map[string]interface{}{}
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatalf("Failed to decode log output %q: %v", output.String(), err)
+		}
+		events[event["msg"].(string)] = event
+	}
+
+	expected := map[string]map[string]interface{}{
+		"Pulling image":           {"level": "info", "image": ref.Name()},
+		"Trying endpoint":         {"level": "debug", "image": ref.Name(), "endpoint": server.URL + "/v2"},
+		"Got image from endpoint": {"level": "debug", "image": ref.Name(), "endpoint": server.URL + "/v2"},
+	}
+	for msg, fields := range expected {
+		event, ok := events[msg]
+		if !ok {
+			t.Errorf("Expected %q to be logged, got %v", msg, events)
+			continue
+		}
+		for key, value := range fields {
+			if event[key] != value {
+				t.Errorf("Expected %q to be logged with %s=%v, got %v", msg, key, value, event)
+			}
+		}
+	}
+}
+
+// stallingHandler serves the first half of each blob, then stalls until the request is cancelled, so that a
+// client is left partway through reading it.
+type stallingHandler struct {
+	http.Handler
+}
+
+func (h stallingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !strings.Contains(r.URL.Path, "/blobs/") {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+	recorder := httptest.NewRecorder()
+	h.Handler.ServeHTTP(recorder, r)
+	body := recorder.Body.Bytes()
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(recorder.Code)
+	w.Write(body[:len(body)/2])
+	w.(http.Flusher).Flush()
+	<-r.Context().Done()
+}
+
+func TestInterrupt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Interrupting a child process is not supported on Windows")
+	}
+
+	// a single large file that cannot be compressed, so that half of the layer is partway through it
+	content := make([]byte, 4<<20)
+	rand.New(rand.NewSource(0)).Read(content)
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "large", Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))})
+	tw.Write(content)
+	tw.Close()
+	layer, err := tarball.LayerFromReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	img, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+
+	server := httptest.NewServer(stallingHandler{registry.New()})
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	ref, _ := name.ParseReference(u.Host + "/test/interrupt:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+
+	for _, atomic := range []bool{true, false} {
+		t.Run(fmt.Sprintf("atomic=%t", atomic), func(t *testing.T) {
+			dir := t.TempDir()
+			destination := filepath.Join(dir, "extract")
+			stderr := &bytes.Buffer{}
+			cmd := exec.Command(os.Args[0], "--private-registry", filepath.Join(dir, "registries.yaml"), fmt.Sprintf("--atomic=%t", atomic), ref.Name(), destination)
+			cmd.Env = append(os.Environ(), "WHARFIE_TEST_MAIN=1")
+			cmd.Stderr = stderr
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("Failed to start wharfie: %v", err)
+			}
+
+			// wait for extraction of the file to start
+			started := false
+			for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline) && !started; time.Sleep(10 * time.Millisecond) {
+				entries, _ := os.ReadDir(destination)
+				for _, entry := range entries {
+					if strings.Contains(entry.Name(), "large") {
+						started = true
+					}
+				}
+			}
+			if !started {
+				cmd.Process.Kill()
+				cmd.Wait()
+				t.Fatalf("Extraction did not start: %s", stderr)
+			}
+
+			if err := cmd.Process.Signal(os.Interrupt); err != nil {
+				t.Fatalf("Failed to interrupt wharfie: %v", err)
+			}
+			err := cmd.Wait()
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitInterrupted {
+				t.Errorf("Expected exit code %d but got %v: %s", exitInterrupted, err, stderr)
+			}
+			if strings.Contains(stderr.String(), "level=fatal") {
+				t.Errorf("Expected no fatal error to be logged: %s", stderr)
+			}
+
+			entries, err := os.ReadDir(destination)
+			if err != nil {
+				t.Fatalf("Failed to read destination: %v", err)
+			}
+			for _, entry := range entries {
+				t.Errorf("Expected partially extracted file %s to be removed", entry.Name())
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Package credentialprovider combines the sources of registry credentials that wharfie supports into a single
+// keychain. Kubelet image credential provider plugins are in the plugin subpackage.
+package credentialprovider
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/sirupsen/logrus"
+)
+
+// namedKeychain is a keychain with a name to identify it in logs.
+type namedKeychain struct {
+	authn.Keychain
+	name string
+}
+
+// Named returns the keychain with a name, which NewChainKeychain logs when the keychain supplies credentials.
+func Named(name string, keychain authn.Keychain) authn.Keychain {
+	return &namedKeychain{Keychain: keychain, name: name}
+}
+
+// chainKeychain tries each of its keychains in order.
+type chainKeychain struct {
+	keychains []authn.Keychain
+}
+
+// Explicit interface checks
+var _ authn.Keychain = &chainKeychain{}
+var _ registries.RotatingKeychain = &chainKeychain{}
+var _ registries.InvalidatingKeychain = &chainKeychain{}
+
+// NewChainKeychain returns a keychain that asks each of the keychains for credentials in order, and uses the answer
+// of the first that does not return anonymous access. Unlike authn.NewMultiKeychain, a keychain that returns an error
+// does not stop the others from being asked; its error is only returned if none of them have credentials. Nil
+// keychains are skipped.
+func NewChainKeychain(keychains ...authn.Keychain) authn.Keychain {
+	chain := &chainKeychain{}
+	for _, keychain := range keychains {
+		if keychain != nil {
+			chain.keychains = append(chain.keychains, keychain)
+		}
+	}
+	return chain
+}
+
+// Resolve returns the credentials of the first keychain that has any for the target.
+func (c *chainKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	authenticators, err := c.resolve(target, false)
+	if err != nil {
+		return nil, err
+	}
+	return authenticators[0], nil
+}
+
+// ResolveAll returns all of the credentials of the first keychain that has any for the target, if it is a
+// registries.RotatingKeychain, so that each of them can be tried if the registry rejects the first.
+func (c *chainKeychain) ResolveAll(target authn.Resource) ([]authn.Authenticator, error) {
+	return c.resolve(target, true)
+}
+
+// Invalidate drops any credentials that the keychains have cached for the target, if they are
+// registries.InvalidatingKeychains, so that they are looked up again.
+func (c *chainKeychain) Invalidate(target authn.Resource) {
+	for _, keychain := range c.keychains {
+		if named, ok := keychain.(*namedKeychain); ok {
+			keychain = named.Keychain
+		}
+		if invalidating, ok := keychain.(registries.InvalidatingKeychain); ok {
+			invalidating.Invalidate(target)
+		}
+	}
+}
+
+func (c *chainKeychain) resolve(target authn.Resource, all bool) ([]authn.Authenticator, error) {
+	var firstErr error
+	for i, keychain := range c.keychains {
+		authenticators, err := resolve(keychain, target, all)
+		if err != nil {
+			logrus.Debugf("Failed to get credentials for %s from %s: %v", target, keychainName(i, keychain), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if authenticators[0] != authn.Anonymous {
+			logrus.Debugf("Using credentials from %s for %s", keychainName(i, keychain), target)
+			return authenticators, nil
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return []authn.Authenticator{authn.Anonymous}, nil
+}
+
+// resolve returns the credentials of the keychain for the target; all of them if requested and the keychain can
+// return more than one. At least one authenticator is returned if there is no error.
+func resolve(keychain authn.Keychain, target authn.Resource, all bool) ([]authn.Authenticator, error) {
+	if named, ok := keychain.(*namedKeychain); ok {
+		keychain = named.Keychain
+	}
+	if rotating, ok := keychain.(registries.RotatingKeychain); ok && all {
+		authenticators, err := rotating.ResolveAll(target)
+		if err != nil {
+			return nil, err
+		}
+		if len(authenticators) == 0 {
+			return []authn.Authenticator{authn.Anonymous}, nil
+		}
+		return authenticators, nil
+	}
+	authenticator, err := keychain.Resolve(target)
+	if err != nil {
+		return nil, err
+	}
+	return []authn.Authenticator{authenticator}, nil
+}
+
+// keychainName returns the name of the keychain at the index of the chain, for logging.
+func keychainName(i int, keychain authn.Keychain) string {
+	if named, ok := keychain.(*namedKeychain); ok {
+		return named.name
+	}
+	return fmt.Sprintf("keychain %d (%T)", i+1, keychain)
+}
@@ -0,0 +1,170 @@
+package credentialprovider
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/sirupsen/logrus"
+)
+
+// fakeKeychain returns its authenticators, or its error, for every target.
+type fakeKeychain struct {
+	authenticators []authn.Authenticator
+	err            error
+}
+
+func (k *fakeKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	return k.authenticators[0], nil
+}
+
+func (k *fakeKeychain) ResolveAll(authn.Resource) ([]authn.Authenticator, error) {
+	if k.err != nil {
+		return nil, k.err
+	}
+	return k.authenticators, nil
+}
+
+// simpleKeychain implements authn.Keychain only.
+type simpleKeychain struct {
+	authenticator authn.Authenticator
+}
+
+func (k *simpleKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return k.authenticator, nil
+}
+
+func TestChainKeychain(t *testing.T) {
+	first := &authn.Basic{Username: "first"}
+	second := &authn.Basic{Username: "second"}
+	third := &authn.Basic{Username: "third"}
+	anonymous := &fakeKeychain{authenticators: []authn.Authenticator{authn.Anonymous}}
+	failing := &fakeKeychain{err: errors.New("plugin failed")}
+
+	tests := map[string]struct {
+		keychains []authn.Keychain
+		expected  []string
+		all       []string
+		err       string
+		log       string
+	}{
+		"first keychain wins": {
+			keychains: []authn.Keychain{Named("plugins", &fakeKeychain{authenticators: []authn.Authenticator{first, second}}), &simpleKeychain{third}},
+			expected:  []string{"first"},
+			all:       []string{"first", "second"},
+			log:       "Using credentials from plugins for registry.example.com/team/app",
+		},
+		"anonymous falls through": {
+			keychains: []authn.Keychain{Named("plugins", anonymous), Named("docker config", &simpleKeychain{third})},
+			expected:  []string{"third"},
+			all:       []string{"third"},
+			log:       "Using credentials from docker config for registry.example.com/team/app",
+		},
+		"error falls through": {
+			keychains: []authn.Keychain{Named("plugins", failing), nil, &simpleKeychain{third}},
+			expected:  []string{"third"},
+			all:       []string{"third"},
+			log:       "Using credentials from keychain 2 (*credentialprovider.simpleKeychain) for registry.example.com/team/app",
+		},
+		"error without credentials": {
+			keychains: []authn.Keychain{anonymous, failing},
+			err:       "plugin failed",
+		},
+		"all anonymous": {
+			keychains: []authn.Keychain{anonymous, &simpleKeychain{authn.Anonymous}},
+			expected:  []string{""},
+			all:       []string{""},
+		},
+		"no keychains": {
+			expected: []string{""},
+			all:      []string{""},
+		},
+	}
+
+	defer func(level logrus.Level) { logrus.SetLevel(level) }(logrus.GetLevel())
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	repo, err := name.NewRepository("registry.example.com/team/app")
+	if err != nil {
+		t.Fatalf("Failed to parse repository: %v", err)
+	}
+	usernames := func(authenticators ...authn.Authenticator) []string {
+		usernames := []string{}
+		for _, authenticator := range authenticators {
+			auth, err := authenticator.Authorization()
+			if err != nil {
+				t.Fatalf("Failed to get credentials: %v", err)
+			}
+			usernames = append(usernames, auth.Username)
+		}
+		return usernames
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			output := &bytes.Buffer{}
+			logrus.SetOutput(output)
+			chain := NewChainKeychain(test.keychains...)
+
+			authenticator, err := chain.Resolve(repo)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("Expected error %q but got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Failed to resolve credentials: %v", err)
+			}
+			if got := usernames(authenticator); strings.Join(got, ",") != strings.Join(test.expected, ",") {
+				t.Errorf("Expected credentials for %v but got %v", test.expected, got)
+			}
+
+			authenticators, err := chain.(registries.RotatingKeychain).ResolveAll(repo)
+			if err != nil {
+				t.Fatalf("Failed to resolve all credentials: %v", err)
+			}
+			if got := usernames(authenticators...); strings.Join(got, ",") != strings.Join(test.all, ",") {
+				t.Errorf("Expected all credentials for %v but got %v", test.all, got)
+			}
+
+			if test.log != "" && !strings.Contains(output.String(), test.log) {
+				t.Errorf("Expected log to contain %q but got:\n%s", test.log, output.String())
+			}
+		})
+	}
+}
+
+// invalidatingKeychain records the targets that it is asked to invalidate.
+type invalidatingKeychain struct {
+	simpleKeychain
+	invalidated []string
+}
+
+func (k *invalidatingKeychain) Invalidate(target authn.Resource) {
+	k.invalidated = append(k.invalidated, target.String())
+}
+
+func TestChainKeychainInvalidate(t *testing.T) {
+	first := &invalidatingKeychain{simpleKeychain: simpleKeychain{authn.Anonymous}}
+	second := &invalidatingKeychain{simpleKeychain: simpleKeychain{&authn.Basic{Username: "second"}}}
+	chain := NewChainKeychain(Named("plugins", first), &simpleKeychain{authn.Anonymous}, second)
+
+	repo, err := name.NewRepository("registry.example.com/team/app")
+	if err != nil {
+		t.Fatalf("Failed to parse repository: %v", err)
+	}
+	chain.(registries.InvalidatingKeychain).Invalidate(repo)
+	for i, keychain := range []*invalidatingKeychain{first, second} {
+		if strings.Join(keychain.invalidated, ",") != repo.String() {
+			t.Errorf("Expected keychain %d to be invalidated for %s, but got %v", i+1, repo, keychain.invalidated)
+		}
+	}
+}
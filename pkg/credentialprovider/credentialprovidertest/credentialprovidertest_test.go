@@ -0,0 +1,102 @@
+package credentialprovidertest_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/rancher/wharfie/pkg/credentialprovider/credentialprovidertest"
+	"github.com/rancher/wharfie/pkg/credentialprovider/plugin"
+)
+
+func TestKeychain(t *testing.T) {
+	keychain := credentialprovidertest.NewKeychain(map[string]authn.AuthConfig{
+		"registry.example.com":          {Username: "registry"},
+		"registry.example.com/team":     {Username: "team"},
+		"registry.example.com/team/app": {Username: "app"},
+		"docker.io":                     {Username: "hub"},
+	})
+
+	tests := []struct {
+		target   string
+		username string
+		key      string
+	}{
+		{target: "registry.example.com/team/app", username: "app", key: "registry.example.com/team/app"},
+		{target: "registry.example.com/team/app/sidecar", username: "app", key: "registry.example.com/team/app"},
+		{target: "registry.example.com/team/other", username: "team", key: "registry.example.com/team"},
+		{target: "registry.example.com/teams/app", username: "registry", key: "registry.example.com"},
+		{target: "library/busybox", username: "hub", key: "docker.io"},
+		{target: "registry.example.org/team/app"},
+	}
+	expected := []credentialprovidertest.Lookup{}
+	for _, test := range tests {
+		repo, err := name.NewRepository(test.target)
+		if err != nil {
+			t.Fatalf("Failed to parse repository: %v", err)
+		}
+		authenticator, err := keychain.Resolve(repo)
+		if err != nil {
+			t.Fatalf("Failed to resolve credentials for %s: %v", test.target, err)
+		}
+		if auth := credentialprovidertest.Authorization(t, authenticator); auth.Username != test.username {
+			t.Errorf("Expected credentials for %q for %s but got %+v", test.username, test.target, auth)
+		}
+		expected = append(expected, credentialprovidertest.Lookup{Target: repo.String(), Key: test.key})
+	}
+	if lookups := keychain.Lookups(); !reflect.DeepEqual(lookups, expected) {
+		t.Errorf("Expected lookups %+v but got %+v", expected, lookups)
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	dir := t.TempDir()
+	fake := credentialprovidertest.WritePlugin(t, dir, "fake-provider", credentialprovidertest.Response{
+		Auth: map[string]authn.AuthConfig{"*.example.com": {Username: "user", Password: "it's a secret"}},
+	})
+	failing := credentialprovidertest.WriteFailingPlugin(t, dir, "failing-provider", 2, "it's broken")
+	config := credentialprovidertest.WriteConfig(t, dir,
+		credentialprovidertest.Provider{Name: "fake-provider", MatchImages: []string{"*.example.com"}},
+		credentialprovidertest.Provider{Name: "failing-provider", MatchImages: []string{"*.example.org"}},
+	)
+	if err := plugin.ValidateConfig(config, dir); err != nil {
+		t.Fatalf("Expected config to be valid but got %v", err)
+	}
+	keychain, err := plugin.RegisterCredentialProviderPlugins(config, dir)
+	if err != nil {
+		t.Fatalf("Failed to register plugins: %v", err)
+	}
+
+	if requests := fake.Requests(t); len(requests) != 0 {
+		t.Errorf("Expected no requests before resolving but got %+v", requests)
+	}
+	repos := []string{"registry.example.com/team/app", "registry.example.com/team/other"}
+	for _, repository := range repos {
+		repo, _ := name.NewRepository(repository)
+		authenticator, err := keychain.Resolve(repo)
+		if err != nil {
+			t.Fatalf("Failed to resolve credentials for %s: %v", repository, err)
+		}
+		if auth := credentialprovidertest.Authorization(t, authenticator); auth.Username != "user" || auth.Password != "it's a secret" {
+			t.Errorf("Expected credentials from the response for %s but got %+v", repository, auth)
+		}
+	}
+	expected := []credentialprovidertest.Request{}
+	for _, repository := range repos {
+		expected = append(expected, credentialprovidertest.Request{APIVersion: credentialprovidertest.PluginAPIVersion, Kind: "CredentialProviderRequest", Image: repository})
+	}
+	if requests := fake.Requests(t); !reflect.DeepEqual(requests, expected) {
+		t.Errorf("Expected requests %+v but got %+v", expected, requests)
+	}
+
+	repo, _ := name.NewRepository("registry.example.org/team/app")
+	pluginErr := &plugin.PluginError{}
+	if _, err := keychain.Resolve(repo); !errors.As(err, &pluginErr) || pluginErr.ExitCode != 2 || pluginErr.Stderr != "it's broken\n" {
+		t.Errorf("Expected plugin to fail with exit code 2 and its message, but got %v", err)
+	}
+	if count := failing.Invocations(t); count != 1 {
+		t.Errorf("Expected failing plugin to be executed once but got %d", count)
+	}
+}
@@ -0,0 +1,99 @@
+// Package credentialprovidertest provides fakes for tests of programs that resolve registry credentials with wharfie's
+// keychains: a static keychain that records the credentials it was asked for, and fake kubelet image credential
+// provider plugins, with the CredentialProviderConfig files that configure them, that return canned responses and
+// record the requests that they receive.
+package credentialprovidertest
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Lookup is a request for credentials that a Keychain received.
+type Lookup struct {
+	// Target is the registry or repository that credentials were requested for, as given by its String method.
+	Target string
+	// Key is the key of the credentials that were returned, or empty if anonymous access was returned.
+	Key string
+}
+
+// Keychain is a keychain that returns fixed credentials for registries and repositories. It is safe to use from
+// multiple goroutines.
+type Keychain struct {
+	auths   map[string]authn.AuthConfig
+	keys    map[string]string
+	mu      sync.Mutex
+	lookups []Lookup
+}
+
+var _ authn.Keychain = &Keychain{}
+
+// NewKeychain returns a keychain with the credentials, keyed by the registry, such as registry.example.com:5000, or by
+// a repository, such as registry.example.com/team/app, which also applies to the repositories beneath it. The most
+// specific key that applies to a target is used; docker.io and index.docker.io are the same registry.
+func NewKeychain(auths map[string]authn.AuthConfig) *Keychain {
+	k := &Keychain{auths: map[string]authn.AuthConfig{}, keys: map[string]string{}}
+	for key, auth := range auths {
+		normalized := normalize(key)
+		k.auths[normalized] = auth
+		k.keys[normalized] = key
+	}
+	return k
+}
+
+// normalize returns the key in the form that targets are compared with: the registry as go-containerregistry names
+// it, followed by the repository if there is one.
+func normalize(key string) string {
+	if !strings.Contains(key, "/") {
+		if registry, err := name.NewRegistry(key); err == nil {
+			return registry.RegistryStr()
+		}
+		return key
+	}
+	if repo, err := name.NewRepository(key); err == nil {
+		return repo.String()
+	}
+	return key
+}
+
+// Resolve returns the credentials with the most specific key that applies to the target, or anonymous access if
+// there are none, and records the lookup.
+func (k *Keychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	match := ""
+	for key := range k.auths {
+		if (key == target.RegistryStr() || key == target.String() || strings.HasPrefix(target.String(), key+"/")) && len(key) > len(match) {
+			match = key
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if match == "" {
+		k.lookups = append(k.lookups, Lookup{Target: target.String()})
+		return authn.Anonymous, nil
+	}
+	k.lookups = append(k.lookups, Lookup{Target: target.String(), Key: k.keys[match]})
+	return authn.FromConfig(k.auths[match]), nil
+}
+
+// Lookups returns the lookups that the keychain has received, in the order they were received.
+func (k *Keychain) Lookups() []Lookup {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return append([]Lookup{}, k.lookups...)
+}
+
+// Authorization returns the credentials of the authenticator, so that tests can check which were resolved. The test
+// fails if they cannot be read.
+func Authorization(t testing.TB, authenticator authn.Authenticator) authn.AuthConfig {
+	t.Helper()
+	auth, err := authenticator.Authorization()
+	if err != nil {
+		t.Fatalf("Failed to get credentials: %v", err)
+	}
+	return *auth
+}
@@ -0,0 +1,217 @@
+package credentialprovidertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// ConfigAPIVersion is the apiVersion of the CredentialProviderConfig files that WriteConfig writes.
+	ConfigAPIVersion = "kubelet.config.k8s.io/v1"
+	// PluginAPIVersion is the apiVersion that providers and responses default to.
+	PluginAPIVersion = "credentialprovider.kubelet.k8s.io/v1"
+)
+
+// Response is the CredentialProviderResponse that a fake plugin prints.
+type Response struct {
+	// APIVersion defaults to PluginAPIVersion.
+	APIVersion string
+	// CacheKeyType defaults to Registry.
+	CacheKeyType string
+	// CacheDuration is the cacheDuration of the response, such as 0s, or omitted if it is empty.
+	CacheDuration string
+	// Auth maps the images that the credentials apply to, which may contain wildcards, to the credentials. Only the
+	// username and password are included in the response.
+	Auth map[string]authn.AuthConfig
+}
+
+// MarshalJSON encodes the response as a plugin prints it.
+func (r Response) MarshalJSON() ([]byte, error) {
+	type authConfig struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	response := struct {
+		APIVersion    string                `json:"apiVersion"`
+		Kind          string                `json:"kind"`
+		CacheKeyType  string                `json:"cacheKeyType"`
+		CacheDuration string                `json:"cacheDuration,omitempty"`
+		Auth          map[string]authConfig `json:"auth"`
+	}{
+		APIVersion:    r.APIVersion,
+		Kind:          "CredentialProviderResponse",
+		CacheKeyType:  r.CacheKeyType,
+		CacheDuration: r.CacheDuration,
+		Auth:          map[string]authConfig{},
+	}
+	if response.APIVersion == "" {
+		response.APIVersion = PluginAPIVersion
+	}
+	if response.CacheKeyType == "" {
+		response.CacheKeyType = "Registry"
+	}
+	for image, auth := range r.Auth {
+		response.Auth[image] = authConfig{Username: auth.Username, Password: auth.Password}
+	}
+	return json.Marshal(response)
+}
+
+// Request is a CredentialProviderRequest that a fake plugin received.
+type Request struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+// Plugin is a fake credential provider plugin in a bin directory.
+type Plugin struct {
+	Dir  string
+	Name string
+}
+
+// WritePlugin writes a fake plugin to the bin directory, which prints the response, and records each request that it
+// receives. Fake plugins are shell scripts, so the test is skipped on Windows.
+func WritePlugin(t testing.TB, dir, name string, response Response) *Plugin {
+	t.Helper()
+	b, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		t.Fatalf("Failed to encode credential provider response: %v", err)
+	}
+	return WriteScript(t, dir, name, fmt.Sprintf("cat <<'EOF'\n%s\nEOF\n", b))
+}
+
+// WriteFailingPlugin writes a fake plugin to the bin directory, which writes the message to stderr and exits with the
+// exit code, and records each request that it receives.
+func WriteFailingPlugin(t testing.TB, dir, name string, exitCode int, message string) *Plugin {
+	t.Helper()
+	return WriteScript(t, dir, name, fmt.Sprintf("echo %s >&2\nexit %d\n", shellQuote(message), exitCode))
+}
+
+// WriteScript writes a fake plugin to the bin directory, which records the request that it receives, and then runs
+// the shell script, for plugins that behave in other ways, such as printing their environment or never exiting.
+func WriteScript(t testing.TB, dir, name, script string) *Plugin {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake credential provider plugins are shell scripts, which cannot be run on Windows")
+	}
+	p := &Plugin{Dir: dir, Name: name}
+	// each request is recorded on a line of its own; requests are encoded without newlines
+	record := fmt.Sprintf("cat >> %s\necho >> %s\n", shellQuote(p.requestsFile()), shellQuote(p.requestsFile()))
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+record+script), 0755); err != nil {
+		t.Fatalf("Failed to write credential provider plugin: %v", err)
+	}
+	return p
+}
+
+func (p *Plugin) requestsFile() string {
+	return filepath.Join(p.Dir, p.Name+".requests")
+}
+
+// Requests returns the requests that the plugin has received, in the order they were received.
+func (p *Plugin) Requests(t testing.TB) []Request {
+	t.Helper()
+	b, err := os.ReadFile(p.requestsFile())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatalf("Failed to read requests of credential provider plugin %s: %v", p.Name, err)
+	}
+	requests := []Request{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		request := Request{}
+		if err := json.Unmarshal([]byte(line), &request); err != nil {
+			t.Fatalf("Failed to decode request of credential provider plugin %s: %v", p.Name, err)
+		}
+		requests = append(requests, request)
+	}
+	return requests
+}
+
+// Invocations returns the number of times that the plugin has been run.
+func (p *Plugin) Invocations(t testing.TB) int {
+	t.Helper()
+	return len(p.Requests(t))
+}
+
+// Provider is a provider in a CredentialProviderConfig file.
+type Provider struct {
+	Name string
+	// APIVersion defaults to PluginAPIVersion.
+	APIVersion  string
+	MatchImages []string
+	// DefaultCacheDuration defaults to 0s, so that credentials are not cached.
+	DefaultCacheDuration string
+	Args                 []string
+	// Env is written in order of the names of the variables.
+	Env map[string]string
+}
+
+// WriteConfig writes a CredentialProviderConfig file for the providers to the directory, and returns its path.
+func WriteConfig(t testing.TB, dir string, providers ...Provider) string {
+	t.Helper()
+	type envConfig struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	}
+	type providerConfig struct {
+		Name                 string      `yaml:"name"`
+		APIVersion           string      `yaml:"apiVersion"`
+		MatchImages          []string    `yaml:"matchImages"`
+		DefaultCacheDuration string      `yaml:"defaultCacheDuration"`
+		Args                 []string    `yaml:"args,omitempty"`
+		Env                  []envConfig `yaml:"env,omitempty"`
+	}
+	config := struct {
+		APIVersion string           `yaml:"apiVersion"`
+		Kind       string           `yaml:"kind"`
+		Providers  []providerConfig `yaml:"providers"`
+	}{APIVersion: ConfigAPIVersion, Kind: "CredentialProviderConfig"}
+	for _, provider := range providers {
+		c := providerConfig{
+			Name:                 provider.Name,
+			APIVersion:           provider.APIVersion,
+			MatchImages:          provider.MatchImages,
+			DefaultCacheDuration: provider.DefaultCacheDuration,
+			Args:                 provider.Args,
+		}
+		if c.APIVersion == "" {
+			c.APIVersion = PluginAPIVersion
+		}
+		if c.DefaultCacheDuration == "" {
+			c.DefaultCacheDuration = "0s"
+		}
+		names := make([]string, 0, len(provider.Env))
+		for name := range provider.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			c.Env = append(c.Env, envConfig{Name: name, Value: provider.Env[name]})
+		}
+		config.Providers = append(config.Providers, c)
+	}
+
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Failed to encode credential provider config: %v", err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatalf("Failed to write credential provider config: %v", err)
+	}
+	return path
+}
+
+// shellQuote quotes the string for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
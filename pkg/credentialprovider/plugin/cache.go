@@ -0,0 +1,57 @@
+package plugin
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// credentialCache holds the credentials looked up for each registry or repository until they expire, so that
+// resolving credentials for every request of a pull does not execute the plugin again.
+type credentialCache struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	auths     []authn.AuthConfig
+	expiresAt time.Time
+}
+
+func newCredentialCache() *credentialCache {
+	return &credentialCache{
+		now:     time.Now,
+		entries: map[string]cacheEntry{},
+	}
+}
+
+// get returns the credentials cached for the key, if they have not expired. Expired credentials are removed.
+func (c *credentialCache) get(key string) ([]authn.AuthConfig, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.now().Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.auths, true
+}
+
+// add caches the credentials for the key, until the duration has passed.
+func (c *credentialCache) add(key string, auths []authn.AuthConfig, duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = cacheEntry{auths: auths, expiresAt: c.now().Add(duration)}
+}
+
+// remove drops the credentials cached for the key.
+func (c *credentialCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+}
@@ -0,0 +1,225 @@
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// credentialProviderConfig is the kubelet CredentialProviderConfig file. The file may be either YAML or JSON.
+type credentialProviderConfig struct {
+	APIVersion string           `yaml:"apiVersion"`
+	Kind       string           `yaml:"kind"`
+	Providers  []providerConfig `yaml:"providers"`
+}
+
+// configAPIVersions are the supported apiVersions of the CredentialProviderConfig file.
+var configAPIVersions = map[string]bool{
+	"kubelet.config.k8s.io/v1alpha1": true,
+	"kubelet.config.k8s.io/v1beta1":  true,
+	"kubelet.config.k8s.io/v1":       true,
+}
+
+// pluginAPIVersions are the supported apiVersions of the CredentialProviderRequest and CredentialProviderResponse
+// exchanged with plugins.
+var pluginAPIVersions = map[string]bool{
+	"credentialprovider.kubelet.k8s.io/v1alpha1": true,
+	"credentialprovider.kubelet.k8s.io/v1beta1":  true,
+	"credentialprovider.kubelet.k8s.io/v1":       true,
+}
+
+// providerConfig is a provider entry in the kubelet CredentialProviderConfig file.
+type providerConfig struct {
+	Name                 string      `yaml:"name"`
+	APIVersion           string      `yaml:"apiVersion"`
+	MatchImages          []string    `yaml:"matchImages"`
+	DefaultCacheDuration string      `yaml:"defaultCacheDuration"`
+	Args                 []string    `yaml:"args"`
+	Env                  []envConfig `yaml:"env"`
+
+	cacheDuration time.Duration
+}
+
+// envConfig is an environment variable set for a provider's plugin.
+type envConfig struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// ValidationError lists the problems found in a credential provider configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid credential provider configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// ValidateConfig checks the kubelet CredentialProviderConfig file in the same way as RegisterCredentialProviderPlugins,
+// without executing any plugins: the configuration must be valid as the kubelet requires, only use supported
+// apiVersions, and each configured plugin binary must exist in the directory and be executable. All of the problems
+// found are returned as a *ValidationError.
+func ValidateConfig(imageCredentialProviderConfigFile, imageCredentialProviderBinDir string) error {
+	_, err := readProviderConfigs(imageCredentialProviderConfigFile, imageCredentialProviderBinDir)
+	return err
+}
+
+// readProviderConfigs returns the providers configured in the kubelet CredentialProviderConfig file, after checking
+// that the configuration is valid, and that the plugin binaries exist in the directory.
+func readProviderConfigs(path, binDir string) ([]providerConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read credential provider config")
+	}
+	config := credentialProviderConfig{}
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse credential provider config %s", path)
+	}
+	if problems := append(config.validate(), config.validateBinaries(binDir)...); len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	for i, provider := range config.Providers {
+		config.Providers[i].cacheDuration, _ = time.ParseDuration(provider.DefaultCacheDuration)
+	}
+	return config.Providers, nil
+}
+
+// validate returns the problems with the configuration that the kubelet would refuse to start with.
+func (c *credentialProviderConfig) validate() []string {
+	problems := []string{}
+	if c.Kind != "CredentialProviderConfig" {
+		problems = append(problems, fmt.Sprintf("kind: unsupported kind %q, expected CredentialProviderConfig", c.Kind))
+	}
+	if !configAPIVersions[c.APIVersion] {
+		problems = append(problems, fmt.Sprintf("apiVersion: unsupported apiVersion %q, supported values: %s", c.APIVersion, supported(configAPIVersions)))
+	}
+	if len(c.Providers) == 0 {
+		problems = append(problems, "providers: at least one provider is required")
+	}
+	for i, provider := range c.Providers {
+		key := fmt.Sprintf("providers[%q]", provider.Name)
+		switch {
+		case provider.Name == "":
+			key = fmt.Sprintf("providers[%d]", i)
+			problems = append(problems, key+": name is required")
+		case strings.Contains(provider.Name, "/"):
+			problems = append(problems, key+": name cannot contain '/'")
+		case strings.Contains(provider.Name, " "):
+			problems = append(problems, key+": name cannot contain spaces")
+		case provider.Name == "." || provider.Name == "..":
+			problems = append(problems, key+": name cannot be '.' or '..'")
+		}
+
+		if provider.APIVersion == "" {
+			problems = append(problems, key+": apiVersion is required")
+		} else if !pluginAPIVersions[provider.APIVersion] {
+			problems = append(problems, fmt.Sprintf("%s: unsupported apiVersion %q, supported values: %s", key, provider.APIVersion, supported(pluginAPIVersions)))
+		}
+
+		if len(provider.MatchImages) == 0 {
+			problems = append(problems, key+": at least one matchImages entry is required")
+		}
+		for _, matchImage := range provider.MatchImages {
+			if _, err := parseSchemelessURL(matchImage); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: invalid matchImages entry %q: %v", key, matchImage, err))
+			}
+		}
+
+		if provider.DefaultCacheDuration == "" {
+			problems = append(problems, key+": defaultCacheDuration is required")
+		} else if duration, err := time.ParseDuration(provider.DefaultCacheDuration); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: invalid defaultCacheDuration: %v", key, err))
+		} else if duration < 0 {
+			problems = append(problems, key+": defaultCacheDuration must be greater than or equal to 0")
+		}
+	}
+	return problems
+}
+
+// validateBinaries returns the problems with the plugin binaries of the providers in the directory: those that do
+// not exist, or are not executable files.
+func (c *credentialProviderConfig) validateBinaries(binDir string) []string {
+	if info, err := os.Stat(binDir); err != nil {
+		return []string{fmt.Sprintf("plugin binary directory %s: %v", binDir, err)}
+	} else if !info.IsDir() {
+		return []string{fmt.Sprintf("plugin binary directory %s is not a directory", binDir)}
+	}
+	problems := []string{}
+	for _, provider := range c.Providers {
+		if provider.Name == "" || strings.ContainsAny(provider.Name, "/ ") || provider.Name == "." || provider.Name == ".." {
+			continue
+		}
+		key := fmt.Sprintf("providers[%q]", provider.Name)
+		pluginBin := filepath.Join(binDir, provider.Name)
+		info, err := os.Stat(pluginBin)
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, fmt.Sprintf("%s: plugin binary %s does not exist", key, pluginBin))
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+		case info.IsDir():
+			problems = append(problems, fmt.Sprintf("%s: plugin binary %s is a directory", key, pluginBin))
+		case runtime.GOOS != "windows" && info.Mode()&0111 == 0:
+			problems = append(problems, fmt.Sprintf("%s: plugin binary %s is not executable", key, pluginBin))
+		}
+	}
+	return problems
+}
+
+// supported returns the sorted keys of the set, for listing the supported values in problems.
+func supported(values map[string]bool) string {
+	keys := []string{}
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ", ")
+}
+
+// readEnvFile returns the environment variables for each provider in the file given to WithEnvFile.
+func readEnvFile(path string) (map[string]map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read credential provider environment file")
+	}
+	env := map[string]map[string]string{}
+	if err := yaml.UnmarshalStrict(b, &env); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse credential provider environment file %s", path)
+	}
+	return env, nil
+}
+
+// envVarPattern matches references to environment variables in the values of the env of a provider.
+var envVarPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// environ returns the environment to execute the provider's plugin with: wharfie's own, with the env of the provider
+// added. References to wharfie's environment in the values, as ${VAR}, are replaced by their value, or removed if the
+// variable is not set; other uses of $ are left as they are.
+func (c *providerConfig) environ() []string {
+	env := os.Environ()
+	for _, e := range c.Env {
+		value := envVarPattern.ReplaceAllStringFunc(e.Value, func(ref string) string {
+			return os.Getenv(envVarPattern.FindStringSubmatch(ref)[1])
+		})
+		env = append(env, e.Name+"="+value)
+	}
+	return env
+}
+
+// matches returns true if any of the provider's matchImages match the image.
+func (c *providerConfig) matches(image string) bool {
+	for _, matchImage := range c.MatchImages {
+		if matched, _ := urlsMatch(matchImage, image); matched {
+			return true
+		}
+	}
+	return false
+}
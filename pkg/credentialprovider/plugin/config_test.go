@@ -0,0 +1,178 @@
+package plugin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	binDir := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(filepath.Join(binDir, "directory-provider"), 0755); err != nil {
+		t.Fatalf("Failed to create bin dir: %v", err)
+	}
+	for name, mode := range map[string]os.FileMode{"ecr-credential-provider": 0755, "gcr-credential-provider": 0755, "unexecutable-provider": 0644} {
+		if err := os.WriteFile(filepath.Join(binDir, name), []byte{}, mode); err != nil {
+			t.Fatalf("Failed to write plugin: %v", err)
+		}
+	}
+
+	tests := map[string]struct {
+		config   string
+		binDir   string
+		problems []string
+		err      string
+	}{
+		"valid": {
+			config: `apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: ecr-credential-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.dkr.ecr.*.amazonaws.com"]
+  defaultCacheDuration: 12h
+- name: gcr-credential-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1beta1
+  matchImages: ["*.gcr.io", "*.pkg.dev"]
+  defaultCacheDuration: 1m
+`,
+		},
+		"json": {
+			config: `{"apiVersion": "kubelet.config.k8s.io/v1", "kind": "CredentialProviderConfig", "providers": [
+  {"name": "ecr-credential-provider", "apiVersion": "credentialprovider.kubelet.k8s.io/v1", "matchImages": ["*.dkr.ecr.*.amazonaws.com"], "defaultCacheDuration": "12h"}
+]}`,
+		},
+		"missing binaries": {
+			config: `apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: ecr-credential-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.dkr.ecr.*.amazonaws.com"]
+  defaultCacheDuration: 12h
+- name: ecr-credentials-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.dkr.ecr.*.amazonaws.com"]
+  defaultCacheDuration: 12h
+- name: acr-credential-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.azurecr.io"]
+  defaultCacheDuration: 10m
+- name: directory-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.example.com"]
+  defaultCacheDuration: 10m
+`,
+			problems: []string{
+				`providers["ecr-credentials-provider"]: plugin binary ` + filepath.Join(binDir, "ecr-credentials-provider") + ` does not exist`,
+				`providers["acr-credential-provider"]: plugin binary ` + filepath.Join(binDir, "acr-credential-provider") + ` does not exist`,
+				`providers["directory-provider"]: plugin binary ` + filepath.Join(binDir, "directory-provider") + ` is a directory`,
+			},
+		},
+		"missing bin dir": {
+			config: `apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: ecr-credential-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.dkr.ecr.*.amazonaws.com"]
+  defaultCacheDuration: 12h
+`,
+			binDir: filepath.Join(dir, "missing"),
+			problems: []string{
+				"plugin binary directory " + filepath.Join(dir, "missing") + ": stat " + filepath.Join(dir, "missing") + ": no such file or directory",
+			},
+		},
+		"invalid providers": {
+			config: `apiVersion: kubelet.config.k8s.io/v2
+kind: CredentialProviderConfig
+providers:
+- name: ecr-credential-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v2
+  matchImages: []
+  defaultCacheDuration: -1h
+- name: gcr-credential-provider
+  matchImages: ["*.gcr.io:port"]
+- name: ../ecr-credential-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.example.com"]
+  defaultCacheDuration: 1day
+`,
+			problems: []string{
+				`apiVersion: unsupported apiVersion "kubelet.config.k8s.io/v2", supported values: kubelet.config.k8s.io/v1, kubelet.config.k8s.io/v1alpha1, kubelet.config.k8s.io/v1beta1`,
+				`providers["ecr-credential-provider"]: unsupported apiVersion "credentialprovider.kubelet.k8s.io/v2", supported values: credentialprovider.kubelet.k8s.io/v1, credentialprovider.kubelet.k8s.io/v1alpha1, credentialprovider.kubelet.k8s.io/v1beta1`,
+				`providers["ecr-credential-provider"]: at least one matchImages entry is required`,
+				`providers["ecr-credential-provider"]: defaultCacheDuration must be greater than or equal to 0`,
+				`providers["gcr-credential-provider"]: apiVersion is required`,
+				`providers["gcr-credential-provider"]: invalid matchImages entry "*.gcr.io:port": parse "https://*.gcr.io:port": invalid port ":port" after host`,
+				`providers["gcr-credential-provider"]: defaultCacheDuration is required`,
+				`providers["../ecr-credential-provider"]: name cannot contain '/'`,
+				`providers["../ecr-credential-provider"]: invalid defaultCacheDuration: time: unknown unit "day" in duration "1day"`,
+			},
+		},
+		"no providers": {
+			config:   "apiVersion: kubelet.config.k8s.io/v1\nkind: KubeletConfiguration\n",
+			problems: []string{`kind: unsupported kind "KubeletConfiguration", expected CredentialProviderConfig`, "providers: at least one provider is required"},
+		},
+		"invalid yaml": {
+			config: "providers: {",
+			err:    "failed to parse credential provider config",
+		},
+	}
+	if runtime.GOOS != "windows" {
+		tests["unexecutable binary"] = struct {
+			config   string
+			binDir   string
+			problems []string
+			err      string
+		}{
+			config: `apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: unexecutable-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.example.com"]
+  defaultCacheDuration: 10m
+`,
+			problems: []string{`providers["unexecutable-provider"]: plugin binary ` + filepath.Join(binDir, "unexecutable-provider") + ` is not executable`},
+		}
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			config := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(config, []byte(test.config), 0644); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+			testBinDir := binDir
+			if test.binDir != "" {
+				testBinDir = test.binDir
+			}
+
+			err := ValidateConfig(config, testBinDir)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error containing %q but got %v", test.err, err)
+				}
+				return
+			}
+			if len(test.problems) == 0 {
+				if err != nil {
+					t.Fatalf("Expected valid configuration but got %v", err)
+				}
+				return
+			}
+			verr := &ValidationError{}
+			if !errors.As(err, &verr) {
+				t.Fatalf("Expected ValidationError but got %v", err)
+			}
+			if strings.Join(verr.Problems, "\n") != strings.Join(test.problems, "\n") {
+				t.Errorf("Expected problems:\n%s\nbut got:\n%s", strings.Join(test.problems, "\n"), strings.Join(verr.Problems, "\n"))
+			}
+		})
+	}
+}
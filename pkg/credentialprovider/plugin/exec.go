@@ -0,0 +1,161 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultTimeout is how long a credential provider plugin may run before it is killed, unless a different timeout
+// is set with WithTimeout. It is the same as the kubelet's.
+const DefaultTimeout = time.Minute
+
+// waitDelay is how long to wait for the output of a plugin that has been killed, in case it has started processes
+// that are still holding its stdout or stderr open.
+const waitDelay = time.Second
+
+// PluginError is returned when a credential provider plugin fails or times out. It identifies the plugin, and
+// includes its exit code and what it wrote to stderr.
+type PluginError struct {
+	Plugin string
+	Image  string
+	// ExitCode is the exit code of the plugin, or -1 if it did not exit, such as when it was killed after timing out.
+	ExitCode int
+	Stderr   string
+	Err      error
+}
+
+func (e *PluginError) Error() string {
+	msg := fmt.Sprintf("credential provider plugin %s failed for image %s", e.Plugin, e.Image)
+	if e.ExitCode > 0 {
+		msg += fmt.Sprintf(" with exit code %d", e.ExitCode)
+	}
+	msg += ": " + e.Err.Error()
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+func (e *PluginError) Unwrap() error {
+	return e.Err
+}
+
+// typeMeta is the apiVersion and kind of a CredentialProviderResponse. They are decoded before the rest of the
+// response, so that a plugin that responds with a different apiVersion than its provider is configured with is
+// reported as such, instead of failing to decode.
+type typeMeta struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+}
+
+// credentialProviderRequest is the CredentialProviderRequest written to the stdin of a plugin. The request has the
+// same fields in each of the pluginAPIVersions, so it is written in any of them by setting its apiVersion.
+type credentialProviderRequest struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Image      string `json:"image"`
+}
+
+// credentialProviderResponse is the CredentialProviderResponse read from the stdout of a plugin. As for the request,
+// the fields that are read are the same in each of the pluginAPIVersions.
+type credentialProviderResponse struct {
+	APIVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Auth       map[string]authConfig `json:"auth"`
+}
+
+// authConfig is the credentials for a registry or repository in a CredentialProviderResponse.
+type authConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// dockerConfig returns the credentials in the response, for adding to a keyring.
+func (r *credentialProviderResponse) dockerConfig() dockerConfig {
+	config := dockerConfig{}
+	for match, auth := range r.Auth {
+		config[match] = dockerConfigEntry{
+			Username: auth.Username,
+			Password: auth.Password,
+		}
+	}
+	return config
+}
+
+// exec runs the provider's plugin binary from the directory to get credentials for the image, in the same way as
+// the kubelet: the request is written to its stdin, with the configured arguments and environment, and the response
+// is read from its stdout. The plugin is killed if it runs for longer than the
+// timeout, unless it is zero.
+func (c *providerConfig) exec(binDir, image string, timeout time.Duration) (*credentialProviderResponse, error) {
+	request, err := json.Marshal(credentialProviderRequest{
+		APIVersion: c.APIVersion,
+		Kind:       "CredentialProviderRequest",
+		Image:      image,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode credential provider request")
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, filepath.Join(binDir, c.Name), c.Args...)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.WaitDelay = waitDelay
+	cmd.Env = c.environ()
+
+	if err := cmd.Run(); err != nil {
+		pluginErr := &PluginError{Plugin: c.Name, Image: image, ExitCode: -1, Stderr: stderr.String(), Err: err}
+		if ctx.Err() != nil {
+			pluginErr.Err = errors.Wrapf(ctx.Err(), "timed out after %s", timeout)
+		} else if exitErr, ok := err.(*exec.ExitError); ok {
+			pluginErr.ExitCode = exitErr.ExitCode()
+			pluginErr.Err = errors.New("plugin exited unsuccessfully")
+		}
+		return nil, pluginErr
+	}
+
+	response, err := c.decodeResponse(stdout.Bytes())
+	if err != nil {
+		return nil, &PluginError{Plugin: c.Name, Image: image, Stderr: stderr.String(), Err: err}
+	}
+	return response, nil
+}
+
+// decodeResponse decodes the plugin's response, which must be a CredentialProviderResponse in the apiVersion that
+// the provider is configured with, as the kubelet requires. Decoding errors are not wrapped, as they may contain
+// credentials from the response.
+func (c *providerConfig) decodeResponse(b []byte) (*credentialProviderResponse, error) {
+	meta := typeMeta{}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, errors.New("failed to decode credential provider response")
+	}
+	if meta.APIVersion != c.APIVersion {
+		return nil, errors.Errorf("response has apiVersion %q, expected %q as configured for the provider", meta.APIVersion, c.APIVersion)
+	}
+	if meta.Kind != "CredentialProviderResponse" {
+		return nil, errors.Errorf("unexpected response kind %q, expected CredentialProviderResponse", meta.Kind)
+	}
+
+	response := &credentialProviderResponse{}
+	if err := json.Unmarshal(b, response); err != nil {
+		return nil, errors.Errorf("failed to decode %s CredentialProviderResponse", c.APIVersion)
+	}
+	return response, nil
+}
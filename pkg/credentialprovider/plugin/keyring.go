@@ -0,0 +1,24 @@
+package plugin
+
+import "github.com/google/go-containerregistry/pkg/authn"
+
+// dockerConfig holds credentials keyed by the registry or repository that they are for, as in the auths of a Docker
+// config.json file, or the auth of a CredentialProviderResponse.
+type dockerConfig map[string]dockerConfigEntry
+
+// dockerConfigEntry is the credentials for a registry or repository in a dockerConfig.
+type dockerConfigEntry struct {
+	Username string
+	Password string
+}
+
+// keyring looks up credentials for images with the kubelet's semantics. Its implementation, along with matching
+// images against patterns and reading legacy Docker config files, is either the kubelet's own, or wharfie's
+// reimplementation of it when built with the no_kubernetes tag, which leaves k8s.io/kubernetes out of the binary.
+type keyring interface {
+	// add adds the credentials in the config to the keyring.
+	add(config dockerConfig)
+	// lookup returns the credentials for the image, ordered with the most specific match first, and true if there
+	// are any.
+	lookup(image string) ([]authn.AuthConfig, bool)
+}
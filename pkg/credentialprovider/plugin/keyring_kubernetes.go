@@ -0,0 +1,70 @@
+//go:build !no_kubernetes
+
+package plugin
+
+import (
+	"net/url"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	kubecredentialprovider "k8s.io/kubernetes/pkg/credentialprovider"
+)
+
+// kubeKeyring is a keyring backed by the kubelet's.
+type kubeKeyring struct {
+	keyring kubecredentialprovider.BasicDockerKeyring
+}
+
+func newKeyring() keyring {
+	return &kubeKeyring{}
+}
+
+func (k *kubeKeyring) add(config dockerConfig) {
+	kubeConfig := kubecredentialprovider.DockerConfig{}
+	for match, entry := range config {
+		kubeConfig[match] = kubecredentialprovider.DockerConfigEntry{Username: entry.Username, Password: entry.Password}
+	}
+	k.keyring.Add(kubeConfig)
+}
+
+func (k *kubeKeyring) lookup(image string) ([]authn.AuthConfig, bool) {
+	configs, ok := k.keyring.Lookup(image)
+	if !ok {
+		return nil, false
+	}
+	auths := make([]authn.AuthConfig, 0, len(configs))
+	for _, config := range configs {
+		auths = append(auths, authn.AuthConfig{
+			Username:      config.Username,
+			Password:      config.Password,
+			Auth:          config.Auth,
+			IdentityToken: config.IdentityToken,
+			RegistryToken: config.RegistryToken,
+		})
+	}
+	return auths, true
+}
+
+// parseSchemelessURL parses a matchImages pattern, or an image, as a URL without a scheme.
+func parseSchemelessURL(schemelessURL string) (*url.URL, error) {
+	return kubecredentialprovider.ParseSchemelessURL(schemelessURL)
+}
+
+// urlsMatch returns true if the image matches the matchImages pattern.
+func urlsMatch(glob, target string) (bool, error) {
+	return kubecredentialprovider.URLsMatchStr(glob, target)
+}
+
+// readDockerConfigFile reads credentials from the legacy Docker config files that the kubelet falls back to: a
+// config.json file in the working directory, ~/.docker, or /.docker, or a .dockercfg file in the working directory,
+// home directory, or /.
+func readDockerConfigFile() (dockerConfig, error) {
+	kubeConfig, err := kubecredentialprovider.ReadDockerConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	config := dockerConfig{}
+	for match, entry := range kubeConfig {
+		config[match] = dockerConfigEntry{Username: entry.Username, Password: entry.Password}
+	}
+	return config, nil
+}
@@ -0,0 +1,207 @@
+//go:build no_kubernetes
+
+package plugin
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/sirupsen/logrus"
+)
+
+// basicKeyring is a reimplementation of the kubelet's BasicDockerKeyring, so that wharfie can be built without
+// k8s.io/kubernetes.
+type basicKeyring struct {
+	// index is the keys of creds, reverse-sorted so that more specific paths are matched first.
+	index []string
+	creds map[string][]authn.AuthConfig
+}
+
+func newKeyring() keyring {
+	return &basicKeyring{creds: map[string][]authn.AuthConfig{}}
+}
+
+func (k *basicKeyring) add(config dockerConfig) {
+	for match, entry := range config {
+		value := match
+		if !strings.HasPrefix(value, "https://") && !strings.HasPrefix(value, "http://") {
+			value = "https://" + value
+		}
+		parsed, err := url.Parse(value)
+		if err != nil {
+			logrus.Errorf("Ignoring invalid credentials entry %q: %v", match, err)
+			continue
+		}
+
+		// as in the docker client, /v1/ and /v2/ paths are equivalent to the host
+		path := parsed.Path
+		if strings.HasPrefix(path, "/v2/") || strings.HasPrefix(path, "/v1/") {
+			path = path[3:]
+		}
+		key := parsed.Host
+		if path != "" && path != "/" {
+			key += path
+		}
+		if _, ok := k.creds[key]; !ok {
+			k.index = append(k.index, key)
+		}
+		k.creds[key] = append(k.creds[key], authn.AuthConfig{Username: entry.Username, Password: entry.Password})
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(k.index)))
+}
+
+func (k *basicKeyring) lookup(image string) ([]authn.AuthConfig, bool) {
+	auths := []authn.AuthConfig{}
+	for _, key := range k.index {
+		if matched, _ := urlsMatch(key, image); matched {
+			auths = append(auths, k.creds[key]...)
+		}
+	}
+	if len(auths) > 0 {
+		return auths, true
+	}
+
+	// credentials for Docker Hub also apply to images that do not name a registry
+	if isDefaultRegistryMatch(image) {
+		if auths, ok := k.creds["index.docker.io"]; ok {
+			return auths, true
+		}
+	}
+	return nil, false
+}
+
+// isDefaultRegistryMatch returns true if the image is pulled from Docker Hub.
+func isDefaultRegistryMatch(image string) bool {
+	parts := strings.SplitN(image, "/", 2)
+	if parts[0] == "" {
+		return false
+	}
+	if len(parts) == 1 || parts[0] == "docker.io" || parts[0] == "index.docker.io" {
+		return true
+	}
+	// the first part is a registry only if it contains a domain or port separator
+	return !strings.ContainsAny(parts[0], ".:")
+}
+
+// parseSchemelessURL parses a matchImages pattern, or an image, as a URL without a scheme.
+func parseSchemelessURL(schemelessURL string) (*url.URL, error) {
+	parsed, err := url.Parse("https://" + schemelessURL)
+	if err != nil {
+		return nil, err
+	}
+	parsed.Scheme = ""
+	return parsed, nil
+}
+
+// urlsMatch returns true if the image matches the matchImages pattern. Each part of the host name of the pattern may
+// be a glob matching the same part of the image's, the ports must be the same, and the path of the pattern must be a
+// prefix of the image's.
+func urlsMatch(glob, target string) (bool, error) {
+	globURL, err := parseSchemelessURL(glob)
+	if err != nil {
+		return false, err
+	}
+	targetURL, err := parseSchemelessURL(target)
+	if err != nil {
+		return false, err
+	}
+
+	globParts, globPort := splitHost(globURL)
+	targetParts, targetPort := splitHost(targetURL)
+	if globPort != targetPort || len(globParts) != len(targetParts) {
+		return false, nil
+	}
+	if !strings.HasPrefix(targetURL.Path, globURL.Path) {
+		return false, nil
+	}
+	for i, globPart := range globParts {
+		if matched, err := filepath.Match(globPart, targetParts[i]); err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// splitHost returns the parts of the host name of the URL, and its port.
+func splitHost(u *url.URL) ([]string, string) {
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, port = u.Host, ""
+	}
+	return strings.Split(host, "."), port
+}
+
+// readDockerConfigFile reads credentials from the legacy Docker config files that the kubelet falls back to: a
+// config.json file in the working directory, ~/.docker, or /.docker, or a .dockercfg file in the working directory,
+// home directory, or /.
+func readDockerConfigFile() (dockerConfig, error) {
+	home, _ := os.UserHomeDir()
+	for _, dir := range []string{"", filepath.Join(home, ".docker"), filepath.Join("/", ".docker")} {
+		b, err := os.ReadFile(filepath.Join(dir, "config.json"))
+		if err != nil {
+			continue
+		}
+		config := struct {
+			Auths dockerConfig `json:"auths"`
+		}{}
+		if err := json.Unmarshal(b, &config); err != nil {
+			logrus.Debugf("Failed to parse %s: invalid JSON", filepath.Join(dir, "config.json"))
+			continue
+		}
+		return config.Auths, nil
+	}
+	for _, dir := range []string{"", home, "/"} {
+		b, err := os.ReadFile(filepath.Join(dir, ".dockercfg"))
+		if err != nil {
+			continue
+		}
+		config := dockerConfig{}
+		if err := json.Unmarshal(b, &config); err != nil {
+			logrus.Debugf("Failed to parse %s: invalid JSON", filepath.Join(dir, ".dockercfg"))
+			continue
+		}
+		return config, nil
+	}
+	return nil, fmt.Errorf("no valid config.json or .dockercfg file found")
+}
+
+// UnmarshalJSON decodes an entry of a Docker config file, in which the credentials may be given as a base64-encoded
+// auth field instead of a username and password.
+func (e *dockerConfigEntry) UnmarshalJSON(data []byte) error {
+	entry := struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Auth     string `json:"auth"`
+	}{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return err
+	}
+	e.Username, e.Password = entry.Username, entry.Password
+	if entry.Auth == "" {
+		return nil
+	}
+	encoding := base64.RawStdEncoding
+	if strings.HasSuffix(strings.TrimSpace(entry.Auth), "=") {
+		encoding = base64.StdEncoding
+	}
+	decoded, err := encoding.DecodeString(entry.Auth)
+	if err != nil {
+		return err
+	}
+	var ok bool
+	if e.Username, e.Password, ok = strings.Cut(string(decoded), ":"); !ok {
+		return fmt.Errorf("unable to parse auth field, must be formatted as base64(username:password)")
+	}
+	return nil
+}
+
+// klogSetup does nothing, as klog is only used by the kubelet's credential provider code.
+func klogSetup() {}
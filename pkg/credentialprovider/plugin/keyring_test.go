@@ -0,0 +1,72 @@
+package plugin
+
+import (
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKeyringLookup(t *testing.T) {
+	keyring := newKeyring()
+	keyring.add(dockerConfig{
+		"registry.example.com":                 {Username: "registry"},
+		"https://registry.example.com/v2/team": {Username: "team"},
+		"index.docker.io":                      {Username: "hub"},
+	})
+	keyring.add(dockerConfig{"registry.example.com": {Username: "rotated"}})
+
+	tests := map[string][]string{
+		"registry.example.com/team/app":  {"team", "registry", "rotated"},
+		"registry.example.com/other/app": {"registry", "rotated"},
+		"busybox":                        {"hub"},
+		"rancher/kubectl":                {"hub"},
+		"registry.example.org/team/app":  nil,
+	}
+	for image, expected := range tests {
+		t.Run(image, func(t *testing.T) {
+			auths, ok := keyring.lookup(image)
+			if ok != (len(expected) > 0) {
+				t.Fatalf("Expected credentials for %s: %t", image, len(expected) > 0)
+			}
+			usernames := []string{}
+			for _, auth := range auths {
+				usernames = append(usernames, auth.Username)
+			}
+			if strings.Join(usernames, ",") != strings.Join(expected, ",") {
+				t.Errorf("Expected credentials %v for %s but got %v", expected, image, usernames)
+			}
+		})
+	}
+}
+
+func TestReadDockerConfigFile(t *testing.T) {
+	// config.json in the working directory is read first
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Failed to change directory: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	auth := base64.StdEncoding.EncodeToString([]byte("robot:secret"))
+	if err := os.WriteFile("config.json", []byte(`{"auths": {
+  "registry.example.com": {"auth": "`+auth+`"},
+  "mirror.example.com": {"username": "user", "password": "pass"}
+}}`), 0600); err != nil {
+		t.Fatalf("Failed to write config.json: %v", err)
+	}
+
+	config, err := readDockerConfigFile()
+	if err != nil {
+		t.Fatalf("Failed to read Docker config: %v", err)
+	}
+	if entry := config["registry.example.com"]; entry.Username != "robot" || entry.Password != "secret" {
+		t.Errorf("Expected credentials robot:secret from auth field but got %s:%s", entry.Username, entry.Password)
+	}
+	if entry := config["mirror.example.com"]; entry.Username != "user" || entry.Password != "pass" {
+		t.Errorf("Expected credentials user:pass but got %s:%s", entry.Username, entry.Password)
+	}
+}
@@ -0,0 +1,86 @@
+//go:build !no_kubernetes
+
+package plugin
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/go-logr/logr"
+	"github.com/sirupsen/logrus"
+	"k8s.io/klog/v2"
+)
+
+var klogOnce sync.Once
+
+// klogSetup sends klog output from the kubernetes credential provider code to logrus, so that it uses wharfie's log
+// level, format, and target instead of klog's own. All verbosity levels are enabled in klog, and messages are
+// filtered by the logrus level instead: klog info messages are logged at info level, and verbose messages at debug
+// level.
+func klogSetup() {
+	klogOnce.Do(func() {
+		var verbosity klog.Level
+		_ = verbosity.Set("9")
+		klog.SetLogger(logr.New(&logrusSink{entry: logrus.WithField("component", "credentialprovider")}))
+	})
+}
+
+// logrusSink is a logr.LogSink that logs to logrus. Key/value pairs are logged as fields.
+type logrusSink struct {
+	entry *logrus.Entry
+}
+
+var _ logr.LogSink = &logrusSink{}
+
+func (s *logrusSink) Init(logr.RuntimeInfo) {}
+
+func (s *logrusSink) Enabled(level int) bool {
+	return s.entry.Logger.IsLevelEnabled(logrusLevel(level))
+}
+
+func (s *logrusSink) Info(level int, msg string, keysAndValues ...interface{}) {
+	s.withValues(keysAndValues).Log(logrusLevel(level), msg)
+}
+
+func (s *logrusSink) Error(err error, msg string, keysAndValues ...interface{}) {
+	entry := s.withValues(keysAndValues)
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Error(msg)
+}
+
+func (s *logrusSink) WithValues(keysAndValues ...interface{}) logr.LogSink {
+	return &logrusSink{entry: s.withValues(keysAndValues)}
+}
+
+func (s *logrusSink) WithName(name string) logr.LogSink {
+	if logger, ok := s.entry.Data["logger"]; ok {
+		name = fmt.Sprintf("%v/%s", logger, name)
+	}
+	return &logrusSink{entry: s.entry.WithField("logger", name)}
+}
+
+// withValues returns the entry with the key/value pairs added as fields.
+func (s *logrusSink) withValues(keysAndValues []interface{}) *logrus.Entry {
+	if len(keysAndValues) == 0 {
+		return s.entry
+	}
+	fields := logrus.Fields{}
+	for i := 0; i < len(keysAndValues); i += 2 {
+		var value interface{}
+		if i+1 < len(keysAndValues) {
+			value = keysAndValues[i+1]
+		}
+		fields[fmt.Sprint(keysAndValues[i])] = value
+	}
+	return s.entry.WithFields(fields)
+}
+
+// logrusLevel returns the logrus level for a klog verbosity level.
+func logrusLevel(level int) logrus.Level {
+	if level > 0 {
+		return logrus.DebugLevel
+	}
+	return logrus.InfoLevel
+}
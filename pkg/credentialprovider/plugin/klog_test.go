@@ -0,0 +1,64 @@
+//go:build !no_kubernetes
+
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/klog/v2"
+)
+
+func TestKlogSetup(t *testing.T) {
+	output := &bytes.Buffer{}
+	defer func(level logrus.Level) { logrus.SetLevel(level) }(logrus.GetLevel())
+	defer logrus.SetOutput(logrus.StandardLogger().Out)
+	logrus.SetOutput(output)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "logging-provider"), []byte{}, 0755); err != nil {
+		t.Fatalf("Failed to write plugin: %v", err)
+	}
+	config := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(config, []byte(`apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: logging-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.logging.example.com"]
+  defaultCacheDuration: 1h
+`), 0644); err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	// registering the plugins reads legacy Docker config files, which logs verbose klog messages
+	if _, err := RegisterCredentialProviderPlugins(config, dir); err != nil {
+		t.Fatalf("Failed to register plugins: %v", err)
+	}
+	klog.ErrorS(errors.New("token expired"), "Failed to refresh credentials", "provider", "logging-provider")
+	klog.Flush()
+
+	expected := []string{
+		`level=debug msg="looking for config.json at [^"]+" component=credentialprovider`,
+		`level=error msg="Failed to refresh credentials" component=credentialprovider error="token expired" provider=logging-provider`,
+	}
+	for _, message := range expected {
+		if !regexp.MustCompile(message).MatchString(output.String()) {
+			t.Errorf("Expected logrus output to match %s but got:\n%s", message, output.String())
+		}
+	}
+
+	// verbose messages are not logged unless debug logging is enabled
+	output.Reset()
+	logrus.SetLevel(logrus.InfoLevel)
+	klog.V(4).Infof("Verbose message")
+	if output.Len() != 0 {
+		t.Errorf("Expected no output for verbose klog message at info level, but got:\n%s", output.String())
+	}
+}
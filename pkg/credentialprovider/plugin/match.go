@@ -0,0 +1,64 @@
+package plugin
+
+import (
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// imageCandidates returns the forms of the target that the matchImages of the providers, and the registries and
+// repositories that plugins return credentials for, are matched against with the kubelet's semantics. They are tried
+// in order, and the first form that matches is used:
+//
+//  1. the registry, with its port if it has one, and the repository path, as the kubelet would match the image
+//  2. the same without the port, so that a pattern for a host also matches the host on a non-default port
+//
+// Images from Docker Hub are also tried as docker.io, which the kubelet uses, after the index.docker.io that
+// go-containerregistry uses.
+func imageCandidates(target authn.Resource) []string {
+	registry := target.RegistryStr()
+	path := strings.TrimPrefix(target.String(), registry)
+
+	registries := []string{registry}
+	if registry == name.DefaultRegistry {
+		registries = append(registries, "docker.io")
+	}
+	candidates := []string{}
+	for _, registry := range registries {
+		candidates = append(candidates, registry+path)
+	}
+	for _, registry := range registries {
+		if host, _, ok := strings.Cut(registry, ":"); ok {
+			candidates = append(candidates, host+path)
+		}
+	}
+	return candidates
+}
+
+// matchingProviders returns the providers whose matchImages match the first of the candidates that any of them
+// match, and that candidate.
+func (p *pluginWrapper) matchingProviders(candidates []string) ([]*providerConfig, string) {
+	for _, candidate := range candidates {
+		providers := []*providerConfig{}
+		for i := range p.providers {
+			if p.providers[i].matches(candidate) {
+				providers = append(providers, &p.providers[i])
+			}
+		}
+		if len(providers) > 0 {
+			return providers, candidate
+		}
+	}
+	return nil, ""
+}
+
+// lookupCandidates returns the credentials in the keyring for the first of the candidates that it has any for.
+func lookupCandidates(keyring keyring, candidates []string) ([]authn.AuthConfig, bool) {
+	for _, candidate := range candidates {
+		if auths, ok := keyring.lookup(candidate); ok {
+			return auths, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,176 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestMatchImages(t *testing.T) {
+	tests := map[string]struct {
+		matchImage string
+		target     string
+		registry   bool
+		matched    bool
+	}{
+		"registry": {
+			matchImage: "registry.example.com",
+			target:     "registry.example.com/team/app",
+			matched:    true,
+		},
+		"registry with port": {
+			matchImage: "registry.example.com:5000",
+			target:     "registry.example.com:5000/team/app",
+			matched:    true,
+		},
+		"registry with port for registry resource": {
+			matchImage: "registry.example.com:5000",
+			target:     "registry.example.com:5000",
+			registry:   true,
+			matched:    true,
+		},
+		"registry without port for registry with port": {
+			matchImage: "registry.example.com",
+			target:     "registry.example.com:5000/team/app",
+			matched:    true,
+		},
+		"registry without port for registry resource with port": {
+			matchImage: "registry.example.com",
+			target:     "registry.example.com:5000",
+			registry:   true,
+			matched:    true,
+		},
+		"registry with port for registry without port": {
+			matchImage: "registry.example.com:5000",
+			target:     "registry.example.com/team/app",
+		},
+		"registry with different port": {
+			matchImage: "registry.example.com:5000",
+			target:     "registry.example.com:5001/team/app",
+		},
+		"different registry": {
+			matchImage: "registry.example.com",
+			target:     "registry.example.org/team/app",
+		},
+		"localhost with port": {
+			matchImage: "localhost:5000",
+			target:     "localhost:5000/app",
+			matched:    true,
+		},
+		"repository path prefix": {
+			matchImage: "registry.example.com/team",
+			target:     "registry.example.com/team/app",
+			matched:    true,
+		},
+		"repository path prefix with port": {
+			matchImage: "registry.example.com:5000/team",
+			target:     "registry.example.com:5000/team/app",
+			matched:    true,
+		},
+		"repository path prefix without port for registry with port": {
+			matchImage: "registry.example.com/team",
+			target:     "registry.example.com:5000/team/app",
+			matched:    true,
+		},
+		"different repository path": {
+			matchImage: "registry.example.com/team",
+			target:     "registry.example.com/other/app",
+		},
+		"repository path for registry resource": {
+			matchImage: "registry.example.com/team",
+			target:     "registry.example.com",
+			registry:   true,
+		},
+		"wildcard subdomain": {
+			matchImage: "*.example.com",
+			target:     "registry.example.com/team/app",
+			matched:    true,
+		},
+		"wildcard subdomain with port": {
+			matchImage: "*.example.com:5000",
+			target:     "registry.example.com:5000/team/app",
+			matched:    true,
+		},
+		"wildcard subdomain for parent domain": {
+			matchImage: "*.example.com",
+			target:     "example.com/team/app",
+		},
+		"wildcard subdomain for nested subdomain": {
+			matchImage: "*.example.com",
+			target:     "eu.registry.example.com/team/app",
+		},
+		"ecr wildcards": {
+			matchImage: "*.dkr.ecr.*.amazonaws.com",
+			target:     "123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app",
+			matched:    true,
+		},
+		"ecr wildcards for registry resource": {
+			matchImage: "*.dkr.ecr.*.amazonaws.com",
+			target:     "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			registry:   true,
+			matched:    true,
+		},
+		"ecr wildcards for different domain": {
+			matchImage: "*.dkr.ecr.*.amazonaws.com",
+			target:     "123456789012.dkr.ecr.us-east-1.amazonaws.com.cn/team/app",
+		},
+		"partial wildcard": {
+			matchImage: "*-docker.pkg.dev",
+			target:     "us-central1-docker.pkg.dev/project/repo/app",
+			matched:    true,
+		},
+		"docker hub": {
+			matchImage: "docker.io",
+			target:     "library/busybox",
+			matched:    true,
+		},
+		"docker hub index": {
+			matchImage: "index.docker.io",
+			target:     "busybox",
+			matched:    true,
+		},
+		"docker hub wildcard": {
+			matchImage: "*.docker.io",
+			target:     "rancher/kubectl",
+			matched:    true,
+		},
+		"docker hub repository path prefix": {
+			matchImage: "docker.io/rancher",
+			target:     "rancher/kubectl",
+			matched:    true,
+		},
+		"docker hub different repository path": {
+			matchImage: "docker.io/rancher",
+			target:     "busybox",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var target authn.Resource
+			var err error
+			if test.registry {
+				target, err = name.NewRegistry(test.target)
+			} else {
+				target, err = name.NewRepository(test.target)
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse %s: %v", test.target, err)
+			}
+			candidates := imageCandidates(target)
+
+			p := &pluginWrapper{providers: []providerConfig{{Name: "provider", MatchImages: []string{test.matchImage}}}}
+			if providers, _ := p.matchingProviders(candidates); (len(providers) > 0) != test.matched {
+				t.Errorf("Expected matchImages %s to match %s (tried as %v): %t", test.matchImage, test.target, candidates, test.matched)
+			}
+
+			// plugins may return credentials for the same patterns
+			keyring := newKeyring()
+			keyring.add(dockerConfig{test.matchImage: dockerConfigEntry{Username: "user"}})
+			if _, ok := lookupCandidates(keyring, candidates); ok != test.matched {
+				t.Errorf("Expected credentials for %s to match %s (tried as %v): %t", test.matchImage, test.target, candidates, test.matched)
+			}
+		})
+	}
+}
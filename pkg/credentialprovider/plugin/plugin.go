@@ -1,59 +1,204 @@
 package plugin
 
 import (
-	"flag"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 
 	"github.com/google/go-containerregistry/pkg/authn"
-	"k8s.io/klog/v2"
-	kubecredentialprovider "k8s.io/kubernetes/pkg/credentialprovider"
-	kubeplugin "k8s.io/kubernetes/pkg/credentialprovider/plugin"
+	"github.com/rancher/wharfie/pkg/registries"
 )
 
 type pluginWrapper struct {
-	k kubecredentialprovider.DockerKeyring
+	binDir       string
+	timeout      time.Duration
+	providers    []providerConfig
+	dockerConfig dockerConfig
+	cache        *credentialCache
+	stats        *pluginStats
+}
+
+// Option configures the credential provider plugins.
+type Option func(*pluginWrapper) error
+
+// WithTimeout sets how long each plugin may run before it is killed, instead of DefaultTimeout. A timeout of zero
+// lets plugins run for as long as they need.
+func WithTimeout(timeout time.Duration) Option {
+	return func(p *pluginWrapper) error {
+		p.timeout = timeout
+		return nil
+	}
+}
+
+// WithEnvFile adds the environment variables in the file to those set for the plugins by the env of each provider in
+// the CredentialProviderConfig file, replacing any with the same name. The file maps the name of each provider to the
+// names and values of its variables, as YAML or JSON. Values may refer to wharfie's own environment as ${VAR}, as
+// they may in the CredentialProviderConfig file.
+func WithEnvFile(path string) Option {
+	return func(p *pluginWrapper) error {
+		env, err := readEnvFile(path)
+		if err != nil {
+			return err
+		}
+		for i := range p.providers {
+			provider := &p.providers[i]
+			names := make([]string, 0, len(env[provider.Name]))
+			for name := range env[provider.Name] {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				provider.Env = append(provider.Env, envConfig{Name: name, Value: env[provider.Name][name]})
+			}
+			delete(env, provider.Name)
+		}
+		if len(env) > 0 {
+			unknown := make([]string, 0, len(env))
+			for name := range env {
+				unknown = append(unknown, name)
+			}
+			sort.Strings(unknown)
+			return errors.Errorf("credential provider environment file %s sets variables for providers that are not configured: %s", path, strings.Join(unknown, ", "))
+		}
+		return nil
+	}
 }
 
 // Explicit interface checks
 var _ authn.Keychain = &pluginWrapper{}
+var _ registries.RotatingKeychain = &pluginWrapper{}
+var _ registries.InvalidatingKeychain = &pluginWrapper{}
 
-// RegisterCredentialProviderPlugins loads the provided configuration into the credentialprovider plugin registry
+// RegisterCredentialProviderPlugins loads the provided configuration, and returns a keychain that executes the
+// configured plugins to get credentials. Each keychain is independent of any others, so it may be called again
+// with the same or a different configuration.
 // If the configuration is not valid or any configured plugins are missing, an error will be raised.
-func RegisterCredentialProviderPlugins(imageCredentialProviderConfigFile, imageCredentialProviderBinDir string) (*pluginWrapper, error) {
+func RegisterCredentialProviderPlugins(imageCredentialProviderConfigFile, imageCredentialProviderBinDir string, opts ...Option) (*pluginWrapper, error) {
 	klogSetup()
-	if err := kubeplugin.RegisterCredentialProviderPlugins(imageCredentialProviderConfigFile, imageCredentialProviderBinDir); err != nil {
+	providers, err := readProviderConfigs(imageCredentialProviderConfigFile, imageCredentialProviderBinDir)
+	if err != nil {
 		return nil, errors.Wrap(err, "failed to register CRI auth plugins")
 	}
-	return &pluginWrapper{k: kubecredentialprovider.NewDockerKeyring()}, nil
+	p := &pluginWrapper{
+		binDir:    imageCredentialProviderBinDir,
+		timeout:   DefaultTimeout,
+		providers: providers,
+		cache:     newCredentialCache(),
+		stats:     newPluginStats(),
+	}
+	// the kubelet also falls back to credentials from legacy Docker config files
+	if config, err := readDockerConfigFile(); err == nil {
+		p.dockerConfig = config
+	}
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
 }
 
 // Resolve returns an authenticator for the authn.Keychain interface. The authenticator provides
-// credentials to a registry by calling the credentialprovider plugin registry's Lookup method,
-// which in turn consults the configuration and executes plugins to obtain credentials.
+// credentials to a registry by executing the plugins whose matchImages match the target, and looking up the
+// credentials that they return, along with any from legacy Docker config files, in the same way as the kubelet.
+// There may be multiple AuthConfigs for credential rotation support; Resolve returns the first of them, and
+// ResolveAll returns them all so that the others can be tried if the registry rejects it.
+// If there are no credentials for the target because a plugin failed, its *PluginError is returned.
 func (p *pluginWrapper) Resolve(target authn.Resource) (authn.Authenticator, error) {
-	// Lookup may provide multiple AuthConfigs (for credential rotation support) but the Keychain interface only allows us to return one.
-	if configs, ok := p.k.Lookup(target.String()); ok {
-		return authn.FromConfig(authn.AuthConfig{
-			Username:      configs[0].Username,
-			Password:      configs[0].Password,
-			Auth:          configs[0].Auth,
-			IdentityToken: configs[0].IdentityToken,
-			RegistryToken: configs[0].RegistryToken,
-		}), nil
+	auths, err := p.lookup(target)
+	if err != nil {
+		return nil, err
+	}
+	if len(auths) > 0 {
+		return authn.FromConfig(auths[0]), nil
 	}
-
 	return authn.Anonymous, nil
 }
 
-// klogSetup syncs the klog verbosity to the current Logrus log level. This is necessary because the
-// auth plugin stuff all uses klog/v2 and there's no good translation layer between logrus and klog.
-func klogSetup() {
-	klogFlags := flag.NewFlagSet("klog", flag.ContinueOnError)
-	klog.InitFlags(klogFlags)
-	if logrus.IsLevelEnabled(logrus.DebugLevel) {
-		_ = klogFlags.Set("v", "9")
+// ResolveAll returns an authenticator for each of the credentials that the plugins provide for the target, in the
+// order that the kubelet would try them, or anonymous access if there are none.
+func (p *pluginWrapper) ResolveAll(target authn.Resource) ([]authn.Authenticator, error) {
+	auths, err := p.lookup(target)
+	if err != nil {
+		return nil, err
+	}
+	if len(auths) == 0 {
+		return []authn.Authenticator{authn.Anonymous}, nil
+	}
+	authenticators := make([]authn.Authenticator, 0, len(auths))
+	for _, auth := range auths {
+		authenticators = append(authenticators, authn.FromConfig(auth))
+	}
+	return authenticators, nil
+}
+
+// lookup returns the credentials for the target. Credentials are cached for the registry or repository of the
+// target for the defaultCacheDuration of the providers that match it, so that they are not looked up again for
+// each request of a pull. Plugins that fail are logged, and the first of their errors is returned if no
+// credentials are found.
+func (p *pluginWrapper) lookup(target authn.Resource) ([]authn.AuthConfig, error) {
+	key := target.String()
+	auths, ok := p.cache.get(key)
+	p.stats.cacheLookup(ok)
+	if ok {
+		return auths, nil
+	}
+
+	var pluginErr error
+	candidates := imageCandidates(target)
+	keyring := newKeyring()
+	keyring.add(p.dockerConfig)
+	providers, matched := p.matchingProviders(candidates)
+	for _, provider := range providers {
+		logrus.Debugf("Credential provider plugin %s matches %s", provider.Name, matched)
+		// plugins are given the full image, even if only a form without the port matched
+		start := time.Now()
+		response, err := provider.exec(p.binDir, key, p.timeout)
+		p.stats.invocation(provider.Name, time.Since(start), err != nil)
+		if err != nil {
+			logrus.Debugf("Credential provider plugin %s did not return credentials: %v", provider.Name, err)
+			if pluginErr == nil {
+				pluginErr = err
+			}
+			continue
+		}
+		logrus.Debugf("Credential provider plugin %s returned %d credentials for %s", provider.Name, len(response.Auth), key)
+		keyring.add(response.dockerConfig())
+	}
+
+	auths, ok = lookupCandidates(keyring, candidates)
+	if !ok {
+		return nil, pluginErr
+	}
+	if pluginErr != nil {
+		logrus.Warnf("Using other credentials for %s, as a credential provider plugin failed: %v", key, pluginErr)
+	}
+	if duration := cacheDuration(providers); duration > 0 {
+		p.cache.add(key, auths, duration)
+	}
+	return auths, nil
+}
+
+// Invalidate drops the credentials cached for the target, so that the next Resolve looks them up again. It should be
+// called when the registry rejects the credentials, such as with a 401 response.
+func (p *pluginWrapper) Invalidate(target authn.Resource) {
+	p.cache.remove(target.String())
+}
+
+// cacheDuration returns how long credentials from the providers may be cached: the shortest of their
+// defaultCacheDurations, or zero if there are no providers or any of them does not set one.
+func cacheDuration(providers []*providerConfig) time.Duration {
+	var duration time.Duration
+	for _, provider := range providers {
+		if provider.cacheDuration == 0 {
+			return 0
+		}
+		if duration == 0 || provider.cacheDuration < duration {
+			duration = provider.cacheDuration
+		}
 	}
-	_ = klogFlags.Parse(nil)
+	return duration
 }
@@ -0,0 +1,465 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/rancher/wharfie/pkg/credentialprovider/credentialprovidertest"
+)
+
+func TestResolveCache(t *testing.T) {
+	dir := t.TempDir()
+	// the plugin asks for its response not to be cached, so that only the wrapper's cache prevents it being executed
+	plugin := credentialprovidertest.WritePlugin(t, dir, "counting-provider", credentialprovidertest.Response{
+		CacheDuration: "0s",
+		Auth:          map[string]authn.AuthConfig{"*.cache.example.com": {Username: "user", Password: "pass"}},
+	})
+	config := credentialprovidertest.WriteConfig(t, dir, credentialprovidertest.Provider{
+		Name:                 "counting-provider",
+		MatchImages:          []string{"*.cache.example.com"},
+		DefaultCacheDuration: "1h",
+	})
+
+	p, err := RegisterCredentialProviderPlugins(config, dir)
+	if err != nil {
+		t.Fatalf("Failed to register plugins: %v", err)
+	}
+	now := time.Now()
+	p.cache.now = func() time.Time { return now }
+
+	resolve := func(repository string, expected int) {
+		t.Helper()
+		repo, err := name.NewRepository(repository)
+		if err != nil {
+			t.Fatalf("Failed to parse repository: %v", err)
+		}
+		authenticator, err := p.Resolve(repo)
+		if err != nil {
+			t.Fatalf("Failed to resolve credentials for %s: %v", repository, err)
+		}
+		auth := credentialprovidertest.Authorization(t, authenticator)
+		if auth.Username != "user" || auth.Password != "pass" {
+			t.Errorf("Expected credentials user:pass for %s but got %+v", repository, auth)
+		}
+		if count := plugin.Invocations(t); count != expected {
+			t.Errorf("Expected plugin to be executed %d times after resolving %s, but got %d", expected, repository, count)
+		}
+	}
+
+	resolve("registry.cache.example.com/team/app", 1)
+	resolve("registry.cache.example.com/team/app", 1)
+	// credentials are cached for each repository
+	resolve("registry.cache.example.com/team/other", 2)
+
+	repo, _ := name.NewRepository("registry.cache.example.com/team/app")
+	p.Invalidate(repo)
+	resolve("registry.cache.example.com/team/app", 3)
+	resolve("registry.cache.example.com/team/app", 3)
+
+	now = now.Add(time.Hour)
+	resolve("registry.cache.example.com/team/app", 4)
+
+	// images that no provider matches do not execute the plugin
+	unmatched, _ := name.NewRepository("registry.example.org/team/app")
+	if authenticator, err := p.Resolve(unmatched); err != nil || authenticator != authn.Anonymous {
+		t.Errorf("Expected anonymous access for unmatched registry, but got %v, %v", authenticator, err)
+	}
+	if count := plugin.Invocations(t); count != 4 {
+		t.Errorf("Expected plugin not to be executed for unmatched registry, but got %d executions", count)
+	}
+}
+
+func TestResolveAll(t *testing.T) {
+	dir := t.TempDir()
+	credentialprovidertest.WritePlugin(t, dir, "rotating-provider", credentialprovidertest.Response{
+		Auth: map[string]authn.AuthConfig{
+			"*.rotate.example.com":        {Username: "old", Password: "pass"},
+			"registry.rotate.example.com": {Username: "new", Password: "pass"},
+		},
+	})
+	config := credentialprovidertest.WriteConfig(t, dir, credentialprovidertest.Provider{
+		Name:                 "rotating-provider",
+		MatchImages:          []string{"*.rotate.example.com"},
+		DefaultCacheDuration: "1h",
+	})
+
+	p, err := RegisterCredentialProviderPlugins(config, dir)
+	if err != nil {
+		t.Fatalf("Failed to register plugins: %v", err)
+	}
+
+	repo, err := name.NewRepository("registry.rotate.example.com/team/app")
+	if err != nil {
+		t.Fatalf("Failed to parse repository: %v", err)
+	}
+	authenticators, err := p.ResolveAll(repo)
+	if err != nil {
+		t.Fatalf("Failed to resolve credentials: %v", err)
+	}
+	usernames := []string{}
+	for _, authenticator := range authenticators {
+		usernames = append(usernames, credentialprovidertest.Authorization(t, authenticator).Username)
+	}
+	if strings.Join(usernames, ",") != "new,old" {
+		t.Errorf("Expected credentials for new,old but got %s", strings.Join(usernames, ","))
+	}
+
+	authenticator, err := p.Resolve(repo)
+	if err != nil {
+		t.Fatalf("Failed to resolve credentials: %v", err)
+	}
+	if auth := credentialprovidertest.Authorization(t, authenticator); auth.Username != "new" {
+		t.Errorf("Expected Resolve to return the most specific credentials, but got %+v", auth)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	dir := t.TempDir()
+	credentialprovidertest.WriteScript(t, dir, "hanging-provider", "echo 'requesting token' >&2\nexec sleep 60\n")
+	credentialprovidertest.WriteFailingPlugin(t, dir, "failing-provider", 3, "token endpoint returned 403")
+	credentialprovidertest.WriteScript(t, dir, "garbled-provider", "echo 'not json'\n")
+	config := credentialprovidertest.WriteConfig(t, dir,
+		credentialprovidertest.Provider{Name: "hanging-provider", MatchImages: []string{"hang.example.com"}, DefaultCacheDuration: "1h"},
+		credentialprovidertest.Provider{Name: "failing-provider", MatchImages: []string{"fail.example.com"}, DefaultCacheDuration: "1h"},
+		credentialprovidertest.Provider{Name: "garbled-provider", MatchImages: []string{"garbled.example.com"}, DefaultCacheDuration: "1h"},
+	)
+
+	p, err := RegisterCredentialProviderPlugins(config, dir, WithTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to register plugins: %v", err)
+	}
+
+	tests := map[string]struct {
+		repository string
+		plugin     string
+		exitCode   int
+		message    []string
+	}{
+		"plugin times out": {
+			repository: "hang.example.com/team/app",
+			plugin:     "hanging-provider",
+			exitCode:   -1,
+			message:    []string{"hanging-provider", "timed out after 200ms", "requesting token"},
+		},
+		"plugin exits unsuccessfully": {
+			repository: "fail.example.com/team/app",
+			plugin:     "failing-provider",
+			exitCode:   3,
+			message:    []string{"failing-provider", "exit code 3", "token endpoint returned 403"},
+		},
+		"plugin returns invalid response": {
+			repository: "garbled.example.com/team/app",
+			plugin:     "garbled-provider",
+			message:    []string{"garbled-provider", "failed to decode credential provider response"},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			repo, err := name.NewRepository(test.repository)
+			if err != nil {
+				t.Fatalf("Failed to parse repository: %v", err)
+			}
+			start := time.Now()
+			_, err = p.Resolve(repo)
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Expected plugin to be killed after timing out, but Resolve took %s", elapsed)
+			}
+			pluginErr := &PluginError{}
+			if !errors.As(err, &pluginErr) {
+				t.Fatalf("Expected PluginError but got %v", err)
+			}
+			if pluginErr.Plugin != test.plugin || pluginErr.ExitCode != test.exitCode {
+				t.Errorf("Expected error from plugin %s with exit code %d, but got %s with exit code %d", test.plugin, test.exitCode, pluginErr.Plugin, pluginErr.ExitCode)
+			}
+			for _, message := range test.message {
+				if !strings.Contains(err.Error(), message) {
+					t.Errorf("Expected error to contain %q but got %v", message, err)
+				}
+			}
+		})
+	}
+}
+
+func TestIndependentKeychains(t *testing.T) {
+	// each keychain has a plugin with the same name, which returns different credentials
+	keychains := map[string]*pluginWrapper{}
+	for _, username := range []string{"first", "second"} {
+		dir := t.TempDir()
+		credentialprovidertest.WritePlugin(t, dir, "shared-provider", credentialprovidertest.Response{
+			Auth: map[string]authn.AuthConfig{"*.shared.example.com": {Username: username, Password: "pass"}},
+		})
+		config := credentialprovidertest.WriteConfig(t, dir, credentialprovidertest.Provider{
+			Name:        "shared-provider",
+			MatchImages: []string{"*.shared.example.com"},
+		})
+		// registering the same configuration again is safe
+		for i := 0; i < 2; i++ {
+			p, err := RegisterCredentialProviderPlugins(config, dir)
+			if err != nil {
+				t.Fatalf("Failed to register plugins for %s: %v", username, err)
+			}
+			keychains[username] = p
+		}
+	}
+
+	repo, err := name.NewRepository("registry.shared.example.com/team/app")
+	if err != nil {
+		t.Fatalf("Failed to parse repository: %v", err)
+	}
+	errs := make(chan error, 10*len(keychains))
+	wg := sync.WaitGroup{}
+	for username, p := range keychains {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(username string, p *pluginWrapper) {
+				defer wg.Done()
+				authenticator, err := p.Resolve(repo)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if auth, _ := authenticator.Authorization(); auth.Username != username {
+					errs <- fmt.Errorf("expected credentials for %s but got %+v", username, auth)
+				}
+			}(username, p)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestPluginEnv(t *testing.T) {
+	dir := t.TempDir()
+	// the plugin returns its environment as the credentials
+	credentialprovidertest.WriteScript(t, dir, "env-provider", `cat <<EOF
+{
+  "apiVersion": "credentialprovider.kubelet.k8s.io/v1",
+  "kind": "CredentialProviderResponse",
+  "cacheKeyType": "Registry",
+  "auth": {"*.env.example.com": {"username": "$PLUGIN_USER", "password": "$PLUGIN_PASSWORD"}}
+}
+EOF
+`)
+	config := credentialprovidertest.WriteConfig(t, dir, credentialprovidertest.Provider{
+		Name:        "env-provider",
+		MatchImages: []string{"*.env.example.com"},
+		Env: map[string]string{
+			"PLUGIN_USER":     "${WHARFIE_TEST_USER}-from-config",
+			"PLUGIN_PASSWORD": "from-config",
+		},
+	})
+	t.Setenv("WHARFIE_TEST_USER", "robot")
+	t.Setenv("WHARFIE_TEST_PASSWORD", "secret")
+
+	tests := map[string]struct {
+		env      string
+		username string
+		password string
+		err      string
+	}{
+		"config env": {
+			username: "robot-from-config",
+			password: "from-config",
+		},
+		"env file": {
+			env:      "env-provider:\n  PLUGIN_PASSWORD: ${WHARFIE_TEST_PASSWORD}$1${WHARFIE_TEST_UNSET}\n",
+			username: "robot-from-config",
+			password: "secret$1",
+		},
+		"env file for unknown provider": {
+			env: "env-provider:\n  PLUGIN_PASSWORD: pass\nother-provider:\n  PLUGIN_PASSWORD: pass\n",
+			err: "sets variables for providers that are not configured: other-provider",
+		},
+	}
+
+	repo, err := name.NewRepository("registry.env.example.com/team/app")
+	if err != nil {
+		t.Fatalf("Failed to parse repository: %v", err)
+	}
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			opts := []Option{}
+			if test.env != "" {
+				envFile := filepath.Join(t.TempDir(), "env.yaml")
+				if err := os.WriteFile(envFile, []byte(test.env), 0644); err != nil {
+					t.Fatalf("Failed to write env file: %v", err)
+				}
+				opts = append(opts, WithEnvFile(envFile))
+			}
+			p, err := RegisterCredentialProviderPlugins(config, dir, opts...)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error containing %q but got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Failed to register plugins: %v", err)
+			}
+
+			authenticator, err := p.Resolve(repo)
+			if err != nil {
+				t.Fatalf("Failed to resolve credentials: %v", err)
+			}
+			auth := credentialprovidertest.Authorization(t, authenticator)
+			if auth.Username != test.username || auth.Password != test.password {
+				t.Errorf("Expected credentials %s:%s but got %s:%s", test.username, test.password, auth.Username, auth.Password)
+			}
+		})
+	}
+}
+
+func TestPluginAPIVersions(t *testing.T) {
+	dir := t.TempDir()
+	// each plugin always responds in its apiVersion, as a plugin built against that version would
+	plugins := map[string]*credentialprovidertest.Plugin{}
+	for _, version := range []string{"v1", "v1beta1", "v1alpha1"} {
+		pluginName := version + "-provider"
+		plugins[pluginName] = credentialprovidertest.WritePlugin(t, dir, pluginName, credentialprovidertest.Response{
+			APIVersion: "credentialprovider.kubelet.k8s.io/" + version,
+			Auth:       map[string]authn.AuthConfig{"*.version.example.com": {Username: pluginName, Password: "pass"}},
+		})
+	}
+
+	tests := map[string]struct {
+		plugin     string
+		apiVersion string
+		err        string
+	}{
+		"v1": {
+			plugin:     "v1-provider",
+			apiVersion: "credentialprovider.kubelet.k8s.io/v1",
+		},
+		"v1beta1": {
+			plugin:     "v1beta1-provider",
+			apiVersion: "credentialprovider.kubelet.k8s.io/v1beta1",
+		},
+		"v1alpha1": {
+			plugin:     "v1alpha1-provider",
+			apiVersion: "credentialprovider.kubelet.k8s.io/v1alpha1",
+		},
+		"v1beta1 plugin configured as v1": {
+			plugin:     "v1beta1-provider",
+			apiVersion: "credentialprovider.kubelet.k8s.io/v1",
+			err:        `response has apiVersion "credentialprovider.kubelet.k8s.io/v1beta1", expected "credentialprovider.kubelet.k8s.io/v1" as configured for the provider`,
+		},
+		"v1 plugin configured as v1beta1": {
+			plugin:     "v1-provider",
+			apiVersion: "credentialprovider.kubelet.k8s.io/v1beta1",
+			err:        `response has apiVersion "credentialprovider.kubelet.k8s.io/v1", expected "credentialprovider.kubelet.k8s.io/v1beta1" as configured for the provider`,
+		},
+	}
+
+	repo, err := name.NewRepository("registry.version.example.com/team/app")
+	if err != nil {
+		t.Fatalf("Failed to parse repository: %v", err)
+	}
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			config := credentialprovidertest.WriteConfig(t, t.TempDir(), credentialprovidertest.Provider{
+				Name:        test.plugin,
+				APIVersion:  test.apiVersion,
+				MatchImages: []string{"*.version.example.com"},
+			})
+			p, err := RegisterCredentialProviderPlugins(config, dir)
+			if err != nil {
+				t.Fatalf("Failed to register plugins: %v", err)
+			}
+
+			authenticator, err := p.Resolve(repo)
+			requests := plugins[test.plugin].Requests(t)
+			if len(requests) == 0 {
+				t.Fatalf("Expected plugin %s to be executed", test.plugin)
+			}
+			// the request is always sent in the configured apiVersion
+			expected := credentialprovidertest.Request{APIVersion: test.apiVersion, Kind: "CredentialProviderRequest", Image: repo.String()}
+			if request := requests[len(requests)-1]; request != expected {
+				t.Errorf("Expected request %+v but got %+v", expected, request)
+			}
+
+			if test.err != "" {
+				pluginErr := &PluginError{}
+				if !errors.As(err, &pluginErr) || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected PluginError containing %q but got %v", test.err, err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Failed to resolve credentials: %v", err)
+			}
+			if auth := credentialprovidertest.Authorization(t, authenticator); auth.Username != test.plugin {
+				t.Errorf("Expected credentials from %s but got username %q", test.plugin, auth.Username)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir := t.TempDir()
+	plugin := credentialprovidertest.WritePlugin(t, dir, "counting-provider", credentialprovidertest.Response{
+		Auth: map[string]authn.AuthConfig{"*.stats.example.com": {Username: "user", Password: "pass"}},
+	})
+	credentialprovidertest.WriteFailingPlugin(t, dir, "failing-provider", 1, "failed")
+	config := credentialprovidertest.WriteConfig(t, dir,
+		credentialprovidertest.Provider{Name: "counting-provider", MatchImages: []string{"*.stats.example.com"}, DefaultCacheDuration: "1h"},
+		credentialprovidertest.Provider{Name: "failing-provider", MatchImages: []string{"*.stats.example.com", "*.failing.example.com"}, DefaultCacheDuration: "1h"},
+	)
+
+	p, err := RegisterCredentialProviderPlugins(config, dir)
+	if err != nil {
+		t.Fatalf("Failed to register plugins: %v", err)
+	}
+	if stats := p.Stats(); stats.CacheHits != 0 || stats.CacheMisses != 0 || len(stats.Providers) != 0 {
+		t.Errorf("Expected no statistics before resolving, but got %+v", stats)
+	}
+
+	for _, repository := range []string{
+		"registry.stats.example.com/team/app",
+		"registry.stats.example.com/team/app",
+		"registry.stats.example.com/team/other",
+		"registry.failing.example.com/team/app",
+	} {
+		repo, err := name.NewRepository(repository)
+		if err != nil {
+			t.Fatalf("Failed to parse repository: %v", err)
+		}
+		_, _ = p.Resolve(repo)
+	}
+
+	stats := p.Stats()
+	if stats.CacheHits != 1 || stats.CacheMisses != 3 {
+		t.Errorf("Expected 1 cache hit and 3 misses, but got %d hits and %d misses", stats.CacheHits, stats.CacheMisses)
+	}
+	expected := map[string][2]int{
+		"counting-provider": {2, 0},
+		"failing-provider":  {3, 3},
+	}
+	if len(stats.Providers) != len(expected) {
+		t.Fatalf("Expected statistics for %d providers, but got %+v", len(expected), stats.Providers)
+	}
+	for i, provider := range stats.Providers {
+		if i > 0 && stats.Providers[i-1].Provider >= provider.Provider {
+			t.Errorf("Expected providers to be sorted by name, but got %+v", stats.Providers)
+		}
+		counts := expected[provider.Provider]
+		if provider.Invocations != counts[0] || provider.Failures != counts[1] {
+			t.Errorf("Expected %s to have %d invocations and %d failures, but got %+v", provider.Provider, counts[0], counts[1], provider)
+		}
+		if provider.Duration <= 0 || provider.MaxDuration <= 0 || provider.MaxDuration > provider.Duration {
+			t.Errorf("Expected %s to have a total duration of at least its max duration, but got %+v", provider.Provider, provider)
+		}
+	}
+	if count := plugin.Invocations(t); count != stats.Providers[0].Invocations {
+		t.Errorf("Expected %d invocations of counting-provider to be recorded, but it was executed %d times", count, stats.Providers[0].Invocations)
+	}
+}
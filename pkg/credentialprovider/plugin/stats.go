@@ -0,0 +1,82 @@
+package plugin
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stats summarizes the credential lookups of a keychain returned by RegisterCredentialProviderPlugins, and the
+// invocations of its plugins.
+type Stats struct {
+	// CacheHits is the number of lookups answered from the credential cache, without executing any plugins.
+	CacheHits int
+	// CacheMisses is the number of lookups that were not cached.
+	CacheMisses int
+	// Providers are the statistics of each provider whose plugin has been executed, sorted by name.
+	Providers []ProviderStats
+}
+
+// ProviderStats summarizes the invocations of a provider's plugin. Durations are totals across all invocations,
+// including those that failed.
+type ProviderStats struct {
+	Provider    string
+	Invocations int
+	Failures    int
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+// pluginStats records the statistics of a keychain.
+type pluginStats struct {
+	mu          sync.Mutex
+	cacheHits   int
+	cacheMisses int
+	providers   map[string]*ProviderStats
+}
+
+func newPluginStats() *pluginStats {
+	return &pluginStats{providers: map[string]*ProviderStats{}}
+}
+
+// cacheLookup records a lookup that was answered from the cache, or not.
+func (s *pluginStats) cacheLookup(hit bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if hit {
+		s.cacheHits++
+	} else {
+		s.cacheMisses++
+	}
+}
+
+// invocation records an invocation of the provider's plugin that took the duration, and whether it failed.
+func (s *pluginStats) invocation(provider string, duration time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.providers[provider]
+	if !ok {
+		stats = &ProviderStats{Provider: provider}
+		s.providers[provider] = stats
+	}
+	stats.Invocations++
+	if failed {
+		stats.Failures++
+	}
+	stats.Duration += duration
+	if duration > stats.MaxDuration {
+		stats.MaxDuration = duration
+	}
+}
+
+// Stats returns the statistics recorded since the keychain was created.
+func (p *pluginWrapper) Stats() Stats {
+	p.stats.mu.Lock()
+	defer p.stats.mu.Unlock()
+	stats := Stats{CacheHits: p.stats.cacheHits, CacheMisses: p.stats.cacheMisses}
+	for _, provider := range p.stats.providers {
+		stats.Providers = append(stats.Providers, *provider)
+	}
+	sort.Slice(stats.Providers, func(i, j int) bool { return stats.Providers[i].Provider < stats.Providers[j].Provider })
+	return stats
+}
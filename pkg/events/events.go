@@ -0,0 +1,135 @@
+// Package events defines the events that wharfie's packages emit as images are pulled and extracted, so that programs
+// that embed wharfie can report fine-grained progress without parsing its logs. Events are sent to a Handler given to
+// the Puller, or to extraction with extract.WithEvents; nothing is sent if no handler is set.
+package events
+
+import (
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// Event is an event in the lifecycle of pulling and extracting an image: one of the event types in this package.
+type Event interface {
+	event()
+}
+
+// EndpointSelected is emitted when the manifest of an image has been read from a registry endpoint.
+type EndpointSelected struct {
+	Image    string
+	Endpoint string
+}
+
+// ManifestResolved is emitted once the image has been found, and its manifest read. Digest is the digest that the
+// reference resolved to: of the image index that the image was selected from, if the reference is an image index, or
+// else of the image. Layers is the number of layers of the image, and Size their total compressed size.
+type ManifestResolved struct {
+	Image  string
+	Digest v1.Hash
+	Layers int
+	Size   int64
+}
+
+// Layer describes a layer of an image, and how much of it has been read.
+type Layer struct {
+	Image string
+	// Digest is the digest of the layer, or the diff ID that it was looked up by in a layer cache.
+	Digest v1.Hash
+	// Index is the position of the layer in the manifest, starting at 1, and Count the number of layers of the image,
+	// or 0 if they are not known, as for layers read from a layer cache that is shared by several images.
+	Index int
+	Count int
+	// Complete is the number of bytes read so far.
+	Complete int64
+	// Size is the compressed size of the layer from its manifest, or 0 if it is not known, as for cached layers.
+	Size int64
+	// Cached is set if the layer is being read from local storage, such as a layer cache or a local image tarball,
+	// rather than downloaded.
+	Cached bool
+}
+
+// LayerPullStarted is emitted when the content of a layer is opened.
+type LayerPullStarted struct {
+	Layer
+}
+
+// LayerPullProgress is emitted at most once per ProgressInterval while the content of a layer is read.
+type LayerPullProgress struct {
+	Layer
+}
+
+// LayerPullFinished is emitted when the content of a layer is closed, whether or not it was read to the end.
+type LayerPullFinished struct {
+	Layer
+}
+
+// FileExtracted is emitted for each directory, file, link, and device node once it has been extracted, with the path
+// in the image, and the size of regular files in bytes.
+type FileExtracted struct {
+	Image       string
+	Path        string
+	Destination string
+	Size        int64
+}
+
+// Done is emitted when an image has been pulled and extracted.
+type Done struct {
+	Image string
+}
+
+// Failed is emitted when pulling or extracting an image failed, with the error that it failed with.
+type Failed struct {
+	Image string
+	Err   error
+}
+
+func (EndpointSelected) event()  {}
+func (ManifestResolved) event()  {}
+func (LayerPullStarted) event()  {}
+func (LayerPullProgress) event() {}
+func (LayerPullFinished) event() {}
+func (FileExtracted) event()     {}
+func (Done) event()              {}
+func (Failed) event()            {}
+
+// Handler receives events. It is called synchronously by the goroutine that the event happened on, so it must return
+// promptly, and be safe to call from multiple goroutines, as the layers of an image may be read concurrently.
+type Handler interface {
+	Handle(event Event)
+}
+
+// HandlerFunc is a function that receives events.
+type HandlerFunc func(event Event)
+
+func (f HandlerFunc) Handle(event Event) {
+	f(event)
+}
+
+// Emit sends the event to the handler, if it is not nil.
+func Emit(handler Handler, event Event) {
+	if handler != nil {
+		handler.Handle(event)
+	}
+}
+
+// Recorder is a handler that records all of the events sent to it, so that tests can check what was emitted. It is
+// safe to use from multiple goroutines.
+type Recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+var _ Handler = &Recorder{}
+
+func (r *Recorder) Handle(event Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+// Events returns the events recorded so far, in the order they were sent.
+func (r *Recorder) Events() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event{}, r.events...)
+}
@@ -0,0 +1,218 @@
+package events
+
+import (
+	"io"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// ProgressInterval is the minimum interval between LayerPullProgress events for a layer.
+var ProgressInterval = 100 * time.Millisecond
+
+// Reader counts the bytes read from a layer. It emits LayerPullStarted when it is created, LayerPullProgress at most
+// once per ProgressInterval while the layer is read, and LayerPullFinished when it is closed.
+type Reader struct {
+	rc       io.ReadCloser
+	layer    Layer
+	handler  Handler
+	lastSent time.Time
+	closed   bool
+}
+
+// NewReader returns a reader that counts the bytes read from rc, and sends events for the layer to the handler.
+func NewReader(rc io.ReadCloser, layer Layer, handler Handler) *Reader {
+	r := &Reader{rc: rc, layer: layer, handler: handler, lastSent: time.Now()}
+	Emit(handler, LayerPullStarted{layer})
+	return r
+}
+
+func (r *Reader) Read(b []byte) (int, error) {
+	n, err := r.rc.Read(b)
+	r.layer.Complete += int64(n)
+	if n > 0 && time.Since(r.lastSent) >= ProgressInterval {
+		r.lastSent = time.Now()
+		Emit(r.handler, LayerPullProgress{r.layer})
+	}
+	return n, err
+}
+
+// Close closes the layer, and emits LayerPullFinished.
+func (r *Reader) Close() error {
+	err := r.rc.Close()
+	if !r.closed {
+		r.closed = true
+		Emit(r.handler, LayerPullFinished{r.layer})
+	}
+	return err
+}
+
+// Image returns an image whose layers send events to the handler as their compressed content is downloaded, for the
+// image with the given name. The uncompressed content is decompressed from the counted compressed content, so that
+// progress is reported against the layer sizes in the manifest whichever is read. This should wrap the remote image,
+// beneath any layer cache. If the handler is nil, the image is returned as it is.
+func Image(img v1.Image, image string, handler Handler) v1.Image {
+	if handler == nil {
+		return img
+	}
+	return &layerImage{Image: img, image: image, handler: handler}
+}
+
+// CachedImage returns an image whose layers send events to the handler as they are read, as Image does, for an image
+// that is read from local storage, such as a layer cache or a local image tarball. Whichever content of a layer is
+// read is counted, so the layers are reported as cached, without a size.
+func CachedImage(img v1.Image, image string, handler Handler) v1.Image {
+	if handler == nil {
+		return img
+	}
+	return &layerImage{Image: img, image: image, handler: handler, cached: true}
+}
+
+type layerImage struct {
+	v1.Image
+	image   string
+	handler Handler
+	cached  bool
+}
+
+func (i *layerImage) Layers() ([]v1.Layer, error) {
+	layers, err := i.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]v1.Layer, len(layers))
+	for idx, layer := range layers {
+		out[idx] = i.wrap(layer, idx, len(layers))
+	}
+	return out, nil
+}
+
+func (i *layerImage) LayerByDigest(h v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDigest(h)
+	if err != nil {
+		return nil, err
+	}
+	idx, count := -1, 0
+	if manifest, err := i.Image.Manifest(); err == nil {
+		count = len(manifest.Layers)
+		for n, desc := range manifest.Layers {
+			if desc.Digest == h {
+				idx = n
+				break
+			}
+		}
+	}
+	return i.wrap(layer, idx, count), nil
+}
+
+func (i *layerImage) LayerByDiffID(h v1.Hash) (v1.Layer, error) {
+	layer, err := i.Image.LayerByDiffID(h)
+	if err != nil {
+		return nil, err
+	}
+	idx, count := -1, 0
+	if config, err := i.Image.ConfigFile(); err == nil {
+		count = len(config.RootFS.DiffIDs)
+		for n, diffID := range config.RootFS.DiffIDs {
+			if diffID == h {
+				idx = n
+				break
+			}
+		}
+	}
+	return i.wrap(layer, idx, count), nil
+}
+
+// wrap wraps the layer at the index of the layers of the image, or -1 if it is not known.
+func (i *layerImage) wrap(layer v1.Layer, idx, count int) v1.Layer {
+	info := Layer{Image: i.image}
+	if idx >= 0 {
+		info.Index, info.Count = idx+1, count
+	}
+	if i.cached {
+		digest, _ := layer.Digest()
+		info.Digest, info.Cached = digest, true
+		return &cachedLayer{Layer: layer, info: info, handler: i.handler}
+	}
+	l, _ := partial.CompressedToLayer(&compressedLayer{Layer: layer, info: info, handler: i.handler})
+	return l
+}
+
+// compressedLayer counts the compressed content of a layer as it is downloaded. DiffID is delegated to the layer, so
+// that it is not computed by reading the content.
+type compressedLayer struct {
+	v1.Layer
+	info    Layer
+	handler Handler
+}
+
+func (l *compressedLayer) Compressed() (io.ReadCloser, error) {
+	digest, err := l.Layer.Digest()
+	if err != nil {
+		return nil, err
+	}
+	size, err := l.Layer.Size()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	info := l.info
+	info.Digest, info.Size = digest, size
+	return NewReader(rc, info, l.handler), nil
+}
+
+func (l *compressedLayer) DiffID() (v1.Hash, error)            { return l.Layer.DiffID() }
+func (l *compressedLayer) MediaType() (types.MediaType, error) { return l.Layer.MediaType() }
+
+// Cache returns a cache whose cached layers send events to the handler as they are read, for the image with the given
+// name. The size of cached layers, and their position in the image, are not known without reading them, so they are
+// not set. If the handler is nil, the cache is returned as it is.
+func Cache(c cache.Cache, image string, handler Handler) cache.Cache {
+	if handler == nil {
+		return c
+	}
+	return &layerCache{Cache: c, image: image, handler: handler}
+}
+
+type layerCache struct {
+	cache.Cache
+	image   string
+	handler Handler
+}
+
+func (c *layerCache) Get(h v1.Hash) (v1.Layer, error) {
+	layer, err := c.Cache.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedLayer{Layer: layer, info: Layer{Image: c.image, Digest: h, Cached: true}, handler: c.handler}, nil
+}
+
+// cachedLayer counts the content of a layer as it is read from a cache.
+type cachedLayer struct {
+	v1.Layer
+	info    Layer
+	handler Handler
+}
+
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(rc, l.info, l.handler), nil
+}
+
+func (l *cachedLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(rc, l.info, l.handler), nil
+}
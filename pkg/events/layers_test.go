@@ -0,0 +1,124 @@
+package events
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+// readLayer reads the layer content to completion, and returns the events recorded while reading it.
+func readLayer(t *testing.T, recorder *Recorder, open func() (io.ReadCloser, error)) []Event {
+	t.Helper()
+	before := len(recorder.Events())
+	rc, err := open()
+	if err != nil {
+		t.Fatalf("Failed to open layer: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Failed to close layer: %v", err)
+	}
+	sent := recorder.Events()[before:]
+	if len(sent) < 2 {
+		t.Fatalf("Expected layer to be started and finished, but got %v", sent)
+	}
+	if _, ok := sent[0].(LayerPullStarted); !ok {
+		t.Errorf("Expected first event to start the layer, but got %#v", sent[0])
+	}
+	if _, ok := sent[len(sent)-1].(LayerPullFinished); !ok {
+		t.Errorf("Expected last event to finish the layer, but got %#v", sent[len(sent)-1])
+	}
+	for _, event := range sent[1 : len(sent)-1] {
+		if _, ok := event.(LayerPullProgress); !ok {
+			t.Errorf("Expected progress while the layer is read, but got %#v", event)
+		}
+	}
+	return sent
+}
+
+func TestImage(t *testing.T) {
+	defer func(interval time.Duration) { ProgressInterval = interval }(ProgressInterval)
+	ProgressInterval = 0
+	recorder := &Recorder{}
+	img, err := random.Image(64*1024, 3)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	if Image(img, "busybox", nil) != img {
+		t.Errorf("Expected image to be returned as it is without a handler")
+	}
+
+	layers, err := Image(img, "busybox", recorder).Layers()
+	if err != nil {
+		t.Fatalf("Failed to get layers: %v", err)
+	}
+	for i, layer := range layers {
+		digest, _ := layer.Digest()
+		size, _ := layer.Size()
+
+		// the size is the compressed size whichever content is read, and the count matches it once read
+		for _, open := range []func() (io.ReadCloser, error){layer.Compressed, layer.Uncompressed} {
+			sent := readLayer(t, recorder, open)
+			final := sent[len(sent)-1].(LayerPullFinished)
+			expected := Layer{Image: "busybox", Digest: digest, Index: i + 1, Count: 3, Complete: size, Size: size}
+			if final.Layer != expected {
+				t.Errorf("Expected layer %+v but got %+v", expected, final.Layer)
+			}
+		}
+	}
+
+	// layers looked up by digest and diff ID are numbered by their position in the image
+	last, _ := layers[2].Digest()
+	layer, err := Image(img, "busybox", recorder).LayerByDigest(last)
+	if err != nil {
+		t.Fatalf("Failed to get layer: %v", err)
+	}
+	if started := readLayer(t, recorder, layer.Compressed)[0].(LayerPullStarted); started.Index != 3 || started.Count != 3 {
+		t.Errorf("Expected layer 3 of 3 but got %+v", started.Layer)
+	}
+	diffID, _ := layers[1].DiffID()
+	if layer, err = CachedImage(img, "busybox", recorder).LayerByDiffID(diffID); err != nil {
+		t.Fatalf("Failed to get layer: %v", err)
+	}
+	if started := readLayer(t, recorder, layer.Uncompressed)[0].(LayerPullStarted); started.Index != 2 || !started.Cached || started.Size != 0 {
+		t.Errorf("Expected cached layer 2 without a size but got %+v", started.Layer)
+	}
+}
+
+func TestCache(t *testing.T) {
+	layer, err := random.Layer(64*1024, "")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	c := cache.NewFilesystemCache(t.TempDir())
+	cached, err := c.Put(layer)
+	if err != nil {
+		t.Fatalf("Failed to cache layer: %v", err)
+	}
+	rc, err := cached.Uncompressed()
+	if err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	_, size, err := v1.SHA256(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+
+	recorder := &Recorder{}
+	diffID, _ := layer.DiffID()
+	if cached, err = Cache(c, "busybox", recorder).Get(diffID); err != nil {
+		t.Fatalf("Failed to get cached layer: %v", err)
+	}
+	sent := readLayer(t, recorder, cached.Uncompressed)
+	expected := Layer{Image: "busybox", Digest: diffID, Complete: size, Cached: true}
+	if final := sent[len(sent)-1].(LayerPullFinished); final.Layer != expected {
+		t.Errorf("Expected cached layer %+v but got %+v", expected, final.Layer)
+	}
+}
@@ -0,0 +1,35 @@
+package extract
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// createTemp creates a temporary file in the same directory as the given path, so that
+// it can be renamed over the path once the content has been written.
+func createTemp(path string) (*os.File, error) {
+	return os.CreateTemp(longPath(filepath.Dir(path)), "."+filepath.Base(path)+".")
+}
+
+// writeFileAtomic writes the content of the reader to a temporary file, and renames it over the
+// given path once all content has been written. If an error occurs, the path is left untouched.
+func writeFileAtomic(path string, r io.Reader, mode os.FileMode) error {
+	f, err := createTemp(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		return err
+	}
+	return replaceFile(f.Name(), path)
+}
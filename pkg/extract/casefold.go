@@ -0,0 +1,133 @@
+package extract
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/logging"
+)
+
+var ErrCaseCollision = errors.New("destination differs only by case from another extracted path")
+
+// CaseCollisionPolicy controls the handling of extracted paths that differ only by case, when extracting
+// to a case-insensitive filesystem. Such paths refer to the same file, so one overwrites the other.
+type CaseCollisionPolicy int
+
+const (
+	// CaseCollisionWarn logs a warning when paths differ only by case.
+	CaseCollisionWarn CaseCollisionPolicy = iota
+	// CaseCollisionError fails extraction when paths differ only by case.
+	CaseCollisionError
+	// CaseCollisionIgnore does not check for paths that differ only by case.
+	CaseCollisionIgnore
+)
+
+var caseCollisionPolicies = map[string]CaseCollisionPolicy{
+	"warn":   CaseCollisionWarn,
+	"error":  CaseCollisionError,
+	"ignore": CaseCollisionIgnore,
+}
+
+// ParseCaseCollisionPolicy returns the CaseCollisionPolicy with the given name: one of warn, error, or ignore.
+func ParseCaseCollisionPolicy(name string) (CaseCollisionPolicy, error) {
+	if policy, ok := caseCollisionPolicies[name]; ok {
+		return policy, nil
+	}
+	return CaseCollisionWarn, errors.Errorf("invalid case collision policy %q", name)
+}
+
+// caseTracker records extracted paths under case-insensitive destination roots, to detect paths that
+// differ only by case.
+type caseTracker struct {
+	policy CaseCollisionPolicy
+	force  bool
+	// roots records whether each destination root is on a case-insensitive filesystem
+	roots map[string]bool
+	// paths maps the lower-cased form of each extracted path, and its parents, to the path as extracted
+	paths  map[string]string
+	logger logging.Logger
+}
+
+func newCaseTracker(o *options) *caseTracker {
+	return &caseTracker{
+		policy: o.caseCollisionPolicy,
+		force:  o.caseInsensitive,
+		roots:  map[string]bool{},
+		paths:  map[string]string{},
+		logger: o.log(),
+	}
+}
+
+// add records a destination path and its parent directories up to the destination root. If the root is
+// case-insensitive and any of them differ only by case from a previously recorded path, the collision is
+// handled according to the policy.
+func (c *caseTracker) add(root, destination string) error {
+	if c.policy == CaseCollisionIgnore {
+		return nil
+	}
+	insensitive, ok := c.roots[root]
+	if !ok {
+		insensitive = c.force || isCaseInsensitive(root, c.logger)
+		if insensitive {
+			c.logger.Debugf("Destination %s is case-insensitive", root)
+		}
+		c.roots[root] = insensitive
+	}
+	if !insensitive {
+		return nil
+	}
+
+	for p := destination; isWithin(root, p) && p != root; p = filepath.Dir(p) {
+		key := strings.ToLower(p)
+		prev, ok := c.paths[key]
+		if !ok {
+			c.paths[key] = p
+			continue
+		}
+		if prev == p {
+			// parents were recorded along with this path
+			return nil
+		}
+		if c.policy == CaseCollisionError {
+			return errors.Wrapf(ErrCaseCollision, "%s collides with %s", p, prev)
+		}
+		c.logger.Warnf("Extracted path %s differs only by case from %s; one will overwrite the other", p, prev)
+		return nil
+	}
+	return nil
+}
+
+// isCaseInsensitive probes the filesystem holding the directory, or its closest existing parent, by creating
+// a temporary file and checking whether it can be found by its upper-cased name. If the probe cannot be
+// completed, the filesystem is assumed to be case-sensitive.
+func isCaseInsensitive(dir string, logger logging.Logger) bool {
+	for {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+
+	f, err := os.CreateTemp(dir, ".wharfie-case-probe-")
+	if err != nil {
+		logger.Debugf("Unable to probe case sensitivity of %s: %v", dir, err)
+		return false
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	probe := filepath.Join(dir, strings.ToUpper(filepath.Base(name)))
+	a, err := os.Lstat(name)
+	if err != nil {
+		return false
+	}
+	b, err := os.Lstat(probe)
+	return err == nil && os.SameFile(a, b)
+}
@@ -0,0 +1,29 @@
+//go:build linux
+
+package extract
+
+import (
+	"archive/tar"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// canMknod returns true if entries of the given type can be created on this platform. Fifos can be created
+// by any user; device nodes require root.
+func canMknod(typeflag byte) bool {
+	return typeflag == tar.TypeFifo || os.Geteuid() == 0
+}
+
+// mknod creates a fifo or device node at the path, with the type and device numbers from the tar header.
+func mknod(path string, h *tar.Header, mode os.FileMode) error {
+	perm := uint32(mode.Perm())
+	dev := int(unix.Mkdev(uint32(h.Devmajor), uint32(h.Devminor)))
+	switch h.Typeflag {
+	case tar.TypeChar:
+		return unix.Mknod(path, unix.S_IFCHR|perm, dev)
+	case tar.TypeBlock:
+		return unix.Mknod(path, unix.S_IFBLK|perm, dev)
+	}
+	return unix.Mkfifo(path, perm)
+}
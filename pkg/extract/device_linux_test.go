@@ -0,0 +1,93 @@
+package extract
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestFifo(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "run/initctl", Typeflag: tar.TypeFifo, Mode: 0600}},
+		{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, content: "localhost"},
+	})
+
+	tempdir := t.TempDir()
+	if err := Extract(img, tempdir); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(tempdir, "run", "initctl")); !os.IsNotExist(err) {
+		t.Errorf("Expected fifo to be skipped by default, got %v", err)
+	}
+
+	tempdir = t.TempDir()
+	entries, err := ExtractDirsWithResult(context.Background(), img, map[string]string{"/": tempdir}, WithDevices(true))
+	if err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+	fi, err := os.Lstat(filepath.Join(tempdir, "run", "initctl"))
+	if err != nil {
+		t.Fatalf("Failed to stat fifo: %v", err)
+	}
+	if fi.Mode().Type() != os.ModeNamedPipe {
+		t.Errorf("Expected fifo, got mode %v", fi.Mode())
+	}
+	found := false
+	for _, entry := range entries {
+		if entry.Type == TypeFifo {
+			found = true
+			if entry.Mode != os.ModeNamedPipe|0600 {
+				t.Errorf("Expected fifo entry mode %v, got %v", os.ModeNamedPipe|0600, entry.Mode)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected fifo in extracted entries, got %v", entries)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("creating device nodes requires root")
+	}
+
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3}},
+		{header: tar.Header{Name: "dev/loop0", Typeflag: tar.TypeBlock, Mode: 0660, Devmajor: 7, Devminor: 0}},
+	})
+
+	tempdir := t.TempDir()
+	if err := Extract(img, tempdir, WithDevices(true), WithPreservePermissions()); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+
+	expected := map[string]struct {
+		mode         os.FileMode
+		major, minor uint32
+	}{
+		"dev/null":  {mode: os.ModeDevice | os.ModeCharDevice | 0666, major: 1, minor: 3},
+		"dev/loop0": {mode: os.ModeDevice | 0660, major: 7, minor: 0},
+	}
+	for name, want := range expected {
+		fi, err := os.Lstat(filepath.Join(tempdir, name))
+		if err != nil {
+			// device nodes cannot be created without CAP_MKNOD, or on filesystems mounted nodev
+			if os.IsNotExist(err) {
+				t.Skipf("unable to create device nodes in %s", tempdir)
+			}
+			t.Fatalf("Failed to stat %s: %v", name, err)
+		}
+		if fi.Mode() != want.mode {
+			t.Errorf("Expected mode %v for %s, got %v", want.mode, name, fi.Mode())
+		}
+		rdev := uint64(fi.Sys().(*syscall.Stat_t).Rdev)
+		if unix.Major(rdev) != want.major || unix.Minor(rdev) != want.minor {
+			t.Errorf("Expected device %d:%d for %s, got %d:%d", want.major, want.minor, name, unix.Major(rdev), unix.Minor(rdev))
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package extract
+
+import (
+	"archive/tar"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// canMknod returns true if entries of the given type can be created on this platform.
+func canMknod(typeflag byte) bool {
+	return false
+}
+
+// mknod is not supported on this platform.
+func mknod(path string, h *tar.Header, mode os.FileMode) error {
+	return errors.New("creating fifos and device nodes is not supported on this platform")
+}
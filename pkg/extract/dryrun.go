@@ -0,0 +1,78 @@
+package extract
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+)
+
+// dryRunEntry returns an Entry for a tar header that would be extracted to the given destination. If the entry
+// type is not handled, nil is returned. An error is returned if the entry could not be extracted.
+func (o *options) dryRunEntry(dirs map[string]string, h *tar.Header, destination string) (*Entry, error) {
+	entry := &Entry{
+		Source:      h.Name,
+		Destination: destination,
+		Type:        entryType(h.Typeflag),
+		Mode:        o.mode,
+	}
+
+	switch entry.Type {
+	case "":
+		return nil, nil
+	case TypeDir:
+		entry.Mode = o.dirMode(h)
+	case TypeFile:
+		entry.Size = h.Size
+		entry.Mode = o.fileMode(h)
+		if _, err := os.Lstat(destination); err == nil && o.overwritePolicy == OverwriteError {
+			return nil, ErrExists
+		}
+	case TypeSymlink:
+		linkname, err := o.symlinkTarget(dirs, h, destination)
+		if err != nil {
+			return nil, err
+		}
+		entry.Mode = os.ModeSymlink | os.ModePerm
+		entry.Linkname = linkname
+	case TypeHardlink:
+		linkname, err := findPath(dirs, h.Linkname)
+		if err != nil {
+			return nil, err
+		}
+		entry.Mode = o.fileMode(h)
+		entry.Linkname = linkname
+	case TypeFifo, TypeCharDevice, TypeBlockDevice:
+		entry.Mode = o.deviceMode(h)
+	}
+
+	if err := checkConflict(destination, h.Typeflag); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// checkConflict returns ErrConflict if an entry of the given type cannot be created at the destination due to
+// existing content on the local filesystem.
+func checkConflict(destination string, typeflag byte) error {
+	if typeflag == tar.TypeDir {
+		if fi, err := os.Stat(destination); err == nil && !fi.IsDir() {
+			return ErrConflict
+		}
+	} else if fi, err := os.Lstat(destination); err == nil && fi.IsDir() {
+		// regular files cannot replace directories; links may replace empty directories
+		if entries, err := os.ReadDir(destination); typeflag == tar.TypeReg || err != nil || len(entries) > 0 {
+			return ErrConflict
+		}
+	}
+
+	// check that the closest existing parent is a directory
+	for parent := filepath.Dir(destination); parent != filepath.Dir(parent); parent = filepath.Dir(parent) {
+		if fi, err := os.Stat(parent); err == nil {
+			if !fi.IsDir() {
+				return ErrConflict
+			}
+			break
+		}
+	}
+	return nil
+}
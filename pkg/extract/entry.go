@@ -0,0 +1,138 @@
+package extract
+
+import (
+	"archive/tar"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Entry types
+const (
+	TypeDir         = "dir"
+	TypeFile        = "file"
+	TypeSymlink     = "symlink"
+	TypeHardlink    = "hardlink"
+	TypeFifo        = "fifo"
+	TypeCharDevice  = "char"
+	TypeBlockDevice = "block"
+	TypeOther       = "other"
+)
+
+// Entry describes a single entry that was, or would be, extracted from an image. SHA256 is the
+// hex-encoded digest of the content of regular files, and is only set for files that were written.
+// Destination is not set for entries returned by List.
+type Entry struct {
+	Source      string      `json:"source"`
+	Destination string      `json:"destination,omitempty"`
+	Type        string      `json:"type"`
+	Size        int64       `json:"size"`
+	Mode        os.FileMode `json:"mode"`
+	Linkname    string      `json:"linkname,omitempty"`
+	SHA256      string      `json:"sha256,omitempty"`
+}
+
+// entryType returns the Entry type for a tar header typeflag, or an empty string if the type is not handled.
+func entryType(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeDir:
+		return TypeDir
+	case tar.TypeReg:
+		return TypeFile
+	case tar.TypeSymlink:
+		return TypeSymlink
+	case tar.TypeLink:
+		return TypeHardlink
+	case tar.TypeFifo:
+		return TypeFifo
+	case tar.TypeChar:
+		return TypeCharDevice
+	case tar.TypeBlock:
+		return TypeBlockDevice
+	}
+	return ""
+}
+
+// manifest collects the entries extracted from an image, in extraction order.
+type manifest struct {
+	entries []Entry
+	index   map[string]int
+	// destinations of existing files that were left in place because they already match the image
+	unchanged map[string]bool
+}
+
+func newManifest() *manifest {
+	return &manifest{index: map[string]int{}, unchanged: map[string]bool{}}
+}
+
+// add records an entry, replacing any previous entry with the same destination.
+func (m *manifest) add(entry Entry) {
+	if i, ok := m.index[entry.Destination]; ok {
+		m.entries[i] = entry
+		return
+	}
+	m.index[entry.Destination] = len(m.entries)
+	m.entries = append(m.entries, entry)
+}
+
+// addUnchanged records an existing file that was not extracted because it already matches the image. It is not an
+// entry of the manifest, but hardlinks may still be created to it.
+func (m *manifest) addUnchanged(destination string) {
+	m.unchanged[destination] = true
+}
+
+// hasFile returns true if a file or hardlink has been extracted to the destination, or an existing file there
+// already matches the image. Hardlinks are only created to content that matches this run, rather than to whatever
+// already exists at the destination, which may be excluded or stale content from a previous extraction.
+func (m *manifest) hasFile(destination string) bool {
+	if m.unchanged[destination] {
+		return true
+	}
+	i, ok := m.index[destination]
+	return ok && (m.entries[i].Type == TypeFile || m.entries[i].Type == TypeHardlink)
+}
+
+// addDirs records entries for directories created implicitly as parents of the named entry.
+func (m *manifest) addDirs(name, destination string, dirs []string, mode os.FileMode) {
+	for _, dir := range dirs {
+		if _, ok := m.index[dir]; !ok {
+			m.add(Entry{Source: sourceDir(name, destination, dir), Destination: dir, Type: TypeDir, Mode: mode})
+		}
+	}
+}
+
+// sourceDir returns the path within the image that corresponds to dir, a parent of the destination that the
+// named entry is extracted to.
+func sourceDir(name, destination, dir string) string {
+	name = strings.TrimPrefix(path.Clean(imagePath(name)), "/")
+	for ; destination != dir && destination != filepath.Dir(destination); destination = filepath.Dir(destination) {
+		name = path.Dir(name)
+	}
+	return name
+}
+
+// pruneEntries removes directories from the list of entries that would be removed by pruneExcludedDirs,
+// because all of their content was excluded.
+func pruneEntries(entries []Entry, createdDirs, excludedParents map[string]bool) []Entry {
+	children := map[string]int{}
+	for _, entry := range entries {
+		children[filepath.Dir(entry.Destination)]++
+	}
+
+	pruned := map[string]bool{}
+	for _, dir := range pruneCandidates(createdDirs, excludedParents) {
+		if children[dir] == 0 {
+			pruned[dir] = true
+			children[filepath.Dir(dir)]--
+		}
+	}
+
+	kept := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Type != TypeDir || !pruned[entry.Destination] {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
@@ -2,27 +2,117 @@ package extract
 
 import (
 	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
 	"io"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"github.com/rancher/wharfie/pkg/events"
+	"github.com/rancher/wharfie/pkg/logging"
+	"github.com/rancher/wharfie/pkg/util"
 )
 
 var (
 	ErrIllegalPath = errors.New("illegal path")
+	ErrConflict    = errors.New("destination conflicts with existing content")
+	ErrExists      = errors.New("destination file already exists")
+	ErrVerify      = errors.New("extracted content does not match image")
 	ps             = string(os.PathSeparator)
+	specialBits    = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
 )
 
+// SymlinkPolicy controls the handling of symlinks whose targets would resolve outside the
+// extraction roots, or to a different location than the mapped target.
+type SymlinkPolicy int
+
+const (
+	// SymlinkPreserve creates symlinks with the target from the image, unmodified.
+	SymlinkPreserve SymlinkPolicy = iota
+	// SymlinkRewrite rewrites symlink targets to a relative path to the mapped location of the
+	// target. Symlinks whose targets are not within any extraction root are refused.
+	SymlinkRewrite
+	// SymlinkRefuse refuses to create symlinks whose targets do not resolve to the mapped location
+	// of the target.
+	SymlinkRefuse
+)
+
+// OverwritePolicy controls the handling of files that already exist at the destination.
+type OverwritePolicy int
+
+const (
+	// OverwriteAlways replaces existing files with the content from the image.
+	OverwriteAlways OverwritePolicy = iota
+	// OverwriteSkip leaves existing files untouched.
+	OverwriteSkip
+	// OverwriteError fails extraction if a file already exists.
+	OverwriteError
+	// OverwriteIfChanged replaces existing files only if their content or mode differs from the image.
+	OverwriteIfChanged
+)
+
+var overwritePolicies = map[string]OverwritePolicy{
+	"overwrite":  OverwriteAlways,
+	"skip":       OverwriteSkip,
+	"error":      OverwriteError,
+	"if-changed": OverwriteIfChanged,
+}
+
+// ParseOverwritePolicy returns the OverwritePolicy with the given name: one of overwrite, skip, error, or if-changed.
+func ParseOverwritePolicy(name string) (OverwritePolicy, error) {
+	if policy, ok := overwritePolicies[name]; ok {
+		return policy, nil
+	}
+	return OverwriteAlways, errors.Errorf("invalid overwrite policy %q", name)
+}
+
 // An Option modifies the default file extraction behavior
 type Option func(*options) error
 
 type options struct {
-	mode os.FileMode
+	mode                os.FileMode
+	modeSet             bool
+	preservePermissions bool
+	preserveSpecialBits bool
+	preserveOwnership   bool
+	lookupOwnerNames    bool
+	chownSet            bool
+	chownUID            int
+	chownGID            int
+	preserveXattrs      bool
+	devices             bool
+	symlinkPolicy       SymlinkPolicy
+	overwritePolicy     OverwritePolicy
+	caseCollisionPolicy CaseCollisionPolicy
+	caseInsensitive     bool
+	atomic              bool
+	verify              bool
+	maxSize             int64
+	maxFiles            int
+	maxFileSize         int64
+	exclude             []string
+	stripComponents     int
+	readAhead           int64
+	metadataDir         string
+	metadataRef         name.Reference
+	dryRun              func(Entry)
+	onFile              func(string, string, *tar.Header) error
+	logger              logging.Logger
+	events              events.Handler
+	eventsImage         string
 }
 
 // Extract extracts all content from the image to the provided path.
@@ -34,167 +124,1503 @@ func Extract(img v1.Image, dir string, opts ...Option) error {
 // ExtractDirs extracts content from the image, honoring the directory map when
 // deciding where on the local filesystem to place the extracted files. For example:
 // {"/bin": "/usr/local/bin", "/etc": "/etc", "/etc/rancher": "/opt/rancher/etc"}
+// If a source path is a file within the image, the destination is used as the
+// name of the extracted file, unless the destination is an existing directory.
+// For example: {"/usr/local/bin/kubectl": "/usr/local/bin/kubectl-1.29"}
+// Source paths may also be glob patterns, with `**` matching any number of directories.
+// Plain source paths take precedence over patterns. For example: {"/usr/lib/**/*.so": "/opt/libs"}
 func ExtractDirs(img v1.Image, dirs map[string]string, opts ...Option) error {
+	return ExtractDirsWithOptions(img, dirs, opts...)
+}
+
+// ExtractDirsWithOptions extracts content from the image as described for ExtractDirs, with the default
+// extraction behavior modified by the provided options. Options that cannot be used together are rejected
+// before anything is extracted.
+func ExtractDirsWithOptions(img v1.Image, dirs map[string]string, opts ...Option) error {
+	return ExtractDirsContext(context.Background(), img, dirs, opts...)
+}
+
+// ExtractDirsContext extracts content from the image as described for ExtractDirs. If the context is
+// cancelled, extraction stops promptly and the context's error is returned; files being written at the
+// time are left untouched when atomic writes are enabled.
+func ExtractDirsContext(ctx context.Context, img v1.Image, dirs map[string]string, opts ...Option) error {
+	_, err := ExtractDirsWithResult(ctx, img, dirs, opts...)
+	return err
+}
+
+// ExtractDirsWithResult extracts content from the image as described for ExtractDirsContext, and returns
+// a list of the directories, files, and links that were extracted.
+func ExtractDirsWithResult(ctx context.Context, img v1.Image, dirs map[string]string, opts ...Option) ([]Entry, error) {
 	opt, err := makeOptions(opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	cleanDirs, err := cleanExtractDirs(dirs)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if opt.preserveOwnership && !canChown() {
+		opt.log().Warnf("Not preserving file ownership: must be running as root on a platform that supports chown")
+		opt.preserveOwnership = false
+	}
+
+	if opt.chownSet && !canChown() {
+		opt.log().Warnf("Not changing file ownership: must be running as root on a platform that supports chown")
+		opt.chownSet = false
+	}
+
+	if opt.preserveXattrs && !canSetXattrs() {
+		opt.log().Warnf("Not preserving extended attributes: not supported on this platform")
+		opt.preserveXattrs = false
 	}
 
-	reader := mutate.Extract(img)
+	reader := newContextReader(ctx, newReadAheadReader(mutate.Extract(img), opt.readAhead))
 	defer reader.Close()
 
+	// hardlinks to files that were not extracted, keyed by the target path within the image
+	deferredLinks := map[string][]deferredLink{}
+	// directories created by extraction, and directories that would have held excluded content
+	createdDirs := map[string]bool{}
+	excludedParents := map[string]bool{}
+	// modes of extracted directories, which are applied once their content has been extracted
+	dirModes := map[string]os.FileMode{}
+	// entries that were extracted, or would be extracted if this is a dry run
+	extracted := newManifest()
+	limits := &limiter{maxSize: opt.maxSize, maxFiles: opt.maxFiles, maxFileSize: opt.maxFileSize}
+	cases := newCaseTracker(opt)
+	// fifos and device nodes that were not extracted
+	skippedDevices := 0
+
 	// Read from the tar until EOF
 	t := tar.NewReader(reader)
 	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		h, err := t.Next()
 		if err == io.EOF {
-			return nil
+			break
 		} else if err != nil {
-			return err
+			return nil, err
 		}
 
+		if !opt.strip(h) {
+			opt.entryLogger(h, "").Debugf("Skipping file with too few path components")
+			continue
+		}
+
+		if opt.excluded(h.Name) {
+			opt.entryLogger(h, "").Debugf("Excluding file")
+			if destination, _ := findPath(cleanDirs, h.Name); destination != "" {
+				excludedParents[filepath.Dir(destination)] = true
+			}
+			continue
+		}
+
+		// destination must be determined anew for each entry; files without a mapping are skipped.
 		destination, err := findPath(cleanDirs, h.Name)
-		parent := filepath.Dir(destination)
 		if err != nil {
-			return errors.Wrapf(err, "unable to extract file %s", h.Name)
+			return nil, errors.Wrapf(err, "unable to extract file %s", h.Name)
 		}
 		if destination == "" {
-			logrus.Debugf("Skipping file %s", h.Name)
+			opt.entryLogger(h, "").Debugf("Skipping file without a destination")
+			continue
+		}
+		if h.Typeflag != tar.TypeDir {
+			destination = fileDestination(cleanDirs, h.Name, destination)
+		}
+		parent := filepath.Dir(destination)
+
+		// refuse to write through symlinks that lead out of the destination root. When not writing atomically,
+		// a regular file is written through a symlink at the destination, so it is checked as well; so is a
+		// directory, whose mode and ownership would be set on the symlink target.
+		checked := parent
+		if h.Typeflag == tar.TypeDir || (h.Typeflag == tar.TypeReg && !opt.atomic) {
+			checked = destination
+		}
+		root := destinationRoot(cleanDirs, destination)
+		if err := checkSymlinks(root, checked); err != nil {
+			return nil, errors.Wrapf(err, "unable to extract file %s to %s", h.Name, destination)
+		}
+
+		if err := cases.add(root, destination); err != nil {
+			return nil, errors.Wrapf(err, "unable to extract file %s to %s", h.Name, destination)
+		}
+
+		if isDevice(h.Typeflag) {
+			if reason := opt.skipDevice(h.Typeflag); reason != "" {
+				opt.entryLogger(h, destination).WithFields(logging.Fields{"reason": reason}).Debugf("Skipping %s", entryType(h.Typeflag))
+				skippedDevices++
+				continue
+			}
+		}
+
+		if err := limits.add(h.Name, h.Size); err != nil {
+			return nil, err
+		}
+
+		if opt.dryRun != nil {
+			entry, err := opt.dryRunEntry(cleanDirs, h, destination)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to extract file %s", h.Name)
+			}
+			if entry == nil {
+				opt.log().Warnf("Unhandled Typeflag %d for %s", h.Typeflag, h.Name)
+				continue
+			}
+			// list parent directories that would be created implicitly
+			parents := missingDirs(parent)
+			for _, dir := range parents {
+				createdDirs[dir] = true
+			}
+			extracted.addDirs(h.Name, destination, parents, opt.mode)
+			if _, err := os.Lstat(destination); entry.Type == TypeDir && os.IsNotExist(err) {
+				createdDirs[destination] = true
+			}
+			extracted.add(*entry)
 			continue
 		}
 
+		// record directories created by extraction, so that they can be pruned if left empty
+		if h.Typeflag == tar.TypeDir {
+			if _, err := os.Lstat(destination); os.IsNotExist(err) {
+				createdDirs[destination] = true
+			}
+		}
+		parents := missingDirs(parent)
+		for _, dir := range parents {
+			createdDirs[dir] = true
+		}
+
+		entry := Entry{Source: h.Name, Destination: destination, Type: entryType(h.Typeflag), Mode: opt.mode}
 		switch h.Typeflag {
 		case tar.TypeDir:
-			logrus.Infof("Creating directory %s", destination)
-			if err := os.MkdirAll(destination, opt.mode); err != nil {
-				return err
+			opt.entryLogger(h, destination).Infof("Creating directory")
+			// the directory is kept writable by its owner until its content has been extracted
+			if err := os.MkdirAll(longPath(destination), opt.dirMode(h)|0700); err != nil {
+				return nil, err
 			}
+			if err := opt.chown(destination, h); err != nil {
+				return nil, err
+			}
+			if err := opt.chmod(destination, opt.dirMode(h)|0700); err != nil {
+				return nil, err
+			}
+			if err := opt.setXattrs(destination, h); err != nil {
+				return nil, err
+			}
+			dirModes[destination] = opt.dirMode(h)
+			entry.Mode = opt.dirMode(h)
 		case tar.TypeReg:
-			logrus.Infof("Extracting file %s to %s", h.Name, destination)
-			mode := h.FileInfo().Mode() & opt.mode
-			if mode == 0 {
-				// images tarfiles created on Windows have empty mode bits, which when round-tripped
-				// results in creating files that are marked read-only. In this case, use the
-				// requested mode instead of masking.
-				mode = opt.mode
-			}
-			if err := os.MkdirAll(parent, opt.mode); err != nil {
-				return err
+			if err := os.MkdirAll(longPath(parent), opt.mode); err != nil {
+				return nil, err
 			}
-			f, err := os.OpenFile(destination, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+			sum, written, err := opt.writeFile(destination, t, h)
 			if err != nil {
-				return err
+				return nil, err
+			} else if !written {
+				if sum != nil {
+					extracted.addUnchanged(destination)
+				}
+				continue
 			}
-
-			if _, err = io.Copy(f, t); err != nil {
-				f.Close()
-				return err
+			if err := opt.chown(destination, h); err != nil {
+				return nil, err
 			}
-			if err := f.Close(); err != nil {
-				return err
+			if err := opt.chmod(destination, opt.fileMode(h)); err != nil {
+				return nil, err
+			}
+			if err := opt.setXattrs(destination, h); err != nil {
+				return nil, err
 			}
+			entry.Size = h.Size
+			entry.Mode = opt.fileMode(h)
+			entry.SHA256 = hex.EncodeToString(sum)
 		case tar.TypeSymlink:
-			logrus.Infof("Symlinking %s to %s", destination, h.Linkname)
-			if err := os.MkdirAll(parent, opt.mode); err != nil {
-				return err
+			linkname, err := opt.symlinkTarget(cleanDirs, h, destination)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to create symlink %s to %s", destination, h.Linkname)
+			}
+			opt.entryLogger(h, destination).WithFields(logging.Fields{"target": linkname}).Infof("Creating symlink")
+			if err := os.MkdirAll(longPath(parent), opt.mode); err != nil {
+				return nil, err
 			}
 			_ = os.Remove(destination) // blind remove, if it fails the Symlink call will deal with it.
-			err := os.Symlink(h.Linkname, destination)
+			err = os.Symlink(linkname, longPath(destination))
 			if err != nil {
-				return err
+				return nil, err
 			}
+			if err := opt.chown(destination, h); err != nil {
+				return nil, err
+			}
+			entry.Mode = os.ModeSymlink | os.ModePerm
+			entry.Linkname = linkname
 		case tar.TypeLink:
 			linkname, err := findPath(cleanDirs, h.Linkname)
 			if err != nil {
-				return errors.Wrapf(err, "unable to find target for hardlink %s", destination)
+				return nil, errors.Wrapf(err, "unable to find target for hardlink %s", destination)
+			}
+			if err := os.MkdirAll(longPath(parent), opt.mode); err != nil {
+				return nil, err
 			}
-			if linkname == "" {
-				logrus.Warnf("Skipping hardlink %s, target was skipped", destination)
+			_ = os.Remove(destination) // blind remove, if it fails the Link call will deal with it.
+			if linkname == "" || !extracted.hasFile(linkname) {
+				// The target was not extracted, or has not been extracted yet because it is in a lower layer.
+				// The link will be created once the rest of the image has been extracted.
+				opt.entryLogger(h, destination).WithFields(logging.Fields{"target": h.Linkname}).Debugf("Deferring hardlink until target has been extracted")
+				target := path.Clean(imagePath(h.Linkname))
+				extracted.addDirs(h.Name, destination, parents, opt.mode)
+				deferredLinks[target] = append(deferredLinks[target], deferredLink{destination: destination, header: h})
 				continue
 			}
-			logrus.Infof("Linking %s to %s", destination, linkname)
-			if err := os.MkdirAll(parent, opt.mode); err != nil {
+			if err := opt.link(linkname, destination, h); err != nil {
+				return nil, err
+			}
+			entry.Mode = opt.fileMode(h)
+			entry.Linkname = linkname
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			opt.entryLogger(h, destination).Infof("Creating %s", entry.Type)
+			if err := os.MkdirAll(longPath(parent), opt.mode); err != nil {
+				return nil, err
+			}
+			_ = os.Remove(destination) // blind remove, if it fails the mknod call will deal with it.
+			if err := mknod(destination, h, opt.fileMode(h)); err != nil {
+				if os.IsPermission(err) {
+					opt.entryLogger(h, destination).WithFields(logging.Fields{"error": err}).Debugf("Skipping %s", entry.Type)
+					skippedDevices++
+					continue
+				}
+				return nil, errors.Wrapf(err, "unable to create %s %s", entry.Type, destination)
+			}
+			if err := opt.chown(destination, h); err != nil {
+				return nil, err
+			}
+			if err := opt.chmod(destination, opt.fileMode(h)); err != nil {
+				return nil, err
+			}
+			entry.Mode = opt.deviceMode(h)
+		default:
+			opt.log().Warnf("Unhandled Typeflag %d for %s", h.Typeflag, h.Name)
+			continue
+		}
+		if err := opt.fileHook(h, destination); err != nil {
+			return nil, err
+		}
+		extracted.addDirs(h.Name, destination, parents, opt.mode)
+		extracted.add(entry)
+	}
+
+	if skippedDevices > 0 {
+		opt.log().Infof("Skipped %d fifo and device entries; extracting them requires WithDevices, and root for device nodes", skippedDevices)
+	}
+
+	if opt.dryRun != nil {
+		entries := pruneEntries(extracted.entries, createdDirs, excludedParents)
+		for _, entry := range entries {
+			opt.dryRun(entry)
+		}
+		return entries, nil
+	}
+
+	if err := extractDeferredLinks(ctx, img, cleanDirs, deferredLinks, extracted, limits, opt); err != nil {
+		return nil, err
+	}
+
+	if err := opt.pruneExcludedDirs(createdDirs, excludedParents); err != nil {
+		return nil, err
+	}
+
+	if err := opt.chownDirs(createdDirs); err != nil {
+		return nil, err
+	}
+
+	if err := opt.chmodDirs(dirModes); err != nil {
+		return nil, err
+	}
+
+	if opt.verify {
+		if err := opt.verifyEntries(extracted.entries); err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.metadataDir != "" {
+		if err := writeImageMetadata(img, opt.metadataDir, opt.metadataRef, opt.log()); err != nil {
+			return nil, errors.Wrap(err, "failed to write image metadata")
+		}
+	}
+	return pruneEntries(extracted.entries, createdDirs, excludedParents), nil
+}
+
+// verifyHook is called before each file is verified; it is used by tests to simulate corruption.
+var verifyHook func(path string)
+
+// verifyEntries re-reads each file written during extraction, and returns an error listing any files
+// whose content does not match the content read from the image.
+func (o *options) verifyEntries(entries []Entry) error {
+	mismatched := []string{}
+	for _, entry := range entries {
+		if entry.SHA256 == "" {
+			continue
+		}
+		if verifyHook != nil {
+			verifyHook(entry.Destination)
+		}
+		sum, err := fileHash(entry.Destination)
+		if err != nil || hex.EncodeToString(sum) != entry.SHA256 {
+			o.log().Warnf("Failed to verify file %s", entry.Destination)
+			mismatched = append(mismatched, entry.Destination)
+		}
+	}
+	if len(mismatched) > 0 {
+		return errors.Wrapf(ErrVerify, "unable to verify %s", strings.Join(mismatched, ", "))
+	}
+	return nil
+}
+
+// pruneExcludedDirs removes directories created by extraction that are empty because all of their content was
+// excluded. Directories are removed deepest-first, so that parents left empty by removal of their children
+// are also removed.
+func (o *options) pruneExcludedDirs(createdDirs, excludedParents map[string]bool) error {
+	for _, dir := range pruneCandidates(createdDirs, excludedParents) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			o.log().Debugf("Removing empty directory %s", dir)
+			if err := os.Remove(dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// missingDirs returns the directories that os.MkdirAll would create for the given path, outermost first.
+func missingDirs(dir string) []string {
+	var dirs []string
+	for ; dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil {
+			break
+		}
+		dirs = append([]string{dir}, dirs...)
+	}
+	return dirs
+}
+
+// pruneCandidates returns a list of directories created by extraction that would have held excluded content,
+// along with any parents also created by extraction. The list is sorted deepest-first.
+func pruneCandidates(createdDirs, excludedParents map[string]bool) []string {
+	candidates := map[string]bool{}
+	for dir := range excludedParents {
+		for ; createdDirs[dir] && !candidates[dir]; dir = filepath.Dir(dir) {
+			candidates[dir] = true
+		}
+	}
+
+	dirs := make([]string, 0, len(candidates))
+	for dir := range candidates {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+	return dirs
+}
+
+// deferredLink is a hardlink whose target was not extracted.
+type deferredLink struct {
+	destination string
+	header      *tar.Header
+}
+
+// entry returns an Entry for the hardlink, once it has been created.
+func (l deferredLink) entry(linkname string, opt *options) Entry {
+	return Entry{
+		Source:      l.header.Name,
+		Destination: l.destination,
+		Type:        TypeHardlink,
+		Mode:        opt.fileMode(l.header),
+		Linkname:    linkname,
+	}
+}
+
+// extractDeferredLinks creates hardlinks whose targets had not been extracted when the link was encountered.
+// Links to targets that have since been extracted are created directly. For targets that were not extracted
+// at all, a second pass is made through the image to copy the target content to the first link destination,
+// and any additional links to the same target are linked to the first copy.
+func extractDeferredLinks(ctx context.Context, img v1.Image, dirs map[string]string, deferredLinks map[string][]deferredLink, extracted *manifest, limits *limiter, opt *options) error {
+	for target, links := range deferredLinks {
+		linkname, err := findPath(dirs, target)
+		if err != nil || linkname == "" || !extracted.hasFile(linkname) {
+			continue
+		}
+		for _, link := range links {
+			if err := opt.link(linkname, link.destination, link.header); err != nil {
 				return err
 			}
-			_ = os.Remove(destination) // blind remove, if it fails the Link call will deal with it.
-			err = os.Link(linkname, destination)
-			if err != nil {
+			if err := opt.fileHook(link.header, link.destination); err != nil {
 				return err
 			}
-		default:
-			logrus.Warnf("Unhandled Typeflag %d for %s", h.Typeflag, h.Name)
+			extracted.add(link.entry(linkname, opt))
+		}
+		delete(deferredLinks, target)
+	}
+
+	if len(deferredLinks) == 0 {
+		return nil
+	}
+
+	reader := newContextReader(ctx, newReadAheadReader(mutate.Extract(img), opt.readAhead))
+	defer reader.Close()
+
+	t := tar.NewReader(reader)
+	for len(deferredLinks) > 0 {
+		h, err := t.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if !opt.strip(h) {
+			continue
+		}
+		name := path.Clean(imagePath(h.Name))
+		links, ok := deferredLinks[name]
+		if !ok || h.Typeflag != tar.TypeReg {
+			continue
+		}
+		delete(deferredLinks, name)
+
+		first := links[0].destination
+		if err := limits.add(h.Name, h.Size); err != nil {
+			return err
+		}
+		opt.entryLogger(h, first).Infof("Extracting hardlink target")
+		digest := sha256.New()
+		if err := opt.write(first, io.TeeReader(t, digest), opt.fileMode(h)); err != nil {
+			return err
+		}
+		if err := opt.chown(first, links[0].header); err != nil {
+			return err
+		}
+		if err := opt.chmod(first, opt.fileMode(h)); err != nil {
+			return err
+		}
+		if err := opt.setXattrs(first, h); err != nil {
+			return err
+		}
+		if err := opt.fileHook(links[0].header, first); err != nil {
+			return err
+		}
+		entry := links[0].entry("", opt)
+		entry.SHA256 = hex.EncodeToString(digest.Sum(nil))
+		extracted.add(entry)
+		for _, link := range links[1:] {
+			if err := opt.link(first, link.destination, link.header); err != nil {
+				return err
+			}
+			if err := opt.fileHook(link.header, link.destination); err != nil {
+				return err
+			}
+			extracted.add(link.entry(first, opt))
 		}
 	}
+
+	for name, links := range deferredLinks {
+		for _, link := range links {
+			opt.entryLogger(link.header, link.destination).WithFields(logging.Fields{"target": name}).Warnf("Skipping hardlink, target was not found")
+		}
+	}
+	return nil
 }
 
-// WithMode overrides the default mode used when extracting files and directories.
+// WithMode overrides the default mode used when extracting files and directories. The mode of files
+// from the image is masked by this mode. Cannot be used with WithPreservePermissions.
 func WithMode(mode os.FileMode) Option {
 	return func(o *options) error {
 		o.mode = mode
+		o.modeSet = true
 		return nil
 	}
 }
 
-// makeOptions applies Options, returning a modified option struct.
-func makeOptions(opts ...Option) (*options, error) {
-	o := &options{
-		mode: 0755,
+// WithPreservePermissions sets the permission bits of extracted files and directories to the mode from the
+// image, instead of masking it. Setuid, setgid, and sticky bits are not included unless WithPreserveSpecialBits
+// is also used. Cannot be used with WithMode.
+func WithPreservePermissions() Option {
+	return func(o *options) error {
+		o.preservePermissions = true
+		return nil
 	}
-	for _, option := range opts {
-		if err := option(o); err != nil {
-			return nil, err
+}
+
+// WithPreserveSpecialBits retains the setuid, setgid, and sticky bits from the image when extracting files
+// and directories. These bits are security sensitive, so they are stripped by default, even when permissions
+// are preserved. When used without WithPreservePermissions, the special bits are added to the masked mode.
+func WithPreserveSpecialBits(preserve bool) Option {
+	return func(o *options) error {
+		o.preserveSpecialBits = preserve
+		return nil
+	}
+}
+
+// WithPreserveOwnership sets ownership of extracted files, directories, and links to the uid and gid
+// from the image. This is only possible when running as root on a platform that supports chown; in
+// all other cases a warning is logged and extracted content is owned by the current user.
+func WithPreserveOwnership(preserve bool) Option {
+	return func(o *options) error {
+		o.preserveOwnership = preserve
+		return nil
+	}
+}
+
+// WithChown sets ownership of all extracted files, directories, and links to the given uid and gid,
+// including parent directories created by extraction. Like WithPreserveOwnership, this is only possible
+// when running as root on a platform that supports chown.
+func WithChown(uid, gid int) Option {
+	return func(o *options) error {
+		if uid < 0 || gid < 0 {
+			return errors.Errorf("invalid owner %d:%d", uid, gid)
 		}
+		o.chownSet = true
+		o.chownUID = uid
+		o.chownGID = gid
+		return nil
 	}
-	return o, nil
 }
 
-// cleanExtractDirs normalizes the directory map to ensure that source and destination
-// reliably do not have trailing slashes, unless the path is root.  This is required to
-// make directory name matching reliable while walking up the source path.
-func cleanExtractDirs(dirs map[string]string) (map[string]string, error) {
-	cleanDirs := make(map[string]string, len(dirs))
-	for s, d := range dirs {
-		if s != ps {
-			s = filepath.Clean(strings.TrimSuffix(s, ps))
+// ParseOwner parses an owner in the form user:group, as accepted by chown. The user and group may be
+// numeric ids, or names that are looked up on the local system.
+func ParseOwner(owner string) (int, int, error) {
+	name, group, ok := strings.Cut(owner, ":")
+	if !ok || name == "" || group == "" {
+		return 0, 0, errors.Errorf("invalid owner %q: must be user:group", owner)
+	}
+
+	if _, err := strconv.Atoi(name); err != nil {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid owner %q", owner)
 		}
-		if d != ps {
-			var err error
-			d, err = filepath.Abs(strings.TrimSuffix(d, ps))
-			if err != nil {
-				return nil, errors.Wrap(err, "invalid destination")
-			}
+		name = u.Uid
+	}
+	if _, err := strconv.Atoi(group); err != nil {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "invalid owner %q", owner)
 		}
-		cleanDirs[s] = d
+		group = g.Gid
 	}
-	return cleanDirs, nil
+	uid, err := strconv.Atoi(name)
+	if err != nil || uid < 0 {
+		return 0, 0, errors.Errorf("invalid owner %q", owner)
+	}
+	gid, err := strconv.Atoi(group)
+	if err != nil || gid < 0 {
+		return 0, 0, errors.Errorf("invalid owner %q", owner)
+	}
+	return uid, gid, nil
 }
 
-// findPath walks up the path, finding the longest match in the dirs map and returning the desired path.
-func findPath(dirs map[string]string, path string) (string, error) {
-	if !strings.HasPrefix(path, ps) {
-		path = ps + path
+// WithDevices creates fifos and character and block device nodes from the image, as needed when extracting
+// a complete root filesystem. This is only supported on Linux, and device nodes can only be created when
+// running as root with permission to do so. Entries that cannot be created are skipped and counted in a
+// summary log message. The default is to skip them.
+func WithDevices(devices bool) Option {
+	return func(o *options) error {
+		o.devices = devices
+		return nil
 	}
+}
 
-	// Depth-first walk up the path to find a matching entry in the map, until we hit the root path separator.
-	for source := path; ; source = filepath.Dir(source) {
-		if destination, ok := dirs[source]; ok {
-			// Trim the source path prefix, replace it with the destination, and normalize the joined result.
-			joined := filepath.Clean(filepath.Join(destination, strings.TrimPrefix(path, source)))
+// WithOwnerLookup causes the user and group names from the image to be looked up on the local system
+// when preserving ownership. If a name is found, the local id is used instead of the numeric id from
+// the image. If the name is not found, the numeric id from the image is used.
+func WithOwnerLookup(lookup bool) Option {
+	return func(o *options) error {
+		o.lookupOwnerNames = lookup
+		return nil
+	}
+}
 
-			// Ensure that the path after cleaning does not escape the target prefix.
-			if !strings.HasPrefix(joined, destination) {
-				return "", ErrIllegalPath
-			}
+// WithPreserveXattrs sets extended attributes on extracted files and directories from the PAX records
+// in the image, including file capabilities stored in security.capability. This is only supported on
+// Linux; on other platforms a warning is logged. Attributes that cannot be set because the filesystem
+// does not support them, or the current user is not permitted to set them, are skipped with a warning.
+func WithPreserveXattrs(preserve bool) Option {
+	return func(o *options) error {
+		o.preserveXattrs = preserve
+		return nil
+	}
+}
+
+// WithSymlinkPolicy sets the policy for handling symlinks whose targets are outside the extraction
+// roots. The default is to create symlinks exactly as they appear in the image.
+func WithSymlinkPolicy(policy SymlinkPolicy) Option {
+	return func(o *options) error {
+		switch policy {
+		case SymlinkPreserve, SymlinkRewrite, SymlinkRefuse:
+			o.symlinkPolicy = policy
+			return nil
+		}
+		return errors.Errorf("invalid symlink policy %d", policy)
+	}
+}
+
+// WithOverwritePolicy sets the policy for handling files that already exist at the destination. The default
+// is to overwrite existing files.
+func WithOverwritePolicy(policy OverwritePolicy) Option {
+	return func(o *options) error {
+		switch policy {
+		case OverwriteAlways, OverwriteSkip, OverwriteError, OverwriteIfChanged:
+			o.overwritePolicy = policy
+			return nil
+		}
+		return errors.Errorf("invalid overwrite policy %d", policy)
+	}
+}
+
+// WithCaseCollisionPolicy sets the policy for handling extracted paths that differ only by case, such as
+// /bin/Foo and /bin/foo, when the destination is on a case-insensitive filesystem. The default is to log
+// a warning. Case sensitivity is probed at each destination root, unless forced with WithCaseInsensitive.
+func WithCaseCollisionPolicy(policy CaseCollisionPolicy) Option {
+	return func(o *options) error {
+		switch policy {
+		case CaseCollisionWarn, CaseCollisionError, CaseCollisionIgnore:
+			o.caseCollisionPolicy = policy
+			return nil
+		}
+		return errors.Errorf("invalid case collision policy %d", policy)
+	}
+}
+
+// WithCaseInsensitive treats all destinations as case-insensitive when checking for paths that differ only
+// by case, without probing the filesystem. This is useful when extracted content will later be copied to a
+// case-insensitive filesystem.
+func WithCaseInsensitive(insensitive bool) Option {
+	return func(o *options) error {
+		o.caseInsensitive = insensitive
+		return nil
+	}
+}
+
+// WithAtomic controls whether files are written to a temporary file and renamed into place once complete,
+// so that an interrupted extraction does not leave truncated files at the destination. The default is true.
+func WithAtomic(atomic bool) Option {
+	return func(o *options) error {
+		o.atomic = atomic
+		return nil
+	}
+}
+
+// WithMaxSize limits the total number of bytes written by extraction. Extraction fails with a LimitError
+// before writing a file that would exceed the limit. The default of zero is unlimited.
+func WithMaxSize(bytes int64) Option {
+	return func(o *options) error {
+		if bytes < 0 {
+			return errors.Errorf("invalid maximum size %d", bytes)
+		}
+		o.maxSize = bytes
+		return nil
+	}
+}
+
+// WithMaxFiles limits the number of files, directories, and links created by extraction. Extraction fails
+// with a LimitError before creating an entry that would exceed the limit. The default of zero is unlimited.
+func WithMaxFiles(files int) Option {
+	return func(o *options) error {
+		if files < 0 {
+			return errors.Errorf("invalid maximum file count %d", files)
+		}
+		o.maxFiles = files
+		return nil
+	}
+}
+
+// WithMaxFileSize limits the size of any single file written by extraction. Extraction fails with a LimitError
+// before writing a file that would exceed the limit. The default of zero is unlimited.
+func WithMaxFileSize(bytes int64) Option {
+	return func(o *options) error {
+		if bytes < 0 {
+			return errors.Errorf("invalid maximum file size %d", bytes)
+		}
+		o.maxFileSize = bytes
+		return nil
+	}
+}
+
+// WithVerify causes each written file to be read back once extraction is complete, and compared to the
+// content read from the image. This is expensive, and is disabled by default.
+func WithVerify(verify bool) Option {
+	return func(o *options) error {
+		o.verify = verify
+		return nil
+	}
+}
+
+// WithImageMetadata writes the image's manifest and config file, and the reference the image was pulled by
+// along with its resolved digest, as JSON files in the given directory once extraction has succeeded. The
+// reference should be the one originally requested, before any registry rewrites; it may be nil. Metadata is
+// not written for dry runs.
+func WithImageMetadata(dir string, ref name.Reference) Option {
+	return func(o *options) error {
+		o.metadataDir = dir
+		o.metadataRef = ref
+		return nil
+	}
+}
+
+// WithExclude excludes entries matching any of the given glob patterns from extraction. Patterns are matched
+// against the path of each entry within the image, with `**` matching any number of directories. Entries within
+// an excluded directory are also excluded. May be specified multiple times; patterns are cumulative.
+func WithExclude(patterns ...string) Option {
+	return func(o *options) error {
+		for _, pattern := range patterns {
+			if err := util.ValidateGlob(pattern); err != nil {
+				return errors.Wrapf(err, "invalid exclude pattern %s", pattern)
+			}
+		}
+		o.exclude = append(o.exclude, patterns...)
+		return nil
+	}
+}
+
+// WithStripComponents removes the given number of leading path components from the name of each entry in
+// the image, as with the --strip-components option to GNU tar. Entries with fewer components are skipped.
+// Components are stripped before any other processing, so directory mappings and exclude patterns are
+// matched against the stripped path. The targets of hardlinks are also stripped; symlink targets are not.
+func WithStripComponents(n int) Option {
+	return func(o *options) error {
+		if n < 0 {
+			return errors.Errorf("invalid strip components %d", n)
+		}
+		o.stripComponents = n
+		return nil
+	}
+}
+
+// WithReadAhead sets the amount of memory used to buffer image content ahead of extraction, so that layers
+// can be downloaded and decompressed while extracted files are being written. The default is 16MiB; a size
+// of zero disables buffering.
+func WithReadAhead(size int64) Option {
+	return func(o *options) error {
+		if size < 0 {
+			return errors.Errorf("invalid read-ahead size %d", size)
+		}
+		o.readAhead = size
+		return nil
+	}
+}
+
+// WithDryRun walks the image applying all mapping and exclusion logic, but does not write anything to the
+// local filesystem. Instead, the callback is called for each entry that would be extracted. Errors that would
+// occur during extraction due to illegal paths or conflicts with existing content are still returned.
+func WithDryRun(callback func(Entry)) Option {
+	return func(o *options) error {
+		o.dryRun = callback
+		return nil
+	}
+}
+
+// WithOnFile sets a callback that is called with the image path, destination, and tar header of each directory,
+// file, link, and device node once it has been extracted, including after an atomic write has been renamed into
+// place. Existing files left untouched by the overwrite policy are not passed to the callback. If the callback
+// returns an error, extraction is aborted. The callback is not called for dry runs.
+func WithOnFile(callback func(source, destination string, h *tar.Header) error) Option {
+	return func(o *options) error {
+		o.onFile = callback
+		return nil
+	}
+}
+
+// WithLogger sets the logger that each extracted entry, and everything else done while extracting, is logged to, so
+// that callers can add fields such as the image reference, or send the logs to their own logger. Entries are logged
+// with structured path and destination fields, and the size of regular files in bytes. By default, the standard
+// logrus logger is used.
+func WithLogger(logger logging.Logger) Option {
+	return func(o *options) error {
+		o.logger = logger
+		return nil
+	}
+}
+
+// WithEvents sends a FileExtracted event for the image with the given name to the handler for each directory, file,
+// link, and device node once it has been extracted, as for WithOnFile, so that callers can report what is being
+// extracted without parsing the logs.
+func WithEvents(handler events.Handler, image string) Option {
+	return func(o *options) error {
+		o.events = handler
+		o.eventsImage = image
+		return nil
+	}
+}
+
+// ValidateOptions returns an error if any of the options is invalid, such as an exclude pattern that cannot be
+// parsed, or if options that cannot be used together are set, so that callers can check the options before pulling
+// an image.
+func ValidateOptions(opts ...Option) error {
+	_, err := makeOptions(opts...)
+	return err
+}
+
+// makeOptions applies Options, returning a modified option struct.
+func makeOptions(opts ...Option) (*options, error) {
+	o := &options{
+		mode:      0755,
+		atomic:    true,
+		readAhead: defaultReadAhead,
+	}
+	for _, option := range opts {
+		if err := option(o); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// validate returns an error if options that cannot be used together have been set.
+func (o *options) validate() error {
+	if o.modeSet && o.preservePermissions {
+		return errors.New("WithMode and WithPreservePermissions cannot be used together")
+	}
+	if o.chownSet && o.preserveOwnership {
+		return errors.New("WithChown and WithPreserveOwnership cannot be used together")
+	}
+	if o.dryRun != nil && o.verify {
+		return errors.New("WithDryRun and WithVerify cannot be used together")
+	}
+	return nil
+}
+
+// strip removes leading path components from the header's name, and from the link target of hardlinks, if
+// components are being stripped. It returns false if the entry should be skipped because its name or link
+// target has too few components.
+func (o *options) strip(h *tar.Header) bool {
+	if o.stripComponents == 0 {
+		return true
+	}
+	name, ok := stripComponents(h.Name, o.stripComponents)
+	if !ok {
+		return false
+	}
+	if h.Typeflag == tar.TypeLink {
+		linkname, ok := stripComponents(h.Linkname, o.stripComponents)
+		if !ok {
+			return false
+		}
+		h.Linkname = linkname
+	}
+	h.Name = name
+	return true
+}
+
+// stripComponents removes n leading components from the path. It returns false if the path does not have
+// more than n components.
+func stripComponents(name string, n int) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path.Clean(imagePath(name)), "/"), "/")
+	if len(parts) <= n || parts[0] == "" {
+		return "", false
+	}
+	return path.Join(parts[n:]...), true
+}
+
+// fileHook sends the FileExtracted event for an extracted entry, and calls the OnFile callback, if they are set.
+func (o *options) fileHook(h *tar.Header, destination string) error {
+	if o.events != nil {
+		event := events.FileExtracted{Image: o.eventsImage, Path: h.Name, Destination: destination}
+		if h.Typeflag == tar.TypeReg {
+			event.Size = h.Size
+		}
+		o.events.Handle(event)
+	}
+	if o.onFile == nil {
+		return nil
+	}
+	if err := o.onFile(h.Name, destination, h); err != nil {
+		return errors.Wrapf(err, "file hook failed for %s at %s", h.Name, destination)
+	}
+	return nil
+}
+
+// entryLogger returns a logger with fields identifying the entry and its destination.
+func (o *options) entryLogger(h *tar.Header, destination string) logging.Logger {
+	fields := logging.Fields{"path": h.Name}
+	if destination != "" {
+		fields["destination"] = destination
+	}
+	if h.Typeflag == tar.TypeReg {
+		fields["bytes"] = h.Size
+	}
+	return o.log().WithFields(fields)
+}
+
+// log returns the logger, or the standard logger if none was set.
+func (o *options) log() logging.Logger {
+	return logging.OrDefault(o.logger)
+}
+
+// excluded returns true if the path, or any of its parent directories, matches an exclude pattern.
+func (o *options) excluded(name string) bool {
+	if len(o.exclude) == 0 {
+		return false
+	}
+	for p := path.Clean(imagePath(name)); ; p = path.Dir(p) {
+		for _, pattern := range o.exclude {
+			if ok, _ := util.MatchGlob(pattern, p); ok {
+				return true
+			}
+		}
+		if p == "/" {
+			return false
+		}
+	}
+}
+
+// fileMode returns the mode to use when extracting a file with the given header. Permission bits from the
+// image are masked by the requested mode, or used as-is if permissions are preserved. Special bits are
+// only included if they are preserved, whether or not permissions are preserved.
+func (o *options) fileMode(h *tar.Header) os.FileMode {
+	mode := h.FileInfo().Mode() & o.mode.Perm()
+	if o.preservePermissions {
+		mode = h.FileInfo().Mode().Perm()
+	}
+	if mode == 0 {
+		// images tarfiles created on Windows have empty mode bits, which when round-tripped
+		// results in creating files that are marked read-only. In this case, use the
+		// requested mode instead of masking.
+		mode = o.mode.Perm()
+	}
+	return mode | o.specialBits(h)
+}
+
+// specialBits returns the setuid, setgid, and sticky bits from the header, if special bits are being preserved.
+func (o *options) specialBits(h *tar.Header) os.FileMode {
+	if !o.preserveSpecialBits {
+		return 0
+	}
+	return h.FileInfo().Mode() & specialBits
+}
+
+// isDevice returns true if the tar entry type is a fifo or device node.
+func isDevice(typeflag byte) bool {
+	return typeflag == tar.TypeFifo || typeflag == tar.TypeChar || typeflag == tar.TypeBlock
+}
+
+// skipDevice returns the reason a fifo or device node cannot be extracted, or an empty string if it can.
+func (o *options) skipDevice(typeflag byte) string {
+	if !o.devices {
+		return "device extraction is not enabled"
+	}
+	if !canMknod(typeflag) {
+		return "must be running as root on Linux"
+	}
+	return ""
+}
+
+// deviceMode returns the mode for a fifo or device node, including the file type.
+func (o *options) deviceMode(h *tar.Header) os.FileMode {
+	return h.FileInfo().Mode().Type() | o.fileMode(h)
+}
+
+// dirMode returns the mode to use when extracting a directory with the given header.
+func (o *options) dirMode(h *tar.Header) os.FileMode {
+	if o.preservePermissions {
+		return o.fileMode(h)
+	}
+	return o.mode.Perm() | o.specialBits(h)
+}
+
+// chmod sets the mode of an extracted file or directory, if permissions are being preserved or the mode includes
+// special bits. This is necessary to apply bits that are masked by the umask, or cleared when changing ownership.
+func (o *options) chmod(path string, mode os.FileMode) error {
+	if !o.preservePermissions && mode&specialBits == 0 {
+		return nil
+	}
+	return os.Chmod(path, mode)
+}
+
+// writeFile writes the content of a file from the image to the destination, honoring the overwrite policy.
+// It returns the sha256 hash of the file content, or nil if an existing file was skipped, and whether the file was
+// written. Existing files that already match the image are not written, but their hash is still returned.
+func (o *options) writeFile(destination string, r io.Reader, h *tar.Header) ([]byte, bool, error) {
+	mode := o.fileMode(h)
+	digest := sha256.New()
+	r = io.TeeReader(r, digest)
+
+	fi, err := os.Lstat(destination)
+	if err != nil || o.overwritePolicy == OverwriteAlways {
+		o.entryLogger(h, destination).Infof("Extracting file")
+		if err := o.write(destination, r, mode); err != nil {
+			return nil, false, err
+		}
+		return digest.Sum(nil), true, nil
+	}
+
+	switch o.overwritePolicy {
+	case OverwriteSkip:
+		o.entryLogger(h, destination).Infof("Skipping existing file")
+		return nil, false, nil
+	case OverwriteError:
+		return nil, false, errors.Wrapf(ErrExists, "unable to extract file %s to %s", h.Name, destination)
+	}
+
+	// files of differing type, size, or mode are known to have changed; otherwise the content must be compared.
+	if !fi.Mode().IsRegular() || fi.Size() != h.Size || fi.Mode().Perm() != mode.Perm() {
+		o.entryLogger(h, destination).Infof("Extracting changed file")
+		if err := o.write(destination, r, mode); err != nil {
+			return nil, false, err
+		}
+		return digest.Sum(nil), true, os.Chmod(destination, mode)
+	}
+	changed, err := writeFileIfChanged(destination, r, digest, mode)
+	if err != nil {
+		return nil, false, err
+	}
+	if changed {
+		o.entryLogger(h, destination).Infof("Extracting changed file")
+	} else {
+		o.entryLogger(h, destination).Infof("Skipping unchanged file")
+	}
+	return digest.Sum(nil), changed, nil
+}
+
+// writeFileIfChanged writes the content to a temporary file alongside the destination, and replaces the
+// destination with it if the content differs, returning true if it was replaced. The digest must be updated with
+// the content as it is read.
+func writeFileIfChanged(destination string, r io.Reader, digest hash.Hash, mode os.FileMode) (bool, error) {
+	existing, err := fileHash(destination)
+	if err != nil {
+		return false, err
+	}
+
+	f, err := createTemp(destination)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		return false, err
+	}
+	if bytes.Equal(existing, digest.Sum(nil)) {
+		return false, nil
+	}
+
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		return false, err
+	}
+	return true, replaceFile(f.Name(), destination)
+}
+
+// write writes the content of the reader to a file at the given path. If atomic writes are enabled,
+// the content is written to a temporary file that is renamed into place once complete.
+func (o *options) write(path string, r io.Reader, mode os.FileMode) error {
+	if o.atomic {
+		return writeFileAtomic(path, r, mode)
+	}
+	return writeFile(path, r, mode)
+}
+
+// fileHash returns the sha256 hash of the file content.
+func fileHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	digest := sha256.New()
+	if _, err := io.Copy(digest, f); err != nil {
+		return nil, err
+	}
+	return digest.Sum(nil), nil
+}
+
+// link creates a hardlink at the destination to the target file. If the link cannot be created, as may happen
+// when the destination is on a different filesystem than the target, the target content is copied instead.
+func (o *options) link(target, destination string, h *tar.Header) error {
+	logger := o.entryLogger(h, destination).WithFields(logging.Fields{"target": target})
+	logger.Infof("Creating hardlink")
+	if err := os.Link(longPath(target), longPath(destination)); err != nil {
+		logger.WithFields(logging.Fields{"error": err}).Debugf("Failed to create hardlink, copying instead")
+		if err := copyFile(target, destination); err != nil {
+			return err
+		}
+		return o.chown(destination, h)
+	}
+	return nil
+}
+
+// symlinkTarget returns the link target to use when creating a symlink at the given destination.
+// The target is resolved within the image, and mapped to its destination on the local filesystem.
+// If the link as written would not resolve to the mapped location, the symlink policy determines
+// whether the target is rewritten, refused, or used as-is.
+func (o *options) symlinkTarget(dirs map[string]string, h *tar.Header, destination string) (string, error) {
+	if o.symlinkPolicy == SymlinkPreserve {
+		return h.Linkname, nil
+	}
+
+	// find the target's location within the image, and on the local filesystem
+	linkname := strings.ReplaceAll(h.Linkname, `\`, "/")
+	imageTarget, hostTarget := linkname, filepath.FromSlash(linkname)
+	if !path.IsAbs(linkname) {
+		imageTarget = path.Join(path.Dir(imagePath(h.Name)), linkname)
+		hostTarget = filepath.Join(filepath.Dir(destination), hostTarget)
+	}
+	mappedTarget, err := findPath(dirs, imageTarget)
+	if err != nil || mappedTarget == "" {
+		return "", ErrIllegalPath
+	}
+	if filepath.Clean(hostTarget) == mappedTarget {
+		return h.Linkname, nil
+	}
+
+	if o.symlinkPolicy == SymlinkRewrite {
+		return filepath.Rel(filepath.Dir(destination), mappedTarget)
+	}
+	return "", ErrIllegalPath
+}
+
+// chown sets ownership of the path to the uid and gid set by WithChown, or from the tar header if ownership
+// is being preserved.
+func (o *options) chown(path string, h *tar.Header) error {
+	if !o.preserveOwnership && !o.chownSet {
+		return nil
+	}
+	uid, gid := h.Uid, h.Gid
+	if o.chownSet {
+		uid, gid = o.chownUID, o.chownGID
+	} else if o.lookupOwnerNames {
+		if h.Uname != "" {
+			if u, err := user.Lookup(h.Uname); err == nil {
+				if id, err := strconv.Atoi(u.Uid); err == nil {
+					uid = id
+				}
+			}
+		}
+		if h.Gname != "" {
+			if g, err := user.LookupGroup(h.Gname); err == nil {
+				if id, err := strconv.Atoi(g.Gid); err == nil {
+					gid = id
+				}
+			}
+		}
+	}
+	o.log().Debugf("Setting ownership of %s to %d:%d", path, uid, gid)
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return errors.Wrapf(err, "failed to set ownership of %s", path)
+	}
+	return nil
+}
+
+// xattrPAXPrefix is the prefix of PAX records that hold extended attributes.
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// setXattrs sets extended attributes on the path from the SCHILY.xattr PAX records in the tar header, if
+// extended attributes are being preserved. This must be done after chown, as changing ownership clears
+// file capabilities.
+func (o *options) setXattrs(path string, h *tar.Header) error {
+	if !o.preserveXattrs {
+		return nil
+	}
+	for key, value := range h.PAXRecords {
+		name, ok := strings.CutPrefix(key, xattrPAXPrefix)
+		if !ok || name == "" {
+			continue
+		}
+		o.log().Debugf("Setting extended attribute %s on %s", name, path)
+		if err := setXattr(path, name, []byte(value)); err != nil {
+			if isXattrUnsupported(err) {
+				o.log().Warnf("Unable to set extended attribute %s on %s: %v", name, path, err)
+				continue
+			}
+			return errors.Wrapf(err, "failed to set extended attribute %s on %s", name, path)
+		}
+	}
+	return nil
+}
+
+// chownDirs sets ownership of directories created by extraction to the uid and gid set by WithChown. This
+// covers parent directories that were created implicitly, which do not have a header in the image.
+func (o *options) chownDirs(dirs map[string]bool) error {
+	if !o.chownSet {
+		return nil
+	}
+	for dir := range dirs {
+		if _, err := os.Lstat(dir); os.IsNotExist(err) {
+			continue
+		}
+		o.log().Debugf("Setting ownership of %s to %d:%d", dir, o.chownUID, o.chownGID)
+		if err := os.Lchown(dir, o.chownUID, o.chownGID); err != nil {
+			return errors.Wrapf(err, "failed to set ownership of %s", dir)
+		}
+	}
+	return nil
+}
+
+// chmodDirs sets the modes of extracted directories, once all content has been extracted into them. Directories
+// are changed deepest first, so that a directory that is not writable by its owner does not prevent its children
+// from being changed.
+func (o *options) chmodDirs(modes map[string]os.FileMode) error {
+	dirs := make([]string, 0, len(modes))
+	for dir := range modes {
+		dirs = append(dirs, dir)
+	}
+	// children sort after their parents, so reverse order changes them first
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if _, err := os.Lstat(dir); os.IsNotExist(err) {
+			continue
+		}
+		if err := o.chmod(dir, modes[dir]); err != nil {
+			return errors.Wrapf(err, "failed to set mode of %s", dir)
+		}
+	}
+	return nil
+}
+
+// writeFile writes the content of the reader to a file at the given path, creating or truncating it as necessary.
+// If the content cannot be written completely, the partial file is removed.
+func writeFile(path string, r io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(longPath(path), os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		// the previous content has already been truncated, so do not leave a partial file in its place
+		f.Close()
+		os.Remove(longPath(path))
+		return err
+	}
+	return f.Close()
+}
+
+// copyFile copies the content and mode of an existing file to a new file at the given path.
+func copyFile(source, destination string) error {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFile(destination, f, fi.Mode().Perm())
+}
+
+// canChown returns true if the current process is able to change file ownership.
+func canChown() bool {
+	return runtime.GOOS != "windows" && os.Geteuid() == 0
+}
+
+// cleanExtractDirs normalizes the directory map to ensure that source and destination
+// reliably do not have trailing slashes, unless the path is root.  This is required to
+// make directory name matching reliable while walking up the source path.
+func cleanExtractDirs(dirs map[string]string) (map[string]string, error) {
+	cleanDirs := make(map[string]string, len(dirs))
+	for s, d := range dirs {
+		s = path.Clean(imagePath(s))
+		if util.HasGlob(s) {
+			if err := util.ValidateGlob(s); err != nil {
+				return nil, errors.Wrapf(err, "invalid source pattern %s", s)
+			}
+		}
+		if d != ps {
+			var err error
+			d, err = filepath.Abs(strings.TrimSuffix(d, ps))
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid destination")
+			}
+		}
+		cleanDirs[s] = d
+	}
+	return cleanDirs, nil
+}
+
+// fileDestination returns the destination for a non-directory entry. If the entry's path exactly matches a
+// source in the dirs map and the destination is an existing directory, the file is placed within that
+// directory; otherwise the destination is used as the output filename.
+func fileDestination(dirs map[string]string, name, destination string) string {
+	name = path.Clean(imagePath(name))
+	if _, ok := dirs[name]; ok {
+		if fi, err := os.Stat(destination); err == nil && fi.IsDir() {
+			return filepath.Join(destination, path.Base(name))
+		}
+	}
+	return destination
+}
+
+// imagePath returns a path within the image as an absolute, slash-separated path. Windows layers may
+// contain backslash-separated paths; these are converted to forward slashes so that they can be matched
+// against the dirs map regardless of the local platform. The path is not cleaned.
+func imagePath(name string) string {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if !strings.HasPrefix(name, "/") {
+		name = "/" + name
+	}
+	return name
+}
+
+// findPath walks up the path, finding the longest match in the dirs map and returning the desired path.
+func findPath(dirs map[string]string, name string) (string, error) {
+	name = imagePath(name)
+
+	// Depth-first walk up the path to find a matching entry in the map, until we hit the root.
+	for source := name; ; source = path.Dir(source) {
+		if destination, ok := dirs[source]; ok {
+			// Trim the source path prefix, replace it with the destination, and normalize the joined result.
+			joined := filepath.Clean(filepath.Join(destination, filepath.FromSlash(strings.TrimPrefix(name, source))))
+
+			// Ensure that the path after cleaning does not escape the target prefix.
+			if !isWithin(destination, joined) {
+				return "", ErrIllegalPath
+			}
 
 			return joined, nil
 		}
-		if source == ps {
-			return "", nil
+		if source == "/" {
+			return findGlobPath(dirs, name)
+		}
+	}
+}
+
+// findGlobPath finds the first glob pattern in the dirs map that matches the path, returning the desired path.
+// The path relative to the static prefix of the pattern is preserved within the destination. Patterns are
+// checked in order of decreasing static prefix length, so that more specific patterns are preferred.
+func findGlobPath(dirs map[string]string, name string) (string, error) {
+	patterns := []string{}
+	for source := range dirs {
+		if util.HasGlob(source) {
+			patterns = append(patterns, source)
+		}
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		pi, pj := util.GlobPrefix(patterns[i]), util.GlobPrefix(patterns[j])
+		if len(pi) != len(pj) {
+			return len(pi) > len(pj)
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	for _, pattern := range patterns {
+		if ok, err := util.MatchGlob(pattern, name); err != nil || !ok {
+			continue
+		}
+		destination := dirs[pattern]
+		rel, err := filepath.Rel(filepath.FromSlash(util.GlobPrefix(pattern)), filepath.FromSlash(name))
+		if err != nil {
+			return "", ErrIllegalPath
+		}
+		joined := filepath.Clean(filepath.Join(destination, rel))
+
+		// Ensure that the path after cleaning does not escape the target prefix.
+		if !isWithin(destination, joined) {
+			return "", ErrIllegalPath
+		}
+
+		return joined, nil
+	}
+	return "", nil
+}
+
+// destinationRoot returns the most specific destination in the dirs map that contains the path.
+func destinationRoot(dirs map[string]string, path string) string {
+	root := ""
+	for _, destination := range dirs {
+		if isWithin(destination, path) && len(destination) > len(root) {
+			root = destination
+		}
+	}
+	return root
+}
+
+// checkSymlinks returns ErrIllegalPath if the path, or any of its parents below the root, is an existing symlink
+// that resolves to a location outside of the root. The root itself is trusted, and is not checked.
+func checkSymlinks(root, path string) error {
+	rel, err := filepath.Rel(root, path)
+	if root == "" || err != nil || rel == "." || !isWithin(root, path) {
+		return nil
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		realRoot = root
+	}
+	current := root
+	for _, component := range strings.Split(rel, ps) {
+		current = filepath.Join(current, component)
+		fi, err := os.Lstat(current)
+		if err != nil {
+			// nothing exists below this point, so there are no further symlinks to traverse
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			// dangling symlinks would be followed when creating content through them
+			return ErrIllegalPath
 		}
+		if !isWithin(realRoot, resolved) {
+			return ErrIllegalPath
+		}
+	}
+	return nil
+}
+
+// isWithin returns true if the path is the same as, or a child of, the root path. Paths are compared by
+// component, so that a root of /bin does not contain /binaries.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
 	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+ps)
+}
+
+// contextReader wraps a ReadCloser, closing it when the context is cancelled so that blocked
+// reads return promptly. Once the context is cancelled, reads return the context's error.
+type contextReader struct {
+	ctx  context.Context
+	r    io.ReadCloser
+	stop func() bool
+}
+
+func newContextReader(ctx context.Context, r io.ReadCloser) *contextReader {
+	return &contextReader{
+		ctx:  ctx,
+		r:    r,
+		stop: context.AfterFunc(ctx, func() { r.Close() }),
+	}
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := c.r.Read(p)
+	if err != nil && c.ctx.Err() != nil {
+		return n, c.ctx.Err()
+	}
+	return n, err
+}
+
+func (c *contextReader) Close() error {
+	c.stop()
+	return c.r.Close()
 }
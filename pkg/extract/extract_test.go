@@ -1,13 +1,32 @@
 package extract
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/logging"
 	"github.com/sirupsen/logrus"
 )
 
@@ -104,6 +123,61 @@ func TestFindPath(t *testing.T) {
 					err: ErrIllegalPath,
 				},
 			},
+		}, {
+			// test path components that share a prefix with the mapping source or destination
+			dirs: mss{
+				"/":    filepath.Join(temp, "dest"),
+				"/bin": filepath.Join(temp, "bin"),
+			},
+			paths: []testPath{
+				{
+					in:  "/bin/nsenter",
+					out: filepath.Join(temp, "bin", "nsenter"),
+					err: nil,
+				}, {
+					in:  "/bin/bash",
+					out: filepath.Join(temp, "bin", "bash"),
+					err: nil,
+				}, {
+					in:  "/binaries/foo",
+					out: filepath.Join(temp, "dest", "binaries", "foo"),
+					err: nil,
+				}, {
+					in:  "/destination.txt",
+					out: filepath.Join(temp, "dest", "destination.txt"),
+					err: nil,
+				}, {
+					in:  "/etc/nsswitch.conf",
+					out: filepath.Join(temp, "dest", "etc", "nsswitch.conf"),
+					err: nil,
+				}, {
+					in:  "../dest-sibling/evil",
+					out: "",
+					err: ErrIllegalPath,
+				}, {
+					in:  "../destination/evil",
+					out: "",
+					err: ErrIllegalPath,
+				},
+			},
+		}, {
+			// test that a mapping does not match paths that only share a prefix with it
+			dirs: mss{"/bin": filepath.Join(temp, "bin")},
+			paths: []testPath{
+				{
+					in:  "/bin/nsenter",
+					out: filepath.Join(temp, "bin", "nsenter"),
+					err: nil,
+				}, {
+					in:  "/binaries/foo",
+					out: "",
+					err: nil,
+				}, {
+					in:  "/bin.old/foo",
+					out: "",
+					err: nil,
+				},
+			},
 		}, {
 			// test no mapping at all
 			dirs: mss{},
@@ -180,6 +254,40 @@ func TestFindPath(t *testing.T) {
 					err: ErrIllegalPath,
 				},
 			},
+		}, {
+			// test mapping backslash-separated paths from Windows layers
+			dirs: mss{
+				"/Files/bin": filepath.Join(temp, "Files-bin"),
+				"\\Hives":    filepath.Join(temp, "Hives"),
+				"/etc":       filepath.Join(temp, "etc"),
+			},
+			paths: []testPath{
+				{
+					in:  "Files\\bin",
+					out: filepath.Join(temp, "Files-bin"),
+					err: nil,
+				}, {
+					in:  "Files\\bin\\containerd.exe",
+					out: filepath.Join(temp, "Files-bin", "containerd.exe"),
+					err: nil,
+				}, {
+					in:  "Files\\bin/aux\\mount.exe",
+					out: filepath.Join(temp, "Files-bin", "aux", "mount.exe"),
+					err: nil,
+				}, {
+					in:  "Hives\\Software_Delta",
+					out: filepath.Join(temp, "Hives", "Software_Delta"),
+					err: nil,
+				}, {
+					in:  "Files\\opt\\other.txt",
+					out: "",
+					err: nil,
+				}, {
+					in:  "Files\\bin\\..\\..\\..\\..\\etc\\passwd",
+					out: "",
+					err: ErrIllegalPath,
+				},
+			},
 		},
 	}
 
@@ -204,3 +312,2223 @@ func TestFindPath(t *testing.T) {
 		}
 	}
 }
+
+// testEntry is a single entry in a synthetic image layer. Content is only used for regular files.
+type testEntry struct {
+	header  tar.Header
+	content string
+}
+
+// newTestImage builds an image with one layer for each provided slice of entries.
+func newTestImage(t testing.TB, layers ...[]testEntry) v1.Image {
+	img := empty.Image
+	for _, entries := range layers {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, entry := range entries {
+			h := entry.header
+			if h.Typeflag == tar.TypeReg {
+				h.Size = int64(len(entry.content))
+			}
+			if h.Mode == 0 {
+				h.Mode = 0644
+			}
+			if err := tw.WriteHeader(&h); err != nil {
+				t.Fatalf("Failed to write tar header for %s: %v", h.Name, err)
+			}
+			if h.Typeflag == tar.TypeReg {
+				if _, err := tw.Write([]byte(entry.content)); err != nil {
+					t.Fatalf("Failed to write tar content for %s: %v", h.Name, err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Failed to close tar writer: %v", err)
+		}
+		layerBytes := buf.Bytes()
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(layerBytes)), nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to create layer: %v", err)
+		}
+		img, err = mutate.AppendLayers(img, layer)
+		if err != nil {
+			t.Fatalf("Failed to append layer: %v", err)
+		}
+	}
+	return img
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+	type link struct {
+		name   string
+		target string
+	}
+	// expected link targets for each policy; an empty string indicates that ErrIllegalPath is expected.
+	symlinkTests := map[string]struct {
+		link     link
+		expected map[SymlinkPolicy]string
+	}{
+		"relative target within root": {
+			link: link{"bin/sh", "busybox"},
+			expected: map[SymlinkPolicy]string{
+				SymlinkPreserve: "busybox",
+				SymlinkRewrite:  "busybox",
+				SymlinkRefuse:   "busybox",
+			},
+		},
+		"absolute target within root": {
+			link: link{"bin/ls", "/bin/busybox"},
+			expected: map[SymlinkPolicy]string{
+				SymlinkPreserve: "/bin/busybox",
+				SymlinkRewrite:  "busybox",
+				SymlinkRefuse:   "",
+			},
+		},
+		"relative target in another root": {
+			link: link{"usr/bin/env", "../../bin/busybox"},
+			expected: map[SymlinkPolicy]string{
+				SymlinkPreserve: "../../bin/busybox",
+				SymlinkRewrite:  filepath.Join("..", "bin", "busybox"),
+				SymlinkRefuse:   "",
+			},
+		},
+		"relative target escaping roots": {
+			link: link{"bin/passwd", "../../etc/passwd"},
+			expected: map[SymlinkPolicy]string{
+				SymlinkPreserve: "../../etc/passwd",
+				SymlinkRewrite:  "",
+				SymlinkRefuse:   "",
+			},
+		},
+		"absolute target escaping roots": {
+			link: link{"bin/shadow", "/etc/shadow"},
+			expected: map[SymlinkPolicy]string{
+				SymlinkPreserve: "/etc/shadow",
+				SymlinkRewrite:  "",
+				SymlinkRefuse:   "",
+			},
+		},
+	}
+
+	for testName, test := range symlinkTests {
+		t.Run(testName, func(t *testing.T) {
+			img := newTestImage(t, []testEntry{
+				{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, content: "busybox"},
+				{header: tar.Header{Name: test.link.name, Typeflag: tar.TypeSymlink, Linkname: test.link.target}},
+			})
+			for policy, expected := range test.expected {
+				tempdir := t.TempDir()
+				dirs := map[string]string{
+					"/bin":     filepath.Join(tempdir, "bin"),
+					"/usr/bin": filepath.Join(tempdir, "usrbin"),
+				}
+				// pre-create a file at the link destination to ensure that it is replaced
+				destination, err := findPath(dirs, test.link.name)
+				if err != nil {
+					t.Fatalf("Failed to find destination for %s: %v", test.link.name, err)
+				}
+				if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+					t.Fatalf("Failed to create parent directory: %v", err)
+				}
+				if err := os.WriteFile(destination, []byte("existing"), 0644); err != nil {
+					t.Fatalf("Failed to create existing file: %v", err)
+				}
+
+				err = ExtractDirs(img, dirs, WithSymlinkPolicy(policy))
+				if expected == "" {
+					if !errors.Is(err, ErrIllegalPath) {
+						t.Errorf("Expected error %v for policy %d but got %v", ErrIllegalPath, policy, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Errorf("Failed to extract with policy %d: %v", policy, err)
+					continue
+				}
+				target, err := os.Readlink(destination)
+				if err != nil {
+					t.Errorf("Failed to read link %s with policy %d: %v", destination, policy, err)
+				} else if target != expected {
+					t.Errorf("Expected link target %q for policy %d but got %q", expected, policy, target)
+				}
+			}
+		})
+	}
+}
+
+func TestHardlinkStaleTarget(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "usr/bin/coreutils"}},
+	})
+
+	// content left at the target by a previous extraction must not be linked to when the target is not extracted
+	tempdir := t.TempDir()
+	stale := filepath.Join(tempdir, "usr", "bin", "coreutils")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(stale, []byte("stale"), 0755); err != nil {
+		t.Fatalf("Failed to write stale target: %v", err)
+	}
+	if err := Extract(img, tempdir); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(tempdir, "bin", "ls")); !os.IsNotExist(err) {
+		t.Errorf("Expected hardlink to a target that is not in the image to be skipped, got %v", err)
+	}
+	if content, _ := os.ReadFile(stale); string(content) != "stale" {
+		t.Errorf("Expected stale target to be left untouched, got %q", content)
+	}
+}
+
+func TestHardlink(t *testing.T) {
+	img := newTestImage(t,
+		[]testEntry{
+			{header: tar.Header{Name: "usr/bin/coreutils", Typeflag: tar.TypeReg, Mode: 0755}, content: "coreutils"},
+			{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, content: "busybox"},
+			{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}},
+			{header: tar.Header{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "usr/bin/coreutils"}},
+			{header: tar.Header{Name: "bin/cat", Typeflag: tar.TypeLink, Linkname: "usr/bin/coreutils"}},
+		},
+		// links in an upper layer are flattened ahead of their targets in lower layers
+		[]testEntry{
+			{header: tar.Header{Name: "bin/vi", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}},
+		},
+	)
+
+	hardlinkTests := map[string]struct {
+		dirs   func(string) map[string]string
+		linked [][2]string // pairs of paths that are expected to be the same file
+		copied [][2]string // pairs of paths that are expected to have the same content, but not be the same file
+	}{
+		"all targets extracted": {
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/": dir}
+			},
+			linked: [][2]string{
+				{"bin/sh", "bin/busybox"},
+				{"bin/vi", "bin/busybox"},
+				{"bin/ls", "usr/bin/coreutils"},
+				{"bin/cat", "usr/bin/coreutils"},
+			},
+		},
+		"targets extracted to separate roots": {
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/bin": filepath.Join(dir, "bin"), "/usr/bin": filepath.Join(dir, "usr-bin")}
+			},
+			linked: [][2]string{
+				{"bin/sh", "bin/busybox"},
+				{"bin/ls", "usr-bin/coreutils"},
+				{"bin/cat", "usr-bin/coreutils"},
+			},
+		},
+		"fallback to copy when target was not extracted": {
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/bin": filepath.Join(dir, "bin")}
+			},
+			linked: [][2]string{
+				{"bin/sh", "bin/busybox"},
+				{"bin/vi", "bin/busybox"},
+				{"bin/ls", "bin/cat"},
+			},
+			copied: [][2]string{
+				{"bin/ls", "usr/bin/coreutils"},
+			},
+		},
+	}
+
+	for testName, test := range hardlinkTests {
+		t.Run(testName, func(t *testing.T) {
+			tempdir := t.TempDir()
+			if err := ExtractDirs(img, test.dirs(tempdir)); err != nil {
+				t.Fatalf("Failed to extract image: %v", err)
+			}
+
+			for _, pair := range test.linked {
+				a, err := os.Stat(filepath.Join(tempdir, pair[0]))
+				if err != nil {
+					t.Fatalf("Failed to stat %s: %v", pair[0], err)
+				}
+				b, err := os.Stat(filepath.Join(tempdir, pair[1]))
+				if err != nil {
+					t.Fatalf("Failed to stat %s: %v", pair[1], err)
+				}
+				if !os.SameFile(a, b) {
+					t.Errorf("Expected %s to be linked to %s", pair[0], pair[1])
+				}
+			}
+
+			for _, pair := range test.copied {
+				a, err := os.Stat(filepath.Join(tempdir, pair[0]))
+				if err != nil {
+					t.Fatalf("Failed to stat %s: %v", pair[0], err)
+				}
+				if _, err := os.Stat(filepath.Join(tempdir, pair[1])); !os.IsNotExist(err) {
+					t.Errorf("Expected %s to not be extracted, got %v", pair[1], err)
+				}
+				content, err := os.ReadFile(filepath.Join(tempdir, pair[0]))
+				if err != nil {
+					t.Fatalf("Failed to read %s: %v", pair[0], err)
+				}
+				if string(content) != "coreutils" {
+					t.Errorf("Expected %s to contain the content of %s, got %q", pair[0], pair[1], content)
+				}
+				if a.Mode().Perm() != 0755 {
+					t.Errorf("Expected %s to have mode 0755, got %#o", pair[0], a.Mode().Perm())
+				}
+			}
+		})
+	}
+}
+
+func TestExtractDirsSkipsUnmapped(t *testing.T) {
+	tempdir := t.TempDir()
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "bin/containerd", Typeflag: tar.TypeReg, Mode: 0755}, content: "containerd"},
+		{header: tar.Header{Name: "usr/share/doc/README", Typeflag: tar.TypeReg}, content: "readme"},
+		{header: tar.Header{Name: "bin/runc", Typeflag: tar.TypeReg, Mode: 0755}, content: "runc"},
+		{header: tar.Header{Name: "usr/share/man/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "usr/share/man/runc.1", Typeflag: tar.TypeReg}, content: "manpage"},
+		{header: tar.Header{Name: "bin/ctr", Typeflag: tar.TypeSymlink, Linkname: "containerd"}},
+		{header: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg}, content: "hosts"},
+	})
+
+	if err := ExtractDirs(img, map[string]string{"/bin": filepath.Join(tempdir, "bin")}); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+
+	expected := map[string]bool{"bin": true, "bin/containerd": true, "bin/runc": true, "bin/ctr": true}
+	err := filepath.Walk(tempdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == tempdir {
+			return err
+		}
+		rel, err := filepath.Rel(tempdir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !expected[rel] {
+			t.Errorf("Unexpected file extracted: %s", rel)
+		}
+		delete(expected, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk extracted files: %v", err)
+	}
+	for path := range expected {
+		t.Errorf("Expected file not extracted: %s", path)
+	}
+}
+
+func TestFileMapping(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "usr/local/bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "usr/local/bin/kubectl", Typeflag: tar.TypeReg, Mode: 0755}, content: "kubectl"},
+		{header: tar.Header{Name: "usr/local/bin/crictl", Typeflag: tar.TypeReg, Mode: 0755}, content: "crictl"},
+		{header: tar.Header{Name: "etc/crictl.yaml", Typeflag: tar.TypeReg}, content: "runtime-endpoint: unix:///run/containerd/containerd.sock"},
+	})
+
+	fileMappingTests := map[string]struct {
+		setup    func(t *testing.T, dir string)
+		dirs     func(dir string) map[string]string
+		expected map[string]string
+		err      bool
+	}{
+		"file to file": {
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/usr/local/bin/kubectl": filepath.Join(dir, "bin", "kubectl-1.29")}
+			},
+			expected: map[string]string{"bin/kubectl-1.29": "kubectl"},
+		},
+		"file to existing file": {
+			setup: func(t *testing.T, dir string) {
+				if err := os.WriteFile(filepath.Join(dir, "kubectl"), []byte("old"), 0755); err != nil {
+					t.Fatalf("Failed to create existing file: %v", err)
+				}
+			},
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/usr/local/bin/kubectl": filepath.Join(dir, "kubectl")}
+			},
+			expected: map[string]string{"kubectl": "kubectl"},
+		},
+		"file to existing directory": {
+			setup: func(t *testing.T, dir string) {
+				if err := os.MkdirAll(filepath.Join(dir, "bin"), 0755); err != nil {
+					t.Fatalf("Failed to create existing directory: %v", err)
+				}
+			},
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/usr/local/bin/kubectl": filepath.Join(dir, "bin")}
+			},
+			expected: map[string]string{"bin/kubectl": "kubectl"},
+		},
+		"file mapping alongside directory mapping": {
+			dirs: func(dir string) map[string]string {
+				return map[string]string{
+					"/usr/local/bin":         filepath.Join(dir, "bin"),
+					"/usr/local/bin/kubectl": filepath.Join(dir, "kubectl-1.29"),
+					"/etc/crictl.yaml":       filepath.Join(dir, "etc", "crictl.yaml"),
+				}
+			},
+			expected: map[string]string{
+				"bin/crictl":      "crictl",
+				"kubectl-1.29":    "kubectl",
+				"etc/crictl.yaml": "runtime-endpoint: unix:///run/containerd/containerd.sock",
+			},
+		},
+		"directory mapped over existing file": {
+			setup: func(t *testing.T, dir string) {
+				if err := os.WriteFile(filepath.Join(dir, "bin"), []byte("file"), 0644); err != nil {
+					t.Fatalf("Failed to create existing file: %v", err)
+				}
+			},
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/usr/local/bin": filepath.Join(dir, "bin")}
+			},
+			err: true,
+		},
+	}
+
+	for testName, test := range fileMappingTests {
+		t.Run(testName, func(t *testing.T) {
+			tempdir := t.TempDir()
+			if test.setup != nil {
+				test.setup(t, tempdir)
+			}
+
+			err := ExtractDirs(img, test.dirs(tempdir))
+			if test.err {
+				if err == nil {
+					t.Errorf("Expected error but extraction succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to extract image: %v", err)
+			}
+
+			for path, content := range test.expected {
+				b, err := os.ReadFile(filepath.Join(tempdir, path))
+				if err != nil {
+					t.Errorf("Failed to read %s: %v", path, err)
+				} else if string(b) != content {
+					t.Errorf("Expected content %q for %s but got %q", content, path, b)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(tempdir, "bin", "kubectl-1.29", "kubectl")); err == nil {
+				t.Errorf("File was extracted into a directory named for the destination file")
+			}
+		})
+	}
+}
+
+func TestGlobMapping(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "usr/lib/libc.so", Typeflag: tar.TypeReg}, content: "libc"},
+		{header: tar.Header{Name: "usr/lib/x86_64/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "usr/lib/x86_64/libssl.so", Typeflag: tar.TypeReg}, content: "libssl"},
+		{header: tar.Header{Name: "usr/lib/x86_64/libssl.so.3", Typeflag: tar.TypeReg}, content: "libssl.3"},
+		{header: tar.Header{Name: "usr/lib/x86_64/gconv/UTF-8.so", Typeflag: tar.TypeReg}, content: "utf-8"},
+		{header: tar.Header{Name: "usr/lib/firmware/fw.so", Typeflag: tar.TypeReg}, content: "fw"},
+		{header: tar.Header{Name: "usr/share/doc/README.md", Typeflag: tar.TypeReg}, content: "readme"},
+	})
+
+	globTests := map[string]struct {
+		dirs     func(dir string) map[string]string
+		expected []string
+	}{
+		"glob only": {
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/usr/lib/**/*.so": filepath.Join(dir, "libs")}
+			},
+			expected: []string{"libs/libc.so", "libs/x86_64/libssl.so", "libs/x86_64/gconv/UTF-8.so", "libs/firmware/fw.so"},
+		},
+		"plain prefix takes precedence over glob": {
+			dirs: func(dir string) map[string]string {
+				return map[string]string{
+					"/usr/lib/**/*.so":  filepath.Join(dir, "libs"),
+					"/usr/lib/firmware": filepath.Join(dir, "firmware"),
+				}
+			},
+			expected: []string{"libs/libc.so", "libs/x86_64/libssl.so", "libs/x86_64/gconv/UTF-8.so", "firmware/fw.so"},
+		},
+		"more specific glob takes precedence": {
+			dirs: func(dir string) map[string]string {
+				return map[string]string{
+					"/usr/lib/**/*.so":     filepath.Join(dir, "libs"),
+					"/usr/lib/x86_64/*.so": filepath.Join(dir, "x86_64"),
+				}
+			},
+			expected: []string{"libs/libc.so", "x86_64/libssl.so", "libs/x86_64/gconv/UTF-8.so", "libs/firmware/fw.so"},
+		},
+		"glob across the whole image": {
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/**/*.md": filepath.Join(dir, "docs")}
+			},
+			expected: []string{"docs/usr/share/doc/README.md"},
+		},
+	}
+
+	for testName, test := range globTests {
+		t.Run(testName, func(t *testing.T) {
+			tempdir := t.TempDir()
+			if err := ExtractDirs(img, test.dirs(tempdir)); err != nil {
+				t.Fatalf("Failed to extract image: %v", err)
+			}
+
+			files := []string{}
+			err := filepath.Walk(tempdir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(tempdir, path)
+				files = append(files, filepath.ToSlash(rel))
+				return err
+			})
+			if err != nil {
+				t.Fatalf("Failed to walk extracted files: %v", err)
+			}
+			sort.Strings(files)
+			sort.Strings(test.expected)
+			if !reflect.DeepEqual(files, test.expected) {
+				t.Errorf("Expected files %v but got %v", test.expected, files)
+			}
+		})
+	}
+
+	if err := ExtractDirs(img, map[string]string{"/usr/lib/[a-*.so": t.TempDir()}); err == nil {
+		t.Errorf("Expected error for malformed pattern")
+	}
+}
+
+func TestExclude(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeReg, Mode: 0755}, content: "sh"},
+		{header: tar.Header{Name: "proc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "proc/self/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "proc/self/status", Typeflag: tar.TypeReg}, content: "status"},
+		{header: tar.Header{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 01777}},
+		{header: tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "usr/share/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "usr/share/doc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "usr/share/doc/README.md", Typeflag: tar.TypeReg}, content: "readme"},
+		{header: tar.Header{Name: "usr/share/doc/pkg/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "usr/share/doc/pkg/CHANGES.md", Typeflag: tar.TypeReg}, content: "changes"},
+		{header: tar.Header{Name: "usr/share/zoneinfo/UTC", Typeflag: tar.TypeReg}, content: "utc"},
+		{header: tar.Header{Name: "vendor/pkg/testdata/fixture.txt", Typeflag: tar.TypeReg}, content: "fixture"},
+		{header: tar.Header{Name: "vendor/pkg/pkg.go", Typeflag: tar.TypeReg}, content: "package pkg"},
+	})
+
+	excludeTests := map[string]struct {
+		exclude  []string
+		expected []string
+	}{
+		"no exclusions": {
+			expected: []string{
+				"bin", "bin/sh", "proc", "proc/self", "proc/self/status", "tmp", "usr", "usr/share", "usr/share/doc",
+				"usr/share/doc/README.md", "usr/share/doc/pkg", "usr/share/doc/pkg/CHANGES.md", "usr/share/zoneinfo",
+				"usr/share/zoneinfo/UTC", "vendor", "vendor/pkg", "vendor/pkg/testdata", "vendor/pkg/testdata/fixture.txt",
+				"vendor/pkg/pkg.go",
+			},
+		},
+		"directory subtree exclusion": {
+			exclude: []string{"/proc", "usr/share/doc", "**/testdata"},
+			expected: []string{
+				"bin", "bin/sh", "tmp", "usr", "usr/share", "usr/share/zoneinfo", "usr/share/zoneinfo/UTC", "vendor",
+				"vendor/pkg", "vendor/pkg/pkg.go",
+			},
+		},
+		"file exclusion prunes empty directories": {
+			exclude: []string{"**/*.md", "/proc/self/status"},
+			expected: []string{
+				"bin", "bin/sh", "tmp", "usr", "usr/share", "usr/share/zoneinfo", "usr/share/zoneinfo/UTC",
+				"vendor", "vendor/pkg", "vendor/pkg/testdata", "vendor/pkg/testdata/fixture.txt", "vendor/pkg/pkg.go",
+			},
+		},
+	}
+
+	for testName, test := range excludeTests {
+		t.Run(testName, func(t *testing.T) {
+			tempdir := t.TempDir()
+			if err := Extract(img, tempdir, WithExclude(test.exclude...)); err != nil {
+				t.Fatalf("Failed to extract image: %v", err)
+			}
+
+			files := []string{}
+			err := filepath.Walk(tempdir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || path == tempdir {
+					return err
+				}
+				rel, err := filepath.Rel(tempdir, path)
+				files = append(files, filepath.ToSlash(rel))
+				return err
+			})
+			if err != nil {
+				t.Fatalf("Failed to walk extracted files: %v", err)
+			}
+			sort.Strings(files)
+			sort.Strings(test.expected)
+			if !reflect.DeepEqual(files, test.expected) {
+				t.Errorf("Expected files %v but got %v", test.expected, files)
+			}
+		})
+	}
+
+	if err := Extract(img, t.TempDir(), WithExclude("/usr/[a-")); err == nil {
+		t.Errorf("Expected error for malformed pattern")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	img := newTestImage(t,
+		[]testEntry{
+			{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, content: "busybox"},
+			{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "busybox"}},
+			{header: tar.Header{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin/busybox", Mode: 0755}},
+			{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644}, content: "127.0.0.1 localhost"},
+			{header: tar.Header{Name: "usr/share/doc/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "usr/share/doc/README.md", Typeflag: tar.TypeReg}, content: "readme"},
+		},
+		[]testEntry{
+			{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644}, content: "localhost"},
+		},
+	)
+
+	tempdir := t.TempDir()
+	dirs := map[string]string{
+		"/bin": filepath.Join(tempdir, "bin"),
+		"/etc": filepath.Join(tempdir, "etc"),
+		"/usr": filepath.Join(tempdir, "usr"),
+	}
+	exclude := WithExclude("**/*.md")
+
+	entries := map[string]Entry{}
+	if err := ExtractDirs(img, dirs, exclude, WithDryRun(func(entry Entry) {
+		entries[entry.Destination] = entry
+	})); err != nil {
+		t.Fatalf("Failed to dry-run extraction: %v", err)
+	}
+
+	if dirEntries, err := os.ReadDir(tempdir); err != nil || len(dirEntries) != 0 {
+		t.Fatalf("Expected dry run to write nothing, found %d entries: %v", len(dirEntries), err)
+	}
+
+	if err := ExtractDirs(img, dirs, exclude); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+
+	err := filepath.Walk(tempdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == tempdir {
+			return err
+		}
+		entry, ok := entries[path]
+		if !ok {
+			t.Errorf("File %s was extracted, but not listed by dry run", path)
+			return nil
+		}
+		delete(entries, path)
+		if entry.Type == TypeFile && entry.Size != info.Size() {
+			t.Errorf("Expected size %d for %s but got %d", entry.Size, path, info.Size())
+		}
+		if entry.Type != TypeSymlink && entry.Mode.Perm() != info.Mode().Perm() {
+			t.Errorf("Expected mode %v for %s but got %v", entry.Mode, path, info.Mode())
+		}
+		if entry.Type == TypeSymlink {
+			if target, err := os.Readlink(path); err != nil || target != entry.Linkname {
+				t.Errorf("Expected link target %q for %s but got %q: %v", entry.Linkname, path, target, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk extracted files: %v", err)
+	}
+	for path := range entries {
+		t.Errorf("File %s was listed by dry run, but not extracted", path)
+	}
+
+	// a directory in the image that conflicts with an existing file
+	conflictdir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(conflictdir, "etc"), []byte("file"), 0644); err != nil {
+		t.Fatalf("Failed to create conflicting file: %v", err)
+	}
+	err = Extract(img, conflictdir, WithDryRun(func(Entry) {}))
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("Expected error %v for conflicting destination but got %v", ErrConflict, err)
+	}
+
+	// a symlink that would be refused
+	err = ExtractDirs(img, map[string]string{"/bin/sh": filepath.Join(conflictdir, "sh")}, WithSymlinkPolicy(SymlinkRefuse), WithDryRun(func(Entry) {}))
+	if !errors.Is(err, ErrIllegalPath) {
+		t.Errorf("Expected error %v for refused symlink but got %v", ErrIllegalPath, err)
+	}
+}
+
+func TestOnFile(t *testing.T) {
+	img := newTestImage(t,
+		[]testEntry{
+			{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, content: "busybox"},
+			{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "busybox"}},
+			{header: tar.Header{Name: "usr/bin/coreutils", Typeflag: tar.TypeReg, Mode: 0755}, content: "coreutils"},
+			{header: tar.Header{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "usr/bin/coreutils"}},
+		},
+		[]testEntry{
+			{header: tar.Header{Name: "bin/vi", Typeflag: tar.TypeLink, Linkname: "bin/busybox"}},
+		},
+	)
+
+	type call struct {
+		source      string
+		destination string
+		typeflag    byte
+	}
+
+	for _, atomic := range []bool{true, false} {
+		t.Run(fmt.Sprintf("atomic=%t", atomic), func(t *testing.T) {
+			tempdir := t.TempDir()
+			calls := []call{}
+			onFile := WithOnFile(func(source, destination string, h *tar.Header) error {
+				// the entry must be in place by the time the hook is called
+				if _, err := os.Lstat(destination); err != nil {
+					t.Errorf("Expected %s to exist when hook is called: %v", destination, err)
+				}
+				rel, _ := filepath.Rel(tempdir, destination)
+				calls = append(calls, call{source: source, destination: filepath.ToSlash(rel), typeflag: h.Typeflag})
+				return nil
+			})
+			if err := ExtractDirs(img, map[string]string{"/bin": filepath.Join(tempdir, "bin")}, onFile, WithAtomic(atomic)); err != nil {
+				t.Fatalf("Failed to extract image: %v", err)
+			}
+
+			// links are deferred until their target has been extracted, and links to targets that were
+			// not extracted are copied from the image in a second pass.
+			expected := []call{
+				{source: "bin", destination: "bin", typeflag: tar.TypeDir},
+				{source: "bin/busybox", destination: "bin/busybox", typeflag: tar.TypeReg},
+				{source: "bin/sh", destination: "bin/sh", typeflag: tar.TypeSymlink},
+				{source: "bin/vi", destination: "bin/vi", typeflag: tar.TypeLink},
+				{source: "bin/ls", destination: "bin/ls", typeflag: tar.TypeLink},
+			}
+			if !reflect.DeepEqual(calls, expected) {
+				t.Errorf("Expected hook calls %+v but got %+v", expected, calls)
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		tempdir := t.TempDir()
+		errHook := errors.New("hook failed")
+		onFile := WithOnFile(func(source, destination string, h *tar.Header) error {
+			if source == "bin/busybox" {
+				return errHook
+			}
+			return nil
+		})
+		err := ExtractDirs(img, map[string]string{"/bin": filepath.Join(tempdir, "bin")}, onFile)
+		if !errors.Is(err, errHook) {
+			t.Fatalf("Expected hook error but got %v", err)
+		}
+		if !strings.Contains(err.Error(), "bin/busybox") {
+			t.Errorf("Expected error to identify the failed file, got %v", err)
+		}
+		if _, err := os.Lstat(filepath.Join(tempdir, "bin", "sh")); !os.IsNotExist(err) {
+			t.Errorf("Expected extraction to stop after hook error: %v", err)
+		}
+	})
+}
+
+func TestOverwritePolicy(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0755}, content: "new"},
+	})
+
+	type testCase struct {
+		policy   OverwritePolicy
+		existing string
+		mode     os.FileMode
+		expected string
+		err      error
+		replaced bool
+	}
+	testCases := map[string]testCase{
+		"overwrite identical":          {policy: OverwriteAlways, existing: "new", mode: 0755, expected: "new"},
+		"overwrite differing":          {policy: OverwriteAlways, existing: "old", mode: 0755, expected: "new"},
+		"skip identical":               {policy: OverwriteSkip, existing: "new", mode: 0755, expected: "new"},
+		"skip differing":               {policy: OverwriteSkip, existing: "old", mode: 0755, expected: "old"},
+		"error identical":              {policy: OverwriteError, existing: "new", mode: 0755, expected: "new", err: ErrExists},
+		"error differing":              {policy: OverwriteError, existing: "old", mode: 0755, expected: "old", err: ErrExists},
+		"if-changed identical":         {policy: OverwriteIfChanged, existing: "new", mode: 0755, expected: "new"},
+		"if-changed differing content": {policy: OverwriteIfChanged, existing: "old", mode: 0755, expected: "new", replaced: true},
+		"if-changed differing size":    {policy: OverwriteIfChanged, existing: "older", mode: 0755, expected: "new", replaced: true},
+		"if-changed differing mode":    {policy: OverwriteIfChanged, existing: "new", mode: 0644, expected: "new", replaced: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tempdir := t.TempDir()
+			destination := filepath.Join(tempdir, "tool")
+			if err := os.WriteFile(destination, []byte(tc.existing), tc.mode); err != nil {
+				t.Fatalf("Failed to create existing file: %v", err)
+			}
+			before, err := os.Stat(destination)
+			if err != nil {
+				t.Fatalf("Failed to stat existing file: %v", err)
+			}
+
+			err = ExtractDirs(img, map[string]string{"/bin": tempdir}, WithOverwritePolicy(tc.policy))
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Expected error %v but got %v", tc.err, err)
+			}
+
+			content, err := os.ReadFile(destination)
+			if err != nil {
+				t.Fatalf("Failed to read file: %v", err)
+			}
+			if string(content) != tc.expected {
+				t.Errorf("Expected content %q but got %q", tc.expected, content)
+			}
+
+			after, err := os.Stat(destination)
+			if err != nil {
+				t.Fatalf("Failed to stat file: %v", err)
+			}
+			if tc.policy == OverwriteIfChanged && after.Mode().Perm() != 0755 {
+				t.Errorf("Expected mode %v but got %v", os.FileMode(0755), after.Mode())
+			}
+			if tc.policy == OverwriteIfChanged && os.SameFile(before, after) == tc.replaced {
+				t.Errorf("Expected file replaced to be %t", tc.replaced)
+			}
+		})
+	}
+
+	if _, err := ParseOverwritePolicy("if-changed"); err != nil {
+		t.Errorf("Failed to parse overwrite policy: %v", err)
+	}
+	if _, err := ParseOverwritePolicy("sometimes"); err == nil {
+		t.Errorf("Expected error parsing invalid overwrite policy")
+	}
+}
+
+func TestOverwriteIfChangedOnFile(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "bin/tool", Typeflag: tar.TypeReg, Mode: 0755}, content: "tool"},
+		{header: tar.Header{Name: "bin/alias", Typeflag: tar.TypeLink, Linkname: "bin/tool"}},
+	})
+
+	tempdir := t.TempDir()
+	dirs := map[string]string{"/bin": tempdir}
+	for _, run := range []string{"first", "second"} {
+		calls := []string{}
+		onFile := WithOnFile(func(source, destination string, h *tar.Header) error {
+			calls = append(calls, source)
+			return nil
+		})
+		entries, err := ExtractDirsWithResult(context.Background(), img, dirs, onFile, WithOverwritePolicy(OverwriteIfChanged))
+		if err != nil {
+			t.Fatalf("Failed to extract image on %s run: %v", run, err)
+		}
+
+		// the file is only written, and passed to the callback, by the first run
+		written := run == "first"
+		if slices.Contains(calls, "bin/tool") != written {
+			t.Errorf("Expected callback for bin/tool on %s run to be %t, got calls %v", run, written, calls)
+		}
+		if slices.ContainsFunc(entries, func(e Entry) bool { return e.Source == "bin/tool" }) != written {
+			t.Errorf("Expected entry for bin/tool on %s run to be %t, got entries %v", run, written, entries)
+		}
+
+		// hardlinks to a file that already matches the image are still linked to it
+		tool, err := os.Stat(filepath.Join(tempdir, "tool"))
+		if err != nil {
+			t.Fatalf("Failed to stat tool: %v", err)
+		}
+		alias, err := os.Stat(filepath.Join(tempdir, "alias"))
+		if err != nil {
+			t.Fatalf("Failed to stat alias: %v", err)
+		}
+		if !os.SameFile(tool, alias) {
+			t.Errorf("Expected alias to be a hardlink to tool on %s run", run)
+		}
+	}
+}
+
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		return n, e.err
+	}
+	return n, err
+}
+
+func TestAtomicWrite(t *testing.T) {
+	tempdir := t.TempDir()
+	destination := filepath.Join(tempdir, "containerd")
+	if err := os.WriteFile(destination, []byte("original"), 0755); err != nil {
+		t.Fatalf("Failed to create existing file: %v", err)
+	}
+
+	copyErr := errors.New("unexpected EOF")
+	r := &errReader{r: bytes.NewBufferString("truncated"), err: copyErr}
+	if err := writeFileAtomic(destination, r, 0755); !errors.Is(err, copyErr) {
+		t.Fatalf("Expected error %v but got %v", copyErr, err)
+	}
+
+	content, err := os.ReadFile(destination)
+	if err != nil {
+		t.Fatalf("Failed to read file: %v", err)
+	}
+	if string(content) != "original" {
+		t.Errorf("Expected original content to be untouched, but got %q", content)
+	}
+
+	entries, err := os.ReadDir(tempdir)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected temporary file to be removed, but found %d entries", len(entries))
+	}
+
+	if err := writeFileAtomic(destination, bytes.NewBufferString("updated"), 0700); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if fi, err := os.Stat(destination); err != nil {
+		t.Errorf("Failed to stat file: %v", err)
+	} else if fi.Mode().Perm() != 0700 {
+		t.Errorf("Expected mode %v but got %v", os.FileMode(0700), fi.Mode())
+	}
+	if content, err := os.ReadFile(destination); err != nil || string(content) != "updated" {
+		t.Errorf("Expected content %q but got %q: %v", "updated", content, err)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	img := newTestImage(t,
+		[]testEntry{
+			{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, content: "busybox"},
+			{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "busybox"}},
+			{header: tar.Header{Name: "etc/hosts", Typeflag: tar.TypeReg, Mode: 0644}, content: "127.0.0.1 localhost"},
+			{header: tar.Header{Name: "usr/share/doc/README.md", Typeflag: tar.TypeReg}, content: "readme"},
+		},
+		[]testEntry{
+			{header: tar.Header{Name: "bin/ls", Typeflag: tar.TypeLink, Linkname: "bin/busybox", Mode: 0755}},
+		},
+	)
+
+	tempdir := t.TempDir()
+	dirs := map[string]string{
+		"/bin": filepath.Join(tempdir, "bin"),
+		"/etc": filepath.Join(tempdir, "etc"),
+		"/usr": filepath.Join(tempdir, "usr"),
+	}
+	exclude := WithExclude("**/*.md")
+
+	dryRunEntries, err := ExtractDirsWithResult(context.Background(), img, dirs, exclude, WithDryRun(func(Entry) {}))
+	if err != nil {
+		t.Fatalf("Failed to dry-run extraction: %v", err)
+	}
+
+	entries, err := ExtractDirsWithResult(context.Background(), img, dirs, exclude)
+	if err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+
+	manifest := map[string]Entry{}
+	for _, entry := range entries {
+		manifest[entry.Destination] = entry
+	}
+
+	err = filepath.Walk(tempdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == tempdir {
+			return err
+		}
+		entry, ok := manifest[path]
+		if !ok {
+			t.Errorf("File %s was extracted, but not listed in manifest", path)
+			return nil
+		}
+		delete(manifest, path)
+		if entry.Type != TypeFile {
+			return nil
+		}
+		if entry.Size != info.Size() {
+			t.Errorf("Expected size %d for %s but got %d", entry.Size, path, info.Size())
+		}
+		if entry.Mode.Perm() != info.Mode().Perm() {
+			t.Errorf("Expected mode %v for %s but got %v", entry.Mode, path, info.Mode())
+		}
+		if sum, err := fileHash(path); err != nil || hex.EncodeToString(sum) != entry.SHA256 {
+			t.Errorf("Expected sha256 %s for %s but got %x: %v", entry.SHA256, path, sum, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk extracted files: %v", err)
+	}
+	for path := range manifest {
+		t.Errorf("File %s was listed in manifest, but not extracted", path)
+	}
+
+	// the manifest should match the dry run, aside from file hashes
+	dryRun := map[string]Entry{}
+	for _, entry := range dryRunEntries {
+		dryRun[entry.Destination] = entry
+	}
+	for _, entry := range entries {
+		entry.SHA256 = ""
+		if !reflect.DeepEqual(entry, dryRun[entry.Destination]) {
+			t.Errorf("Expected manifest entry %+v to match dry run entry %+v", entry, dryRun[entry.Destination])
+		}
+	}
+	if len(entries) != len(dryRunEntries) {
+		t.Errorf("Expected %d manifest entries to match %d dry run entries", len(entries), len(dryRunEntries))
+	}
+}
+
+func TestImageMetadata(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, content: "busybox"},
+	})
+	ref, err := name.ParseReference("docker.io/rancher/wharfie:latest")
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+
+	tempdir := t.TempDir()
+	dirs := map[string]string{"/": filepath.Join(tempdir, "root")}
+	metadataDir := filepath.Join(tempdir, "metadata")
+
+	// metadata is not written for dry runs
+	if err := ExtractDirs(img, dirs, WithImageMetadata(metadataDir, ref), WithDryRun(func(Entry) {})); err != nil {
+		t.Fatalf("Failed to dry-run extraction: %v", err)
+	}
+	if _, err := os.Stat(metadataDir); !os.IsNotExist(err) {
+		t.Errorf("Expected metadata not to be written for dry run: %v", err)
+	}
+
+	if err := ExtractDirs(img, dirs, WithImageMetadata(metadataDir, ref)); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(metadataDir, ManifestFile))
+	if err != nil {
+		t.Fatalf("Failed to open manifest: %v", err)
+	}
+	defer f.Close()
+	manifest, err := v1.ParseManifest(f)
+	if err != nil {
+		t.Fatalf("Failed to parse manifest: %v", err)
+	}
+	if expected, _ := img.Manifest(); !jsonEqual(t, manifest, expected) {
+		t.Errorf("Expected manifest %+v but got %+v", expected, manifest)
+	}
+
+	f, err = os.Open(filepath.Join(metadataDir, ConfigFile))
+	if err != nil {
+		t.Fatalf("Failed to open config file: %v", err)
+	}
+	defer f.Close()
+	config, err := v1.ParseConfigFile(f)
+	if err != nil {
+		t.Fatalf("Failed to parse config file: %v", err)
+	}
+	if expected, _ := img.ConfigFile(); !jsonEqual(t, config, expected) {
+		t.Errorf("Expected config file %+v but got %+v", expected, config)
+	}
+
+	data, err := os.ReadFile(filepath.Join(metadataDir, ImageFile))
+	if err != nil {
+		t.Fatalf("Failed to read image metadata: %v", err)
+	}
+	metadata := ImageMetadata{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		t.Fatalf("Failed to parse image metadata: %v", err)
+	}
+	digest, _ := img.Digest()
+	expected := ImageMetadata{
+		Reference:         "index.docker.io/rancher/wharfie:latest",
+		Digest:            digest.String(),
+		ResolvedReference: "index.docker.io/rancher/wharfie@" + digest.String(),
+	}
+	if metadata != expected {
+		t.Errorf("Expected image metadata %+v but got %+v", expected, metadata)
+	}
+}
+
+// jsonEqual returns true if the values have the same JSON encoding.
+func jsonEqual(t *testing.T, a, b interface{}) bool {
+	t.Helper()
+	aj, err := json.Marshal(a)
+	if err != nil {
+		t.Fatalf("Failed to marshal %+v: %v", a, err)
+	}
+	bj, err := json.Marshal(b)
+	if err != nil {
+		t.Fatalf("Failed to marshal %+v: %v", b, err)
+	}
+	return bytes.Equal(aj, bj)
+}
+
+func TestVerify(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "bin/containerd", Typeflag: tar.TypeReg, Mode: 0755}, content: "containerd"},
+		{header: tar.Header{Name: "bin/runc", Typeflag: tar.TypeReg, Mode: 0755}, content: "runc"},
+	})
+
+	tempdir := t.TempDir()
+	if err := Extract(img, tempdir, WithVerify(true)); err != nil {
+		t.Fatalf("Failed to extract and verify image: %v", err)
+	}
+
+	corrupted := filepath.Join(tempdir, "bin", "runc")
+	verifyHook = func(path string) {
+		if path == corrupted {
+			if err := os.WriteFile(path, []byte("corrupt"), 0755); err != nil {
+				t.Errorf("Failed to corrupt file: %v", err)
+			}
+		}
+	}
+	defer func() { verifyHook = nil }()
+
+	err := Extract(img, tempdir, WithVerify(true))
+	if !errors.Is(err, ErrVerify) {
+		t.Fatalf("Expected error %v but got %v", ErrVerify, err)
+	}
+	if !strings.Contains(err.Error(), corrupted) {
+		t.Errorf("Expected error to list corrupted file %s: %v", corrupted, err)
+	}
+	if strings.Contains(err.Error(), filepath.Join(tempdir, "bin", "containerd")) {
+		t.Errorf("Expected error to list only corrupted files: %v", err)
+	}
+}
+
+func TestWindowsPaths(t *testing.T) {
+	// Windows layers place files under a Files/ prefix, and may use backslash-separated paths.
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "Files\\", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "Files\\bin\\", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "Files\\bin\\containerd.exe", Typeflag: tar.TypeReg, Mode: 0755}, content: "containerd"},
+		{header: tar.Header{Name: "Files\\bin\\containerd.pdb", Typeflag: tar.TypeReg, Mode: 0644}, content: "symbols"},
+		{header: tar.Header{Name: "Files/bin/crictl.exe", Typeflag: tar.TypeReg, Mode: 0755}, content: "crictl"},
+		{header: tar.Header{Name: "Files\\etc\\config.toml", Typeflag: tar.TypeReg, Mode: 0644}, content: "config"},
+		{header: tar.Header{Name: "Hives\\Software_Delta", Typeflag: tar.TypeReg, Mode: 0644}, content: "hive"},
+	})
+
+	testCases := map[string]struct {
+		dirs     func(tempdir string) map[string]string
+		expected []string
+	}{
+		"slash source": {
+			dirs: func(tempdir string) map[string]string {
+				return map[string]string{"/Files/bin": filepath.Join(tempdir, "bin")}
+			},
+			expected: []string{"bin", "bin/containerd.exe", "bin/crictl.exe"},
+		},
+		"backslash source": {
+			dirs: func(tempdir string) map[string]string {
+				return map[string]string{"\\Files\\bin": filepath.Join(tempdir, "bin")}
+			},
+			expected: []string{"bin", "bin/containerd.exe", "bin/crictl.exe"},
+		},
+		"files root": {
+			dirs: func(tempdir string) map[string]string {
+				return map[string]string{"/Files": tempdir}
+			},
+			expected: []string{"bin", "bin/containerd.exe", "bin/crictl.exe", "etc", "etc/config.toml"},
+		},
+		"file mapping": {
+			dirs: func(tempdir string) map[string]string {
+				return map[string]string{"/Files/bin/containerd.exe": filepath.Join(tempdir, "containerd-1.7.exe")}
+			},
+			expected: []string{"containerd-1.7.exe"},
+		},
+		"glob mapping": {
+			dirs: func(tempdir string) map[string]string {
+				return map[string]string{"/Files/**/*.exe": tempdir}
+			},
+			expected: []string{"bin", "bin/containerd.exe", "bin/crictl.exe"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tempdir := t.TempDir()
+			if err := ExtractDirs(img, tc.dirs(tempdir), WithExclude("/Files/**/*.pdb")); err != nil {
+				t.Fatalf("Failed to extract image: %v", err)
+			}
+
+			extracted := []string{}
+			err := filepath.Walk(tempdir, func(path string, info os.FileInfo, err error) error {
+				if err != nil || path == tempdir {
+					return err
+				}
+				rel, err := filepath.Rel(tempdir, path)
+				extracted = append(extracted, filepath.ToSlash(rel))
+				return err
+			})
+			if err != nil {
+				t.Fatalf("Failed to walk extracted files: %v", err)
+			}
+			sort.Strings(extracted)
+			if !reflect.DeepEqual(extracted, tc.expected) {
+				t.Errorf("Expected extracted files %v but got %v", tc.expected, extracted)
+			}
+		})
+	}
+}
+
+// stallingLayer wraps a layer, stalling reads of the uncompressed content once the given offset is reached.
+type stallingLayer struct {
+	v1.Layer
+	offset  int
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (l *stallingLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	return &stallingReader{ReadCloser: rc, layer: l}, nil
+}
+
+type stallingReader struct {
+	io.ReadCloser
+	layer *stallingLayer
+	read  int
+}
+
+func (r *stallingReader) Read(p []byte) (int, error) {
+	if r.read >= r.layer.offset {
+		close(r.layer.stalled)
+		<-r.layer.release
+		return 0, io.ErrUnexpectedEOF
+	}
+	if remaining := r.layer.offset - r.read; len(p) > remaining {
+		p = p[:remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.read += n
+	return n, err
+}
+
+func TestExtractDirsContext(t *testing.T) {
+	big := strings.Repeat("x", 1<<20)
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "bin/runc", Typeflag: tar.TypeReg, Mode: 0755}, content: "runc"},
+		{header: tar.Header{Name: "bin/containerd", Typeflag: tar.TypeReg, Mode: 0755}, content: big},
+	})
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Failed to get image layers: %v", err)
+	}
+	layer := &stallingLayer{Layer: layers[0], offset: len(big) / 2, stalled: make(chan struct{}), release: make(chan struct{})}
+	defer close(layer.release)
+	img, err = mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatalf("Failed to append layer: %v", err)
+	}
+
+	tempdir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-layer.stalled
+		cancel()
+	}()
+
+	start := time.Now()
+	err = ExtractDirsContext(ctx, img, map[string]string{"/bin": tempdir})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected error %v but got %v", context.Canceled, err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected extraction to return promptly after cancellation, but took %v", elapsed)
+	}
+
+	entries, err := os.ReadDir(tempdir)
+	if err != nil {
+		t.Fatalf("Failed to read directory: %v", err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !reflect.DeepEqual(names, []string{"runc"}) {
+		t.Errorf("Expected only fully extracted files to be visible, but found %v", names)
+	}
+}
+
+func TestOptions(t *testing.T) {
+	testCases := map[string]struct {
+		opts     []Option
+		expected *options
+		err      bool
+	}{
+		"defaults": {
+			expected: &options{mode: 0755, atomic: true, readAhead: defaultReadAhead},
+		},
+		"later options override earlier ones": {
+			opts:     []Option{WithMode(0700), WithMode(0750), WithAtomic(false), WithOverwritePolicy(OverwriteSkip), WithOverwritePolicy(OverwriteIfChanged)},
+			expected: &options{mode: 0750, modeSet: true, overwritePolicy: OverwriteIfChanged, readAhead: defaultReadAhead},
+		},
+		"exclude patterns accumulate": {
+			opts:     []Option{WithExclude("/usr/share/doc"), WithExclude("**/*.md", "/tmp")},
+			expected: &options{mode: 0755, atomic: true, exclude: []string{"/usr/share/doc", "**/*.md", "/tmp"}, readAhead: defaultReadAhead},
+		},
+		"preserve permissions": {
+			opts:     []Option{WithPreservePermissions(), WithPreserveOwnership(true), WithVerify(true)},
+			expected: &options{mode: 0755, atomic: true, preservePermissions: true, preserveOwnership: true, verify: true, readAhead: defaultReadAhead},
+		},
+		"chown": {
+			opts:     []Option{WithChown(1000, 1001)},
+			expected: &options{mode: 0755, atomic: true, chownSet: true, chownUID: 1000, chownGID: 1001, readAhead: defaultReadAhead},
+		},
+		"chown with preserve ownership": {
+			opts: []Option{WithChown(1000, 1000), WithPreserveOwnership(true)},
+			err:  true,
+		},
+		"read-ahead disabled": {
+			opts:     []Option{WithReadAhead(0)},
+			expected: &options{mode: 0755, atomic: true},
+		},
+		"invalid read-ahead": {
+			opts: []Option{WithReadAhead(-1)},
+			err:  true,
+		},
+		"invalid case collision policy": {
+			opts: []Option{WithCaseCollisionPolicy(CaseCollisionPolicy(42))},
+			err:  true,
+		},
+		"invalid strip components": {
+			opts: []Option{WithStripComponents(-1)},
+			err:  true,
+		},
+		"invalid chown": {
+			opts: []Option{WithChown(-1, 1000)},
+			err:  true,
+		},
+		"invalid exclude pattern": {
+			opts: []Option{WithExclude("/usr/[")},
+			err:  true,
+		},
+		"invalid symlink policy": {
+			opts: []Option{WithSymlinkPolicy(SymlinkPolicy(42))},
+			err:  true,
+		},
+		"mode with preserve permissions": {
+			opts: []Option{WithMode(0700), WithPreservePermissions()},
+			err:  true,
+		},
+		"dry run with verify": {
+			opts: []Option{WithDryRun(func(Entry) {}), WithVerify(true)},
+			err:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			o, err := makeOptions(tc.opts...)
+			if tc.err {
+				if err == nil {
+					t.Errorf("Expected error but got options %+v", o)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to make options: %v", err)
+			}
+			if !reflect.DeepEqual(o, tc.expected) {
+				t.Errorf("Expected options %+v but got %+v", tc.expected, o)
+			}
+		})
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	if err := ValidateOptions(WithExclude("/usr/share/doc/**", "**/*.md"), WithStripComponents(1)); err != nil {
+		t.Errorf("Expected valid options but got %v", err)
+	}
+	if err := ValidateOptions(WithExclude("**/*.md", "/usr/["), WithStripComponents(1)); err == nil || !strings.Contains(err.Error(), "invalid exclude pattern /usr/[") {
+		t.Errorf("Expected invalid exclude pattern error but got %v", err)
+	}
+	if err := ValidateOptions(WithMode(0700), WithPreservePermissions()); err == nil {
+		t.Errorf("Expected error for options that cannot be used together")
+	}
+}
+
+func TestExtractDirsWithOptions(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "etc/app.conf", Typeflag: tar.TypeReg, Mode: 0640}, content: "app"},
+		{header: tar.Header{Name: "etc/README.md", Typeflag: tar.TypeReg, Mode: 0644}, content: "readme"},
+	})
+
+	tempdir := t.TempDir()
+	if err := ExtractDirsWithOptions(img, map[string]string{"/etc": tempdir}, WithMode(0700), WithPreservePermissions()); err == nil {
+		t.Errorf("Expected error for options that cannot be used together")
+	}
+	if entries, _ := os.ReadDir(tempdir); len(entries) != 0 {
+		t.Errorf("Expected nothing to be extracted with invalid options, got %d entries", len(entries))
+	}
+
+	if err := ExtractDirsWithOptions(img, map[string]string{"/etc": tempdir}, WithExclude("**/*.md")); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(tempdir, "app.conf")); err != nil || string(content) != "app" {
+		t.Errorf("Expected app.conf to be extracted, got %q: %v", content, err)
+	}
+	if _, err := os.Lstat(filepath.Join(tempdir, "README.md")); !os.IsNotExist(err) {
+		t.Errorf("Expected README.md to be excluded, got %v", err)
+	}
+}
+
+func TestExtractLayers(t *testing.T) {
+	img := newTestImage(t,
+		[]testEntry{
+			{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "etc/base.conf", Typeflag: tar.TypeReg}, content: "base"},
+			{header: tar.Header{Name: "etc/removed.conf", Typeflag: tar.TypeReg}, content: "removed"},
+		},
+		[]testEntry{
+			{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "etc/.wh.removed.conf", Typeflag: tar.TypeReg}},
+			{header: tar.Header{Name: "etc/addon.conf", Typeflag: tar.TypeReg}, content: "addon"},
+			{header: tar.Header{Name: "etc/obsolete.conf", Typeflag: tar.TypeReg}, content: "obsolete"},
+		},
+		[]testEntry{
+			{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "etc/.wh.obsolete.conf", Typeflag: tar.TypeReg}},
+			{header: tar.Header{Name: "etc/patch.conf", Typeflag: tar.TypeReg}, content: "patch"},
+		},
+	)
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Failed to get image layers: %v", err)
+	}
+	digest, err := layers[1].Digest()
+	if err != nil {
+		t.Fatalf("Failed to get layer digest: %v", err)
+	}
+
+	testCases := map[string]struct {
+		selector func(int, v1.Layer) bool
+		expected []string
+		err      bool
+	}{
+		"all layers": {
+			selector: func(int, v1.Layer) bool { return true },
+			expected: []string{"addon.conf", "base.conf", "patch.conf"},
+		},
+		"first layer": {
+			selector: func(i int, _ v1.Layer) bool { return i == 0 },
+			expected: []string{"base.conf", "removed.conf"},
+		},
+		"last layer": {
+			selector: func(i int, _ v1.Layer) bool { return i == 2 },
+			expected: []string{"patch.conf"},
+		},
+		"last two layers": {
+			selector: func(i int, _ v1.Layer) bool { return i >= 1 },
+			expected: []string{"addon.conf", "patch.conf"},
+		},
+		"layer by digest": {
+			selector: func(_ int, l v1.Layer) bool {
+				d, err := l.Digest()
+				return err == nil && d == digest
+			},
+			expected: []string{"addon.conf", "obsolete.conf"},
+		},
+		"no layers": {
+			selector: func(int, v1.Layer) bool { return false },
+			err:      true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tempdir := t.TempDir()
+			err := ExtractLayers(img, tc.selector, map[string]string{"/etc": tempdir})
+			if tc.err {
+				if err == nil {
+					t.Errorf("Expected error extracting layers")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to extract layers: %v", err)
+			}
+
+			entries, err := os.ReadDir(tempdir)
+			if err != nil {
+				t.Fatalf("Failed to read directory: %v", err)
+			}
+			names := []string{}
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+			if !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("Expected extracted files %v but got %v", tc.expected, names)
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	// a highly compressible layer: a large file of zeros, and many tiny files
+	entries := []testEntry{
+		{header: tar.Header{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "data/small", Typeflag: tar.TypeReg}, content: "small"},
+		{header: tar.Header{Name: "data/zeros", Typeflag: tar.TypeReg}, content: strings.Repeat("\x00", 8<<20)},
+		{header: tar.Header{Name: "tiny/", Typeflag: tar.TypeDir, Mode: 0755}},
+	}
+	for i := 0; i < 100; i++ {
+		entries = append(entries, testEntry{header: tar.Header{Name: "tiny/" + strconv.Itoa(i), Typeflag: tar.TypeReg}, content: "x"})
+	}
+	img := newTestImage(t, entries)
+
+	testCases := map[string]struct {
+		opts     []Option
+		expected *LimitError
+	}{
+		"unlimited": {},
+		"within limits": {
+			opts: []Option{WithMaxSize(9 << 20), WithMaxFiles(104), WithMaxFileSize(8 << 20)},
+		},
+		"max size": {
+			opts:     []Option{WithMaxSize(1 << 20)},
+			expected: &LimitError{Limit: LimitSize, Max: 1 << 20, Path: "data/zeros", Files: 2, Bytes: 5},
+		},
+		"max file size": {
+			opts:     []Option{WithMaxFileSize(1 << 20)},
+			expected: &LimitError{Limit: LimitFileSize, Max: 1 << 20, Path: "data/zeros", Files: 2, Bytes: 5},
+		},
+		"max files": {
+			opts:     []Option{WithMaxFiles(50)},
+			expected: &LimitError{Limit: LimitFiles, Max: 50, Path: "tiny/46", Files: 50, Bytes: 8<<20 + 5 + 46},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tempdir := t.TempDir()
+			err := Extract(img, tempdir, tc.opts...)
+			if tc.expected == nil {
+				if err != nil {
+					t.Fatalf("Failed to extract image: %v", err)
+				}
+				return
+			}
+
+			limitErr := &LimitError{}
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("Expected LimitError but got %v", err)
+			}
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("Expected error %v but got %v", ErrLimitExceeded, err)
+			}
+			if !reflect.DeepEqual(limitErr, tc.expected) {
+				t.Errorf("Expected error %+v but got %+v", tc.expected, limitErr)
+			}
+			if _, err := os.Stat(filepath.Join(tempdir, tc.expected.Path)); !os.IsNotExist(err) {
+				t.Errorf("Expected %s not to be extracted: %v", tc.expected.Path, err)
+			}
+		})
+	}
+}
+
+func TestSymlinkTraversal(t *testing.T) {
+	outside := t.TempDir()
+
+	// dirs map image paths to paths relative to the destination; existing symlinks are created before extraction.
+	testCases := map[string]struct {
+		entries  []testEntry
+		dirs     map[string]string
+		existing map[string]string
+		opts     []Option
+		expected map[string]string
+		err      error
+	}{
+		"parent directory entry": {
+			entries: []testEntry{
+				{header: tar.Header{Name: "bin/../../evil", Typeflag: tar.TypeReg}, content: "evil"},
+			},
+			dirs: map[string]string{"/": ""},
+			err:  ErrIllegalPath,
+		},
+		"absolute entry": {
+			entries: []testEntry{
+				{header: tar.Header{Name: "/bin/tool", Typeflag: tar.TypeReg}, content: "tool"},
+			},
+			dirs:     map[string]string{"/bin": "bin"},
+			expected: map[string]string{"bin/tool": "tool"},
+		},
+		"write through symlink from image": {
+			entries: []testEntry{
+				{header: tar.Header{Name: "links/", Typeflag: tar.TypeDir, Mode: 0755}},
+				{header: tar.Header{Name: "links/evil", Typeflag: tar.TypeSymlink, Linkname: outside}},
+				{header: tar.Header{Name: "files/evil/cron", Typeflag: tar.TypeReg}, content: "evil"},
+			},
+			dirs: map[string]string{"/links": "", "/files": ""},
+			err:  ErrIllegalPath,
+		},
+		"write through existing symlink": {
+			entries: []testEntry{
+				{header: tar.Header{Name: "bin/evil/cron", Typeflag: tar.TypeReg}, content: "evil"},
+			},
+			dirs:     map[string]string{"/bin": ""},
+			existing: map[string]string{"evil": outside},
+			err:      ErrIllegalPath,
+		},
+		"write to existing symlink without atomic writes": {
+			entries: []testEntry{
+				{header: tar.Header{Name: "bin/cron", Typeflag: tar.TypeReg}, content: "evil"},
+			},
+			dirs:     map[string]string{"/bin": ""},
+			existing: map[string]string{"cron": filepath.Join(outside, "cron")},
+			opts:     []Option{WithAtomic(false)},
+			err:      ErrIllegalPath,
+		},
+		"directory at existing symlink": {
+			entries: []testEntry{
+				{header: tar.Header{Name: "bin/evil/", Typeflag: tar.TypeDir, Mode: 0777}},
+			},
+			dirs:     map[string]string{"/bin": ""},
+			existing: map[string]string{"evil": outside},
+			opts:     []Option{WithPreservePermissions()},
+			err:      ErrIllegalPath,
+		},
+		"replace existing symlink with atomic writes": {
+			entries: []testEntry{
+				{header: tar.Header{Name: "bin/cron", Typeflag: tar.TypeReg}, content: "cron"},
+			},
+			dirs:     map[string]string{"/bin": ""},
+			existing: map[string]string{"cron": filepath.Join(outside, "cron")},
+			expected: map[string]string{"cron": "cron"},
+		},
+		"write through symlink within root": {
+			entries: []testEntry{
+				{header: tar.Header{Name: "links/", Typeflag: tar.TypeDir, Mode: 0755}},
+				{header: tar.Header{Name: "links/sbin", Typeflag: tar.TypeSymlink, Linkname: "lib"}},
+				{header: tar.Header{Name: "files/lib/", Typeflag: tar.TypeDir, Mode: 0755}},
+				{header: tar.Header{Name: "files/sbin/tool", Typeflag: tar.TypeReg}, content: "tool"},
+			},
+			dirs:     map[string]string{"/links": "", "/files": ""},
+			expected: map[string]string{"lib/tool": "tool"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tempdir := t.TempDir()
+			for link, target := range tc.existing {
+				if err := os.Symlink(target, filepath.Join(tempdir, link)); err != nil {
+					t.Fatalf("Failed to create symlink: %v", err)
+				}
+			}
+			dirs := map[string]string{}
+			for source, destination := range tc.dirs {
+				dirs[source] = filepath.Join(tempdir, destination)
+			}
+
+			img := newTestImage(t, tc.entries)
+			err := ExtractDirs(img, dirs, tc.opts...)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Expected error %v but got %v", tc.err, err)
+			}
+
+			if outsideEntries, _ := os.ReadDir(outside); len(outsideEntries) != 0 {
+				t.Errorf("Expected nothing to be written outside of the destination, found %d entries", len(outsideEntries))
+			}
+			for path, expected := range tc.expected {
+				path = filepath.Join(tempdir, path)
+				if content, err := os.ReadFile(path); err != nil || string(content) != expected {
+					t.Errorf("Expected content %q at %s but got %q: %v", expected, path, content, err)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractToWriter(t *testing.T) {
+	img := newTestImage(t,
+		[]testEntry{
+			{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755, Uid: 1000, Gid: 1000}, content: "busybox"},
+			{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox", Mode: 0755}},
+			{header: tar.Header{Name: "bin/ls", Typeflag: tar.TypeSymlink, Linkname: "busybox"}},
+			{header: tar.Header{Name: "etc/config.yaml", Typeflag: tar.TypeReg, Mode: 0600}, content: "config"},
+			{header: tar.Header{Name: "etc/debug.yaml", Typeflag: tar.TypeReg}, content: "debug"},
+			{header: tar.Header{Name: "usr/share/doc/README", Typeflag: tar.TypeReg}, content: "readme"},
+		},
+	)
+	opts := []Option{WithExclude("/etc/debug.yaml")}
+
+	buf := &bytes.Buffer{}
+	if err := ExtractToWriter(img, map[string]string{"/bin": "/out/bin", "/etc": "/out/etc"}, buf, opts...); err != nil {
+		t.Fatalf("Failed to write image to tar: %v", err)
+	}
+
+	names := map[string]*tar.Header{}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Failed to read tar: %v", err)
+		}
+		names[h.Name] = h
+	}
+	for _, name := range []string{"out/bin/", "out/bin/busybox", "out/bin/sh", "out/bin/ls", "out/etc/config.yaml"} {
+		if _, ok := names[name]; !ok {
+			t.Errorf("Expected %s in tar, got %v", name, names)
+		}
+	}
+	for _, name := range []string{"out/etc/debug.yaml", "out/usr/share/doc/README", "usr/share/doc/README"} {
+		if _, ok := names[name]; ok {
+			t.Errorf("Expected %s to not be in tar", name)
+		}
+	}
+	if h, ok := names["out/bin/busybox"]; ok && (h.Uid != 1000 || h.Gid != 1000) {
+		t.Errorf("Expected out/bin/busybox to be owned by 1000:1000, got %d:%d", h.Uid, h.Gid)
+	}
+	if h, ok := names["out/bin/sh"]; ok && (h.Typeflag != tar.TypeLink || h.Linkname != "out/bin/busybox") {
+		t.Errorf("Expected out/bin/sh to be a hardlink to out/bin/busybox, got %q to %q", h.Typeflag, h.Linkname)
+	}
+
+	// extracting the tar should produce the same tree as extracting the image directly
+	streamed := t.TempDir()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	tarImg, err := mutate.AppendLayers(empty.Image, layer)
+	if err != nil {
+		t.Fatalf("Failed to append layer: %v", err)
+	}
+	if err := ExtractDirs(tarImg, map[string]string{"/out": streamed}); err != nil {
+		t.Fatalf("Failed to extract tar: %v", err)
+	}
+
+	direct := t.TempDir()
+	dirs := map[string]string{"/bin": filepath.Join(direct, "bin"), "/etc": filepath.Join(direct, "etc")}
+	if err := ExtractDirs(img, dirs, opts...); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+
+	if got, want := readTree(t, streamed), readTree(t, direct); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected extracted tar to match direct extraction\ngot:  %v\nwant: %v", got, want)
+	}
+}
+
+// readTree returns a description of the type, mode, and content or link target of each path under a directory.
+func readTree(t *testing.T, root string) map[string]string {
+	tree := map[string]string{}
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		desc := info.Mode().String()
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(name)
+			if err != nil {
+				return err
+			}
+			desc += " -> " + target
+		case info.Mode().IsRegular():
+			content, err := os.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			desc += " " + string(content)
+		}
+		tree[filepath.ToSlash(rel)] = desc
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to walk %s: %v", root, err)
+	}
+	return tree
+}
+
+func TestStripComponents(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "README", Typeflag: tar.TypeReg}, content: "readme"},
+		{header: tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "usr/src/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "usr/src/app/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "usr/src/app/index.js", Typeflag: tar.TypeReg}, content: "index"},
+		{header: tar.Header{Name: "usr/src/app/dist/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "usr/src/app/dist/bundle.js", Typeflag: tar.TypeReg}, content: "bundle"},
+		{header: tar.Header{Name: "usr/src/app/dist/main.js", Typeflag: tar.TypeLink, Linkname: "usr/src/app/dist/bundle.js"}},
+		{header: tar.Header{Name: "usr/src/app/dist/assets/logo.svg", Typeflag: tar.TypeReg}, content: "logo"},
+	})
+
+	testCases := map[string]struct {
+		strip    int
+		dirs     func(string) map[string]string
+		expected map[string]string
+		missing  []string
+	}{
+		"root mapping": {
+			strip: 3,
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/": dir}
+			},
+			expected: map[string]string{
+				"index.js":             "index",
+				"dist/bundle.js":       "bundle",
+				"dist/main.js":         "bundle",
+				"dist/assets/logo.svg": "logo",
+			},
+			missing: []string{"README", "usr", "app"},
+		},
+		"source mapping": {
+			strip: 3,
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/dist": filepath.Join(dir, "www")}
+			},
+			expected: map[string]string{
+				"www/bundle.js":       "bundle",
+				"www/main.js":         "bundle",
+				"www/assets/logo.svg": "logo",
+			},
+			missing: []string{"index.js", "dist", "usr"},
+		},
+		"more components than any entry": {
+			strip: 6,
+			dirs: func(dir string) map[string]string {
+				return map[string]string{"/": dir}
+			},
+			missing: []string{"README", "usr", "logo.svg", "dist", "assets"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tempdir := t.TempDir()
+			if err := ExtractDirs(img, tc.dirs(tempdir), WithStripComponents(tc.strip)); err != nil {
+				t.Fatalf("Failed to extract image: %v", err)
+			}
+			for name, content := range tc.expected {
+				b, err := os.ReadFile(filepath.Join(tempdir, name))
+				if err != nil {
+					t.Errorf("Failed to read %s: %v", name, err)
+				} else if string(b) != content {
+					t.Errorf("Expected %s to contain %q, got %q", name, content, b)
+				}
+			}
+			for _, name := range tc.missing {
+				if _, err := os.Lstat(filepath.Join(tempdir, name)); !os.IsNotExist(err) {
+					t.Errorf("Expected %s to not exist, got %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	img := newTestImage(t,
+		[]testEntry{
+			{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, content: "busybox"},
+			{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox", Mode: 0755}},
+			{header: tar.Header{Name: "bin/ls", Typeflag: tar.TypeSymlink, Linkname: "busybox", Mode: 0777}},
+			{header: tar.Header{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666}},
+			{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, content: "old"},
+		},
+		[]testEntry{
+			{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg}, content: "localhost"},
+		},
+	)
+
+	entries, err := List(img)
+	if err != nil {
+		t.Fatalf("Failed to list image: %v", err)
+	}
+
+	expected := map[string]Entry{
+		"/bin":          {Source: "/bin", Type: TypeDir, Mode: os.ModeDir | 0755},
+		"/bin/busybox":  {Source: "/bin/busybox", Type: TypeFile, Size: 7, Mode: 0755},
+		"/bin/sh":       {Source: "/bin/sh", Type: TypeHardlink, Mode: 0755, Linkname: "/bin/busybox"},
+		"/bin/ls":       {Source: "/bin/ls", Type: TypeSymlink, Mode: os.ModeSymlink | 0777, Linkname: "busybox"},
+		"/dev/null":     {Source: "/dev/null", Type: TypeCharDevice, Mode: os.ModeDevice | os.ModeCharDevice | 0666},
+		"/etc/hostname": {Source: "/etc/hostname", Type: TypeFile, Size: 9, Mode: 0644},
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("Expected %d entries but got %d: %v", len(expected), len(entries), entries)
+	}
+	for _, entry := range entries {
+		if want, ok := expected[entry.Source]; !ok {
+			t.Errorf("Unexpected entry %+v", entry)
+		} else if entry != want {
+			t.Errorf("Expected entry %+v but got %+v", want, entry)
+		}
+	}
+}
+
+// slowLayer wraps a layer, delaying reads of the uncompressed content to simulate the time taken to
+// request the layer from a registry.
+type slowLayer struct {
+	v1.Layer
+	latency time.Duration
+}
+
+func (l *slowLayer) Uncompressed() (io.ReadCloser, error) {
+	time.Sleep(l.latency)
+	return l.Layer.Uncompressed()
+}
+
+func TestReadAhead(t *testing.T) {
+	content := make([]byte, 3*readAheadChunk+12345)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+
+	for _, size := range []int64{100, readAheadChunk, 2*readAheadChunk + 1, defaultReadAhead} {
+		t.Run(strconv.FormatInt(size, 10), func(t *testing.T) {
+			r := newReadAheadReader(io.NopCloser(bytes.NewReader(content)), size)
+			defer r.Close()
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("Failed to read: %v", err)
+			}
+			if !bytes.Equal(b, content) {
+				t.Errorf("Expected %d bytes of content to match, got %d bytes", len(content), len(b))
+			}
+		})
+	}
+
+	t.Run("error", func(t *testing.T) {
+		readErr := errors.New("read failed")
+		r := newReadAheadReader(io.NopCloser(&errReader{r: bytes.NewReader(content), err: readErr}), 100)
+		defer r.Close()
+		b, err := io.ReadAll(r)
+		if err != readErr {
+			t.Errorf("Expected error %v, got %v", readErr, err)
+		}
+		if !bytes.Equal(b, content) {
+			t.Errorf("Expected %d bytes of content before the error, got %d bytes", len(content), len(b))
+		}
+	})
+
+	t.Run("close", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		go pw.Write(content)
+		r := newReadAheadReader(pr, 100)
+		if _, err := r.Read(make([]byte, 10)); err != nil {
+			t.Fatalf("Failed to read: %v", err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("Failed to close: %v", err)
+		}
+		if _, err := io.ReadAll(r); err == nil {
+			t.Errorf("Expected error reading after close")
+		}
+		if err := r.Close(); err != nil {
+			t.Errorf("Expected second close to succeed, got %v", err)
+		}
+	})
+}
+
+func TestReadAheadExtract(t *testing.T) {
+	img := newTestImage(t,
+		[]testEntry{
+			{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, content: strings.Repeat("busybox", 100000)},
+			{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeLink, Linkname: "bin/busybox", Mode: 0755}},
+			{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644}, content: "old"},
+			{header: tar.Header{Name: "etc/removed", Typeflag: tar.TypeReg, Mode: 0644}, content: "removed"},
+			{header: tar.Header{Name: "var/cache/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "var/cache/old", Typeflag: tar.TypeReg, Mode: 0644}, content: "old"},
+		},
+		[]testEntry{
+			{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644}, content: "new"},
+			{header: tar.Header{Name: "etc/.wh.removed", Typeflag: tar.TypeReg, Mode: 0644}},
+			{header: tar.Header{Name: "var/cache/.wh..wh..opq", Typeflag: tar.TypeReg, Mode: 0644}},
+			{header: tar.Header{Name: "var/cache/new", Typeflag: tar.TypeReg, Mode: 0644}, content: "new"},
+		},
+	)
+
+	unbuffered := t.TempDir()
+	if err := Extract(img, unbuffered, WithReadAhead(0)); err != nil {
+		t.Fatalf("Failed to extract image without read-ahead: %v", err)
+	}
+	expected := readTree(t, unbuffered)
+
+	for _, size := range []int64{1024, readAheadChunk, defaultReadAhead} {
+		t.Run(strconv.FormatInt(size, 10), func(t *testing.T) {
+			tempdir := t.TempDir()
+			if err := Extract(img, tempdir, WithReadAhead(size)); err != nil {
+				t.Fatalf("Failed to extract image: %v", err)
+			}
+			if got := readTree(t, tempdir); !reflect.DeepEqual(got, expected) {
+				t.Errorf("Expected extraction with read-ahead to match extraction without\ngot:  %v\nwant: %v", got, expected)
+			}
+		})
+	}
+}
+
+func BenchmarkExtract(b *testing.B) {
+	// several layers pulled from a simulated registry, so that waiting for layers and writing files take comparable time
+	rng := rand.New(rand.NewSource(1))
+	contents := [][]testEntry{}
+	for i := 0; i < 4; i++ {
+		entries := []testEntry{}
+		for j := 0; j < 16; j++ {
+			content := make([]byte, 256<<10)
+			rng.Read(content)
+			entries = append(entries, testEntry{header: tar.Header{Name: fmt.Sprintf("layer%d/file%d", i, j), Typeflag: tar.TypeReg, Mode: 0644}, content: string(content)})
+		}
+		contents = append(contents, entries)
+	}
+	layers, err := newTestImage(b, contents...).Layers()
+	if err != nil {
+		b.Fatalf("Failed to get image layers: %v", err)
+	}
+	img := empty.Image
+	for _, layer := range layers {
+		if img, err = mutate.AppendLayers(img, &slowLayer{Layer: layer, latency: 10 * time.Millisecond}); err != nil {
+			b.Fatalf("Failed to append layer: %v", err)
+		}
+	}
+
+	// per-file logging would otherwise dominate the results
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	for _, size := range []int64{0, defaultReadAhead} {
+		b.Run("read-ahead="+strconv.FormatInt(size, 10), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := Extract(img, b.TempDir(), WithReadAhead(size)); err != nil {
+					b.Fatalf("Failed to extract image: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestCaseCollision(t *testing.T) {
+	testCases := map[string]struct {
+		layers [][]testEntry
+		opts   []Option
+		err    bool
+	}{
+		"files differing by case": {
+			layers: [][]testEntry{{
+				{header: tar.Header{Name: "bin/Foo", Typeflag: tar.TypeReg}, content: "Foo"},
+				{header: tar.Header{Name: "bin/foo", Typeflag: tar.TypeReg}, content: "foo"},
+			}},
+			opts: []Option{WithCaseInsensitive(true), WithCaseCollisionPolicy(CaseCollisionError)},
+			err:  true,
+		},
+		"parent directories differing by case": {
+			layers: [][]testEntry{{
+				{header: tar.Header{Name: "etc/App/config", Typeflag: tar.TypeReg}, content: "config"},
+				{header: tar.Header{Name: "etc/app/data", Typeflag: tar.TypeReg}, content: "data"},
+			}},
+			opts: []Option{WithCaseInsensitive(true), WithCaseCollisionPolicy(CaseCollisionError)},
+			err:  true,
+		},
+		"warn": {
+			layers: [][]testEntry{{
+				{header: tar.Header{Name: "bin/Foo", Typeflag: tar.TypeReg}, content: "Foo"},
+				{header: tar.Header{Name: "bin/foo", Typeflag: tar.TypeReg}, content: "foo"},
+			}},
+			opts: []Option{WithCaseInsensitive(true)},
+		},
+		"ignore": {
+			layers: [][]testEntry{{
+				{header: tar.Header{Name: "bin/Foo", Typeflag: tar.TypeReg}, content: "Foo"},
+				{header: tar.Header{Name: "bin/foo", Typeflag: tar.TypeReg}, content: "foo"},
+			}},
+			opts: []Option{WithCaseInsensitive(true), WithCaseCollisionPolicy(CaseCollisionIgnore)},
+		},
+		"same path in multiple layers": {
+			layers: [][]testEntry{
+				{
+					{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+					{header: tar.Header{Name: "bin/foo", Typeflag: tar.TypeReg}, content: "old"},
+				},
+				{
+					{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+					{header: tar.Header{Name: "bin/foo", Typeflag: tar.TypeReg}, content: "new"},
+					{header: tar.Header{Name: "bin/bar", Typeflag: tar.TypeReg}, content: "bar"},
+				},
+			},
+			opts: []Option{WithCaseInsensitive(true), WithCaseCollisionPolicy(CaseCollisionError)},
+		},
+		"dry run": {
+			layers: [][]testEntry{{
+				{header: tar.Header{Name: "bin/Foo", Typeflag: tar.TypeReg}, content: "Foo"},
+				{header: tar.Header{Name: "bin/foo", Typeflag: tar.TypeReg}, content: "foo"},
+			}},
+			opts: []Option{WithCaseInsensitive(true), WithCaseCollisionPolicy(CaseCollisionError), WithDryRun(func(Entry) {})},
+			err:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			img := newTestImage(t, tc.layers...)
+			err := Extract(img, t.TempDir(), tc.opts...)
+			if tc.err {
+				if !errors.Is(err, ErrCaseCollision) {
+					t.Errorf("Expected case collision error, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("Failed to extract image: %v", err)
+			}
+		})
+	}
+
+	t.Run("probed case-sensitive destination", func(t *testing.T) {
+		tempdir := t.TempDir()
+		if isCaseInsensitive(tempdir, logging.Discard()) {
+			t.Skip("temporary directory is on a case-insensitive filesystem")
+		}
+		img := newTestImage(t, []testEntry{
+			{header: tar.Header{Name: "bin/Foo", Typeflag: tar.TypeReg}, content: "Foo"},
+			{header: tar.Header{Name: "bin/foo", Typeflag: tar.TypeReg}, content: "foo"},
+		})
+		if err := Extract(img, filepath.Join(tempdir, "missing"), WithCaseCollisionPolicy(CaseCollisionError)); err != nil {
+			t.Errorf("Expected no error on a case-sensitive filesystem, got %v", err)
+		}
+		entries, err := os.ReadDir(tempdir)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", tempdir, err)
+		}
+		if len(entries) != 1 || entries[0].Name() != "missing" {
+			t.Errorf("Expected probe file to be removed, got %v", entries)
+		}
+	})
+}
+
+func TestLogger(t *testing.T) {
+	img := newTestImage(t,
+		[]testEntry{
+			{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, content: "busybox"},
+			{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "busybox"}},
+		},
+	)
+
+	output := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.SetOutput(output)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+
+	tempdir := t.TempDir()
+	if err := Extract(img, tempdir, WithLogger(logging.Logrus(logger.WithField("image", "docker.io/library/busybox:latest")))); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+
+	events := map[string]map[string]interface{}{}
+	decoder := json.NewDecoder(output)
+	for decoder.More() {
+		event := map[string]interface{}{}
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatalf("Failed to decode log output: %v", err)
+		}
+		events[event["msg"].(string)] = event
+	}
+
+	// numbers are decoded as float64
+	expected := map[string]map[string]interface{}{
+		"Creating directory": {
+			"path":        "bin",
+			"destination": filepath.Join(tempdir, "bin"),
+		},
+		"Extracting file": {
+			"path":        "bin/busybox",
+			"destination": filepath.Join(tempdir, "bin", "busybox"),
+			"bytes":       float64(len("busybox")),
+		},
+		"Creating symlink": {
+			"path":        "bin/sh",
+			"destination": filepath.Join(tempdir, "bin", "sh"),
+			"target":      "busybox",
+		},
+	}
+	for msg, fields := range expected {
+		event, ok := events[msg]
+		if !ok {
+			t.Errorf("Expected %q to be logged, got %v", msg, events)
+			continue
+		}
+		if event["image"] != "docker.io/library/busybox:latest" {
+			t.Errorf("Expected %q to be logged with image field, got %v", msg, event)
+		}
+		for key, value := range fields {
+			if event[key] != value {
+				t.Errorf("Expected %q to be logged with %s=%v, got %v", msg, key, value, event)
+			}
+		}
+	}
+}
+
+func TestLoggerInterface(t *testing.T) {
+	img := newTestImage(t,
+		[]testEntry{
+			{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "bin/busybox", Typeflag: tar.TypeReg, Mode: 0755}, content: "busybox"},
+		},
+	)
+
+	// nothing is logged to the standard logger when a logger is given
+	output := &bytes.Buffer{}
+	defer func(out io.Writer, level logrus.Level) {
+		logrus.SetOutput(out)
+		logrus.SetLevel(level)
+	}(logrus.StandardLogger().Out, logrus.GetLevel())
+	logrus.SetOutput(output)
+	logrus.SetLevel(logrus.DebugLevel)
+
+	recorder := &logging.Recorder{}
+	tempdir := t.TempDir()
+	if err := Extract(img, tempdir, WithLogger(recorder.WithFields(logging.Fields{"image": "busybox"}))); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+	if output.Len() > 0 {
+		t.Errorf("Expected nothing to be logged to the standard logger, got %s", output)
+	}
+
+	entry, ok := recorder.Find(logging.LevelInfo, "Extracting file")
+	if !ok {
+		t.Fatalf("Expected file extraction to be logged, got %v", recorder.Entries())
+	}
+	expected := logging.Fields{"image": "busybox", "path": "bin/busybox", "destination": filepath.Join(tempdir, "bin", "busybox"), "bytes": int64(len("busybox"))}
+	if !reflect.DeepEqual(entry.Fields, expected) {
+		t.Errorf("Expected file extraction to be logged with %v, got %v", expected, entry.Fields)
+	}
+}
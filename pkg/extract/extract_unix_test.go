@@ -0,0 +1,236 @@
+//go:build unix
+
+package extract
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPreserveOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("preserving ownership requires root")
+	}
+
+	tempdir := t.TempDir()
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 0, Gid: 0}},
+		{header: tar.Header{Name: "etc/shadow", Typeflag: tar.TypeReg, Mode: 0640, Uid: 0, Gid: 42}, content: "root:*::0:::::\n"},
+		{header: tar.Header{Name: "home/user/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 1000, Gid: 1000}},
+		{header: tar.Header{Name: "home/user/.profile", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1001}, content: "# profile\n"},
+		{header: tar.Header{Name: "home/user/profile", Typeflag: tar.TypeSymlink, Linkname: ".profile", Uid: 1002, Gid: 1003}},
+	})
+
+	if err := Extract(img, tempdir, WithPreserveOwnership(true)); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+
+	expected := map[string][2]uint32{
+		"etc":                {0, 0},
+		"etc/shadow":         {0, 42},
+		"home/user":          {1000, 1000},
+		"home/user/.profile": {1000, 1001},
+		"home/user/profile":  {1002, 1003},
+	}
+	for path, ids := range expected {
+		fi, err := os.Lstat(filepath.Join(tempdir, path))
+		if err != nil {
+			t.Errorf("Failed to stat %s: %v", path, err)
+			continue
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Uid != ids[0] || st.Gid != ids[1] {
+			t.Errorf("Expected ownership %d:%d for %s but got %d:%d", ids[0], ids[1], path, st.Uid, st.Gid)
+		}
+	}
+}
+
+func TestChown(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership requires root")
+	}
+
+	tempdir := t.TempDir()
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755, Uid: 0, Gid: 0}},
+		{header: tar.Header{Name: "etc/config.yaml", Typeflag: tar.TypeReg, Mode: 0640, Uid: 0, Gid: 42}, content: "config"},
+		{header: tar.Header{Name: "var/lib/app/data/state", Typeflag: tar.TypeReg, Mode: 0644, Uid: 1000, Gid: 1000}, content: "state"},
+		{header: tar.Header{Name: "var/lib/app/current", Typeflag: tar.TypeSymlink, Linkname: "data/state", Uid: 0, Gid: 0}},
+	})
+
+	if err := Extract(img, filepath.Join(tempdir, "root"), WithChown(2000, 2001)); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+
+	// parent directories created implicitly are also owned by the new owner
+	for _, path := range []string{"root", "root/etc", "root/etc/config.yaml", "root/var", "root/var/lib", "root/var/lib/app", "root/var/lib/app/data", "root/var/lib/app/data/state", "root/var/lib/app/current"} {
+		fi, err := os.Lstat(filepath.Join(tempdir, path))
+		if err != nil {
+			t.Errorf("Failed to stat %s: %v", path, err)
+			continue
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if st.Uid != 2000 || st.Gid != 2001 {
+			t.Errorf("Expected ownership 2000:2001 for %s but got %d:%d", path, st.Uid, st.Gid)
+		}
+	}
+}
+
+func TestParseOwner(t *testing.T) {
+	testCases := map[string]struct {
+		owner string
+		uid   int
+		gid   int
+		err   bool
+	}{
+		"numeric":       {owner: "1000:1001", uid: 1000, gid: 1001},
+		"names":         {owner: "root:root", uid: 0, gid: 0},
+		"name and id":   {owner: "root:42", uid: 0, gid: 42},
+		"missing group": {owner: "1000", err: true},
+		"empty group":   {owner: "1000:", err: true},
+		"empty user":    {owner: ":1000", err: true},
+		"negative id":   {owner: "-1:1000", err: true},
+		"unknown user":  {owner: "wharfie-no-such-user:1000", err: true},
+		"unknown group": {owner: "1000:wharfie-no-such-group", err: true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			uid, gid, err := ParseOwner(tc.owner)
+			if tc.err {
+				if err == nil {
+					t.Errorf("Expected error for %q but got %d:%d", tc.owner, uid, gid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse owner %q: %v", tc.owner, err)
+			}
+			if uid != tc.uid || gid != tc.gid {
+				t.Errorf("Expected %d:%d for %q but got %d:%d", tc.uid, tc.gid, tc.owner, uid, gid)
+			}
+		})
+	}
+}
+
+func TestPreservePermissions(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "bin/mount", Typeflag: tar.TypeReg, Mode: 04755}, content: "mount"},
+		{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0666}, content: "hello"},
+		{header: tar.Header{Name: "root/", Typeflag: tar.TypeDir, Mode: 0700}},
+		{header: tar.Header{Name: "tmp/", Typeflag: tar.TypeDir, Mode: 01777}},
+		{header: tar.Header{Name: "var/mail/", Typeflag: tar.TypeDir, Mode: 02775}},
+	})
+
+	testCases := map[string]struct {
+		opts     []Option
+		expected map[string]os.FileMode
+	}{
+		"default": {
+			expected: map[string]os.FileMode{
+				"bin/mount": 0755,
+				"etc/motd":  0644,
+				"root":      os.ModeDir | 0755,
+				"tmp":       os.ModeDir | 0755,
+				"var/mail":  os.ModeDir | 0755,
+			},
+		},
+		"preserve permissions": {
+			opts: []Option{WithPreservePermissions()},
+			expected: map[string]os.FileMode{
+				"bin/mount": 0755,
+				"etc/motd":  0666,
+				"root":      os.ModeDir | 0700,
+				"tmp":       os.ModeDir | 0777,
+				"var/mail":  os.ModeDir | 0775,
+			},
+		},
+		"preserve special bits": {
+			opts: []Option{WithPreserveSpecialBits(true)},
+			expected: map[string]os.FileMode{
+				"bin/mount": os.ModeSetuid | 0755,
+				"etc/motd":  0644,
+				"root":      os.ModeDir | 0755,
+				"tmp":       os.ModeDir | os.ModeSticky | 0755,
+				"var/mail":  os.ModeDir | os.ModeSetgid | 0755,
+			},
+		},
+		"preserve permissions and special bits": {
+			opts: []Option{WithPreservePermissions(), WithPreserveSpecialBits(true)},
+			expected: map[string]os.FileMode{
+				"bin/mount": os.ModeSetuid | 0755,
+				"etc/motd":  0666,
+				"root":      os.ModeDir | 0700,
+				"tmp":       os.ModeDir | os.ModeSticky | 0777,
+				"var/mail":  os.ModeDir | os.ModeSetgid | 0775,
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tempdir := t.TempDir()
+			if err := Extract(img, tempdir, tc.opts...); err != nil {
+				t.Fatalf("Failed to extract image: %v", err)
+			}
+			for path, mode := range tc.expected {
+				fi, err := os.Stat(filepath.Join(tempdir, path))
+				if err != nil {
+					t.Errorf("Failed to stat %s: %v", path, err)
+					continue
+				}
+				if fi.Mode() != mode {
+					t.Errorf("Expected mode %v for %s but got %v", mode, path, fi.Mode())
+				}
+			}
+		})
+	}
+}
+
+func TestPreservePermissionsReadOnlyDir(t *testing.T) {
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "ro/", Typeflag: tar.TypeDir, Mode: 0555}},
+		{header: tar.Header{Name: "ro/sub/", Typeflag: tar.TypeDir, Mode: 0500}},
+		{header: tar.Header{Name: "ro/sub/file", Typeflag: tar.TypeReg, Mode: 0444}, content: "file"},
+		{header: tar.Header{Name: "ro/other", Typeflag: tar.TypeReg, Mode: 0644}, content: "other"},
+	})
+
+	tempdir := t.TempDir()
+	// read-only directories cannot be removed by a user other than root until they are made writable again
+	t.Cleanup(func() {
+		filepath.Walk(tempdir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.IsDir() {
+				os.Chmod(path, 0755)
+			}
+			return nil
+		})
+	})
+
+	// children are extracted into the directories before their modes are applied
+	if err := Extract(img, tempdir, WithPreservePermissions()); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+	for path, mode := range map[string]os.FileMode{
+		"ro":          os.ModeDir | 0555,
+		"ro/sub":      os.ModeDir | 0500,
+		"ro/sub/file": 0444,
+		"ro/other":    0644,
+	} {
+		fi, err := os.Stat(filepath.Join(tempdir, path))
+		if err != nil {
+			t.Errorf("Failed to stat %s: %v", path, err)
+			continue
+		}
+		if fi.Mode() != mode {
+			t.Errorf("Expected mode %v for %s but got %v", mode, path, fi.Mode())
+		}
+	}
+	if content, err := os.ReadFile(filepath.Join(tempdir, "ro", "sub", "file")); err != nil || string(content) != "file" {
+		t.Errorf("Expected content %q but got %q: %v", "file", content, err)
+	}
+}
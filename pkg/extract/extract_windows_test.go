@@ -0,0 +1,68 @@
+package extract
+
+import (
+	"archive/tar"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLongPath(t *testing.T) {
+	testCases := map[string]string{
+		`C:\bin`:                   `\\?\C:\bin`,
+		`C:\bin\..\etc\`:           `\\?\C:\etc`,
+		`\\server\share\dir`:       `\\?\UNC\server\share\dir`,
+		`\\?\C:\bin`:               `\\?\C:\bin`,
+		`\\?\UNC\server\share\dir`: `\\?\UNC\server\share\dir`,
+		`bin\busybox`:              `bin\busybox`,
+	}
+	for in, expected := range testCases {
+		if out := longPath(in); out != expected {
+			t.Errorf("Expected %q for %q but got %q", expected, in, out)
+		}
+	}
+}
+
+func TestExtractLongPath(t *testing.T) {
+	// build a destination well over MAX_PATH characters
+	tempdir := t.TempDir()
+	destination := tempdir
+	for len(destination) < 300 {
+		destination = filepath.Join(destination, strings.Repeat("d", 50))
+	}
+
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "node_modules/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "node_modules/pkg/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "node_modules/pkg/index.js", Typeflag: tar.TypeReg, Mode: 0644}, content: "index"},
+		{header: tar.Header{Name: "node_modules/pkg/main.js", Typeflag: tar.TypeLink, Linkname: "node_modules/pkg/index.js"}},
+	})
+
+	for name, atomic := range map[string]bool{"atomic": true, "non-atomic": false} {
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join(destination, name)
+			entries, err := ExtractDirsWithResult(context.Background(), img, map[string]string{"/": dir}, WithAtomic(atomic))
+			if err != nil {
+				t.Fatalf("Failed to extract image to long path: %v", err)
+			}
+
+			for _, file := range []string{"index.js", "main.js"} {
+				content, err := os.ReadFile(longPath(filepath.Join(dir, "node_modules", "pkg", file)))
+				if err != nil {
+					t.Errorf("Failed to read %s: %v", file, err)
+				} else if string(content) != "index" {
+					t.Errorf("Expected %s to contain %q, got %q", file, "index", content)
+				}
+			}
+
+			// destinations are reported in their unprefixed form
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Destination, `\\?\`) || !isWithin(dir, entry.Destination) {
+					t.Errorf("Expected unprefixed destination within %s, got %s", dir, entry.Destination)
+				}
+			}
+		})
+	}
+}
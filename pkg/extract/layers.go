@@ -0,0 +1,39 @@
+package extract
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/pkg/errors"
+)
+
+// ExtractLayers extracts content from the layers of the image selected by the selector function, as described
+// for ExtractDirs. The selector is called with the index and content of each layer, from the bottom of the image
+// up. Whiteouts within the selected layers are honored; files in unselected layers are not extracted.
+func ExtractLayers(img v1.Image, selector func(int, v1.Layer) bool, dirs map[string]string, opts ...Option) error {
+	selected, err := SelectLayers(img, selector)
+	if err != nil {
+		return err
+	}
+	return ExtractDirs(selected, dirs, opts...)
+}
+
+// SelectLayers returns an image containing only the layers of the image selected by the selector function.
+// An error is returned if no layers are selected.
+func SelectLayers(img v1.Image, selector func(int, v1.Layer) bool) (v1.Image, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := []v1.Layer{}
+	for i, layer := range layers {
+		if selector(i, layer) {
+			selected = append(selected, layer)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, errors.New("no layers selected")
+	}
+	return mutate.AppendLayers(empty.Image, selected...)
+}
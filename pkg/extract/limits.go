@@ -0,0 +1,64 @@
+package extract
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLimitExceeded is the cause of all LimitErrors.
+var ErrLimitExceeded = errors.New("extraction limit exceeded")
+
+// Limits that may be exceeded during extraction
+const (
+	LimitSize     = "size"
+	LimitFiles    = "files"
+	LimitFileSize = "file size"
+)
+
+// LimitError is returned when extraction would exceed a configured limit. It identifies the limit that
+// was hit, the entry that would have exceeded it, and how much had been extracted up to that point.
+type LimitError struct {
+	Limit string
+	Max   int64
+	Path  string
+	Files int
+	Bytes int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%v: extracting %s would exceed the maximum %s of %d, after extracting %d files totalling %d bytes", ErrLimitExceeded, e.Path, e.Limit, e.Max, e.Files, e.Bytes)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// limiter tracks the number of entries and bytes extracted, and enforces the configured limits.
+// A limit of zero is unlimited.
+type limiter struct {
+	maxSize     int64
+	maxFiles    int
+	maxFileSize int64
+	files       int
+	bytes       int64
+}
+
+// add records an entry of the given size, returning a LimitError if any limit would be exceeded.
+// The entry is not recorded if a limit would be exceeded.
+func (l *limiter) add(path string, size int64) error {
+	err := &LimitError{Path: path, Files: l.files, Bytes: l.bytes}
+	switch {
+	case l.maxFileSize > 0 && size > l.maxFileSize:
+		err.Limit, err.Max = LimitFileSize, l.maxFileSize
+	case l.maxSize > 0 && l.bytes+size > l.maxSize:
+		err.Limit, err.Max = LimitSize, l.maxSize
+	case l.maxFiles > 0 && l.files+1 > l.maxFiles:
+		err.Limit, err.Max = LimitFiles, int64(l.maxFiles)
+	default:
+		l.files++
+		l.bytes += size
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,48 @@
+package extract
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+)
+
+// List returns the entries in the flattened filesystem of the image, without extracting anything.
+// Source is set to the absolute path of each entry within the image, and Mode includes the file type.
+// Entries of types that are not otherwise handled have type TypeOther.
+func List(img v1.Image) ([]Entry, error) {
+	reader := mutate.Extract(img)
+	defer reader.Close()
+
+	entries := []Entry{}
+	t := tar.NewReader(reader)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		entry := Entry{
+			Source:   path.Clean(imagePath(h.Name)),
+			Type:     entryType(h.Typeflag),
+			Mode:     h.FileInfo().Mode(),
+			Linkname: h.Linkname,
+		}
+		if entry.Type == "" {
+			entry.Type = TypeOther
+		}
+		switch h.Typeflag {
+		case tar.TypeReg:
+			entry.Size = h.Size
+		case tar.TypeLink:
+			// hardlink targets are paths within the image, like the entry's own name
+			entry.Linkname = path.Clean(imagePath(h.Linkname))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package extract
+
+// longPath returns the path unmodified; extended-length paths are only required on Windows.
+func longPath(path string) string {
+	return path
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package extract
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// longPath returns the extended-length form of an absolute path, so that it can be used with filesystem APIs
+// when it is longer than MAX_PATH. UNC paths such as \\server\share\dir are converted to \\?\UNC\server\share\dir.
+// Relative paths, and paths that are already in extended-length form, are returned unmodified.
+// Paths are only converted for use with the filesystem; mapping and path checks use the unprefixed form.
+func longPath(path string) string {
+	if strings.HasPrefix(path, `\\?\`) || !filepath.IsAbs(path) {
+		return path
+	}
+	path = filepath.Clean(path)
+	if strings.HasPrefix(path, `\\`) {
+		return `\\?\UNC\` + path[2:]
+	}
+	return `\\?\` + path
+}
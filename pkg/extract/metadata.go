@@ -0,0 +1,72 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/logging"
+)
+
+const (
+	// ManifestFile is the name of the file that the image manifest is written to by WithImageMetadata.
+	ManifestFile = "manifest.json"
+	// ConfigFile is the name of the file that the image config file is written to by WithImageMetadata.
+	ConfigFile = "config.json"
+	// ImageFile is the name of the file that the ImageMetadata is written to by WithImageMetadata.
+	ImageFile = "image.json"
+)
+
+// ImageMetadata identifies the image that extracted content was produced from.
+type ImageMetadata struct {
+	// Reference is the reference the image was requested by, before any registry rewrites.
+	Reference string `json:"reference,omitempty"`
+	// Digest is the digest of the image manifest.
+	Digest string `json:"digest"`
+	// ResolvedReference is the requested repository, pinned to the manifest digest.
+	ResolvedReference string `json:"resolvedReference,omitempty"`
+}
+
+// writeImageMetadata writes the image manifest, config file, and ImageMetadata to the given directory.
+// The manifest and config file are written as retrieved from the image, so that their digests still match.
+// Each file is written atomically, so that an interrupted write does not leave truncated metadata behind.
+func writeImageMetadata(img v1.Image, dir string, ref name.Reference, logger logging.Logger) error {
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	manifest, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	config, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+
+	metadata := ImageMetadata{Digest: digest.String()}
+	if ref != nil {
+		metadata.Reference = ref.Name()
+		metadata.ResolvedReference = ref.Context().Digest(digest.String()).Name()
+	}
+	image, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(longPath(dir), 0755); err != nil {
+		return err
+	}
+
+	logger.Infof("Writing image metadata to %s", dir)
+	for file, data := range map[string][]byte{ManifestFile: manifest, ConfigFile: config, ImageFile: image} {
+		if err := writeFileAtomic(filepath.Join(dir, file), bytes.NewReader(data), 0644); err != nil {
+			return errors.Wrapf(err, "failed to write %s", file)
+		}
+	}
+	return nil
+}
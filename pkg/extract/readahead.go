@@ -0,0 +1,109 @@
+package extract
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// defaultReadAhead is the default amount of image content buffered ahead of extraction.
+	defaultReadAhead = 16 << 20
+	// readAheadChunk is the size of each buffered read.
+	readAheadChunk = 256 << 10
+)
+
+// readAheadReader reads from a ReadCloser in a separate goroutine, buffering up to a fixed amount of content
+// ahead of the consumer. This allows layer download and decompression to proceed while extracted files are
+// being written to disk, instead of alternating between the two.
+type readAheadReader struct {
+	r      io.ReadCloser
+	chunks chan []byte
+	free   chan []byte
+	done   chan struct{}
+	once   sync.Once
+	buf    []byte
+	chunk  []byte
+	err    error
+}
+
+// newReadAheadReader returns a reader that buffers up to size bytes read from r. If size is zero, r is
+// returned unmodified.
+func newReadAheadReader(r io.ReadCloser, size int64) io.ReadCloser {
+	if size <= 0 {
+		return r
+	}
+	chunkSize := int64(readAheadChunk)
+	if size < chunkSize {
+		chunkSize = size
+	}
+	count := int(size / chunkSize)
+	ra := &readAheadReader{
+		r:      r,
+		chunks: make(chan []byte, count-1),
+		free:   make(chan []byte, count),
+		done:   make(chan struct{}),
+	}
+	go ra.fill(int(chunkSize))
+	return ra
+}
+
+// fill reads chunks from the underlying reader until it returns an error or the reader is closed. The error
+// is stored before the chunk channel is closed, so that it is visible to Read once the channel is drained.
+func (ra *readAheadReader) fill(chunkSize int) {
+	defer close(ra.chunks)
+	for {
+		var buf []byte
+		select {
+		case buf = <-ra.free:
+		default:
+			buf = make([]byte, chunkSize)
+		}
+		n, err := io.ReadFull(ra.r, buf)
+		if n > 0 {
+			select {
+			case ra.chunks <- buf[:n]:
+			case <-ra.done:
+				ra.err = io.ErrClosedPipe
+				return
+			}
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if err != nil {
+			ra.err = err
+			return
+		}
+	}
+}
+
+func (ra *readAheadReader) Read(p []byte) (int, error) {
+	if len(ra.buf) == 0 {
+		if ra.chunk != nil {
+			select {
+			case ra.free <- ra.chunk[:cap(ra.chunk)]:
+			default:
+			}
+			ra.chunk = nil
+		}
+		chunk, ok := <-ra.chunks
+		if !ok {
+			return 0, ra.err
+		}
+		ra.chunk, ra.buf = chunk, chunk
+	}
+	n := copy(p, ra.buf)
+	ra.buf = ra.buf[n:]
+	return n, nil
+}
+
+// Close closes the underlying reader, and stops the goroutine filling the buffer. It is safe to call
+// more than once, and concurrently with Read.
+func (ra *readAheadReader) Close() error {
+	var err error
+	ra.once.Do(func() {
+		close(ra.done)
+		err = ra.r.Close()
+	})
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package extract
+
+import "os"
+
+// replaceFile renames the source file over the destination.
+func replaceFile(source, destination string) error {
+	return os.Rename(source, destination)
+}
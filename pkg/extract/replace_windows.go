@@ -0,0 +1,25 @@
+//go:build windows
+
+package extract
+
+import (
+	"os"
+	"time"
+)
+
+// replaceFile renames the source file over the destination. Renaming over an existing file fails on
+// Windows if the file is in use, so the destination is removed and the rename retried.
+func replaceFile(source, destination string) error {
+	destination = longPath(destination)
+	var err error
+	for i := 0; i < 5; i++ {
+		if err = os.Rename(source, destination); err == nil {
+			return nil
+		}
+		if rerr := os.Remove(destination); rerr != nil && !os.IsNotExist(rerr) {
+			err = rerr
+		}
+		time.Sleep(time.Duration(i+1) * 100 * time.Millisecond)
+	}
+	return err
+}
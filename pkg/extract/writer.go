@@ -0,0 +1,152 @@
+package extract
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/pkg/errors"
+)
+
+// ExtractToWriter applies the same mapping and exclusion logic as ExtractDirs, but instead of creating files,
+// writes a tar archive to the writer. Entries are named for their destination, relative to the filesystem root,
+// so that the archive can be extracted with `tar -C / -x`. Header metadata such as mode and ownership is
+// preserved from the image, unless ownership is overridden with WithChown. Hardlinks are written after all
+// other entries, and only if their target was also written to the archive.
+func ExtractToWriter(img v1.Image, dirs map[string]string, w io.Writer, opts ...Option) error {
+	return ExtractToWriterContext(context.Background(), img, dirs, w, opts...)
+}
+
+// ExtractToWriterContext writes a tar archive of the image content to the writer, as described for ExtractToWriter.
+// If the context is cancelled, reading the image is aborted and the context error is returned.
+func ExtractToWriterContext(ctx context.Context, img v1.Image, dirs map[string]string, w io.Writer, opts ...Option) error {
+	opt, err := makeOptions(opts...)
+	if err != nil {
+		return err
+	}
+
+	cleanDirs, err := cleanExtractDirs(dirs)
+	if err != nil {
+		return err
+	}
+
+	reader := newContextReader(ctx, newReadAheadReader(mutate.Extract(img), opt.readAhead))
+	defer reader.Close()
+
+	limits := &limiter{maxSize: opt.maxSize, maxFiles: opt.maxFiles, maxFileSize: opt.maxFileSize}
+	// names written to the archive, keyed by the destination path
+	written := map[string]string{}
+	links := []*tar.Header{}
+
+	tw := tar.NewWriter(w)
+	t := tar.NewReader(reader)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if !opt.strip(h) {
+			opt.log().Debugf("Skipping file %s with too few path components", h.Name)
+			continue
+		}
+
+		if opt.excluded(h.Name) {
+			opt.log().Debugf("Excluding file %s", h.Name)
+			continue
+		}
+
+		destination, err := findPath(cleanDirs, h.Name)
+		if err != nil {
+			return errors.Wrapf(err, "unable to extract file %s", h.Name)
+		}
+		if destination == "" {
+			opt.log().Debugf("Skipping file %s", h.Name)
+			continue
+		}
+		if h.Typeflag != tar.TypeDir {
+			destination = fileDestination(cleanDirs, h.Name, destination)
+		}
+
+		out := *h
+		out.Name = archiveName(destination)
+		if opt.chownSet {
+			out.Uid, out.Gid = opt.chownUID, opt.chownGID
+			out.Uname, out.Gname = "", ""
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			out.Name += "/"
+		case tar.TypeReg:
+		case tar.TypeSymlink:
+			linkname, err := opt.symlinkTarget(cleanDirs, h, destination)
+			if err != nil {
+				return errors.Wrapf(err, "unable to create symlink %s to %s", destination, h.Linkname)
+			}
+			out.Linkname = filepath.ToSlash(linkname)
+		case tar.TypeLink:
+			linkname, err := findPath(cleanDirs, h.Linkname)
+			if err != nil {
+				return errors.Wrapf(err, "unable to find target for hardlink %s", destination)
+			}
+			out.Linkname = linkname
+			links = append(links, &out)
+			continue
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if !opt.devices {
+				opt.log().Debugf("Skipping %s %s: device extraction is not enabled", entryType(h.Typeflag), h.Name)
+				continue
+			}
+		default:
+			opt.log().Warnf("Unhandled Typeflag %d for %s", h.Typeflag, h.Name)
+			continue
+		}
+
+		if err := limits.add(h.Name, h.Size); err != nil {
+			return err
+		}
+		opt.log().Debugf("Writing %s to archive as %s", h.Name, out.Name)
+		if err := tw.WriteHeader(&out); err != nil {
+			return err
+		}
+		if h.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(tw, t); err != nil {
+				return err
+			}
+		}
+		written[destination] = out.Name
+	}
+
+	for _, link := range links {
+		target, ok := written[link.Linkname]
+		if !ok {
+			opt.log().Warnf("Skipping hardlink %s, target %s was not written", link.Name, link.Linkname)
+			continue
+		}
+		if err := limits.add(link.Name, 0); err != nil {
+			return err
+		}
+		link.Linkname = target
+		if err := tw.WriteHeader(link); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// archiveName returns the name of an entry in the output archive for a destination path on the local filesystem.
+func archiveName(destination string) string {
+	name := filepath.ToSlash(destination)
+	if volume := filepath.VolumeName(destination); volume != "" {
+		name = strings.TrimPrefix(name, filepath.ToSlash(volume))
+	}
+	return strings.TrimPrefix(path.Clean(name), "/")
+}
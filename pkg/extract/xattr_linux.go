@@ -0,0 +1,21 @@
+//go:build linux
+
+package extract
+
+import "golang.org/x/sys/unix"
+
+// canSetXattrs returns true if extended attributes can be set on this platform.
+func canSetXattrs() bool {
+	return true
+}
+
+// setXattr sets an extended attribute on the path, without following symlinks.
+func setXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
+
+// isXattrUnsupported returns true if the error indicates that the attribute cannot be set because the
+// filesystem does not support it, or the current user is not permitted to set it.
+func isXattrUnsupported(err error) bool {
+	return err == unix.ENOTSUP || err == unix.EPERM
+}
@@ -0,0 +1,72 @@
+package extract
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPreserveXattrs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("preserving extended attributes requires root")
+	}
+
+	// vfs_cap_data revision 2 with cap_net_raw permitted
+	capability := string([]byte{
+		0x01, 0x00, 0x00, 0x02,
+		0x00, 0x20, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00,
+	})
+	xattrs := map[string]string{
+		"user.wharfie":        "test",
+		"security.capability": capability,
+	}
+	records := map[string]string{}
+	for name, value := range xattrs {
+		records[xattrPAXPrefix+name] = value
+	}
+
+	img := newTestImage(t, []testEntry{
+		{header: tar.Header{Name: "bin/ping", Typeflag: tar.TypeReg, Mode: 0755, Format: tar.FormatPAX, PAXRecords: records}, content: "ping"},
+	})
+
+	tempdir := t.TempDir()
+	if err := unix.Lsetxattr(tempdir, "user.wharfie", []byte("test"), 0); err == unix.ENOTSUP {
+		t.Skipf("filesystem does not support user extended attributes: %v", err)
+	}
+
+	if err := Extract(img, tempdir, WithPreserveOwnership(true), WithPreserveXattrs(true)); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+
+	name := filepath.Join(tempdir, "bin", "ping")
+	for attr, value := range xattrs {
+		buf := make([]byte, 64)
+		n, err := unix.Lgetxattr(name, attr, buf)
+		if err != nil {
+			t.Errorf("Failed to get extended attribute %s: %v", attr, err)
+			continue
+		}
+		if !bytes.Equal(buf[:n], []byte(value)) {
+			t.Errorf("Expected extended attribute %s to be %x, got %x", attr, value, buf[:n])
+		}
+	}
+
+	// without the option, no attributes are set
+	tempdir = t.TempDir()
+	if err := Extract(img, tempdir); err != nil {
+		t.Fatalf("Failed to extract image: %v", err)
+	}
+	name = filepath.Join(tempdir, "bin", "ping")
+	for attr := range xattrs {
+		if _, err := unix.Lgetxattr(name, attr, make([]byte, 64)); err != unix.ENODATA {
+			t.Errorf("Expected extended attribute %s to not be set, got %v", attr, err)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+
+package extract
+
+import "github.com/pkg/errors"
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+// canSetXattrs returns true if extended attributes can be set on this platform.
+func canSetXattrs() bool {
+	return false
+}
+
+// setXattr is not supported on this platform.
+func setXattr(path, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+// isXattrUnsupported returns true if the error indicates that the attribute cannot be set.
+func isXattrUnsupported(err error) bool {
+	return err == errXattrUnsupported
+}
@@ -0,0 +1,301 @@
+package layercache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// manifestsDir is the directory in the cache that the manifests and configs of images are stored in, named by
+	// their digest as layers are.
+	manifestsDir = "manifests"
+	// refsDir is the directory in the cache that records the manifest that each image reference was last pulled as.
+	refsDir = "refs"
+)
+
+// reference records the manifest that an image reference was last pulled as.
+type reference struct {
+	Reference string `json:"reference"`
+	Digest    string `json:"digest"`
+}
+
+// MissingError lists the blobs of an image that are not in the cache.
+type MissingError struct {
+	Reference string
+	Digests   []string
+}
+
+func (e *MissingError) Error() string {
+	return fmt.Sprintf("layer cache is missing %d blobs of %s: %s", len(e.Digests), e.Reference, strings.Join(e.Digests, ", "))
+}
+
+// PutImage stores the manifest and config of the image in the cache, alongside its layers, so that the image can be
+// exported from the cache. If the reference is not nil, it is recorded as the image's reference. Manifests, configs,
+// and references are not listed as blobs, but are pruned with them.
+func PutImage(dir string, ref name.Reference, img v1.Image) error {
+	manifest, err := img.RawManifest()
+	if err != nil {
+		return err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return err
+	}
+	config, err := img.RawConfigFile()
+	if err != nil {
+		return err
+	}
+	configName, err := img.ConfigName()
+	if err != nil {
+		return err
+	}
+	if err := writeBlob(filepath.Join(dir, manifestsDir), digest, manifest); err != nil {
+		return errors.Wrapf(err, "failed to cache manifest %s", digest)
+	}
+	if err := writeBlob(filepath.Join(dir, manifestsDir), configName, config); err != nil {
+		return errors.Wrapf(err, "failed to cache config %s", configName)
+	}
+	if ref == nil {
+		return nil
+	}
+
+	b, err := json.Marshal(reference{Reference: ref.Name(), Digest: digest.String()})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(dir, refsDir), refPath(dir, ref), b); err != nil {
+		return errors.Wrapf(err, "failed to record image %s in cache", ref.Name())
+	}
+	return nil
+}
+
+// Image returns the image for the reference from the manifest, config, and layers stored in the cache. Tags are looked
+// up in the references recorded by PutImage. If any of the blobs of the image are not in the cache, or do not match
+// their digest, a *MissingError lists them all. Layers are stored uncompressed, so the layers of the image are
+// compressed again, and the digest of the image differs from the one it was pulled with.
+func Image(dir string, ref name.Reference) (v1.Image, error) {
+	digest, err := Digest(dir, ref)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readBlob(filepath.Join(dir, manifestsDir), digest)
+	if err != nil {
+		return nil, &MissingError{Reference: ref.Name(), Digests: []string{digest.String()}}
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse cached manifest %s", digest)
+	}
+	if manifest.MediaType.IsIndex() {
+		return nil, fmt.Errorf("cached manifest %s of %s is an image index, not an image", digest, ref.Name())
+	}
+	config, err := readBlob(filepath.Join(dir, manifestsDir), manifest.Config.Digest)
+	if err != nil {
+		return nil, &MissingError{Reference: ref.Name(), Digests: []string{manifest.Config.Digest.String()}}
+	}
+	configFile, err := v1.ParseConfigFile(bytes.NewReader(config))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse cached config %s", manifest.Config.Digest)
+	}
+
+	layerType := types.DockerLayer
+	if manifest.MediaType == types.OCIManifestSchema1 {
+		layerType = types.OCILayer
+	}
+	c := NewFilesystemCache(dir)
+	img := &cachedImage{mediaType: manifest.MediaType, config: config, layers: map[v1.Hash]partial.UncompressedLayer{}}
+	missing := []string{}
+	for _, diffID := range configFile.RootFS.DiffIDs {
+		layer, err := c.Get(diffID)
+		if err == cache.ErrNotFound {
+			missing = append(missing, diffID.String())
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		img.layers[diffID] = &exportedLayer{Layer: layer, mediaType: layerType}
+	}
+	if len(missing) > 0 {
+		return nil, &MissingError{Reference: ref.Name(), Digests: missing}
+	}
+	return partial.UncompressedToImage(img)
+}
+
+// Export writes the image for the reference from the cache to the target: as a tarball that can be loaded with docker
+// load, or from the images directory, if the target ends with .tar, or else to an OCI image layout directory. The
+// directory of a tarball, or the image layout, is created if it does not exist; an existing image layout has the image
+// added to it. Nothing is written if the cache does not have all of the blobs of the image; the
+// *MissingError returned by Image lists them.
+func Export(dir string, ref name.Reference, target string) error {
+	img, err := Image(dir, ref)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(target, ".tar") {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return tarball.WriteToFile(target, ref, img)
+	}
+	p, err := layout.FromPath(target)
+	if err != nil {
+		if p, err = layout.Write(target, empty.Index); err != nil {
+			return err
+		}
+	}
+	return p.AppendImage(img, layout.WithAnnotations(map[string]string{"org.opencontainers.image.ref.name": ref.Name()}))
+}
+
+// Digest returns the digest of the manifest of the image, which is the digest that it was pulled with, as recorded by
+// PutImage for tags.
+func Digest(dir string, ref name.Reference) (v1.Hash, error) {
+	if digest, ok := ref.(name.Digest); ok {
+		return v1.NewHash(digest.DigestStr())
+	}
+	b, err := os.ReadFile(refPath(dir, ref))
+	if os.IsNotExist(err) {
+		return v1.Hash{}, errors.Wrapf(cache.ErrNotFound, "image %s has not been pulled into the layer cache", ref.Name())
+	}
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	r := reference{}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return v1.Hash{}, errors.Wrapf(err, "failed to parse cached reference %s", ref.Name())
+	}
+	return v1.NewHash(r.Digest)
+}
+
+// refPath returns the path of the file that records the reference. References are named by their hash, as they may
+// contain characters that are not allowed in file names.
+func refPath(dir string, ref name.Reference) string {
+	sum := sha256.Sum256([]byte(ref.Name()))
+	return filepath.Join(dir, refsDir, hex.EncodeToString(sum[:]))
+}
+
+// readBlob returns the content of the blob in the directory, if it matches its digest.
+func readBlob(dir string, h v1.Hash) ([]byte, error) {
+	b, err := os.ReadFile(Path(dir, h))
+	if err != nil {
+		return nil, err
+	}
+	if sum, _, err := v1.SHA256(bytes.NewReader(b)); err != nil {
+		return nil, err
+	} else if sum != h {
+		return nil, fmt.Errorf("cached blob %s does not match its digest", h)
+	}
+	return b, nil
+}
+
+// writeBlob writes the content of a blob to the directory.
+func writeBlob(dir string, h v1.Hash, b []byte) error {
+	return writeFile(dir, Path(dir, h), b)
+}
+
+// writeFile writes the file in the directory through a temporary file, so that it is never read incomplete.
+func writeFile(dir, path string, b []byte) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, tempPrefix+filepath.Base(path)+"-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return nil
+}
+
+// cachedImage is an image assembled from the blobs stored in the cache.
+type cachedImage struct {
+	mediaType types.MediaType
+	config    []byte
+	layers    map[v1.Hash]partial.UncompressedLayer
+}
+
+var _ partial.UncompressedImageCore = &cachedImage{}
+
+func (i *cachedImage) RawConfigFile() ([]byte, error) {
+	return i.config, nil
+}
+
+func (i *cachedImage) MediaType() (types.MediaType, error) {
+	return i.mediaType, nil
+}
+
+func (i *cachedImage) LayerByDiffID(h v1.Hash) (partial.UncompressedLayer, error) {
+	layer, ok := i.layers[h]
+	if !ok {
+		return nil, fmt.Errorf("layer %s is not in the cache", h)
+	}
+	return layer, nil
+}
+
+// exportedLayer is a cached layer with the media type of the layers of the image that it is exported with.
+type exportedLayer struct {
+	v1.Layer
+	mediaType types.MediaType
+}
+
+func (l *exportedLayer) MediaType() (types.MediaType, error) {
+	return l.mediaType, nil
+}
+
+// pruneImages removes the manifests, configs, and references of images that were last pulled before the cutoff, or
+// all of them if the cutoff is zero, along with any temporary files left behind while writing them.
+func pruneImages(dir string, cutoff time.Time) error {
+	for _, subdir := range []string{manifestsDir, refsDir} {
+		entries, err := os.ReadDir(filepath.Join(dir, subdir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			if !cutoff.IsZero() && !info.ModTime().Before(cutoff) && !strings.HasPrefix(entry.Name(), tempPrefix) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, subdir, entry.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
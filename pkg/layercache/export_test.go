@@ -0,0 +1,146 @@
+package layercache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/rancher/wharfie/pkg/tarfile"
+)
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	layers, _ := img.Layers()
+	for _, layer := range layers {
+		cached, err := c.Put(layer)
+		if err != nil {
+			t.Fatalf("Failed to cache layer: %v", err)
+		}
+		if err := readAll(cached); err != nil {
+			t.Fatalf("Failed to read layer: %v", err)
+		}
+	}
+	ref, _ := name.ParseReference("registry.example.com/test/export:v1")
+	if err := PutImage(dir, ref, img); err != nil {
+		t.Fatalf("Failed to cache image: %v", err)
+	}
+	// manifests and configs are not listed as blobs
+	if blobs, _ := List(dir); len(blobs) != len(layers) {
+		t.Errorf("Expected %d blobs to be listed but got %d", len(layers), len(blobs))
+	}
+
+	// the exported image has the same config and content as the image that was pulled
+	assertSameImage := func(exported v1.Image) {
+		t.Helper()
+		configName, _ := img.ConfigName()
+		if exportedName, err := exported.ConfigName(); err != nil || exportedName != configName {
+			t.Errorf("Expected config %s but got %s: %v", configName, exportedName, err)
+		}
+		exportedLayers, err := exported.Layers()
+		if err != nil || len(exportedLayers) != len(layers) {
+			t.Fatalf("Expected %d layers but got %d: %v", len(layers), len(exportedLayers), err)
+		}
+		for i, layer := range exportedLayers {
+			expected, _ := layers[i].DiffID()
+			diffID, _ := layer.DiffID()
+			rc, err := layer.Uncompressed()
+			if err != nil {
+				t.Fatalf("Failed to read exported layer: %v", err)
+			}
+			h, _, err := v1.SHA256(rc)
+			rc.Close()
+			if err != nil || diffID != expected || h != expected {
+				t.Errorf("Expected layer %d to have diff ID %s but got %s with content %s: %v", i, expected, diffID, h, err)
+			}
+		}
+	}
+
+	tarDir := t.TempDir()
+	if err := Export(dir, ref, filepath.Join(tarDir, "export.tar")); err != nil {
+		t.Fatalf("Failed to export image: %v", err)
+	}
+	exported, err := tarfile.FindImage(tarDir, ref)
+	if err != nil {
+		t.Fatalf("Failed to find exported image: %v", err)
+	}
+	assertSameImage(exported)
+
+	layoutDir := filepath.Join(t.TempDir(), "layout")
+	if err := Export(dir, ref, layoutDir); err != nil {
+		t.Fatalf("Failed to export image: %v", err)
+	}
+	p, err := layout.FromPath(layoutDir)
+	if err != nil {
+		t.Fatalf("Failed to read exported layout: %v", err)
+	}
+	index, _ := p.ImageIndex()
+	manifest, err := index.IndexManifest()
+	if err != nil || len(manifest.Manifests) != 1 {
+		t.Fatalf("Expected one image in exported layout but got %v: %v", manifest, err)
+	}
+	if refName := manifest.Manifests[0].Annotations["org.opencontainers.image.ref.name"]; refName != ref.Name() {
+		t.Errorf("Expected exported image to be annotated with %s but got %q", ref.Name(), refName)
+	}
+	exported, err = index.Image(manifest.Manifests[0].Digest)
+	if err != nil {
+		t.Fatalf("Failed to read exported image: %v", err)
+	}
+	if mediaType, _ := exported.MediaType(); mediaType != types.DockerManifestSchema2 {
+		t.Errorf("Expected exported manifest to have media type %s but got %s", types.DockerManifestSchema2, mediaType)
+	}
+	assertSameImage(exported)
+
+	// the image can be exported by the digest that it was pulled with
+	digest, _ := img.Digest()
+	if _, err := Image(dir, ref.Context().Digest(digest.String())); err != nil {
+		t.Errorf("Failed to get image by digest: %v", err)
+	}
+
+	// images that have not been pulled are not found
+	other, _ := name.ParseReference("registry.example.com/test/export:v2")
+	if _, err := Image(dir, other); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("Expected image that has not been pulled not to be found, but got %v", err)
+	}
+
+	// all of the missing blobs are listed, and nothing is written
+	missing := []string{}
+	for _, i := range []int{0, 2} {
+		diffID, _ := layers[i].DiffID()
+		missing = append(missing, diffID.String())
+		if err := c.Delete(diffID); err != nil {
+			t.Fatalf("Failed to delete layer: %v", err)
+		}
+	}
+	err = Export(dir, ref, filepath.Join(tarDir, "missing.tar"))
+	var missingErr *MissingError
+	if !errors.As(err, &missingErr) {
+		t.Fatalf("Expected missing blobs error but got %v", err)
+	}
+	if len(missingErr.Digests) != 2 || missingErr.Digests[0] != missing[0] || missingErr.Digests[1] != missing[1] {
+		t.Errorf("Expected missing blobs %v but got %v", missing, missingErr.Digests)
+	}
+	if _, err := os.Stat(filepath.Join(tarDir, "missing.tar")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be written for an incomplete image: %v", err)
+	}
+
+	// pruning the cache removes the images as well as their layers
+	if _, err := Prune(dir, time.Time{}); err != nil {
+		t.Fatalf("Failed to prune cache: %v", err)
+	}
+	if _, err := Image(dir, ref); !errors.Is(err, cache.ErrNotFound) {
+		t.Errorf("Expected pruned image not to be found, but got %v", err)
+	}
+}
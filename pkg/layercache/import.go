@@ -0,0 +1,118 @@
+package layercache
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/tarfile"
+	"github.com/sirupsen/logrus"
+)
+
+// ImportResult summarizes the layers read from local image archives by Import.
+type ImportResult struct {
+	// Archives is the number of image archives that were read.
+	Archives int
+	// Imported are the layers that were stored in the cache.
+	Imported []Blob
+	// Cached is the number of layers that were already in the cache, or being written to it by another process.
+	Cached int
+}
+
+// Import stores the layers of the images in local image archives in the cache, named by their diff ID as layers pulled
+// from a registry are, so that pulls of other images that share them do not download them again. The path may be an
+// archive, or a directory of archives as read from the images directory. Layers are stored with the options of the
+// cache, as they would be when pulled.
+func Import(dir, path string, opts ...Option) (*ImportResult, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		if files, err = tarfile.Archives(path); err != nil {
+			return nil, err
+		}
+	}
+
+	c := NewFilesystemCache(dir, opts...).(*filesystemCache)
+	result := &ImportResult{Imported: []Blob{}}
+	for _, file := range files {
+		images, err := tarfile.ArchiveImages(file)
+		if err != nil {
+			return result, errors.Wrapf(err, "failed to read image archive %s", file)
+		}
+		result.Archives++
+		for _, img := range images {
+			layers, err := img.Layers()
+			if err != nil {
+				return result, errors.Wrapf(err, "failed to read image archive %s", file)
+			}
+			for _, layer := range layers {
+				blob, err := importLayer(c, layer)
+				if err != nil {
+					return result, errors.Wrapf(err, "failed to import layer from %s", file)
+				}
+				if blob == nil {
+					result.Cached++
+					continue
+				}
+				logrus.WithField("layer", blob.Digest).Debugf("Imported layer from %s", file)
+				result.Imported = append(result.Imported, *blob)
+			}
+		}
+	}
+	return result, nil
+}
+
+// importLayer stores the uncompressed content of the layer in the cache, and returns the stored blob, or nil if the
+// layer was already cached. The layer is written as it would be when read from the registry, so that it is verified
+// against its diff ID before it is moved into place.
+func importLayer(c *filesystemCache, layer v1.Layer) (*Blob, error) {
+	diffID, err := layer.DiffID()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Get(diffID); err == nil {
+		return nil, nil
+	} else if err != cache.ErrNotFound {
+		return nil, err
+	}
+
+	hasher, err := v1.Hasher(diffID.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	w, err := c.newBlobWriter(diffID, readCloser{Reader: io.TeeReader(rc, hasher), Closer: rc})
+	if err != nil {
+		return nil, err
+	}
+	size, err := io.Copy(io.Discard, w)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != diffID.Hex {
+		return nil, errors.Errorf("content of layer %s does not match its diff ID", diffID)
+	}
+	// a layer that is being written by another process is left to it
+	if _, err := os.Stat(blobPath(c.dir, diffID)); os.IsNotExist(err) {
+		return nil, nil
+	}
+	return &Blob{Digest: diffID.String(), Size: size}, nil
+}
+
+// readCloser reads from one reader, and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,89 @@
+package layercache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestImport(t *testing.T) {
+	base, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	extra, err := random.Layer(1024, "")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	derived, err := mutate.AppendLayers(base, extra)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	untagged, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+
+	imagesDir := t.TempDir()
+	baseTag, _ := name.NewTag("registry.example.com/test/base:v1")
+	derivedTag, _ := name.NewTag("registry.example.com/test/derived:v1")
+	if err := tarball.MultiWriteToFile(filepath.Join(imagesDir, "images.tar"), map[name.Tag]v1.Image{baseTag: base, derivedTag: derived}); err != nil {
+		t.Fatalf("Failed to write image archive: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(imagesDir, "untagged"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	file, err := os.Create(filepath.Join(imagesDir, "untagged", "untagged.tar"))
+	if err != nil {
+		t.Fatalf("Failed to create image archive: %v", err)
+	}
+	if err := tarball.Write(nil, untagged, file); err != nil {
+		t.Fatalf("Failed to write image archive: %v", err)
+	}
+	file.Close()
+	if err := os.WriteFile(filepath.Join(imagesDir, ".hidden.tar"), []byte("not an archive"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	dir := t.TempDir()
+	result, err := Import(dir, imagesDir)
+	if err != nil {
+		t.Fatalf("Failed to import image archives: %v", err)
+	}
+	// the layers of the base image are shared with the derived image, and only imported once
+	if result.Archives != 2 || len(result.Imported) != 4 || result.Cached != 2 {
+		t.Errorf("Expected 4 layers to be imported from 2 archives, with 2 already cached, but got %+v", result)
+	}
+	c := NewFilesystemCache(dir)
+	for _, img := range []v1.Image{derived, untagged} {
+		layers, _ := img.Layers()
+		for _, layer := range layers {
+			diffID, _ := layer.DiffID()
+			if _, err := c.Get(diffID); err != nil {
+				t.Errorf("Expected layer %s to be cached: %v", diffID, err)
+			}
+		}
+	}
+
+	// importing a single archive again finds its layers already cached
+	result, err = Import(dir, filepath.Join(imagesDir, "images.tar"))
+	if err != nil {
+		t.Fatalf("Failed to import image archive: %v", err)
+	}
+	if result.Archives != 1 || len(result.Imported) != 0 || result.Cached != 5 {
+		t.Errorf("Expected 5 layers to be already cached, but got %+v", result)
+	}
+
+	if _, err := Import(dir, filepath.Join(imagesDir, "missing.tar")); !os.IsNotExist(err) {
+		t.Errorf("Expected missing archive to fail to import, but got %v", err)
+	}
+	if blobs, _ := List(dir); len(blobs) != 4 {
+		t.Errorf("Expected 4 blobs in the cache but got %d", len(blobs))
+	}
+}
@@ -0,0 +1,442 @@
+// Package layercache manages the on-disk layer cache used by wharfie. Layers are stored in the same layout as the
+// go-containerregistry filesystem cache, one file per layer named by its digest; the modification time of each file
+// is updated whenever the layer is read from the cache, so that layers which have not been used recently can be
+// pruned. Layers may also be stored compressed with zstd, with a .zst suffix added to the file name.
+package layercache
+
+import (
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/compression"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// tempPrefix is the prefix of the temporary files that blobs are written to before they are complete.
+const tempPrefix = ".tmp-"
+
+// Blob is a layer stored in the cache.
+type Blob struct {
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+}
+
+// filesystemCache is a filesystem cache that is safe for concurrent use by multiple processes. Each layer is
+// written to a temporary file while it is read, and renamed into place once it has been read to completion and
+// verified, so that a partially written layer is never read from the cache. Writers hold an exclusive lock on the
+// layer while writing it; a layer that is already being written by another writer is read without being cached.
+type filesystemCache struct {
+	dir         string
+	compression compression.Compression
+	counters    *counters
+}
+
+// Option is an option for NewFilesystemCache.
+type Option func(*filesystemCache)
+
+// WithCompression stores the layers written to the cache compressed with zstd, if the compression is
+// compression.ZStd; otherwise layers are stored as they are read. Layers are read from the cache whether or not they
+// were stored compressed, so the compression of a cache can be changed at any time.
+func WithCompression(c compression.Compression) Option {
+	return func(f *filesystemCache) {
+		f.compression = c
+	}
+}
+
+// NewFilesystemCache returns a filesystem cache rooted at dir, which updates the modification time of each layer
+// read from the cache. The cache also has a Stats method, which returns its hits and misses.
+func NewFilesystemCache(dir string, opts ...Option) cache.Cache {
+	c := &filesystemCache{dir: dir, compression: compression.None, counters: &counters{}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Put returns a layer that writes its content to the cache as it is read.
+func (c *filesystemCache) Put(l v1.Layer) (v1.Layer, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	diffID, err := l.DiffID()
+	if err != nil {
+		return nil, err
+	}
+	return &cachingLayer{Layer: l, cache: c, digest: digest, diffID: diffID}, nil
+}
+
+// Get returns the cached layer, and marks it as used. Layers that are not in the cache are not found. Layers whose
+// content does not match their digest, such as those left truncated by an unclean shutdown or incomplete by an earlier
+// version of the cache, are removed from the cache and not found either, so that the caller falls back to the remote
+// layer and caches it again.
+func (c *filesystemCache) Get(h v1.Hash) (v1.Layer, error) {
+	path := blobPath(c.dir, h)
+	layer, size, err := openBlob(path)
+	if os.IsNotExist(err) {
+		c.counters.miss()
+		return nil, cache.ErrNotFound
+	}
+	if err != nil {
+		// a corrupt blob may not be readable as a layer at all; other errors are returned
+		if ok, verr := verifyBlob(path, h); verr != nil || ok {
+			return nil, err
+		}
+		return nil, c.evict(h)
+	}
+	// the layer's digest and diff ID are computed from the content of the file; a blob is stored under one of them
+	if digest, _ := layer.Digest(); digest != h {
+		if diffID, _ := layer.DiffID(); diffID != h {
+			return nil, c.evict(h)
+		}
+	}
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		if os.IsNotExist(err) {
+			c.counters.miss()
+			return nil, cache.ErrNotFound
+		}
+		return nil, err
+	}
+	c.counters.hit(size)
+	return layer, nil
+}
+
+// Delete removes the layer from the cache, whether or not it was stored compressed.
+func (c *filesystemCache) Delete(h v1.Hash) error {
+	path := Path(c.dir, h)
+	err := os.Remove(path)
+	if zerr := os.Remove(path + zstdSuffix); os.IsNotExist(err) {
+		err = zerr
+	}
+	if os.IsNotExist(err) {
+		return cache.ErrNotFound
+	}
+	return err
+}
+
+// evict removes a corrupt layer from the cache, and returns cache.ErrNotFound so that the layer is read from the
+// registry instead.
+func (c *filesystemCache) evict(h v1.Hash) error {
+	logrus.Warnf("Removing corrupt layer %s from the cache", h)
+	c.counters.miss()
+	if err := c.Delete(h); err != nil && err != cache.ErrNotFound {
+		return err
+	}
+	return cache.ErrNotFound
+}
+
+// cachingLayer is a layer whose compressed and uncompressed content are written to the cache as they are read.
+type cachingLayer struct {
+	v1.Layer
+	cache          *filesystemCache
+	digest, diffID v1.Hash
+}
+
+func (l *cachingLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	return l.cache.newBlobWriter(l.digest, &countingReader{ReadCloser: rc, counters: l.cache.counters})
+}
+
+func (l *cachingLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	return l.cache.newBlobWriter(l.diffID, &countingReader{ReadCloser: rc, counters: l.cache.counters})
+}
+
+// blobWriter copies the content read from a layer to a temporary file in the cache, and renames it into place when
+// closed, if the content was read to completion and matches the expected hash. The content is hashed before it is
+// compressed, if the cache compresses layers.
+type blobWriter struct {
+	rc      io.ReadCloser
+	h       v1.Hash
+	path    string
+	file    *os.File
+	w       io.Writer
+	encoder *zstd.Encoder
+	hasher  hash.Hash
+	lock    *Lock
+	done    bool
+}
+
+// newBlobWriter returns a reader that writes the content of rc to the cache. If the blob is already being written
+// by another writer, or cannot be written, rc is returned unchanged so that the layer can still be read.
+func (c *filesystemCache) newBlobWriter(h v1.Hash, rc io.ReadCloser) (io.ReadCloser, error) {
+	hasher, err := v1.Hasher(h.Algorithm)
+	if err != nil {
+		return rc, nil
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	path := Path(c.dir, h)
+	lock, err := tryLock(path + ".lock")
+	if err == ErrLocked {
+		return rc, nil
+	}
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	file, err := os.CreateTemp(c.dir, tempPrefix+filepath.Base(path)+"-")
+	if err != nil {
+		lock.Unlock()
+		rc.Close()
+		return nil, err
+	}
+	w := &blobWriter{rc: rc, h: h, path: path, file: file, w: file, hasher: hasher, lock: lock}
+	if c.compression == compression.ZStd {
+		if w.encoder, err = zstd.NewWriter(file); err != nil {
+			w.discard()
+			lock.Unlock()
+			rc.Close()
+			return nil, err
+		}
+		w.path += zstdSuffix
+		w.w = w.encoder
+	}
+	return w, nil
+}
+
+func (w *blobWriter) Read(b []byte) (int, error) {
+	n, err := w.rc.Read(b)
+	if n > 0 && w.file != nil {
+		w.hasher.Write(b[:n])
+		if _, werr := w.w.Write(b[:n]); werr != nil {
+			w.discard()
+		}
+	}
+	if err == io.EOF {
+		w.done = true
+	}
+	return n, err
+}
+
+// Close closes the layer, and moves the blob into place if it is complete. A blob that is incomplete or does not
+// match its hash is discarded.
+func (w *blobWriter) Close() error {
+	err := w.rc.Close()
+	if w.file != nil {
+		sum := v1.Hash{Algorithm: w.h.Algorithm, Hex: hex.EncodeToString(w.hasher.Sum(nil))}
+		if !w.done || sum != w.h {
+			w.discard()
+		} else if cerr := w.closeFile(); cerr != nil {
+			os.Remove(w.file.Name())
+			if err == nil {
+				err = cerr
+			}
+		} else if rerr := os.Rename(w.file.Name(), w.path); rerr != nil {
+			// the blob may have been cached by an earlier writer, and be in use
+			os.Remove(w.file.Name())
+			if _, serr := os.Stat(w.path); serr != nil && err == nil {
+				err = rerr
+			}
+		}
+		w.file = nil
+	}
+	if uerr := w.lock.Unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// closeFile flushes the compressed content, if the blob is compressed, and closes the temporary file.
+func (w *blobWriter) closeFile() error {
+	if w.encoder != nil {
+		if err := w.encoder.Close(); err != nil {
+			w.file.Close()
+			return err
+		}
+	}
+	return w.file.Close()
+}
+
+// discard removes the temporary file, and stops writing to the cache.
+func (w *blobWriter) discard() {
+	if w.file != nil {
+		if w.encoder != nil {
+			w.encoder.Close()
+		}
+		w.file.Close()
+		os.Remove(w.file.Name())
+		w.file = nil
+	}
+}
+
+// Path returns the path of the file that the filesystem cache stores the layer in. Colons are not allowed in file
+// names on Windows, so the cache separates the algorithm from the hex digest with a dash instead.
+func Path(dir string, h v1.Hash) string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(dir, h.Algorithm+"-"+h.Hex)
+	}
+	return filepath.Join(dir, h.String())
+}
+
+// Contains returns true if the layer is stored in the cache, whether or not it is stored compressed. The content of
+// the layer is not checked, as it is when the layer is read.
+func Contains(dir string, h v1.Hash) bool {
+	_, err := os.Stat(blobPath(dir, h))
+	return err == nil
+}
+
+// List returns the layers stored in the cache, least recently used first, with the size they are stored at. Files
+// that are not named by a digest, such as the lock file, are ignored. A cache directory that does not exist is empty.
+func List(dir string) ([]Blob, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Blob{}, nil
+		}
+		return nil, errors.Wrap(err, "failed to read layer cache")
+	}
+
+	blobs := []Blob{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		h, err := v1.NewHash(strings.Replace(strings.TrimSuffix(entry.Name(), zstdSuffix), "-", ":", 1))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		blobs = append(blobs, Blob{Digest: h.String(), Size: info.Size(), LastUsed: info.ModTime()})
+	}
+	sort.SliceStable(blobs, func(i, j int) bool {
+		return blobs[i].LastUsed.Before(blobs[j].LastUsed)
+	})
+	return blobs, nil
+}
+
+// Prune removes the layers that were last used before the cutoff, and returns the removed layers. A zero cutoff
+// removes all layers. The caller must hold the exclusive lock on the cache.
+func Prune(dir string, cutoff time.Time) ([]Blob, error) {
+	blobs, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []Blob{}
+	for _, blob := range blobs {
+		if !cutoff.IsZero() && !blob.LastUsed.Before(cutoff) {
+			continue
+		}
+		if err := remove(dir, blob); err != nil {
+			return removed, err
+		}
+		removed = append(removed, blob)
+	}
+
+	if err := pruneImages(dir, cutoff); err != nil {
+		return removed, err
+	}
+
+	// temporary files are left behind by writers that did not exit cleanly; no writers can be active while the
+	// exclusive lock is held
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempPrefix) {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// Verify hashes the content of each layer in the cache, and removes the layers whose content does not match the digest
+// they are stored under, such as those left truncated by an unclean shutdown. It returns the layers that were checked,
+// and those that were removed. The caller must hold the exclusive lock on the cache.
+func Verify(dir string) ([]Blob, []Blob, error) {
+	blobs, err := List(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	removed := []Blob{}
+	for i, blob := range blobs {
+		h, err := v1.NewHash(blob.Digest)
+		if err != nil {
+			return blobs[:i], removed, err
+		}
+		ok, err := verifyBlob(blobPath(dir, h), h)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return blobs[:i], removed, errors.Wrapf(err, "failed to verify cached layer %s", blob.Digest)
+		}
+		if !ok {
+			if err := remove(dir, blob); err != nil {
+				return blobs[:i], removed, err
+			}
+			removed = append(removed, blob)
+		}
+	}
+	return blobs, removed, nil
+}
+
+// verifyBlob returns true if the content of the file matches the hash. The content of a compressed file is hashed
+// after it is decompressed, and a file that cannot be decompressed does not match.
+func verifyBlob(path string, h v1.Hash) (bool, error) {
+	hasher, err := v1.Hasher(h.Algorithm)
+	if err != nil {
+		return false, err
+	}
+	rc, err := openBlobContent(path)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	if _, err := io.Copy(hasher, rc); err != nil {
+		if strings.HasSuffix(path, zstdSuffix) {
+			return false, nil
+		}
+		return false, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)) == h.Hex, nil
+}
+
+// remove removes the layer and its lock file from the cache.
+func remove(dir string, blob Blob) error {
+	h, err := v1.NewHash(blob.Digest)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{Path(dir, h), Path(dir, h) + zstdSuffix} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to remove cached layer %s", blob.Digest)
+		}
+	}
+	if err := os.Remove(Path(dir, h) + ".lock"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove lock for cached layer %s", blob.Digest)
+	}
+	return nil
+}
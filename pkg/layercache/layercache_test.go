@@ -0,0 +1,427 @@
+package layercache
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/compression"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/pkg/errors"
+)
+
+func TestLastUsed(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+
+	layer, err := random.Layer(1024, "")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	cached, err := c.Put(layer)
+	if err != nil {
+		t.Fatalf("Failed to cache layer: %v", err)
+	}
+	if err := readAll(cached); err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+
+	diffID, _ := layer.DiffID()
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(Path(dir, diffID), old, old); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+	if _, err := c.Get(diffID); err != nil {
+		t.Fatalf("Failed to get cached layer: %v", err)
+	}
+
+	// the lock file is not listed
+	lock, err := LockShared(dir)
+	if err != nil {
+		t.Fatalf("Failed to lock cache: %v", err)
+	}
+	defer lock.Unlock()
+	blobs, err := List(dir)
+	if err != nil {
+		t.Fatalf("Failed to list cache: %v", err)
+	}
+	if len(blobs) != 1 || blobs[0].Digest != diffID.String() {
+		t.Fatalf("Expected only layer %s to be listed but got %v", diffID, blobs)
+	}
+	if !blobs[0].LastUsed.After(old) {
+		t.Errorf("Expected layer to be marked as used, but it was last used %s", blobs[0].LastUsed)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+
+	now := time.Now()
+	ages := []time.Duration{0, 2 * time.Hour, 48 * time.Hour}
+	for _, age := range ages {
+		layer, err := random.Layer(1024, "")
+		if err != nil {
+			t.Fatalf("Failed to create layer: %v", err)
+		}
+		cached, err := c.Put(layer)
+		if err != nil {
+			t.Fatalf("Failed to cache layer: %v", err)
+		}
+		if err := readAll(cached); err != nil {
+			t.Fatalf("Failed to read layer: %v", err)
+		}
+		diffID, _ := layer.DiffID()
+		lastUsed := now.Add(-age)
+		if err := os.Chtimes(Path(dir, diffID), lastUsed, lastUsed); err != nil {
+			t.Fatalf("Failed to set modification time: %v", err)
+		}
+	}
+
+	// the cache cannot be pruned while it is in use
+	lock, err := LockShared(dir)
+	if err != nil {
+		t.Fatalf("Failed to lock cache: %v", err)
+	}
+	if _, err := TryLockExclusive(dir); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected cache to be locked but got %v", err)
+	}
+	lock.Unlock()
+	if lock, err = TryLockExclusive(dir); err != nil {
+		t.Fatalf("Failed to lock cache: %v", err)
+	}
+	defer lock.Unlock()
+
+	removed, err := Prune(dir, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to prune cache: %v", err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("Expected 2 blobs to be removed but got %d", len(removed))
+	}
+	if blobs, _ := List(dir); len(blobs) != 1 {
+		t.Errorf("Expected 1 blob to be kept but got %d", len(blobs))
+	}
+
+	if removed, err = Prune(dir, time.Time{}); err != nil {
+		t.Fatalf("Failed to prune cache: %v", err)
+	}
+	if len(removed) != 1 {
+		t.Errorf("Expected 1 blob to be removed but got %d", len(removed))
+	}
+	if blobs, _ := List(dir); len(blobs) != 0 {
+		t.Errorf("Expected empty cache but got %d blobs", len(blobs))
+	}
+}
+
+func TestIncompleteWrite(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+
+	layer, err := random.Layer(4096, "")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	diffID, _ := layer.DiffID()
+	cached, err := c.Put(layer)
+	if err != nil {
+		t.Fatalf("Failed to cache layer: %v", err)
+	}
+
+	// a layer that is not read to completion is not cached
+	rc, err := cached.Uncompressed()
+	if err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	if _, err := io.ReadFull(rc, make([]byte, 16)); err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	rc.Close()
+	if _, err := c.Get(diffID); err != cache.ErrNotFound {
+		t.Errorf("Expected partially read layer not to be cached but got %v", err)
+	}
+
+	// a layer that is already being written is read without being cached
+	lock, err := tryLock(Path(dir, diffID) + ".lock")
+	if err != nil {
+		t.Fatalf("Failed to lock blob: %v", err)
+	}
+	if err := readAll(cached); err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	if _, err := c.Get(diffID); err != cache.ErrNotFound {
+		t.Errorf("Expected layer being written by another writer not to be cached but got %v", err)
+	}
+	lock.Unlock()
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the blob lock file to be left but got %v", entries)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	layer, err := random.Layer(1<<20, "")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	diffID, _ := layer.DiffID()
+
+	// each writer has its own cache, as separate processes would
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := NewFilesystemCache(dir)
+			if _, err := c.Get(diffID); err == nil {
+				return
+			}
+			cached, err := c.Put(layer)
+			if err != nil {
+				errs <- err
+				return
+			}
+			errs <- readAll(cached)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to read layer: %v", err)
+		}
+	}
+
+	cached, err := NewFilesystemCache(dir).Get(diffID)
+	if err != nil {
+		t.Fatalf("Expected layer to be cached: %v", err)
+	}
+	rc, err := cached.Uncompressed()
+	if err != nil {
+		t.Fatalf("Failed to read cached layer: %v", err)
+	}
+	defer rc.Close()
+	h, _, err := v1.SHA256(rc)
+	if err != nil {
+		t.Fatalf("Failed to read cached layer: %v", err)
+	}
+	if h != diffID {
+		t.Errorf("Expected cached layer with diff ID %s but got %s", diffID, h)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempPrefix) {
+			t.Errorf("Expected temporary file %s to be removed", entry.Name())
+		}
+	}
+}
+
+func TestCorruptBlobs(t *testing.T) {
+	testCases := map[string]struct {
+		compressed bool
+		zstd       bool
+		corrupt    func([]byte) []byte
+	}{
+		"truncated": {
+			corrupt: func(b []byte) []byte { return b[:len(b)/2] },
+		},
+		"modified": {
+			corrupt: func(b []byte) []byte { b[len(b)/2] ^= 0xff; return b },
+		},
+		"truncated compressed": {
+			compressed: true,
+			corrupt:    func(b []byte) []byte { return b[:len(b)/2] },
+		},
+		"modified compressed": {
+			compressed: true,
+			corrupt:    func(b []byte) []byte { b[len(b)/2] ^= 0xff; return b },
+		},
+		"truncated zstd": {
+			zstd:    true,
+			corrupt: func(b []byte) []byte { return b[:len(b)/2] },
+		},
+		"modified zstd": {
+			zstd:    true,
+			corrupt: func(b []byte) []byte { b[len(b)/2] ^= 0xff; return b },
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			dir := t.TempDir()
+			opts := []Option{}
+			if tc.zstd {
+				opts = append(opts, WithCompression(compression.ZStd))
+			}
+			c := NewFilesystemCache(dir, opts...)
+			layer, err := random.Layer(4096, "")
+			if err != nil {
+				t.Fatalf("Failed to create layer: %v", err)
+			}
+			h, _ := layer.DiffID()
+			read := readAll
+			if tc.compressed {
+				h, _ = layer.Digest()
+				read = readCompressed
+			}
+			cached, err := c.Put(layer)
+			if err != nil {
+				t.Fatalf("Failed to cache layer: %v", err)
+			}
+			if err := read(cached); err != nil {
+				t.Fatalf("Failed to read layer: %v", err)
+			}
+			if _, err := c.Get(h); err != nil {
+				t.Fatalf("Expected layer to be cached: %v", err)
+			}
+
+			path := Path(dir, h)
+			if tc.zstd {
+				path += zstdSuffix
+			}
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("Failed to read cached layer: %v", err)
+			}
+			if err := os.WriteFile(path, tc.corrupt(b), 0600); err != nil {
+				t.Fatalf("Failed to corrupt cached layer: %v", err)
+			}
+
+			// the corrupt layer is not found, and removed so that it can be cached again
+			if _, err := c.Get(h); err != cache.ErrNotFound {
+				t.Errorf("Expected corrupt layer not to be found but got %v", err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("Expected corrupt layer to be removed: %v", err)
+			}
+			if cached, err = c.Put(layer); err != nil {
+				t.Fatalf("Failed to cache layer: %v", err)
+			}
+			if err := read(cached); err != nil {
+				t.Fatalf("Failed to read layer: %v", err)
+			}
+			if _, err := c.Get(h); err != nil {
+				t.Errorf("Expected layer to be cached again: %v", err)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+
+	diffIDs := []v1.Hash{}
+	for i := 0; i < 3; i++ {
+		layer, err := random.Layer(1024, "")
+		if err != nil {
+			t.Fatalf("Failed to create layer: %v", err)
+		}
+		cached, err := c.Put(layer)
+		if err != nil {
+			t.Fatalf("Failed to cache layer: %v", err)
+		}
+		if err := readAll(cached); err != nil {
+			t.Fatalf("Failed to read layer: %v", err)
+		}
+		diffID, _ := layer.DiffID()
+		diffIDs = append(diffIDs, diffID)
+	}
+	if err := os.Truncate(Path(dir, diffIDs[1]), 100); err != nil {
+		t.Fatalf("Failed to truncate cached layer: %v", err)
+	}
+
+	checked, removed, err := Verify(dir)
+	if err != nil {
+		t.Fatalf("Failed to verify cache: %v", err)
+	}
+	if len(checked) != 3 {
+		t.Errorf("Expected 3 blobs to be checked but got %d", len(checked))
+	}
+	if len(removed) != 1 || removed[0].Digest != diffIDs[1].String() {
+		t.Errorf("Expected only truncated blob %s to be removed but got %v", diffIDs[1], removed)
+	}
+	for i, diffID := range diffIDs {
+		if _, err := os.Stat(Path(dir, diffID)); (i == 1) != os.IsNotExist(err) {
+			t.Errorf("Unexpected state of blob %s after verifying: %v", diffID, err)
+		}
+	}
+
+	if _, removed, err = Verify(dir); err != nil || len(removed) != 0 {
+		t.Errorf("Expected no blobs to be removed from a verified cache but got %v, %v", removed, err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir)
+	stats := func() Stats { return c.(*filesystemCache).Stats() }
+
+	layer, err := random.Layer(4096, "")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	diffID, _ := layer.DiffID()
+	if _, err := c.Get(diffID); err != cache.ErrNotFound {
+		t.Fatalf("Expected layer not to be cached but got %v", err)
+	}
+	cached, err := c.Put(layer)
+	if err != nil {
+		t.Fatalf("Failed to cache layer: %v", err)
+	}
+	if err := readAll(cached); err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	info, err := os.Stat(Path(dir, diffID))
+	if err != nil {
+		t.Fatalf("Expected layer to be cached: %v", err)
+	}
+	if s := stats(); s.Hits != 0 || s.Misses != 1 || s.CachedBytes != 0 || s.RemoteBytes != info.Size() || s.HitRatio() != 0 {
+		t.Errorf("Expected 1 miss and %d bytes read from the registry but got %+v", info.Size(), s)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(diffID); err != nil {
+			t.Fatalf("Failed to get cached layer: %v", err)
+		}
+	}
+	if s := stats(); s.Hits != 2 || s.Misses != 1 || s.CachedBytes != 2*info.Size() || s.HitRatio() < 0.66 || s.HitRatio() > 0.67 {
+		t.Errorf("Expected 2 hits serving %d bytes but got %+v", 2*info.Size(), s)
+	}
+
+	// each cache counts its own hits and misses
+	if s := NewFilesystemCache(dir).(*filesystemCache).Stats(); s != (Stats{}) {
+		t.Errorf("Expected new cache to have no hits or misses but got %+v", s)
+	}
+}
+
+func readAll(layer v1.Layer) error {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		rc.Close()
+		return err
+	}
+	return rc.Close()
+}
+
+func readCompressed(layer v1.Layer) error {
+	rc, err := layer.Compressed()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		rc.Close()
+		return err
+	}
+	return rc.Close()
+}
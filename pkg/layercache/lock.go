@@ -0,0 +1,66 @@
+package layercache
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ErrLocked is returned by TryLockExclusive when another process holds a lock on the cache.
+var ErrLocked = errors.New("layer cache is locked")
+
+// Lock is an advisory lock on a cache directory or blob. Processes that read from or write to the cache hold a
+// shared lock on the directory, and pruning the cache requires an exclusive lock, so that layers are not removed
+// while they are in use. Writers also hold an exclusive lock on each blob while writing it.
+type Lock struct {
+	file *os.File
+}
+
+// LockShared waits for a shared lock on the cache directory, creating the directory if necessary.
+func LockShared(dir string) (*Lock, error) {
+	return lock(dir, false)
+}
+
+// TryLockExclusive takes an exclusive lock on the cache directory without waiting, creating the directory if
+// necessary. ErrLocked is returned if another process holds a lock on the cache.
+func TryLockExclusive(dir string) (*Lock, error) {
+	return lock(dir, true)
+}
+
+func lock(dir string, exclusive bool) (*Lock, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create layer cache directory")
+	}
+	return lockPath(filepath.Join(dir, ".lock"), exclusive)
+}
+
+// tryLock takes an exclusive lock on the file at path without waiting, creating the file if necessary.
+func tryLock(path string) (*Lock, error) {
+	return lockPath(path, true)
+}
+
+func lockPath(path string, exclusive bool) (*Lock, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open layer cache lock")
+	}
+	if err := lockFile(file, exclusive); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Lock{file: file}, nil
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	err := unlockFile(l.file)
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file = nil
+	return err
+}
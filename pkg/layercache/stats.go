@@ -0,0 +1,70 @@
+package layercache
+
+import (
+	"io"
+	"sync"
+)
+
+// Stats counts the layers that were found in, or missing from, a cache since it was created, and how much layer
+// content was served from the cache or read from the registry to be cached.
+type Stats struct {
+	Hits   int `json:"hits"`
+	Misses int `json:"misses"`
+	// CachedBytes is the size of the layers found in the cache, before any compression that they are stored with.
+	CachedBytes int64 `json:"cachedBytes"`
+	// RemoteBytes is the amount of content read from the layers that were not in the cache.
+	RemoteBytes int64 `json:"remoteBytes"`
+}
+
+// HitRatio returns the fraction of layer content that was served from the cache, or zero if no content was read.
+func (s Stats) HitRatio() float64 {
+	if s.CachedBytes+s.RemoteBytes == 0 {
+		return 0
+	}
+	return float64(s.CachedBytes) / float64(s.CachedBytes+s.RemoteBytes)
+}
+
+// counters records the Stats of a cache.
+type counters struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+func (c *counters) hit(size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Hits++
+	c.stats.CachedBytes += size
+}
+
+func (c *counters) miss() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Misses++
+}
+
+func (c *counters) remote(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.RemoteBytes += int64(n)
+}
+
+// Stats returns the hits and misses of the cache, and the amount of layer content it has served or read from the
+// registry, since it was created.
+func (c *filesystemCache) Stats() Stats {
+	c.counters.mu.Lock()
+	defer c.counters.mu.Unlock()
+	return c.counters.stats
+}
+
+// countingReader counts the content read from a layer that was not in the cache.
+type countingReader struct {
+	io.ReadCloser
+	counters *counters
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.counters.remote(n)
+	return n, err
+}
@@ -0,0 +1,93 @@
+package layercache
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/klauspost/compress/zstd"
+	"github.com/rancher/wharfie/pkg/tarfile"
+)
+
+// zstdSuffix is added to the names of the files that layers are stored compressed in.
+const zstdSuffix = ".zst"
+
+// blobPath returns the path of the file that the layer is stored in: the compressed file, if only it exists, or else
+// the uncompressed file, whether or not it exists.
+func blobPath(dir string, h v1.Hash) string {
+	path := Path(dir, h)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if _, err := os.Stat(path + zstdSuffix); err == nil {
+			return path + zstdSuffix
+		}
+	}
+	return path
+}
+
+// openBlob returns the layer stored in the file, which is decompressed as it is read if it is compressed, and the size
+// of its content. The digest and diff ID of the layer are computed from the decompressed content.
+func openBlob(path string) (v1.Layer, int64, error) {
+	if !strings.HasSuffix(path, zstdSuffix) {
+		layer, err := tarball.LayerFromFile(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		return layer, info.Size(), nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, 0, err
+	}
+	// the content is read to completion to compute the digest and diff ID, which gives its decompressed size
+	var size atomic.Int64
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		rc, err := openBlobContent(path)
+		if err != nil {
+			return nil, err
+		}
+		return &sizeReader{ReadCloser: rc, size: &size}, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return layer, size.Load(), nil
+}
+
+// openBlobContent returns the content of the file that a layer is stored in, decompressed if it is compressed.
+func openBlobContent(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, zstdSuffix) {
+		return file, nil
+	}
+	zr, err := zstd.NewReader(file, zstd.WithDecoderMaxMemory(tarfile.MaxDecoderMemory))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return tarfile.ZstdReadCloser(zr, file), nil
+}
+
+// sizeReader records the number of bytes read, when the content has been read to completion.
+type sizeReader struct {
+	io.ReadCloser
+	n    int64
+	size *atomic.Int64
+}
+
+func (r *sizeReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	if err == io.EOF {
+		r.size.Store(r.n)
+	}
+	return n, err
+}
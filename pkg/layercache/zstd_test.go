@@ -0,0 +1,174 @@
+package layercache
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/compression"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+func TestCompression(t *testing.T) {
+	dir := t.TempDir()
+	c := NewFilesystemCache(dir, WithCompression(compression.ZStd))
+
+	layer := textLayer(t, 1<<20)
+	diffID, _ := layer.DiffID()
+	cached, err := c.Put(layer)
+	if err != nil {
+		t.Fatalf("Failed to cache layer: %v", err)
+	}
+	if err := readAll(cached); err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+
+	// the layer is stored compressed, and is smaller than its content
+	if _, err := os.Stat(Path(dir, diffID)); !os.IsNotExist(err) {
+		t.Errorf("Expected layer not to be stored uncompressed: %v", err)
+	}
+	info, err := os.Stat(Path(dir, diffID) + zstdSuffix)
+	if err != nil {
+		t.Fatalf("Expected layer to be stored compressed: %v", err)
+	}
+	content := layerContent(t, layer)
+	if info.Size() >= int64(len(content)) {
+		t.Errorf("Expected compressed layer to be smaller than its content of %d bytes but got %d", len(content), info.Size())
+	}
+
+	// the layer read from the cache has the same content, digest, and diff ID as the original
+	restored, err := c.Get(diffID)
+	if err != nil {
+		t.Fatalf("Failed to get cached layer: %v", err)
+	}
+	if !bytes.Equal(layerContent(t, restored), content) {
+		t.Errorf("Expected cached layer to have the same content as the original")
+	}
+	if h, _ := restored.DiffID(); h != diffID {
+		t.Errorf("Expected cached layer with diff ID %s but got %s", diffID, h)
+	}
+	if s := c.(*filesystemCache).Stats(); s.CachedBytes != int64(len(content)) {
+		t.Errorf("Expected hit to serve %d bytes of content but got %d", len(content), s.CachedBytes)
+	}
+
+	// a cache that does not compress layers reads compressed layers, and the other way around
+	plain := NewFilesystemCache(dir)
+	if _, err := plain.Get(diffID); err != nil {
+		t.Errorf("Expected compressed layer to be read without compression: %v", err)
+	}
+	other, err := random.Layer(1024, "")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	otherDiffID, _ := other.DiffID()
+	if cached, err = plain.Put(other); err != nil {
+		t.Fatalf("Failed to cache layer: %v", err)
+	}
+	if err := readAll(cached); err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	if _, err := c.Get(otherDiffID); err != nil {
+		t.Errorf("Expected uncompressed layer to be read with compression: %v", err)
+	}
+
+	// compressed layers are listed, verified, and pruned by their digest
+	blobs, err := List(dir)
+	if err != nil {
+		t.Fatalf("Failed to list cache: %v", err)
+	}
+	digests := map[string]bool{}
+	for _, blob := range blobs {
+		digests[blob.Digest] = true
+	}
+	if len(blobs) != 2 || !digests[diffID.String()] || !digests[otherDiffID.String()] {
+		t.Errorf("Expected layers %s and %s to be listed but got %v", diffID, otherDiffID, blobs)
+	}
+	checked, removed, err := Verify(dir)
+	if err != nil || len(checked) != 2 || len(removed) != 0 {
+		t.Errorf("Expected 2 blobs to be verified and none removed but got %v, %v, %v", checked, removed, err)
+	}
+	if removed, err = Prune(dir, time.Time{}); err != nil || len(removed) != 2 {
+		t.Errorf("Expected 2 blobs to be pruned but got %v, %v", removed, err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".lock") {
+				t.Errorf("Expected pruned blob %s to be removed", entry.Name())
+			}
+		}
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	for _, c := range []compression.Compression{compression.None, compression.ZStd} {
+		b.Run(string(c), func(b *testing.B) {
+			dir := b.TempDir()
+			fc := NewFilesystemCache(dir, WithCompression(c))
+			layer := textLayer(b, 8<<20)
+			diffID, _ := layer.DiffID()
+			cached, err := fc.Put(layer)
+			if err != nil {
+				b.Fatalf("Failed to cache layer: %v", err)
+			}
+			if err := readAll(cached); err != nil {
+				b.Fatalf("Failed to read layer: %v", err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cached, err := fc.Get(diffID)
+				if err != nil {
+					b.Fatalf("Failed to get cached layer: %v", err)
+				}
+				if err := readAll(cached); err != nil {
+					b.Fatalf("Failed to read cached layer: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// textLayer returns a layer with a file of compressible text of about the size.
+func textLayer(t testing.TB, size int) v1.Layer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	line := "the quick brown fox jumps over the lazy dog\n"
+	content := strings.Repeat(line, size/len(line))
+	if err := tw.WriteHeader(&tar.Header{Name: "text", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("Failed to write layer: %v", err)
+	}
+	if _, err := io.WriteString(tw, content); err != nil {
+		t.Fatalf("Failed to write layer: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to write layer: %v", err)
+	}
+	b := buf.Bytes()
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	return layer
+}
+
+// layerContent returns the uncompressed content of the layer.
+func layerContent(t testing.TB, layer v1.Layer) []byte {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	return b
+}
@@ -0,0 +1,174 @@
+// Package logging defines the logger that wharfie's packages log to, so that programs that embed wharfie can send
+// its logs to their own logger instead of the standard logrus logger. By default, the packages log to the standard
+// logrus logger, as the wharfie command does.
+package logging
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields are structured fields attached to log messages, such as the image or endpoint that a message is about.
+// Errors are attached under the "error" key.
+type Fields map[string]interface{}
+
+// Logger is the logger that wharfie's packages log to. Implementations decide which levels are written; messages
+// are formatted as for fmt.Sprintf.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	// WithFields returns a logger that attaches the fields to each message, along with those already attached.
+	WithFields(fields Fields) Logger
+}
+
+// Default returns a logger that logs to the standard logrus logger, at its level.
+func Default() Logger {
+	return Logrus(logrus.StandardLogger())
+}
+
+// Logrus returns a logger that logs to the logrus logger or entry.
+func Logrus(logger logrus.FieldLogger) Logger {
+	return logrusLogger{logger: logger}
+}
+
+// OrDefault returns the logger, or the default logger if it is nil.
+func OrDefault(logger Logger) Logger {
+	if logger == nil {
+		return Default()
+	}
+	return logger
+}
+
+// logrusLogger adapts a logrus logger.
+type logrusLogger struct {
+	logger logrus.FieldLogger
+}
+
+func (l logrusLogger) Debugf(format string, args ...interface{}) {
+	l.logger.Debugf(format, args...)
+}
+
+func (l logrusLogger) Infof(format string, args ...interface{}) {
+	l.logger.Infof(format, args...)
+}
+
+func (l logrusLogger) Warnf(format string, args ...interface{}) {
+	l.logger.Warnf(format, args...)
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{logger: l.logger.WithFields(logrus.Fields(fields))}
+}
+
+// Discard returns a logger that discards all messages.
+func Discard() Logger {
+	return discard{}
+}
+
+// discard discards all messages.
+type discard struct{}
+
+func (discard) Debugf(string, ...interface{}) {}
+func (discard) Infof(string, ...interface{})  {}
+func (discard) Warnf(string, ...interface{})  {}
+func (discard) WithFields(Fields) Logger      { return discard{} }
+
+// Level is the level that a message was logged at.
+type Level string
+
+const (
+	LevelDebug Level = "debug"
+	LevelInfo  Level = "info"
+	LevelWarn  Level = "warn"
+)
+
+// Entry is a message recorded by a Recorder.
+type Entry struct {
+	Level   Level
+	Message string
+	Fields  Fields
+}
+
+// Recorder is a logger that records all of the messages logged to it, and to the loggers returned by its WithFields,
+// so that tests can check what was logged. It is safe to use from multiple goroutines.
+type Recorder struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+var _ Logger = &Recorder{}
+
+// Entries returns the messages recorded so far, in the order they were logged.
+func (r *Recorder) Entries() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Entry{}, r.entries...)
+}
+
+// Find returns the first recorded message at the level with the message, or false if there is none.
+func (r *Recorder) Find(level Level, message string) (Entry, bool) {
+	for _, entry := range r.Entries() {
+		if entry.Level == level && entry.Message == message {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
+
+func (r *Recorder) Debugf(format string, args ...interface{}) {
+	r.record(LevelDebug, nil, format, args)
+}
+
+func (r *Recorder) Infof(format string, args ...interface{}) {
+	r.record(LevelInfo, nil, format, args)
+}
+
+func (r *Recorder) Warnf(format string, args ...interface{}) {
+	r.record(LevelWarn, nil, format, args)
+}
+
+func (r *Recorder) WithFields(fields Fields) Logger {
+	return (&recorderEntry{recorder: r}).WithFields(fields)
+}
+
+// record records a message with the fields.
+func (r *Recorder) record(level Level, fields Fields, format string, args []interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if fields == nil {
+		fields = Fields{}
+	}
+	r.entries = append(r.entries, Entry{Level: level, Message: fmt.Sprintf(format, args...), Fields: fields})
+}
+
+// recorderEntry records messages to a Recorder with fields attached.
+type recorderEntry struct {
+	recorder *Recorder
+	fields   Fields
+}
+
+func (e *recorderEntry) Debugf(format string, args ...interface{}) {
+	e.recorder.record(LevelDebug, e.fields, format, args)
+}
+
+func (e *recorderEntry) Infof(format string, args ...interface{}) {
+	e.recorder.record(LevelInfo, e.fields, format, args)
+}
+
+func (e *recorderEntry) Warnf(format string, args ...interface{}) {
+	e.recorder.record(LevelWarn, e.fields, format, args)
+}
+
+func (e *recorderEntry) WithFields(fields Fields) Logger {
+	merged := Fields{}
+	for k, v := range e.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &recorderEntry{recorder: e.recorder, fields: merged}
+}
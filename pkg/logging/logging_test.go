@@ -0,0 +1,71 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogrus(t *testing.T) {
+	output := &bytes.Buffer{}
+	logger := logrus.New()
+	logger.SetOutput(output)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.SetLevel(logrus.InfoLevel)
+
+	l := Logrus(logger).WithFields(Fields{"image": "busybox"})
+	l.Debugf("Not logged at info level")
+	l.WithFields(Fields{"error": errors.New("failed")}).Warnf("Failed to pull %s", "busybox")
+
+	if lines := bytes.Count(output.Bytes(), []byte("\n")); lines != 1 {
+		t.Fatalf("Expected a single message to be logged, got %s", output)
+	}
+	event := map[string]interface{}{}
+	if err := json.NewDecoder(output).Decode(&event); err != nil {
+		t.Fatalf("Failed to decode log output: %v", err)
+	}
+	expected := map[string]interface{}{"level": "warning", "msg": "Failed to pull busybox", "image": "busybox", "error": "failed"}
+	delete(event, "time")
+	if !reflect.DeepEqual(event, expected) {
+		t.Errorf("Expected %v to be logged, got %v", expected, event)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	recorder := &Recorder{}
+	fields := Fields{"image": "busybox"}
+	logger := recorder.WithFields(fields)
+	recorder.Infof("Pulling %d images", 2)
+	logger.WithFields(Fields{"path": "bin/sh"}).Debugf("Extracting file")
+	logger.Warnf("Failed to verify file")
+	// the fields that were given are copied
+	fields["image"] = "changed"
+
+	expected := []Entry{
+		{Level: LevelInfo, Message: "Pulling 2 images", Fields: Fields{}},
+		{Level: LevelDebug, Message: "Extracting file", Fields: Fields{"image": "busybox", "path": "bin/sh"}},
+		{Level: LevelWarn, Message: "Failed to verify file", Fields: Fields{"image": "busybox"}},
+	}
+	if entries := recorder.Entries(); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %v to be recorded, got %v", expected, entries)
+	}
+	if entry, ok := recorder.Find(LevelDebug, "Extracting file"); !ok || entry.Fields["path"] != "bin/sh" {
+		t.Errorf("Expected to find the extracted file, got %v", entry)
+	}
+	if _, ok := recorder.Find(LevelInfo, "Extracting file"); ok {
+		t.Errorf("Expected not to find the extracted file at info level")
+	}
+}
+
+func TestOrDefault(t *testing.T) {
+	if _, ok := OrDefault(nil).(logrusLogger); !ok {
+		t.Errorf("Expected the default logger to log to logrus")
+	}
+	if logger := OrDefault(Discard()); logger != Discard() {
+		t.Errorf("Expected the given logger to be returned")
+	}
+}
@@ -0,0 +1,216 @@
+// Package policy enforces an image policy file, which lists the registries and repositories that images may be pulled
+// from, and those whose images must be signed with cosign. Images are matched by the reference they were requested
+// with, before any mirror or rewrite is applied.
+package policy
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/registries"
+	"gopkg.in/yaml.v2"
+)
+
+// Action is what a rule, or the policy's default, does with the images that it applies to.
+type Action string
+
+const (
+	// Allow allows images to be pulled, if they have the signatures that the rule requires.
+	Allow Action = "allow"
+	// Deny refuses to pull images, before any registry is contacted.
+	Deny Action = "deny"
+)
+
+// ErrViolation is matched by the errors returned for images that the policy does not allow.
+var ErrViolation = errors.New("image policy violation")
+
+// Violation is returned for an image that the policy does not allow. It matches ErrViolation.
+type Violation struct {
+	Image string
+	// Rule describes the rule that applied to the image, or is "default" if none of the rules matched.
+	Rule   string
+	Reason string
+}
+
+func (e *Violation) Error() string {
+	return fmt.Sprintf("image %s is not allowed by image policy rule %s: %s", e.Image, e.Rule, e.Reason)
+}
+
+func (e *Violation) Is(target error) bool {
+	return target == ErrViolation
+}
+
+// Policy is an image policy file. The rules are matched against each image in order, and the first that matches
+// applies; the DefaultAction applies to images that none match.
+type Policy struct {
+	DefaultAction Action  `yaml:"defaultAction"`
+	Rules         []*Rule `yaml:"rules"`
+}
+
+// Rule is a rule of the image policy.
+type Rule struct {
+	// Match are the repositories that the rule applies to, as <registry>/<repository> globs, such as
+	// docker.io/library/*. * matches any part of a single path component, and ** any number of path components, so
+	// registry.example.com/** matches every repository of the registry. Docker Hub is docker.io.
+	Match  []string `yaml:"match"`
+	Action Action   `yaml:"action"`
+	// RequireSignature, which may only be set for rules that allow images, requires images to be signed by one of the
+	// cosign public keys.
+	RequireSignature *SignatureRequirement `yaml:"requireSignature"`
+
+	index int
+}
+
+// SignatureRequirement lists the cosign public keys, one of which must have signed an image.
+type SignatureRequirement struct {
+	// Keys are the paths of PEM encoded ECDSA, RSA, or Ed25519 public keys, relative to the policy file.
+	Keys []string `yaml:"keys"`
+
+	keys []crypto.PublicKey
+}
+
+// String describes the rule by its position and the repositories it matches.
+func (r *Rule) String() string {
+	if r == nil {
+		return "default"
+	}
+	return fmt.Sprintf("%d (%s)", r.index+1, strings.Join(r.Match, ", "))
+}
+
+// RequiresSignature returns true if images that the rule applies to must be signed. It returns false for a nil rule,
+// as the default action never requires signatures.
+func (r *Rule) RequiresSignature() bool {
+	return r != nil && r.RequireSignature != nil
+}
+
+// Load reads the image policy file, and the public keys that it refers to, and checks that it is valid.
+func Load(file string) (*Policy, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read image policy")
+	}
+	p := &Policy{}
+	if err := yaml.UnmarshalStrict(b, p); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse image policy %s", file)
+	}
+	if err := p.load(filepath.Dir(file)); err != nil {
+		return nil, errors.Wrapf(err, "invalid image policy %s", file)
+	}
+	return p, nil
+}
+
+// load checks the policy, and loads the public keys of its rules from paths relative to the directory.
+func (p *Policy) load(dir string) error {
+	if p.DefaultAction != Allow && p.DefaultAction != Deny {
+		return fmt.Errorf("defaultAction must be %s or %s, not %q", Allow, Deny, p.DefaultAction)
+	}
+	for i, rule := range p.Rules {
+		if rule == nil {
+			return fmt.Errorf("rule %d is empty", i+1)
+		}
+		rule.index = i
+		if len(rule.Match) == 0 {
+			return fmt.Errorf("rule %d does not match any repositories", i+1)
+		}
+		for _, pattern := range rule.Match {
+			if _, err := matchGlob(pattern, ""); err != nil {
+				return errors.Wrapf(err, "rule %d has invalid match %q", i+1, pattern)
+			}
+		}
+		if rule.Action != Allow && rule.Action != Deny {
+			return fmt.Errorf("rule %d action must be %s or %s, not %q", i+1, Allow, Deny, rule.Action)
+		}
+		if rule.RequireSignature == nil {
+			continue
+		}
+		if rule.Action != Allow {
+			return fmt.Errorf("rule %d requires signatures, but does not allow images", i+1)
+		}
+		if len(rule.RequireSignature.Keys) == 0 {
+			return fmt.Errorf("rule %d requires signatures, but has no keys", i+1)
+		}
+		for _, key := range rule.RequireSignature.Keys {
+			if !filepath.IsAbs(key) {
+				key = filepath.Join(dir, key)
+			}
+			publicKey, err := loadPublicKey(key)
+			if err != nil {
+				return errors.Wrapf(err, "rule %d", i+1)
+			}
+			rule.RequireSignature.keys = append(rule.RequireSignature.keys, publicKey)
+		}
+	}
+	return nil
+}
+
+// Check returns the rule that applies to the image, or nil if the default action applies, and a *Violation if the
+// image is denied. The signatures that the rule requires are not checked; Verify checks them once the digest of the
+// image is known. A nil policy allows all images.
+func (p *Policy) Check(ref name.Reference) (*Rule, error) {
+	if p == nil {
+		return nil, nil
+	}
+	target := repository(ref)
+	for _, rule := range p.Rules {
+		for _, pattern := range rule.Match {
+			if ok, _ := matchGlob(pattern, target); !ok {
+				continue
+			}
+			if rule.Action == Deny {
+				return rule, &Violation{Image: ref.Name(), Rule: rule.String(), Reason: "denied"}
+			}
+			return rule, nil
+		}
+	}
+	if p.DefaultAction == Deny {
+		return nil, &Violation{Image: ref.Name(), Rule: "default", Reason: "not allowed by any rule"}
+	}
+	return nil, nil
+}
+
+// repository returns the repository of the reference in the form that rules match: the normalized registry host,
+// followed by the repository.
+func repository(ref name.Reference) string {
+	return registries.NormalizeHost(ref.Context().RegistryStr()) + "/" + ref.Context().RepositoryStr()
+}
+
+// matchGlob returns true if the path matches the glob, where ** matches any number of path components, and each
+// other component is matched as by path.Match. An error is returned if the glob is malformed.
+func matchGlob(glob, target string) (bool, error) {
+	patterns := strings.Split(glob, "/")
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return false, errors.New("empty path component")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return false, err
+		}
+	}
+	return matchComponents(patterns, strings.Split(target, "/")), nil
+}
+
+// matchComponents returns true if the path components match the patterns.
+func matchComponents(patterns, components []string) bool {
+	if len(patterns) == 0 {
+		return len(components) == 0
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(components); i++ {
+			if matchComponents(patterns[1:], components[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(components) == 0 {
+		return false
+	}
+	ok, _ := path.Match(patterns[0], components[0])
+	return ok && matchComponents(patterns[1:], components[1:])
+}
@@ -0,0 +1,296 @@
+package policy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+// writePolicy writes the policy file, and the public keys of the signers as <name>.pub, to a directory, and returns
+// the path of the policy file.
+func writePolicy(t *testing.T, policy string, signers map[string]crypto.Signer) string {
+	t.Helper()
+	dir := t.TempDir()
+	for keyName, signer := range signers {
+		b, err := x509.MarshalPKIXPublicKey(signer.Public())
+		if err != nil {
+			t.Fatalf("Failed to encode public key: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, keyName+".pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: b}), 0644); err != nil {
+			t.Fatalf("Failed to write public key: %v", err)
+		}
+	}
+	path := filepath.Join(dir, "policy.yaml")
+	if err := os.WriteFile(path, []byte(policy), 0644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	return path
+}
+
+// signatureImage returns a cosign signature image with a signature of the digest by the signer, as cosign sign
+// pushes it.
+func signatureImage(t *testing.T, digest v1.Hash, signer crypto.Signer) v1.Image {
+	t.Helper()
+	payload := fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"registry.example.com/team/app"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, digest)
+	var sig []byte
+	var err error
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		sig, err = signer.Sign(rand.Reader, []byte(payload), crypto.Hash(0))
+	} else {
+		hash := sha256.Sum256([]byte(payload))
+		sig, err = signer.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign payload: %v", err)
+	}
+	img, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer([]byte(payload), types.MediaType("application/vnd.dev.cosign.simplesigning.v1+json")),
+		Annotations: map[string]string{SignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create signature image: %v", err)
+	}
+	return img
+}
+
+func TestLoad(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	tests := map[string]struct {
+		policy string
+		err    string
+	}{
+		"valid": {
+			policy: "defaultAction: deny\nrules:\n- match: [\"docker.io/**\"]\n  action: allow\n  requireSignature:\n    keys: [cosign.pub]\n",
+		},
+		"no default action": {
+			policy: "rules: []\n",
+			err:    `defaultAction must be allow or deny, not ""`,
+		},
+		"unknown field": {
+			policy: "defaultAction: allow\nrule: []\n",
+			err:    "field rule not found",
+		},
+		"no match": {
+			policy: "defaultAction: allow\nrules:\n- action: deny\n",
+			err:    "rule 1 does not match any repositories",
+		},
+		"invalid match": {
+			policy: "defaultAction: allow\nrules:\n- match: [\"docker.io/[\"]\n  action: deny\n",
+			err:    `rule 1 has invalid match "docker.io/["`,
+		},
+		"invalid action": {
+			policy: "defaultAction: allow\nrules:\n- match: [\"docker.io/**\"]\n  action: warn\n",
+			err:    `rule 1 action must be allow or deny, not "warn"`,
+		},
+		"signature required for denied images": {
+			policy: "defaultAction: allow\nrules:\n- match: [\"docker.io/**\"]\n  action: deny\n  requireSignature:\n    keys: [cosign.pub]\n",
+			err:    "rule 1 requires signatures, but does not allow images",
+		},
+		"signature required without keys": {
+			policy: "defaultAction: allow\nrules:\n- match: [\"docker.io/**\"]\n  action: allow\n  requireSignature: {}\n",
+			err:    "rule 1 requires signatures, but has no keys",
+		},
+		"missing key": {
+			policy: "defaultAction: allow\nrules:\n- match: [\"docker.io/**\"]\n  action: allow\n  requireSignature:\n    keys: [missing.pub]\n",
+			err:    "rule 1: failed to read public key",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			_, err := Load(writePolicy(t, test.policy, map[string]crypto.Signer{"cosign": key}))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error containing %q but got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to load policy: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p, err := Load(writePolicy(t, `defaultAction: deny
+rules:
+- match: ["docker.io/library/untrusted"]
+  action: deny
+- match: ["registry.example.com/**", "docker.io/library/*"]
+  action: allow
+- match: ["*.example.org:5000/team/*"]
+  action: allow
+`, nil))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	tests := map[string]struct {
+		image string
+		rule  string
+		err   string
+	}{
+		"allowed registry": {
+			image: "registry.example.com/team/app:v1",
+			rule:  "2 (registry.example.com/**, docker.io/library/*)",
+		},
+		"allowed Docker Hub repository": {
+			image: "busybox",
+			rule:  "2 (registry.example.com/**, docker.io/library/*)",
+		},
+		"allowed by digest": {
+			image: "index.docker.io/library/busybox@sha256:" + strings.Repeat("0", 64),
+			rule:  "2 (registry.example.com/**, docker.io/library/*)",
+		},
+		"allowed with wildcard host": {
+			image: "registry.example.org:5000/team/app:v1",
+			rule:  "3 (*.example.org:5000/team/*)",
+		},
+		"denied by rule": {
+			image: "docker.io/library/untrusted:latest",
+			err:   "image index.docker.io/library/untrusted:latest is not allowed by image policy rule 1 (docker.io/library/untrusted): denied",
+		},
+		"denied by default": {
+			image: "docker.io/rancher/rke2-runtime:v1.29.9-rke2r1",
+			err:   "image index.docker.io/rancher/rke2-runtime:v1.29.9-rke2r1 is not allowed by image policy rule default: not allowed by any rule",
+		},
+		"single component wildcard": {
+			image: "registry.example.org:5000/team/app/sidecar:v1",
+			err:   "not allowed by any rule",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			ref, err := name.ParseReference(test.image)
+			if err != nil {
+				t.Fatalf("Failed to parse reference: %v", err)
+			}
+			rule, err := p.Check(ref)
+			if test.err != "" {
+				if !errors.Is(err, ErrViolation) || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected violation containing %q but got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected image to be allowed but got %v", err)
+			}
+			if rule.String() != test.rule {
+				t.Errorf("Expected rule %s to apply but got %s", test.rule, rule)
+			}
+		})
+	}
+
+	var nilPolicy *Policy
+	if rule, err := nilPolicy.Check(name.MustParseReference("busybox")); rule != nil || err != nil {
+		t.Errorf("Expected nil policy to allow all images, but got %v, %v", rule, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	p, err := Load(writePolicy(t, `defaultAction: allow
+rules:
+- match: ["docker.io/**"]
+  action: allow
+  requireSignature:
+    keys: [ecdsa.pub, rsa.pub, ed25519.pub]
+`, map[string]crypto.Signer{"ecdsa": ecdsaKey, "rsa": rsaKey, "ed25519": ed25519Key}))
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+	ref := name.MustParseReference("docker.io/library/busybox:latest")
+	rule, err := p.Check(ref)
+	if err != nil || !rule.RequiresSignature() {
+		t.Fatalf("Expected rule requiring signatures but got %v, %v", rule, err)
+	}
+	digest, _ := v1.NewHash("sha256:" + strings.Repeat("a", 64))
+	otherDigest, _ := v1.NewHash("sha256:" + strings.Repeat("b", 64))
+
+	tests := map[string]struct {
+		signatures v1.Image
+		err        string
+	}{
+		"signed with ECDSA key": {
+			signatures: signatureImage(t, digest, ecdsaKey),
+		},
+		"signed with RSA key": {
+			signatures: signatureImage(t, digest, rsaKey),
+		},
+		"signed with Ed25519 key": {
+			signatures: signatureImage(t, digest, ed25519Key),
+		},
+		"signed with other key": {
+			signatures: signatureImage(t, digest, otherKey),
+			err:        "no valid signature of digest " + digest.String(),
+		},
+		"signature of other digest": {
+			signatures: signatureImage(t, otherDigest, ecdsaKey),
+			err:        "no valid signature of digest " + digest.String(),
+		},
+		"no signatures": {
+			err: "no signatures found for digest " + digest.String(),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			err := rule.Verify(ref, digest, test.signatures)
+			if test.err != "" {
+				if !errors.Is(err, ErrViolation) || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected violation containing %q but got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Expected signature to be verified but got %v", err)
+			}
+		})
+	}
+
+	if tag := SignatureTag(ref, digest); tag.String() != "index.docker.io/library/busybox:sha256-"+digest.Hex+".sig" {
+		t.Errorf("Expected signature tag in the repository of the image, but got %s", tag)
+	}
+}
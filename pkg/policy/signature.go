@@ -0,0 +1,151 @@
+package policy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SignatureAnnotation is the annotation of the layers of a cosign signature image that holds the base64 encoded
+	// signature of the layer.
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// signatureType is the type of the simple signing payloads that cosign signs.
+	signatureType = "cosign container image signature"
+)
+
+// payload is the simple signing payload of a cosign signature, which names the digest that was signed.
+type payload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// SignatureTag returns the tag that cosign stores the signatures of the image with the digest under, in the repository
+// of the reference.
+func SignatureTag(ref name.Reference, digest v1.Hash) name.Tag {
+	return ref.Context().Tag(fmt.Sprintf("%s-%s.sig", digest.Algorithm, digest.Hex))
+}
+
+// Verify returns nil if the rule does not require signatures, or if the signatures, the image stored under the
+// SignatureTag of the image with the digest, include a signature of the digest by one of the rule's keys. Otherwise,
+// it returns a *Violation, including when signatures is nil because the image has no signatures.
+func (r *Rule) Verify(ref name.Reference, digest v1.Hash, signatures v1.Image) error {
+	if !r.RequiresSignature() {
+		return nil
+	}
+	violation := &Violation{Image: ref.Name(), Rule: r.String()}
+	if signatures == nil {
+		violation.Reason = fmt.Sprintf("no signatures found for digest %s", digest)
+		return violation
+	}
+	manifest, err := signatures.Manifest()
+	if err != nil {
+		return errors.Wrapf(err, "failed to read signatures of image %s", ref.Name())
+	}
+	for _, layer := range manifest.Layers {
+		signature, ok := layer.Annotations[SignatureAnnotation]
+		if !ok {
+			continue
+		}
+		b, err := readBlob(signatures, layer.Digest)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read signatures of image %s", ref.Name())
+		}
+		if r.RequireSignature.verify(b, signature, digest) {
+			return nil
+		}
+	}
+	violation.Reason = fmt.Sprintf("no valid signature of digest %s by any of the keys %v", digest, r.RequireSignature.Keys)
+	return violation
+}
+
+// verify returns true if the base64 encoded signature of the payload was made by one of the keys, and the payload is
+// a cosign signature of the digest.
+func (s *SignatureRequirement) verify(b []byte, signature string, digest v1.Hash) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	verified := false
+	for _, key := range s.keys {
+		if verifySignature(key, b, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return false
+	}
+	p := payload{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return false
+	}
+	return p.Critical.Type == signatureType && p.Critical.Image.DockerManifestDigest == digest.String()
+}
+
+// verifySignature returns true if the signature of the message was made by the public key, as cosign signs: with
+// ECDSA or RSA PKCS #1 v1.5 signatures of the SHA-256 hash of the message, or with Ed25519 signatures of the message.
+func verifySignature(key crypto.PublicKey, message, sig []byte) bool {
+	hash := sha256.Sum256(message)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, hash[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, message, sig)
+	}
+	return false
+}
+
+// readBlob returns the contents of the layer of the image with the digest.
+func readBlob(img v1.Image, digest v1.Hash) ([]byte, error) {
+	layer, err := img.LayerByDigest(digest)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// loadPublicKey reads the PEM encoded public key from the file.
+func loadPublicKey(file string) (crypto.PublicKey, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read public key")
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("public key %s is not a PEM encoded public key", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse public key %s", file)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("public key %s has unsupported type %T", file, key)
+}
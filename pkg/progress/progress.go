@@ -0,0 +1,81 @@
+// Package progress reports how much of each layer of an image has been read, so that callers can display the
+// progress of long downloads. It sends the layer events of the events package as updates on a channel provided by the
+// caller, until the caller closes its done channel; updates are sent at most once per events.ProgressInterval.
+package progress
+
+import (
+	"io"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/rancher/wharfie/pkg/events"
+)
+
+// Update reports the number of bytes read from a layer.
+type Update struct {
+	// Layer is the digest or diff ID of the layer.
+	Layer v1.Hash
+	// Complete is the number of bytes read so far.
+	Complete int64
+	// Total is the size of the layer from its manifest descriptor, or 0 if it is not known.
+	Total int64
+	// Cached is set if the layer is being read from the layer cache rather than downloaded.
+	Cached bool
+	// Done is set on the final update for the layer, once the reader has been closed.
+	Done bool
+}
+
+// Handler returns a handler that sends the layer events it receives as updates on the channel, until done is closed.
+// The final update for a layer is sent when its reader is closed, so the channel must be drained until all readers
+// are closed or done is closed; other updates are dropped if the channel is not ready, so that a slow consumer does
+// not slow the download. Readers may be closed asynchronously after the consumer has stopped, such as when
+// extraction is aborted, so the final update is dropped once done is closed rather than blocking.
+func Handler(updates chan<- Update, done <-chan struct{}) events.Handler {
+	return events.HandlerFunc(func(event events.Event) {
+		switch e := event.(type) {
+		case events.LayerPullStarted:
+			send(updates, done, newUpdate(e.Layer, false), false)
+		case events.LayerPullProgress:
+			send(updates, done, newUpdate(e.Layer, false), false)
+		case events.LayerPullFinished:
+			send(updates, done, newUpdate(e.Layer, true), true)
+		}
+	})
+}
+
+// newUpdate returns the update for the layer.
+func newUpdate(layer events.Layer, done bool) Update {
+	return Update{Layer: layer.Digest, Complete: layer.Complete, Total: layer.Size, Cached: layer.Cached, Done: done}
+}
+
+func send(updates chan<- Update, done <-chan struct{}, update Update, wait bool) {
+	if wait {
+		select {
+		case updates <- update:
+		case <-done:
+		}
+		return
+	}
+	select {
+	case updates <- update:
+	default:
+	}
+}
+
+// NewReader returns a reader that counts the bytes read from rc, and sends updates for the layer to updates until
+// done is closed.
+func NewReader(rc io.ReadCloser, layer v1.Hash, total int64, cached bool, updates chan<- Update, done <-chan struct{}) io.ReadCloser {
+	return events.NewReader(rc, events.Layer{Digest: layer, Size: total, Cached: cached}, Handler(updates, done))
+}
+
+// Image returns an image whose layers send updates as their compressed content is downloaded, as events.Image does.
+// This should wrap the remote image, beneath any layer cache.
+func Image(img v1.Image, updates chan<- Update, done <-chan struct{}) v1.Image {
+	return events.Image(img, "", Handler(updates, done))
+}
+
+// Cache returns a cache whose cached layers send updates as they are read. The size of cached layers is not known
+// without reading them, so updates for cached layers have no total.
+func Cache(c cache.Cache, updates chan<- Update, done <-chan struct{}) cache.Cache {
+	return events.Cache(c, "", Handler(updates, done))
+}
@@ -0,0 +1,137 @@
+package progress
+
+import (
+	"io"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+)
+
+// readLayer reads the layer content to completion, and returns the updates sent while reading it.
+func readLayer(t *testing.T, updates chan Update, open func() (io.ReadCloser, error)) []Update {
+	t.Helper()
+	rc, err := open()
+	if err != nil {
+		t.Fatalf("Failed to open layer: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Failed to close layer: %v", err)
+	}
+	sent := []Update{}
+	for len(updates) > 0 {
+		sent = append(sent, <-updates)
+	}
+	if len(sent) == 0 || !sent[len(sent)-1].Done {
+		t.Fatalf("Expected final update to be sent, but got %v", sent)
+	}
+	for i := 1; i < len(sent); i++ {
+		if sent[i].Complete < sent[i-1].Complete {
+			t.Errorf("Expected progress not to go backwards, but got %d after %d", sent[i].Complete, sent[i-1].Complete)
+		}
+	}
+	return sent
+}
+
+func TestImage(t *testing.T) {
+	img, err := random.Image(64*1024, 3)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	updates := make(chan Update, 1024)
+	layers, err := Image(img, updates, nil).Layers()
+	if err != nil {
+		t.Fatalf("Failed to get layers: %v", err)
+	}
+
+	for _, layer := range layers {
+		digest, _ := layer.Digest()
+		size, _ := layer.Size()
+
+		// the total is the compressed size whichever content is read, and the count matches it once read
+		for _, open := range []func() (io.ReadCloser, error){layer.Compressed, layer.Uncompressed} {
+			sent := readLayer(t, updates, open)
+			final := sent[len(sent)-1]
+			if final.Layer != digest {
+				t.Errorf("Expected update for layer %s but got %s", digest, final.Layer)
+			}
+			if final.Total != size || final.Complete != size {
+				t.Errorf("Expected %d of %d bytes for layer %s but got %d of %d", size, size, digest, final.Complete, final.Total)
+			}
+			if final.Cached {
+				t.Errorf("Expected layer %s not to be reported as cached", digest)
+			}
+		}
+
+		// the diff ID is taken from the image, not computed from the content
+		diffID, _ := layer.DiffID()
+		if expected, _ := partial.BlobToDiffID(img, digest); diffID != expected {
+			t.Errorf("Expected diff ID %s but got %s", expected, diffID)
+		}
+		if len(updates) > 0 {
+			t.Errorf("Expected no updates for the diff ID of layer %s", digest)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	layer, err := random.Layer(64*1024, "")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	c := cache.NewFilesystemCache(t.TempDir())
+	cached, err := c.Put(layer)
+	if err != nil {
+		t.Fatalf("Failed to cache layer: %v", err)
+	}
+	rc, err := cached.Uncompressed()
+	if err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	_, size, err := v1.SHA256(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+
+	updates := make(chan Update, 1024)
+	diffID, _ := layer.DiffID()
+	cached, err = Cache(c, updates, nil).Get(diffID)
+	if err != nil {
+		t.Fatalf("Failed to get cached layer: %v", err)
+	}
+	sent := readLayer(t, updates, cached.Uncompressed)
+	final := sent[len(sent)-1]
+	if !final.Cached || final.Layer != diffID {
+		t.Errorf("Expected update for cached layer %s but got %+v", diffID, final)
+	}
+	if final.Complete != size {
+		t.Errorf("Expected %d bytes read from cache but got %d", size, final.Complete)
+	}
+}
+
+func TestCloseAfterDone(t *testing.T) {
+	layer, err := random.Layer(1024, "")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	rc, err := layer.Compressed()
+	if err != nil {
+		t.Fatalf("Failed to read layer: %v", err)
+	}
+	digest, _ := layer.Digest()
+
+	// nothing receives from the unbuffered channel, so the final update can only be dropped
+	updates := make(chan Update)
+	done := make(chan struct{})
+	r := NewReader(rc, digest, 1024, false, updates, done)
+	close(done)
+	if err := r.Close(); err != nil {
+		t.Fatalf("Failed to close layer: %v", err)
+	}
+}
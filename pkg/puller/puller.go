@@ -0,0 +1,362 @@
+// Package puller pulls images in the same way as the wharfie command: from local image tarballs if they have the
+// image, or else from a registry, reading layers through the layer cache if one is configured. Programs that embed
+// wharfie can use a Puller instead of reimplementing that order themselves, and add sources of their own by
+// implementing ImageSource.
+package puller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/events"
+	"github.com/rancher/wharfie/pkg/extract"
+	"github.com/rancher/wharfie/pkg/layercache"
+	"github.com/rancher/wharfie/pkg/logging"
+	"github.com/rancher/wharfie/pkg/policy"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/rancher/wharfie/pkg/tarfile"
+	"github.com/rancher/wharfie/pkg/util"
+)
+
+// Source is where a pulled image was found: one of the constants below, or the Name of an ImageSource.
+type Source string
+
+const (
+	// SourceTarball is a local image tarball in one of the images directories.
+	SourceTarball Source = "tarball"
+	// SourceCache is the layer cache, which had all of the layers of the image; the manifest and config were still
+	// read from the registry, unless the image was read by CacheSource.
+	SourceCache Source = "cache"
+	// SourceRegistry is a registry endpoint.
+	SourceRegistry Source = "registry"
+)
+
+// PullInfo describes where a pulled image was found, and what was pulled, so that programs can record what was
+// deployed without reading the image again.
+type PullInfo struct {
+	Source Source `json:"source"`
+	// Path is the local image tarball that the image was loaded from, for SourceTarball, or the layer cache
+	// directory, for images read by CacheSource.
+	Path string `json:"path,omitempty"`
+	// Endpoint is the URL of the registry endpoint that the manifest was read from, for SourceCache and
+	// SourceRegistry.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Digest is the digest that the reference resolved to: of the image index that the image was selected from, if
+	// the reference is an image index, or else of the image.
+	Digest v1.Hash `json:"digest"`
+	// Layers is the number of layers of the image, and Size their total compressed size, as listed in its manifest.
+	Layers int   `json:"layers"`
+	Size   int64 `json:"size"`
+}
+
+// SetManifest sets the number of layers and their total size from the manifest of the image.
+func (i *PullInfo) SetManifest(img v1.Image) error {
+	manifest, err := img.Manifest()
+	if err != nil {
+		return err
+	}
+	i.Layers, i.Size = len(manifest.Layers), 0
+	for _, layer := range manifest.Layers {
+		i.Size += layer.Size
+	}
+	return nil
+}
+
+// Registry is a registry that images are pulled from, such as a *registries.Client configured with the private
+// registry configuration.
+type Registry interface {
+	GetEndpoint(ref name.Reference, options ...remote.Option) (*remote.Descriptor, string, error)
+}
+
+// Puller pulls images from local image tarballs, the layer cache, and registries. All fields are optional; the zero
+// value pulls images from the registries that they name, without a layer cache. A Puller may be used concurrently,
+// but its fields must not be changed once it is in use.
+type Puller struct {
+	// Sources are the sources that images are pulled from, in order; each is tried in turn until one has the image.
+	// If it is nil, the DefaultSources are used. The sources returned by the Puller's methods use its other fields.
+	Sources []ImageSource
+	// ImagesDirs are the directories that are searched, in order, for a local image tarball with the image, before
+	// the registry is tried.
+	ImagesDirs []string
+	// Registry is the registry that images are pulled from when they are not found locally. If it is nil, images are
+	// pulled from the registries that they name, with default settings.
+	Registry Registry
+	// Keychain is the keychain that credentials are looked up in when Registry is nil. If it is also nil,
+	// authn.DefaultKeychain is used.
+	Keychain authn.Keychain
+	// Cache is the layer cache that layers pulled from the registry are read through. If it is nil, and CacheDir is
+	// set, the layer cache in CacheDir is opened with CacheOptions when first needed.
+	Cache        cache.Cache
+	CacheDir     string
+	CacheOptions []layercache.Option
+	// Platform is the platform that images are selected for, from image indexes and from local image tarballs.
+	Platform v1.Platform
+	// ReferenceOptions are the options that tags in local image tarballs are parsed with, such as the default
+	// registry that the references given to Pull were parsed with.
+	ReferenceOptions []name.Option
+	// RemoteOptions are added to the options of each request to the registry, such as a user agent, after the
+	// puller's own, so that they take precedence. Images are selected from image indexes for Platform, regardless of
+	// any remote.WithPlatform in them.
+	RemoteOptions []remote.Option
+	// Logger is the logger that the local image tarballs that are checked, the images selected from image indexes,
+	// and the files that are extracted are logged to. It is also used by the registry that is created when Registry
+	// is nil. If it is nil, the standard logrus logger is used.
+	Logger logging.Logger
+	// Events is the handler that the lifecycle events of the images that are pulled are sent to: EndpointSelected and
+	// ManifestResolved when an image is found, and the layer events as the layers of the images returned by the
+	// Puller's own sources are read. PullAndExtract also sends FileExtracted for the files that are extracted, and Done
+	// or Failed once it returns. If it is nil, no events are sent.
+	Events events.Handler
+	// Policy is the image policy that images must satisfy. Images that it denies are not looked for in any source,
+	// and the signatures that it requires are read from the registry and verified once the digest of the image is
+	// known, wherever the image was found. If it is nil, all images are allowed.
+	Policy *policy.Policy
+
+	once     sync.Once
+	cache    cache.Cache
+	registry Registry
+	err      error
+}
+
+// Pull returns the image for the reference from the first of the sources that has it, and describes where it was
+// found, including its size and number of layers. By default, that is the first local image tarball in the images
+// directories that has it, or else the registry, with its layers read through the layer cache. The image is not
+// read beyond its manifest and config; layers are only pulled, and cached, as they are read. If none of the sources
+// have the image, the error from the last source is returned; it matches ErrNotFound. Images that the Policy does not
+// allow return a *policy.Violation.
+func (p *Puller) Pull(ctx context.Context, ref name.Reference) (v1.Image, PullInfo, error) {
+	rule, err := p.Policy.Check(ref)
+	if err != nil {
+		return nil, PullInfo{}, err
+	}
+	var notFound error = &NotFoundError{Source: "any source", Ref: ref}
+	for _, source := range p.sources() {
+		img, info, err := getImage(ctx, source, ref, p.Platform)
+		if errors.Is(err, ErrNotFound) {
+			p.log().WithFields(logging.Fields{"image": ref.Name(), "source": source.Name()}).Debugf("Image not found in source")
+			notFound = err
+			continue
+		}
+		if err != nil {
+			return nil, PullInfo{}, err
+		}
+		if err := p.verifySignatures(ctx, ref, rule, info.Digest); err != nil {
+			return nil, PullInfo{}, err
+		}
+		if err := info.SetManifest(img); err != nil {
+			return nil, PullInfo{}, err
+		}
+		if info.Endpoint != "" {
+			events.Emit(p.Events, events.EndpointSelected{Image: ref.Name(), Endpoint: info.Endpoint})
+		}
+		events.Emit(p.Events, events.ManifestResolved{Image: ref.Name(), Digest: info.Digest, Layers: info.Layers, Size: info.Size})
+		return img, info, nil
+	}
+	return nil, PullInfo{}, notFound
+}
+
+// PullAndExtract pulls the image for the reference as Pull does, and extracts the directories of the image to the
+// destinations they are mapped to, as described for extract.ExtractDirs.
+func (p *Puller) PullAndExtract(ctx context.Context, ref name.Reference, dirs map[string]string, opts ...extract.Option) (PullInfo, error) {
+	info, err := p.pullAndExtract(ctx, ref, dirs, opts)
+	if err != nil {
+		events.Emit(p.Events, events.Failed{Image: ref.Name(), Err: err})
+		return info, err
+	}
+	events.Emit(p.Events, events.Done{Image: ref.Name()})
+	return info, nil
+}
+
+func (p *Puller) pullAndExtract(ctx context.Context, ref name.Reference, dirs map[string]string, opts []extract.Option) (PullInfo, error) {
+	img, info, err := p.Pull(ctx, ref)
+	if err != nil {
+		return PullInfo{}, err
+	}
+	opts = append([]extract.Option{extract.WithLogger(p.log()), extract.WithEvents(p.Events, ref.Name())}, opts...)
+	if err := extract.ExtractDirsContext(ctx, img, dirs, opts...); err != nil {
+		return info, errors.Wrapf(err, "failed to extract image %s", ref.Name())
+	}
+	return info, nil
+}
+
+// LocalImage returns the image for the reference from the first local image tarball in the images directories that
+// has a copy for the platform, and the path of the tarball, or nil if there are no images directories, or none of them
+// have the image. Scanning the tarballs stops when the context is done.
+func (p *Puller) LocalImage(ctx context.Context, ref name.Reference) (v1.Image, string, error) {
+	return p.localImage(ctx, ref, p.Platform)
+}
+
+// localImage returns the image for the reference and platform from the images directories, as LocalImage does.
+func (p *Puller) localImage(ctx context.Context, ref name.Reference, platform v1.Platform) (v1.Image, string, error) {
+	if len(p.ImagesDirs) == 0 {
+		return nil, "", nil
+	}
+	img, path, err := tarfile.FindPlatformImageFileInDirsContext(ctx, p.ImagesDirs, ref, platform, tarfile.WithReferenceOptions(p.ReferenceOptions...), tarfile.WithLogger(p.log()))
+	if err != nil && !errors.Is(err, tarfile.ErrNotFound) {
+		return nil, "", err
+	}
+	return img, path, nil
+}
+
+// RemoteImage returns the descriptor for the reference from the registry, the image for the platform, and the URL of
+// the registry endpoint that had it. The image that best matches the platform is selected from an image index, so
+// that a request for a variant that the index does not have can fall back to a compatible image. The layer cache is
+// not applied.
+func (p *Puller) RemoteImage(ctx context.Context, ref name.Reference) (*remote.Descriptor, v1.Image, string, error) {
+	return p.remoteImage(ctx, ref, p.Platform)
+}
+
+// remoteImage returns the descriptor and image for the reference and platform from the registry, as RemoteImage does.
+func (p *Puller) remoteImage(ctx context.Context, ref name.Reference, platform v1.Platform) (*remote.Descriptor, v1.Image, string, error) {
+	registry, err := p.getRegistry()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	options := append([]remote.Option{remote.WithContext(ctx), remote.WithPlatform(platform)}, p.RemoteOptions...)
+	desc, endpoint, err := registry.GetEndpoint(ref, options...)
+	if err != nil {
+		return nil, nil, "", errors.Wrapf(err, "failed to get image reference %s", ref.Name())
+	}
+	if !desc.MediaType.IsIndex() {
+		img, err := desc.Image()
+		return desc, img, endpoint, err
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	img, err := platformImage(index, platform, p.log())
+	if err != nil {
+		return nil, nil, "", errors.Wrapf(err, "failed to get image reference %s", ref.Name())
+	}
+	return desc, img, endpoint, nil
+}
+
+// VerifySignatures returns nil if the Policy does not require the image to be signed, or if it has a signature of the
+// digest, which is read from the registry, by one of the keys of the rule that applies to it. Otherwise, it returns a
+// *policy.Violation, or the error that the signatures could not be read with.
+func (p *Puller) VerifySignatures(ctx context.Context, ref name.Reference, digest v1.Hash) error {
+	rule, err := p.Policy.Check(ref)
+	if err != nil {
+		return err
+	}
+	return p.verifySignatures(ctx, ref, rule, digest)
+}
+
+// verifySignatures verifies the signatures of the image with the digest that the rule requires, as VerifySignatures
+// does.
+func (p *Puller) verifySignatures(ctx context.Context, ref name.Reference, rule *policy.Rule, digest v1.Hash) error {
+	if !rule.RequiresSignature() {
+		return nil
+	}
+	registry, err := p.getRegistry()
+	if err != nil {
+		return err
+	}
+	var signatures v1.Image
+	options := append([]remote.Option{remote.WithContext(ctx)}, p.RemoteOptions...)
+	desc, _, err := registry.GetEndpoint(policy.SignatureTag(ref, digest), options...)
+	if err == nil {
+		signatures, err = desc.Image()
+	} else if registries.IsNotFound(err) {
+		err = nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get signatures of image %s", ref.Name())
+	}
+	if err := rule.Verify(ref, digest, signatures); err != nil {
+		return err
+	}
+	p.log().WithFields(logging.Fields{"image": ref.Name(), "digest": digest.String()}).Infof("Verified signature of image")
+	return nil
+}
+
+// LayerCache returns the layer cache, opening the cache in CacheDir if Cache is not set, or nil if there is neither.
+func (p *Puller) LayerCache() (cache.Cache, error) {
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	return p.cache, nil
+}
+
+// PlatformImage returns the image in the image index that best matches the platform.
+func PlatformImage(index v1.ImageIndex, platform v1.Platform) (v1.Image, error) {
+	return platformImage(index, platform, logging.Default())
+}
+
+// platformImage returns the image in the image index that best matches the platform, logging the image selected.
+func platformImage(index v1.ImageIndex, platform v1.Platform, logger logging.Logger) (v1.Image, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	manifests := []v1.Descriptor{}
+	for _, m := range manifest.Manifests {
+		if m.MediaType.IsImage() {
+			manifests = append(manifests, m)
+		}
+	}
+	i := util.MatchPlatform(manifests, platform)
+	if i < 0 {
+		return nil, fmt.Errorf("no image for platform %s in index", platform.String())
+	}
+	logger.Debugf("Selected image %s for platform %s", manifests[i].Digest, manifests[i].Platform)
+	return index.Image(manifests[i].Digest)
+}
+
+// cached returns true if all of the layers of the image are in the layer cache directory.
+func (p *Puller) cached(img v1.Image) (bool, error) {
+	config, err := img.ConfigFile()
+	if err != nil {
+		return false, err
+	}
+	for _, diffID := range config.RootFS.DiffIDs {
+		if !layercache.Contains(p.CacheDir, diffID) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// getRegistry returns the registry, or a registry with default settings and the keychain if none was set.
+func (p *Puller) getRegistry() (Registry, error) {
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+	return p.registry, nil
+}
+
+// log returns the logger, or the default logger if none was set.
+func (p *Puller) log() logging.Logger {
+	return logging.OrDefault(p.Logger)
+}
+
+// init sets up the registry and layer cache that were not given, once.
+func (p *Puller) init() error {
+	p.once.Do(func() {
+		p.registry, p.cache = p.Registry, p.Cache
+		if p.registry == nil {
+			opts := []registries.Option{registries.WithLogger(p.log())}
+			if p.Keychain != nil {
+				opts = append(opts, registries.WithDefaultKeychain(p.Keychain))
+			}
+			registry, err := registries.New(nil, opts...)
+			if err != nil {
+				p.err = err
+				return
+			}
+			p.registry = registry
+		}
+		if p.cache == nil && p.CacheDir != "" {
+			p.cache = layercache.NewFilesystemCache(p.CacheDir, p.CacheOptions...)
+		}
+	})
+	return p.err
+}
@@ -0,0 +1,434 @@
+package puller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/events"
+	"github.com/rancher/wharfie/pkg/layercache"
+	"github.com/rancher/wharfie/pkg/policy"
+	"github.com/rancher/wharfie/pkg/registries/registrytest"
+)
+
+func TestPull(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	// the tarball and the registry have different images for the same tag
+	local, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	localDigest, _ := local.Digest()
+	remoteImg, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	remoteDigest, _ := remoteImg.Digest()
+	tag, _ := name.NewTag(u.Host + "/test/puller:v1")
+	otherTag := tag.Context().Tag("v2")
+	for _, tag := range []name.Tag{tag, otherTag} {
+		if err := remote.Write(tag, remoteImg); err != nil {
+			t.Fatalf("Failed to push image: %v", err)
+		}
+	}
+	imagesDir := t.TempDir()
+	if err := tarball.WriteToFile(filepath.Join(imagesDir, "images.tar"), tag, local); err != nil {
+		t.Fatalf("Failed to write image tarball: %v", err)
+	}
+
+	// the index has an image for each platform
+	amd64, _ := v1.ParsePlatform("linux/amd64")
+	arm64, _ := v1.ParsePlatform("linux/arm64")
+	armImg, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	armDigest, _ := armImg.Digest()
+	index := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: remoteImg, Descriptor: v1.Descriptor{Platform: amd64}},
+		mutate.IndexAddendum{Add: armImg, Descriptor: v1.Descriptor{Platform: arm64}},
+	)
+	indexDigest, _ := index.Digest()
+	indexTag, _ := name.NewTag(u.Host + "/test/puller:index")
+	if err := remote.WriteIndex(indexTag, index); err != nil {
+		t.Fatalf("Failed to push index: %v", err)
+	}
+
+	testCases := map[string]struct {
+		ref         name.Reference
+		imagesDirs  []string
+		platform    *v1.Platform
+		source      Source
+		digest      v1.Hash
+		imageDigest v1.Hash
+	}{
+		"local tarball": {
+			ref:         tag,
+			imagesDirs:  []string{imagesDir},
+			source:      SourceTarball,
+			digest:      localDigest,
+			imageDigest: localDigest,
+		},
+		"registry": {
+			ref:         tag,
+			source:      SourceRegistry,
+			digest:      remoteDigest,
+			imageDigest: remoteDigest,
+		},
+		"not in tarball": {
+			ref:         otherTag,
+			imagesDirs:  []string{imagesDir},
+			source:      SourceRegistry,
+			digest:      remoteDigest,
+			imageDigest: remoteDigest,
+		},
+		"index": {
+			ref:         indexTag,
+			platform:    arm64,
+			source:      SourceRegistry,
+			digest:      indexDigest,
+			imageDigest: armDigest,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			p := &Puller{ImagesDirs: tc.imagesDirs, CacheDir: t.TempDir()}
+			if tc.platform != nil {
+				p.Platform = *tc.platform
+			}
+			img, info, err := p.Pull(context.Background(), tc.ref)
+			if err != nil {
+				t.Fatalf("Failed to pull image: %v", err)
+			}
+			if info.Source != tc.source {
+				t.Errorf("Expected image from %s but got %s", tc.source, info.Source)
+			}
+			if info.Digest != tc.digest {
+				t.Errorf("Expected digest %s but got %s", tc.digest, info.Digest)
+			}
+			if digest, _ := img.Digest(); digest != tc.imageDigest {
+				t.Errorf("Expected image %s but got %s", tc.imageDigest, digest)
+			}
+			// the layer count and size are those of the image that was selected, not of the index
+			manifest, err := img.Manifest()
+			if err != nil {
+				t.Fatalf("Failed to read manifest: %v", err)
+			}
+			size := int64(0)
+			for _, layer := range manifest.Layers {
+				size += layer.Size
+			}
+			if info.Layers != len(manifest.Layers) || info.Size != size || size == 0 {
+				t.Errorf("Expected %d layers of %d bytes but got %+v", len(manifest.Layers), size, info)
+			}
+			switch tc.source {
+			case SourceTarball:
+				if info.Path != filepath.Join(imagesDir, "images.tar") || info.Endpoint != "" {
+					t.Errorf("Expected image from %s but got %+v", filepath.Join(imagesDir, "images.tar"), info)
+				}
+			case SourceRegistry:
+				if !strings.Contains(info.Endpoint, u.Host) || info.Path != "" {
+					t.Errorf("Expected image from endpoint for %s but got %+v", u.Host, info)
+				}
+			}
+		})
+	}
+}
+
+func TestPullAndExtract(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	tag, _ := name.NewTag(u.Host + "/test/extract:v1")
+	if err := remote.Write(tag, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+
+	// the first pull reads the layers from the registry into the cache, and the second finds them all there
+	dir := t.TempDir()
+	p := &Puller{CacheDir: filepath.Join(dir, "cache")}
+	for i, source := range []Source{SourceRegistry, SourceCache} {
+		destination := filepath.Join(dir, "extract", string(source))
+		info, err := p.PullAndExtract(context.Background(), tag, map[string]string{"/": destination})
+		if err != nil {
+			t.Fatalf("Failed to pull and extract image: %v", err)
+		}
+		if info.Source != source || !strings.Contains(info.Endpoint, u.Host) {
+			t.Errorf("Expected pull %d to be from %s of %s but got %+v", i+1, source, u.Host, info)
+		}
+		entries, err := os.ReadDir(destination)
+		if err != nil || len(entries) != 2 {
+			t.Errorf("Expected 2 files to be extracted but got %v, %v", entries, err)
+		}
+	}
+
+	layers, _ := img.Layers()
+	for _, layer := range layers {
+		diffID, _ := layer.DiffID()
+		if !layercache.Contains(filepath.Join(dir, "cache"), diffID) {
+			t.Errorf("Expected layer %s to be cached", diffID)
+		}
+	}
+}
+
+func TestPullEvents(t *testing.T) {
+	defer func(interval time.Duration) { events.ProgressInterval = interval }(events.ProgressInterval)
+	events.ProgressInterval = 0
+
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(64*1024, 3)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	tag, _ := name.NewTag(u.Host + "/test/events:v1")
+	if err := remote.Write(tag, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	digest, _ := img.Digest()
+
+	// the first pull downloads the layers into the cache, and the second reads them from it
+	dir := t.TempDir()
+	for _, cached := range []bool{false, true} {
+		recorder := &events.Recorder{}
+		p := &Puller{CacheDir: filepath.Join(dir, "cache"), Events: recorder}
+		destination := filepath.Join(dir, fmt.Sprintf("extract-%t", cached))
+		if _, err := p.PullAndExtract(context.Background(), tag, map[string]string{"/": destination}); err != nil {
+			t.Fatalf("Failed to pull and extract image: %v", err)
+		}
+		sent := recorder.Events()
+		if len(sent) < 3 {
+			t.Fatalf("Expected events for the pull but got %v", sent)
+		}
+
+		// the endpoint and manifest come first, and Done last
+		if e, ok := sent[0].(events.EndpointSelected); !ok || e.Image != tag.Name() || !strings.Contains(e.Endpoint, u.Host) {
+			t.Errorf("Expected endpoint for %s to be selected first but got %#v", u.Host, sent[0])
+		}
+		if e, ok := sent[1].(events.ManifestResolved); !ok || e.Digest != digest || e.Layers != 3 || e.Size == 0 {
+			t.Errorf("Expected manifest %s with 3 layers to be resolved but got %#v", digest, sent[1])
+		}
+		if e, ok := sent[len(sent)-1].(events.Done); !ok || e.Image != tag.Name() {
+			t.Errorf("Expected the pull to be done last but got %#v", sent[len(sent)-1])
+		}
+
+		// each layer is opened before it is read, progress never goes backwards, and every layer is closed
+		open := map[v1.Hash]int64{}
+		started, files := 0, 0
+		for _, event := range sent[2 : len(sent)-1] {
+			switch e := event.(type) {
+			case events.LayerPullStarted:
+				if _, ok := open[e.Digest]; ok {
+					t.Errorf("Expected layer %s to be opened once at a time", e.Digest)
+				}
+				if e.Image != tag.Name() || e.Cached != cached {
+					t.Errorf("Expected layer of %s with cached %t but got %#v", tag.Name(), cached, e)
+				}
+				if !cached && (e.Index < 1 || e.Index > 3 || e.Count != 3 || e.Size == 0) {
+					t.Errorf("Expected layer to be one of 3 with a size but got %#v", e)
+				}
+				open[e.Digest] = 0
+				started++
+			case events.LayerPullProgress:
+				complete, ok := open[e.Digest]
+				if !ok || e.Complete < complete {
+					t.Errorf("Expected progress of open layer %s not to go backwards but got %d after %d", e.Digest, e.Complete, complete)
+				}
+				open[e.Digest] = e.Complete
+			case events.LayerPullFinished:
+				complete, ok := open[e.Digest]
+				if !ok || e.Complete < complete {
+					t.Errorf("Expected open layer %s to be finished after %d bytes but got %d", e.Digest, complete, e.Complete)
+				}
+				if !cached && e.Complete != e.Size {
+					t.Errorf("Expected all %d bytes of layer %s to be read but got %d", e.Size, e.Digest, e.Complete)
+				}
+				delete(open, e.Digest)
+			case events.FileExtracted:
+				if started == 0 {
+					t.Errorf("Expected files to be extracted after layers are opened but got %#v", e)
+				}
+				if e.Image != tag.Name() || !strings.HasPrefix(e.Destination, destination) {
+					t.Errorf("Expected file of %s to be extracted to %s but got %#v", tag.Name(), destination, e)
+				}
+				files++
+			default:
+				t.Errorf("Unexpected event %#v", event)
+			}
+		}
+		if started < 3 || files == 0 || len(open) != 0 {
+			t.Errorf("Expected 3 layers to be read and closed, and files extracted, but got %d started, %d files, and %v open", started, files, open)
+		}
+	}
+
+	// a failed pull ends with Failed
+	recorder := &events.Recorder{}
+	p := &Puller{Events: recorder}
+	if _, err := p.PullAndExtract(context.Background(), tag.Context().Tag("missing"), map[string]string{"/": dir}); err == nil {
+		t.Fatalf("Expected pull of missing image to fail")
+	}
+	if sent := recorder.Events(); len(sent) != 1 {
+		t.Errorf("Expected only the failure to be sent but got %v", sent)
+	} else if e, ok := sent[0].(events.Failed); !ok || !errors.Is(e.Err, ErrNotFound) {
+		t.Errorf("Expected failure for missing image but got %#v", sent[0])
+	}
+}
+
+func TestPullPolicy(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	signed, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	unsigned, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	signedDigest, _ := signed.Digest()
+
+	// the signature is pushed as cosign sign does: a layer with the payload naming the digest, annotated with its
+	// signature, under a tag named after the digest
+	payload := fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"test/signed"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, signedDigest)
+	hash := sha256.Sum256([]byte(payload))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatalf("Failed to sign payload: %v", err)
+	}
+	signatures, err := mutate.Append(empty.Image, mutate.Addendum{
+		Layer:       static.NewLayer([]byte(payload), "application/vnd.dev.cosign.simplesigning.v1+json"),
+		Annotations: map[string]string{policy.SignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create signature image: %v", err)
+	}
+
+	server, err := registrytest.New(
+		registrytest.WithImage("test/signed:v1", signed),
+		registrytest.WithImage(fmt.Sprintf("test/signed:%s-%s.sig", signedDigest.Algorithm, signedDigest.Hex), signatures),
+		registrytest.WithImage("test/unsigned:v1", unsigned),
+		registrytest.WithImage("open/app:v1", unsigned),
+		registrytest.WithImage("denied/app:v1", unsigned),
+		registrytest.WithImage("other/app:v1", unsigned),
+	)
+	if err != nil {
+		t.Fatalf("Failed to start registry: %v", err)
+	}
+	defer server.Close()
+
+	dir := t.TempDir()
+	publicKey, _ := x509.MarshalPKIXPublicKey(key.Public())
+	if err := os.WriteFile(filepath.Join(dir, "cosign.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}), 0644); err != nil {
+		t.Fatalf("Failed to write public key: %v", err)
+	}
+	policyFile := filepath.Join(dir, "policy.yaml")
+	if err := os.WriteFile(policyFile, []byte(fmt.Sprintf(`defaultAction: deny
+rules:
+- match: ["%[1]s/denied/*"]
+  action: deny
+- match: ["%[1]s/open/*"]
+  action: allow
+- match: ["%[1]s/test/*"]
+  action: allow
+  requireSignature:
+    keys: [cosign.pub]
+`, server.Host())), 0644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	imagePolicy, err := policy.Load(policyFile)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	testCases := map[string]struct {
+		repository string
+		violation  string
+		// requested is set if the registry is contacted
+		requested bool
+	}{
+		"allowed": {
+			repository: "open/app",
+			requested:  true,
+		},
+		"signed": {
+			repository: "test/signed",
+			requested:  true,
+		},
+		"unsigned": {
+			repository: "test/unsigned",
+			violation:  "no signatures found for digest",
+			requested:  true,
+		},
+		"denied by rule": {
+			repository: "denied/app",
+			violation:  "denied",
+		},
+		"denied by default": {
+			repository: "other/app",
+			violation:  "not allowed by any rule",
+		},
+	}
+
+	p := &Puller{Policy: imagePolicy}
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			server.ResetRequests()
+			ref, _ := name.ParseReference(server.Host() + "/" + tc.repository + ":v1")
+			_, info, err := p.Pull(context.Background(), ref)
+			if requested := len(server.Requests()) > 0; requested != tc.requested {
+				t.Errorf("Expected registry to be contacted %t, but got %d requests", tc.requested, len(server.Requests()))
+			}
+			if tc.violation != "" {
+				var violation *policy.Violation
+				if !errors.As(err, &violation) || !strings.Contains(violation.Reason, tc.violation) {
+					t.Fatalf("Expected policy violation %q but got %v", tc.violation, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to pull image: %v", err)
+			}
+			if info.Source != SourceRegistry {
+				t.Errorf("Expected image to be pulled from the registry but got %+v", info)
+			}
+		})
+	}
+}
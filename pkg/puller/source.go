@@ -0,0 +1,219 @@
+package puller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/events"
+	"github.com/rancher/wharfie/pkg/layercache"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/rancher/wharfie/pkg/util"
+)
+
+// ErrNotFound is matched by the errors that an ImageSource returns when it does not have the image, so that the
+// next source is tried.
+var ErrNotFound = errors.New("image not found")
+
+// NotFoundError is returned by an ImageSource that does not have the image. It matches ErrNotFound, and wraps the
+// error that the source failed to find the image with, if any.
+type NotFoundError struct {
+	Source string
+	Ref    name.Reference
+	Err    error
+}
+
+func (e *NotFoundError) Error() string {
+	msg := fmt.Sprintf("image %s not found in %s", e.Ref.Name(), e.Source)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return e.Err
+}
+
+// ImageSource is a source that a Puller pulls images from, such as local image tarballs or a registry. Programs that
+// embed wharfie can implement it to pull images from sources of their own. The Puller does not send layer events for
+// the images that other sources return; sources can wrap their images with events.Image to send them.
+type ImageSource interface {
+	// Name identifies the source. It is the Source of the PullInfo for images that the source returns.
+	Name() string
+	// Get returns the image for the reference that best matches the platform. If the source does not have the image,
+	// it returns an error that matches ErrNotFound, such as a *NotFoundError, and the next source is tried; any other
+	// error stops the pull.
+	Get(ctx context.Context, ref name.Reference, platform v1.Platform) (v1.Image, error)
+}
+
+// infoSource is implemented by the sources of the Puller, which describe where an image was found in more detail
+// than its source and digest.
+type infoSource interface {
+	getInfo(ctx context.Context, ref name.Reference, platform v1.Platform) (v1.Image, PullInfo, error)
+}
+
+// getImage returns the image for the reference from the source, and describes where it was found.
+func getImage(ctx context.Context, source ImageSource, ref name.Reference, platform v1.Platform) (v1.Image, PullInfo, error) {
+	if s, ok := source.(infoSource); ok {
+		return s.getInfo(ctx, ref, platform)
+	}
+	img, err := source.Get(ctx, ref, platform)
+	if err != nil {
+		return nil, PullInfo{}, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, PullInfo{}, err
+	}
+	return img, PullInfo{Source: Source(source.Name()), Digest: digest}, nil
+}
+
+// DefaultSources returns the sources that images are pulled from when Sources is nil: TarballSource, and then
+// RegistrySource.
+func (p *Puller) DefaultSources() []ImageSource {
+	return []ImageSource{p.TarballSource(), p.RegistrySource()}
+}
+
+// TarballSource returns the source that reads images from the first local image tarball in ImagesDirs that has a copy
+// for the platform. Tags in the tarballs are parsed with ReferenceOptions.
+func (p *Puller) TarballSource() ImageSource {
+	return tarballSource{p}
+}
+
+// RegistrySource returns the source that pulls images from the registry, with their layers read through the layer
+// cache. The image that best matches the platform is selected from an image index. Images that the registry does
+// not have at any endpoint are not found.
+func (p *Puller) RegistrySource() ImageSource {
+	return registrySource{p}
+}
+
+// CacheSource returns the source that reads images from the manifests, configs, and layers stored in the layer cache
+// in CacheDir, as pulled by the wharfie pull command, without accessing the registry. Images are not found if the
+// cache does not have all of their blobs, or they do not match the platform. It is not one of the DefaultSources.
+func (p *Puller) CacheSource() ImageSource {
+	return cacheSource{p}
+}
+
+// sources returns the sources that images are pulled from, in order.
+func (p *Puller) sources() []ImageSource {
+	if p.Sources == nil {
+		return p.DefaultSources()
+	}
+	return p.Sources
+}
+
+type tarballSource struct {
+	p *Puller
+}
+
+func (s tarballSource) Name() string {
+	return string(SourceTarball)
+}
+
+func (s tarballSource) Get(ctx context.Context, ref name.Reference, platform v1.Platform) (v1.Image, error) {
+	img, _, err := s.getInfo(ctx, ref, platform)
+	return img, err
+}
+
+func (s tarballSource) getInfo(ctx context.Context, ref name.Reference, platform v1.Platform) (v1.Image, PullInfo, error) {
+	img, path, err := s.p.localImage(ctx, ref, platform)
+	if err != nil {
+		return nil, PullInfo{}, err
+	}
+	if img == nil {
+		return nil, PullInfo{}, &NotFoundError{Source: s.Name(), Ref: ref}
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, PullInfo{}, err
+	}
+	return events.CachedImage(img, ref.Name(), s.p.Events), PullInfo{Source: SourceTarball, Path: path, Digest: digest}, nil
+}
+
+type registrySource struct {
+	p *Puller
+}
+
+func (s registrySource) Name() string {
+	return string(SourceRegistry)
+}
+
+func (s registrySource) Get(ctx context.Context, ref name.Reference, platform v1.Platform) (v1.Image, error) {
+	img, _, err := s.getInfo(ctx, ref, platform)
+	return img, err
+}
+
+func (s registrySource) getInfo(ctx context.Context, ref name.Reference, platform v1.Platform) (v1.Image, PullInfo, error) {
+	desc, img, endpoint, err := s.p.remoteImage(ctx, ref, platform)
+	if err != nil {
+		if errors.Is(err, registries.ErrNotFound) {
+			err = &NotFoundError{Source: s.Name(), Ref: ref, Err: err}
+		}
+		return nil, PullInfo{}, err
+	}
+	info := PullInfo{Source: SourceRegistry, Endpoint: endpoint, Digest: desc.Digest}
+	img = events.Image(img, ref.Name(), s.p.Events)
+	c, err := s.p.LayerCache()
+	if err != nil {
+		return nil, PullInfo{}, err
+	}
+	if c == nil {
+		return img, info, nil
+	}
+	if s.p.CacheDir != "" {
+		if cached, err := s.p.cached(img); err != nil {
+			return nil, PullInfo{}, err
+		} else if cached {
+			info.Source = SourceCache
+		}
+	}
+	return cache.Image(img, events.Cache(c, ref.Name(), s.p.Events)), info, nil
+}
+
+type cacheSource struct {
+	p *Puller
+}
+
+func (s cacheSource) Name() string {
+	return string(SourceCache)
+}
+
+func (s cacheSource) Get(ctx context.Context, ref name.Reference, platform v1.Platform) (v1.Image, error) {
+	img, _, err := s.getInfo(ctx, ref, platform)
+	return img, err
+}
+
+func (s cacheSource) getInfo(ctx context.Context, ref name.Reference, platform v1.Platform) (v1.Image, PullInfo, error) {
+	if s.p.CacheDir == "" {
+		return nil, PullInfo{}, &NotFoundError{Source: s.Name(), Ref: ref}
+	}
+	img, err := layercache.Image(s.p.CacheDir, ref)
+	var missing *layercache.MissingError
+	if errors.Is(err, cache.ErrNotFound) || errors.As(err, &missing) {
+		return nil, PullInfo{}, &NotFoundError{Source: s.Name(), Ref: ref, Err: err}
+	}
+	if err != nil {
+		return nil, PullInfo{}, err
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		return nil, PullInfo{}, err
+	}
+	// images that do not declare a platform are assumed to be usable on any platform
+	if imagePlatform := config.Platform(); imagePlatform != nil && util.PlatformScore(imagePlatform, platform) < 0 {
+		return nil, PullInfo{}, &NotFoundError{Source: s.Name(), Ref: ref, Err: fmt.Errorf("platform %s does not match %s", imagePlatform, platform)}
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, PullInfo{}, err
+	}
+	return events.CachedImage(img, ref.Name(), s.p.Events), PullInfo{Source: SourceCache, Path: s.p.CacheDir, Digest: digest}, nil
+}
@@ -0,0 +1,267 @@
+package puller
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/layercache"
+	"github.com/rancher/wharfie/pkg/registries"
+)
+
+// fakeSource is a source that has the images it was given, and fails to get the references in errs. It records the
+// references that it was asked for.
+type fakeSource struct {
+	name   string
+	images map[string]v1.Image
+	errs   map[string]error
+	gets   []string
+}
+
+func (s *fakeSource) Name() string {
+	return s.name
+}
+
+func (s *fakeSource) Get(ctx context.Context, ref name.Reference, platform v1.Platform) (v1.Image, error) {
+	s.gets = append(s.gets, ref.Name())
+	if err, ok := s.errs[ref.Name()]; ok {
+		return nil, err
+	}
+	if img, ok := s.images[ref.Name()]; ok {
+		return img, nil
+	}
+	return nil, &NotFoundError{Source: s.name, Ref: ref}
+}
+
+func TestSources(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	// the registry has the claimed and remote images, and the fake source has the claimed and blob store images
+	remoteImg, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	remoteDigest, _ := remoteImg.Digest()
+	fakeImg, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	fakeDigest, _ := fakeImg.Digest()
+	repo, _ := name.NewRepository(u.Host + "/test/sources")
+	claimed, remoteOnly, fakeOnly, missing, failing := repo.Tag("claimed"), repo.Tag("remote"), repo.Tag("blobstore"), repo.Tag("missing"), repo.Tag("failing")
+	for _, tag := range []name.Tag{claimed, remoteOnly, failing} {
+		if err := remote.Write(tag, remoteImg); err != nil {
+			t.Fatalf("Failed to push image: %v", err)
+		}
+	}
+	failure := errors.New("blob store is unavailable")
+	// the sources of the puller are the fake source and the default sources, in either order, or none
+	fakeFirst := func(p *Puller, fake ImageSource) []ImageSource {
+		return append([]ImageSource{fake}, p.DefaultSources()...)
+	}
+	fakeLast := func(p *Puller, fake ImageSource) []ImageSource { return append(p.DefaultSources(), fake) }
+	noSources := func(*Puller, ImageSource) []ImageSource { return []ImageSource{} }
+
+	testCases := map[string]struct {
+		sources func(p *Puller, fake ImageSource) []ImageSource
+		ref     name.Reference
+		source  Source
+		digest  v1.Hash
+		err     error
+		// gets are the references that the fake source is asked for
+		gets []string
+	}{
+		"fake source first": {
+			sources: fakeFirst,
+			ref:     claimed,
+			source:  "blobstore",
+			digest:  fakeDigest,
+			gets:    []string{claimed.Name()},
+		},
+		"fake source last": {
+			sources: fakeLast,
+			ref:     claimed,
+			source:  SourceRegistry,
+			digest:  remoteDigest,
+		},
+		"not found in fake source": {
+			sources: fakeFirst,
+			ref:     remoteOnly,
+			source:  SourceRegistry,
+			digest:  remoteDigest,
+			gets:    []string{remoteOnly.Name()},
+		},
+		"not found in registry": {
+			sources: fakeLast,
+			ref:     fakeOnly,
+			source:  "blobstore",
+			digest:  fakeDigest,
+			gets:    []string{fakeOnly.Name()},
+		},
+		"not found in any source": {
+			sources: fakeFirst,
+			ref:     missing,
+			err:     registries.ErrNotFound,
+			gets:    []string{missing.Name()},
+		},
+		"failure stops pull": {
+			sources: fakeFirst,
+			ref:     failing,
+			err:     failure,
+			gets:    []string{failing.Name()},
+		},
+		"no sources": {
+			sources: noSources,
+			ref:     claimed,
+			err:     ErrNotFound,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			fake := &fakeSource{
+				name:   "blobstore",
+				images: map[string]v1.Image{claimed.Name(): fakeImg, fakeOnly.Name(): fakeImg},
+				errs:   map[string]error{failing.Name(): failure},
+			}
+			p := &Puller{}
+			p.Sources = tc.sources(p, fake)
+			img, info, err := p.Pull(context.Background(), tc.ref)
+			if !reflect.DeepEqual(fake.gets, tc.gets) {
+				t.Errorf("Expected fake source to be asked for %v but got %v", tc.gets, fake.gets)
+			}
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("Expected error %v but got %v", tc.err, err)
+				}
+				if tc.err != failure && !errors.Is(err, ErrNotFound) {
+					t.Errorf("Expected error %v to match %v", err, ErrNotFound)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to pull image: %v", err)
+			}
+			if info.Source != tc.source || info.Digest != tc.digest {
+				t.Errorf("Expected image %s from %s but got %+v", tc.digest, tc.source, info)
+			}
+			if digest, _ := img.Digest(); digest != tc.digest {
+				t.Errorf("Expected image %s but got %s", tc.digest, digest)
+			}
+		})
+	}
+}
+
+func TestDefaultSources(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	tag, _ := name.NewTag("registry.example.com/test/sources:v1")
+	imagesDir := t.TempDir()
+	if err := tarball.WriteToFile(filepath.Join(imagesDir, "images.tar"), tag, img); err != nil {
+		t.Fatalf("Failed to write image tarball: %v", err)
+	}
+
+	p := &Puller{ImagesDirs: []string{imagesDir}}
+	names := []string{}
+	for _, source := range p.DefaultSources() {
+		names = append(names, source.Name())
+	}
+	if expected := []string{string(SourceTarball), string(SourceRegistry)}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected default sources %v but got %v", expected, names)
+	}
+
+	// the sources of the puller can be used on their own
+	found, err := p.TarballSource().Get(context.Background(), tag, v1.Platform{})
+	if err != nil {
+		t.Fatalf("Failed to get image from tarball source: %v", err)
+	}
+	if expected, _ := img.Digest(); mustDigest(t, found) != expected {
+		t.Errorf("Expected image %s from tarball source", expected)
+	}
+	if _, err := p.TarballSource().Get(context.Background(), tag.Context().Tag("v2"), v1.Platform{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected error %v but got %v", ErrNotFound, err)
+	}
+}
+
+func TestCacheSource(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	config, _ := img.ConfigFile()
+	config.OS, config.Architecture = "linux", "amd64"
+	if img, err = mutate.ConfigFile(img, config); err != nil {
+		t.Fatalf("Failed to set image platform: %v", err)
+	}
+	tag, _ := name.NewTag("registry.example.com/test/cached:v1")
+	dir := t.TempDir()
+
+	p := &Puller{CacheDir: dir, Sources: []ImageSource{}}
+	p.Sources = append(p.Sources, p.CacheSource())
+	if _, _, err := p.Pull(context.Background(), tag); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected error %v before the image is cached but got %v", ErrNotFound, err)
+	}
+
+	// cache the layers, manifest, and config of the image, as the pull command does
+	c := layercache.NewFilesystemCache(dir)
+	layers, _ := img.Layers()
+	for _, layer := range layers {
+		cached, err := c.Put(layer)
+		if err != nil {
+			t.Fatalf("Failed to cache layer: %v", err)
+		}
+		rc, err := cached.Uncompressed()
+		if err != nil {
+			t.Fatalf("Failed to read layer: %v", err)
+		}
+		io.Copy(io.Discard, rc)
+		rc.Close()
+	}
+	if err := layercache.PutImage(dir, tag, img); err != nil {
+		t.Fatalf("Failed to cache image: %v", err)
+	}
+
+	found, info, err := p.Pull(context.Background(), tag)
+	if err != nil {
+		t.Fatalf("Failed to pull image from cache: %v", err)
+	}
+	if info.Source != SourceCache || info.Path != dir || info.Endpoint != "" {
+		t.Errorf("Expected image from cache %s but got %+v", dir, info)
+	}
+	expected, _ := img.ConfigName()
+	if configName, _ := found.ConfigName(); configName != expected {
+		t.Errorf("Expected image with config %s but got %s", expected, configName)
+	}
+
+	// images for other platforms are not found
+	p.Platform = v1.Platform{OS: "windows", Architecture: "arm64"}
+	if _, _, err := p.Pull(context.Background(), tag); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected error %v for another platform but got %v", ErrNotFound, err)
+	}
+}
+
+func mustDigest(t *testing.T, img v1.Image) v1.Hash {
+	t.Helper()
+	digest, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Failed to get image digest: %v", err)
+	}
+	return digest
+}
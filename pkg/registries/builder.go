@@ -0,0 +1,109 @@
+package registries
+
+import (
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// AddMirror adds the endpoints to the mirror for the registry host, creating the mirror if there is none, and returns
+// it. Endpoints that the mirror already has are not added twice. Rewrites set on the returned mirror with SetRewrite
+// apply to the mirror in the configuration; call AddMirror again to add more endpoints. The host is normalized as
+// described for NormalizeHost.
+func (r *Registry) AddMirror(host string, endpoints ...string) *Mirror {
+	if r.Mirrors == nil {
+		r.Mirrors = map[string]Mirror{}
+	}
+	key := NormalizeHost(host)
+	mirror := r.Mirrors[key]
+	for _, endpoint := range endpoints {
+		if !slices.Contains(mirror.Endpoints, endpoint) {
+			mirror.Endpoints = append(mirror.Endpoints, endpoint)
+		}
+	}
+	// the map of rewrites is shared with the mirror that is returned, so that rewrites set on it are stored
+	if mirror.Rewrites == nil {
+		mirror.Rewrites = map[string]string{}
+	}
+	r.Mirrors[key] = mirror
+	return &mirror
+}
+
+// SetRewrite rewrites repositories matching the regular expression to the replacement, when images are pulled from
+// the mirror's endpoints. The replacement may refer to groups in the expression, such as $1.
+func (m *Mirror) SetRewrite(pattern, replacement string) {
+	if m.Rewrites == nil {
+		m.Rewrites = map[string]string{}
+	}
+	m.Rewrites[pattern] = replacement
+}
+
+// SetAuth sets the credentials for the registry host, keeping any TLS configuration it has. The host is normalized
+// as described for NormalizeHost.
+func (r *Registry) SetAuth(host string, auth AuthConfig) {
+	r.setConfig(host, func(config *RegistryConfig) { config.Auth = &auth })
+}
+
+// SetTLS sets the TLS configuration for the registry host, keeping any credentials it has. The host is normalized as
+// described for NormalizeHost.
+func (r *Registry) SetTLS(host string, tls TLSConfig) {
+	r.setConfig(host, func(config *RegistryConfig) { config.TLS = &tls })
+}
+
+// setConfig updates the configuration for the normalized registry host.
+func (r *Registry) setConfig(host string, update func(*RegistryConfig)) {
+	if r.Configs == nil {
+		r.Configs = map[string]RegistryConfig{}
+	}
+	key := NormalizeHost(host)
+	config := r.Configs[key]
+	update(&config)
+	r.Configs[key] = config
+}
+
+// NormalizeHost returns the key that configuration for the registry host is stored under by the Registry builders:
+// the host in lowercase, without the scheme and path if it is given as a URL, and without the port if it is the
+// default port for HTTPS or HTTP. Docker Hub is stored as docker.io. The wildcard "*" is returned unchanged.
+// Configuration stored under the key applies to image references for the host with or without the default port, and
+// to mirror endpoints on the host.
+func NormalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if host == "*" {
+		return host
+	}
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+len("://"):]
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	host = stripDefaultPort(host)
+	if host == name.DefaultRegistry {
+		return "docker.io"
+	}
+	return host
+}
+
+// stripDefaultPort returns the host without its port, if the port is 443 or 80.
+func stripDefaultPort(host string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil || (port != "443" && port != "80") {
+		return host
+	}
+	if strings.Contains(h, ":") {
+		return "[" + h + "]"
+	}
+	return h
+}
+
+// hostKeys returns the keys that configuration for the registry host is looked up under, before the wildcard: the
+// host as given, and as normalized by NormalizeHost, so that configuration added by the builders applies.
+func hostKeys(host string) []string {
+	keys := []string{host}
+	if key := NormalizeHost(host); key != host {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,132 @@
+package registries
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := map[string]string{
+		"registry.example.com":               "registry.example.com",
+		" Registry.Example.COM ":             "registry.example.com",
+		"registry.example.com:443":           "registry.example.com",
+		"registry.example.com:80":            "registry.example.com",
+		"registry.example.com:5000":          "registry.example.com:5000",
+		"https://registry.example.com/v2":    "registry.example.com",
+		"http://registry.example.com:5000/":  "registry.example.com:5000",
+		"https://registry.example.com:443/x": "registry.example.com",
+		"docker.io":                          "docker.io",
+		"index.docker.io":                    "docker.io",
+		"index.docker.io:443":                "docker.io",
+		"10.0.0.1:443":                       "10.0.0.1",
+		"[::1]:443":                          "[::1]",
+		"[::1]:5000":                         "[::1]:5000",
+		"*":                                  "*",
+	}
+	for host, expected := range tests {
+		assert.Equal(t, expected, NormalizeHost(host), "host %q", host)
+	}
+}
+
+func TestRegistryBuilders(t *testing.T) {
+	tests := map[string]struct {
+		host string
+		// matches are references that the configuration for the host applies to
+		matches []string
+		// others are references that it does not apply to
+		others []string
+	}{
+		"hostname": {
+			host:    "registry.example.com",
+			matches: []string{"registry.example.com/team/app:v1", "registry.example.com:443/team/app:v1"},
+			others:  []string{"registry.example.com:5000/team/app:v1", "other.example.com/team/app:v1"},
+		},
+		"hostname with uppercase and default port": {
+			host:    "Registry.Example.com:443",
+			matches: []string{"registry.example.com/team/app:v1", "registry.example.com:443/team/app:v1"},
+			others:  []string{"registry.example.com:5000/team/app:v1"},
+		},
+		"hostname as URL": {
+			host:    "https://registry.example.com/v2",
+			matches: []string{"registry.example.com/team/app:v1"},
+		},
+		"hostname with port": {
+			host:    "registry.example.com:5000",
+			matches: []string{"registry.example.com:5000/team/app:v1"},
+			others:  []string{"registry.example.com/team/app:v1"},
+		},
+		"docker hub": {
+			host:    "index.docker.io",
+			matches: []string{"busybox", "docker.io/library/busybox", "index.docker.io/rancher/rancher:v2.9.2"},
+			others:  []string{"registry.example.com/team/app:v1"},
+		},
+		"wildcard": {
+			host:    "*",
+			matches: []string{"busybox", "registry.example.com/team/app:v1", "registry.example.com:5000/team/app:v1"},
+		},
+	}
+
+	auth := AuthConfig{Username: "user", Password: "pass"}
+	tlsConfig := TLSConfig{InsecureSkipVerify: true}
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			registry := &Registry{}
+			mirror := registry.AddMirror(test.host, "https://mirror.example.com:8443")
+			mirror.SetRewrite("^team/(.*)", "mirrored/$1")
+			registry.AddMirror(test.host, "https://mirror.example.com:8443", "mirror2.example.com")
+			registry.SetAuth(test.host, auth)
+			registry.SetTLS(test.host, tlsConfig)
+			key := NormalizeHost(test.host)
+
+			// each builder stores its configuration under the same key, without replacing the others
+			assert.Len(t, registry.Mirrors, 1)
+			assert.Equal(t, []string{"https://mirror.example.com:8443", "mirror2.example.com"}, registry.Mirrors[key].Endpoints)
+			assert.Equal(t, map[string]string{"^team/(.*)": "mirrored/$1"}, registry.Mirrors[key].Rewrites)
+			assert.Equal(t, map[string]RegistryConfig{key: {Auth: &auth, TLS: &tlsConfig}}, registry.Configs)
+			assert.NoError(t, registry.Validate())
+
+			client := &Client{Registry: registry, transports: map[string]*http.Transport{}}
+			for _, image := range test.matches {
+				ref, err := name.ParseReference(image)
+				if !assert.NoError(t, err) {
+					continue
+				}
+				endpoints, err := client.Endpoints(ref)
+				if !assert.NoError(t, err) || !assert.Len(t, endpoints, 3, "endpoints for %s", image) {
+					continue
+				}
+				assert.Equal(t, key, endpoints[0].Mirror, "mirror for %s", image)
+				assert.Equal(t, key, endpoints[2].Auth, "auth for %s", image)
+				assert.Equal(t, key, endpoints[2].TLS, "TLS for %s", image)
+				assert.Equal(t, registry.Mirrors[key].Rewrites, client.getRewrites(ref.Context().RegistryStr()), "rewrites for %s", image)
+			}
+			for _, image := range test.others {
+				ref, err := name.ParseReference(image)
+				if !assert.NoError(t, err) {
+					continue
+				}
+				endpoints, err := client.Endpoints(ref)
+				if !assert.NoError(t, err) {
+					continue
+				}
+				assert.Len(t, endpoints, 1, "endpoints for %s", image)
+				assert.Empty(t, endpoints[0].Auth, "auth for %s", image)
+			}
+		})
+	}
+}
+
+func TestSetRewrite(t *testing.T) {
+	mirror := &Mirror{}
+	mirror.SetRewrite("(.*)", "rewritten/$1")
+	assert.Equal(t, map[string]string{"(.*)": "rewritten/$1"}, mirror.Rewrites)
+
+	// rewrites set on a mirror that has been added are stored in the configuration
+	registry := &Registry{}
+	mirror = registry.AddMirror("docker.io")
+	mirror.SetRewrite("^library/(.*)", "mirrored-library/$1")
+	assert.Equal(t, map[string]string{"^library/(.*)": "mirrored-library/$1"}, registry.Mirrors["docker.io"].Rewrites)
+}
@@ -1,13 +1,20 @@
 package registries
 
 import (
+	"context"
+	"encoding/base64"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
-	"github.com/sirupsen/logrus"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/logging"
 )
 
 var _ authn.Keychain = &endpoint{}
@@ -18,12 +25,229 @@ const (
 	defaultRegistryHost = "index.docker.io"
 )
 
+// RotatingKeychain is implemented by keychains that may hold several credentials for a resource, such as the old and
+// rotated credentials returned by a credential provider plugin during a rotation window. When an endpoint rejects the
+// credentials returned by Resolve, the request is retried with each of the others in turn.
+type RotatingKeychain interface {
+	authn.Keychain
+	// ResolveAll returns all of the credentials for the resource, starting with those returned by Resolve.
+	ResolveAll(target authn.Resource) ([]authn.Authenticator, error)
+}
+
+// InvalidatingKeychain is implemented by keychains that cache credentials, such as those returned by credential
+// provider plugins. When an endpoint rejects credentials that it previously accepted, such as a short-lived token
+// that expired during a long pull, they are invalidated before the keychain is asked to resolve them again.
+type InvalidatingKeychain interface {
+	authn.Keychain
+	// Invalidate drops any credentials cached for the resource, so that the next Resolve looks them up again.
+	Invalidate(target authn.Resource)
+}
+
 type endpoint struct {
-	auth     authn.Authenticator
+	auth        authn.Authenticator
+	keychain    authn.Keychain
+	credentials *refreshingAuth
+	ref         name.Reference
+	registry    *Client
+	url         *url.URL
+}
+
+// refreshingAuth is an authenticator for the credentials that an endpoint resolved from its keychain. If the endpoint
+// rejects them after having accepted them, they are resolved again, so that a pull that outlives its credentials
+// can continue with fresh ones. It is shared by all of the requests made for an image through the endpoint.
+type refreshingAuth struct {
 	keychain authn.Keychain
-	ref      name.Reference
-	registry *registry
-	url      *url.URL
+	logger   logging.Logger
+	mu       sync.Mutex
+	target   authn.Resource
+	auth     authn.Authenticator
+	accepted bool
+	// stale are the Authorization headers of credentials that have been replaced, so that requests rejected with
+	// them are retried with the current credentials.
+	stale map[string]bool
+}
+
+var _ authn.Authenticator = &refreshingAuth{}
+
+// resolve resolves the credentials for the target from the keychain. Anonymous access is returned as it is, as there
+// are no credentials to refresh.
+func (a *refreshingAuth) resolve(target authn.Resource) (authn.Authenticator, error) {
+	auth, err := a.keychain.Resolve(target)
+	if err != nil || auth == authn.Anonymous {
+		return auth, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.target = target
+	a.auth = auth
+	a.accepted = false
+	return a, nil
+}
+
+// Authorization returns the current credentials.
+func (a *refreshingAuth) Authorization() (*authn.AuthConfig, error) {
+	a.mu.Lock()
+	auth := a.auth
+	a.mu.Unlock()
+	return auth.Authorization()
+}
+
+// accept records that the endpoint accepted a request made with the credentials.
+func (a *refreshingAuth) accept() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.accepted = true
+}
+
+// refresh is called when the endpoint rejects a request that was made with the Authorization header. If the current
+// credentials have been accepted before, they are invalidated in the keychain and resolved again. It returns the
+// header to retry the request with, if the request was made with credentials that have since been replaced; a
+// request made with a bearer token that the transport got for the credentials is retried by the transport itself,
+// which gets a new token with the current credentials.
+func (a *refreshingAuth) refresh(rejected string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.auth == nil {
+		return "", false
+	}
+	if a.accepted {
+		a.logger.Infof("Credentials for %s were rejected after being accepted; resolving them again", a.target)
+		if keychain, ok := a.keychain.(InvalidatingKeychain); ok {
+			keychain.Invalidate(a.target)
+		}
+		auth, err := a.keychain.Resolve(a.target)
+		if err != nil {
+			a.logger.Warnf("Failed to resolve credentials for %s again: %v", a.target, err)
+		} else if auth != authn.Anonymous {
+			if a.stale == nil {
+				a.stale = map[string]bool{}
+			}
+			a.stale[authHeader(a.auth)] = true
+			a.auth = auth
+			a.accepted = false
+		}
+	}
+	if current := authHeader(a.auth); a.stale[rejected] && current != rejected {
+		return current, true
+	}
+	return "", false
+}
+
+// authHeader returns the Authorization header that go-containerregistry sends with the credentials, or an empty
+// string if it does not send them directly.
+func authHeader(auth authn.Authenticator) string {
+	config, err := auth.Authorization()
+	if err != nil {
+		return ""
+	}
+	switch {
+	case config.RegistryToken != "":
+		return "Bearer " + config.RegistryToken
+	case config.Username != "" && config.Password != "":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(config.Username+":"+config.Password))
+	case config.Auth != "":
+		return "Basic " + config.Auth
+	}
+	return ""
+}
+
+// EndpointInfo describes an endpoint that is tried for an image reference, and the configuration that applies to it.
+type EndpointInfo struct {
+	// URL is the URL of the endpoint.
+	URL string
+	// Reference is the reference requested from the endpoint, with repository rewrites applied.
+	Reference name.Reference
+	// Default is true for endpoints of the registry itself, which are not rewritten.
+	Default bool
+	// Mirror is the key of the mirrors entry that supplied the endpoint. It is empty for the registry's own
+	// endpoint, which is always tried last.
+	Mirror string
+	// Auth is the key of the configs entry that supplies credentials for the endpoint, if any.
+	Auth string
+	// TLS is the key of the configs entry that supplies TLS configuration for the endpoint, if any.
+	TLS string
+}
+
+// Endpoints returns the endpoints that are tried for the reference, in order, without making any requests.
+func (r *Client) Endpoints(ref name.Reference) ([]EndpointInfo, error) {
+	endpoints, err := r.getEndpoints(ref)
+	if err != nil {
+		return nil, err
+	}
+	mirror, _, _ := r.getMirror(ref.Context().RegistryStr())
+
+	infos := []EndpointInfo{}
+	for i, endpoint := range endpoints {
+		info := EndpointInfo{
+			URL:       endpoint.url.String(),
+			Reference: ref,
+			Default:   endpoint.isDefault(),
+		}
+		if !info.Default {
+			info.Reference = r.ResolveReference(ref)
+		}
+		if i < len(endpoints)-1 {
+			info.Mirror = mirror
+		}
+		key, config := r.getConfig(endpoint.url.Host)
+		if config.Auth != nil {
+			info.Auth = key
+		}
+		if config.TLS != nil {
+			info.TLS = key
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// EndpointStatus is the result of checking an endpoint that is tried for an image reference with CheckEndpoints.
+type EndpointStatus struct {
+	EndpointInfo
+	// Authenticator supplied the credentials that were sent to the endpoint; authn.Anonymous if there were none.
+	Authenticator authn.Authenticator
+	// StatusCode is the HTTP status of the manifest request, or 0 if no response was received.
+	StatusCode int
+	// Err is the error returned by the endpoint, or while getting its credentials, if any.
+	Err error
+}
+
+// CheckEndpoints requests the manifest of the reference from each of the endpoints that are tried for it, using HEAD
+// requests and the credentials that a pull would use, and returns the outcome for each of them in order. Unlike a
+// pull, every endpoint is requested, and credentials are not retried when an endpoint rejects them.
+func (r *Client) CheckEndpoints(ctx context.Context, ref name.Reference) ([]EndpointStatus, error) {
+	infos, err := r.Endpoints(ref)
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := r.getEndpoints(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []EndpointStatus{}
+	for i, endpoint := range endpoints {
+		status := EndpointStatus{EndpointInfo: infos[i]}
+		status.Authenticator, status.Err = endpoint.Resolve(status.Reference.Context())
+		if status.Err == nil {
+			options := r.remoteOptions([]remote.Option{remote.WithContext(ctx), remote.WithTransport(endpoint), remote.WithAuth(status.Authenticator)}, nil)
+			_, status.Err = remote.Head(status.Reference, options...)
+			var terr *transport.Error
+			if status.Err == nil {
+				status.StatusCode = http.StatusOK
+			} else if errors.As(status.Err, &terr) {
+				status.StatusCode = terr.StatusCode
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// ResolveReference returns the reference that is requested from the mirror endpoints for the reference, with
+// repository rewrites applied. The default endpoint is requested with the reference as given.
+func (r *Client) ResolveReference(ref name.Reference) name.Reference {
+	return r.rewrite(ref)
 }
 
 // Resolve returns an authenticator for the authn.Keychain interface. The authenticator
@@ -35,6 +259,9 @@ func (e endpoint) Resolve(target authn.Resource) (authn.Authenticator, error) {
 		return e.auth, nil
 	}
 	if e.keychain != nil {
+		if e.credentials != nil {
+			return e.credentials.resolve(target)
+		}
 		return e.keychain.Resolve(target)
 	}
 	return authn.Anonymous, nil
@@ -88,9 +315,53 @@ func (e endpoint) RoundTrip(req *http.Request) (*http.Response, error) {
 	}
 
 	if newURL := req.URL.String(); originalURL != newURL {
-		logrus.Debugf("Registry endpoint URL modified: %s => %s", originalURL, newURL)
+		e.registry.log().Debugf("Registry endpoint URL modified: %s => %s", originalURL, newURL)
+	}
+	resp, err := e.roundTrip(req)
+	if err != nil || e.credentials == nil || req.Header.Get("Authorization") == "" {
+		return resp, err
+	}
+
+	// if the endpoint rejects credentials that it has accepted before, they may have expired during the pull, so
+	// they are resolved again, and the request is retried once with the fresh credentials
+	if resp.StatusCode != http.StatusUnauthorized {
+		e.credentials.accept()
+		return resp, nil
+	}
+	header, ok := e.credentials.refresh(req.Header.Get("Authorization"))
+	if !ok || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	retry.Header.Set("Authorization", header)
+	resp.Body.Close()
+	e.registry.log().Debugf("Retrying %s %s with refreshed credentials", req.Method, req.URL)
+	return e.roundTrip(retry)
+}
+
+// roundTrip makes the request with the transport for its URL, and reports it to the metrics hook, if any.
+func (e endpoint) roundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	var resp *http.Response
+	var err error
+	if e.registry.tracer != nil {
+		resp, err = e.registry.tracer.roundTrip(e.registry.getTransport(req.URL), req)
+	} else {
+		resp, err = e.registry.getTransport(req.URL).RoundTrip(req)
+	}
+	if e.registry.metrics != nil {
+		metric := RequestMetric{Endpoint: e.url.String(), Method: req.Method, Duration: time.Since(start), Err: err}
+		if resp != nil {
+			metric.StatusCode = resp.StatusCode
+		}
+		e.registry.metrics(metric)
 	}
-	return e.registry.getTransport(req.URL).RoundTrip(req)
+	return resp, err
 }
 
 // isDefault returns true if this endpoint is the default endpoint for the image -
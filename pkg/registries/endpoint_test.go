@@ -1,23 +1,27 @@
 package registries
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/base64"
+	"bytes"
 	"fmt"
+	"io"
+	"log"
 	"net"
 	"net/http"
-	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
-	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
-	"github.com/rancher/dynamiclistener/cert"
-	"github.com/rancher/dynamiclistener/factory"
+	"github.com/rancher/wharfie/pkg/credentialprovider/credentialprovidertest"
+	"github.com/rancher/wharfie/pkg/registries/registrytest"
 	"github.com/sirupsen/logrus"
 )
 
@@ -42,19 +46,13 @@ func TestImage(t *testing.T) {
 
 	for testName, test := range imageTests {
 		t.Run(testName, func(t *testing.T) {
-			rs, as, mux := newServers(t, "127.0.0.1:443", true, true, true)
-			defer rs.Close()
-			defer as.Close()
+			rs := newServer(t, registrytest.WithAddress("127.0.0.1:443"), registrytest.WithHostname(localhost), registrytest.WithTLS(),
+				registrytest.WithAuth(registrytest.AuthBasic, "user", "pass"), registrytest.WithBusybox())
+			regHost := rs.Host()
 
-			regHost, regEndpoint := getHostEndpoint(rs.Listener.Addr().String(), true, false)
-			authHost, authEndpoint := getHostEndpoint(as.Listener.Addr().String(), true, false)
+			t.Logf("INFO: %s registry %s at %s, scheme %q", t.Name(), regHost, rs.URL(), "Basic")
 
-			t.Logf("INFO: %s registry %s at %s, auth %s at %s, scheme %q", t.Name(), regHost, regEndpoint, authHost, authEndpoint, "Basic")
-
-			mux.Handle("/v2/", serveRegistry(t, "Basic", authEndpoint+"/auth"))
-			mux.Handle("/auth/", serveAuth(t))
-
-			r := &registry{
+			r := &Client{
 				DefaultKeychain: authn.DefaultKeychain,
 				Registry: &Registry{
 					Mirrors: map[string]Mirror{
@@ -109,16 +107,417 @@ func TestImage(t *testing.T) {
 	}
 }
 
+func TestListTags(t *testing.T) {
+	rs := newServer(t, registrytest.WithBusybox())
+	// the server is both a mirror for docker.io, and the default endpoint for its own address
+	endpointURL := rs.URL() + "/v2"
+
+	r := &Client{
+		DefaultKeychain: authn.DefaultKeychain,
+		Registry: &Registry{
+			Mirrors: map[string]Mirror{
+				"docker.io": Mirror{Endpoints: []string{endpointURL}},
+			},
+		},
+		transports: map[string]*http.Transport{},
+	}
+
+	listTests := map[string]struct {
+		repository string
+		pageSize   int
+		endpoint   string
+	}{
+		"single page from mirror": {
+			repository: "docker.io/library/busybox",
+			endpoint:   endpointURL,
+		},
+		"paginated from mirror": {
+			repository: "docker.io/library/busybox",
+			pageSize:   4,
+			endpoint:   endpointURL,
+		},
+		"paginated from default endpoint": {
+			repository: rs.Host() + "/library/busybox",
+			pageSize:   2,
+			endpoint:   endpointURL,
+		},
+	}
+
+	for testName, test := range listTests {
+		t.Run(testName, func(t *testing.T) {
+			repo, err := name.NewRepository(test.repository)
+			if err != nil {
+				t.Fatalf("FATAL: Failed to parse repository: %v", err)
+			}
+			options := []remote.Option{}
+			if test.pageSize > 0 {
+				options = append(options, remote.WithPageSize(test.pageSize))
+			}
+			tags, endpoint, err := r.ListTags(repo, options...)
+			if err != nil {
+				t.Fatalf("FATAL: Failed to list tags: %v", err)
+			}
+			if !reflect.DeepEqual(tags, registrytest.BusyboxTags) {
+				t.Errorf("Expected tags %v but got %v", registrytest.BusyboxTags, tags)
+			}
+			if endpoint != test.endpoint {
+				t.Errorf("Expected tags to be listed from %s but got %s", test.endpoint, endpoint)
+			}
+		})
+	}
+}
+
+func TestSetTLS(t *testing.T) {
+	rs := newServer(t, registrytest.WithTLS(), registrytest.WithBusybox())
+	host := rs.Host()
+
+	// write the CA that signed the server's certificate, as if given by the --ca-file flag
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, rs.CACert(), 0644); err != nil {
+		t.Fatalf("FATAL: Failed to write CA file: %v", err)
+	}
+
+	tlsTests := map[string]struct {
+		configs            map[string]RegistryConfig
+		insecureSkipVerify bool
+		tls                *TLSConfig
+		precedence         []string
+		expectedTLS        *TLSConfig
+		err                string
+	}{
+		"no TLS config": {
+			err: "certificate signed by unknown authority",
+		},
+		"ca file flag": {
+			tls:         &TLSConfig{CAFile: caFile},
+			expectedTLS: &TLSConfig{CAFile: caFile},
+		},
+		"ca file flag keeps auth from wildcard": {
+			configs:     map[string]RegistryConfig{"*": RegistryConfig{Auth: &AuthConfig{Username: "user", Password: "pass"}}},
+			tls:         &TLSConfig{CAFile: caFile},
+			expectedTLS: &TLSConfig{CAFile: caFile},
+		},
+		"ca file flag merged with insecure skip verify flag": {
+			insecureSkipVerify: true,
+			tls:                &TLSConfig{CAFile: caFile},
+			expectedTLS:        &TLSConfig{CAFile: caFile, InsecureSkipVerify: true},
+		},
+		"ca file flag does not override TLS config for the registry": {
+			configs:     map[string]RegistryConfig{host: RegistryConfig{TLS: &TLSConfig{}}},
+			tls:         &TLSConfig{CAFile: caFile},
+			precedence:  []string{host},
+			expectedTLS: &TLSConfig{},
+			err:         "certificate signed by unknown authority",
+		},
+		"ca file flag does not override TLS config in wildcard": {
+			configs:    map[string]RegistryConfig{"*": RegistryConfig{TLS: &TLSConfig{}}},
+			tls:        &TLSConfig{CAFile: caFile},
+			precedence: []string{"*"},
+			err:        "certificate signed by unknown authority",
+		},
+	}
+
+	for testName, test := range tlsTests {
+		t.Run(testName, func(t *testing.T) {
+			r := &Client{
+				DefaultKeychain: authn.DefaultKeychain,
+				Registry: &Registry{
+					Mirrors: map[string]Mirror{
+						host: Mirror{Endpoints: []string{"https://" + host + "/v2"}},
+					},
+					Configs: test.configs,
+				},
+				transports: map[string]*http.Transport{},
+			}
+
+			var precedence []string
+			if test.insecureSkipVerify {
+				precedence = append(precedence, r.SetInsecureSkipVerify(host)...)
+			}
+			if test.tls != nil {
+				precedence = append(precedence, r.SetTLS(host, *test.tls)...)
+			}
+			if !reflect.DeepEqual(precedence, test.precedence) {
+				t.Errorf("Expected config precedence %v but got %v", test.precedence, precedence)
+			}
+			if test.expectedTLS != nil && !reflect.DeepEqual(r.Registry.Configs[host].TLS, test.expectedTLS) {
+				t.Errorf("Expected TLS config %+v but got %+v", test.expectedTLS, r.Registry.Configs[host].TLS)
+			}
+
+			ref, err := name.ParseReference(host + "/library/busybox:latest")
+			if err != nil {
+				t.Fatalf("FATAL: Failed to parse reference: %v", err)
+			}
+			image, err := r.Image(ref, remote.WithPlatform(v1.Platform{Architecture: "amd64", OS: "linux"}))
+			if err == nil {
+				_, err = image.Manifest()
+			}
+			if test.err == "" && err != nil {
+				t.Fatalf("FATAL: Failed to get image: %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("FATAL: Expected error containing %q but got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestRequestTracing(t *testing.T) {
+	rs := newServer(t, registrytest.WithTLS(), registrytest.WithBusybox())
+	host := rs.Host()
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, rs.CACert(), 0644); err != nil {
+		t.Fatalf("FATAL: Failed to write CA file: %v", err)
+	}
+
+	r := &Client{
+		DefaultKeychain: authn.DefaultKeychain,
+		Registry: &Registry{
+			Mirrors: map[string]Mirror{
+				host: Mirror{Endpoints: []string{"https://" + host + "/v2"}},
+			},
+		},
+		transports: map[string]*http.Transport{},
+	}
+	r.SetTLS(host, TLSConfig{CAFile: caFile})
+	if stats := r.RequestStats(); stats != nil {
+		t.Errorf("Expected no request stats before tracing is enabled but got %v", stats)
+	}
+	output := &bytes.Buffer{}
+	r.EnableRequestTracing(log.New(output, "", 0))
+
+	ref, err := name.ParseReference(host + "/library/busybox:latest")
+	if err != nil {
+		t.Fatalf("FATAL: Failed to parse reference: %v", err)
+	}
+	image, err := r.Image(ref, remote.WithPlatform(v1.Platform{Architecture: "amd64", OS: "linux"}))
+	if err != nil {
+		t.Fatalf("FATAL: Failed to get image: %v", err)
+	}
+	if _, err := image.Manifest(); err != nil {
+		t.Fatalf("FATAL: Failed to get manifest: %v", err)
+	}
+
+	stats := r.RequestStats()
+	if len(stats) != 1 || stats[0].Endpoint != "https://"+host {
+		t.Fatalf("FATAL: Expected request stats for https://%s but got %+v", host, stats)
+	}
+	s := stats[0]
+	if s.Requests < 2 || s.Connections < 1 {
+		t.Errorf("Expected at least 2 requests over at least 1 connection but got %d requests over %d connections", s.Requests, s.Connections)
+	}
+	if s.Connect <= 0 || s.TLSHandshake <= 0 || s.FirstByte <= 0 || s.MaxFirstByte <= 0 {
+		t.Errorf("Expected connect, TLS handshake, and first byte timings to be recorded but got %+v", s)
+	}
+	if s.MaxFirstByte > s.FirstByte {
+		t.Errorf("Expected max time to first byte %s not to exceed the total %s", s.MaxFirstByte, s.FirstByte)
+	}
+	for _, expected := range []string{"GET https://" + host + "/v2/ ", "tls=", "ttfb="} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("Expected %q in request log:\n%s", expected, output)
+		}
+	}
+}
+
+// rotatingKeychain returns all of its credentials from ResolveAll, and the first of them from Resolve.
+type rotatingKeychain []authn.Authenticator
+
+func (k rotatingKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return k[0], nil
+}
+
+func (k rotatingKeychain) ResolveAll(authn.Resource) ([]authn.Authenticator, error) {
+	return k, nil
+}
+
+func TestRotatingKeychain(t *testing.T) {
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("FATAL: Failed to create image: %v", err)
+	}
+	rs := newServer(t, registrytest.WithImage("library/rotated:latest", img), registrytest.WithAuth(registrytest.AuthBasic, "rotated", "pass"))
+	requests := map[string]int{}
+	rs.Intercept(func(resp http.ResponseWriter, req *http.Request) bool {
+		username, _, _ := req.BasicAuth()
+		requests[username]++
+		return false
+	})
+	host := rs.Host()
+
+	ref, err := name.ParseReference(host + "/library/rotated:latest")
+	if err != nil {
+		t.Fatalf("FATAL: Failed to parse reference: %v", err)
+	}
+
+	old := &authn.Basic{Username: "old", Password: "pass"}
+	rotated := &authn.Basic{Username: "rotated", Password: "pass"}
+	tests := map[string]struct {
+		keychain authn.Keychain
+		success  bool
+	}{
+		"second credentials accepted": {
+			keychain: rotatingKeychain{old, rotated},
+			success:  true,
+		},
+		"first credentials accepted": {
+			keychain: rotatingKeychain{rotated, old},
+			success:  true,
+		},
+		"no credentials accepted": {
+			keychain: rotatingKeychain{old, &authn.Basic{Username: "other", Password: "pass"}},
+		},
+		"keychain without rotation": {
+			keychain: authn.NewMultiKeychain(rotatingKeychain{old, rotated}),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			for username := range requests {
+				delete(requests, username)
+			}
+			r := &Client{
+				DefaultKeychain: test.keychain,
+				Registry:        &Registry{},
+				transports:      map[string]*http.Transport{},
+			}
+			r.SetPlainHTTP(host)
+
+			_, err := r.Image(ref)
+			if test.success {
+				if err != nil {
+					t.Fatalf("FATAL: Failed to get image: %v", err)
+				}
+				if requests["old"] > 1 {
+					t.Errorf("Expected rejected credentials to be tried at most once, but got %d requests", requests["old"])
+				}
+			} else if err == nil || !isUnauthorized(err) {
+				t.Fatalf("FATAL: Expected unauthorized error but got %v", err)
+			}
+		})
+	}
+}
+
+// expiringKeychain returns a new token each time its credentials are invalidated.
+type expiringKeychain struct {
+	tokens int
+}
+
+func (k *expiringKeychain) Resolve(authn.Resource) (authn.Authenticator, error) {
+	return &authn.Basic{Username: "user", Password: fmt.Sprintf("token-%d", k.tokens+1)}, nil
+}
+
+func (k *expiringKeychain) Invalidate(authn.Resource) {
+	k.tokens++
+}
+
+func TestRefreshCredentials(t *testing.T) {
+	img, err := random.Image(256, 3)
+	if err != nil {
+		t.Fatalf("FATAL: Failed to create image: %v", err)
+	}
+	rs := newServer(t, registrytest.WithImage("library/expiring:latest", img))
+
+	// the registry accepts the first token for a limited number of requests, and then only the second
+	var mu sync.Mutex
+	accepted := map[string]int{}
+	rs.Intercept(func(resp http.ResponseWriter, req *http.Request) bool {
+		mu.Lock()
+		_, password, _ := req.BasicAuth()
+		valid := password == "token-2" || (password == "token-1" && accepted["token-1"] < 2)
+		if valid {
+			accepted[password]++
+		}
+		mu.Unlock()
+		if !valid {
+			resp.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			resp.WriteHeader(http.StatusUnauthorized)
+			return true
+		}
+		return false
+	})
+	host := rs.Host()
+
+	ref, err := name.ParseReference(host + "/library/expiring:latest")
+	if err != nil {
+		t.Fatalf("FATAL: Failed to parse reference: %v", err)
+	}
+
+	tests := map[string]struct {
+		keychain authn.Keychain
+		success  bool
+	}{
+		"credentials refreshed": {
+			keychain: &expiringKeychain{},
+			success:  true,
+		},
+		"credentials not refreshed": {
+			// a keychain without a cache returns the same credentials each time
+			keychain: credentialprovidertest.NewKeychain(map[string]authn.AuthConfig{host: {Username: "user", Password: "token-1"}}),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			mu.Lock()
+			accepted = map[string]int{}
+			mu.Unlock()
+			r := &Client{
+				DefaultKeychain: test.keychain,
+				Registry:        &Registry{},
+				transports:      map[string]*http.Transport{},
+			}
+			r.SetPlainHTTP(host)
+
+			// the manifest and config are pulled with the first token, which expires before the layers are pulled
+			image, err := r.Image(ref)
+			if err != nil {
+				t.Fatalf("FATAL: Failed to get image: %v", err)
+			}
+			if _, err := image.ConfigFile(); err != nil {
+				t.Fatalf("FATAL: Failed to get config: %v", err)
+			}
+			layers, err := image.Layers()
+			if err != nil {
+				t.Fatalf("FATAL: Failed to get layers: %v", err)
+			}
+			for _, layer := range layers {
+				rc, lerr := layer.Compressed()
+				if lerr == nil {
+					_, lerr = io.Copy(io.Discard, rc)
+					rc.Close()
+				}
+				if lerr != nil {
+					err = lerr
+					break
+				}
+			}
+
+			if test.success {
+				if err != nil {
+					t.Fatalf("FATAL: Failed to pull layers: %v", err)
+				}
+				if accepted["token-2"] != len(layers) {
+					t.Errorf("Expected %d layers to be pulled with the refreshed token, but got %d requests", len(layers), accepted["token-2"])
+				}
+			} else if !isUnauthorized(err) {
+				t.Fatalf("FATAL: Expected unauthorized error but got %v", err)
+			}
+		})
+	}
+}
+
 func TestEndpoint(t *testing.T) {
 	logrus.SetLevel(logrus.DebugLevel)
 
 	endpointTests := map[string]struct {
-		address      string // the address to bind to
-		explicitPort bool   // whether or not to include the port in the URL, even if it is default for the scheme
-		registryTLS  bool   // enable TLS for registry endpoint
-		authTLS      bool   // enable TLS for auth endpoint
-		sameAddress  bool   // use the same endpoint for both registry and auth
-		authScheme   string // scheme to use for authentication (none/basic/bearer)
+		address      string                  // the address to bind to
+		explicitPort bool                    // whether or not to include the port in the URL, even if it is default for the scheme
+		registryTLS  bool                    // enable TLS for registry endpoint
+		authTLS      bool                    // enable TLS for auth endpoint
+		sameAddress  bool                    // use the same endpoint for both registry and auth
+		authScheme   registrytest.AuthScheme // scheme to use for authentication (none/basic/bearer)
 	}{
 		"http anonymous":          {"127.0.0.1:80", false, false, false, true, ""},
 		"http basic+local":        {"127.0.0.1:80", false, false, false, true, "Basic"},
@@ -170,19 +569,25 @@ func TestEndpoint(t *testing.T) {
 				t.Fatal("FATAL: Invalid test case: sameAddress is true, but registryTLS != authTLS")
 			}
 
-			rs, as, mux := newServers(t, test.address, test.registryTLS, test.authTLS, test.sameAddress)
-			defer rs.Close()
-			defer as.Close()
-
-			regHost, regEndpoint := getHostEndpoint(rs.Listener.Addr().String(), test.registryTLS, test.explicitPort)
-			authHost, authEndpoint := getHostEndpoint(as.Listener.Addr().String(), test.authTLS, test.explicitPort)
+			opts := []registrytest.Option{registrytest.WithAddress(test.address), registrytest.WithHostname(localhost), registrytest.WithBusybox()}
+			if test.registryTLS {
+				opts = append(opts, registrytest.WithTLS())
+			}
+			if test.authScheme != "" {
+				opts = append(opts, registrytest.WithAuth(test.authScheme, "user", "pass"))
+			}
+			if !test.sameAddress {
+				opts = append(opts, registrytest.WithTokenServer(test.authTLS))
+			}
+			rs := newServer(t, opts...)
 
-			t.Logf("INFO: %s registry %s at %s, auth %s at %s, scheme %q", t.Name(), regHost, regEndpoint, authHost, authEndpoint, test.authScheme)
+			regHost, regEndpoint := getHostEndpoint(rs.Addr(), test.registryTLS, test.explicitPort)
+			tokenURL, _ := url.Parse(rs.TokenURL())
+			authHost := tokenURL.Host
 
-			mux.Handle("/v2/", serveRegistry(t, test.authScheme, authEndpoint+"/auth"))
-			mux.Handle("/auth/", serveAuth(t))
+			t.Logf("INFO: %s registry %s at %s, auth %s at %s, scheme %q", t.Name(), regHost, regEndpoint, authHost, rs.TokenURL(), test.authScheme)
 
-			r := &registry{
+			r := &Client{
 				DefaultKeychain: authn.DefaultKeychain,
 				Registry: &Registry{
 					Mirrors: map[string]Mirror{
@@ -252,72 +657,15 @@ func TestEndpoint(t *testing.T) {
 	}
 }
 
-// newServers creates and starts httptest.Server instances for the registry and auth endpoints,
-// returning both the servers, and a http.ServeMux used by both servers.  If sameAddress is true,
-// the authentication server is local to the registry - the same server instance is returned for
-// both registry and auth, and the authTLS settings are ignored.  If sameAddress is false, a second
-// server is started on a random port.
-func newServers(t *testing.T, registryAddress string, registryTLS bool, authTLS bool, sameAddress bool) (*httptest.Server, *httptest.Server, *http.ServeMux) {
-	l, err := net.Listen("tcp", registryAddress)
+// newServer starts a fake registry with the options, which is closed when the test ends.
+func newServer(t *testing.T, opts ...registrytest.Option) *registrytest.Server {
+	t.Helper()
+	rs, err := registrytest.New(opts...)
 	if err != nil {
-		t.Fatalf("FATAL: Failed to listen on %s: %v", registryAddress, err)
-	}
-
-	// Create a unique dummy CA and cert for this test's servers, if necessary
-	var tlsConfig *tls.Config
-	if registryTLS || authTLS {
-		caCert, caKey, err := factory.GenCA()
-		if err != nil {
-			t.Fatalf("FATAL: Failed to generate CA: %v", err)
-		}
-
-		cfg := cert.Config{
-			CommonName:   localhost,
-			Organization: []string{t.Name()},
-			Usages:       []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-			AltNames: cert.AltNames{
-				DNSNames: []string{localhost},
-				IPs:      []net.IP{net.IPv4(127, 0, 0, 1)},
-			},
-		}
-		serverCert, err := cert.NewSignedCert(cfg, caKey, caCert, caKey)
-		if err != nil {
-			t.Fatalf("FATAL: Failed to generate certificate: %v", err)
-		}
-
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{
-				{Certificate: [][]byte{serverCert.Raw}, Leaf: serverCert, PrivateKey: caKey},
-				{Certificate: [][]byte{caCert.Raw}, Leaf: caCert},
-			},
-		}
-	}
-
-	mux := http.NewServeMux()
-	rs := &httptest.Server{
-		Listener:    l,
-		Config:      &http.Server{Handler: mux},
-		EnableHTTP2: true,
-		TLS:         tlsConfig,
-	}
-	if registryTLS {
-		rs.StartTLS()
-	} else {
-		rs.Start()
-	}
-	if sameAddress {
-		return rs, rs, mux
-	}
-
-	as := httptest.NewUnstartedServer(mux)
-	as.EnableHTTP2 = true
-	as.TLS = tlsConfig
-	if authTLS {
-		as.StartTLS()
-	} else {
-		as.Start()
+		t.Fatalf("FATAL: Failed to start registry: %v", err)
 	}
-	return rs, as, mux
+	t.Cleanup(rs.Close)
+	return rs
 }
 
 // getHostEndpoint returns both the bare request host value, and the endpoint URL, for the given address.
@@ -343,121 +691,3 @@ func getHostEndpoint(addr string, tls, explicitPort bool) (string, string) {
 
 	return host, scheme + "://" + host
 }
-
-// serveRegistry serves requests to the registry endpoint
-// If authScheme is set and the request does not have an authorization header, the request will
-// be responded to with a requst for authentication.
-// Otherwise, a few canned registry API responses will be served; just enough to satisfy the tests.
-func serveRegistry(t *testing.T, authScheme, realm string) http.Handler {
-	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
-		resp.Header().Add("Docker-Distribution-Api-Version", "registry/2")
-
-		if authScheme != "" && req.Header.Get("Authorization") == "" {
-			var scope string
-			if req.URL.Path == "/v2/" {
-				scope = "registry:catalog"
-			} else if strings.HasPrefix(req.URL.Path, "/v2/library/busybox") {
-				scope = "repository:library/busybox"
-				switch req.Method {
-				case http.MethodGet, http.MethodHead:
-					scope += ":pull"
-				case http.MethodPost, http.MethodPut, http.MethodPatch:
-					scope += ":push,pull"
-				case http.MethodDelete:
-					scope += ":delete"
-				}
-			} else {
-				resp.WriteHeader(http.StatusForbidden)
-				return
-			}
-			resp.Header().Add("WWW-Authenticate", fmt.Sprintf(`%s realm="%s",service="registry",scope="%s"`, authScheme, realm, scope))
-			resp.Header().Add("Content-Type", "application/json")
-			resp.WriteHeader(http.StatusUnauthorized)
-			resp.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required","detail":null}]}`))
-			return
-		}
-
-		switch req.URL.Path {
-		case "/v2/":
-			resp.Header().Add("Content-Type", "application/json")
-			resp.Write([]byte(`{}`))
-		case "/v2/library/busybox/manifests/latest":
-			resp.Header().Add("Content-Type", "application/vnd.docker.distribution.manifest.list.v2+json")
-			resp.Write([]byte(manifestList))
-		case "/v2/library/busybox/manifests/sha256:5cd3db04b8be5773388576a83177aff4f40a03457a63855f4b9cbe30542b9a43":
-			resp.Header().Add("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
-			resp.Write([]byte(manifest))
-		case "/v2/library/busybox/blobs/sha256:8135583d97feb82398909c9c97607159e6db2c4ca2c885c0b8f590ee0f9fe90d":
-			resp.Header().Add("Content-Type", "application/octet-stream")
-			resp.Write([]byte(config))
-		default:
-			resp.WriteHeader(http.StatusNotFound)
-		}
-	})
-}
-
-// serveAuth serves requests to the authorization service endpoint.
-// It does not actually validate any credentials; any request with an Authorization header will be granted a dummy token.
-func serveAuth(t *testing.T) http.Handler {
-	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
-		if req.Method != http.MethodGet {
-			resp.WriteHeader(http.StatusMethodNotAllowed)
-		} else if auth := req.Header.Get("Authorization"); auth != "" {
-			if b64, ok := strings.CutPrefix(auth, "Basic "); ok {
-				if b, err := base64.StdEncoding.DecodeString(b64); err == nil {
-					auth = string(b)
-				}
-			}
-			params := req.URL.Query()
-			t.Logf("Got auth request: %+v for %+v", params, auth)
-			if service := params["service"]; len(service) != 1 || service[0] != "registry" {
-				resp.WriteHeader(http.StatusNotFound)
-			} else if scope := params["scope"]; len(scope) != 1 || !(scope[0] == "registry:catalog" || strings.HasPrefix(scope[0], "repository:library/busybox:")) {
-				resp.WriteHeader(http.StatusNotFound)
-			} else {
-				resp.Header().Add("Content-Type", "application/json")
-				resp.Write([]byte(fmt.Sprintf(`{"token": "abc", "access_token": "123", "expires_in": 300, "issued_at": "%s"}`, time.Now().Format(time.RFC3339))))
-			}
-		} else {
-			resp.WriteHeader(http.StatusForbidden)
-		}
-	})
-}
-
-// a canned single-arch manifest list for the busybox image's latest tag
-var manifestList = `{
-  "manifests": [
-    {
-      "digest": "sha256:5cd3db04b8be5773388576a83177aff4f40a03457a63855f4b9cbe30542b9a43",
-      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
-      "platform": {
-        "architecture": "amd64",
-        "os": "linux"
-      },
-      "size": 528
-    }
-  ],
-  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
-  "schemaVersion": 2
-}`
-
-// a canned manifest for the busybox image's latest tag
-var manifest = `{
-   "schemaVersion": 2,
-   "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
-   "config": {
-      "mediaType": "application/vnd.docker.container.image.v1+json",
-      "size": 1457,
-      "digest": "sha256:8135583d97feb82398909c9c97607159e6db2c4ca2c885c0b8f590ee0f9fe90d"
-   },
-   "layers": [
-      {
-         "mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
-         "size": 2591575,
-         "digest": "sha256:325d69979d33f72bfd1d30d420b8ec7f130919916fd02238ba23e4a22d753ed8"
-      }
-   ]
-}`
-
-// a canned config blob for the busybox image's latest tag
-var config = `{"architecture":"amd64","config":{"Hostname":"","Domainname":"","User":"","AttachStdin":false,"AttachStdout":false,"AttachStderr":false,"Tty":false,"OpenStdin":false,"StdinOnce":false,"Env":["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"],"Cmd":["sh"],"Image":"sha256:505de91dcca928e5436702f887bbd8b81be91e719b552fb5c64e34234d22ac86","Volumes":null,"WorkingDir":"","Entrypoint":null,"OnBuild":null,"Labels":null},"container":"ffeefc40361ae173c8c4a1c2bad0f899f4de97601938eab16b5d019bdf2fa5f3","container_config":{"Hostname":"ffeefc40361a","Domainname":"","User":"","AttachStdin":false,"AttachStdout":false,"AttachStderr":false,"Tty":false,"OpenStdin":false,"StdinOnce":false,"Env":["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"],"Cmd":["/bin/sh","-c","#(nop) ","CMD [\"sh\"]"],"Image":"sha256:505de91dcca928e5436702f887bbd8b81be91e719b552fb5c64e34234d22ac86","Volumes":null,"WorkingDir":"","Entrypoint":null,"OnBuild":null,"Labels":{}},"created":"2023-05-19T20:19:22.751398522Z","docker_version":"20.10.23","history":[{"created":"2023-05-19T20:19:22.642507645Z","created_by":"/bin/sh -c #(nop) ADD file:cfd4bc7e9470d1298c9d4143538a77aa9aedd74f96aa5a3262cf8714c6fc3ec6 in / "},{"created":"2023-05-19T20:19:22.751398522Z","created_by":"/bin/sh -c #(nop)  CMD [\"sh\"]","empty_layer":true}],"os":"linux","rootfs":{"type":"layers","diff_ids":["sha256:9547b4c33213e630a0ca602a989ecc094e042146ae8afa502e1e65af6473db03"]}}`
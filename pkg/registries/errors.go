@@ -0,0 +1,100 @@
+package registries
+
+import (
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+	"go.uber.org/multierr"
+)
+
+// Errors that the errors returned by the client match with errors.Is, so that callers can tell failures apart.
+var (
+	// ErrAllEndpointsFailed is matched when every endpoint for an image or registry was tried, and none succeeded.
+	ErrAllEndpointsFailed = errors.New("all endpoints failed")
+	// ErrNotFound is matched when none of the endpoints tried had the requested reference.
+	ErrNotFound = errors.New("not found at any endpoint")
+	// ErrUnauthorized is matched when a registry rejected the credentials, or required credentials that were not
+	// given. When several endpoints were tried, it is matched if any of them rejected the credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// EndpointsError is returned when every endpoint for an image or registry failed. It matches ErrAllEndpointsFailed,
+// and ErrNotFound if none of the endpoints had the reference. Errs holds the error from each endpoint, in the order
+// that they were tried.
+type EndpointsError struct {
+	Errs []error
+}
+
+func (e *EndpointsError) Error() string {
+	if len(e.Errs) == 0 {
+		return ErrAllEndpointsFailed.Error()
+	}
+	return ErrAllEndpointsFailed.Error() + ": " + multierr.Combine(e.Errs...).Error()
+}
+
+func (e *EndpointsError) Is(target error) bool {
+	switch target {
+	case ErrAllEndpointsFailed:
+		return true
+	case ErrNotFound:
+		return allNotFound(e.Errs)
+	}
+	return false
+}
+
+func (e *EndpointsError) Unwrap() []error {
+	return e.Errs
+}
+
+// unauthorizedError is an error from a registry that rejected the credentials; it matches ErrUnauthorized.
+type unauthorizedError struct {
+	error
+}
+
+func (e *unauthorizedError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+func (e *unauthorizedError) Unwrap() error {
+	return e.error
+}
+
+// wrapUnauthorized returns the error so that it matches ErrUnauthorized, if it is a 401 response from the registry
+// or its token service.
+func wrapUnauthorized(err error) error {
+	if isUnauthorized(err) {
+		return &unauthorizedError{err}
+	}
+	return err
+}
+
+// isUnauthorized returns true if the error is a 401 response from the registry or its token service.
+func isUnauthorized(err error) bool {
+	var terr *transport.Error
+	return errors.As(err, &terr) && terr.StatusCode == http.StatusUnauthorized
+}
+
+// endpointErrors returns the error from each endpoint that was tried, if the error was returned because they all
+// failed, or else the error itself.
+func endpointErrors(err error) []error {
+	var eerr *EndpointsError
+	if errors.As(err, &eerr) {
+		return eerr.Errs
+	}
+	return multierr.Errors(errors.Cause(err))
+}
+
+// allNotFound returns true if there are errors, and each is a 404 response from the registry.
+func allNotFound(errs []error) bool {
+	if len(errs) == 0 {
+		return false
+	}
+	for _, err := range errs {
+		var terr *transport.Error
+		if !errors.As(err, &terr) || terr.StatusCode != http.StatusNotFound {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+package registries
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrors(t *testing.T) {
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+	// a server that has been closed refuses connections
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	img, err := random.Image(1024, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := map[string]struct {
+		// mirrors are the endpoints that the image is pulled through, before the default endpoint
+		mirrors  []string
+		expected []error
+		others   []error
+	}{
+		"not found": {
+			mirrors:  []string{notFound.URL},
+			expected: []error{ErrAllEndpointsFailed, ErrNotFound},
+			others:   []error{ErrUnauthorized},
+		},
+		"unauthorized": {
+			mirrors:  []string{unauthorized.URL, notFound.URL},
+			expected: []error{ErrAllEndpointsFailed, ErrUnauthorized},
+			others:   []error{ErrNotFound},
+		},
+		"unreachable": {
+			mirrors:  []string{unreachable.URL},
+			expected: []error{ErrAllEndpointsFailed},
+			others:   []error{ErrNotFound, ErrUnauthorized},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			// the default endpoint is a server that does not have the image either
+			u, _ := url.Parse(notFound.URL)
+			registry := &Registry{}
+			registry.AddMirror(u.Host, test.mirrors...)
+			r, err := New(registry, WithDefaultKeychain(authn.NewMultiKeychain()))
+			if !assert.NoError(t, err) {
+				return
+			}
+			r.SetPlainHTTP(u.Host)
+			ref, _ := name.ParseReference(u.Host + "/test/errors:v1")
+
+			_, err = r.Image(ref, remote.WithRetryStatusCodes())
+			var eerr *EndpointsError
+			if assert.True(t, errors.As(err, &eerr), "expected an EndpointsError but got %v", err) {
+				assert.Len(t, eerr.Errs, len(test.mirrors)+1)
+			}
+			for _, target := range test.expected {
+				assert.True(t, errors.Is(err, target), "expected %v to match %v", err, target)
+			}
+			for _, target := range test.others {
+				assert.False(t, errors.Is(err, target), "expected %v not to match %v", err, target)
+			}
+		})
+	}
+
+	t.Run("write unauthorized", func(t *testing.T) {
+		u, _ := url.Parse(unauthorized.URL)
+		r, err := New(nil, WithDefaultKeychain(authn.NewMultiKeychain()))
+		if !assert.NoError(t, err) {
+			return
+		}
+		ref, _ := name.ParseReference(u.Host + "/test/errors:v1")
+		err = r.Write(ref, img)
+		assert.True(t, errors.Is(err, ErrUnauthorized), "expected %v to match %v", err, ErrUnauthorized)
+		assert.False(t, errors.Is(err, ErrAllEndpointsFailed), "expected %v not to match %v", err, ErrAllEndpointsFailed)
+	})
+
+	t.Run("ping unauthorized", func(t *testing.T) {
+		u, _ := url.Parse(unauthorized.URL)
+		r, err := New(nil, WithDefaultKeychain(authn.NewMultiKeychain()))
+		if !assert.NoError(t, err) {
+			return
+		}
+		reg, _ := name.NewRegistry(u.Host)
+		_, err = r.Ping(context.Background(), reg, nil)
+		assert.True(t, errors.Is(err, ErrUnauthorized), "expected %v to match %v", err, ErrUnauthorized)
+		assert.True(t, errors.Is(err, ErrAllEndpointsFailed), "expected %v to match %v", err, ErrAllEndpointsFailed)
+	})
+}
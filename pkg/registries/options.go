@@ -0,0 +1,152 @@
+package registries
+
+import (
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/logging"
+)
+
+// Option configures a Client created by New.
+type Option func(*Client) error
+
+// RetryPolicy sets how reads from registries are retried when they fail with an error that IsRetryable.
+type RetryPolicy struct {
+	// Retries is the number of times a failed read is retried; zero disables retries.
+	Retries int
+	// Delay is how long to wait before each retry.
+	Delay time.Duration
+}
+
+// RequestMetric describes a request made to a registry endpoint, for the hook set by WithMetrics.
+type RequestMetric struct {
+	// Endpoint is the URL of the endpoint that the request was made to.
+	Endpoint string
+	Method   string
+	// StatusCode is the status of the response, or zero if no response was received.
+	StatusCode int
+	Duration   time.Duration
+	// Err is the error that the request failed with, if no response was received.
+	Err error
+}
+
+// New returns a client for the registry configuration, with the options applied. A nil configuration has no mirrors,
+// rewrites, or credentials, so that images are pulled from the registries that they name. Without options, the
+// client looks up credentials in authn.DefaultKeychain, does not retry, and connects with default transport settings.
+func New(registry *Registry, opts ...Option) (*Client, error) {
+	if registry == nil {
+		registry = &Registry{}
+	}
+	r := &Client{
+		DefaultKeychain: authn.DefaultKeychain,
+		Registry:        registry,
+		transports:      map[string]*http.Transport{},
+	}
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// WithDefaultKeychain sets the keychain that credentials are looked up in for endpoints that have none in the
+// registry configuration, instead of authn.DefaultKeychain. Use authn.NewMultiKeychain() to pull anonymously.
+func WithDefaultKeychain(keychain authn.Keychain) Option {
+	return func(r *Client) error {
+		if keychain == nil {
+			return errors.New("default keychain must not be nil")
+		}
+		r.DefaultKeychain = keychain
+		return nil
+	}
+}
+
+// WithUserAgent sets the User-Agent that requests to registries are made with, ahead of the one that
+// go-containerregistry adds. A user agent given in the options of a request takes precedence.
+func WithUserAgent(userAgent string) Option {
+	return func(r *Client) error {
+		if strings.TrimSpace(userAgent) == "" {
+			return errors.New("user agent must not be empty")
+		}
+		if strings.IndexFunc(userAgent, unicode.IsControl) >= 0 {
+			return errors.Errorf("user agent %q must not contain control characters", userAgent)
+		}
+		r.userAgent = userAgent
+		return nil
+	}
+}
+
+// WithRetryPolicy retries reads from registries, such as getting a manifest or listing tags, that fail with an error
+// that IsRetryable. Every endpoint for the image is tried again on each retry.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(r *Client) error {
+		if policy.Retries < 0 {
+			return errors.Errorf("invalid retries %d: must not be negative", policy.Retries)
+		}
+		if policy.Delay < 0 {
+			return errors.Errorf("invalid retry delay %s: must not be negative", policy.Delay)
+		}
+		r.retryPolicy = policy
+		return nil
+	}
+}
+
+// WithMetrics calls the hook with a RequestMetric for each request made to a registry endpoint, after its response
+// headers are received. The hook may be called from several goroutines at once, when images are pulled in parallel.
+func WithMetrics(hook func(RequestMetric)) Option {
+	return func(r *Client) error {
+		if hook == nil {
+			return errors.New("metrics hook must not be nil")
+		}
+		r.metrics = hook
+		return nil
+	}
+}
+
+// WithTransportDefaults sets the transport that the transports for registry endpoints are copied from, instead of
+// the defaults used by go-containerregistry, such as to set a proxy or connection limits. The TLS configuration of
+// each HTTPS endpoint replaces that of the transport, if the registry configuration has any for it.
+func WithTransportDefaults(transport *http.Transport) Option {
+	return func(r *Client) error {
+		if transport == nil {
+			return errors.New("default transport must not be nil")
+		}
+		r.transportDefaults = transport
+		return nil
+	}
+}
+
+// WithLogger sets the logger that the client logs the endpoints it tries, and problems with the registry
+// configuration, to, instead of the standard logrus logger.
+func WithLogger(logger logging.Logger) Option {
+	return func(r *Client) error {
+		if logger == nil {
+			return errors.New("logger must not be nil")
+		}
+		r.logger = logger
+		return nil
+	}
+}
+
+// log returns the client's logger, or the default logger if it has none.
+func (r *Client) log() logging.Logger {
+	return logging.OrDefault(r.logger)
+}
+
+// remoteOptions returns the options for a request to a registry endpoint: the client's user agent, if it has one, and
+// the client's own options for the request, such as the transport and credentials of the endpoint, followed by the
+// options given by the caller, so that those take precedence.
+func (r *Client) remoteOptions(own []remote.Option, options []remote.Option) []remote.Option {
+	all := []remote.Option{}
+	if r.userAgent != "" {
+		all = append(all, remote.WithUserAgent(r.userAgent))
+	}
+	all = append(all, own...)
+	return append(all, options...)
+}
@@ -0,0 +1,230 @@
+package registries
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/rancher/wharfie/pkg/credentialprovider/credentialprovidertest"
+	"github.com/rancher/wharfie/pkg/logging"
+	"github.com/rancher/wharfie/pkg/registries/registrytest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	r, err := New(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, authn.DefaultKeychain, r.DefaultKeychain)
+	assert.Equal(t, &Registry{}, r.Registry)
+	assert.Equal(t, RetryPolicy{}, r.retryPolicy)
+	assert.Equal(t, remote.DefaultTransport, r.getTransport(&url.URL{Scheme: "http", Host: "registry.local"}))
+
+	invalid := map[string]Option{
+		"nil keychain":           WithDefaultKeychain(nil),
+		"empty user agent":       WithUserAgent(" "),
+		"user agent with CRLF":   WithUserAgent("wharfie\r\nX-Injected: true"),
+		"negative retries":       WithRetryPolicy(RetryPolicy{Retries: -1}),
+		"negative retry delay":   WithRetryPolicy(RetryPolicy{Retries: 1, Delay: -time.Second}),
+		"nil metrics hook":       WithMetrics(nil),
+		"nil transport defaults": WithTransportDefaults(nil),
+		"nil logger":             WithLogger(nil),
+	}
+	for testName, opt := range invalid {
+		t.Run(testName, func(t *testing.T) {
+			r, err := New(&Registry{}, opt)
+			assert.Error(t, err)
+			assert.Nil(t, r)
+			_, err = GetPrivateRegistriesFromBytes(nil, opt)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestOptions(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if !assert.NoError(t, err) {
+		return
+	}
+	server := newServer(t, registrytest.WithImage("test/options:v1", img))
+	ref, _ := name.ParseReference(server.Host() + "/test/options:v1")
+	digest, _ := img.Digest()
+
+	// pull pulls the image with a client created with the options, while the requests to the registry are passed to
+	// the interceptor, which handles the request itself if it returns true. The retries of go-containerregistry are
+	// disabled, so that only those of the client are made.
+	pull := func(t *testing.T, f func(w http.ResponseWriter, req *http.Request) bool, opts ...Option) error {
+		server.Intercept(f)
+		defer server.Intercept(nil)
+		r, err := New(nil, opts...)
+		if err != nil {
+			return err
+		}
+		img, err := r.Image(ref, remote.WithRetryStatusCodes())
+		if err != nil {
+			return err
+		}
+		if _, err := img.ConfigFile(); err != nil {
+			return err
+		}
+		if actual, _ := img.Digest(); actual != digest {
+			t.Errorf("Expected image %s but got %s", digest, actual)
+		}
+		return nil
+	}
+
+	t.Run("default keychain", func(t *testing.T) {
+		requireAuth := func(w http.ResponseWriter, req *http.Request) bool {
+			if user, pass, ok := req.BasicAuth(); ok && user == "user" && pass == "pass" {
+				return false
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return true
+		}
+		keychain := credentialprovidertest.NewKeychain(map[string]authn.AuthConfig{server.Host(): {Username: "user", Password: "pass"}})
+		assert.NoError(t, pull(t, requireAuth, WithDefaultKeychain(keychain)))
+		assert.Contains(t, keychain.Lookups(), credentialprovidertest.Lookup{Target: ref.Context().String(), Key: server.Host()})
+		assert.Error(t, pull(t, requireAuth, WithDefaultKeychain(authn.NewMultiKeychain())))
+	})
+
+	t.Run("user agent", func(t *testing.T) {
+		agents := []string{}
+		record := func(w http.ResponseWriter, req *http.Request) bool {
+			agents = append(agents, req.UserAgent())
+			return false
+		}
+		if !assert.NoError(t, pull(t, record, WithUserAgent("wharfie-test/1.0"))) {
+			return
+		}
+		assert.NotEmpty(t, agents)
+		for _, agent := range agents {
+			assert.True(t, strings.HasPrefix(agent, "wharfie-test/1.0 "), "unexpected User-Agent %q", agent)
+		}
+	})
+
+	t.Run("retry policy", func(t *testing.T) {
+		// each pull fails its first two manifest requests
+		var failures int
+		unavailable := func(w http.ResponseWriter, req *http.Request) bool {
+			if strings.Contains(req.URL.Path, "/manifests/") && failures < 2 {
+				failures++
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return true
+			}
+			return false
+		}
+		assert.NoError(t, pull(t, unavailable, WithRetryPolicy(RetryPolicy{Retries: 2, Delay: time.Millisecond})))
+		assert.Equal(t, 2, failures)
+
+		failures = 0
+		err := pull(t, unavailable, WithRetryPolicy(RetryPolicy{Retries: 1}))
+		assert.True(t, IsRetryable(err), "expected a retryable error but got %v", err)
+
+		failures = 0
+		err = pull(t, unavailable)
+		assert.True(t, IsRetryable(err), "expected a retryable error but got %v", err)
+		assert.Equal(t, 1, failures)
+	})
+
+	t.Run("metrics", func(t *testing.T) {
+		var metricsMu sync.Mutex
+		metrics := []RequestMetric{}
+		hook := func(m RequestMetric) {
+			metricsMu.Lock()
+			defer metricsMu.Unlock()
+			metrics = append(metrics, m)
+		}
+		if !assert.NoError(t, pull(t, nil, WithMetrics(hook))) {
+			return
+		}
+		assert.NotEmpty(t, metrics)
+		for _, m := range metrics {
+			assert.Equal(t, server.URL()+"/v2", m.Endpoint)
+			assert.Equal(t, http.StatusOK, m.StatusCode)
+			assert.NoError(t, m.Err)
+			assert.NotEmpty(t, m.Method)
+		}
+	})
+
+	t.Run("logger", func(t *testing.T) {
+		// the image is pulled through a mirror, so that the request URLs are modified
+		registry := &Registry{}
+		registry.AddMirror("registry.example.com", server.URL())
+		recorder := &logging.Recorder{}
+		r, err := New(registry, WithLogger(recorder))
+		if !assert.NoError(t, err) {
+			return
+		}
+		mirrored, _ := name.ParseReference("registry.example.com/test/options:v1")
+		if _, err := r.Image(mirrored); !assert.NoError(t, err) {
+			return
+		}
+
+		entry, ok := recorder.Find(logging.LevelDebug, "Trying endpoint")
+		assert.True(t, ok, "expected endpoint to be logged: %v", recorder.Entries())
+		assert.Equal(t, logging.Fields{"image": mirrored.Name(), "endpoint": server.URL() + "/v2"}, entry.Fields)
+		_, ok = recorder.Find(logging.LevelDebug, fmt.Sprintf("Registry endpoint URL modified: https://registry.example.com/v2/ => %s/v2/?ns=registry.example.com", server.URL()))
+		assert.True(t, ok, "expected modified endpoint URL to be logged: %v", recorder.Entries())
+		_, ok = recorder.Find(logging.LevelDebug, "Got image from endpoint")
+		assert.True(t, ok, "expected endpoint to be logged: %v", recorder.Entries())
+	})
+
+	t.Run("transport defaults", func(t *testing.T) {
+		var proxied int
+		defaults := http.DefaultTransport.(*http.Transport).Clone()
+		defaults.Proxy = func(req *http.Request) (*url.URL, error) {
+			proxied++
+			return nil, nil
+		}
+		if !assert.NoError(t, pull(t, nil, WithTransportDefaults(defaults))) {
+			return
+		}
+		assert.NotZero(t, proxied)
+	})
+
+	t.Run("remote options", func(t *testing.T) {
+		// the options given to the request are applied after the client's own, such as the user agent and the
+		// transport of the endpoint, so that they take precedence
+		agents := []string{}
+		transport := &recordingTransport{next: remote.DefaultTransport}
+		record := func(w http.ResponseWriter, req *http.Request) bool {
+			agents = append(agents, req.UserAgent())
+			return false
+		}
+		server.Intercept(record)
+		defer server.Intercept(nil)
+		r, err := New(nil, WithUserAgent("wharfie-test/1.0"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		if _, err := r.Image(ref, remote.WithTransport(transport), remote.WithUserAgent("caller/2.0")); !assert.NoError(t, err) {
+			return
+		}
+		assert.NotZero(t, transport.requests)
+		assert.NotEmpty(t, agents)
+		for _, agent := range agents {
+			assert.True(t, strings.HasPrefix(agent, "caller/2.0 "), "unexpected User-Agent %q", agent)
+		}
+	})
+}
+
+// recordingTransport counts the requests that are made through it.
+type recordingTransport struct {
+	next     http.RoundTripper
+	requests int
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests++
+	return t.next.RoundTrip(req)
+}
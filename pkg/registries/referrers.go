@@ -0,0 +1,109 @@
+package registries
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CosignSignatureArtifactType is the artifact type of referrers found under the tag that cosign stores the
+	// signatures of an image under.
+	CosignSignatureArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	// CosignAttestationArtifactType is the artifact type of referrers found under the tag that cosign stores the
+	// attestations of an image under.
+	CosignAttestationArtifactType = "application/vnd.dev.cosign.artifact.att.v1+json"
+	// CosignSBOMArtifactType is the artifact type of referrers found under the tag that cosign stores the SBOMs of an
+	// image under.
+	CosignSBOMArtifactType = "application/vnd.dev.cosign.artifact.sbom.v1+json"
+	// ReferrerTagAnnotation is the annotation that holds the tag of referrers found under a cosign tag, so that they
+	// can be copied to the same tag.
+	ReferrerTagAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// cosignTags are the suffixes of the tags that cosign stores referrers under, after the digest of the image, and the
+// artifact types that the referrers found under them are reported as.
+var cosignTags = []struct {
+	suffix       string
+	artifactType string
+}{
+	{".sig", CosignSignatureArtifactType},
+	{".att", CosignAttestationArtifactType},
+	{".sbom", CosignSBOMArtifactType},
+}
+
+// errNoReferrers is returned by endpoints that have no referrers for a digest, so that the next endpoint is tried.
+var errNoReferrers = &transport.Error{
+	StatusCode: http.StatusNotFound,
+	Errors:     []transport.Diagnostic{{Code: transport.ManifestUnknownErrorCode, Message: "no referrers found"}},
+}
+
+// Referrers returns the descriptors of the manifests that refer to the digest, such as signatures, SBOMs, and
+// provenance attestations, from the first endpoint that has any. If artifactType is set, only referrers of that
+// artifact type are returned. Repository rewrites are applied, and endpoints are tried, as for Image.
+//
+// Referrers are listed with the OCI referrers API. Endpoints that do not support the API are checked for the index
+// under the referrers tag of the digest instead. If an endpoint has neither, the tags that cosign stores signatures,
+// attestations, and SBOMs under are checked. Referrers found under a cosign tag have the cosign artifact type, and
+// the tag in their ReferrerTagAnnotation. An empty list is returned if none of the endpoints have any referrers.
+func (r *Client) Referrers(ref name.Digest, artifactType string, options ...remote.Option) ([]v1.Descriptor, error) {
+	var referrers []v1.Descriptor
+	_, err := r.tryEndpoints(ref, options, func(ref name.Reference, options ...remote.Option) (err error) {
+		referrers, err = endpointReferrers(ref.Context().Digest(ref.Identifier()), artifactType, options)
+		return err
+	})
+	if IsNotFound(err) {
+		return []v1.Descriptor{}, nil
+	}
+	return referrers, err
+}
+
+// endpointReferrers returns the referrers of the digest from a single endpoint, as Referrers does, or errNoReferrers
+// if it has none.
+func endpointReferrers(ref name.Digest, artifactType string, options []remote.Option) ([]v1.Descriptor, error) {
+	if artifactType != "" {
+		options = append(options, remote.WithFilter("artifactType", artifactType))
+	}
+	index, err := remote.Referrers(ref, options...)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	if len(manifest.Manifests) > 0 {
+		return manifest.Manifests, nil
+	}
+
+	digest, err := v1.NewHash(ref.DigestStr())
+	if err != nil {
+		return nil, err
+	}
+	referrers := []v1.Descriptor{}
+	for _, cosignTag := range cosignTags {
+		if artifactType != "" && artifactType != cosignTag.artifactType {
+			continue
+		}
+		tag := fmt.Sprintf("%s-%s%s", digest.Algorithm, digest.Hex, cosignTag.suffix)
+		desc, err := remote.Head(ref.Context().Tag(tag), options...)
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		desc.ArtifactType = cosignTag.artifactType
+		desc.Annotations = map[string]string{ReferrerTagAnnotation: tag}
+		referrers = append(referrers, *desc)
+	}
+	if len(referrers) == 0 {
+		return nil, errNoReferrers
+	}
+	return referrers, nil
+}
@@ -0,0 +1,127 @@
+package registries
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/rancher/wharfie/pkg/registries/registrytest"
+	"github.com/stretchr/testify/assert"
+)
+
+// sbom returns an artifact that refers to the image, with the SPDX artifact type.
+func sbom(t *testing.T, subject v1.Image) v1.Image {
+	t.Helper()
+	artifact, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("Failed to create artifact: %v", err)
+	}
+	artifact = mutate.MediaType(artifact, types.OCIManifestSchema1)
+	artifact = mutate.ConfigMediaType(artifact, "application/spdx+json")
+	digest, _ := subject.Digest()
+	size, _ := subject.Size()
+	mediaType, _ := subject.MediaType()
+	return mutate.Subject(artifact, v1.Descriptor{MediaType: mediaType, Digest: digest, Size: size}).(v1.Image)
+}
+
+func TestReferrers(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	img = mutate.MediaType(img, types.OCIManifestSchema1)
+	digest, _ := img.Digest()
+	artifact := sbom(t, img)
+	artifactDigest, _ := artifact.Digest()
+	signature, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatalf("Failed to create signature: %v", err)
+	}
+	signatureDigest, _ := signature.Digest()
+	signatureTag := fmt.Sprintf("%s-%s.sig", digest.Algorithm, digest.Hex)
+
+	tests := map[string]struct {
+		opts         []registrytest.Option
+		artifactType string
+		expected     []v1.Hash
+		// tag is the ReferrerTagAnnotation expected on each referrer
+		tag string
+	}{
+		"referrers API": {
+			opts:     []registrytest.Option{registrytest.WithReferrers(), registrytest.WithImage("mirrored/app:v1", img), registrytest.WithImage("mirrored/app:sbom", artifact)},
+			expected: []v1.Hash{artifactDigest},
+		},
+		"referrers API with artifact type": {
+			opts:         []registrytest.Option{registrytest.WithReferrers(), registrytest.WithImage("mirrored/app:v1", img), registrytest.WithImage("mirrored/app:sbom", artifact)},
+			artifactType: "application/spdx+json",
+			expected:     []v1.Hash{artifactDigest},
+		},
+		"referrers API with other artifact type": {
+			opts:         []registrytest.Option{registrytest.WithReferrers(), registrytest.WithImage("mirrored/app:v1", img), registrytest.WithImage("mirrored/app:sbom", artifact)},
+			artifactType: "application/vnd.in-toto+json",
+			expected:     []v1.Hash{},
+		},
+		"referrers tag": {
+			opts:     []registrytest.Option{registrytest.WithImage("mirrored/app:v1", img), registrytest.WithImage("mirrored/app:sbom", artifact)},
+			expected: []v1.Hash{artifactDigest},
+		},
+		"cosign tag": {
+			opts:     []registrytest.Option{registrytest.WithImage("mirrored/app:v1", img), registrytest.WithImage("mirrored/app:"+signatureTag, signature)},
+			expected: []v1.Hash{signatureDigest},
+			tag:      signatureTag,
+		},
+		"cosign tag with other artifact type": {
+			opts:         []registrytest.Option{registrytest.WithImage("mirrored/app:v1", img), registrytest.WithImage("mirrored/app:"+signatureTag, signature)},
+			artifactType: CosignSBOMArtifactType,
+			expected:     []v1.Hash{},
+		},
+		"no referrers": {
+			opts:     []registrytest.Option{registrytest.WithReferrers(), registrytest.WithImage("mirrored/app:v1", img)},
+			expected: []v1.Hash{},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			// The image is requested from the registry as localhost, and as team/app, which only the mirror endpoint
+			// rewrites to the repository that it was pushed to, so that referrers are only found if the rewrite is
+			// applied.
+			server := newServer(t, test.opts...)
+			_, port, _ := net.SplitHostPort(server.Addr())
+			regHost := net.JoinHostPort("localhost", port)
+			r, err := GetPrivateRegistriesFromBytes([]byte(fmt.Sprintf(`
+mirrors:
+  %s:
+    endpoint:
+      - %s
+    rewrite:
+      "^team/(.*)": "mirrored/$1"
+`, regHost, server.URL())))
+			if !assert.NoError(t, err) {
+				return
+			}
+			ref, _ := name.NewDigest(regHost + "/team/app@" + digest.String())
+
+			referrers, err := r.Referrers(ref, test.artifactType)
+			if !assert.NoError(t, err) {
+				return
+			}
+			digests := []v1.Hash{}
+			for _, referrer := range referrers {
+				digests = append(digests, referrer.Digest)
+				if test.tag != "" {
+					assert.Equal(t, CosignSignatureArtifactType, referrer.ArtifactType)
+					assert.Equal(t, test.tag, referrer.Annotations[ReferrerTagAnnotation])
+				} else {
+					assert.Equal(t, "application/spdx+json", referrer.ArtifactType)
+				}
+			}
+			assert.Equal(t, test.expected, digests)
+		})
+	}
+}
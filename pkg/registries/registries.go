@@ -1,9 +1,11 @@
 package registries
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -11,56 +13,427 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
-	"go.uber.org/multierr"
+	"github.com/rancher/wharfie/pkg/logging"
 	"gopkg.in/yaml.v2"
 )
 
-// registry stores information necessary to configure authentication and
-// connections to remote registries, including overriding registry endpoints
-type registry struct {
+// Client stores information necessary to configure authentication and
+// connections to remote registries, including overriding registry endpoints.
+// Clients are created by New, or by loading the registry configuration.
+type Client struct {
+	// DefaultKeychain is the keychain that credentials are looked up in for endpoints that have none configured.
+	//
+	// Deprecated: set it with WithDefaultKeychain when the client is created; changing it once the client is in use
+	// is not safe.
 	DefaultKeychain authn.Keychain
 	Registry        *Registry
 
-	transports map[string]*http.Transport
+	plainHTTP         map[string]bool
+	flagTLS           map[string]bool
+	transports        map[string]*http.Transport
+	transportsLock    sync.Mutex
+	tracer            *requestTracer
+	userAgent         string
+	retryPolicy       RetryPolicy
+	metrics           func(RequestMetric)
+	transportDefaults *http.Transport
+	logger            logging.Logger
 }
 
-// getPrivateRegistries loads private registry configuration from a given file
+// GetPrivateRegistries loads private registry configuration from a given file
 // If no file exists at the given path, default settings are returned.
 // Errors such as unreadable files or unparseable content are raised.
-func GetPrivateRegistries(path string) (*registry, error) {
-	registry := &registry{
-		DefaultKeychain: authn.DefaultKeychain,
-		Registry:        &Registry{},
-		transports:      map[string]*http.Transport{},
-	}
+// The client is created with the options, as for New.
+func GetPrivateRegistries(path string, opts ...Option) (*Client, error) {
 	privRegistryFile, err := ioutil.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return registry, nil
+			return New(nil, opts...)
 		}
 		return nil, err
 	}
-	logrus.Infof("Using private registry config file at %s", path)
-	if err := yaml.Unmarshal(privRegistryFile, registry.Registry); err != nil {
+	registry, err := GetPrivateRegistriesFromBytes(privRegistryFile, opts...)
+	if err != nil {
 		return nil, err
 	}
+	registry.log().Infof("Using private registry config file at %s", path)
 	return registry, nil
 }
 
-func (r *registry) Image(ref name.Reference, options ...remote.Option) (v1.Image, error) {
-	endpoints, err := r.getEndpoints(ref)
+// GetPrivateRegistriesFromReader loads private registry configuration from a reader, such as stdin, in the same
+// format as the configuration file. If nothing is read, default settings are returned.
+func GetPrivateRegistriesFromReader(r io.Reader, opts ...Option) (*Client, error) {
+	b, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	return GetPrivateRegistriesFromBytes(b, opts...)
+}
+
+// GetPrivateRegistriesFromBytes loads private registry configuration from its content, such as a Kubernetes Secret
+// or configuration generated by the caller, in the same format as the configuration file. YAML is a superset of JSON,
+// so configuration given as JSON is parsed as YAML too, with the same field names. If the content is empty, default
+// settings are returned.
+func GetPrivateRegistriesFromBytes(b []byte, opts ...Option) (*Client, error) {
+	registry := &Registry{}
+	if err := yaml.Unmarshal(b, registry); err != nil {
+		return nil, err
+	}
+	return New(registry, opts...)
+}
+
+// Image returns the image for the reference from the first endpoint that provides it,
+// applying repository rewrites for non-default endpoints. As for all requests, the options are applied after the
+// client's own user agent, and the transport and credentials of each endpoint, so that they take precedence.
+func (r *Client) Image(ref name.Reference, options ...remote.Option) (v1.Image, error) {
+	var img v1.Image
+	_, err := r.tryEndpoints(ref, options, func(ref name.Reference, options ...remote.Option) (err error) {
+		img, err = remote.Image(ref, options...)
+		return err
+	})
+	return img, err
+}
+
+// Get returns the descriptor for the reference from the first endpoint that provides it, which may
+// be either an image or an image index. Repository rewrites are applied as for Image.
+func (r *Client) Get(ref name.Reference, options ...remote.Option) (*remote.Descriptor, error) {
+	desc, _, err := r.GetEndpoint(ref, options...)
+	return desc, err
+}
+
+// GetEndpoint returns the descriptor for the reference as Get does, along with the URL of the endpoint that has it.
+func (r *Client) GetEndpoint(ref name.Reference, options ...remote.Option) (*remote.Descriptor, string, error) {
+	var desc *remote.Descriptor
+	endpoint, err := r.tryEndpoints(ref, options, func(ref name.Reference, options ...remote.Option) (err error) {
+		desc, err = remote.Get(ref, options...)
+		return err
+	})
+	return desc, endpoint, err
+}
+
+// Head returns the descriptor for the reference from the first endpoint that has it, using a HEAD request so that
+// the manifest is not downloaded. Repository rewrites are applied as for Image.
+func (r *Client) Head(ref name.Reference, options ...remote.Option) (*v1.Descriptor, error) {
+	desc, _, err := r.HeadEndpoint(ref, options...)
+	return desc, err
+}
+
+// HeadEndpoint returns the descriptor for the reference as Head does, along with the URL of the endpoint that has it.
+func (r *Client) HeadEndpoint(ref name.Reference, options ...remote.Option) (*v1.Descriptor, string, error) {
+	var desc *v1.Descriptor
+	endpoint, err := r.tryEndpoints(ref, options, func(ref name.Reference, options ...remote.Option) (err error) {
+		desc, err = remote.Head(ref, options...)
+		return err
+	})
+	return desc, endpoint, err
+}
+
+// ListTags returns the tags in the repository from the first endpoint that lists them, along with the URL of that
+// endpoint. Paginated tag lists are followed to the end. Repository rewrites are applied as for Image.
+func (r *Client) ListTags(repo name.Repository, options ...remote.Option) ([]string, string, error) {
+	var tags []string
+	endpoint, err := r.tryEndpoints(repo.Tag(name.DefaultTag), options, func(ref name.Reference, options ...remote.Option) (err error) {
+		tags, err = remote.List(ref.Context(), options...)
+		return err
+	})
+	return tags, endpoint, err
+}
+
+// Write pushes the image to the reference at the default endpoint for its registry; mirrors are only used
+// for pulls. Blobs that already exist at the destination are not uploaded again.
+func (r *Client) Write(ref name.Reference, img v1.Image, options ...remote.Option) error {
+	endpoint, err := r.defaultEndpoint(ref)
+	if err != nil {
+		return err
+	}
+	err = remote.Write(ref, img, r.remoteOptions(endpointOptions(endpoint), options)...)
+	return wrapUnauthorized(err)
+}
+
+// WriteIndex pushes the image index, and all of the images it references, to the reference at the default
+// endpoint for its registry. Blobs that already exist at the destination are not uploaded again.
+func (r *Client) WriteIndex(ref name.Reference, index v1.ImageIndex, options ...remote.Option) error {
+	endpoint, err := r.defaultEndpoint(ref)
+	if err != nil {
+		return err
+	}
+	err = remote.WriteIndex(ref, index, r.remoteOptions(endpointOptions(endpoint), options)...)
+	return wrapUnauthorized(err)
+}
+
+// BlobExists returns true if the blob exists in the repository at the default endpoint for its registry.
+func (r *Client) BlobExists(ctx context.Context, repo name.Repository, digest v1.Hash) (bool, error) {
+	endpoint, err := r.defaultEndpoint(repo.Tag(name.DefaultTag))
+	if err != nil {
+		return false, err
+	}
+	auth, err := endpoint.Resolve(repo)
+	if err != nil {
+		return false, err
+	}
+	var rt http.RoundTripper = endpoint
+	if r.userAgent != "" {
+		rt = transport.NewUserAgent(rt, r.userAgent)
+	}
+	if logs.Enabled(logs.Debug) {
+		rt = transport.NewLogger(rt)
+	}
+	t, err := transport.NewWithContext(ctx, repo.Registry, auth, rt, []string{repo.Scope(transport.PullScope)})
+	if err != nil {
+		return false, wrapUnauthorized(err)
+	}
+
+	u := url.URL{Scheme: repo.Scheme(), Host: repo.RegistryStr(), Path: fmt.Sprintf("/v2/%s/blobs/%s", repo.RepositoryStr(), digest)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := (&http.Client{Transport: t}).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := transport.CheckError(resp, http.StatusOK); err != nil {
+		return false, wrapUnauthorized(err)
+	}
+	return true, nil
+}
+
+// Ping checks that the registry accepts the credentials, by requesting its API root through each endpoint for the
+// registry in turn, until one succeeds, and returns the URL of the endpoint that succeeded. If the credentials are
+// nil, those configured for the endpoint are used.
+func (r *Client) Ping(ctx context.Context, reg name.Registry, auth authn.Authenticator) (string, error) {
+	// only the registry of the reference is used to select endpoints
+	endpoints, err := r.getEndpoints(reg.Repo("library").Tag(name.DefaultTag))
+	if err != nil {
+		return "", err
+	}
+
+	errs := []error{}
+	for _, endpoint := range endpoints {
+		logger := r.log().WithFields(logging.Fields{"registry": reg.RegistryStr(), "endpoint": endpoint.url.String()})
+		logger.Debugf("Trying endpoint")
+		if err := r.ping(ctx, reg, endpoint, auth); err != nil {
+			logger.WithFields(logging.Fields{"error": err}).Warnf("Failed to authenticate to endpoint")
+			errs = append(errs, wrapUnauthorized(err))
+			continue
+		}
+		return endpoint.url.String(), nil
+	}
+	return "", &EndpointsError{Errs: errs}
+}
+
+// ping requests the API root of the registry through the endpoint, with the credentials.
+func (r *Client) ping(ctx context.Context, reg name.Registry, endpoint endpoint, auth authn.Authenticator) error {
+	if auth == nil {
+		var err error
+		if auth, err = endpoint.Resolve(reg); err != nil {
+			return err
+		}
+	}
+	var rt http.RoundTripper = endpoint
+	if r.userAgent != "" {
+		rt = transport.NewUserAgent(rt, r.userAgent)
+	}
+	if logs.Enabled(logs.Debug) {
+		rt = transport.NewLogger(rt)
+	}
+	t, err := transport.NewWithContext(ctx, reg, auth, rt, nil)
+	if err != nil {
+		return err
+	}
+
+	u := url.URL{Scheme: reg.Scheme(), Host: reg.RegistryStr(), Path: "/v2/"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: t}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return transport.CheckError(resp, http.StatusOK)
+}
+
+// SetInsecureSkipVerify disables verification of TLS certificates for the registry, or for all registries if the
+// registry is "*", by merging TLS configuration into the loaded configuration. TLS settings that were already
+// loaded take precedence; the keys of the configurations that were left unchanged for that reason are returned.
+// It must be called before any images are pulled.
+func (r *Client) SetInsecureSkipVerify(registry string) []string {
+	if registry != "*" {
+		return r.SetTLS(registry, TLSConfig{InsecureSkipVerify: true})
+	}
+
+	skipped := []string{}
+	for key := range r.Registry.Configs {
+		skipped = append(skipped, r.mergeTLS(key, key, TLSConfig{InsecureSkipVerify: true})...)
+	}
+	if _, ok := r.Registry.Configs["*"]; !ok {
+		r.mergeTLS("*", "*", TLSConfig{InsecureSkipVerify: true})
+	}
+	sort.Strings(skipped)
+	return skipped
+}
+
+// SetTLS merges the TLS settings into the configuration for the registry, along with any set by earlier calls. TLS
+// settings that were already loaded for the registry take precedence; the key of the configuration that was left
+// unchanged for that reason is returned. It must be called before any images are pulled.
+func (r *Client) SetTLS(registry string, tls TLSConfig) []string {
+	// the configuration that applies to the registry is copied, so that auth configured for "*" still applies
+	key, _ := r.getConfig(registry)
+	return r.mergeTLS(registry, key, tls)
+}
+
+// mergeTLS merges the TLS settings into the configuration with the given key, as a copy of the configuration with
+// the from key, unless TLS settings were loaded for it, in which case from is returned.
+func (r *Client) mergeTLS(registry, from string, tls TLSConfig) []string {
+	if r.Registry.Configs == nil {
+		r.Registry.Configs = map[string]RegistryConfig{}
+	}
+	if r.flagTLS == nil {
+		r.flagTLS = map[string]bool{}
+	}
+
+	config := r.Registry.Configs[from]
+	merged := TLSConfig{}
+	if config.TLS != nil {
+		if !r.flagTLS[from] {
+			return []string{from}
+		}
+		merged = *config.TLS
+	}
+	merged.InsecureSkipVerify = merged.InsecureSkipVerify || tls.InsecureSkipVerify
+	if tls.CAFile != "" {
+		merged.CAFile = tls.CAFile
+	}
+	if tls.CertFile != "" {
+		merged.CertFile = tls.CertFile
+	}
+	if tls.KeyFile != "" {
+		merged.KeyFile = tls.KeyFile
+	}
+	config.TLS = &merged
+	r.Registry.Configs[registry] = config
+	r.flagTLS[registry] = true
+	return nil
+}
+
+// SetPlainHTTP uses plain HTTP instead of HTTPS for the default endpoint of the registry. TLS settings that were
+// already loaded for the registry take precedence; the key of the configuration that was left unchanged for that
+// reason is returned. It must be called before any images are pulled.
+func (r *Client) SetPlainHTTP(registry string) []string {
+	if key, config := r.getConfig(registry); config.TLS != nil && !r.flagTLS[key] {
+		return []string{key}
+	}
+	if r.plainHTTP == nil {
+		r.plainHTTP = map[string]bool{}
+	}
+	r.plainHTTP[registry] = true
+	return nil
+}
+
+// SetAuth uses the credentials for the registry, by merging them into the loaded configuration. They take
+// precedence over credentials that were already loaded for the registry; the key of the configuration whose
+// credentials were overridden is returned, or an empty string if there were none. It must be called before any
+// images are pulled.
+func (r *Client) SetAuth(registry string, auth AuthConfig) string {
+	if r.Registry.Configs == nil {
+		r.Registry.Configs = map[string]RegistryConfig{}
+	}
+
+	// the configuration that applies to the registry is copied, so that TLS configured for "*" still applies
+	key, config := r.getConfig(registry)
+	if config.Auth == nil {
+		key = ""
+	}
+	config.Auth = &auth
+	r.Registry.Configs[registry] = config
+	return key
+}
+
+// defaultEndpoint returns the default endpoint for the reference's registry, ignoring any mirrors.
+func (r *Client) defaultEndpoint(ref name.Reference) (endpoint, error) {
+	registry := ref.Context().RegistryStr()
+	address := registry
+	if r.plainHTTP[registry] {
+		address = "http://" + registry
+	}
+	defaultURL, err := normalizeEndpointAddress(address)
+	if err != nil {
+		return endpoint{}, errors.Wrapf(err, "failed to construct default endpoint for registry %s", registry)
+	}
+	return r.makeEndpoint(defaultURL, ref), nil
+}
+
+// IsNotFound returns true if the error was returned because none of the endpoints tried had the requested
+// reference, as opposed to an endpoint being unreachable or refusing access. Errors returned by the client that
+// IsNotFound match ErrNotFound.
+func IsNotFound(err error) bool {
+	return allNotFound(endpointErrors(err))
+}
+
+// IsRetryable returns true if the error may not recur if the operation is retried: at least one endpoint was
+// unreachable, dropped the connection, or returned a temporary error such as a 503 or 429. Not-found and
+// authentication errors are not retryable, nor are operations that were cancelled or timed out.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	for _, err := range endpointErrors(err) {
+		var terr *transport.Error
+		if errors.As(err, &terr) {
+			if terr.Temporary() || terr.StatusCode == http.StatusTooManyRequests {
+				return true
+			}
+			continue
+		}
+		var nerr net.Error
+		if errors.As(err, &nerr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+			return true
+		}
+	}
+	return false
+}
+
+// tryEndpoints calls get with the reference and options for each endpoint in turn, until one succeeds,
+// and returns the URL of the endpoint that succeeded. If all of the endpoints fail with an error that is retryable,
+// they are all tried again, as many times as the retry policy allows. The options are applied after the transport and
+// credentials of each endpoint, so that they take precedence.
+func (r *Client) tryEndpoints(ref name.Reference, options []remote.Option, get func(name.Reference, ...remote.Option) error) (string, error) {
+	for attempt := 1; ; attempt++ {
+		endpoint, err := r.tryEachEndpoint(ref, options, get)
+		if err == nil || attempt > r.retryPolicy.Retries || !IsRetryable(err) {
+			return endpoint, err
+		}
+		r.log().WithFields(logging.Fields{"image": ref.Name(), "attempt": attempt, "error": err}).Warnf("Attempt %d of %d failed, retrying in %s", attempt, r.retryPolicy.Retries+1, r.retryPolicy.Delay)
+		time.Sleep(r.retryPolicy.Delay)
+	}
+}
+
+// tryEachEndpoint makes a single attempt of tryEndpoints.
+func (r *Client) tryEachEndpoint(ref name.Reference, options []remote.Option, get func(name.Reference, ...remote.Option) error) (string, error) {
+	endpoints, err := r.getEndpoints(ref)
+	if err != nil {
+		return "", err
+	}
 
 	errs := []error{}
 	for _, endpoint := range endpoints {
@@ -68,21 +441,53 @@ func (r *registry) Image(ref name.Reference, options ...remote.Option) (v1.Image
 		if !endpoint.isDefault() {
 			epRef = r.rewrite(ref)
 		}
-		logrus.Debugf("Trying endpoint %s", endpoint.url)
-		endpointOptions := append(options, remote.WithTransport(endpoint), remote.WithAuthFromKeychain(endpoint))
-		remoteImage, err := remote.Image(epRef, endpointOptions...)
+		logger := r.log().WithFields(logging.Fields{"image": epRef.Name(), "endpoint": endpoint.url.String()})
+		logger.Debugf("Trying endpoint")
+		err := get(epRef, r.remoteOptions(endpointOptions(endpoint), options)...)
+		if isUnauthorized(err) {
+			err = r.retryCredentials(endpoint, epRef, options, get, err)
+		}
 		if err != nil {
-			logrus.Warnf("Failed to get image from endpoint: %v", err)
-			errs = append(errs, err)
+			logger.WithFields(logging.Fields{"error": err}).Warnf("Failed to get image from endpoint")
+			errs = append(errs, wrapUnauthorized(err))
 			continue
 		}
-		return remoteImage, nil
+		logger.Debugf("Got image from endpoint")
+		return endpoint.url.String(), nil
+	}
+	return "", &EndpointsError{Errs: errs}
+}
+
+// retryCredentials retries get against the endpoint with each of the other credentials that its keychain holds for
+// the repository, after the endpoint rejected the first. The last error is returned if none of them are accepted.
+// Credentials configured for the endpoint in the private registry configuration are not retried.
+func (r *Client) retryCredentials(e endpoint, ref name.Reference, options []remote.Option, get func(name.Reference, ...remote.Option) error, err error) error {
+	keychain, ok := e.keychain.(RotatingKeychain)
+	if !ok || (e.auth != nil && e.auth != authn.Anonymous) {
+		return err
 	}
-	return nil, errors.Wrap(multierr.Combine(errs...), "all endpoints failed")
+	candidates, rerr := keychain.ResolveAll(ref.Context())
+	if rerr != nil {
+		return err
+	}
+	for i := 1; i < len(candidates) && isUnauthorized(err); i++ {
+		r.log().WithFields(logging.Fields{"image": ref.Name(), "endpoint": e.url.String()}).Debugf("Credentials rejected; trying credentials %d of %d", i+1, len(candidates))
+		candidate := e
+		candidate.auth = candidates[i]
+		candidate.credentials = nil
+		err = get(ref, r.remoteOptions(endpointOptions(candidate), options)...)
+	}
+	return err
+}
+
+// endpointOptions returns the options that requests to the endpoint are made with: its transport, and the credentials
+// that it resolves.
+func endpointOptions(e endpoint) []remote.Option {
+	return []remote.Option{remote.WithTransport(e), remote.WithAuthFromKeychain(e)}
 }
 
 // rewrite applies repository rewrites to the given image reference.
-func (r *registry) rewrite(ref name.Reference) name.Reference {
+func (r *Client) rewrite(ref name.Reference) name.Reference {
 	registry := ref.Context().RegistryStr()
 	rewrites := r.getRewrites(registry)
 	repository := ref.Context().RepositoryStr()
@@ -90,13 +495,13 @@ func (r *registry) rewrite(ref name.Reference) name.Reference {
 	for pattern, replace := range rewrites {
 		exp, err := regexp.Compile(pattern)
 		if err != nil {
-			logrus.Warnf("Failed to compile rewrite `%s` for %s", pattern, registry)
+			r.log().Warnf("Failed to compile rewrite `%s` for %s", pattern, registry)
 			continue
 		}
 		if rr := exp.ReplaceAllString(repository, replace); rr != repository {
 			newRepo, err := name.NewRepository(registry + "/" + rr)
 			if err != nil {
-				logrus.Warnf("Invalid repository rewrite %s for %s", rr, registry)
+				r.log().Warnf("Invalid repository rewrite %s for %s", rr, registry)
 				continue
 			}
 			if t, ok := ref.(name.Tag); ok {
@@ -115,15 +520,28 @@ func (r *registry) rewrite(ref name.Reference) name.Reference {
 // getTransport returns a transport for a given endpoint URL. For HTTP endpoints,
 // the default transport is used. For HTTPS endpoints, a unique transport is created
 // with the endpoint's TLSConfig (if any), and cached for all connections to this host.
-func (r *registry) getTransport(endpointURL *url.URL) http.RoundTripper {
+// Both are copied from the transport defaults, if the client has them.
+// It is safe to call from multiple goroutines, so that images can be pulled in parallel.
+func (r *Client) getTransport(endpointURL *url.URL) http.RoundTripper {
 	if endpointURL.Scheme == "https" {
+		r.transportsLock.Lock()
+		defer r.transportsLock.Unlock()
+
 		// Create and cache transport if not found.
 		if _, ok := r.transports[endpointURL.Host]; !ok {
 			tlsConfig, err := r.getTLSConfig(endpointURL)
 			if err != nil {
-				logrus.Warnf("Failed to get TLS config for endpoint %v: %v", endpointURL, err)
+				r.log().Warnf("Failed to get TLS config for endpoint %v: %v", endpointURL, err)
 			}
 
+			if r.transportDefaults != nil {
+				t := r.transportDefaults.Clone()
+				if tlsConfig != nil {
+					t.TLSClientConfig = tlsConfig
+				}
+				r.transports[endpointURL.Host] = t
+				return t
+			}
 			r.transports[endpointURL.Host] = &http.Transport{
 				Proxy: http.ProxyFromEnvironment,
 				DialContext: (&net.Dialer{
@@ -140,6 +558,9 @@ func (r *registry) getTransport(endpointURL *url.URL) http.RoundTripper {
 		}
 		return r.transports[endpointURL.Host]
 	}
+	if r.transportDefaults != nil {
+		return r.transportDefaults
+	}
 	return remote.DefaultTransport
 }
 
@@ -150,51 +571,60 @@ func (r *registry) getTransport(endpointURL *url.URL) http.RoundTripper {
 // * `gcr.io` is configured: endpoints for `gcr.io` + default endpoint `https://gcr.io/v2`.
 // * `*` is configured, and `gcr.io` is not: endpoints for `*` + default endpoint `https://gcr.io/v2`.
 // * None of above is configured: default endpoint `https://gcr.io/v2`.
-func (r *registry) getEndpoints(ref name.Reference) ([]endpoint, error) {
+func (r *Client) getEndpoints(ref name.Reference) ([]endpoint, error) {
 	endpoints := []endpoint{}
 	registry := ref.Context().RegistryStr()
-	keys := []string{registry}
-	if registry == name.DefaultRegistry {
-		keys = append(keys, "docker.io")
-	} else if _, _, err := net.SplitHostPort(registry); err != nil {
-		keys = append(keys, registry+":443", registry+":80")
-	}
-	keys = append(keys, "*")
-
-	for _, key := range keys {
-		if mirror, ok := r.Registry.Mirrors[key]; ok {
-			for _, endpointStr := range mirror.Endpoints {
-				if endpointURL, err := normalizeEndpointAddress(endpointStr); err != nil {
-					logrus.Warnf("Ignoring invalid endpoint %s for registry %s: %v", endpointStr, registry, err)
-				} else {
-					endpoints = append(endpoints, r.makeEndpoint(endpointURL, ref))
-				}
+	if _, mirror, ok := r.getMirror(registry); ok {
+		for _, endpointStr := range mirror.Endpoints {
+			if endpointURL, err := normalizeEndpointAddress(endpointStr); err != nil {
+				r.log().Warnf("Ignoring invalid endpoint %s for registry %s: %v", endpointStr, registry, err)
+			} else {
+				endpoints = append(endpoints, r.makeEndpoint(endpointURL, ref))
 			}
-			// found a mirror for this registry, don't check any further entries
-			// even if we didn't add any valid endpoints.
-			break
 		}
 	}
 
 	// always add the default endpoint
-	defaultURL, err := normalizeEndpointAddress(registry)
+	defaultEndpoint, err := r.defaultEndpoint(ref)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to construct default endpoint for registry %s", registry)
+		return nil, err
+	}
+	return append(endpoints, defaultEndpoint), nil
+}
+
+// getMirror returns the mirror that applies to a registry, and its key. Only the first matching mirror applies, even
+// if it has no valid endpoints.
+func (r *Client) getMirror(registry string) (string, Mirror, bool) {
+	keys := hostKeys(registry)
+	if registry != name.DefaultRegistry {
+		if _, _, err := net.SplitHostPort(registry); err != nil {
+			keys = append(keys, registry+":443", registry+":80")
+		}
 	}
-	endpoints = append(endpoints, r.makeEndpoint(defaultURL, ref))
-	return endpoints, nil
+	keys = append(keys, "*")
+
+	for _, key := range keys {
+		if mirror, ok := r.Registry.Mirrors[key]; ok {
+			return key, mirror, true
+		}
+	}
+	return "", Mirror{}, false
 }
 
 // makeEndpoint is a utility function to create an endpoint struct for a given endpoint URL
 // and registry name.
-func (r *registry) makeEndpoint(endpointURL *url.URL, ref name.Reference) endpoint {
-	return endpoint{
+func (r *Client) makeEndpoint(endpointURL *url.URL, ref name.Reference) endpoint {
+	e := endpoint{
 		auth:     r.getAuthenticator(endpointURL),
 		keychain: r.DefaultKeychain,
 		ref:      ref,
 		registry: r,
 		url:      endpointURL,
 	}
+	if e.keychain != nil {
+		e.credentials = &refreshingAuth{keychain: e.keychain, logger: r.log()}
+	}
+	return e
 }
 
 // normalizeEndpointAddress normalizes the endpoint address.
@@ -234,13 +664,8 @@ func normalizeEndpointAddress(endpoint string) (*url.URL, error) {
 
 // getAuthenticatorForHost returns an Authenticator for an endpoint URL. If no
 // configuration is present, Anonymous authentication is used.
-func (r *registry) getAuthenticator(endpointURL *url.URL) authn.Authenticator {
-	registry := endpointURL.Host
-	keys := []string{registry}
-	if registry == name.DefaultRegistry {
-		keys = append(keys, "docker.io")
-	}
-	keys = append(keys, "*")
+func (r *Client) getAuthenticator(endpointURL *url.URL) authn.Authenticator {
+	keys := append(hostKeys(endpointURL.Host), "*")
 
 	for _, key := range keys {
 		if config, ok := r.Registry.Configs[key]; ok {
@@ -250,6 +675,7 @@ func (r *registry) getAuthenticator(endpointURL *url.URL) authn.Authenticator {
 					Password:      config.Auth.Password,
 					Auth:          config.Auth.Auth,
 					IdentityToken: config.Auth.IdentityToken,
+					RegistryToken: config.Auth.RegistryToken,
 				})
 			}
 			// found a config for this registry, don't check any further entries
@@ -262,14 +688,9 @@ func (r *registry) getAuthenticator(endpointURL *url.URL) authn.Authenticator {
 
 // getTLSConfig returns TLS configuration for an endpoint URL. This is cribbed from
 // https://github.com/containerd/cri/blob/release/1.4/pkg/server/image_pull.go#L274
-func (r *registry) getTLSConfig(endpointURL *url.URL) (*tls.Config, error) {
+func (r *Client) getTLSConfig(endpointURL *url.URL) (*tls.Config, error) {
 	tlsConfig := &tls.Config{}
-	registry := endpointURL.Host
-	keys := []string{registry}
-	if registry == name.DefaultRegistry {
-		keys = append(keys, "docker.io")
-	}
-	keys = append(keys, "*")
+	keys := append(hostKeys(endpointURL.Host), "*")
 
 	for _, key := range keys {
 		if config, ok := r.Registry.Configs[key]; ok {
@@ -315,13 +736,22 @@ func (r *registry) getTLSConfig(endpointURL *url.URL) (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
-// getRewritesForHost gets the map of rewrite patterns for a given registry.
-func (r *registry) getRewrites(registry string) map[string]string {
-	keys := []string{registry}
-	if registry == name.DefaultRegistry {
-		keys = append(keys, "docker.io")
+// getConfig returns the configuration that applies to a registry, and its key, or an empty configuration if there
+// is none.
+func (r *Client) getConfig(registry string) (string, RegistryConfig) {
+	keys := append(hostKeys(registry), "*")
+
+	for _, key := range keys {
+		if config, ok := r.Registry.Configs[key]; ok {
+			return key, config
+		}
 	}
-	keys = append(keys, "*")
+	return "", RegistryConfig{}
+}
+
+// getRewritesForHost gets the map of rewrite patterns for a given registry.
+func (r *Client) getRewrites(registry string) map[string]string {
+	keys := append(hostKeys(registry), "*")
 
 	for _, key := range keys {
 		if mirror, ok := r.Registry.Mirrors[key]; ok {
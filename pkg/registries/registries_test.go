@@ -1,13 +1,22 @@
 package registries
 
 import (
+	"context"
 	"crypto/tls"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -133,7 +142,7 @@ func TestRewrite(t *testing.T) {
 
 	for testName, test := range rewriteTests {
 		t.Run(testName, func(t *testing.T) {
-			registry := registry{
+			registry := Client{
 				Registry: &Registry{
 					Mirrors: map[string]Mirror{
 						test.registry: {
@@ -163,11 +172,16 @@ func TestEndpoints(t *testing.T) {
 	type msm map[string]Mirror
 
 	endpointTests := map[string]struct {
-		imageName  string
-		configs    msr
-		mirrors    msm
-		endpoints  []endpoint
-		tlsconfigs []*tls.Config
+		imageName          string
+		configs            msr
+		mirrors            msm
+		insecureSkipVerify string
+		plainHTTP          string
+		auth               map[string]AuthConfig
+		precedence         []string
+		overridden         string
+		endpoints          []endpoint
+		tlsconfigs         []*tls.Config
 	}{
 		"no config, default endpoint": {
 			imageName: "busybox",
@@ -374,11 +388,240 @@ func TestEndpoints(t *testing.T) {
 				},
 			},
 		},
+		"insecure skip verify flag for the registry": {
+			imageName:          "registry.example.com/busybox",
+			insecureSkipVerify: "registry.example.com",
+			endpoints: []endpoint{
+				{url: mustParseURL("https://registry.example.com/v2")},
+			},
+			tlsconfigs: []*tls.Config{
+				{InsecureSkipVerify: true},
+			},
+		},
+		"insecure skip verify flag for another registry": {
+			imageName:          "registry.example.com/busybox",
+			insecureSkipVerify: "other.example.com",
+			endpoints: []endpoint{
+				{url: mustParseURL("https://registry.example.com/v2")},
+			},
+			tlsconfigs: []*tls.Config{
+				{InsecureSkipVerify: false},
+			},
+		},
+		"insecure skip verify flag does not override TLS config for the registry": {
+			imageName:          "registry.example.com/busybox",
+			configs:            msr{"registry.example.com": RegistryConfig{TLS: &TLSConfig{}}},
+			insecureSkipVerify: "registry.example.com",
+			precedence:         []string{"registry.example.com"},
+			endpoints: []endpoint{
+				{url: mustParseURL("https://registry.example.com/v2")},
+			},
+			tlsconfigs: []*tls.Config{
+				{InsecureSkipVerify: false},
+			},
+		},
+		"insecure skip verify flag does not override TLS config in wildcard": {
+			imageName:          "registry.example.com/busybox",
+			configs:            msr{"*": RegistryConfig{TLS: &TLSConfig{}}},
+			insecureSkipVerify: "registry.example.com",
+			precedence:         []string{"*"},
+			endpoints: []endpoint{
+				{url: mustParseURL("https://registry.example.com/v2")},
+			},
+			tlsconfigs: []*tls.Config{
+				{InsecureSkipVerify: false},
+			},
+		},
+		"insecure skip verify flag keeps creds from wildcard config": {
+			imageName:          "registry.example.com/busybox",
+			configs:            msr{"*": RegistryConfig{Auth: &AuthConfig{Username: "user", Password: "pass"}}},
+			insecureSkipVerify: "registry.example.com",
+			endpoints: []endpoint{
+				{
+					url:  mustParseURL("https://registry.example.com/v2"),
+					auth: &authn.Basic{Username: "user", Password: "pass"},
+				},
+			},
+			tlsconfigs: []*tls.Config{
+				{InsecureSkipVerify: true},
+			},
+		},
+		"insecure skip verify flag for all registries": {
+			imageName: "registry.example.com/busybox",
+			mirrors:   msm{"registry.example.com": Mirror{Endpoints: []string{"https://mirror.example.com/v2"}}},
+			configs: msr{
+				"registry.example.com": RegistryConfig{Auth: &AuthConfig{Username: "user", Password: "pass"}},
+				"other.example.com":    RegistryConfig{TLS: &TLSConfig{}},
+			},
+			insecureSkipVerify: "*",
+			precedence:         []string{"other.example.com"},
+			endpoints: []endpoint{
+				{url: mustParseURL("https://mirror.example.com/v2")},
+				{
+					url:  mustParseURL("https://registry.example.com/v2"),
+					auth: &authn.Basic{Username: "user", Password: "pass"},
+				},
+			},
+			tlsconfigs: []*tls.Config{
+				{InsecureSkipVerify: true},
+				{InsecureSkipVerify: true},
+			},
+		},
+		"plain http flag for the registry": {
+			imageName: "registry.example.com/busybox",
+			plainHTTP: "registry.example.com",
+			endpoints: []endpoint{
+				{url: mustParseURL("http://registry.example.com/v2")},
+			},
+		},
+		"plain http flag for the registry with a mirror": {
+			imageName: "registry.example.com/busybox",
+			mirrors:   msm{"registry.example.com": Mirror{Endpoints: []string{"https://mirror.example.com/v2"}}},
+			plainHTTP: "registry.example.com",
+			endpoints: []endpoint{
+				{url: mustParseURL("https://mirror.example.com/v2")},
+				{url: mustParseURL("http://registry.example.com/v2")},
+			},
+		},
+		"plain http flag for another registry": {
+			imageName: "registry.example.com/busybox",
+			plainHTTP: "other.example.com",
+			endpoints: []endpoint{
+				{url: mustParseURL("https://registry.example.com/v2")},
+			},
+		},
+		"plain http flag does not override TLS config for the registry": {
+			imageName:  "registry.example.com/busybox",
+			configs:    msr{"registry.example.com": RegistryConfig{TLS: &TLSConfig{InsecureSkipVerify: true}}},
+			plainHTTP:  "registry.example.com",
+			precedence: []string{"registry.example.com"},
+			endpoints: []endpoint{
+				{url: mustParseURL("https://registry.example.com/v2")},
+			},
+			tlsconfigs: []*tls.Config{
+				{InsecureSkipVerify: true},
+			},
+		},
+		"creds flags for the registry": {
+			imageName: "registry.example.com/busybox",
+			auth:      map[string]AuthConfig{"registry.example.com": {Username: "user", Password: "pass"}},
+			endpoints: []endpoint{
+				{
+					url:  mustParseURL("https://registry.example.com/v2"),
+					auth: &authn.Basic{Username: "user", Password: "pass"},
+				},
+			},
+		},
+		"creds flags for another registry": {
+			imageName: "registry.example.com/busybox",
+			auth:      map[string]AuthConfig{"other.example.com": {Username: "user", Password: "pass"}},
+			endpoints: []endpoint{
+				{url: mustParseURL("https://registry.example.com/v2")},
+			},
+		},
+		"creds flags for docker hub": {
+			imageName: "busybox",
+			auth:      map[string]AuthConfig{"index.docker.io": {Username: "user", Password: "pass"}},
+			endpoints: []endpoint{
+				{
+					url:  mustParseURL("https://index.docker.io/v2"),
+					auth: &authn.Basic{Username: "user", Password: "pass"},
+				},
+			},
+		},
+		"creds flags override creds config for the registry": {
+			imageName:  "registry.example.com/busybox",
+			configs:    msr{"registry.example.com": RegistryConfig{Auth: &AuthConfig{Username: "config", Password: "secret"}}},
+			auth:       map[string]AuthConfig{"registry.example.com": {Username: "user", Password: "pass"}},
+			overridden: "registry.example.com",
+			endpoints: []endpoint{
+				{
+					url:  mustParseURL("https://registry.example.com/v2"),
+					auth: &authn.Basic{Username: "user", Password: "pass"},
+				},
+			},
+		},
+		"creds flags override creds config in wildcard": {
+			imageName:  "registry.example.com/busybox",
+			configs:    msr{"*": RegistryConfig{Auth: &AuthConfig{Username: "config", Password: "secret"}}},
+			auth:       map[string]AuthConfig{"registry.example.com": {Username: "user", Password: "pass"}},
+			overridden: "*",
+			endpoints: []endpoint{
+				{
+					url:  mustParseURL("https://registry.example.com/v2"),
+					auth: &authn.Basic{Username: "user", Password: "pass"},
+				},
+			},
+		},
+		"creds flags override creds config for docker.io": {
+			imageName:  "busybox",
+			configs:    msr{"docker.io": RegistryConfig{Auth: &AuthConfig{Username: "config", Password: "secret"}}},
+			auth:       map[string]AuthConfig{"index.docker.io": {Username: "user", Password: "pass"}},
+			overridden: "docker.io",
+			endpoints: []endpoint{
+				{
+					url:  mustParseURL("https://index.docker.io/v2"),
+					auth: &authn.Basic{Username: "user", Password: "pass"},
+				},
+			},
+		},
+		"registry token flag for the registry": {
+			imageName: "registry.example.com/busybox",
+			auth:      map[string]AuthConfig{"registry.example.com": {RegistryToken: "token"}},
+			endpoints: []endpoint{
+				{
+					url:  mustParseURL("https://registry.example.com/v2"),
+					auth: &authn.Bearer{Token: "token"},
+				},
+			},
+		},
+		"creds flags keep TLS config for the registry": {
+			imageName: "registry.example.com/busybox",
+			configs:   msr{"registry.example.com": RegistryConfig{TLS: &TLSConfig{InsecureSkipVerify: true}}},
+			auth:      map[string]AuthConfig{"registry.example.com": {Username: "user", Password: "pass"}},
+			endpoints: []endpoint{
+				{
+					url:  mustParseURL("https://registry.example.com/v2"),
+					auth: &authn.Basic{Username: "user", Password: "pass"},
+				},
+			},
+			tlsconfigs: []*tls.Config{
+				{InsecureSkipVerify: true},
+			},
+		},
+		"creds flags keep TLS config from wildcard": {
+			imageName: "registry.example.com/busybox",
+			configs:   msr{"*": RegistryConfig{TLS: &TLSConfig{InsecureSkipVerify: true}}},
+			auth:      map[string]AuthConfig{"registry.example.com": {Username: "user", Password: "pass"}},
+			endpoints: []endpoint{
+				{
+					url:  mustParseURL("https://registry.example.com/v2"),
+					auth: &authn.Basic{Username: "user", Password: "pass"},
+				},
+			},
+			tlsconfigs: []*tls.Config{
+				{InsecureSkipVerify: true},
+			},
+		},
+		"creds flags with insecure skip verify flag": {
+			imageName:          "registry.example.com/busybox",
+			insecureSkipVerify: "registry.example.com",
+			auth:               map[string]AuthConfig{"registry.example.com": {Username: "user", Password: "pass"}},
+			endpoints: []endpoint{
+				{
+					url:  mustParseURL("https://registry.example.com/v2"),
+					auth: &authn.Basic{Username: "user", Password: "pass"},
+				},
+			},
+			tlsconfigs: []*tls.Config{
+				{InsecureSkipVerify: true},
+			},
+		},
 	}
 
 	for testName, test := range endpointTests {
 		t.Run(testName, func(t *testing.T) {
-			registry := registry{
+			registry := Client{
 				Registry: &Registry{
 					Mirrors: test.mirrors,
 					Configs: test.configs,
@@ -389,6 +632,23 @@ func TestEndpoints(t *testing.T) {
 			ref, err := name.ParseReference(test.imageName)
 			assert.NoError(t, err, "Failed to parse test reference for %v", test.imageName)
 
+			// flags are merged into the loaded config, which takes precedence
+			var precedence []string
+			if test.insecureSkipVerify != "" {
+				precedence = append(precedence, registry.SetInsecureSkipVerify(test.insecureSkipVerify)...)
+			}
+			if test.plainHTTP != "" {
+				precedence = append(precedence, registry.SetPlainHTTP(test.plainHTTP)...)
+			}
+			var overridden string
+			for host, auth := range test.auth {
+				if key := registry.SetAuth(host, auth); key != "" {
+					overridden = key
+				}
+			}
+			assert.Equal(t, test.precedence, precedence, "Unexpected config precedence for %s", ref)
+			assert.Equal(t, test.overridden, overridden, "Unexpected overridden creds config for %s", ref)
+
 			endpoints, err := registry.getEndpoints(ref)
 			assert.NoError(t, err, "Failed to get endpoints for %s", ref)
 
@@ -439,3 +699,203 @@ func mustParseURL(s string) *url.URL {
 	}
 	return u
 }
+
+func TestIsRetryable(t *testing.T) {
+	notFound := &transport.Error{StatusCode: http.StatusNotFound}
+	unauthorized := &transport.Error{StatusCode: http.StatusUnauthorized}
+	unavailable := &transport.Error{StatusCode: http.StatusServiceUnavailable}
+	tooManyRequests := &transport.Error{StatusCode: http.StatusTooManyRequests}
+	unreachable := &url.Error{Op: "Get", URL: "https://registry.example.com/v2/", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}
+	// endpoints returns the error that the client returns when each endpoint fails with the errors
+	endpoints := func(errs ...error) error {
+		for i, err := range errs {
+			errs[i] = wrapUnauthorized(err)
+		}
+		return errors.Wrap(&EndpointsError{Errs: errs}, "failed to get image")
+	}
+
+	tests := map[string]struct {
+		err          error
+		retryable    bool
+		notFound     bool
+		unauthorized bool
+		allFailed    bool
+	}{
+		"nil":                        {err: nil},
+		"not found":                  {err: endpoints(notFound, notFound), notFound: true, allFailed: true},
+		"unauthorized":               {err: endpoints(unauthorized), unauthorized: true, allFailed: true},
+		"not found and forbidden":    {err: endpoints(notFound, &transport.Error{StatusCode: http.StatusForbidden}), allFailed: true},
+		"not found and unauthorized": {err: endpoints(notFound, unauthorized), unauthorized: true, allFailed: true},
+		"unavailable":                {err: endpoints(notFound, unavailable), retryable: true, allFailed: true},
+		"too many requests":          {err: endpoints(tooManyRequests), retryable: true, allFailed: true},
+		"unreachable":                {err: endpoints(unreachable, notFound), retryable: true, allFailed: true},
+		"single unauthorized":        {err: wrapUnauthorized(unauthorized), unauthorized: true},
+		"connection reset":           {err: errors.Wrap(syscall.ECONNRESET, "failed to read layer"), retryable: true},
+		"unexpected eof":             {err: errors.Wrap(io.ErrUnexpectedEOF, "failed to read layer"), retryable: true},
+		"cancelled":                  {err: &url.Error{Op: "Get", URL: "https://registry.example.com/v2/", Err: context.Canceled}},
+		"deadline":                   {err: endpoints(&url.Error{Op: "Get", URL: "https://registry.example.com/v2/", Err: context.DeadlineExceeded}), allFailed: true},
+		"local":                      {err: errors.New("unable to extract file")},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.retryable, IsRetryable(test.err), "IsRetryable")
+			assert.Equal(t, test.notFound, IsNotFound(test.err), "IsNotFound")
+			assert.Equal(t, test.notFound, errors.Is(test.err, ErrNotFound), "ErrNotFound")
+			assert.Equal(t, test.unauthorized, errors.Is(test.err, ErrUnauthorized), "ErrUnauthorized")
+			assert.Equal(t, test.allFailed, errors.Is(test.err, ErrAllEndpointsFailed), "ErrAllEndpointsFailed")
+			if test.unauthorized {
+				var terr *transport.Error
+				assert.True(t, errors.As(test.err, &terr), "expected the response error to be kept")
+			}
+		})
+	}
+}
+
+func TestGetPrivateRegistries(t *testing.T) {
+	expected := &Registry{
+		Mirrors: map[string]Mirror{"docker.io": {Endpoints: []string{"https://mirror.example.com"}}},
+		Configs: map[string]RegistryConfig{"mirror.example.com": {Auth: &AuthConfig{Username: "user", RegistryToken: "token"}}},
+	}
+
+	tests := map[string]struct {
+		config   string
+		expected *Registry
+		err      bool
+	}{
+		"empty":                        {expected: &Registry{}},
+		"yaml":                         {config: "mirrors:\n  docker.io:\n    endpoint:\n      - https://mirror.example.com\nconfigs:\n  mirror.example.com:\n    auth:\n      username: user\n      registry_token: token\n", expected: expected},
+		"json":                         {config: `{"mirrors": {"docker.io": {"endpoint": ["https://mirror.example.com"]}}, "configs": {"mirror.example.com": {"auth": {"username": "user", "registry_token": "token"}}}}`, expected: expected},
+		"json with leading whitespace": {config: "\n  {\"mirrors\": {\"docker.io\": {\"endpoint\": [\"https://mirror.example.com\"]}}, \"configs\": {\"mirror.example.com\": {\"auth\": {\"username\": \"user\", \"registry_token\": \"token\"}}}}", expected: expected},
+		"invalid json":                 {config: `{"mirrors": [}`, err: true},
+		"invalid yaml":                 {config: "mirrors: [", err: true},
+	}
+
+	// the same configuration is loaded from a file, a reader, and bytes
+	loaders := map[string]func(t *testing.T, config string) (*Client, error){
+		"file": func(t *testing.T, config string) (*Client, error) {
+			path := filepath.Join(t.TempDir(), "registries.yaml")
+			if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+				t.Fatalf("Failed to write config: %v", err)
+			}
+			return GetPrivateRegistries(path)
+		},
+		"reader": func(t *testing.T, config string) (*Client, error) {
+			return GetPrivateRegistriesFromReader(strings.NewReader(config))
+		},
+		"bytes": func(t *testing.T, config string) (*Client, error) {
+			return GetPrivateRegistriesFromBytes([]byte(config))
+		},
+	}
+
+	for name, test := range tests {
+		for loaderName, load := range loaders {
+			t.Run(name+" from "+loaderName, func(t *testing.T) {
+				registry, err := load(t, test.config)
+				if test.err {
+					assert.Error(t, err)
+					return
+				}
+				if assert.NoError(t, err) {
+					assert.Equal(t, test.expected, registry.Registry)
+					assert.Equal(t, authn.DefaultKeychain, registry.DefaultKeychain)
+				}
+			})
+		}
+	}
+
+	// a configuration file that does not exist has default settings
+	registry, err := GetPrivateRegistries(filepath.Join(t.TempDir(), "missing.yaml"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, &Registry{}, registry.Registry)
+	}
+}
+
+func TestEndpointInfo(t *testing.T) {
+	registry := Client{
+		Registry: &Registry{
+			Mirrors: map[string]Mirror{
+				"docker.io": {
+					Endpoints: []string{"https://mirror.example.com", "invalid{"},
+					Rewrites:  map[string]string{"^library/(.*)": "mirrored-library/$1"},
+				},
+				"registry.example.com:443": {
+					Endpoints: []string{"https://registry.example.com"},
+					Rewrites:  map[string]string{"(.*)": "rewritten/$1"},
+				},
+				"*": {
+					Endpoints: []string{"http://wildcard.example.com:5000/v2/proxy"},
+				},
+			},
+			Configs: map[string]RegistryConfig{
+				"mirror.example.com": {Auth: &AuthConfig{Username: "user", Password: "pass"}},
+				"docker.io":          {TLS: &TLSConfig{InsecureSkipVerify: true}},
+				"*":                  {Auth: &AuthConfig{RegistryToken: "token"}, TLS: &TLSConfig{InsecureSkipVerify: true}},
+			},
+		},
+		transports: map[string]*http.Transport{},
+	}
+
+	type info struct {
+		url, reference, mirror, auth, tls string
+		isDefault                         bool
+	}
+	tests := map[string]struct {
+		image    string
+		expected []info
+	}{
+		"docker.io mirror with rewrite": {
+			image: "busybox",
+			expected: []info{
+				{url: "https://mirror.example.com/v2", reference: "index.docker.io/mirrored-library/busybox:latest", mirror: "docker.io", auth: "mirror.example.com"},
+				{url: "https://index.docker.io/v2", reference: "index.docker.io/library/busybox:latest", tls: "docker.io", isDefault: true},
+			},
+		},
+		"rewrite does not match": {
+			image: "rancher/rancher:v2.5.9",
+			expected: []info{
+				{url: "https://mirror.example.com/v2", reference: "index.docker.io/rancher/rancher:v2.5.9", mirror: "docker.io", auth: "mirror.example.com"},
+				{url: "https://index.docker.io/v2", reference: "index.docker.io/rancher/rancher:v2.5.9", tls: "docker.io", isDefault: true},
+			},
+		},
+		"mirror for the registry's default port": {
+			image: "registry.example.com/team/app:v1",
+			expected: []info{
+				{url: "https://registry.example.com/v2", reference: "registry.example.com/team/app:v1", mirror: "registry.example.com:443", auth: "*", tls: "*", isDefault: true},
+				{url: "https://registry.example.com/v2", reference: "registry.example.com/team/app:v1", auth: "*", tls: "*", isDefault: true},
+			},
+		},
+		"wildcard mirror": {
+			image: "registry.local/test@sha256:82becede498899ec668628e7cb0ad87b6e1c371cb8a1e597d83a47fac21d6af3",
+			expected: []info{
+				{url: "http://wildcard.example.com:5000/v2/proxy", reference: "registry.local/test@sha256:82becede498899ec668628e7cb0ad87b6e1c371cb8a1e597d83a47fac21d6af3", mirror: "*", auth: "*", tls: "*"},
+				{url: "https://registry.local/v2", reference: "registry.local/test@sha256:82becede498899ec668628e7cb0ad87b6e1c371cb8a1e597d83a47fac21d6af3", auth: "*", tls: "*", isDefault: true},
+			},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			ref, err := name.ParseReference(test.image)
+			if !assert.NoError(t, err) {
+				return
+			}
+			endpoints, err := registry.Endpoints(ref)
+			if !assert.NoError(t, err) {
+				return
+			}
+			actual := []info{}
+			for _, endpoint := range endpoints {
+				actual = append(actual, info{
+					url:       endpoint.URL,
+					reference: endpoint.Reference.Name(),
+					mirror:    endpoint.Mirror,
+					auth:      endpoint.Auth,
+					tls:       endpoint.TLS,
+					isDefault: endpoint.Default,
+				})
+			}
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package registrytest
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// BusyboxRepository is the repository of the canned busybox image that WithBusybox serves.
+const BusyboxRepository = "library/busybox"
+
+// BusyboxTags are the tags of the canned busybox image, in order.
+var BusyboxTags = []string{"1.35", "1.36", "1.36.1", "1.37", "latest", "musl"}
+
+// BusyboxPlatform is the only platform in the image index of the canned busybox image.
+var BusyboxPlatform = v1.Platform{OS: "linux", Architecture: "amd64"}
+
+// WithBusybox serves a canned busybox image under BusyboxRepository: a single-platform image index tagged with each
+// of BusyboxTags, its image manifest, and its config. The layer is not served, so the manifests and config of the
+// image can be read, but its layers cannot.
+func WithBusybox() Option {
+	return func(s *Server) {
+		s.setup = append(s.setup, func() error {
+			if err := s.AddBlob(BusyboxRepository, []byte(busyboxConfig)); err != nil {
+				return err
+			}
+			if err := s.AddManifest(BusyboxRepository+"@"+busyboxManifestDigest, types.DockerManifestSchema2, []byte(busyboxManifest)); err != nil {
+				return err
+			}
+			for _, tag := range BusyboxTags {
+				if err := s.AddManifest(BusyboxRepository+":"+tag, types.DockerManifestList, []byte(busyboxManifestList)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+}
+
+const busyboxManifestDigest = "sha256:5cd3db04b8be5773388576a83177aff4f40a03457a63855f4b9cbe30542b9a43"
+
+// a canned single-arch manifest list for the busybox image
+const busyboxManifestList = `{
+  "manifests": [
+    {
+      "digest": "sha256:5cd3db04b8be5773388576a83177aff4f40a03457a63855f4b9cbe30542b9a43",
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "platform": {
+        "architecture": "amd64",
+        "os": "linux"
+      },
+      "size": 528
+    }
+  ],
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "schemaVersion": 2
+}`
+
+// a canned manifest for the busybox image
+const busyboxManifest = `{
+   "schemaVersion": 2,
+   "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+   "config": {
+      "mediaType": "application/vnd.docker.container.image.v1+json",
+      "size": 1457,
+      "digest": "sha256:8135583d97feb82398909c9c97607159e6db2c4ca2c885c0b8f590ee0f9fe90d"
+   },
+   "layers": [
+      {
+         "mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+         "size": 2591575,
+         "digest": "sha256:325d69979d33f72bfd1d30d420b8ec7f130919916fd02238ba23e4a22d753ed8"
+      }
+   ]
+}`
+
+// a canned config blob for the busybox image
+const busyboxConfig = `{"architecture":"amd64","config":{"Hostname":"","Domainname":"","User":"","AttachStdin":false,"AttachStdout":false,"AttachStderr":false,"Tty":false,"OpenStdin":false,"StdinOnce":false,"Env":["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"],"Cmd":["sh"],"Image":"sha256:505de91dcca928e5436702f887bbd8b81be91e719b552fb5c64e34234d22ac86","Volumes":null,"WorkingDir":"","Entrypoint":null,"OnBuild":null,"Labels":null},"container":"ffeefc40361ae173c8c4a1c2bad0f899f4de97601938eab16b5d019bdf2fa5f3","container_config":{"Hostname":"ffeefc40361a","Domainname":"","User":"","AttachStdin":false,"AttachStdout":false,"AttachStderr":false,"Tty":false,"OpenStdin":false,"StdinOnce":false,"Env":["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"],"Cmd":["/bin/sh","-c","#(nop) ","CMD [\"sh\"]"],"Image":"sha256:505de91dcca928e5436702f887bbd8b81be91e719b552fb5c64e34234d22ac86","Volumes":null,"WorkingDir":"","Entrypoint":null,"OnBuild":null,"Labels":{}},"created":"2023-05-19T20:19:22.751398522Z","docker_version":"20.10.23","history":[{"created":"2023-05-19T20:19:22.642507645Z","created_by":"/bin/sh -c #(nop) ADD file:cfd4bc7e9470d1298c9d4143538a77aa9aedd74f96aa5a3262cf8714c6fc3ec6 in / "},{"created":"2023-05-19T20:19:22.751398522Z","created_by":"/bin/sh -c #(nop)  CMD [\"sh\"]","empty_layer":true}],"os":"linux","rootfs":{"type":"layers","diff_ids":["sha256:9547b4c33213e630a0ca602a989ecc094e042146ae8afa502e1e65af6473db03"]}}`
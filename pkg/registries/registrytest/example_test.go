@@ -0,0 +1,46 @@
+package registrytest_test
+
+import (
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/rancher/wharfie/pkg/registries/registrytest"
+)
+
+// This example tests that a private registry configuration provides the credentials that a registry requires, and
+// that images on a mirror are found through it.
+func Example() {
+	server, err := registrytest.New(registrytest.WithBusybox(), registrytest.WithAuth(registrytest.AuthBasic, "user", "pass"))
+	if err != nil {
+		panic(err)
+	}
+	defer server.Close()
+
+	config := fmt.Sprintf(`
+mirrors:
+  registry.example.com:
+    endpoint:
+      - %s
+configs:
+  %s:
+    auth:
+      username: user
+      password: pass
+`, server.URL(), server.Host())
+	client, err := registries.GetPrivateRegistriesFromBytes([]byte(config))
+	if err != nil {
+		panic(err)
+	}
+
+	repo, _ := name.NewRepository("registry.example.com/" + registrytest.BusyboxRepository)
+	tags, endpoint, err := client.ListTags(repo)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(tags)
+	fmt.Println(endpoint == server.URL()+"/v2")
+	// Output:
+	// [1.35 1.36 1.36.1 1.37 latest musl]
+	// true
+}
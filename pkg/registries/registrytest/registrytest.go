@@ -0,0 +1,584 @@
+// Package registrytest provides a fake container registry for tests of programs that pull images with wharfie's
+// registries package, such as tests of their private registry configuration. A Server serves images from an in-memory
+// registry over HTTP or HTTPS, optionally requiring basic or bearer token authentication, and records the requests that
+// it receives so that tests can check which endpoints and credentials were used.
+package registrytest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	"github.com/rancher/dynamiclistener/cert"
+	"github.com/rancher/dynamiclistener/factory"
+)
+
+// AuthScheme is the authentication scheme that a Server requires.
+type AuthScheme string
+
+const (
+	// AuthNone serves all requests without credentials.
+	AuthNone AuthScheme = ""
+	// AuthBasic requires the username and password on each request to the registry.
+	AuthBasic AuthScheme = "Basic"
+	// AuthBearer requires a token on each request to the registry, which the token service issues for the username
+	// and password.
+	AuthBearer AuthScheme = "Bearer"
+)
+
+// service is the name of the registry in the challenges of a Server that requires bearer tokens.
+const service = "registry"
+
+// Request is a request that a Server received.
+type Request struct {
+	// Token is set if the request was made to the token service rather than to the registry.
+	Token  bool
+	Method string
+	// Host is the Host header of the request.
+	Host   string
+	Path   string
+	Query  url.Values
+	Header http.Header
+}
+
+// Server is a fake registry. It is created with New, and must be closed when it is no longer needed.
+type Server struct {
+	address   string
+	hostname  string
+	tls       bool
+	auth      AuthScheme
+	username  string
+	password  string
+	separate  bool
+	tokenTLS  bool
+	referrers bool
+	setup     []func() error
+	handler   http.Handler
+	registry  *httptest.Server
+	tokens    *httptest.Server
+	caCert    []byte
+	token     string
+	mu        sync.Mutex
+	requests  []Request
+	intercept func(w http.ResponseWriter, req *http.Request) bool
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithAddress sets the address that the server listens on, such as 127.0.0.1:443 to test the default port of a
+// scheme. By default, it listens on a random port of 127.0.0.1.
+func WithAddress(address string) Option {
+	return func(s *Server) {
+		s.address = address
+	}
+}
+
+// WithHostname sets the host name that the URLs of the server use, which must resolve to the address that it listens
+// on. It is added to the server's certificate. By default, the IP address that the server listens on is used.
+func WithHostname(hostname string) Option {
+	return func(s *Server) {
+		s.hostname = hostname
+	}
+}
+
+// WithTLS serves the registry over HTTPS, with a certificate signed by a CA that is generated for the server.
+func WithTLS() Option {
+	return func(s *Server) {
+		s.tls = true
+	}
+}
+
+// WithAuth requires the username and password, either on each request to the registry, or to get a token from the
+// token service, depending on the scheme.
+func WithAuth(scheme AuthScheme, username, password string) Option {
+	return func(s *Server) {
+		s.auth, s.username, s.password = scheme, username, password
+	}
+}
+
+// WithTokenServer serves the token service on a second server, listening on a random port, instead of on the
+// registry's own, over HTTPS if useTLS is set. It only applies to AuthBearer.
+func WithTokenServer(useTLS bool) Option {
+	return func(s *Server) {
+		s.separate, s.tokenTLS = true, useTLS
+	}
+}
+
+// WithImage serves the image under the reference, such as library/busybox:latest, which is relative to the server.
+func WithImage(ref string, img v1.Image) Option {
+	return func(s *Server) {
+		s.setup = append(s.setup, func() error { return s.AddImage(ref, img) })
+	}
+}
+
+// WithIndex serves the image index, and the images it references, under the reference, which is relative to the
+// server.
+func WithIndex(ref string, index v1.ImageIndex) Option {
+	return func(s *Server) {
+		s.setup = append(s.setup, func() error { return s.AddIndex(ref, index) })
+	}
+}
+
+// WithManifest serves the manifest, as it is, under the reference, which is relative to the server. The blobs and
+// manifests that an image index references must be added before it.
+func WithManifest(ref string, mediaType types.MediaType, manifest []byte) Option {
+	return func(s *Server) {
+		s.setup = append(s.setup, func() error { return s.AddManifest(ref, mediaType, manifest) })
+	}
+}
+
+// WithBlob serves the blob in the repository, which is relative to the server.
+func WithBlob(repo string, blob []byte) Option {
+	return func(s *Server) {
+		s.setup = append(s.setup, func() error { return s.AddBlob(repo, blob) })
+	}
+}
+
+// WithReferrers serves the OCI referrers API. Without it, requests to the API fail with 404 Not Found, as they do at
+// registries that do not support it, and clients fall back to the referrers tag scheme when pushing and listing
+// referrers.
+func WithReferrers() Option {
+	return func(s *Server) {
+		s.referrers = true
+	}
+}
+
+// New starts a server with the options. Images are added in the order of the options.
+func New(opts ...Option) (*Server, error) {
+	s := &Server{address: "127.0.0.1:0"}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.handler = registry.New(registry.Logger(log.New(io.Discard, "", 0)), registry.WithReferrersSupport(s.referrers))
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	s.token = hex.EncodeToString(token)
+	for _, setup := range s.setup {
+		if err := setup(); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.start(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// start starts the registry, and the token service if it is separate.
+func (s *Server) start() error {
+	l, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", s.address)
+	}
+	var tlsConfig *tls.Config
+	if s.tls || (s.separate && s.tokenTLS) {
+		if tlsConfig, err = s.certificates(l.Addr()); err != nil {
+			l.Close()
+			return err
+		}
+	}
+
+	s.registry = &httptest.Server{
+		Listener:    l,
+		Config:      &http.Server{Handler: s.serve(false)},
+		EnableHTTP2: true,
+		TLS:         tlsConfig,
+	}
+	if s.tls {
+		s.registry.StartTLS()
+	} else {
+		s.registry.Start()
+	}
+	if !s.separate {
+		return nil
+	}
+
+	s.tokens = httptest.NewUnstartedServer(s.serve(true))
+	s.tokens.EnableHTTP2 = true
+	s.tokens.TLS = tlsConfig
+	if s.tokenTLS {
+		s.tokens.StartTLS()
+	} else {
+		s.tokens.Start()
+	}
+	return nil
+}
+
+// certificates generates a CA, and a certificate that it signs for the host name and address of the server.
+func (s *Server) certificates(addr net.Addr) (*tls.Config, error) {
+	caCert, caKey, err := factory.GenCA()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate CA")
+	}
+	cfg := cert.Config{
+		CommonName:   "registrytest",
+		Organization: []string{"registrytest"},
+		Usages:       []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		AltNames: cert.AltNames{
+			DNSNames: []string{"localhost"},
+			IPs:      []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		},
+	}
+	if s.hostname != "" {
+		if ip := net.ParseIP(s.hostname); ip != nil {
+			cfg.AltNames.IPs = append(cfg.AltNames.IPs, ip)
+		} else {
+			cfg.CommonName = s.hostname
+			cfg.AltNames.DNSNames = append(cfg.AltNames.DNSNames, s.hostname)
+		}
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		cfg.AltNames.IPs = append(cfg.AltNames.IPs, tcp.IP)
+	}
+	serverCert, err := cert.NewSignedCert(cfg, caKey, caCert, caKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate certificate")
+	}
+	s.caCert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw, caCert.Raw}, Leaf: serverCert, PrivateKey: caKey}},
+	}, nil
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	if s.registry != nil {
+		s.registry.Close()
+	}
+	if s.tokens != nil {
+		s.tokens.Close()
+	}
+}
+
+// Addr returns the address that the registry listens on.
+func (s *Server) Addr() string {
+	return s.registry.Listener.Addr().String()
+}
+
+// Host returns the host of the registry, as it appears in image references: the host name, and the port unless it is
+// the default port for the scheme.
+func (s *Server) Host() string {
+	return host(s.hostname, s.Addr(), s.tls)
+}
+
+// URL returns the URL of the registry, such as https://127.0.0.1:34567.
+func (s *Server) URL() string {
+	return scheme(s.tls) + "://" + s.Host()
+}
+
+// TokenURL returns the URL of the token service, which is the realm of the challenges of a registry that requires
+// bearer tokens.
+func (s *Server) TokenURL() string {
+	if s.tokens == nil {
+		return s.URL() + "/token"
+	}
+	return scheme(s.tokenTLS) + "://" + host(s.hostname, s.tokens.Listener.Addr().String(), s.tokenTLS) + "/token"
+}
+
+// CACert returns the PEM-encoded certificate of the CA that signed the server's certificate, or nil if it does not
+// use TLS.
+func (s *Server) CACert() []byte {
+	return s.caCert
+}
+
+// CertPool returns a pool of the CA that signed the server's certificate, for clients that trust it.
+func (s *Server) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(s.caCert)
+	return pool
+}
+
+// Requests returns the requests that the server has received, in the order they were received.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+// ResetRequests forgets the requests that the server has received.
+func (s *Server) ResetRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+// Intercept sets a function that is called with each request to the registry after it has been recorded, and before
+// it is authenticated, which handles the request itself if it returns true. It can be used to inject failures, or to
+// check credentials of its own. It replaces any function that was set before; nil removes it.
+func (s *Server) Intercept(f func(w http.ResponseWriter, req *http.Request) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.intercept = f
+}
+
+// AddImage serves the image under the reference, which is relative to the server. Credentials are not required.
+func (s *Server) AddImage(ref string, img v1.Image) error {
+	r, err := reference(ref)
+	if err != nil {
+		return err
+	}
+	return remote.Write(r, img, remote.WithTransport(s.direct()))
+}
+
+// AddIndex serves the image index, and the images it references, under the reference, which is relative to the
+// server.
+func (s *Server) AddIndex(ref string, index v1.ImageIndex) error {
+	r, err := reference(ref)
+	if err != nil {
+		return err
+	}
+	return remote.WriteIndex(r, index, remote.WithTransport(s.direct()))
+}
+
+// AddManifest serves the manifest, as it is, under the reference, which is relative to the server.
+func (s *Server) AddManifest(ref string, mediaType types.MediaType, manifest []byte) error {
+	r, err := reference(ref)
+	if err != nil {
+		return err
+	}
+	return remote.Put(r, rawManifest{manifest: manifest, mediaType: mediaType}, remote.WithTransport(s.direct()))
+}
+
+// AddBlob serves the blob in the repository, which is relative to the server.
+func (s *Server) AddBlob(repo string, blob []byte) error {
+	r, err := name.NewRepository("registrytest.local/" + repo)
+	if err != nil {
+		return err
+	}
+	return remote.WriteLayer(r, static.NewLayer(blob, types.OCILayer), remote.WithTransport(s.direct()))
+}
+
+// reference parses the reference relative to the server. The host is not used, as requests are made directly to the
+// in-memory registry.
+func reference(ref string) (name.Reference, error) {
+	return name.ParseReference("registrytest.local/" + ref)
+}
+
+// rawManifest is a manifest that is put as it is.
+type rawManifest struct {
+	manifest  []byte
+	mediaType types.MediaType
+}
+
+func (m rawManifest) RawManifest() ([]byte, error)        { return m.manifest, nil }
+func (m rawManifest) MediaType() (types.MediaType, error) { return m.mediaType, nil }
+
+// direct returns a transport that passes requests directly to the in-memory registry, without recording them or
+// requiring credentials.
+func (s *Server) direct() http.RoundTripper {
+	return roundTripper(func(req *http.Request) (*http.Response, error) {
+		// handlers expect the body of a request to be set, as it is for requests received by a server
+		served := req.Clone(req.Context())
+		if served.Body == nil {
+			served.Body = http.NoBody
+		}
+		recorder := httptest.NewRecorder()
+		s.handler.ServeHTTP(recorder, served)
+		resp := recorder.Result()
+		resp.Request = req
+		return resp, nil
+	})
+}
+
+type roundTripper func(req *http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// serve returns the handler for the registry, or for the separate token service. The registry also serves the token
+// service, unless it is separate.
+func (s *Server) serve(token bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		isToken := token || (!s.separate && req.URL.Path == "/token")
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{
+			Token:  isToken,
+			Method: req.Method,
+			Host:   req.Host,
+			Path:   req.URL.Path,
+			Query:  req.URL.Query(),
+			Header: req.Header.Clone(),
+		})
+		intercept := s.intercept
+		s.mu.Unlock()
+
+		if isToken {
+			s.serveToken(w, req)
+			return
+		}
+		if intercept != nil && intercept(w, req) {
+			return
+		}
+		w.Header().Set("Docker-Distribution-Api-Version", "registry/2")
+		if !s.authorized(req) {
+			s.challenge(w, req)
+			return
+		}
+		if req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/tags/list") {
+			s.serveTags(w, req)
+			return
+		}
+		s.handler.ServeHTTP(w, req)
+	})
+}
+
+// authorized returns true if the request to the registry has the credentials that the server requires.
+func (s *Server) authorized(req *http.Request) bool {
+	switch s.auth {
+	case AuthBasic:
+		username, password, ok := req.BasicAuth()
+		return ok && username == s.username && password == s.password
+	case AuthBearer:
+		return req.Header.Get("Authorization") == "Bearer "+s.token
+	}
+	return true
+}
+
+// challenge responds to a request to the registry without the required credentials, with the scope of the request.
+func (s *Server) challenge(w http.ResponseWriter, req *http.Request) {
+	challenge := string(s.auth) + ` realm="registry"`
+	if s.auth == AuthBearer {
+		challenge = fmt.Sprintf(`Bearer realm="%s",service="%s"`, s.TokenURL(), service)
+		if scope := scope(req); scope != "" {
+			challenge += fmt.Sprintf(`,scope="%s"`, scope)
+		}
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write([]byte(`{"errors":[{"code":"UNAUTHORIZED","message":"authentication required","detail":null}]}`))
+}
+
+// scope returns the scope of the request to the registry: the repository and the actions of the method, or none for
+// requests that are not for a repository.
+func scope(req *http.Request) string {
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	for _, kind := range []string{"/manifests/", "/blobs/", "/tags/"} {
+		if i := strings.LastIndex(path, kind); i > 0 {
+			actions := "pull"
+			switch req.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch:
+				actions = "push,pull"
+			case http.MethodDelete:
+				actions = "delete"
+			}
+			return "repository:" + path[:i] + ":" + actions
+		}
+	}
+	return ""
+}
+
+// serveToken issues a token for requests to the token service with the username and password. Any scope is granted.
+func (s *Server) serveToken(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if service := req.URL.Query()["service"]; len(service) != 1 || service[0] != "registry" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if username, password, ok := req.BasicAuth(); !ok || username != s.username || password != s.password {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":        s.token,
+		"access_token": s.token,
+		"expires_in":   300,
+		"issued_at":    time.Now().Format(time.RFC3339),
+	})
+}
+
+// serveTags serves a paginated list of tags. The page size is set by the n query parameter, and each page after the
+// first starts after the tag in the last query parameter. If there are more tags, the Link header points to the next
+// page.
+func (s *Server) serveTags(w http.ResponseWriter, req *http.Request) {
+	all := req.Clone(req.Context())
+	all.URL.RawQuery = ""
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, all)
+	if recorder.Code != http.StatusOK {
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(recorder.Code)
+		io.Copy(w, recorder.Body)
+		return
+	}
+	list := struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{}
+	if err := json.NewDecoder(recorder.Body).Decode(&list); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tags := list.Tags
+	if last := req.URL.Query().Get("last"); last != "" {
+		for i, tag := range tags {
+			if tag == last {
+				tags = tags[i+1:]
+				break
+			}
+		}
+	}
+	if n, err := strconv.Atoi(req.URL.Query().Get("n")); err == nil && n > 0 && n < len(tags) {
+		tags = tags[:n]
+		next := url.Values{"n": []string{strconv.Itoa(n)}, "last": []string{tags[n-1]}}
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, req.URL.Path, next.Encode()))
+	}
+	list.Tags = tags
+	body := &bytes.Buffer{}
+	json.NewEncoder(body).Encode(list)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body.Bytes())
+}
+
+// host returns the host name, or else the IP address of the address, with the port unless it is the default port for
+// the scheme.
+func host(hostname, addr string, useTLS bool) string {
+	ip, port, _ := net.SplitHostPort(addr)
+	if hostname == "" {
+		hostname = ip
+	}
+	if (useTLS && port == "443") || (!useTLS && port == "80") {
+		return hostname
+	}
+	return net.JoinHostPort(hostname, port)
+}
+
+func scheme(useTLS bool) string {
+	if useTLS {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,224 @@
+package registrytest
+
+import (
+	"crypto/tls"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+)
+
+// newServer starts a server with the options, which is closed when the test ends.
+func newServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	s, err := New(opts...)
+	if err != nil {
+		t.Fatalf("Failed to start registry: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+// clientTransport returns a transport that trusts the CA of the server.
+func clientTransport(s *Server) http.RoundTripper {
+	tr := remote.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{RootCAs: s.CertPool()}
+	return tr
+}
+
+func TestAuth(t *testing.T) {
+	valid := &authn.Basic{Username: "user", Password: "pass"}
+	invalid := &authn.Basic{Username: "user", Password: "wrong"}
+
+	testCases := map[string]struct {
+		opts []Option
+		// status is the status of requests without valid credentials, or 0 if credentials are not required
+		status int
+		// tokens is set if tokens are requested from the token service
+		tokens bool
+	}{
+		"anonymous": {},
+		"anonymous over TLS": {
+			opts: []Option{WithTLS()},
+		},
+		"basic": {
+			opts:   []Option{WithAuth(AuthBasic, "user", "pass")},
+			status: http.StatusUnauthorized,
+		},
+		"basic over TLS": {
+			opts:   []Option{WithTLS(), WithAuth(AuthBasic, "user", "pass")},
+			status: http.StatusUnauthorized,
+		},
+		"bearer": {
+			opts:   []Option{WithAuth(AuthBearer, "user", "pass")},
+			status: http.StatusForbidden,
+			tokens: true,
+		},
+		"bearer from token server": {
+			opts:   []Option{WithAuth(AuthBearer, "user", "pass"), WithTokenServer(false)},
+			status: http.StatusForbidden,
+			tokens: true,
+		},
+		"bearer over TLS from token server over TLS": {
+			opts:   []Option{WithTLS(), WithAuth(AuthBearer, "user", "pass"), WithTokenServer(true)},
+			status: http.StatusForbidden,
+			tokens: true,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			s := newServer(t, append(tc.opts, WithBusybox())...)
+			ref, err := name.ParseReference(s.Host() + "/" + BusyboxRepository + ":latest")
+			if err != nil {
+				t.Fatalf("Failed to parse reference: %v", err)
+			}
+			tr := clientTransport(s)
+
+			desc, err := remote.Get(ref, remote.WithTransport(tr), remote.WithAuth(valid))
+			if err != nil {
+				t.Fatalf("Failed to get image with valid credentials: %v", err)
+			}
+			if desc.Digest.String() == "" || !desc.MediaType.IsIndex() {
+				t.Errorf("Expected busybox image index but got %+v", desc.Descriptor)
+			}
+			tokens := 0
+			for _, req := range s.Requests() {
+				if req.Token {
+					tokens++
+					if user, _, _ := (&http.Request{Header: req.Header}).BasicAuth(); user != "user" {
+						t.Errorf("Expected token request with credentials but got %v", req.Header)
+					}
+				}
+			}
+			if tc.tokens != (tokens > 0) {
+				t.Errorf("Expected tokens to be requested %t, but got %d token requests", tc.tokens, tokens)
+			}
+
+			_, err = remote.Get(ref, remote.WithTransport(tr), remote.WithAuth(invalid))
+			if tc.status == 0 {
+				if err != nil {
+					t.Errorf("Expected credentials to be ignored but got %v", err)
+				}
+				return
+			}
+			var terr *transport.Error
+			if !errors.As(err, &terr) || terr.StatusCode != tc.status {
+				t.Errorf("Expected status %d with invalid credentials but got %v", tc.status, err)
+			}
+		})
+	}
+}
+
+func TestImages(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	platform := v1.Platform{OS: "linux", Architecture: "arm64"}
+	index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &platform}})
+	s := newServer(t, WithImage("test/image:v1", img), WithIndex("test/index:v1", index), WithBusybox())
+
+	for ref, expected := range map[string]interface{ Digest() (v1.Hash, error) }{"test/image:v1": img, "test/index:v1": index} {
+		r, _ := name.ParseReference(s.Host() + "/" + ref)
+		desc, err := remote.Get(r)
+		if err != nil {
+			t.Fatalf("Failed to get %s: %v", ref, err)
+		}
+		if digest, _ := expected.Digest(); desc.Digest != digest {
+			t.Errorf("Expected %s to be %s but got %s", ref, digest, desc.Digest)
+		}
+	}
+
+	// the canned image can be resolved for its platform, and its config read
+	r, _ := name.ParseReference(s.Host() + "/" + BusyboxRepository + ":1.36")
+	busybox, err := remote.Image(r, remote.WithPlatform(BusyboxPlatform))
+	if err != nil {
+		t.Fatalf("Failed to get busybox: %v", err)
+	}
+	if config, err := busybox.ConfigFile(); err != nil || config.Architecture != BusyboxPlatform.Architecture {
+		t.Errorf("Expected busybox config for %s but got %+v, %v", BusyboxPlatform.Architecture, config, err)
+	}
+
+	// tags are paginated with the Link header
+	repo, _ := name.NewRepository(s.Host() + "/" + BusyboxRepository)
+	s.ResetRequests()
+	tags, err := remote.List(repo, remote.WithPageSize(4))
+	if err != nil {
+		t.Fatalf("Failed to list tags: %v", err)
+	}
+	if !reflect.DeepEqual(tags, BusyboxTags) {
+		t.Errorf("Expected tags %v but got %v", BusyboxTags, tags)
+	}
+	pages := 0
+	for _, req := range s.Requests() {
+		if strings.HasSuffix(req.Path, "/tags/list") {
+			pages++
+		}
+	}
+	if pages != 2 {
+		t.Errorf("Expected 2 pages of tags but got %d", pages)
+	}
+}
+
+func TestIntercept(t *testing.T) {
+	s := newServer(t, WithBusybox())
+	ref, _ := name.ParseReference(s.Host() + "/" + BusyboxRepository + ":latest")
+	s.Intercept(func(w http.ResponseWriter, req *http.Request) bool {
+		if strings.Contains(req.URL.Path, "/manifests/") {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		}
+		return false
+	})
+	var terr *transport.Error
+	if _, err := remote.Get(ref, remote.WithRetryStatusCodes()); !errors.As(err, &terr) || terr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected intercepted request to fail with %d but got %v", http.StatusServiceUnavailable, err)
+	}
+	if len(s.Requests()) == 0 {
+		t.Errorf("Expected intercepted requests to be recorded")
+	}
+
+	s.Intercept(nil)
+	if _, err := remote.Get(ref); err != nil {
+		t.Errorf("Expected request to succeed once the interceptor is removed but got %v", err)
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	digest, _ := img.Digest()
+
+	for testName, tc := range map[string]struct {
+		opts   []Option
+		status int
+	}{
+		"referrers API":    {opts: []Option{WithReferrers()}, status: http.StatusOK},
+		"no referrers API": {status: http.StatusNotFound},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			s := newServer(t, append(tc.opts, WithImage("test/image:v1", img))...)
+			resp, err := http.Get(s.URL() + "/v2/test/image/referrers/" + digest.String())
+			if err != nil {
+				t.Fatalf("Failed to list referrers: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Errorf("Expected status %d but got %d", tc.status, resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package registries
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RequestStats summarizes the timings of the requests made to a registry endpoint. Durations are totals across all
+// requests; DNS, connect, and TLS handshake timings are only recorded for requests that opened a new connection.
+type RequestStats struct {
+	Endpoint     string
+	Requests     int
+	Failures     int
+	Connections  int
+	DNS          time.Duration
+	Connect      time.Duration
+	TLSHandshake time.Duration
+	FirstByte    time.Duration
+	MaxFirstByte time.Duration
+}
+
+// requestTracer records the timings of requests to each endpoint.
+type requestTracer struct {
+	logger *log.Logger
+	mu     sync.Mutex
+	stats  map[string]*RequestStats
+}
+
+// requestTiming records the timings of a single request. Dials may be raced, so the hooks may be called from
+// other goroutines, and may still be called after the request has completed.
+type requestTiming struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	newConn      bool
+	dns          time.Duration
+	connect      time.Duration
+	tlsHandshake time.Duration
+	firstByte    time.Duration
+}
+
+// EnableRequestTracing records the DNS lookup, connect, TLS handshake, and time to first byte of each request made
+// to the registry endpoints. Each request is logged to the logger, if it is not nil, and the totals for each
+// endpoint are returned by RequestStats. It must be called before any images are pulled.
+func (r *Client) EnableRequestTracing(logger *log.Logger) {
+	r.tracer = &requestTracer{logger: logger, stats: map[string]*RequestStats{}}
+}
+
+// RequestStats returns the request timings for each endpoint that requests were made to, sorted by endpoint, or
+// nil if request tracing is not enabled.
+func (r *Client) RequestStats() []RequestStats {
+	if r.tracer == nil {
+		return nil
+	}
+	r.tracer.mu.Lock()
+	defer r.tracer.mu.Unlock()
+	stats := make([]RequestStats, 0, len(r.tracer.stats))
+	for _, s := range r.tracer.stats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Endpoint < stats[j].Endpoint })
+	return stats
+}
+
+// roundTrip makes the request with the transport, recording its timings.
+func (t *requestTracer) roundTrip(transport http.RoundTripper, req *http.Request) (*http.Response, error) {
+	timing := &requestTiming{start: time.Now()}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			timing.mu.Lock()
+			defer timing.mu.Unlock()
+			timing.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			timing.mu.Lock()
+			defer timing.mu.Unlock()
+			timing.dns = time.Since(timing.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			timing.mu.Lock()
+			defer timing.mu.Unlock()
+			timing.connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			timing.mu.Lock()
+			defer timing.mu.Unlock()
+			timing.connect = time.Since(timing.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			timing.mu.Lock()
+			defer timing.mu.Unlock()
+			timing.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			timing.mu.Lock()
+			defer timing.mu.Unlock()
+			timing.tlsHandshake = time.Since(timing.tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			timing.mu.Lock()
+			defer timing.mu.Unlock()
+			timing.newConn = !info.Reused
+		},
+		GotFirstResponseByte: func() {
+			timing.mu.Lock()
+			defer timing.mu.Unlock()
+			timing.firstByte = time.Since(timing.start)
+		},
+	}
+
+	resp, err := transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	t.record(req, resp, err, timing)
+	return resp, err
+}
+
+// record adds the timings of the request to the totals for its endpoint, and logs them. The query is omitted from
+// the logged URL, as it may hold credentials for redirected blob downloads.
+func (t *requestTracer) record(req *http.Request, resp *http.Response, err error, timing *requestTiming) {
+	timing.mu.Lock()
+	defer timing.mu.Unlock()
+	endpoint := req.URL.Scheme + "://" + req.URL.Host
+
+	t.mu.Lock()
+	stats, ok := t.stats[endpoint]
+	if !ok {
+		stats = &RequestStats{Endpoint: endpoint}
+		t.stats[endpoint] = stats
+	}
+	stats.Requests++
+	if err != nil {
+		stats.Failures++
+	}
+	if timing.newConn {
+		stats.Connections++
+		stats.DNS += timing.dns
+		stats.Connect += timing.connect
+		stats.TLSHandshake += timing.tlsHandshake
+	}
+	stats.FirstByte += timing.firstByte
+	if timing.firstByte > stats.MaxFirstByte {
+		stats.MaxFirstByte = timing.firstByte
+	}
+	t.mu.Unlock()
+
+	if t.logger == nil {
+		return
+	}
+	u := *req.URL
+	u.RawQuery = ""
+	status := "failed: "
+	if err == nil {
+		status = resp.Status
+	} else {
+		status += err.Error()
+	}
+	if timing.newConn {
+		t.logger.Printf("%s %s %s: dns=%s connect=%s tls=%s ttfb=%s", req.Method, u.String(), status,
+			timing.dns, timing.connect, timing.tlsHandshake, timing.firstByte)
+	} else {
+		t.logger.Printf("%s %s %s: reused connection, ttfb=%s", req.Method, u.String(), status, timing.firstByte)
+	}
+}
@@ -26,6 +26,8 @@ type AuthConfig struct {
 	// IdentityToken is used to authenticate the user and get
 	// an access token for the registry.
 	IdentityToken string `toml:"identitytoken" yaml:"identity_token" json:"identitytoken"`
+	// RegistryToken is a bearer token to be sent to the registry.
+	RegistryToken string `toml:"registrytoken" yaml:"registry_token" json:"registrytoken"`
 }
 
 // TLSConfig contains the CA/Cert/Key used for a registry
@@ -48,6 +50,9 @@ type Registry struct {
 	// be a valid url with host specified.
 	// DEPRECATED: Use Configs instead. Remove in containerd 1.4.
 	Auths map[string]AuthConfig `toml:"auths" yaml:"auths" json:"auths"`
+
+	// DefaultRegistry is the registry that unqualified image names refer to, instead of Docker Hub.
+	DefaultRegistry string `toml:"defaultRegistry" yaml:"defaultRegistry" json:"defaultRegistry"`
 }
 
 // RegistryConfig contains configuration used to communicate with the registry.
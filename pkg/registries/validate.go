@@ -0,0 +1,100 @@
+package registries
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"gopkg.in/yaml.v2"
+)
+
+// ValidationError lists the problems found in a private registry configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid private registry configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// UnmarshalStrict parses private registry configuration in the same format as the configuration file, but returns an
+// error for unknown fields and duplicate keys, which are ignored when the configuration is loaded.
+func UnmarshalStrict(b []byte) (*Registry, error) {
+	registry := &Registry{}
+	if err := yaml.UnmarshalStrict(b, registry); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// Validate checks the configuration for problems that are otherwise only logged, or cause requests to fail, once
+// images are pulled: an invalid default registry, invalid endpoints and rewrites, incomplete credentials, and TLS
+// files that cannot be loaded. All of the problems found are returned as a *ValidationError. Files are read, but no
+// requests are made.
+func (r *Registry) Validate() error {
+	problems := []string{}
+	if r.DefaultRegistry != "" {
+		if _, err := name.NewRegistry(r.DefaultRegistry); err != nil {
+			problems = append(problems, fmt.Sprintf("defaultRegistry: invalid registry %q: %v", r.DefaultRegistry, err))
+		}
+	}
+	for key, mirror := range r.Mirrors {
+		for _, endpoint := range mirror.Endpoints {
+			if _, err := normalizeEndpointAddress(endpoint); err != nil {
+				problems = append(problems, fmt.Sprintf("mirrors[%q]: invalid endpoint %q: %v", key, endpoint, err))
+			}
+		}
+		for pattern := range mirror.Rewrites {
+			if _, err := regexp.Compile(pattern); err != nil {
+				problems = append(problems, fmt.Sprintf("mirrors[%q]: invalid rewrite %q: %v", key, pattern, err))
+			}
+		}
+	}
+
+	for key, config := range r.Configs {
+		if auth := config.Auth; auth != nil {
+			if (auth.Username == "") != (auth.Password == "") {
+				problems = append(problems, fmt.Sprintf("configs[%q]: username and password must be given together", key))
+			}
+		}
+		if config.TLS != nil {
+			for _, problem := range validateTLS(config.TLS) {
+				problems = append(problems, fmt.Sprintf("configs[%q]: %s", key, problem))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+// validateTLS returns the problems with loading the TLS configuration's certificate, key, and CA files.
+func validateTLS(config *TLSConfig) []string {
+	problems := []string{}
+	switch {
+	case config.CertFile != "" && config.KeyFile == "":
+		problems = append(problems, fmt.Sprintf("cert file %q was specified, but no corresponding key file was specified", config.CertFile))
+	case config.CertFile == "" && config.KeyFile != "":
+		problems = append(problems, fmt.Sprintf("key file %q was specified, but no corresponding cert file was specified", config.KeyFile))
+	case config.CertFile != "":
+		if _, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to load cert file: %v", err))
+		}
+	}
+	if config.CAFile != "" {
+		if b, err := os.ReadFile(config.CAFile); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to load CA file: %v", err))
+		} else if !x509.NewCertPool().AppendCertsFromPEM(b) {
+			problems = append(problems, fmt.Sprintf("no certificates found in CA file %s", config.CAFile))
+		}
+	}
+	return problems
+}
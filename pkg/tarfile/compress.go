@@ -0,0 +1,69 @@
+package tarfile
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/pkg/errors"
+)
+
+// Compression is the compression of a tar archive written with NewCompressor.
+type Compression int
+
+const (
+	// CompressionNone writes the archive uncompressed.
+	CompressionNone Compression = iota
+	// CompressionGzip compresses the archive with gzip, as read from .tar.gz and .tgz files.
+	CompressionGzip
+	// CompressionZstd compresses the archive with zstd, as read from .tar.zst and .tzst files.
+	CompressionZstd
+	// CompressionLZ4 compresses the archive with lz4, as read from .tar.lz4 files.
+	CompressionLZ4
+)
+
+var compressions = map[string]Compression{
+	"none": CompressionNone,
+	"gzip": CompressionGzip,
+	"zstd": CompressionZstd,
+	"lz4":  CompressionLZ4,
+}
+
+// ParseCompression returns the Compression with the given name: one of none, gzip, zstd, or lz4.
+func ParseCompression(name string) (Compression, error) {
+	if compression, ok := compressions[name]; ok {
+		return compression, nil
+	}
+	return CompressionNone, errors.Wrapf(ErrUnsupportedFormat, "invalid compression %q", name)
+}
+
+// NewCompressor returns a writer that compresses what is written to it, with the same compressors whose
+// decompressors GetOpener uses to read image tarballs, and writes it to w. Closing the writer flushes the
+// compressed stream, but does not close w.
+func NewCompressor(w io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return zw, nil
+	case CompressionLZ4:
+		return lz4.NewWriter(w), nil
+	}
+	return nil, errors.Wrapf(ErrUnsupportedFormat, "invalid compression %d", compression)
+}
+
+// nopWriteCloser implements the WriteCloser interface for uncompressed output, which has nothing to flush.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
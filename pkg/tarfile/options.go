@@ -0,0 +1,40 @@
+package tarfile
+
+import (
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/rancher/wharfie/pkg/logging"
+)
+
+// Option configures how local image archives are searched.
+type Option func(*options)
+
+type options struct {
+	logger           logging.Logger
+	referenceOptions []name.Option
+}
+
+// WithLogger sets the logger that the archives that are checked, and the reasons that copies of the image in them
+// are ignored, are logged to, instead of the standard logrus logger.
+func WithLogger(logger logging.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithReferenceOptions parses the tags in the archives with the options, so that name.WithDefaultRegistry qualifies
+// unqualified tags with the same registry as the reference was parsed with.
+func WithReferenceOptions(opts ...name.Option) Option {
+	return func(o *options) {
+		o.referenceOptions = append(o.referenceOptions, opts...)
+	}
+}
+
+// makeOptions applies the options, defaulting to the standard logger.
+func makeOptions(opts ...Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.logger = logging.OrDefault(o.logger)
+	return o
+}
@@ -1,8 +1,10 @@
 package tarfile
 
 import (
+	"context"
 	"io"
 
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/klauspost/compress/zstd"
 	"github.com/urfave/cli"
 )
@@ -11,6 +13,7 @@ import (
 var _ io.ReadCloser = &zstdReadCloser{}
 var _ io.ReadCloser = &multiReadCloser{}
 var _ io.ReadCloser = &splitReadCloser{}
+var _ io.ReadCloser = &contextReadCloser{}
 
 // ZstdReadCloser implements the ReadCloser interface for zstd. The zstd decompressor's Close()
 // method doesn't have a return value and therefore doesn't match the ReadCloser interface, so we
@@ -80,3 +83,40 @@ func (s splitReadCloser) Read(p []byte) (int, error) {
 func (s splitReadCloser) Close() error {
 	return s.c.Close()
 }
+
+// ContextReadCloser implements the ReadCloser interface for readers that should stop once a context is done. Reads
+// return the context's error once it is done, so that decompressing a large file does not continue after the caller
+// has given up on it; reads that are already in progress are not interrupted.
+func ContextReadCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	return contextReadCloser{ctx, rc}
+}
+
+type contextReadCloser struct {
+	ctx context.Context
+	rc  io.ReadCloser
+}
+
+func (c contextReadCloser) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.rc.Read(p)
+}
+
+func (c contextReadCloser) Close() error {
+	return c.rc.Close()
+}
+
+// contextOpener returns an opener whose readers stop once the context is done.
+func contextOpener(ctx context.Context, opener tarball.Opener) tarball.Opener {
+	return func() (io.ReadCloser, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rc, err := opener()
+		if err != nil {
+			return nil, err
+		}
+		return ContextReadCloser(ctx, rc), nil
+	}
+}
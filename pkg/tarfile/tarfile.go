@@ -3,6 +3,7 @@ package tarfile
 import (
 	"compress/bzip2"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -16,11 +17,13 @@ import (
 	"github.com/pierrec/lz4"
 	"github.com/pkg/errors"
 	"github.com/rancher/wharfie/pkg/util"
-	"github.com/sirupsen/logrus"
 )
 
 var (
 	ErrNotFound = errors.New("image not found")
+	// ErrUnsupportedFormat is returned when a file does not have one of the SupportedExtensions, or a compression is
+	// not one that is supported.
+	ErrUnsupportedFormat = errors.New("unsupported archive format")
 	// This needs to be kept in sync with the decompressor list
 	SupportedExtensions = []string{".tar", ".tar.lz4", ".tar.bz2", ".tbz", ".tar.gz", ".tgz", ".tar.zst", ".tzst"}
 	// The zstd decoder will attempt to use up to 1GB memory for streaming operations by default,
@@ -36,66 +39,241 @@ var (
 // FindImage checks tarball files in a given directory for a copy of the referenced image. The image reference must be a Tag, not a Digest.
 // The image is retrieved from the first file (ordered by name) that it is found in; there is no preference in terms of compression format.
 // If the image is not found in any file in the given directory, a NotFoundError is returned.
-func FindImage(imagesDir string, imageRef name.Reference) (v1.Image, error) {
+func FindImage(imagesDir string, imageRef name.Reference, opts ...Option) (v1.Image, error) {
+	return FindImageContext(context.Background(), imagesDir, imageRef, opts...)
+}
+
+// FindImageContext finds the referenced image as FindImage does, and stops scanning the directory when the context
+// is done. The context is checked between files, and reads from the files, including the layers of the returned
+// image, fail once it is done, so that decompressing a large archive stops promptly. When the scan is stopped, the
+// error wraps ctx.Err() with how many files were checked.
+func FindImageContext(ctx context.Context, imagesDir string, imageRef name.Reference, opts ...Option) (v1.Image, error) {
+	return FindPlatformImageContext(ctx, imagesDir, imageRef, v1.Platform{}, opts...)
+}
+
+// FindPlatformImage checks tarball files in a given directory for a copy of the referenced image for the requested platform.
+// The image reference must be a Tag, not a Digest. Copies whose config declares a platform that does not satisfy the requested
+// platform are ignored; if several copies do, the one that best matches the requested variant is returned, as scored by
+// util.PlatformScore, with ties going to the first file (ordered by name).
+// If the image is not found in any file in the given directory, a NotFoundError is returned.
+func FindPlatformImage(imagesDir string, imageRef name.Reference, platform v1.Platform, opts ...Option) (v1.Image, error) {
+	return FindPlatformImageContext(context.Background(), imagesDir, imageRef, platform, opts...)
+}
+
+// FindPlatformImageContext finds the referenced image for the requested platform as FindPlatformImage does, and stops
+// scanning the directory when the context is done, as FindImageContext does.
+func FindPlatformImageContext(ctx context.Context, imagesDir string, imageRef name.Reference, platform v1.Platform, opts ...Option) (v1.Image, error) {
+	img, _, err := FindPlatformImageFileInDirsContext(ctx, []string{imagesDir}, imageRef, platform, opts...)
+	return img, err
+}
+
+// FindPlatformImageInDirs checks tarball files in each of the given directories, in order, for a copy of the referenced image
+// for the requested platform, as FindPlatformImage does. The image is returned from the first directory that has a copy for the
+// requested platform; later directories are not checked once it is found, even if they have a copy that better matches the
+// requested variant. Directories that do not exist are skipped.
+// Tags in the tarball files are parsed with the given options, so that name.WithDefaultRegistry qualifies unqualified
+// tags with the same registry as the reference was parsed with.
+// If the image is not found in any file in the given directories, a NotFoundError is returned.
+func FindPlatformImageInDirs(imagesDirs []string, imageRef name.Reference, platform v1.Platform, options ...name.Option) (v1.Image, error) {
+	img, _, err := FindPlatformImageFileInDirs(imagesDirs, imageRef, platform, WithReferenceOptions(options...))
+	return img, err
+}
+
+// FindPlatformImageFileInDirs finds the referenced image for the requested platform as FindPlatformImageInDirs does, with tags
+// parsed with the options given by WithReferenceOptions, and also returns the path of the tarball file that it was found in.
+func FindPlatformImageFileInDirs(imagesDirs []string, imageRef name.Reference, platform v1.Platform, opts ...Option) (v1.Image, string, error) {
+	return FindPlatformImageFileInDirsContext(context.Background(), imagesDirs, imageRef, platform, opts...)
+}
+
+// FindPlatformImageFileInDirsContext finds the referenced image for the requested platform, and the path of the tarball
+// file that it was found in, as FindPlatformImageFileInDirs does, and stops scanning the directories when the context
+// is done, as FindImageContext does.
+func FindPlatformImageFileInDirsContext(ctx context.Context, imagesDirs []string, imageRef name.Reference, platform v1.Platform, opts ...Option) (v1.Image, string, error) {
+	o := makeOptions(opts...)
 	imageTag, ok := imageRef.(name.Tag)
 	if !ok {
-		return nil, fmt.Errorf("no local image available for %s: reference is not a tag", imageRef.Name())
+		return nil, "", fmt.Errorf("no local image available for %s: reference is not a tag", imageRef.Name())
+	}
+
+	for _, imagesDir := range imagesDirs {
+		img, fileName, err := findPlatformImage(ctx, imagesDir, imageTag, platform, o)
+		if err != nil {
+			return nil, "", err
+		}
+		if img != nil {
+			return img, fileName, nil
+		}
 	}
+	return nil, "", errors.Wrapf(ErrNotFound, "no local image available for %s: not found in any file in %s", imageTag.Name(), strings.Join(imagesDirs, ", "))
+}
 
+// findPlatformImage checks tarball files in a directory for a copy of the referenced image for the requested platform, returning
+// the image and the file it was found in, or nil if the directory does not exist or has no copy for the requested platform.
+// If the context is done, the files that were checked are counted in the returned error.
+func findPlatformImage(ctx context.Context, imagesDir string, imageTag name.Tag, platform v1.Platform, o *options) (v1.Image, string, error) {
 	if _, err := os.Stat(imagesDir); err != nil {
 		if os.IsNotExist(err) {
-			return nil, errors.Wrapf(ErrNotFound, "no local image available for %s: directory %s does not exist", imageTag.Name(), imagesDir)
+			o.logger.Debugf("Skipping local image archives in %s for %s: directory does not exist", imagesDir, imageTag.Name())
+			return nil, "", nil
 		}
-		return nil, err
+		return nil, "", err
+	}
+
+	o.logger.Infof("Checking local image archives in %s for %s", imagesDir, imageTag.Name())
+
+	files, err := Archives(imagesDir)
+	if err != nil {
+		return nil, "", err
+	}
+	stopped := func(checked int) error {
+		return errors.Wrapf(ctx.Err(), "stopped checking local image archives in %s for %s after %d of %d files", imagesDir, imageTag.Name(), checked, len(files))
 	}
 
-	logrus.Infof("Checking local image archives in %s for %s", imagesDir, imageTag.Name())
+	// Try to find the requested tag in each file, moving on to the next if there's an error
+	// or the image is for a different platform.
+	var match v1.Image
+	var matchFile string
+	best := -1
+	for i, fileName := range files {
+		if ctx.Err() != nil {
+			return nil, "", stopped(i)
+		}
+		img, err := findImage(ctx, fileName, imageTag, o.referenceOptions)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, "", stopped(i)
+			}
+			o.logger.Infof("Failed to find %s in %s: %v", imageTag.Name(), fileName, err)
+		}
+		if img == nil {
+			continue
+		}
+		config, err := img.ConfigFile()
+		if err != nil {
+			o.logger.Infof("Failed to read config file for %s in %s: %v", imageTag.Name(), fileName, err)
+			continue
+		}
+		// images that do not declare a platform are assumed to be usable on any platform
+		score := 0
+		if imagePlatform := config.Platform(); imagePlatform != nil {
+			score = util.PlatformScore(imagePlatform, platform)
+		}
+		if score < 0 {
+			o.logger.Infof("Ignoring %s in %s: platform %s does not match %s", imageTag.Name(), fileName, config.Platform(), platform)
+			continue
+		}
+		o.logger.Debugf("Found %s in %s", imageTag.Name(), fileName)
+		if score == util.ExactPlatform {
+			return img, fileName, nil
+		}
+		if score > best {
+			match, matchFile, best = img, fileName, score
+		}
+	}
+	return match, matchFile, nil
+}
 
-	// Walk the images dir to get a list of tar files.
-	// dotfiles and files with unsupported extensions are ignored.
-	files := map[string]os.FileInfo{}
+// Archives returns the image archives in a directory, or its subdirectories, in lexical order. Dotfiles and files
+// with unsupported extensions are ignored.
+func Archives(imagesDir string) ([]string, error) {
+	files := []string{}
+	// filepath.Walk visits files in lexical order.
 	if err := filepath.Walk(imagesDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		base := filepath.Base(info.Name())
 		if !info.IsDir() && !strings.HasPrefix(base, ".") && util.HasSuffixI(base, SupportedExtensions...) {
-			files[path] = info
+			files = append(files, path)
 		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
+	return files, nil
+}
 
-	// Try to find the requested tag in each file, moving on to the next if there's an error
-	for fileName := range files {
-		img, err := findImage(fileName, imageTag)
-		if err != nil {
-			logrus.Infof("Failed to find %s in %s: %v", imageTag.Name(), fileName, err)
+// ArchiveImages returns handles to all of the images in a tarfile on disk. Images are looked up by their first tag;
+// an image without tags can only be read from a file that has no other images, and is skipped otherwise.
+func ArchiveImages(fileName string, opts ...Option) ([]v1.Image, error) {
+	o := makeOptions(opts...)
+	opener, err := GetOpener(fileName)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return nil, err
+	}
+	images := []v1.Image{}
+	for i, descriptor := range manifest {
+		var tag *name.Tag
+		if len(descriptor.RepoTags) > 0 {
+			t, err := name.NewTag(descriptor.RepoTags[0])
+			if err != nil {
+				return nil, err
+			}
+			tag = &t
+		} else if len(manifest) > 1 {
+			o.logger.Infof("Skipping untagged image %d in %s: the file has more than one image", i+1, fileName)
+			continue
 		}
-		if img != nil {
-			logrus.Debugf("Found %s in %s", imageTag.Name(), fileName)
-			return img, nil
+		img, err := tarball.Image(opener, tag)
+		if err != nil {
+			return nil, err
 		}
+		images = append(images, img)
 	}
-	return nil, errors.Wrapf(ErrNotFound, "no local image available for %s: not found in any file in %s", imageTag.Name(), imagesDir)
+	return images, nil
 }
 
-// findImage returns a handle to an image in a tarfile on disk.
-// If the image is not found in the file, an error is returned.
-func findImage(fileName string, imageTag name.Tag) (v1.Image, error) {
-	opener, err := GetOpener(fileName)
+// findImage returns a handle to an image in a tarfile on disk, with the tags in the file parsed with the options.
+// Reads from the file fail once the context is done. If the image is not found in the file, an error is returned.
+func findImage(ctx context.Context, fileName string, imageTag name.Tag, options []name.Option) (v1.Image, error) {
+	opener, err := getOpener(fileName)
 	if err != nil {
 		return nil, err
 	}
+	opener = contextOpener(ctx, opener)
+	if len(options) > 0 {
+		// tarball.Image parses the tags in the file without options, so look the image up by its tag as written
+		if imageTag, err = findTag(opener, imageTag, options); err != nil {
+			return nil, err
+		}
+	}
 	return tarball.Image(opener, &imageTag)
 }
 
+// findTag returns the tag in a tarfile's manifest that matches the image tag when parsed with the options, as it is
+// parsed without them.
+func findTag(opener tarball.Opener, imageTag name.Tag, options []name.Option) (name.Tag, error) {
+	manifest, err := tarball.LoadManifest(opener)
+	if err != nil {
+		return name.Tag{}, err
+	}
+	for _, descriptor := range manifest {
+		for _, repoTag := range descriptor.RepoTags {
+			tag, err := name.NewTag(repoTag, options...)
+			if err != nil {
+				return name.Tag{}, err
+			}
+			if tag.Name() == imageTag.Name() {
+				return name.NewTag(repoTag)
+			}
+		}
+	}
+	return name.Tag{}, errors.Wrapf(ErrNotFound, "tag %s not found in tarball", imageTag)
+}
+
+// getOpener returns the opener for a file that is checked for an image. It is a variable so that tests can slow down
+// the reads from the files.
+var getOpener = GetOpener
+
 // GetOpener returns a function implementing the tarball.Opener interface.
 // This is required because compressed tarballs are not seekable, and the image
 // reader may need to seek backwards in the file to find a required layer.
 // Instead of seeking backwards, it just closes and reopens the file.
-// If the file format is not supported, an error is returned.
+// If the file format is not supported, an error wrapping ErrUnsupportedFormat is returned.
 func GetOpener(fileName string) (tarball.Opener, error) {
 	var opener tarball.Opener
 	switch {
@@ -146,7 +324,7 @@ func GetOpener(fileName string) (tarball.Opener, error) {
 			return ZstdReadCloser(zr, file), nil
 		}
 	default:
-		return nil, fmt.Errorf("unhandled file type; supported extensions: " + strings.Join(SupportedExtensions, " "))
+		return nil, errors.Wrapf(ErrUnsupportedFormat, "unhandled file type %s; supported extensions: %s", filepath.Base(fileName), strings.Join(SupportedExtensions, " "))
 	}
 	return opener, nil
 }
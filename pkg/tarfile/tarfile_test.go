@@ -0,0 +1,423 @@
+package tarfile
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/logging"
+)
+
+func TestFindPlatformImageInDirs(t *testing.T) {
+	tag, err := name.NewTag("registry.example.com/test/app:v1")
+	if err != nil {
+		t.Fatalf("Failed to parse tag: %v", err)
+	}
+
+	// each directory has a different image with the same tag
+	root := t.TempDir()
+	digests := map[string]v1.Hash{}
+	for _, dir := range []string{"preload", "updates"} {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		if digests[dir], err = img.Digest(); err != nil {
+			t.Fatalf("Failed to get image digest: %v", err)
+		}
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := tarball.WriteToFile(filepath.Join(root, dir, "images.tar"), tag, img); err != nil {
+			t.Fatalf("Failed to write image tarball: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(root, "empty"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	testCases := map[string]struct {
+		dirs     []string
+		expected string
+	}{
+		"first directory wins":          {dirs: []string{"preload", "updates"}, expected: "preload"},
+		"order determines the winner":   {dirs: []string{"updates", "preload"}, expected: "updates"},
+		"empty directory is skipped":    {dirs: []string{"empty", "updates", "preload"}, expected: "updates"},
+		"missing directory is skipped":  {dirs: []string{"missing", "preload"}, expected: "preload"},
+		"single directory":              {dirs: []string{"updates"}, expected: "updates"},
+		"not found in any directory":    {dirs: []string{"empty", "missing"}},
+		"not found without directories": {},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			dirs := []string{}
+			for _, dir := range tc.dirs {
+				dirs = append(dirs, filepath.Join(root, dir))
+			}
+
+			img, path, err := FindPlatformImageFileInDirs(dirs, tag, v1.Platform{})
+			if tc.expected == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("Expected image not to be found but got %v", err)
+				}
+				for _, dir := range dirs {
+					if !strings.Contains(err.Error(), dir) {
+						t.Errorf("Expected error to list directory %s: %v", dir, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to find image: %v", err)
+			}
+			digest, err := img.Digest()
+			if err != nil {
+				t.Fatalf("Failed to get image digest: %v", err)
+			}
+			if digest != digests[tc.expected] {
+				t.Errorf("Expected image from %s with digest %s but got %s", tc.expected, digests[tc.expected], digest)
+			}
+			if expected := filepath.Join(root, tc.expected, "images.tar"); path != expected {
+				t.Errorf("Expected image to be found in %s but got %s", expected, path)
+			}
+		})
+	}
+}
+
+func TestFindPlatformImageInDirsDefaultRegistry(t *testing.T) {
+	// tags are written to the tarball as given, so the unqualified tag is stored without a registry
+	dir := t.TempDir()
+	digests := map[string]v1.Hash{}
+	for _, image := range []string{"test/app:v1", "docker.io/test/hub:v1"} {
+		tag, err := name.NewTag(image)
+		if err != nil {
+			t.Fatalf("Failed to parse tag: %v", err)
+		}
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		if digests[image], err = img.Digest(); err != nil {
+			t.Fatalf("Failed to get image digest: %v", err)
+		}
+		if err := tarball.WriteToFile(filepath.Join(dir, strings.ReplaceAll(image, "/", "-")+".tar"), tag, img); err != nil {
+			t.Fatalf("Failed to write image tarball: %v", err)
+		}
+	}
+
+	options := []name.Option{name.WithDefaultRegistry("registry.example.com")}
+	testCases := map[string]struct {
+		image    string
+		options  []name.Option
+		expected string
+	}{
+		"unqualified tag with default registry": {
+			image:    "test/app:v1",
+			options:  options,
+			expected: "test/app:v1",
+		},
+		"qualified tag with default registry": {
+			image:    "registry.example.com/test/app:v1",
+			options:  options,
+			expected: "test/app:v1",
+		},
+		"unqualified tag without default registry": {
+			image:    "test/app:v1",
+			expected: "test/app:v1",
+		},
+		"docker hub tag is not qualified with default registry": {
+			image:   "test/hub:v1",
+			options: options,
+		},
+		"docker hub tag with default registry": {
+			image:    "docker.io/test/hub:v1",
+			options:  options,
+			expected: "docker.io/test/hub:v1",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			tag, err := name.NewTag(tc.image, tc.options...)
+			if err != nil {
+				t.Fatalf("Failed to parse tag: %v", err)
+			}
+			img, err := FindPlatformImageInDirs([]string{dir}, tag, v1.Platform{}, tc.options...)
+			if tc.expected == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("Expected image not to be found but got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to find image: %v", err)
+			}
+			digest, err := img.Digest()
+			if err != nil {
+				t.Fatalf("Failed to get image digest: %v", err)
+			}
+			if digest != digests[tc.expected] {
+				t.Errorf("Expected image %s with digest %s but got %s", tc.expected, digests[tc.expected], digest)
+			}
+		})
+	}
+}
+
+func TestFindImageLogger(t *testing.T) {
+	tag, err := name.NewTag("registry.example.com/test/app:v1")
+	if err != nil {
+		t.Fatalf("Failed to parse tag: %v", err)
+	}
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "images.tar")
+	if err := tarball.WriteToFile(file, tag, img); err != nil {
+		t.Fatalf("Failed to write image tarball: %v", err)
+	}
+	missing := filepath.Join(dir, "missing")
+
+	recorder := &logging.Recorder{}
+	if _, _, err := FindPlatformImageFileInDirs([]string{missing, dir}, tag, v1.Platform{}, WithLogger(recorder)); err != nil {
+		t.Fatalf("Failed to find image: %v", err)
+	}
+	expected := []logging.Entry{
+		{Level: logging.LevelDebug, Message: fmt.Sprintf("Skipping local image archives in %s for %s: directory does not exist", missing, tag.Name()), Fields: logging.Fields{}},
+		{Level: logging.LevelInfo, Message: fmt.Sprintf("Checking local image archives in %s for %s", dir, tag.Name()), Fields: logging.Fields{}},
+		{Level: logging.LevelDebug, Message: fmt.Sprintf("Found %s in %s", tag.Name(), file), Fields: logging.Fields{}},
+	}
+	if entries := recorder.Entries(); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected %v to be logged, got %v", expected, entries)
+	}
+}
+
+// slowReader is a reader that sleeps before each read, and calls onRead first.
+type slowReader struct {
+	io.ReadCloser
+	onRead func()
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	r.onRead()
+	time.Sleep(time.Millisecond)
+	return r.ReadCloser.Read(p)
+}
+
+func TestFindImageContext(t *testing.T) {
+	tag, err := name.NewTag("registry.example.com/test/app:v1")
+	if err != nil {
+		t.Fatalf("Failed to parse tag: %v", err)
+	}
+	// none of the files have the image, so that every file is checked unless the scan is stopped
+	dir := t.TempDir()
+	files := []string{"a.tar", "b.tar.gz", "c.tar.zst"}
+	for i, compression := range []Compression{CompressionNone, CompressionGzip, CompressionZstd} {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		if err := writeArchive(filepath.Join(dir, files[i]), compression, tag.Context().Tag(fmt.Sprintf("v%d", i+2)), img); err != nil {
+			t.Fatalf("Failed to write image archive: %v", err)
+		}
+	}
+
+	defer func(opener func(string) (tarball.Opener, error)) { getOpener = opener }(getOpener)
+	testCases := map[string]struct {
+		// cancelIn is the file that the scan is cancelled while reading, or empty if it is not cancelled
+		cancelIn string
+		checked  int
+	}{
+		"cancelled in first file":  {cancelIn: "a.tar", checked: 0},
+		"cancelled in second file": {cancelIn: "b.tar.gz", checked: 1},
+		"not cancelled":            {},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			mu := sync.Mutex{}
+			// reads counts the reads from each file after the context was cancelled
+			reads := map[string]int{}
+			getOpener = func(fileName string) (tarball.Opener, error) {
+				opener, err := GetOpener(fileName)
+				if err != nil {
+					return nil, err
+				}
+				base := filepath.Base(fileName)
+				return func() (io.ReadCloser, error) {
+					rc, err := opener()
+					if err != nil {
+						return nil, err
+					}
+					return slowReader{rc, func() {
+						mu.Lock()
+						defer mu.Unlock()
+						if ctx.Err() != nil {
+							reads[base]++
+						} else if base == tc.cancelIn {
+							cancel()
+						}
+					}}, nil
+				}, nil
+			}
+
+			_, err := FindImageContext(ctx, dir, tag)
+			if tc.cancelIn == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("Expected image not to be found but got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, context.Canceled) || errors.Is(err, ErrNotFound) {
+				t.Fatalf("Expected scan to be cancelled but got %v", err)
+			}
+			if expected := fmt.Sprintf("after %d of %d files", tc.checked, len(files)); !strings.Contains(err.Error(), expected) {
+				t.Errorf("Expected error to say that the scan stopped %s: %v", expected, err)
+			}
+			// the reader is not read from again once the read that cancelled the scan returns, and later files are
+			// not opened
+			mu.Lock()
+			defer mu.Unlock()
+			if len(reads) != 0 {
+				t.Errorf("Expected files not to be read after the scan was cancelled, got %v", reads)
+			}
+		})
+	}
+}
+
+// writeArchive writes the image to a file with the compression.
+func writeArchive(fileName string, compression Compression, tag name.Tag, img v1.Image) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w, err := NewCompressor(file, compression)
+	if err != nil {
+		return err
+	}
+	if err := tarball.Write(tag, img, w); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func TestNewCompressor(t *testing.T) {
+	tag, err := name.NewTag("registry.example.com/test/compressed:v1")
+	if err != nil {
+		t.Fatalf("Failed to parse tag: %v", err)
+	}
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	expected, err := img.Digest()
+	if err != nil {
+		t.Fatalf("Failed to get image digest: %v", err)
+	}
+
+	if _, err := ParseCompression("bzip2"); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected unsupported format error parsing unsupported compression, got %v", err)
+	}
+	if _, err := NewCompressor(nil, Compression(-1)); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected unsupported format error creating compressor, got %v", err)
+	}
+
+	// each archive is read back through the decompressor for its extension
+	testCases := map[string]string{
+		"none": "image.tar",
+		"gzip": "image.tar.gz",
+		"zstd": "image.tar.zst",
+		"lz4":  "image.tar.lz4",
+	}
+
+	for compressionName, fileName := range testCases {
+		t.Run(compressionName, func(t *testing.T) {
+			compression, err := ParseCompression(compressionName)
+			if err != nil {
+				t.Fatalf("Failed to parse compression: %v", err)
+			}
+			dir := t.TempDir()
+			f, err := os.Create(filepath.Join(dir, fileName))
+			if err != nil {
+				t.Fatalf("Failed to create archive: %v", err)
+			}
+			defer f.Close()
+			w, err := NewCompressor(f, compression)
+			if err != nil {
+				t.Fatalf("Failed to create compressor: %v", err)
+			}
+			if err := tarball.Write(tag, img, w); err != nil {
+				t.Fatalf("Failed to write image tarball: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Failed to close compressor: %v", err)
+			}
+
+			found, err := FindImage(dir, tag)
+			if err != nil {
+				t.Fatalf("Failed to find image: %v", err)
+			}
+			digest, err := found.Digest()
+			if err != nil {
+				t.Fatalf("Failed to get image digest: %v", err)
+			}
+			if digest != expected {
+				t.Errorf("Expected image with digest %s but got %s", expected, digest)
+			}
+		})
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tag, err := name.NewTag("registry.example.com/test/errors:v1")
+	if err != nil {
+		t.Fatalf("Failed to parse tag: %v", err)
+	}
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	dir := t.TempDir()
+	if err := tarball.WriteToFile(filepath.Join(dir, "image.tar"), tag, img); err != nil {
+		t.Fatalf("Failed to write image tarball: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "image.zip"), []byte("not an archive"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	if _, err := GetOpener(filepath.Join(dir, "image.zip")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected unsupported format error opening file, got %v", err)
+	}
+	if _, err := ArchiveImages(filepath.Join(dir, "image.zip")); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("Expected unsupported format error reading images, got %v", err)
+	}
+
+	// tags in the file are looked up with the reference options
+	other, _ := name.NewTag("registry.example.com/test/errors:v2")
+	if _, err := FindImage(dir, other, WithReferenceOptions(name.WithDefaultRegistry("registry.example.com"))); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error finding image, got %v", err)
+	}
+	if _, err := FindImage(filepath.Join(dir, "missing"), tag); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error finding image in missing directory, got %v", err)
+	}
+	if _, err := findImage(context.Background(), filepath.Join(dir, "image.tar"), other, []name.Option{name.WithDefaultRegistry("registry.example.com")}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected not found error finding tag in file, got %v", err)
+	}
+}
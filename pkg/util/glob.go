@@ -0,0 +1,75 @@
+package util
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// HasGlob returns true if the path contains any glob metacharacters.
+func HasGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// ValidateGlob returns an error if any component of the pattern is malformed.
+func ValidateGlob(pattern string) error {
+	for _, component := range splitPath(pattern) {
+		if _, err := path.Match(component, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MatchGlob reports whether the path matches the pattern. Patterns are matched component-by-component using
+// path.Match, with the addition of `**` components, which match zero or more directories.
+func MatchGlob(pattern, name string) (bool, error) {
+	return matchComponents(splitPath(pattern), splitPath(name))
+}
+
+// GlobPrefix returns the leading components of the pattern that do not contain glob metacharacters,
+// as a slash-separated path.
+func GlobPrefix(pattern string) string {
+	prefix := []string{}
+	for _, component := range splitPath(pattern) {
+		if HasGlob(component) {
+			break
+		}
+		prefix = append(prefix, component)
+	}
+	joined := path.Join(prefix...)
+	if filepath.IsAbs(pattern) || strings.HasPrefix(pattern, "/") {
+		joined = "/" + joined
+	}
+	return path.Clean(joined)
+}
+
+// matchComponents recursively matches path components against pattern components.
+func matchComponents(pattern, name []string) (bool, error) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if ok, err := matchComponents(pattern[1:], name[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(name) == 0 {
+			return false, nil
+		}
+		if ok, err := path.Match(pattern[0], name[0]); !ok || err != nil {
+			return false, err
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0, nil
+}
+
+// splitPath splits a path into its non-empty components, using both forward slashes and the OS path separator.
+func splitPath(name string) []string {
+	return strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == os.PathSeparator
+	})
+}
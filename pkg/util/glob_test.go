@@ -0,0 +1,63 @@
+package util
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	globTests := []struct {
+		pattern string
+		path    string
+		match   bool
+	}{
+		{"/usr/lib/*.so", "/usr/lib/libc.so", true},
+		{"/usr/lib/*.so", "/usr/lib/x86_64/libc.so", false},
+		{"/usr/lib/**/*.so", "/usr/lib/libc.so", true},
+		{"/usr/lib/**/*.so", "/usr/lib/x86_64/libc.so", true},
+		{"/usr/lib/**/*.so", "/usr/lib/x86_64/gconv/libc.so", true},
+		{"/usr/lib/**/*.so", "/usr/lib/x86_64/libc.so.6", false},
+		{"/usr/lib/**/*.so", "/usr/libexec/libc.so", false},
+		{"/usr/lib/**", "/usr/lib", true},
+		{"/usr/lib/**", "/usr/lib/x86_64/libc.so", true},
+		{"**/*.md", "/README.md", true},
+		{"**/*.md", "/usr/share/doc/README.md", true},
+		{"/usr/share/doc/**", "/usr/share/docs/README", false},
+		{"/bin/[a-c]*", "/bin/cat", true},
+		{"/bin/[a-c]*", "/bin/ls", false},
+		{"/bin/?s", "/bin/ls", true},
+	}
+
+	for _, test := range globTests {
+		match, err := MatchGlob(test.pattern, test.path)
+		if err != nil {
+			t.Errorf("Unexpected error matching %q against %q: %v", test.path, test.pattern, err)
+		} else if match != test.match {
+			t.Errorf("Expected match=%v for %q against %q", test.match, test.path, test.pattern)
+		}
+	}
+}
+
+func TestGlobPrefix(t *testing.T) {
+	prefixTests := map[string]string{
+		"/usr/lib/**/*.so": filepath.FromSlash("/usr/lib"),
+		"/usr/lib/*.so":    filepath.FromSlash("/usr/lib"),
+		"/**/*.md":         filepath.FromSlash("/"),
+		"/bin/[a-c]*":      filepath.FromSlash("/bin"),
+	}
+
+	for pattern, expected := range prefixTests {
+		if prefix := GlobPrefix(pattern); prefix != expected {
+			t.Errorf("Expected prefix %q for %q but got %q", expected, pattern, prefix)
+		}
+	}
+}
+
+func TestValidateGlob(t *testing.T) {
+	if err := ValidateGlob("/usr/lib/**/*.so"); err != nil {
+		t.Errorf("Unexpected error for valid pattern: %v", err)
+	}
+	if err := ValidateGlob("/usr/lib/[a-/*.so"); err == nil {
+		t.Errorf("Expected error for malformed pattern")
+	}
+}
@@ -0,0 +1,80 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	// ExactPlatform is the score of a platform that satisfies the requested platform, including its variant.
+	ExactPlatform = 100
+	// anyVariant is the score of a platform that does not specify a variant, when a variant was requested.
+	anyVariant = 50
+)
+
+// PlatformScore returns how well the platform of an image satisfies the requested platform, or -1 if it does not.
+// The operating system, architecture, and OS version must match when requested. When a variant is requested, an
+// exact match is preferred, followed by an image without a variant, followed by an older compatible arm variant, so
+// that a request for linux/arm/v7 can still use a linux/arm/v6 image. A nil platform only satisfies a request that
+// does not specify an operating system or architecture.
+func PlatformScore(platform *v1.Platform, want v1.Platform) int {
+	if platform == nil {
+		if want.OS == "" && want.Architecture == "" {
+			return 0
+		}
+		return -1
+	}
+	if !satisfies(want.OS, platform.OS) || !satisfies(want.Architecture, platform.Architecture) || !satisfies(want.OSVersion, platform.OSVersion) {
+		return -1
+	}
+
+	variant := normalizeVariant(platform.Architecture, platform.Variant)
+	wantVariant := normalizeVariant(want.Architecture, want.Variant)
+	switch {
+	case wantVariant == "" || variant == wantVariant:
+		return ExactPlatform
+	case variant == "":
+		return anyVariant
+	case platform.Architecture == "arm":
+		// arm variants are backwards compatible, so prefer the newest one that is not newer than requested
+		version, ok := armVersion(variant)
+		wantVersion, wantOK := armVersion(wantVariant)
+		if ok && wantOK && version < wantVersion {
+			return version
+		}
+	}
+	return -1
+}
+
+// MatchPlatform returns the index of the descriptor whose platform best satisfies the requested platform, as scored
+// by PlatformScore, or -1 if none do. If several descriptors are equally good, the first is returned.
+func MatchPlatform(descriptors []v1.Descriptor, want v1.Platform) int {
+	match, best := -1, -1
+	for i, desc := range descriptors {
+		if score := PlatformScore(desc.Platform, want); score > best {
+			match, best = i, score
+		}
+	}
+	return match
+}
+
+// satisfies returns true if the value matches the requested value, or if no value was requested.
+func satisfies(want, have string) bool {
+	return want == "" || want == have
+}
+
+// normalizeVariant returns the variant, treating v8 as the default variant for arm64.
+func normalizeVariant(arch, variant string) string {
+	if arch == "arm64" && variant == "v8" {
+		return ""
+	}
+	return variant
+}
+
+// armVersion returns the version number of an arm variant such as v7.
+func armVersion(variant string) (int, bool) {
+	version, err := strconv.Atoi(strings.TrimPrefix(variant, "v"))
+	return version, err == nil && strings.HasPrefix(variant, "v")
+}
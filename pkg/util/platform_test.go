@@ -0,0 +1,64 @@
+package util
+
+import (
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+func TestMatchPlatform(t *testing.T) {
+	descriptors := func(platforms ...string) []v1.Descriptor {
+		descs := []v1.Descriptor{}
+		for _, platform := range platforms {
+			p, err := v1.ParsePlatform(platform)
+			if err != nil {
+				t.Fatalf("Failed to parse platform %q: %v", platform, err)
+			}
+			descs = append(descs, v1.Descriptor{Platform: p})
+		}
+		return descs
+	}
+
+	platformTests := []struct {
+		platforms []string
+		want      string
+		match     int
+	}{
+		{[]string{"linux/amd64", "linux/arm/v6", "linux/arm/v7"}, "linux/arm/v7", 2},
+		{[]string{"linux/amd64", "linux/arm/v7", "linux/arm/v6"}, "linux/arm/v6", 2},
+		{[]string{"linux/amd64", "linux/arm/v6", "linux/arm/v7"}, "linux/arm", 1},
+		{[]string{"linux/amd64", "linux/arm/v6", "linux/arm"}, "linux/arm/v7", 2},
+		{[]string{"linux/amd64", "linux/arm/v5", "linux/arm/v6"}, "linux/arm/v7", 2},
+		{[]string{"linux/amd64", "linux/arm/v7"}, "linux/arm/v6", -1},
+		{[]string{"linux/amd64", "linux/arm64/v8"}, "linux/arm64", 1},
+		{[]string{"linux/amd64", "linux/arm64"}, "linux/arm64/v8", 1},
+		{[]string{"linux/amd64", "linux/arm64"}, "windows/amd64", -1},
+		{[]string{"windows/amd64:10.0.17763.1", "windows/amd64:10.0.20348.1"}, "windows/amd64:10.0.20348.1", 1},
+		{[]string{"windows/amd64:10.0.17763.1", "windows/amd64:10.0.20348.1"}, "windows/amd64", 0},
+		{[]string{"linux/amd64"}, "", 0},
+	}
+
+	for _, test := range platformTests {
+		want := v1.Platform{}
+		if test.want != "" {
+			p, err := v1.ParsePlatform(test.want)
+			if err != nil {
+				t.Fatalf("Failed to parse platform %q: %v", test.want, err)
+			}
+			want = *p
+		}
+		if match := MatchPlatform(descriptors(test.platforms...), want); match != test.match {
+			t.Errorf("Expected %q to match %d in %v but got %d", test.want, test.match, test.platforms, match)
+		}
+	}
+}
+
+func TestPlatformScore(t *testing.T) {
+	want := v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+	if score := PlatformScore(nil, want); score != -1 {
+		t.Errorf("Expected nil platform not to satisfy %v but got score %d", want, score)
+	}
+	if score := PlatformScore(nil, v1.Platform{}); score < 0 {
+		t.Errorf("Expected nil platform to satisfy empty platform but got score %d", score)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// allPlatforms returns true if all platforms of an image index were requested, either by the command's own
+// --all-platforms flag, or by the global one.
+func allPlatforms(clx *cli.Context) bool {
+	return clx.Bool("all-platforms") || clx.GlobalBool("all-platforms")
+}
+
+// imagePlatform returns the platform to select images for, from the --platform flag, or else from the deprecated
+// --os and --arch flags, which cannot express a variant.
+func imagePlatform(clx *cli.Context) (v1.Platform, error) {
+	legacy := clx.GlobalIsSet("os") || clx.GlobalIsSet("arch")
+	if value := clx.GlobalString("platform"); value != "" {
+		if legacy {
+			return v1.Platform{}, errors.New("--platform cannot be combined with the deprecated --os and --arch flags")
+		}
+		platform, err := v1.ParsePlatform(value)
+		if err != nil {
+			return v1.Platform{}, errors.Wrapf(err, "invalid platform %q", value)
+		}
+		return withOSVersion(clx, *platform), nil
+	}
+	if legacy {
+		logrus.Warn("The --os and --arch flags are deprecated; use --platform instead")
+	}
+	return withOSVersion(clx, v1.Platform{OS: clx.GlobalString("os"), Architecture: clx.GlobalString("arch")}), nil
+}
+
+// withOSVersion returns the platform with the OS version from the --os-version flag, if it is set, which takes
+// precedence over the OS version given by --platform.
+func withOSVersion(clx *cli.Context, platform v1.Platform) v1.Platform {
+	if osVersion := clx.GlobalString("os-version"); osVersion != "" {
+		platform.OSVersion = osVersion
+	}
+	return platform
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/urfave/cli"
+)
+
+func TestImagePlatform(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	// push a synthetic index for each set of platforms, recording the digest of the image for each platform
+	digests := map[string]string{}
+	pushIndex := func(tag string, platforms ...string) name.Reference {
+		index := v1.ImageIndex(empty.Index)
+		for _, platform := range platforms {
+			p, _ := v1.ParsePlatform(platform)
+			img, err := random.Image(256, 1)
+			if err != nil {
+				t.Fatalf("Failed to create image: %v", err)
+			}
+			digest, _ := img.Digest()
+			digests[tag+" "+platform] = digest.String()
+			index = mutate.AppendManifests(index, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: p}})
+		}
+		ref, _ := name.ParseReference(u.Host + "/test/platform:" + tag)
+		if err := remote.WriteIndex(ref, index); err != nil {
+			t.Fatalf("Failed to push index: %v", err)
+		}
+		return ref
+	}
+	variants := pushIndex("variants", "linux/amd64", "linux/arm/v6", "linux/arm/v7")
+	generic := pushIndex("generic", "linux/amd64", "linux/arm")
+
+	testCases := map[string]struct {
+		ref      name.Reference
+		platform string
+		expected string
+	}{
+		"exact variant": {
+			ref:      variants,
+			platform: "linux/arm/v7",
+			expected: "variants linux/arm/v7",
+		},
+		"older exact variant": {
+			ref:      variants,
+			platform: "linux/arm/v6",
+			expected: "variants linux/arm/v6",
+		},
+		"older compatible variant": {
+			ref:      variants,
+			platform: "linux/arm/v8",
+			expected: "variants linux/arm/v7",
+		},
+		"no compatible variant": {
+			ref:      variants,
+			platform: "linux/arm/v5",
+		},
+		"generic arm": {
+			ref:      generic,
+			platform: "linux/arm/v7",
+			expected: "generic linux/arm",
+		},
+		"different architecture": {
+			ref:      generic,
+			platform: "linux/arm64",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("platform", tc.platform, "")
+			source, err := newImageSource(cli.NewContext(cli.NewApp(), set, nil))
+			if err != nil {
+				t.Fatalf("Failed to create image source: %v", err)
+			}
+			source.registry = testRegistry(t)
+			source.once.Do(func() {})
+
+			img, err := source.Image(context.Background(), tc.ref)
+			if tc.expected == "" {
+				if err == nil {
+					t.Fatalf("Expected no image for platform %s", tc.platform)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to get image: %v", err)
+			}
+			if digest, _ := img.Digest(); digest.String() != digests[tc.expected] {
+				t.Errorf("Expected image for %s but got %s", tc.expected, digest)
+			}
+		})
+	}
+}
+
+func TestImagePlatformFlags(t *testing.T) {
+	testCases := map[string]struct {
+		args     []string
+		expected v1.Platform
+		err      bool
+	}{
+		"platform": {
+			args:     []string{"--platform", "linux/arm/v7"},
+			expected: v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"},
+		},
+		"windows os version": {
+			args:     []string{"--platform", "windows/amd64:10.0.20348.2700"},
+			expected: v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.2700"},
+		},
+		"os version flag overrides platform": {
+			args:     []string{"--platform", "windows/amd64:10.0.17763.6414", "--os-version", "10.0.20348.2700"},
+			expected: v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.2700"},
+		},
+		"os version flag with deprecated flags": {
+			args:     []string{"--os", "windows", "--arch", "amd64", "--os-version", "10.0.20348.2700"},
+			expected: v1.Platform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.2700"},
+		},
+		"deprecated flags": {
+			args:     []string{"--os", "linux", "--arch", "s390x"},
+			expected: v1.Platform{OS: "linux", Architecture: "s390x"},
+		},
+		"defaults": {
+			expected: v1.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH},
+		},
+		"combined": {
+			args: []string{"--platform", "linux/arm/v7", "--arch", "arm"},
+			err:  true,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("platform", "", "")
+			set.String("os-version", "", "")
+			set.String("os", runtime.GOOS, "")
+			set.String("arch", runtime.GOARCH, "")
+			if err := set.Parse(tc.args); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+
+			platform, err := imagePlatform(cli.NewContext(cli.NewApp(), set, nil))
+			if tc.err {
+				if err == nil {
+					t.Fatalf("Expected error but got platform %s", platform)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to get platform: %v", err)
+			}
+			if !reflect.DeepEqual(platform, tc.expected) {
+				t.Errorf("Expected platform %+v but got %+v", tc.expected, platform)
+			}
+		})
+	}
+}
+
+func TestAllPlatformsFlag(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	platforms := []string{"linux/amd64", "linux/arm64", "linux/arm/v7", "windows/amd64:10.0.20348.2700"}
+	images := []v1.Image{}
+	index := v1.ImageIndex(empty.Index)
+	for _, platform := range platforms {
+		p, _ := v1.ParsePlatform(platform)
+		img, err := random.Image(512, 2)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		images = append(images, img)
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: p}})
+	}
+	ref, _ := name.ParseReference(u.Host + "/test/all-platforms:v1")
+	if err := remote.WriteIndex(ref, index); err != nil {
+		t.Fatalf("Failed to push index: %v", err)
+	}
+
+	dir := t.TempDir()
+	output := &bytes.Buffer{}
+	newContext := func(args ...string) *cli.Context {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.Bool("all-platforms", true, "")
+		set.String("private-registry", filepath.Join(dir, "registries.yaml"), "")
+		set.String("cache-dir", filepath.Join(dir, "cache"), "")
+		set.String("platform", "linux/amd64", "")
+		if err := set.Parse(args); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		app := cli.NewApp()
+		app.Writer = output
+		return cli.NewContext(app, set, nil)
+	}
+
+	if err := run(context.Background(), newContext(ref.Name(), filepath.Join(dir, "extract"))); err == nil {
+		t.Errorf("Expected extraction with --all-platforms to be rejected")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "extract")); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing to be extracted: %v", err)
+	}
+
+	if err := pull(context.Background(), newContext(ref.Name())); err != nil {
+		t.Fatalf("Failed to pull image: %v", err)
+	}
+	for _, img := range images {
+		assertCached(t, filepath.Join(dir, "cache"), img)
+	}
+	digest, _ := index.Digest()
+	if expected := ref.Context().Digest(digest.String()).Name() + "\n"; output.String() != expected {
+		t.Errorf("Expected output %q but got %q", expected, output.String())
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/rancher/wharfie/pkg/events"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+var (
+	// progressRenderInterval is the interval between redraws of the progress bars on a terminal.
+	progressRenderInterval = 200 * time.Millisecond
+	// progressLogInterval is the interval between progress log lines when not writing to a terminal.
+	progressLogInterval = 5 * time.Second
+)
+
+// progressBarWidth is the number of characters between the brackets of a progress bar.
+const progressBarWidth = 30
+
+// layerProgress is the latest progress of a layer being read.
+type layerProgress struct {
+	events.Layer
+	// Done is set once the layer has been closed.
+	Done bool
+}
+
+// progressDisplay shows the progress of layer downloads, from the layer events that it handles. When both stdout and
+// the log output are terminals, each layer being read is shown as a progress bar alongside the log output, redrawn
+// in place, and log lines written while the bars are shown are printed above them; stdout is left for the result of
+// the command. Otherwise, the percentage downloaded of each layer is logged periodically.
+type progressDisplay struct {
+	stop chan struct{}
+	done chan struct{}
+
+	mu     sync.Mutex
+	tty    bool
+	log    io.Writer
+	layers []v1.Hash
+	state  map[v1.Hash]layerProgress
+	dirty  bool
+	lines  int
+}
+
+var _ events.Handler = &progressDisplay{}
+
+// newProgressDisplay starts displaying the progress of the layers whose events it handles. Progress bars are drawn if
+// stdout and the log output are terminals, in which case log output is routed through the display.
+func newProgressDisplay(stdout io.Writer) *progressDisplay {
+	d := &progressDisplay{
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		log:   logrus.StandardLogger().Out,
+		state: map[v1.Hash]layerProgress{},
+	}
+	if isTerminal(stdout) && isTerminal(d.log) {
+		d.tty = true
+		logrus.SetOutput(&progressLogWriter{d})
+	}
+	go d.run()
+	return d
+}
+
+// Close stops the display, once the progress handled so far has been drawn or logged. Layer readers may still be
+// closed after the display has stopped, such as when extraction is aborted; their events are recorded, but not shown.
+func (d *progressDisplay) Close() {
+	close(d.stop)
+	<-d.done
+	if d.tty {
+		logrus.SetOutput(d.log)
+	}
+}
+
+func (d *progressDisplay) run() {
+	defer close(d.done)
+	interval := progressLogInterval
+	if d.tty {
+		interval = progressRenderInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			d.flush()
+			return
+		case <-ticker.C:
+			d.flush()
+		}
+	}
+}
+
+// Handle records the progress of the layer that a layer event is for; other events are ignored.
+func (d *progressDisplay) Handle(event events.Event) {
+	switch e := event.(type) {
+	case events.LayerPullStarted:
+		d.apply(layerProgress{Layer: e.Layer})
+	case events.LayerPullProgress:
+		d.apply(layerProgress{Layer: e.Layer})
+	case events.LayerPullFinished:
+		d.apply(layerProgress{Layer: e.Layer, Done: true})
+	}
+}
+
+// apply records the latest progress of the layer.
+func (d *progressDisplay) apply(update layerProgress) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.state[update.Digest]; !ok {
+		d.layers = append(d.layers, update.Digest)
+	}
+	d.state[update.Digest] = update
+	d.dirty = true
+}
+
+// flush redraws the progress bars, or logs the progress of layers that are still being downloaded.
+func (d *progressDisplay) flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.dirty {
+		return
+	}
+	d.dirty = false
+
+	if !d.tty {
+		for _, layer := range d.layers {
+			update := d.state[layer]
+			if !update.Done && !update.Cached && update.Size > 0 {
+				logrus.WithField("layer", layer.String()).Infof("Downloading layer: %d%% (%s of %s)",
+					update.Complete*100/update.Size, formatSize(update.Complete), formatSize(update.Size))
+			}
+		}
+		d.forgetDone()
+		return
+	}
+
+	d.erase()
+	d.draw()
+	// once all layers are done, the bars are left on the screen, and later layers are drawn below them
+	if d.forgetDone() {
+		d.lines = 0
+	}
+}
+
+// forgetDone forgets the layers if all of them are done, and returns true if it did.
+func (d *progressDisplay) forgetDone() bool {
+	for _, layer := range d.layers {
+		if !d.state[layer].Done {
+			return false
+		}
+	}
+	d.layers = nil
+	d.state = map[v1.Hash]layerProgress{}
+	return true
+}
+
+// erase clears the progress bars from the terminal, leaving the cursor where they started.
+func (d *progressDisplay) erase() {
+	if d.lines > 0 {
+		fmt.Fprintf(d.log, "\x1b[%dA\x1b[J", d.lines)
+		d.lines = 0
+	}
+}
+
+// draw writes a progress bar for each layer.
+func (d *progressDisplay) draw() {
+	for _, layer := range d.layers {
+		fmt.Fprintln(d.log, progressLine(d.state[layer]))
+	}
+	d.lines = len(d.layers)
+}
+
+// progressLine formats the progress of a layer as a single line.
+func progressLine(update layerProgress) string {
+	id := update.Digest.Hex
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	switch {
+	case update.Cached:
+		status := "Reading from cache"
+		if update.Done {
+			status = "Read from cache"
+		}
+		return fmt.Sprintf("%s %s %s", id, status, formatSize(update.Complete))
+	case update.Size > 0:
+		filled := int(update.Complete * progressBarWidth / update.Size)
+		if filled > progressBarWidth {
+			filled = progressBarWidth
+		}
+		bar := strings.Repeat("=", filled)
+		if filled < progressBarWidth {
+			bar += ">" + strings.Repeat(" ", progressBarWidth-filled-1)
+		}
+		return fmt.Sprintf("%s [%s] %s / %s", id, bar, formatSize(update.Complete), formatSize(update.Size))
+	default:
+		return fmt.Sprintf("%s %s", id, formatSize(update.Complete))
+	}
+}
+
+// progressLogWriter writes log output above the progress bars, and redraws them below it.
+type progressLogWriter struct {
+	d *progressDisplay
+}
+
+func (w *progressLogWriter) Write(p []byte) (int, error) {
+	w.d.mu.Lock()
+	defer w.d.mu.Unlock()
+	w.d.erase()
+	n, err := w.d.log.Write(p)
+	w.d.draw()
+	return n, err
+}
+
+// isTerminal returns true if the writer is a terminal.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/rancher/wharfie/pkg/events"
+	"github.com/sirupsen/logrus"
+)
+
+func TestProgressDisplay(t *testing.T) {
+	layer := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("ab", 32)}
+	cached := v1.Hash{Algorithm: "sha256", Hex: strings.Repeat("cd", 32)}
+
+	lineTests := []struct {
+		update   layerProgress
+		expected string
+	}{
+		{layerProgress{Layer: events.Layer{Digest: layer, Size: 2048}}, "abababababab [>                             ] 0 B / 2.0 KiB"},
+		{layerProgress{Layer: events.Layer{Digest: layer, Complete: 1024, Size: 2048}}, "abababababab [===============>              ] 1.0 KiB / 2.0 KiB"},
+		{layerProgress{Layer: events.Layer{Digest: layer, Complete: 2048, Size: 2048}, Done: true}, "abababababab [==============================] 2.0 KiB / 2.0 KiB"},
+		{layerProgress{Layer: events.Layer{Digest: cached, Complete: 512, Cached: true}}, "cdcdcdcdcdcd Reading from cache 512 B"},
+		{layerProgress{Layer: events.Layer{Digest: cached, Complete: 4096, Cached: true}, Done: true}, "cdcdcdcdcdcd Read from cache 4.0 KiB"},
+	}
+	for _, tt := range lineTests {
+		if line := progressLine(tt.update); line != tt.expected {
+			t.Errorf("Expected progress line %q but got %q", tt.expected, line)
+		}
+	}
+
+	// progress is logged when not writing to a terminal
+	defer func(interval time.Duration) { progressLogInterval = interval }(progressLogInterval)
+	progressLogInterval = 10 * time.Millisecond
+	output := &bytes.Buffer{}
+	logrus.SetOutput(output)
+	defer logrus.SetOutput(os.Stderr)
+
+	stdout := &bytes.Buffer{}
+	display := newProgressDisplay(stdout)
+	display.Handle(events.LayerPullProgress{Layer: events.Layer{Digest: layer, Complete: 512, Size: 2048}})
+	display.Handle(events.LayerPullProgress{Layer: events.Layer{Digest: cached, Complete: 512, Cached: true}})
+	time.Sleep(50 * time.Millisecond)
+	display.Handle(events.LayerPullFinished{Layer: events.Layer{Digest: layer, Complete: 2048, Size: 2048}})
+	display.Handle(events.LayerPullFinished{Layer: events.Layer{Digest: cached, Complete: 4096, Cached: true}})
+	// events that are not about layers are ignored
+	display.Handle(events.Done{Image: "busybox"})
+	display.Close()
+
+	if !strings.Contains(output.String(), "Downloading layer: 25% (512 B of 2.0 KiB)") {
+		t.Errorf("Expected download progress to be logged:\n%s", output)
+	}
+	if strings.Contains(output.String(), cached.String()) {
+		t.Errorf("Expected progress of cached layers not to be logged:\n%s", output)
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("Expected no progress bars when not writing to a terminal, but got:\n%s", stdout)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// pull reads the layers of each image into the layer cache, and prints the digest reference of each image.
+func pull(ctx context.Context, clx *cli.Context) error {
+	if len(clx.Args()) < 1 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <image> is a required argument.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "pull", 1)
+	}
+
+	options, err := referenceOptions(clx)
+	if err != nil {
+		return err
+	}
+	refs, err := parseImages(clx.Args(), options)
+	if err != nil {
+		return err
+	}
+
+	source, err := newImageSource(clx, refs...)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	source.useCache = true
+	if platform := clx.String("platform"); platform != "" {
+		p, err := v1.ParsePlatform(platform)
+		if err != nil {
+			return errors.Wrapf(err, "invalid platform %q", platform)
+		}
+		source.platform = withOSVersion(clx, *p)
+	}
+	pullImage := func(ctx context.Context, ref name.Reference, w io.Writer) error {
+		digest, err := source.Pull(ctx, ref, allPlatforms(clx))
+		if err != nil {
+			return err
+		}
+		if quiet(clx) {
+			_, err = fmt.Fprintln(w, digest)
+			return err
+		}
+		_, err = fmt.Fprintln(w, ref.Context().Digest(digest.String()).Name())
+		return err
+	}
+	if len(refs) == 1 {
+		return pullImage(ctx, refs[0], clx.App.Writer)
+	}
+	return eachImage(ctx, clx, refs, "pull", "Pulled", pullImage)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/rancher/wharfie/pkg/layercache"
+	"github.com/urfave/cli"
+)
+
+func TestPull(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	platforms := []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64"}}
+	images := map[string]v1.Image{}
+	index := v1.ImageIndex(empty.Index)
+	for _, platform := range platforms {
+		img, err := random.Image(1024, 2)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		images[platform.Architecture] = img
+		platform := platform
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &platform}})
+	}
+	ref, err := name.ParseReference(u.Host + "/test/pull:latest")
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+	if err := remote.WriteIndex(ref, index); err != nil {
+		t.Fatalf("Failed to push index: %v", err)
+	}
+	indexDigest, _ := index.Digest()
+
+	testCases := map[string]struct {
+		platform     v1.Platform
+		allPlatforms bool
+		expected     v1.Hash
+		cached       []string
+		uncached     []string
+	}{
+		"single platform": {
+			platform: platforms[1],
+			expected: func() v1.Hash { h, _ := images["arm64"].Digest(); return h }(),
+			cached:   []string{"arm64"},
+			uncached: []string{"amd64"},
+		},
+		"all platforms": {
+			platform:     platforms[1],
+			allPlatforms: true,
+			expected:     indexDigest,
+			cached:       []string{"amd64", "arm64"},
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			dir := t.TempDir()
+			source := &imageSource{
+				clx:      cli.NewContext(cli.NewApp(), flag.NewFlagSet("test", flag.ContinueOnError), nil),
+				platform: tc.platform,
+				registry: testRegistry(t),
+				cache:    cache.NewFilesystemCache(dir),
+			}
+			source.once.Do(func() {})
+
+			digest, err := source.Pull(context.Background(), ref, tc.allPlatforms)
+			if err != nil {
+				t.Fatalf("Failed to pull image: %v", err)
+			}
+			if digest != tc.expected {
+				t.Errorf("Expected digest %s but got %s", tc.expected, digest)
+			}
+			for _, arch := range tc.cached {
+				assertCached(t, dir, images[arch])
+			}
+			for _, arch := range tc.uncached {
+				layers, _ := images[arch].Layers()
+				for _, layer := range layers {
+					diffID, _ := layer.DiffID()
+					if _, err := os.Stat(cachedFile(dir, diffID)); !os.IsNotExist(err) {
+						t.Errorf("Expected layer %s for %s not to be cached: %v", diffID, arch, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentPull(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(256*1024, 4)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, err := name.ParseReference(u.Host + "/test/concurrent:latest")
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+
+	// each pull has its own image source and cache, as separate wharfie processes sharing a cache directory would
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			source := &imageSource{
+				clx:      cli.NewContext(cli.NewApp(), flag.NewFlagSet("test", flag.ContinueOnError), nil),
+				registry: testRegistry(t),
+				cache:    layercache.NewFilesystemCache(dir),
+			}
+			source.once.Do(func() {})
+			_, err := source.Pull(context.Background(), ref, false)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to pull image: %v", err)
+		}
+	}
+
+	// every layer is cached, and is complete
+	assertCached(t, dir, img)
+	layers, _ := img.Layers()
+	for _, layer := range layers {
+		diffID, _ := layer.DiffID()
+		f, err := os.Open(cachedFile(dir, diffID))
+		if err != nil {
+			t.Fatalf("Failed to open cached layer: %v", err)
+		}
+		h, _, err := v1.SHA256(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Failed to read cached layer: %v", err)
+		}
+		if h != diffID {
+			t.Errorf("Expected cached layer with diff ID %s but got %s", diffID, h)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			t.Errorf("Expected temporary file %s to be removed", entry.Name())
+		}
+	}
+}
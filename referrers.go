@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// referrerList describes the referrers of an image, for the referrers command.
+type referrerList struct {
+	Image     string          `json:"image"`
+	Digest    string          `json:"digest"`
+	Referrers []v1.Descriptor `json:"referrers"`
+}
+
+// listReferrers prints the referrers of the image, as listed by the OCI referrers API, or found under the referrers
+// tag or the tags that cosign uses, at the configured registry endpoints. Each is printed with its digest and artifact
+// type, followed by the tag that it was found under, if any.
+func listReferrers(ctx context.Context, clx *cli.Context) error {
+	if len(clx.Args()) < 1 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <image> is a required argument.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "referrers", 1)
+	}
+
+	output := clx.String("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unsupported output format %q; supported formats: text, json", output)
+	}
+	ref, err := parseReference(clx, clx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+
+	source, err := newImageSource(clx, ref)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	digest, ok := ref.(name.Digest)
+	if !ok {
+		hash, err := source.Head(ctx, ref)
+		if err != nil {
+			if registries.IsNotFound(err) {
+				return cli.NewExitError(fmt.Sprintf("image reference %s not found", ref.Name()), exitNotFound)
+			}
+			return err
+		}
+		digest = ref.Context().Digest(hash.String())
+	}
+	referrers, err := source.Referrers(ctx, digest, clx.String("artifact-type"))
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Listed %d referrers of %s", len(referrers), digest.Name())
+
+	if output == "json" {
+		encoder := json.NewEncoder(clx.App.Writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(referrerList{Image: ref.Name(), Digest: digest.DigestStr(), Referrers: referrers})
+	}
+	for _, referrer := range referrers {
+		artifactType := referrer.ArtifactType
+		if artifactType == "" {
+			artifactType = string(referrer.MediaType)
+		}
+		line := referrer.Digest.String() + " " + artifactType
+		if tag := referrer.Annotations[registries.ReferrerTagAnnotation]; tag != "" {
+			line += " " + tag
+		}
+		if _, err := fmt.Fprintln(clx.App.Writer, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// referrer is an image or image index that refers to another, such as a signature or SBOM, as read from the registry.
+type referrer struct {
+	desc  v1.Descriptor
+	image v1.Image
+	index v1.ImageIndex
+}
+
+// getReferrers returns the referrers of the digest, for --include-referrers.
+func getReferrers(ctx context.Context, source *imageSource, ref name.Digest) ([]referrer, error) {
+	descs, err := source.Referrers(ctx, ref, "")
+	if err != nil {
+		return nil, err
+	}
+	referrers := make([]referrer, 0, len(descs))
+	for _, desc := range descs {
+		rdesc, err := source.Get(ctx, ref.Context().Digest(desc.Digest.String()))
+		if err != nil {
+			return nil, err
+		}
+		r := referrer{desc: desc}
+		if rdesc.MediaType.IsIndex() {
+			r.index, err = rdesc.ImageIndex()
+		} else {
+			r.image, err = rdesc.Image()
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read referrer %s of %s", desc.Digest, ref.Name())
+		}
+		referrers = append(referrers, r)
+	}
+	return referrers, nil
+}
+
+// reference returns the reference that the referrer is stored under in the repository: the tag that it was found
+// under, for referrers found under a cosign tag, or else its digest.
+func (r referrer) reference(repo name.Repository) name.Reference {
+	if tag := r.desc.Annotations[registries.ReferrerTagAnnotation]; tag != "" {
+		return repo.Tag(tag)
+	}
+	return repo.Digest(r.desc.Digest.String())
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/urfave/cli"
+)
+
+func TestReferrers(t *testing.T) {
+	srcServer := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0)), registry.WithReferrersSupport(true)))
+	defer srcServer.Close()
+	srcURL, _ := url.Parse(srcServer.URL)
+	push := func(ref string, img v1.Image) v1.Hash {
+		r, _ := name.ParseReference(srcURL.Host + "/" + ref)
+		if err := remote.Write(r, img); err != nil {
+			t.Fatalf("Failed to push image: %v", err)
+		}
+		digest, _ := img.Digest()
+		return digest
+	}
+	newImage := func() v1.Image {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		return mutate.MediaType(img, types.OCIManifestSchema1)
+	}
+
+	// test/app has an SBOM that is listed by the referrers API, and test/signed a signature under its cosign tag
+	app := newImage()
+	appDigest := push("test/app:v1", app)
+	appSize, _ := app.Size()
+	sbom := mutate.ConfigMediaType(newImage(), "application/spdx+json")
+	sbom = mutate.Subject(sbom, v1.Descriptor{MediaType: types.OCIManifestSchema1, Digest: appDigest, Size: appSize}).(v1.Image)
+	sbomDigest := push("test/app:sbom", sbom)
+	signedDigest := push("test/signed:v1", newImage())
+	signatureTag := fmt.Sprintf("sha256-%s.sig", signedDigest.Hex)
+	signatureDigest := push("test/signed:"+signatureTag, newImage())
+
+	dir := t.TempDir()
+	config := filepath.Join(dir, "registries.yaml")
+	mirror := fmt.Sprintf("mirrors:\n  registry.example.com:\n    endpoint:\n      - %s\n", srcServer.URL)
+	if err := os.WriteFile(config, []byte(mirror), 0644); err != nil {
+		t.Fatalf("Failed to write registry config: %v", err)
+	}
+	run := func(t *testing.T, command func(context.Context, *cli.Context) error, flags map[string]string, args ...string) string {
+		t.Helper()
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("private-registry", config, "")
+		set.String("cache-dir", filepath.Join(dir, "cache"), "")
+		set.String("output", "text", "")
+		set.String("artifact-type", "", "")
+		set.Bool("include-referrers", true, "")
+		for key, value := range flags {
+			set.Set(key, value)
+		}
+		if err := set.Parse(args); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		output := &bytes.Buffer{}
+		app := cli.NewApp()
+		app.Writer = output
+		if err := command(context.Background(), cli.NewContext(app, set, nil)); err != nil {
+			t.Fatalf("Failed to run command: %v", err)
+		}
+		return output.String()
+	}
+
+	t.Run("list", func(t *testing.T) {
+		testCases := map[string]struct {
+			image    string
+			flags    map[string]string
+			expected string
+		}{
+			"referrers API": {
+				image:    "registry.example.com/test/app:v1",
+				expected: sbomDigest.String() + " application/spdx+json\n",
+			},
+			"referrers API by digest": {
+				image:    "registry.example.com/test/app@" + appDigest.String(),
+				expected: sbomDigest.String() + " application/spdx+json\n",
+			},
+			"artifact type": {
+				image:    "registry.example.com/test/app:v1",
+				flags:    map[string]string{"artifact-type": "application/spdx+json"},
+				expected: sbomDigest.String() + " application/spdx+json\n",
+			},
+			"cosign tag": {
+				image:    "registry.example.com/test/signed:v1",
+				expected: fmt.Sprintf("%s %s %s\n", signatureDigest, registries.CosignSignatureArtifactType, signatureTag),
+			},
+		}
+		for testName, tc := range testCases {
+			t.Run(testName, func(t *testing.T) {
+				if output := run(t, listReferrers, tc.flags, tc.image); output != tc.expected {
+					t.Errorf("Expected output %q but got %q", tc.expected, output)
+				}
+			})
+		}
+
+		list := referrerList{}
+		output := run(t, listReferrers, map[string]string{"output": "json"}, "registry.example.com/test/signed:v1")
+		if err := json.Unmarshal([]byte(output), &list); err != nil {
+			t.Fatalf("Failed to parse JSON output %q: %v", output, err)
+		}
+		if list.Digest != signedDigest.String() || len(list.Referrers) != 1 || list.Referrers[0].Annotations[registries.ReferrerTagAnnotation] != signatureTag {
+			t.Errorf("Expected signature %s of %s but got %+v", signatureTag, signedDigest, list)
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		// the destination does not support the referrers API, so the SBOM is listed under the referrers tag
+		dstServer := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+		defer dstServer.Close()
+		dstURL, _ := url.Parse(dstServer.URL)
+
+		run(t, copyImage, nil, "registry.example.com/test/app:v1", dstURL.Host+"/test/app:v1")
+		appRef, _ := name.NewDigest(dstURL.Host + "/test/app@" + appDigest.String())
+		index, err := remote.Referrers(appRef)
+		if err != nil {
+			t.Fatalf("Failed to list copied referrers: %v", err)
+		}
+		if manifest, _ := index.IndexManifest(); len(manifest.Manifests) != 1 || manifest.Manifests[0].Digest != sbomDigest {
+			t.Errorf("Expected copied SBOM %s but got %+v", sbomDigest, manifest)
+		}
+
+		run(t, copyImage, nil, "registry.example.com/test/signed:v1", dstURL.Host+"/test/signed:v1")
+		signatureRef, _ := name.NewTag(dstURL.Host + "/test/signed:" + signatureTag)
+		desc, err := remote.Head(signatureRef)
+		if err != nil {
+			t.Fatalf("Failed to get copied signature: %v", err)
+		}
+		if desc.Digest != signatureDigest {
+			t.Errorf("Expected copied signature %s but got %s", signatureDigest, desc.Digest)
+		}
+	})
+
+	t.Run("export", func(t *testing.T) {
+		run(t, pull, nil, "registry.example.com/test/signed:v1")
+		output := filepath.Join(dir, "layout")
+		run(t, exportCache, nil, "registry.example.com/test/signed:v1", output)
+		p, err := layout.FromPath(output)
+		if err != nil {
+			t.Fatalf("Failed to open exported layout: %v", err)
+		}
+		index, err := p.ImageIndex()
+		if err != nil {
+			t.Fatalf("Failed to read exported layout: %v", err)
+		}
+		// the exported image is compressed again, so only the digest of the signature is unchanged
+		manifest, _ := index.IndexManifest()
+		names := []string{}
+		for _, desc := range manifest.Manifests {
+			names = append(names, desc.Annotations[registries.ReferrerTagAnnotation])
+			if desc.Digest != signatureDigest && desc.Annotations[registries.ReferrerTagAnnotation] != "registry.example.com/test/signed:v1" {
+				t.Errorf("Expected exported manifest %s to be the image or its signature %s", desc.Digest, signatureDigest)
+			}
+		}
+		if expected := []string{"registry.example.com/test/signed:v1", "registry.example.com/test/signed:" + signatureTag}; !reflect.DeepEqual(names, expected) {
+			t.Errorf("Expected exported manifests %v but got %v", expected, names)
+		}
+
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("cache-dir", filepath.Join(dir, "cache"), "")
+		set.Bool("include-referrers", true, "")
+		set.Parse([]string{"registry.example.com/test/signed:v1", filepath.Join(dir, "export.tar")})
+		if err := exportCache(context.Background(), cli.NewContext(cli.NewApp(), set, nil)); err == nil || !strings.Contains(err.Error(), "OCI image layout") {
+			t.Errorf("Expected export of referrers to a tarball to fail, but got %v", err)
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// resolve prints the image reference pinned to the digest of the manifest that the configured registry endpoints
+// return for it, or just the digest. If no endpoint has the reference, it exits with exitNotFound.
+func resolve(ctx context.Context, clx *cli.Context) error {
+	if len(clx.Args()) < 1 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <image> is a required argument.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "resolve", 1)
+	}
+
+	// the global --quiet is applied when logging is set up, but resolve has its own
+	if quiet(clx) {
+		logrus.SetLevel(logrus.ErrorLevel)
+	}
+
+	image := clx.Args().Get(0)
+	options, err := referenceOptions(clx)
+	if err != nil {
+		return err
+	}
+	ref, err := name.ParseReference(image, options...)
+	if err != nil {
+		return err
+	}
+	// other tools would resolve unqualified image names against Docker Hub, so they are printed with the default
+	// registry instead
+	if len(options) > 0 {
+		image = ref.Name()
+	}
+
+	source, err := newImageSource(clx, ref)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	digest, err := source.Head(ctx, ref)
+	if err != nil {
+		if registries.IsNotFound(err) {
+			return cli.NewExitError(fmt.Sprintf("image reference %s not found", ref.Name()), exitNotFound)
+		}
+		return err
+	}
+
+	if quiet(clx) {
+		fmt.Fprintln(clx.App.Writer, digest)
+		return nil
+	}
+	// references that are already pinned are printed as-is, once the digest is known to exist
+	if _, ok := ref.(name.Digest); !ok {
+		image += "@" + digest.String()
+	}
+	fmt.Fprintln(clx.App.Writer, image)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+func TestResolve(t *testing.T) {
+	// --quiet suppresses logging for the rest of the process
+	defer logrus.SetLevel(logrus.GetLevel())
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, _ := name.ParseReference(u.Host + "/test/resolve:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	digest, _ := img.Digest()
+
+	// registry.example.com is not resolvable, so images can only be found through the mirror
+	config := filepath.Join(t.TempDir(), "registries.yaml")
+	mirror := fmt.Sprintf("mirrors:\n  registry.example.com:\n    endpoint:\n      - %s\n", server.URL)
+	if err := os.WriteFile(config, []byte(mirror), 0644); err != nil {
+		t.Fatalf("Failed to write registry config: %v", err)
+	}
+
+	testCases := map[string]struct {
+		image    string
+		quiet    bool
+		expected string
+		exitCode int
+	}{
+		"tag through mirror": {
+			image:    "registry.example.com/test/resolve:v1",
+			expected: "registry.example.com/test/resolve:v1@" + digest.String() + "\n",
+		},
+		"quiet": {
+			image:    "registry.example.com/test/resolve:v1",
+			quiet:    true,
+			expected: digest.String() + "\n",
+		},
+		"digest": {
+			image:    u.Host + "/test/resolve@" + digest.String(),
+			expected: u.Host + "/test/resolve@" + digest.String() + "\n",
+		},
+		"missing tag": {
+			image:    u.Host + "/test/resolve:v2",
+			exitCode: exitNotFound,
+		},
+		"missing repository": {
+			image:    u.Host + "/test/missing:v1",
+			exitCode: exitNotFound,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("private-registry", config, "")
+			set.Bool("quiet", tc.quiet, "")
+			if err := set.Parse([]string{tc.image}); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			output := &bytes.Buffer{}
+			app := cli.NewApp()
+			app.Writer = output
+
+			err := resolve(context.Background(), cli.NewContext(app, set, nil))
+			if tc.exitCode != 0 {
+				var exitErr cli.ExitCoder
+				if !errors.As(err, &exitErr) || exitErr.ExitCode() != tc.exitCode {
+					t.Fatalf("Expected exit code %d but got %v", tc.exitCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to resolve image: %v", err)
+			}
+			if output.String() != tc.expected {
+				t.Errorf("Expected output %q but got %q", tc.expected, output.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,1224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/logs"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/credentialprovider"
+	"github.com/rancher/wharfie/pkg/credentialprovider/plugin"
+	"github.com/rancher/wharfie/pkg/events"
+	"github.com/rancher/wharfie/pkg/extract"
+	"github.com/rancher/wharfie/pkg/layercache"
+	"github.com/rancher/wharfie/pkg/policy"
+	"github.com/rancher/wharfie/pkg/puller"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// pullPolicy determines whether images are read from local image tarballs, or pulled from the registry.
+type pullPolicy string
+
+const (
+	// pullIfNotPresent reads images from local image tarballs if they are found there, or else pulls them.
+	pullIfNotPresent pullPolicy = "ifnotpresent"
+	// pullAlways always pulls images, without checking local image tarballs.
+	pullAlways pullPolicy = "always"
+	// pullNever only reads images from local image tarballs, without accessing any registry.
+	pullNever pullPolicy = "never"
+)
+
+// errNotPresent is returned when an image is not found locally, and the pull policy is never.
+var errNotPresent = errors.New("image not found in --images-dir, and --pull-policy is never")
+
+// credentialSources are the sources of credentials that may be given in --credential-order.
+var credentialSources = map[string]bool{
+	"plugins":       true,
+	"docker-config": true,
+}
+
+// stdinRegistryConfig is the app metadata key that private registry configuration read from stdin is kept under.
+const stdinRegistryConfig = "stdin-registry-config"
+
+// imageSource loads images from local image tarballs, or from the registry. The registry configuration, credential
+// provider plugins, and layer cache are set up when first needed, and shared by all images loaded from the source.
+// Flags are looked up globally, so that this can be used by subcommands.
+type imageSource struct {
+	clx        *cli.Context
+	targets    []name.Reference
+	platform   v1.Platform
+	useCache   bool
+	retries    int
+	retryDelay time.Duration
+	pullPolicy pullPolicy
+	// imagePolicy is the --image-policy, or nil if none was given.
+	imagePolicy *policy.Policy
+	// registrySource is the --private-registry file, or where registryConfig was given if it is not nil.
+	registrySource string
+	registryConfig []byte
+	refOptions     []name.Option
+	remoteOptions  []remote.Option
+	tls            *registries.TLSConfig
+	auth           *registries.AuthConfig
+	authFile       *configfile.ConfigFile
+	envAuth        *registries.AuthConfig
+	// sources are the credential sources that registries fall back to, in the order that they are tried.
+	sources   []credentialSource
+	once      sync.Once
+	registry  imageRegistry
+	cache     cache.Cache
+	cacheDir  string
+	cacheLock *layercache.Lock
+	display   *progressDisplay
+	err       error
+}
+
+// credentialSource is a keychain that registry credentials are looked up in, with a name to identify it.
+type credentialSource struct {
+	name     string
+	keychain authn.Keychain
+}
+
+// imageRegistry pulls images from, and pushes images to, a remote registry.
+type imageRegistry interface {
+	Get(ref name.Reference, options ...remote.Option) (*remote.Descriptor, error)
+	GetEndpoint(ref name.Reference, options ...remote.Option) (*remote.Descriptor, string, error)
+	Head(ref name.Reference, options ...remote.Option) (*v1.Descriptor, error)
+	HeadEndpoint(ref name.Reference, options ...remote.Option) (*v1.Descriptor, string, error)
+	Endpoints(ref name.Reference) ([]registries.EndpointInfo, error)
+	CheckEndpoints(ctx context.Context, ref name.Reference) ([]registries.EndpointStatus, error)
+	ListTags(repo name.Repository, options ...remote.Option) ([]string, string, error)
+	Referrers(ref name.Digest, artifactType string, options ...remote.Option) ([]v1.Descriptor, error)
+	Write(ref name.Reference, img v1.Image, options ...remote.Option) error
+	WriteIndex(ref name.Reference, index v1.ImageIndex, options ...remote.Option) error
+	BlobExists(ctx context.Context, repo name.Repository, digest v1.Hash) (bool, error)
+	Ping(ctx context.Context, reg name.Registry, auth authn.Authenticator) (string, error)
+}
+
+// tracedRegistry is a registry that records the timings of its requests, for --trace-requests.
+type tracedRegistry interface {
+	RequestStats() []registries.RequestStats
+}
+
+// countingCache is a layer cache that counts its hits and misses.
+type countingCache interface {
+	Stats() layercache.Stats
+}
+
+// instrumentedKeychain is a credential source that records statistics of its lookups, such as the image credential
+// provider plugins.
+type instrumentedKeychain interface {
+	Stats() plugin.Stats
+}
+
+// newImageSource returns an image source for the target images, whose registries the --insecure-skip-verify,
+// --plain-http, TLS, and credential flags apply to.
+func newImageSource(clx *cli.Context, targets ...name.Reference) (*imageSource, error) {
+	platform, err := imagePlatform(clx)
+	if err != nil {
+		return nil, err
+	}
+	retries := clx.GlobalInt("retries")
+	if retries < 0 {
+		return nil, fmt.Errorf("invalid retries %d: must not be negative", retries)
+	}
+	retryDelay := clx.GlobalDuration("retry-delay")
+	if retryDelay < 0 {
+		return nil, fmt.Errorf("invalid retry delay %s: must not be negative", retryDelay)
+	}
+	imagePolicy, err := loadImagePolicy(clx)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := parsePullPolicy(clx.GlobalString("pull-policy"))
+	if err != nil {
+		return nil, err
+	}
+	registrySource, registryConfig, err := registryConfig(clx)
+	if err != nil {
+		return nil, err
+	}
+	refOptions, err := referenceOptions(clx)
+	if err != nil {
+		return nil, err
+	}
+	remoteOptions, err := flagRemoteOptions(clx)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsFiles(clx)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := credentials(clx)
+	if err != nil {
+		return nil, err
+	}
+	authFile, err := loadAuthFile(clx)
+	if err != nil {
+		return nil, err
+	}
+	envAuth, err := envCredentials()
+	if err != nil {
+		return nil, err
+	}
+	var display *progressDisplay
+	if !quiet(clx) {
+		display = newProgressDisplay(clx.App.Writer)
+	}
+	return &imageSource{
+		clx:            clx,
+		targets:        targets,
+		platform:       platform,
+		useCache:       clx.GlobalBool("cache"),
+		retries:        retries,
+		retryDelay:     retryDelay,
+		pullPolicy:     policy,
+		imagePolicy:    imagePolicy,
+		registrySource: registrySource,
+		registryConfig: registryConfig,
+		refOptions:     refOptions,
+		remoteOptions:  remoteOptions,
+		tls:            tlsConfig,
+		auth:           auth,
+		authFile:       authFile,
+		envAuth:        envAuth,
+		display:        display,
+	}, nil
+}
+
+// parsePullPolicy returns the pull policy for the value of the --pull-policy flag. Case and hyphens are ignored, so
+// that IfNotPresent and if-not-present are also accepted. An empty value is the default policy.
+func parsePullPolicy(value string) (pullPolicy, error) {
+	switch policy := pullPolicy(strings.ToLower(strings.ReplaceAll(value, "-", ""))); policy {
+	case "":
+		return pullIfNotPresent, nil
+	case pullIfNotPresent, pullAlways, pullNever:
+		return policy, nil
+	}
+	return "", fmt.Errorf("invalid pull policy %q: must be one of %s, %s, or %s", value, pullIfNotPresent, pullAlways, pullNever)
+}
+
+// loadImagePolicy returns the image policy given by --image-policy, or nil if none was given.
+func loadImagePolicy(clx *cli.Context) (*policy.Policy, error) {
+	if !clx.GlobalIsSet("image-policy") {
+		return nil, nil
+	}
+	return policy.Load(clx.GlobalString("image-policy"))
+}
+
+// registryConfig returns the private registry configuration given by --registry-config-json, or read from stdin if
+// --private-registry is -, along with where it was given for log messages. Otherwise, the configuration is nil, and
+// the --private-registry file is returned. Stdin can only be read once, so reading the configuration from stdin
+// cannot be combined with reading image references or a password from stdin.
+func registryConfig(clx *cli.Context) (string, []byte, error) {
+	privateRegistry := clx.GlobalString("private-registry")
+	if clx.GlobalIsSet("registry-config-json") {
+		if clx.GlobalIsSet("private-registry") {
+			return "", nil, errors.New("--registry-config-json cannot be combined with --private-registry")
+		}
+		return "--registry-config-json", []byte(clx.GlobalString("registry-config-json")), nil
+	}
+	if privateRegistry != "-" {
+		return privateRegistry, nil, nil
+	}
+	if clx.GlobalBool("password-stdin") {
+		return "", nil, errors.New("--private-registry - cannot be combined with --password-stdin")
+	}
+	for _, arg := range clx.Args() {
+		if arg == "-" {
+			return "", nil, errors.New("--private-registry - cannot be combined with reading image references from stdin")
+		}
+	}
+	// stdin can only be read once, but the configuration is needed to parse image references as well as to pull them
+	if b, ok := clx.App.Metadata[stdinRegistryConfig].([]byte); ok {
+		return "stdin", b, nil
+	}
+	b, err := io.ReadAll(stdin)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to read private registry configuration from stdin")
+	}
+	if clx.App.Metadata == nil {
+		clx.App.Metadata = map[string]interface{}{}
+	}
+	clx.App.Metadata[stdinRegistryConfig] = b
+	return "stdin", b, nil
+}
+
+// referenceOptions returns the options that image references are parsed with, so that unqualified image names refer
+// to the registry given by --default-registry, or by defaultRegistry in the private registry configuration, instead of
+// Docker Hub. Fully qualified image references are unaffected.
+func referenceOptions(clx *cli.Context) ([]name.Option, error) {
+	defaultRegistry := clx.GlobalString("default-registry")
+	if defaultRegistry == "" {
+		source, b, err := registryConfig(clx)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil {
+			if b, err = os.ReadFile(source); err != nil && !os.IsNotExist(err) {
+				return nil, errors.Wrapf(err, "failed to load private registry configuration from %s", source)
+			}
+		}
+		registry, err := registries.GetPrivateRegistriesFromReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load private registry configuration from %s", source)
+		}
+		defaultRegistry = registry.Registry.DefaultRegistry
+	}
+	if defaultRegistry == "" {
+		return nil, nil
+	}
+	if _, err := name.NewRegistry(defaultRegistry); err != nil {
+		return nil, errors.Wrapf(err, "invalid default registry %q", defaultRegistry)
+	}
+	return []name.Option{name.WithDefaultRegistry(defaultRegistry)}, nil
+}
+
+// parseReference parses an image reference with the options returned by referenceOptions.
+func parseReference(clx *cli.Context, image string) (name.Reference, error) {
+	options, err := referenceOptions(clx)
+	if err != nil {
+		return nil, err
+	}
+	return name.ParseReference(image, options...)
+}
+
+// registryAuth returns the credentials for the registry, and where they were given, or nil if there are none.
+// Credentials given by flags take precedence over those given for the registry by its WHARFIE_AUTH_<HOST>
+// environment variable, which take precedence over those given for all registries by environment variables.
+func (s *imageSource) registryAuth(registry string) (*registries.AuthConfig, string, error) {
+	if s.auth != nil {
+		return s.auth, "--username", nil
+	}
+	if s.authFile != nil {
+		auth, err := s.authFile.GetAuthConfig(authKey(registry))
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "failed to get credentials for registry %s from auth file", registry)
+		}
+		if auth.Username != "" || auth.Password != "" || auth.Auth != "" || auth.IdentityToken != "" || auth.RegistryToken != "" {
+			return &registries.AuthConfig{
+				Username:      auth.Username,
+				Password:      auth.Password,
+				Auth:          auth.Auth,
+				IdentityToken: auth.IdentityToken,
+				RegistryToken: auth.RegistryToken,
+			}, "--auth-file", nil
+		}
+	}
+	auth, key, err := registryEnvCredentials(registry)
+	if auth != nil || err != nil {
+		return auth, key, err
+	}
+	if s.envAuth != nil {
+		if s.envAuth.RegistryToken != "" {
+			return s.envAuth, "WHARFIE_REGISTRY_TOKEN", nil
+		}
+		return s.envAuth, "WHARFIE_USERNAME", nil
+	}
+	return nil, "", nil
+}
+
+// flagRemoteOptions returns the options for requests to the registry that are given by flags, such as --concurrency.
+// They are added after wharfie's own options for each request, so that they take precedence. The platform is not
+// included: images are selected from image indexes by wharfie for the platform given by --platform and --os-version.
+func flagRemoteOptions(clx *cli.Context) ([]remote.Option, error) {
+	options := []remote.Option{}
+	if clx.GlobalIsSet("concurrency") {
+		concurrency := clx.GlobalInt("concurrency")
+		if concurrency < 1 {
+			return nil, fmt.Errorf("invalid concurrency %d: must be at least 1", concurrency)
+		}
+		options = append(options, remote.WithJobs(concurrency))
+	}
+	return options, nil
+}
+
+// Image returns the image for the reference, from a local image tarball if one is found in the images
+// directory, or else from the registry. If layers were selected, only the selected layers are included.
+func (s *imageSource) Image(ctx context.Context, ref name.Reference) (v1.Image, error) {
+	img, _, err := s.ImageInfo(ctx, ref)
+	return img, err
+}
+
+// ImageInfo returns the image for the reference as Image does, and describes where it was found, and the layers that
+// were selected.
+func (s *imageSource) ImageInfo(ctx context.Context, ref name.Reference) (v1.Image, puller.PullInfo, error) {
+	if err := s.checkPolicy(ref); err != nil {
+		return nil, puller.PullInfo{}, err
+	}
+	img, path, err := s.localImage(ctx, ref)
+	if err != nil {
+		return nil, puller.PullInfo{}, err
+	}
+
+	info := puller.PullInfo{Source: puller.SourceTarball, Path: path}
+	if img != nil {
+		if info.Digest, err = img.Digest(); err != nil {
+			return nil, puller.PullInfo{}, err
+		}
+		if err := s.verifySignatures(ctx, ref, info.Digest); err != nil {
+			return nil, puller.PullInfo{}, err
+		}
+	} else {
+		if s.pullPolicy == pullNever {
+			return nil, puller.PullInfo{}, errors.Wrap(errNotPresent, ref.Name())
+		}
+		s.once.Do(s.init)
+		if s.err != nil {
+			return nil, puller.PullInfo{}, s.err
+		}
+
+		logrus.WithField("image", ref.Name()).Info("Pulling image")
+		setPhase(ctx, "pulling image %s", ref.Name())
+		err := s.retry(ctx, ref.Name(), func() (err error) {
+			_, img, info, err = s.getImage(ctx, ref)
+			return err
+		})
+		if err != nil {
+			return nil, puller.PullInfo{}, err
+		}
+		if err := s.verifySignatures(ctx, ref, info.Digest); err != nil {
+			return nil, puller.PullInfo{}, err
+		}
+
+		img = s.trackProgress(ref, img)
+		if s.cache != nil {
+			img = cache.Image(img, events.Cache(s.cache, ref.Name(), s.eventHandler()))
+		}
+	}
+
+	if specs := s.clx.GlobalStringSlice("layers"); len(specs) > 0 {
+		selector, err := layerSelector(img, specs)
+		if err != nil {
+			return nil, puller.PullInfo{}, err
+		}
+		if img, err = extract.SelectLayers(img, selector); err != nil {
+			return nil, puller.PullInfo{}, err
+		}
+	}
+
+	if err := info.SetManifest(img); err != nil {
+		return nil, puller.PullInfo{}, err
+	}
+	return img, info, nil
+}
+
+// Pull reads the layers of the image from the registry into the layer cache, so that later extractions do not need
+// to fetch them, and returns the digest of the image. If allPlatforms is set and the reference is an image index,
+// the images for all platforms in the index are pulled, and the digest of the index is returned. Images found in
+// a local image tarball are already available, and are not cached.
+func (s *imageSource) Pull(ctx context.Context, ref name.Reference, allPlatforms bool) (v1.Hash, error) {
+	if err := s.checkPolicy(ref); err != nil {
+		return v1.Hash{}, err
+	}
+	img, _, err := s.localImage(ctx, ref)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	if img != nil {
+		logrus.WithField("image", ref.Name()).Info("Image found in local image tarball, not caching")
+		digest, err := img.Digest()
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		return digest, s.verifySignatures(ctx, ref, digest)
+	}
+	if s.pullPolicy == pullNever {
+		return v1.Hash{}, errors.Wrap(errNotPresent, ref.Name())
+	}
+
+	s.once.Do(s.init)
+	if s.err != nil {
+		return v1.Hash{}, s.err
+	}
+	if s.cache == nil {
+		return v1.Hash{}, errors.New("layer cache is not enabled")
+	}
+
+	// layers cached by a failed attempt are not pulled again when retrying
+	var digest v1.Hash
+	err = s.retry(ctx, ref.Name(), func() (err error) {
+		logrus.WithField("image", ref.Name()).Info("Pulling image")
+		digest, err = s.pull(ctx, ref, allPlatforms)
+		return err
+	})
+	return digest, err
+}
+
+// pull reads the layers of the image, or of all images in the image index, from the registry into the layer cache,
+// and returns the digest of the image or image index.
+func (s *imageSource) pull(ctx context.Context, ref name.Reference, allPlatforms bool) (v1.Hash, error) {
+	setPhase(ctx, "pulling image %s", ref.Name())
+	if !allPlatforms {
+		_, img, info, err := s.getImage(ctx, ref)
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		if err := s.verifySignatures(ctx, ref, info.Digest); err != nil {
+			return v1.Hash{}, err
+		}
+		setPhase(ctx, "caching layers of image %s", ref.Name())
+		if err := cacheLayers(s.trackProgress(ref, img), s.cache); err != nil {
+			return v1.Hash{}, errors.Wrapf(err, "failed to pull image reference %s", ref.Name())
+		}
+		if err := s.putImage(ref, img); err != nil {
+			return v1.Hash{}, err
+		}
+		return img.Digest()
+	}
+
+	desc, err := s.registry.Get(ref, s.requestOptions(ctx)...)
+	if err != nil {
+		return v1.Hash{}, errors.Wrapf(err, "failed to get image reference %s", ref.Name())
+	}
+	if err := s.verifySignatures(ctx, ref, desc.Digest); err != nil {
+		return v1.Hash{}, err
+	}
+	images := []v1.Image{}
+	if desc.MediaType.IsIndex() {
+		index, err := desc.ImageIndex()
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		if images, err = indexImages(index); err != nil {
+			return v1.Hash{}, err
+		}
+	} else {
+		img, err := desc.Image()
+		if err != nil {
+			return v1.Hash{}, err
+		}
+		images = append(images, img)
+	}
+	for _, img := range images {
+		setPhase(ctx, "caching layers of image %s", ref.Name())
+		if err := cacheLayers(s.trackProgress(ref, img), s.cache); err != nil {
+			return v1.Hash{}, errors.Wrapf(err, "failed to pull image reference %s", ref.Name())
+		}
+		// the images of an index are only exported by digest
+		if err := s.putImage(nil, img); err != nil {
+			return v1.Hash{}, err
+		}
+	}
+	return desc.Digest, nil
+}
+
+// putImage stores the manifest and config of the image in the layer cache, so that it can be exported, if the cache
+// is a wharfie layer cache directory.
+func (s *imageSource) putImage(ref name.Reference, img v1.Image) error {
+	if s.cacheDir == "" {
+		return nil
+	}
+	return layercache.PutImage(s.cacheDir, ref, img)
+}
+
+// Resolve returns the image for the reference, and the image index that it was selected from if the reference is
+// an image index, from a local image tarball if one is found in the images directory, or else from the registry.
+// Layer selection and the layer cache are not applied.
+func (s *imageSource) Resolve(ctx context.Context, ref name.Reference) (v1.ImageIndex, v1.Image, error) {
+	if err := s.checkPolicy(ref); err != nil {
+		return nil, nil, err
+	}
+	img, _, err := s.localImage(ctx, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	if img != nil {
+		digest, err := img.Digest()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := s.verifySignatures(ctx, ref, digest); err != nil {
+			return nil, nil, err
+		}
+		return nil, img, nil
+	}
+	if s.pullPolicy == pullNever {
+		return nil, nil, errors.Wrap(errNotPresent, ref.Name())
+	}
+
+	s.once.Do(s.init)
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+
+	logrus.WithField("image", ref.Name()).Info("Resolving image")
+	setPhase(ctx, "resolving image %s", ref.Name())
+	var index v1.ImageIndex
+	var info puller.PullInfo
+	err = s.retry(ctx, ref.Name(), func() (err error) {
+		index, img, info, err = s.getImage(ctx, ref)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.verifySignatures(ctx, ref, info.Digest); err != nil {
+		return nil, nil, err
+	}
+	return index, img, nil
+}
+
+// getImage returns the image for the reference from the registry, the image index that it was selected from if
+// the reference is an image index, and the endpoint and digest that it was pulled from. The image that best matches
+// the requested platform is selected from the index, so that a request for a variant that the index does not have
+// can fall back to a compatible image.
+func (s *imageSource) getImage(ctx context.Context, ref name.Reference) (v1.ImageIndex, v1.Image, puller.PullInfo, error) {
+	p, err := s.puller()
+	if err != nil {
+		return nil, nil, puller.PullInfo{}, err
+	}
+	desc, img, endpoint, err := p.RemoteImage(ctx, ref)
+	if err != nil {
+		return nil, nil, puller.PullInfo{}, err
+	}
+	info := puller.PullInfo{Source: puller.SourceRegistry, Endpoint: endpoint, Digest: desc.Digest}
+	if !desc.MediaType.IsIndex() {
+		return nil, img, info, nil
+	}
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, nil, puller.PullInfo{}, err
+	}
+	return index, img, info, nil
+}
+
+// Head returns the digest of the manifest or image index for the reference, as returned by the registry.
+// Local image tarballs are not checked.
+func (s *imageSource) Head(ctx context.Context, ref name.Reference) (v1.Hash, error) {
+	if err := s.checkPolicy(ref); err != nil {
+		return v1.Hash{}, err
+	}
+	s.once.Do(s.init)
+	if s.err != nil {
+		return v1.Hash{}, s.err
+	}
+
+	logrus.WithField("image", ref.Name()).Info("Resolving image")
+	setPhase(ctx, "resolving image %s", ref.Name())
+	var desc *v1.Descriptor
+	err := s.retry(ctx, ref.Name(), func() (err error) {
+		desc, err = s.registry.Head(ref, s.requestOptions(ctx)...)
+		return err
+	})
+	if err != nil {
+		return v1.Hash{}, errors.Wrapf(err, "failed to get image reference %s", ref.Name())
+	}
+	return desc.Digest, nil
+}
+
+// Plan returns the image for the reference, as Image does, and a plan describing where it is loaded from: a local
+// image tarball, or the registry endpoint that has it. Only the manifest of a remote image is read.
+func (s *imageSource) Plan(ctx context.Context, ref name.Reference) (*dryRunPlan, v1.Image, error) {
+	if err := s.checkPolicy(ref); err != nil {
+		return nil, nil, err
+	}
+	plan := &dryRunPlan{Image: ref.Name()}
+	img, _, err := s.localImage(ctx, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	if img != nil {
+		plan.Local = true
+	} else if s.pullPolicy != pullNever {
+		s.once.Do(s.init)
+		if s.err != nil {
+			return nil, nil, s.err
+		}
+
+		logrus.WithField("image", ref.Name()).Info("Resolving image")
+		setPhase(ctx, "resolving image %s", ref.Name())
+		err := s.retry(ctx, ref.Name(), func() (err error) {
+			_, plan.Endpoint, err = s.registry.HeadEndpoint(ref, s.requestOptions(ctx)...)
+			return err
+		})
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to get image reference %s", ref.Name())
+		}
+		endpoints, err := s.registry.Endpoints(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, endpoint := range endpoints {
+			if endpoint.URL == plan.Endpoint {
+				plan.Mirror = endpoint.Mirror
+				if endpoint.Reference.Name() != ref.Name() {
+					plan.Reference = endpoint.Reference.Name()
+				}
+				break
+			}
+		}
+	}
+
+	img, info, err := s.ImageInfo(ctx, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, nil, err
+	}
+	plan.Digest = digest.String()
+	plan.Layers, plan.Size = info.Layers, info.Size
+	return plan, img, nil
+}
+
+// ListTags returns the tags in the repository, and the URL of the registry endpoint that listed them.
+func (s *imageSource) ListTags(ctx context.Context, repo name.Repository) ([]string, string, error) {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return nil, "", s.err
+	}
+
+	setPhase(ctx, "listing tags for %s", repo.Name())
+	var tags []string
+	var endpoint string
+	err := s.retry(ctx, repo.Name(), func() (err error) {
+		tags, endpoint, err = s.registry.ListTags(repo, s.requestOptions(ctx)...)
+		return err
+	})
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to list tags for %s", repo.Name())
+	}
+	return tags, endpoint, nil
+}
+
+// Referrers returns the descriptors of the manifests that refer to the digest, such as signatures and SBOMs, from
+// the registry, optionally only those of the artifact type.
+func (s *imageSource) Referrers(ctx context.Context, ref name.Digest, artifactType string) ([]v1.Descriptor, error) {
+	if err := s.checkPolicy(ref); err != nil {
+		return nil, err
+	}
+	s.once.Do(s.init)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	setPhase(ctx, "listing referrers of %s", ref.Name())
+	var referrers []v1.Descriptor
+	err := s.retry(ctx, ref.Name(), func() (err error) {
+		referrers, err = s.registry.Referrers(ref, artifactType, s.requestOptions(ctx)...)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list referrers of %s", ref.Name())
+	}
+	return referrers, nil
+}
+
+// Get returns the manifest or image index for the reference from the registry, as is, without selecting an image
+// for the platform. Local image tarballs are not checked.
+func (s *imageSource) Get(ctx context.Context, ref name.Reference) (*remote.Descriptor, error) {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	var desc *remote.Descriptor
+	err := s.retry(ctx, ref.Name(), func() (err error) {
+		desc, err = s.registry.Get(ref, s.requestOptions(ctx)...)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get image reference %s", ref.Name())
+	}
+	return desc, nil
+}
+
+// Write pushes the image to the registry.
+func (s *imageSource) Write(ctx context.Context, ref name.Reference, img v1.Image) error {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return s.err
+	}
+
+	setPhase(ctx, "pushing image %s", ref.Name())
+	if err := s.registry.Write(ref, img, s.requestOptions(ctx)...); err != nil {
+		return errors.Wrapf(err, "failed to write image reference %s", ref.Name())
+	}
+	return nil
+}
+
+// WriteIndex pushes the image index, and the images it references, to the registry.
+func (s *imageSource) WriteIndex(ctx context.Context, ref name.Reference, index v1.ImageIndex) error {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return s.err
+	}
+
+	setPhase(ctx, "pushing image index %s", ref.Name())
+	if err := s.registry.WriteIndex(ref, index, s.requestOptions(ctx)...); err != nil {
+		return errors.Wrapf(err, "failed to write image index reference %s", ref.Name())
+	}
+	return nil
+}
+
+// BlobExists returns true if the blob exists in the repository at the registry.
+func (s *imageSource) BlobExists(ctx context.Context, repo name.Repository, digest v1.Hash) (bool, error) {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return false, s.err
+	}
+	return s.registry.BlobExists(ctx, repo, digest)
+}
+
+// Ping checks that the registry accepts the credentials, through the same endpoints and TLS configuration that
+// images are pulled from it with, and returns the URL of the endpoint that accepted them.
+func (s *imageSource) Ping(ctx context.Context, reg name.Registry, auth authn.Authenticator) (string, error) {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return "", s.err
+	}
+
+	setPhase(ctx, "logging in to %s", reg.RegistryStr())
+	var endpoint string
+	err := s.retry(ctx, reg.RegistryStr(), func() (err error) {
+		endpoint, err = s.registry.Ping(ctx, reg, auth)
+		return err
+	})
+	return endpoint, err
+}
+
+// CheckEndpoints requests the manifest of the reference from each of the endpoints that it is pulled from, with the
+// credentials that a pull would use, and returns the outcome for each endpoint, along with the credential sources that
+// the registries fall back to when no credentials are configured for an endpoint.
+func (s *imageSource) CheckEndpoints(ctx context.Context, ref name.Reference) ([]credentialSource, []registries.EndpointStatus, error) {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return nil, nil, s.err
+	}
+
+	setPhase(ctx, "checking credentials for %s", ref.Name())
+	statuses, err := s.registry.CheckEndpoints(ctx, ref)
+	return s.sources, statuses, err
+}
+
+// retry calls f until it succeeds, returns an error that is not retryable, or has been retried the configured
+// number of times, waiting for the retry delay between attempts. Each failed attempt is logged. The registry and
+// layer cache are shared by all attempts, so layers cached by a failed attempt are not pulled again.
+func (s *imageSource) retry(ctx context.Context, image string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt > s.retries || !registries.IsRetryable(err) {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{"image": image, "attempt": attempt}).WithError(err).Warnf("Attempt %d of %d failed, retrying in %s", attempt, s.retries+1, s.retryDelay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(s.retryDelay):
+		}
+	}
+}
+
+// localImage returns the image for the reference from a local image tarball, and the path of the tarball, or nil if
+// no images directories are set, or none of them contain the image. The first directory that contains the image is
+// used. Local image tarballs are not checked when the pull policy is always. Checking them stops when the context
+// is done.
+func (s *imageSource) localImage(ctx context.Context, ref name.Reference) (v1.Image, string, error) {
+	p, err := s.puller()
+	if err != nil {
+		return nil, "", err
+	}
+	if len(p.ImagesDirs) > 0 {
+		setPhase(ctx, "checking local image archives for %s", ref.Name())
+	}
+	return p.LocalImage(ctx, ref)
+}
+
+// puller returns a puller for the images directories, registry, and layer cache of the source. The registry and layer
+// cache are only set once init has set them up. No images directories are searched when the pull policy is always.
+func (s *imageSource) puller() (*puller.Puller, error) {
+	imagesDirs := []string{}
+	if s.clx.GlobalIsSet("images-dir") && s.pullPolicy != pullAlways {
+		for _, dir := range s.clx.GlobalStringSlice("images-dir") {
+			imagesDir, err := filepath.Abs(os.ExpandEnv(dir))
+			if err != nil {
+				return nil, err
+			}
+			imagesDirs = append(imagesDirs, imagesDir)
+		}
+	}
+	return &puller.Puller{
+		ImagesDirs:       imagesDirs,
+		Registry:         s.registry,
+		Cache:            s.cache,
+		CacheDir:         s.cacheDir,
+		Platform:         s.platform,
+		ReferenceOptions: s.refOptions,
+		RemoteOptions:    s.remoteOptions,
+		Policy:           s.imagePolicy,
+	}, nil
+}
+
+// checkPolicy returns a *policy.Violation if the --image-policy denies the image, before any registry is contacted.
+func (s *imageSource) checkPolicy(ref name.Reference) error {
+	_, err := s.imagePolicy.Check(ref)
+	return err
+}
+
+// verifySignatures verifies the signatures of the image with the digest, if the --image-policy requires it to be
+// signed. Signatures are read from the registry, even for images found in local image tarballs, so the registry
+// configuration is loaded if it has not been already.
+func (s *imageSource) verifySignatures(ctx context.Context, ref name.Reference, digest v1.Hash) error {
+	if rule, err := s.imagePolicy.Check(ref); err != nil || !rule.RequiresSignature() {
+		return err
+	}
+	s.once.Do(s.init)
+	if s.err != nil {
+		return s.err
+	}
+	p, err := s.puller()
+	if err != nil {
+		return err
+	}
+	setPhase(ctx, "verifying signatures of image %s", ref.Name())
+	return p.VerifySignatures(ctx, ref, digest)
+}
+
+// requestOptions returns the options for requests to the registry: the context and platform, followed by the options
+// given by flags.
+func (s *imageSource) requestOptions(ctx context.Context) []remote.Option {
+	return append([]remote.Option{remote.WithContext(ctx), remote.WithPlatform(s.platform)}, s.remoteOptions...)
+}
+
+// init loads the registry configuration and credential provider plugins, and opens the layer cache if enabled.
+// Registries cannot be accessed when the pull policy is never, so nothing is loaded, and no plugins are run.
+func (s *imageSource) init() {
+	if s.pullPolicy == pullNever {
+		s.err = errors.New("registries cannot be accessed when --pull-policy is never")
+		return
+	}
+
+	// credentials that are not configured for a registry are looked up in the configured credential sources, in order
+	sources := map[string]credentialSource{}
+	if s.clx.GlobalIsSet("image-credential-provider-config") && s.clx.GlobalIsSet("image-credential-provider-bin-dir") {
+		opts := []plugin.Option{plugin.WithTimeout(s.clx.GlobalDuration("image-credential-provider-timeout"))}
+		if envFile := s.clx.GlobalString("image-credential-provider-env"); envFile != "" {
+			opts = append(opts, plugin.WithEnvFile(envFile))
+		}
+		plugins, err := plugin.RegisterCredentialProviderPlugins(s.clx.GlobalString("image-credential-provider-config"), s.clx.GlobalString("image-credential-provider-bin-dir"), opts...)
+		if err != nil {
+			s.err = err
+			return
+		}
+		sources["plugins"] = credentialSource{name: "image credential provider plugins", keychain: plugins}
+	}
+	// DefaultKeychain tries to read config from the home dir, and will error if HOME isn't set, so gate on that.
+	if os.Getenv("HOME") != "" {
+		sources["docker-config"] = credentialSource{name: "docker config", keychain: authn.DefaultKeychain}
+	}
+	// credentials stored by wharfie login --store wharfie are tried first
+	if keychain, err := loadCredentialsKeychain(); err != nil {
+		s.err = err
+		return
+	} else if keychain != nil {
+		s.sources = append(s.sources, credentialSource{name: "wharfie credentials file", keychain: keychain})
+	}
+	for _, source := range strings.Split(s.clx.GlobalString("credential-order"), ",") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if !credentialSources[source] {
+			s.err = errors.Errorf("invalid credential source %q in --credential-order", source)
+			return
+		}
+		if source, ok := sources[source]; ok {
+			s.sources = append(s.sources, source)
+		}
+	}
+	keychains := []authn.Keychain{}
+	for _, source := range s.sources {
+		keychains = append(keychains, credentialprovider.Named(source.name, source.keychain))
+	}
+	registryOpts := []registries.Option{
+		registries.WithDefaultKeychain(credentialprovider.NewChainKeychain(keychains...)),
+		registries.WithUserAgent(userAgent()),
+	}
+
+	var registry *registries.Client
+	var err error
+	privateRegistry := s.registrySource
+	if s.registryConfig != nil {
+		registry, err = registries.GetPrivateRegistriesFromBytes(s.registryConfig, registryOpts...)
+	} else {
+		registry, err = registries.GetPrivateRegistries(privateRegistry, registryOpts...)
+	}
+	if err != nil {
+		s.err = errors.Wrapf(err, "failed to load private registry configuration from %s", privateRegistry)
+		return
+	}
+
+	// insecure flags are merged into the registry configuration, which takes precedence, so that they can be used
+	// without writing a configuration file; credentials given by flags or environment variables take precedence over
+	// the configuration instead
+	if s.clx.GlobalBool("insecure-all") {
+		logrus.Warn("TLS certificate verification is disabled for all registries")
+		for _, key := range registry.SetInsecureSkipVerify("*") {
+			logrus.Warnf("Ignoring --insecure-all for %s: TLS is configured in %s", key, privateRegistry)
+		}
+	}
+	// TLS files apply to the registries of the images, unless they are scoped to another registry
+	tlsRegistry := s.clx.GlobalString("tls-registry")
+	setTLS := func(host string) {
+		if keys := registry.SetTLS(host, *s.tls); len(keys) > 0 {
+			logrus.Warnf("Ignoring TLS files given on the command line for registry %s: TLS is configured for %s in %s", host, keys[0], privateRegistry)
+		}
+	}
+	if s.tls != nil && tlsRegistry != "" {
+		setTLS(tlsRegistry)
+	}
+	seen := map[string]bool{}
+	for _, ref := range s.targets {
+		host := ref.Context().RegistryStr()
+		if seen[host] {
+			continue
+		}
+		seen[host] = true
+		if s.clx.GlobalBool("insecure-skip-verify") && !s.clx.GlobalBool("insecure-all") {
+			if keys := registry.SetInsecureSkipVerify(host); len(keys) > 0 {
+				logrus.Warnf("Ignoring --insecure-skip-verify for registry %s: TLS is configured for %s in %s", host, keys[0], privateRegistry)
+			} else {
+				logrus.Warnf("TLS certificate verification is disabled for registry %s", host)
+			}
+		}
+		if s.tls != nil && tlsRegistry == "" {
+			setTLS(host)
+		}
+		if s.clx.GlobalBool("plain-http") {
+			if keys := registry.SetPlainHTTP(host); len(keys) > 0 {
+				logrus.Warnf("Ignoring --plain-http for registry %s: TLS is configured for %s in %s", host, keys[0], privateRegistry)
+			} else {
+				logrus.Warnf("Using plain HTTP for registry %s", host)
+			}
+		}
+		auth, source, err := s.registryAuth(host)
+		if err != nil {
+			s.err = err
+			return
+		}
+		if auth != nil {
+			if key := registry.SetAuth(host, *auth); key != "" {
+				logrus.Infof("Using credentials from %s for registry %s instead of those configured for %s in %s", source, host, key, privateRegistry)
+			} else {
+				logrus.Debugf("Using credentials from %s for registry %s", source, host)
+			}
+		}
+	}
+
+	if s.clx.GlobalBool("trace-requests") {
+		registry.EnableRequestTracing(logs.Debug)
+	}
+	s.registry = registry
+
+	if s.useCache {
+		dir, err := cacheDir(s.clx)
+		if err != nil {
+			s.err = err
+			return
+		}
+		opts, err := cacheOptions(s.clx)
+		if err != nil {
+			s.err = err
+			return
+		}
+		// hold a shared lock while the cache is in use, so that it is not pruned by another process
+		if s.cacheLock, err = layercache.LockShared(dir); err != nil {
+			s.err = err
+			return
+		}
+		logrus.Infof("Using layer cache %s", dir)
+		s.cache = layercache.NewFilesystemCache(dir, opts...)
+		s.cacheDir = dir
+	}
+}
+
+// Close stops displaying download progress, and releases the lock on the layer cache, if it was opened.
+func (s *imageSource) Close() error {
+	if s.display != nil {
+		s.display.Close()
+	}
+	if r, ok := s.registry.(tracedRegistry); ok {
+		logRequestStats(r.RequestStats())
+	}
+	for _, source := range s.sources {
+		if k, ok := source.keychain.(instrumentedKeychain); ok {
+			logCredentialStats(source.name, k.Stats())
+		}
+	}
+	if stats := s.cacheStats(); stats != nil {
+		logCacheStats(*stats)
+	}
+	return s.cacheLock.Unlock()
+}
+
+// cacheStats returns the hits and misses of the layer cache so far, or nil if the cache is not in use.
+func (s *imageSource) cacheStats() *layercache.Stats {
+	c, ok := s.cache.(countingCache)
+	if !ok {
+		return nil
+	}
+	stats := c.Stats()
+	return &stats
+}
+
+// logCacheStats logs a summary of the layer cache hits and misses, and how much of the layer content was served from
+// the cache, if the cache was used.
+func logCacheStats(stats layercache.Stats) {
+	if stats.Hits == 0 && stats.Misses == 0 {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"hits":   stats.Hits,
+		"misses": stats.Misses,
+		"cached": formatSize(stats.CachedBytes),
+		"remote": formatSize(stats.RemoteBytes),
+	}).Infof("Layer cache served %.0f%% of layer content", stats.HitRatio()*100)
+}
+
+// logCredentialStats logs a summary of the lookups of a credential source at debug level: how many were answered
+// from its cache, and the invocations of each of its plugins.
+func logCredentialStats(source string, stats plugin.Stats) {
+	if stats.CacheHits == 0 && stats.CacheMisses == 0 {
+		return
+	}
+	logrus.Debugf("%s: %d lookups, %d cached", source, stats.CacheHits+stats.CacheMisses, stats.CacheHits)
+	for _, p := range stats.Providers {
+		logrus.Debugf("%s: %s: %d invocations (%d failed); average duration=%s; max duration=%s",
+			source, p.Provider, p.Invocations, p.Failures, p.Duration/time.Duration(p.Invocations), p.MaxDuration)
+	}
+}
+
+// logRequestStats logs a summary of the request timings for each endpoint, for --trace-requests. Connection timings
+// are averaged over the requests that opened a new connection.
+func logRequestStats(stats []registries.RequestStats) {
+	for _, s := range stats {
+		var dns, connect, tlsHandshake time.Duration
+		if s.Connections > 0 {
+			n := time.Duration(s.Connections)
+			dns, connect, tlsHandshake = s.DNS/n, s.Connect/n, s.TLSHandshake/n
+		}
+		logs.Debug.Printf("%s: %d requests (%d failed), %d new connections; average dns=%s connect=%s tls=%s ttfb=%s; max ttfb=%s",
+			s.Endpoint, s.Requests, s.Failures, s.Connections, dns, connect, tlsHandshake, s.FirstByte/time.Duration(s.Requests), s.MaxFirstByte)
+	}
+}
+
+// trackProgress wraps the layers of a remote image so that their download progress is displayed, unless --quiet
+// is set.
+func (s *imageSource) trackProgress(ref name.Reference, img v1.Image) v1.Image {
+	return events.Image(img, ref.Name(), s.eventHandler())
+}
+
+// eventHandler returns the handler that the events of the images are sent to: the progress display, or nil if --quiet is
+// set.
+func (s *imageSource) eventHandler() events.Handler {
+	if s.display == nil {
+		return nil
+	}
+	return s.display
+}
+
+// cacheLayers reads the uncompressed content of each layer that is not already cached through the cache, which
+// stores it by diff ID for use by later extractions. Layers that cannot be read completely are removed from the
+// cache, so that a partial layer is not used.
+func cacheLayers(img v1.Image, c cache.Cache) error {
+	layers, err := img.Layers()
+	if err != nil {
+		return err
+	}
+
+	for _, layer := range layers {
+		diffID, err := layer.DiffID()
+		if err != nil {
+			return err
+		}
+		if _, err := c.Get(diffID); err == nil {
+			logrus.WithField("layer", diffID.String()).Info("Layer is already cached")
+			continue
+		}
+
+		logrus.WithField("layer", diffID.String()).Info("Caching layer")
+		cached, err := c.Put(layer)
+		if err != nil {
+			return err
+		}
+		if err := readLayer(cached); err != nil {
+			_ = c.Delete(diffID)
+			return errors.Wrapf(err, "failed to cache layer %s", diffID)
+		}
+	}
+	return nil
+}
+
+// readLayer reads the uncompressed content of the layer to completion.
+func readLayer(layer v1.Layer) error {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		rc.Close()
+		return err
+	}
+	return rc.Close()
+}
+
+// layerSelector returns a function that selects layers matching any of the specs: last:<count> selects
+// the topmost layers of the image, and a digest selects the layer with that digest or diff ID.
+func layerSelector(img v1.Image, specs []string) (func(int, v1.Layer) bool, error) {
+	layers, err := img.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	selectors := []func(int, v1.Layer) bool{}
+	for _, spec := range specs {
+		if count, ok := strings.CutPrefix(spec, "last:"); ok {
+			n, err := strconv.Atoi(count)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid layer selector %q: count must be a positive integer", spec)
+			}
+			first := len(layers) - n
+			selectors = append(selectors, func(i int, _ v1.Layer) bool {
+				return i >= first
+			})
+			continue
+		}
+		hash, err := v1.NewHash(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid layer selector %q", spec)
+		}
+		selectors = append(selectors, func(_ int, layer v1.Layer) bool {
+			digest, _ := layer.Digest()
+			diffID, _ := layer.DiffID()
+			return digest == hash || diffID == hash
+		})
+	}
+
+	return func(i int, layer v1.Layer) bool {
+		for _, selector := range selectors {
+			if selector(i, layer) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
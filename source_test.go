@@ -0,0 +1,887 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// failingLayer is a layer whose uncompressed content fails partway through.
+type failingLayer struct {
+	v1.Layer
+}
+
+func (l failingLayer) Uncompressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(io.LimitReader(rc, 16), errReader{}), rc}, nil
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestCacheLayers(t *testing.T) {
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+
+	dir := t.TempDir()
+	c := cache.NewFilesystemCache(dir)
+	if err := cacheLayers(img, c); err != nil {
+		t.Fatalf("Failed to cache layers: %v", err)
+	}
+	assertCached(t, dir, img)
+
+	// layers that are already cached are not read again
+	if err := cacheLayers(img, c); err != nil {
+		t.Fatalf("Failed to cache layers: %v", err)
+	}
+	assertCached(t, dir, img)
+
+	layer, err := random.Layer(1024, "")
+	if err != nil {
+		t.Fatalf("Failed to create layer: %v", err)
+	}
+	img, err = mutate.AppendLayers(empty.Image, failingLayer{layer})
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	if err := cacheLayers(img, c); err == nil {
+		t.Errorf("Expected error caching layer that could not be read")
+	}
+	diffID, _ := layer.DiffID()
+	if _, err := os.Stat(cachedFile(dir, diffID)); !os.IsNotExist(err) {
+		t.Errorf("Expected partially read layer %s to be removed from cache: %v", diffID, err)
+	}
+}
+
+func TestRegistryConfig(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, _ := name.ParseReference(u.Host + "/test/config:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	digest, _ := img.Digest()
+
+	// registry.example.com is not resolvable, so images can only be found through the mirror
+	mirrorYAML := fmt.Sprintf("mirrors:\n  registry.example.com:\n    endpoint:\n      - %s\n", server.URL)
+	mirrorJSON := fmt.Sprintf(`{"mirrors": {"registry.example.com": {"endpoint": [%q]}}}`, server.URL)
+	image := "registry.example.com/test/config:v1"
+
+	testCases := map[string]struct {
+		flags    []string
+		stdin    string
+		expected string
+	}{
+		"inline JSON": {
+			flags: []string{"--registry-config-json", mirrorJSON},
+		},
+		"inline YAML": {
+			flags: []string{"--registry-config-json", mirrorYAML},
+		},
+		"JSON from stdin": {
+			flags: []string{"--private-registry", "-"},
+			stdin: mirrorJSON,
+		},
+		"YAML from stdin": {
+			flags: []string{"--private-registry", "-"},
+			stdin: mirrorYAML,
+		},
+		"invalid inline JSON": {
+			flags:    []string{"--registry-config-json", `{"mirrors": [}`},
+			expected: "failed to load private registry configuration from --registry-config-json",
+		},
+		"inline and file": {
+			flags:    []string{"--registry-config-json", mirrorJSON, "--private-registry", "registries.yaml"},
+			expected: "--registry-config-json cannot be combined with --private-registry",
+		},
+		"stdin and password from stdin": {
+			flags:    []string{"--private-registry", "-", "--username", "user", "--password-stdin"},
+			stdin:    mirrorYAML,
+			expected: "--private-registry - cannot be combined with --password-stdin",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			stdin = strings.NewReader(tc.stdin)
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("private-registry", filepath.Join(t.TempDir(), "registries.yaml"), "")
+			set.String("registry-config-json", "", "")
+			set.String("username", "", "")
+			set.Bool("password-stdin", false, "")
+			if err := set.Parse(append(tc.flags, image)); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			output := &bytes.Buffer{}
+			app := cli.NewApp()
+			app.Writer = output
+
+			err := resolve(context.Background(), cli.NewContext(app, set, nil))
+			if tc.expected != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expected) {
+					t.Fatalf("Expected error containing %q but got %v", tc.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to resolve image: %v", err)
+			}
+			if expected := image + "@" + digest.String() + "\n"; output.String() != expected {
+				t.Errorf("Expected output %q but got %q", expected, output.String())
+			}
+		})
+	}
+
+	// image references are read from stdin before the image source is created, so that conflict is checked there
+	t.Run("stdin and images from stdin", func(t *testing.T) {
+		set := flag.NewFlagSet("test", flag.ContinueOnError)
+		set.String("private-registry", "-", "")
+		if err := set.Parse([]string{"-"}); err != nil {
+			t.Fatalf("Failed to parse flags: %v", err)
+		}
+		expected := "--private-registry - cannot be combined with reading image references from stdin"
+		_, err := newImageSource(cli.NewContext(cli.NewApp(), set, nil))
+		if err == nil || err.Error() != expected {
+			t.Fatalf("Expected error %q but got %v", expected, err)
+		}
+	})
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, _ := name.ParseReference(u.Host + "/test/default:v1")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	digest, _ := img.Digest()
+
+	// registry.example.com is not resolvable, so images can only be found through the mirror
+	mirror := fmt.Sprintf("mirrors:\n  registry.example.com:\n    endpoint:\n      - %s\n", server.URL)
+
+	testCases := map[string]struct {
+		flags    []string
+		config   string
+		image    string
+		expected string
+		err      string
+	}{
+		"flag": {
+			flags:    []string{"--default-registry", u.Host},
+			image:    "test/default:v1",
+			expected: u.Host + "/test/default:v1@" + digest.String(),
+		},
+		"configuration": {
+			config:   "defaultRegistry: " + u.Host + "\n",
+			image:    "test/default:v1",
+			expected: u.Host + "/test/default:v1@" + digest.String(),
+		},
+		"configuration through mirror": {
+			config:   "defaultRegistry: registry.example.com\n" + mirror,
+			image:    "test/default:v1",
+			expected: "registry.example.com/test/default:v1@" + digest.String(),
+		},
+		"configuration from stdin through mirror": {
+			flags:    []string{"--private-registry", "-"},
+			config:   "defaultRegistry: registry.example.com\n" + mirror,
+			image:    "test/default:v1",
+			expected: "registry.example.com/test/default:v1@" + digest.String(),
+		},
+		"flag overrides configuration": {
+			flags:    []string{"--default-registry", u.Host},
+			config:   "defaultRegistry: registry.example.com\n",
+			image:    "test/default:v1",
+			expected: u.Host + "/test/default:v1@" + digest.String(),
+		},
+		"qualified reference is unaffected": {
+			flags:    []string{"--default-registry", "registry.example.com"},
+			image:    u.Host + "/test/default:v1",
+			expected: u.Host + "/test/default:v1@" + digest.String(),
+		},
+		"invalid default registry": {
+			flags: []string{"--default-registry", "registry.example.com/test"},
+			image: "test/default:v1",
+			err:   `invalid default registry "registry.example.com/test"`,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			config := filepath.Join(t.TempDir(), "registries.yaml")
+			if err := os.WriteFile(config, []byte(tc.config), 0644); err != nil {
+				t.Fatalf("Failed to write registry config: %v", err)
+			}
+			stdin = strings.NewReader(tc.config)
+			output := &bytes.Buffer{}
+			app := newApp(context.Background())
+			app.Writer = output
+
+			args := append([]string{"wharfie", "--private-registry", config}, tc.flags...)
+			err := app.Run(append(args, "resolve", tc.image))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error containing %q but got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to resolve image: %v", err)
+			}
+			if output.String() != tc.expected+"\n" {
+				t.Errorf("Expected output %q but got %q", tc.expected+"\n", output.String())
+			}
+		})
+	}
+}
+
+func TestInsecureFlags(t *testing.T) {
+	defer func(output io.Writer) { logrus.SetOutput(output) }(logrus.StandardLogger().Out)
+
+	config := "configs:\n  other.example.com:\n    tls:\n      insecure_skip_verify: false\n"
+	targets := []string{"registry.example.com/app:v1", "registry.example.com/tools:v1", "other.example.com/app:v1"}
+
+	testCases := map[string]struct {
+		flags    []string
+		expected []string
+	}{
+		"no flags": {},
+		"insecure skip verify": {
+			flags: []string{"--insecure-skip-verify"},
+			expected: []string{
+				"TLS certificate verification is disabled for registry registry.example.com",
+				"Ignoring --insecure-skip-verify for registry other.example.com: TLS is configured for other.example.com in ",
+			},
+		},
+		"insecure all": {
+			flags: []string{"--insecure-skip-verify", "--insecure-all"},
+			expected: []string{
+				"TLS certificate verification is disabled for all registries",
+				"Ignoring --insecure-all for other.example.com: TLS is configured in ",
+			},
+		},
+		"plain http": {
+			flags: []string{"--plain-http"},
+			expected: []string{
+				"Using plain HTTP for registry registry.example.com",
+				"Ignoring --plain-http for registry other.example.com: TLS is configured for other.example.com in ",
+			},
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			privateRegistry := filepath.Join(t.TempDir(), "registries.yaml")
+			if err := os.WriteFile(privateRegistry, []byte(config), 0644); err != nil {
+				t.Fatalf("Failed to write registries.yaml: %v", err)
+			}
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("private-registry", privateRegistry, "")
+			set.Bool("insecure-skip-verify", false, "")
+			set.Bool("insecure-all", false, "")
+			set.Bool("plain-http", false, "")
+			if err := set.Parse(tc.flags); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			refs := []name.Reference{}
+			for _, target := range targets {
+				ref, err := name.ParseReference(target)
+				if err != nil {
+					t.Fatalf("Failed to parse reference: %v", err)
+				}
+				refs = append(refs, ref)
+			}
+			source, err := newImageSource(cli.NewContext(cli.NewApp(), set, nil), refs...)
+			if err != nil {
+				t.Fatalf("Failed to create image source: %v", err)
+			}
+
+			output := &bytes.Buffer{}
+			logrus.SetOutput(output)
+			source.once.Do(source.init)
+			if source.err != nil {
+				t.Fatalf("Failed to initialize image source: %v", source.err)
+			}
+
+			warnings := strings.Count(output.String(), "level=warning")
+			if warnings != len(tc.expected) {
+				t.Errorf("Expected %d warnings but got %d:\n%s", len(tc.expected), warnings, output)
+			}
+			for _, expected := range tc.expected {
+				if !strings.Contains(output.String(), expected) {
+					t.Errorf("Expected warning %q in output:\n%s", expected, output)
+				}
+			}
+		})
+	}
+}
+
+func TestPullPolicy(t *testing.T) {
+	handler := &flakyHandler{Handler: registry.New(), requests: map[string]int{}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	// v1 is both in the registry and in a local image tarball, with different content; v2 is only in the registry
+	remoteImage, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	localImage, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	remoteDigest, _ := remoteImage.Digest()
+	localDigest, _ := localImage.Digest()
+	repo, err := name.NewRepository(u.Host + "/test/policy")
+	if err != nil {
+		t.Fatalf("Failed to parse repository: %v", err)
+	}
+	for _, tag := range []string{"v1", "v2"} {
+		if err := remote.Write(repo.Tag(tag), remoteImage); err != nil {
+			t.Fatalf("Failed to push image: %v", err)
+		}
+	}
+	imagesDir := t.TempDir()
+	if err := tarball.WriteToFile(filepath.Join(imagesDir, "images.tar"), repo.Tag("v1"), localImage); err != nil {
+		t.Fatalf("Failed to write image tarball: %v", err)
+	}
+
+	testCases := map[string]struct {
+		policy   string
+		tag      string
+		expected v1.Hash
+		requests bool
+		err      error
+	}{
+		"default uses local image":          {tag: "v1", expected: localDigest},
+		"if not present uses local image":   {policy: "ifnotpresent", tag: "v1", expected: localDigest},
+		"if not present pulls missing":      {policy: "IfNotPresent", tag: "v2", expected: remoteDigest, requests: true},
+		"always pulls":                      {policy: "always", tag: "v1", expected: remoteDigest, requests: true},
+		"never uses local image":            {policy: "never", tag: "v1", expected: localDigest},
+		"never does not pull missing image": {policy: "never", tag: "v2", err: errNotPresent},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			handler.lock.Lock()
+			handler.requests = map[string]int{}
+			handler.lock.Unlock()
+
+			dir := t.TempDir()
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("private-registry", filepath.Join(dir, "registries.yaml"), "")
+			set.Var(&cli.StringSlice{}, "images-dir", "")
+			set.String("pull-policy", tc.policy, "")
+			set.String("image-credential-provider-config", "", "")
+			set.String("image-credential-provider-bin-dir", "", "")
+			args := []string{"--images-dir", imagesDir}
+			if !tc.requests {
+				// credential provider plugins are only loaded when the registry is accessed, so a missing
+				// configuration would fail the test if they were
+				args = append(args, "--image-credential-provider-config", filepath.Join(dir, "missing.yaml"), "--image-credential-provider-bin-dir", dir)
+			}
+			if err := set.Parse(args); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			source, err := newImageSource(cli.NewContext(cli.NewApp(), set, nil))
+			if err != nil {
+				t.Fatalf("Failed to create image source: %v", err)
+			}
+
+			img, err := source.Image(context.Background(), repo.Tag(tc.tag))
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("Expected error %v but got %v", tc.err, err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Failed to get image: %v", err)
+				}
+				if digest, _ := img.Digest(); digest != tc.expected {
+					t.Errorf("Expected image with digest %s but got %s", tc.expected, digest)
+				}
+			}
+
+			handler.lock.Lock()
+			defer handler.lock.Unlock()
+			if requested := len(handler.requests) > 0; requested != tc.requests {
+				t.Errorf("Expected registry to be requested %t but got %v", tc.requests, handler.requests)
+			}
+		})
+	}
+}
+
+func TestPullPolicyFlag(t *testing.T) {
+	testCases := map[string]struct {
+		value    string
+		expected pullPolicy
+		err      string
+	}{
+		"default":        {expected: pullIfNotPresent},
+		"if not present": {value: "if-not-present", expected: pullIfNotPresent},
+		"always":         {value: "Always", expected: pullAlways},
+		"never":          {value: "never", expected: pullNever},
+		"invalid":        {value: "sometimes", err: `invalid pull policy "sometimes": must be one of ifnotpresent, always, or never`},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			policy, err := parsePullPolicy(tc.value)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("Expected error %q but got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if policy != tc.expected {
+				t.Errorf("Expected pull policy %s but got %s", tc.expected, policy)
+			}
+		})
+	}
+}
+
+func TestPullPolicyNeverExitCode(t *testing.T) {
+	dir := t.TempDir()
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(os.Args[0], "--private-registry", filepath.Join(dir, "registries.yaml"), "--images-dir", dir, "--pull-policy", "never",
+		"--destination", filepath.Join(dir, "extract"), "registry.example.com/test/policy:v1", "registry.example.com/test/policy:v2")
+	cmd.Env = append(os.Environ(), "WHARFIE_TEST_MAIN=1")
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitNotPresent {
+		t.Errorf("Expected exit code %d but got %v: %s", exitNotPresent, err, stderr)
+	}
+}
+
+func TestImagePolicyExitCode(t *testing.T) {
+	dir := t.TempDir()
+	policyFile := filepath.Join(dir, "policy.yaml")
+	if err := os.WriteFile(policyFile, []byte("defaultAction: deny\nrules:\n- match: [\"registry.example.com/allowed/*\"]\n  action: allow\n"), 0644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+
+	// the denied image fails without its registry being contacted, which would fail as unreachable
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(os.Args[0], "--private-registry", filepath.Join(dir, "registries.yaml"), "--image-policy", policyFile,
+		"--destination", filepath.Join(dir, "extract"), "registry.invalid/test/app:v1")
+	cmd.Env = append(os.Environ(), "WHARFIE_TEST_MAIN=1", "DOCKER_CONFIG="+dir)
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitPolicyViolation {
+		t.Errorf("Expected exit code %d but got %v: %s", exitPolicyViolation, err, stderr)
+	}
+	if !strings.Contains(stderr.String(), "not allowed by image policy rule default") {
+		t.Errorf("Expected the violation to be reported but got: %s", stderr)
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, err := name.ParseReference(u.Host + "/test/trace:latest")
+	if err != nil {
+		t.Fatalf("Failed to parse reference: %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	digest, _ := img.Digest()
+
+	// requests are traced regardless of the log level
+	dir := t.TempDir()
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(os.Args[0], "--private-registry", filepath.Join(dir, "registries.yaml"), "--trace-requests", "--quiet", "resolve", ref.Name())
+	cmd.Env = append(os.Environ(), "WHARFIE_TEST_MAIN=1")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Failed to run wharfie: %v\n%s", err, stderr)
+	}
+	if stdout.String() != digest.String()+"\n" {
+		t.Errorf("Expected only the digest on stdout but got %q", stdout)
+	}
+	for _, expected := range []string{
+		"<-- 200 " + server.URL + "/v2/test/trace/manifests/latest",
+		"HEAD " + server.URL + "/v2/test/trace/manifests/latest 200 OK: ",
+		"ttfb=",
+		server.URL + ": 2 requests (0 failed), 1 new connections",
+	} {
+		if !strings.Contains(stderr.String(), expected) {
+			t.Errorf("Expected %q on stderr:\n%s", expected, stderr)
+		}
+	}
+}
+
+// slowHandler delays GET requests whose path contains the given string until the request is cancelled.
+type slowHandler struct {
+	http.Handler
+	slow string
+}
+
+func (h slowHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.Contains(r.URL.Path, h.slow) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestTimeout(t *testing.T) {
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+
+	testCases := map[string]struct {
+		slow     string
+		timeout  time.Duration
+		command  func(context.Context, *cli.Context) error
+		extract  bool
+		expected string
+	}{
+		"slow manifest": {
+			slow:     "/manifests/",
+			timeout:  200 * time.Millisecond,
+			command:  pull,
+			expected: "operation timed out after 200ms while pulling image ",
+		},
+		"slow blob": {
+			slow:     "/blobs/",
+			timeout:  200 * time.Millisecond,
+			command:  pull,
+			expected: "operation timed out after 200ms while caching layers of image ",
+		},
+		"slow extraction": {
+			slow:     "/blobs/",
+			timeout:  200 * time.Millisecond,
+			command:  run,
+			extract:  true,
+			expected: "operation timed out after 200ms while extracting image ",
+		},
+		"within timeout": {
+			slow:    "/none/",
+			timeout: 10 * time.Second,
+			command: pull,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			server := httptest.NewServer(slowHandler{Handler: registry.New(), slow: tc.slow})
+			defer server.Close()
+			u, _ := url.Parse(server.URL)
+			ref, _ := name.ParseReference(u.Host + "/test/timeout:v1")
+			if err := remote.Write(ref, img); err != nil {
+				t.Fatalf("Failed to push image: %v", err)
+			}
+
+			dir := t.TempDir()
+			args := []string{ref.Name()}
+			if tc.extract {
+				args = append(args, filepath.Join(dir, "extract"))
+			}
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.Duration("timeout", tc.timeout, "")
+			set.String("private-registry", filepath.Join(dir, "registries.yaml"), "")
+			set.String("cache-dir", filepath.Join(dir, "cache"), "")
+			set.String("output", "text", "")
+			set.String("overwrite-policy", "overwrite", "")
+			set.String("case-collision-policy", "warn", "")
+			set.String("compress", "none", "")
+			set.Int("parallel", 1, "")
+			set.String("platform", "linux/amd64", "")
+			if err := set.Parse(args); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			app := cli.NewApp()
+			app.Writer = &bytes.Buffer{}
+
+			start := time.Now()
+			err := timed(context.Background(), tc.command)(cli.NewContext(app, set, nil))
+			if tc.expected == "" {
+				if err != nil {
+					t.Fatalf("Expected command to complete within timeout: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tc.expected+ref.Name()) {
+				t.Fatalf("Expected error %q but got %v", tc.expected+ref.Name(), err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Expected command to be aborted at the timeout, but it took %s", elapsed)
+			}
+		})
+	}
+}
+
+// flakyHandler returns 429 Too Many Requests for the first failures GET requests whose path contains fail, and
+// counts the GET requests for each path.
+type flakyHandler struct {
+	http.Handler
+	fail     string
+	failures int
+	lock     sync.Mutex
+	requests map[string]int
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.lock.Lock()
+		h.requests[r.URL.Path]++
+		fail := strings.Contains(r.URL.Path, h.fail) && h.failures > 0
+		if fail {
+			h.failures--
+		}
+		h.lock.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+func TestRetries(t *testing.T) {
+	img, err := random.Image(1024, 2)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatalf("Failed to get layers: %v", err)
+	}
+	first, _ := layers[0].Digest()
+	second, _ := layers[1].Digest()
+
+	testCases := map[string]struct {
+		tag      string
+		fail     string
+		failures int
+		retries  int
+		expected string
+		requests map[string]int
+	}{
+		"no failures": {
+			fail:     "/manifests/",
+			retries:  2,
+			requests: map[string]int{"/manifests/v1": 1},
+		},
+		"manifest recovers": {
+			fail:     "/manifests/",
+			failures: 2,
+			retries:  2,
+			requests: map[string]int{"/manifests/v1": 3},
+		},
+		"manifest retries exhausted": {
+			fail:     "/manifests/",
+			failures: 2,
+			retries:  1,
+			expected: "429 Too Many Requests",
+			requests: map[string]int{"/manifests/v1": 2},
+		},
+		"layer recovers": {
+			fail:     "/blobs/" + second.String(),
+			failures: 1,
+			retries:  1,
+			requests: map[string]int{"/blobs/" + first.String(): 1, "/blobs/" + second.String(): 2},
+		},
+		"not found": {
+			tag:      "v2",
+			fail:     "/manifests/",
+			retries:  3,
+			expected: "MANIFEST_UNKNOWN",
+			requests: map[string]int{"/manifests/v2": 1},
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			handler := &flakyHandler{Handler: registry.New(), fail: tc.fail, failures: tc.failures, requests: map[string]int{}}
+			server := httptest.NewServer(handler)
+			defer server.Close()
+			u, _ := url.Parse(server.URL)
+			ref, _ := name.ParseReference(u.Host + "/test/retries:v1")
+			if err := remote.Write(ref, img); err != nil {
+				t.Fatalf("Failed to push image: %v", err)
+			}
+			if tc.tag != "" {
+				ref = ref.Context().Tag(tc.tag)
+			}
+			handler.lock.Lock()
+			handler.requests = map[string]int{}
+			handler.lock.Unlock()
+
+			dir := t.TempDir()
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.Int("retries", tc.retries, "")
+			set.Duration("retry-delay", time.Millisecond, "")
+			set.String("private-registry", filepath.Join(dir, "registries.yaml"), "")
+			set.String("cache-dir", filepath.Join(dir, "cache"), "")
+			set.String("platform", "linux/amd64", "")
+			if err := set.Parse([]string{ref.Name()}); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			app := cli.NewApp()
+			app.Writer = &bytes.Buffer{}
+
+			err := pull(context.Background(), cli.NewContext(app, set, nil))
+			if tc.expected == "" && err != nil {
+				t.Fatalf("Expected pull to succeed: %v", err)
+			}
+			if tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)) {
+				t.Fatalf("Expected error containing %q but got %v", tc.expected, err)
+			}
+
+			for path, count := range tc.requests {
+				path = "/v2/test/retries" + path
+				if handler.requests[path] != count {
+					t.Errorf("Expected %d requests for %s but got %d", count, path, handler.requests[path])
+				}
+			}
+		})
+	}
+}
+
+func TestRetryFlags(t *testing.T) {
+	testCases := map[string]struct {
+		retries    int
+		retryDelay time.Duration
+		expected   string
+	}{
+		"valid":          {retries: 3, retryDelay: time.Second},
+		"negative count": {retries: -1, expected: "invalid retries -1: must not be negative"},
+		"negative delay": {retryDelay: -time.Second, expected: "invalid retry delay -1s: must not be negative"},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.Int("retries", tc.retries, "")
+			set.Duration("retry-delay", tc.retryDelay, "")
+			_, err := newImageSource(cli.NewContext(cli.NewApp(), set, nil))
+			if tc.expected == "" && err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			if tc.expected != "" && (err == nil || err.Error() != tc.expected) {
+				t.Fatalf("Expected error %q but got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestConcurrencyFlag(t *testing.T) {
+	testCases := map[string]struct {
+		args     []string
+		options  int
+		expected string
+	}{
+		"default":  {},
+		"valid":    {args: []string{"--concurrency", "8"}, options: 1},
+		"zero":     {args: []string{"--concurrency", "0"}, expected: "invalid concurrency 0: must be at least 1"},
+		"negative": {args: []string{"--concurrency", "-1"}, expected: "invalid concurrency -1: must be at least 1"},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.Int("concurrency", 0, "")
+			if err := set.Parse(tc.args); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			source, err := newImageSource(cli.NewContext(cli.NewApp(), set, nil))
+			if tc.expected != "" {
+				if err == nil || err.Error() != tc.expected {
+					t.Fatalf("Expected error %q but got %v", tc.expected, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error but got %v", err)
+			}
+			defer source.Close()
+
+			// the options are added after wharfie's own for each request, and to those of the puller
+			if len(source.remoteOptions) != tc.options {
+				t.Errorf("Expected %d remote options but got %d", tc.options, len(source.remoteOptions))
+			}
+			if options := source.requestOptions(context.Background()); len(options) != 2+tc.options {
+				t.Errorf("Expected %d request options but got %d", 2+tc.options, len(options))
+			}
+			p, err := source.puller()
+			if err != nil {
+				t.Fatalf("Failed to create puller: %v", err)
+			}
+			if len(p.RemoteOptions) != tc.options {
+				t.Errorf("Expected %d puller remote options but got %d", tc.options, len(p.RemoteOptions))
+			}
+		})
+	}
+}
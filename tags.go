@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// tagList describes the tags in a repository, and the endpoint that listed them, for the tags command.
+type tagList struct {
+	Repository string    `json:"repository"`
+	Endpoint   string    `json:"endpoint"`
+	Tags       []tagInfo `json:"tags"`
+}
+
+// tagInfo describes a tag, for the tags command.
+type tagInfo struct {
+	Tag    string `json:"tag"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// listTags prints the tags in the repository, optionally with the digest of each tag. Digest requests are
+// rate-limited, so that auditing a large repository does not trip registry rate limits.
+func listTags(ctx context.Context, clx *cli.Context) error {
+	if len(clx.Args()) < 1 {
+		fmt.Fprintf(clx.App.Writer, "Incorrect Usage. <repository> is a required argument.\n\n")
+		cli.ShowCommandHelpAndExit(clx, "tags", 1)
+	}
+
+	output := clx.String("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unsupported output format %q; supported formats: text, json", output)
+	}
+	rate := clx.Int("digest-rate")
+	if rate < 1 {
+		return fmt.Errorf("invalid digest rate %d: must be at least 1", rate)
+	}
+
+	options, err := referenceOptions(clx)
+	if err != nil {
+		return err
+	}
+	repo, err := name.NewRepository(clx.Args().Get(0), options...)
+	if err != nil {
+		return err
+	}
+
+	source, err := newImageSource(clx, repo.Tag(name.DefaultTag))
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	tags, endpoint, err := source.ListTags(ctx, repo)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Listed %d tags for %s from endpoint %s", len(tags), repo.Name(), endpoint)
+
+	list := tagList{Repository: repo.Name(), Endpoint: endpoint, Tags: make([]tagInfo, 0, len(tags))}
+	for _, tag := range tags {
+		list.Tags = append(list.Tags, tagInfo{Tag: tag})
+	}
+
+	if clx.Bool("digests") {
+		limit := time.NewTicker(time.Second / time.Duration(rate))
+		defer limit.Stop()
+		for i := range list.Tags {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-limit.C:
+				}
+			}
+			digest, err := source.Head(ctx, repo.Tag(list.Tags[i].Tag))
+			if err != nil {
+				logrus.Warnf("Failed to get digest for tag %s: %v", list.Tags[i].Tag, err)
+				continue
+			}
+			list.Tags[i].Digest = digest.String()
+		}
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(clx.App.Writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	}
+	for _, tag := range list.Tags {
+		line := tag.Tag
+		if tag.Digest != "" {
+			line += " " + tag.Digest
+		}
+		if _, err := fmt.Fprintln(clx.App.Writer, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/urfave/cli"
+)
+
+func TestListTags(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	digests := map[string]string{}
+	for _, tag := range []string{"v1", "v2", "latest"} {
+		img, err := random.Image(1024, 1)
+		if err != nil {
+			t.Fatalf("Failed to create image: %v", err)
+		}
+		ref, _ := name.ParseReference(u.Host + "/test/tags:" + tag)
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatalf("Failed to push image: %v", err)
+		}
+		digest, _ := img.Digest()
+		digests[tag] = digest.String()
+	}
+
+	config := filepath.Join(t.TempDir(), "registries.yaml")
+	mirror := fmt.Sprintf("mirrors:\n  registry.example.com:\n    endpoint:\n      - %s\n", server.URL)
+	if err := os.WriteFile(config, []byte(mirror), 0644); err != nil {
+		t.Fatalf("Failed to write registry config: %v", err)
+	}
+
+	testCases := map[string]struct {
+		output   string
+		digests  bool
+		expected string
+	}{
+		"text": {
+			output:   "text",
+			expected: "latest\nv1\nv2\n",
+		},
+		"text with digests": {
+			output:   "text",
+			digests:  true,
+			expected: fmt.Sprintf("latest %s\nv1 %s\nv2 %s\n", digests["latest"], digests["v1"], digests["v2"]),
+		},
+		"json with digests": {
+			output:  "json",
+			digests: true,
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("private-registry", config, "")
+			set.String("output", tc.output, "")
+			set.Bool("digests", tc.digests, "")
+			set.Int("digest-rate", 100, "")
+			if err := set.Parse([]string{"registry.example.com/test/tags"}); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			output := &bytes.Buffer{}
+			app := cli.NewApp()
+			app.Writer = output
+
+			if err := listTags(context.Background(), cli.NewContext(app, set, nil)); err != nil {
+				t.Fatalf("Failed to list tags: %v", err)
+			}
+			if tc.output == "text" {
+				if output.String() != tc.expected {
+					t.Errorf("Expected output %q but got %q", tc.expected, output.String())
+				}
+				return
+			}
+
+			list := tagList{}
+			if err := json.Unmarshal(output.Bytes(), &list); err != nil {
+				t.Fatalf("Failed to parse output: %v", err)
+			}
+			expected := tagList{
+				Repository: "registry.example.com/test/tags",
+				Endpoint:   server.URL + "/v2",
+				Tags: []tagInfo{
+					{Tag: "latest", Digest: digests["latest"]},
+					{Tag: "v1", Digest: digests["v1"]},
+					{Tag: "v2", Digest: digests["v2"]},
+				},
+			}
+			if !reflect.DeepEqual(list, expected) {
+				t.Errorf("Expected tag list %+v but got %+v", expected, list)
+			}
+		})
+	}
+}
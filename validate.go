@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+	"github.com/rancher/wharfie/pkg/credentialprovider/plugin"
+	"github.com/rancher/wharfie/pkg/registries"
+	"github.com/urfave/cli"
+)
+
+// validateConfig parses the private registry configuration strictly, so that unknown fields are reported, and
+// validates it. For each image, the endpoints that are tried are printed in order, along with the repository that is
+// requested from each and the configs entries that supply its credentials and TLS configuration. No requests are made.
+func validateConfig(clx *cli.Context) error {
+	source, b, err := registryConfig(clx)
+	if err != nil {
+		return err
+	}
+	if b == nil {
+		if b, err = os.ReadFile(source); err != nil {
+			return errors.Wrap(err, "failed to read private registry configuration")
+		}
+	}
+
+	config, err := registries.UnmarshalStrict(b)
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		var verr *registries.ValidationError
+		if !errors.As(err, &verr) {
+			return errors.Wrapf(err, "failed to parse private registry configuration from %s", source)
+		}
+		for _, problem := range verr.Problems {
+			fmt.Fprintln(clx.App.Writer, problem)
+		}
+		return fmt.Errorf("private registry configuration from %s is invalid", source)
+	}
+	fmt.Fprintf(clx.App.Writer, "Private registry configuration from %s is valid\n", source)
+
+	if clx.GlobalIsSet("image-credential-provider-config") && clx.GlobalIsSet("image-credential-provider-bin-dir") {
+		pluginConfig := clx.GlobalString("image-credential-provider-config")
+		if err := plugin.ValidateConfig(pluginConfig, clx.GlobalString("image-credential-provider-bin-dir")); err != nil {
+			var verr *plugin.ValidationError
+			if !errors.As(err, &verr) {
+				return err
+			}
+			for _, problem := range verr.Problems {
+				fmt.Fprintln(clx.App.Writer, problem)
+			}
+			return fmt.Errorf("image credential provider configuration from %s is invalid", pluginConfig)
+		}
+		fmt.Fprintf(clx.App.Writer, "Image credential provider configuration from %s is valid\n", pluginConfig)
+	}
+	if clx.GlobalIsSet("image-policy") {
+		if _, err := loadImagePolicy(clx); err != nil {
+			return err
+		}
+		fmt.Fprintf(clx.App.Writer, "Image policy from %s is valid\n", clx.GlobalString("image-policy"))
+	}
+
+	registry, err := registries.GetPrivateRegistriesFromReader(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	options, err := referenceOptions(clx)
+	if err != nil {
+		return err
+	}
+	for _, image := range clx.Args() {
+		ref, err := name.ParseReference(image, options...)
+		if err != nil {
+			return err
+		}
+		endpoints, err := registry.Endpoints(ref)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(clx.App.Writer, "\n%s\n", ref.Name())
+		for _, endpoint := range endpoints {
+			from := "default endpoint"
+			if endpoint.Mirror != "" {
+				from = fmt.Sprintf("mirrors[%q]", endpoint.Mirror)
+			}
+			fmt.Fprintf(clx.App.Writer, "  %s (%s)\n", endpoint.URL, from)
+			fmt.Fprintf(clx.App.Writer, "    repository: %s\n", endpoint.Reference.Context().RepositoryStr())
+			fmt.Fprintf(clx.App.Writer, "    auth: %s\n", configEntry(endpoint.Auth))
+			fmt.Fprintf(clx.App.Writer, "    tls: %s\n", configEntry(endpoint.TLS))
+		}
+	}
+	return nil
+}
+
+// configEntry describes the configs entry with the key, for validate-config.
+func configEntry(key string) string {
+	if key == "" {
+		return "none"
+	}
+	return fmt.Sprintf("configs[%q]", key)
+}
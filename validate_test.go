@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli"
+)
+
+func TestValidateConfig(t *testing.T) {
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "ecr-credential-provider"), []byte{}, 0755); err != nil {
+		t.Fatalf("Failed to write plugin: %v", err)
+	}
+	pluginConfig := filepath.Join(t.TempDir(), "plugins.yaml")
+	testCases := map[string]struct {
+		config       string
+		file         string
+		pluginConfig string
+		images       []string
+		expected     string
+		err          string
+	}{
+		"empty": {
+			expected: "Private registry configuration from --registry-config-json is valid\n",
+		},
+		"default endpoint": {
+			images: []string{"busybox"},
+			expected: `Private registry configuration from --registry-config-json is valid
+
+index.docker.io/library/busybox:latest
+  https://index.docker.io/v2 (default endpoint)
+    repository: library/busybox
+    auth: none
+    tls: none
+`,
+		},
+		"mirror with rewrite and auth": {
+			config: `mirrors:
+  docker.io:
+    endpoint:
+      - https://mirror.example.com
+    rewrite:
+      "^rancher/(.*)": "mirrored-rancher/$1"
+configs:
+  mirror.example.com:
+    auth:
+      username: user
+      password: pass
+    tls:
+      insecure_skip_verify: true
+`,
+			images: []string{"rancher/rancher:v2.5.9", "busybox"},
+			expected: `Private registry configuration from --registry-config-json is valid
+
+index.docker.io/rancher/rancher:v2.5.9
+  https://mirror.example.com/v2 (mirrors["docker.io"])
+    repository: mirrored-rancher/rancher
+    auth: configs["mirror.example.com"]
+    tls: configs["mirror.example.com"]
+  https://index.docker.io/v2 (default endpoint)
+    repository: rancher/rancher
+    auth: none
+    tls: none
+
+index.docker.io/library/busybox:latest
+  https://mirror.example.com/v2 (mirrors["docker.io"])
+    repository: library/busybox
+    auth: configs["mirror.example.com"]
+    tls: configs["mirror.example.com"]
+  https://index.docker.io/v2 (default endpoint)
+    repository: library/busybox
+    auth: none
+    tls: none
+`,
+		},
+		"wildcard mirror and config": {
+			config: `mirrors:
+  "*":
+    endpoint:
+      - http://localhost:5000/v2/proxy
+    rewrite:
+      "/": "-"
+configs:
+  "*":
+    auth:
+      registry_token: token
+`,
+			images: []string{"registry.local/team1/images/test"},
+			expected: `Private registry configuration from --registry-config-json is valid
+
+registry.local/team1/images/test:latest
+  http://localhost:5000/v2/proxy (mirrors["*"])
+    repository: team1-images-test
+    auth: configs["*"]
+    tls: none
+  https://registry.local/v2 (default endpoint)
+    repository: team1/images/test
+    auth: configs["*"]
+    tls: none
+`,
+		},
+		"unknown field": {
+			config: "mirrors:\n  docker.io:\n    endpoints:\n      - https://mirror.example.com\n",
+			err:    "failed to parse private registry configuration from --registry-config-json: yaml: unmarshal errors:\n  line 3: field endpoints not found in type registries.Mirror",
+		},
+		"missing file": {
+			file: "missing.yaml",
+			err:  "failed to read private registry configuration: open missing.yaml: no such file or directory",
+		},
+		"invalid configuration": {
+			config: `mirrors:
+  docker.io:
+    endpoint:
+      - /v2
+    rewrite:
+      "(.*": "docker/$1"
+configs:
+  registry.example.com:
+    auth:
+      username: user
+`,
+			images: []string{"busybox"},
+			expected: `configs["registry.example.com"]: username and password must be given together
+mirrors["docker.io"]: invalid endpoint "/v2": invalid URL without host: ///v2
+mirrors["docker.io"]: invalid rewrite "(.*": error parsing regexp: missing closing ): ` + "`(.*`" + `
+`,
+			err: "private registry configuration from --registry-config-json is invalid",
+		},
+		"credential provider configuration": {
+			pluginConfig: `apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: ecr-credential-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.dkr.ecr.*.amazonaws.com"]
+  defaultCacheDuration: 12h
+`,
+			expected: "Private registry configuration from --registry-config-json is valid\nImage credential provider configuration from " + pluginConfig + " is valid\n",
+		},
+		"invalid credential provider configuration": {
+			pluginConfig: `apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: ecr-credential-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.dkr.ecr.*.amazonaws.com"]
+  defaultCacheDuration: 12h
+- name: acr-credential-provider
+  apiVersion: credentialprovider.kubelet.k8s.io/v2
+  matchImages: ["*.azurecr.io"]
+  defaultCacheDuration: 10m
+`,
+			expected: `Private registry configuration from --registry-config-json is valid
+providers["acr-credential-provider"]: unsupported apiVersion "credentialprovider.kubelet.k8s.io/v2", supported values: credentialprovider.kubelet.k8s.io/v1, credentialprovider.kubelet.k8s.io/v1alpha1, credentialprovider.kubelet.k8s.io/v1beta1
+providers["acr-credential-provider"]: plugin binary ` + filepath.Join(binDir, "acr-credential-provider") + ` does not exist
+`,
+			err: "image credential provider configuration from " + pluginConfig + " is invalid",
+		},
+	}
+
+	for testName, tc := range testCases {
+		t.Run(testName, func(t *testing.T) {
+			set := flag.NewFlagSet("test", flag.ContinueOnError)
+			set.String("private-registry", "", "")
+			set.String("registry-config-json", "", "")
+			set.String("image-credential-provider-config", "", "")
+			set.String("image-credential-provider-bin-dir", "", "")
+			args := []string{"--registry-config-json", tc.config}
+			if tc.file != "" {
+				args = []string{"--private-registry", tc.file}
+			}
+			if tc.pluginConfig != "" {
+				if err := os.WriteFile(pluginConfig, []byte(tc.pluginConfig), 0644); err != nil {
+					t.Fatalf("Failed to write credential provider config: %v", err)
+				}
+				args = append(args, "--image-credential-provider-config", pluginConfig, "--image-credential-provider-bin-dir", binDir)
+			}
+			args = append(args, tc.images...)
+			if err := set.Parse(args); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			output := &bytes.Buffer{}
+			app := cli.NewApp()
+			app.Writer = output
+
+			err := validateConfig(cli.NewContext(app, set, nil))
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Errorf("Expected error %q but got %v", tc.err, err)
+				}
+			} else if err != nil {
+				t.Fatalf("Failed to validate config: %v", err)
+			}
+			if output.String() != tc.expected {
+				t.Errorf("Expected output:\n%s\nbut got:\n%s", tc.expected, output)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/urfave/cli"
+)
+
+// The version, git commit, and build date are set by the release build with -ldflags "-X main.version=...". When
+// they are not set, they are taken from the build information embedded by the go toolchain, where available.
+var (
+	version   = "v0.0.0"
+	gitCommit = ""
+	buildDate = ""
+)
+
+// versionModules are the dependencies whose versions are reported, as they determine how registries and credential
+// provider plugins are accessed.
+var versionModules = []string{
+	"github.com/google/go-containerregistry",
+	"k8s.io/kubernetes",
+	"k8s.io/kubelet",
+}
+
+// buildInfo describes the wharfie binary.
+type buildInfo struct {
+	Version   string            `json:"version"`
+	GitCommit string            `json:"gitCommit"`
+	BuildDate string            `json:"buildDate"`
+	GoVersion string            `json:"goVersion"`
+	Platform  string            `json:"platform"`
+	Modules   map[string]string `json:"modules"`
+}
+
+// getBuildInfo returns the version of the binary, and of the modules it was built with. Values set by ldflags take
+// precedence over the build information embedded by the go toolchain. The versions of replaced modules are the
+// versions of their replacements.
+func getBuildInfo() buildInfo {
+	info := buildInfo{
+		Version:   version,
+		GitCommit: gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Modules:   map[string]string{},
+	}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "v0.0.0" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		info.Version = bi.Main.Version
+	}
+	var modified bool
+	for _, setting := range bi.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.GitCommit == "" {
+				info.GitCommit = setting.Value
+			}
+		case "vcs.time":
+			if info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if modified && gitCommit == "" && info.GitCommit != "" {
+		info.GitCommit += "-dirty"
+	}
+	for _, dep := range bi.Deps {
+		for _, path := range versionModules {
+			if dep.Path != path {
+				continue
+			}
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			info.Modules[path] = dep.Version
+		}
+	}
+	return info
+}
+
+// userAgent returns the User-Agent sent to registries, which is prefixed to the go-containerregistry User-Agent.
+func userAgent() string {
+	return "wharfie/" + getBuildInfo().Version
+}
+
+// writeBuildInfo writes the build information as text, with unknown values shown as "unknown".
+func writeBuildInfo(w io.Writer, info buildInfo) {
+	orUnknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	fmt.Fprintf(w, "Version:    %s\n", info.Version)
+	fmt.Fprintf(w, "Git commit: %s\n", orUnknown(info.GitCommit))
+	fmt.Fprintf(w, "Build date: %s\n", orUnknown(info.BuildDate))
+	fmt.Fprintf(w, "Go version: %s\n", info.GoVersion)
+	fmt.Fprintf(w, "Platform:   %s\n", info.Platform)
+	for _, path := range versionModules {
+		fmt.Fprintf(w, "%s %s\n", path, orUnknown(info.Modules[path]))
+	}
+}
+
+// printVersion prints the build information for --version.
+func printVersion(clx *cli.Context) {
+	writeBuildInfo(clx.App.Writer, getBuildInfo())
+}
+
+// showVersion prints the build information, as text or JSON.
+func showVersion(clx *cli.Context) error {
+	output := clx.String("output")
+	if output != "text" && output != "json" {
+		return fmt.Errorf("unsupported output format %q; supported formats: text, json", output)
+	}
+
+	info := getBuildInfo()
+	if output == "json" {
+		encoder := json.NewEncoder(clx.App.Writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(info)
+	}
+	writeBuildInfo(clx.App.Writer, info)
+	return nil
+}
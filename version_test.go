@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+func TestVersion(t *testing.T) {
+	run := func(args ...string) string {
+		app := newApp(context.Background())
+		output := &bytes.Buffer{}
+		app.Writer = output
+		if err := app.Run(append([]string{"wharfie"}, args...)); err != nil {
+			t.Fatalf("Failed to run %v: %v", args, err)
+		}
+		return output.String()
+	}
+
+	// values set by ldflags take precedence over the embedded build information
+	defer func(v, c, d string) { version, gitCommit, buildDate = v, c, d }(version, gitCommit, buildDate)
+	version, gitCommit, buildDate = "v1.2.3", "abc1234", "2024-01-02T03:04:05Z"
+
+	output := run("version", "--output", "json")
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(output), &fields); err != nil {
+		t.Fatalf("Failed to parse version output: %v\n%s", err, output)
+	}
+	keys := []string{}
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	expectedKeys := []string{"buildDate", "gitCommit", "goVersion", "modules", "platform", "version"}
+	if strings.Join(keys, ",") != strings.Join(expectedKeys, ",") {
+		t.Errorf("Expected version fields %v but got %v", expectedKeys, keys)
+	}
+
+	var info buildInfo
+	if err := json.Unmarshal([]byte(output), &info); err != nil {
+		t.Fatalf("Failed to parse version output: %v\n%s", err, output)
+	}
+	if info.Version != "v1.2.3" || info.GitCommit != "abc1234" || info.BuildDate != "2024-01-02T03:04:05Z" {
+		t.Errorf("Expected ldflag values to be reported but got %+v", info)
+	}
+	if info.GoVersion == "" || info.Platform == "" {
+		t.Errorf("Expected go version and platform to be reported but got %+v", info)
+	}
+	if info.Modules["github.com/google/go-containerregistry"] == "" {
+		t.Errorf("Expected go-containerregistry version to be reported but got %v", info.Modules)
+	}
+
+	// --version prints the same build information as the text output of the version command
+	text := run("version")
+	if versionFlag := run("--version"); versionFlag != text {
+		t.Errorf("Expected --version output\n%s\nto match version command output\n%s", versionFlag, text)
+	}
+	for _, expected := range []string{"Version:    v1.2.3\n", "Git commit: abc1234\n", "github.com/google/go-containerregistry v"} {
+		if !strings.Contains(text, expected) {
+			t.Errorf("Expected version output to contain %q but got\n%s", expected, text)
+		}
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	defer func(v string) { version = v }(version)
+	version = "v1.2.3"
+
+	var mu sync.Mutex
+	agents := map[string]bool{}
+	handler := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		agents[r.UserAgent()] = true
+		mu.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	ref, _ := name.ParseReference(u.Host + "/test/agent:latest")
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("Failed to push image: %v", err)
+	}
+	mu.Lock()
+	agents = map[string]bool{}
+	mu.Unlock()
+
+	app := newApp(context.Background())
+	app.Writer = &bytes.Buffer{}
+	config := filepath.Join(t.TempDir(), "registries.yaml")
+	if err := app.Run([]string{"wharfie", "--private-registry", config, "pull", ref.Name()}); err != nil {
+		t.Fatalf("Failed to pull image: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(agents) == 0 {
+		t.Fatalf("Expected requests to be made to the registry")
+	}
+	for agent := range agents {
+		if !strings.HasPrefix(agent, "wharfie/v1.2.3 ") {
+			t.Errorf("Expected User-Agent to start with wharfie/v1.2.3 but got %q", agent)
+		}
+	}
+}